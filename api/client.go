@@ -24,6 +24,8 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
@@ -42,7 +44,7 @@ func checkError(resp *http.Response, body []byte) error {
 		return nil
 	}
 
-	apiError := StatusError{StatusCode: resp.StatusCode}
+	apiError := StatusError{StatusCode: resp.StatusCode, RetryAfter: retryAfter(resp)}
 
 	err := json.Unmarshal(body, &apiError)
 	if err != nil {
@@ -53,6 +55,17 @@ func checkError(resp *http.Response, body []byte) error {
 	return apiError
 }
 
+// retryAfter returns the delay in seconds of the Retry-After header of resp,
+// or 0 if it doesn't have one
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
 // ClientFromEnvironment creates a new [Client] using configuration from the
 // environment variable OLLAMA_HOST, which points to the network host and
 // port on which the ollama service is listening. The format of this variable
@@ -173,6 +186,17 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 		}
 
 		if errorResponse.Error != "" {
+			// requests refused as the queue is full keep the status and
+			// when to retry, so that callers can back off
+			if response.StatusCode == http.StatusTooManyRequests {
+				return StatusError{
+					StatusCode:   response.StatusCode,
+					Status:       response.Status,
+					ErrorMessage: errorResponse.Error,
+					RetryAfter:   retryAfter(response),
+				}
+			}
+
 			return errors.New(errorResponse.Error)
 		}
 
@@ -194,12 +218,17 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 
 // GenerateResponseFunc is a function that [Client.Generate] invokes every time
 // a response is received from the service. If this function returns an error,
-// [Client.Generate] will stop generating and return this error.
+// [Client.Generate] will stop generating and return this error. If the request
+// has to wait for the model, it is first invoked with a response that only
+// has Queued set.
 type GenerateResponseFunc func(GenerateResponse) error
 
 // Generate generates a response for a given prompt. The req parameter should
 // be populated with prompt details. fn is called for each response (there may
 // be multiple responses, e.g. in case streaming is enabled).
+//
+// If the queue of the server is full, the request is refused with a
+// [StatusError] with StatusCode 429 and RetryAfter set to when to retry.
 func (c *Client) Generate(ctx context.Context, req *GenerateRequest, fn GenerateResponseFunc) error {
 	return c.stream(ctx, http.MethodPost, "/api/generate", req, func(bts []byte) error {
 		var resp GenerateResponse
@@ -213,13 +242,18 @@ func (c *Client) Generate(ctx context.Context, req *GenerateRequest, fn Generate
 
 // ChatResponseFunc is a function that [Client.Chat] invokes every time
 // a response is received from the service. If this function returns an error,
-// [Client.Chat] will stop generating and return this error.
+// [Client.Chat] will stop generating and return this error. If the request
+// has to wait for the model, it is first invoked with a response that only
+// has Queued set.
 type ChatResponseFunc func(ChatResponse) error
 
 // Chat generates the next message in a chat. [ChatRequest] may contain a
 // sequence of messages which can be used to maintain chat history with a model.
 // fn is called for each response (there may be multiple responses, e.g. if case
 // streaming is enabled).
+//
+// If the queue of the server is full, the request is refused with a
+// [StatusError] with StatusCode 429 and RetryAfter set to when to retry.
 func (c *Client) Chat(ctx context.Context, req *ChatRequest, fn ChatResponseFunc) error {
 	return c.stream(ctx, http.MethodPost, "/api/chat", req, func(bts []byte) error {
 		var resp ChatResponse
@@ -316,6 +350,14 @@ func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	return nil
 }
 
+// CancelGenerate cancels the generate request with id while it is in
+// progress, which then ends with a done reason of "cancel". This is for
+// clients that can't cancel a request by closing its connection, such as
+// behind a proxy that buffers responses.
+func (c *Client) CancelGenerate(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/generate/"+url.PathEscape(id), nil, nil)
+}
+
 // Delete deletes a model and its data.
 func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	if err := c.do(ctx, http.MethodDelete, "/api/delete", req, nil); err != nil {
@@ -351,6 +393,58 @@ func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse,
 	return &resp, nil
 }
 
+// Rerank scores documents by their relevance to a query with a reranker
+// model, returning them from the most to the least relevant.
+func (c *Client) Rerank(ctx context.Context, req *RerankRequest) (*RerankResponse, error) {
+	var resp RerankResponse
+	if err := c.do(ctx, http.MethodPost, "/api/rerank", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SaveSession saves the KV cache of a prompt that a model has processed, so
+// that it can be loaded with [Client.LoadSession] instead of processing the
+// prompt again, such as after the model has been unloaded.
+func (c *Client) SaveSession(ctx context.Context, req *SessionRequest) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.do(ctx, http.MethodPost, "/api/session/save", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// LoadSession loads a session saved by [Client.SaveSession] into the KV cache
+// of the model it was saved by. Requests whose prompts start with the prompt
+// of the session continue from it.
+func (c *Client) LoadSession(ctx context.Context, req *SessionRequest) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.do(ctx, http.MethodPost, "/api/session/load", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Tokenize converts text to the token ids of a model with its tokenizer,
+// such as to count the tokens of a prompt.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Detokenize converts the token ids of a model back to text. This is the
+// reverse of [Client.Tokenize].
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Embeddings generates an embedding from a model.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
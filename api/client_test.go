@@ -3,12 +3,14 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestClientFromEnvironment(t *testing.T) {
@@ -253,3 +255,36 @@ func TestClientDo(t *testing.T) {
 		})
 	}
 }
+
+func TestClientTooManyRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "20")
+		w.WriteHeader(http.StatusTooManyRequests)
+		if err := json.NewEncoder(w).Encode(map[string]string{"error": "server busy, please try again.  maximum pending requests exceeded"}); err != nil {
+			t.Fatal("failed to encode error response:", err)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient(&url.URL{Scheme: "http", Host: ts.Listener.Addr().String()}, http.DefaultClient)
+
+	for name, fn := range map[string]func() error{
+		"do": func() error {
+			return client.do(context.Background(), http.MethodPost, "/api/generate", nil, nil)
+		},
+		"stream": func() error {
+			return client.stream(context.Background(), http.MethodPost, "/api/generate", nil, func([]byte) error { return nil })
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var serr StatusError
+			if err := fn(); !errors.As(err, &serr) {
+				t.Fatalf("expected a StatusError, got %v", err)
+			}
+
+			if serr.StatusCode != http.StatusTooManyRequests || serr.RetryAfter != 20*time.Second {
+				t.Errorf("got status %d retrying after %v, want %d after %v", serr.StatusCode, serr.RetryAfter, http.StatusTooManyRequests, 20*time.Second)
+			}
+		})
+	}
+}
@@ -19,6 +19,10 @@ type StatusError struct {
 	StatusCode   int
 	Status       string
 	ErrorMessage string `json:"error"`
+
+	// RetryAfter is how long to wait before retrying a request that was
+	// refused with 429 Too Many Requests as the queue of the server is full
+	RetryAfter time.Duration `json:"-"`
 }
 
 func (e StatusError) Error() string {
@@ -71,10 +75,19 @@ type GenerateRequest struct {
 	// Format specifies the format to return a response in.
 	Format json.RawMessage `json:"format,omitempty"`
 
+	// Grammar is a GBNF grammar that the response must match, which
+	// overrides that of the model. It can't be used with Format.
+	Grammar string `json:"grammar,omitempty"`
+
 	// KeepAlive controls how long the model will stay loaded in memory following
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority orders this request among those waiting for the model: "low",
+	// "normal" (the default) or "high". Requests of high priority may preempt
+	// generation of those of lower priority.
+	Priority string `json:"priority,omitempty"`
+
 	// Images is an optional list of base64-encoded images accompanying this
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
@@ -82,6 +95,11 @@ type GenerateRequest struct {
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]interface{} `json:"options"`
+
+	// ID identifies the request while it is in progress, so that it can be
+	// canceled with [Client.CancelGenerate]. A random ID is used if it is
+	// empty, which is returned in the responses.
+	ID string `json:"id,omitempty"`
 }
 
 // ChatRequest describes a request sent by [Client.Chat].
@@ -98,10 +116,18 @@ type ChatRequest struct {
 	// Format is the format to return the response in (e.g. "json").
 	Format json.RawMessage `json:"format,omitempty"`
 
+	// Grammar is a GBNF grammar as in [GenerateRequest].
+	Grammar string `json:"grammar,omitempty"`
+
 	// KeepAlive controls how long the model will stay loaded into memory
 	// following the request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority orders this request among those waiting for the model: "low",
+	// "normal" (the default) or "high". Requests of high priority may preempt
+	// generation of those of lower priority.
+	Priority string `json:"priority,omitempty"`
+
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
@@ -129,6 +155,11 @@ type Message struct {
 	Content   string      `json:"content"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+
+	// ToolCallDeltas are the parts of tool calls generated since the
+	// previous response of a streamed chat. Each call is also in ToolCalls
+	// of the response where it's complete.
+	ToolCallDeltas []ToolCallDelta `json:"tool_call_deltas,omitempty"`
 }
 
 func (m *Message) UnmarshalJSON(b []byte) error {
@@ -155,6 +186,15 @@ type ToolCallFunction struct {
 
 type ToolCallFunctionArguments map[string]any
 
+// ToolCallDelta is part of a tool call as it's streamed. The first delta of
+// each call has its name, and the arguments of its deltas are fragments of
+// the JSON of its arguments.
+type ToolCallDelta struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
 func (t *ToolCallFunctionArguments) String() string {
 	bts, _ := json.Marshal(t)
 	return string(bts)
@@ -192,11 +232,32 @@ type ChatResponse struct {
 	Message    Message   `json:"message"`
 	DoneReason string    `json:"done_reason,omitempty"`
 
+	// Logprobs are those of the tokens of Message if the logprobs option is
+	// set.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Done bool `json:"done"`
 
+	// Queued is set on a response sent before generation begins if the
+	// request has to wait for the model
+	Queued *QueueStatus `json:"queued,omitempty"`
+
 	Metrics
 }
 
+// TokenLogprob is the log probability of a token.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// Logprob is the log probability of a generated token with those of the most
+// likely tokens in its place, if top_logprobs is set, from the most likely.
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -204,6 +265,15 @@ type Metrics struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// PromptCacheCount is the number of tokens of the prompt that were
+	// already in the cache, which aren't in PromptEvalCount
+	PromptCacheCount int `json:"prompt_cache_count,omitempty"`
+
+	// DraftCount is the number of tokens proposed by the draft model of
+	// speculative decoding, of which DraftAcceptedCount were generated
+	DraftCount         int `json:"draft_count,omitempty"`
+	DraftAcceptedCount int `json:"draft_accepted_count,omitempty"`
 }
 
 // Options specified in [GenerateRequest].  If you add a new option here, also
@@ -213,6 +283,7 @@ type Options struct {
 
 	// Predict options used at runtime
 	NumKeep          int      `json:"num_keep,omitempty"`
+	ContextShift     bool     `json:"context_shift,omitempty"`
 	Seed             int      `json:"seed,omitempty"`
 	NumPredict       int      `json:"num_predict,omitempty"`
 	TopK             int      `json:"top_k,omitempty"`
@@ -228,6 +299,53 @@ type Options struct {
 	MirostatTau      float32  `json:"mirostat_tau,omitempty"`
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+	Grammar          string   `json:"grammar,omitempty"`
+
+	// DRY ("don't repeat yourself") penalizes tokens that would extend a
+	// sequence of at least DRYAllowedLength tokens that is repeated within
+	// the last DRYPenaltyLastN tokens (-1 for the context length) by
+	// DRYMultiplier * DRYBase ^ (length - DRYAllowedLength). Repeated
+	// sequences don't extend across tokens that contain any of
+	// DRYSequenceBreakers. A DRYMultiplier of 0 disables it.
+	DRYMultiplier       float32  `json:"dry_multiplier,omitempty"`
+	DRYBase             float32  `json:"dry_base,omitempty"`
+	DRYAllowedLength    int      `json:"dry_allowed_length,omitempty"`
+	DRYPenaltyLastN     int      `json:"dry_penalty_last_n,omitempty"`
+	DRYSequenceBreakers []string `json:"dry_sequence_breakers,omitempty"`
+
+	// LogitBias adds biases to the logits of tokens before sampling, by token
+	// id or by text that is a single token of the model. A bias of -100 or
+	// less bans a token, and one of 100 or more restricts sampling to the
+	// tokens with such a bias.
+	LogitBias map[string]float32 `json:"logit_bias,omitempty"`
+
+	// Logprobs returns the log probability of each generated token, with
+	// those of the TopLogprobs most likely tokens. They are computed after
+	// logit_bias, the repetition penalties and any format or grammar, and
+	// after the temperature only if LogprobsTemperature is set.
+	Logprobs            bool `json:"logprobs,omitempty"`
+	TopLogprobs         int  `json:"top_logprobs,omitempty"`
+	LogprobsTemperature bool `json:"logprobs_temperature,omitempty"`
+
+	// NumBeams decodes with beam search of this many beams instead of
+	// sampling, which returns the completion with the highest log probability
+	// per token. The other sampling options are ignored and the completion
+	// is returned at once rather than streamed. ReturnSequences also returns
+	// up to this many of the best completions in Sequences.
+	NumBeams        int `json:"num_beams,omitempty"`
+	ReturnSequences int `json:"return_sequences,omitempty"`
+
+	// NumDraft is the number of tokens that the draft model of a model with
+	// one proposes for the model to verify at once with speculative decoding.
+	// 0 disables speculative decoding.
+	NumDraft int `json:"num_draft,omitempty"`
+
+	// Pooling overrides how embedding models pool the hidden states of an
+	// input into its embedding: "mean" averages them, "cls" takes the first
+	// and "last" the last. By default, the pooling type of the model is
+	// used. Normalize scales embeddings to unit length, which is the default.
+	Pooling   string `json:"pooling,omitempty"`
+	Normalize *bool  `json:"normalize,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -243,6 +361,10 @@ type Runner struct {
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	UseMLock  bool  `json:"use_mlock,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
+
+	// TensorPlacement places weights on the CPU or GPU by name, such as
+	// "experts=cpu", with the new engine. See ml.ParseTensorPlacement.
+	TensorPlacement string `json:"tensor_placement,omitempty"`
 }
 
 // EmbedRequest is the request passed to [Client.Embed].
@@ -257,6 +379,11 @@ type EmbedRequest struct {
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Priority orders this request among those waiting for the model: "low",
+	// "normal" (the default) or "high". Requests of high priority may preempt
+	// generation of those of lower priority.
+	Priority string `json:"priority,omitempty"`
+
 	Truncate *bool `json:"truncate,omitempty"`
 
 	// Options lists model-specific options.
@@ -294,6 +421,148 @@ type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// RerankRequest is the request passed to [Client.Rerank].
+type RerankRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Query is the query to rank the documents against.
+	Query string `json:"query"`
+
+	// Documents are the documents to rank.
+	Documents []string `json:"documents"`
+
+	// TopN is the number of results to return. If 0, all documents are
+	// returned.
+	TopN int `json:"top_n,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// RerankResult is the relevance of a document in a [RerankResponse].
+type RerankResult struct {
+	// Index is the index of the document in the request.
+	Index int `json:"index"`
+
+	// Document is the document text.
+	Document string `json:"document"`
+
+	// RelevanceScore is the score of the model's classification head for
+	// the query and document.
+	RelevanceScore float32 `json:"relevance_score"`
+}
+
+// RerankResponse is the response from [Client.Rerank].
+type RerankResponse struct {
+	Model string `json:"model"`
+
+	// Results are sorted by descending relevance.
+	Results []RerankResult `json:"results"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+}
+
+// SessionRequest is the request passed to [Client.SaveSession] and
+// [Client.LoadSession].
+type SessionRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Session is the name of the session, which may only contain letters,
+	// digits, '_', '-' and '.', and doesn't start with '.'.
+	Session string `json:"session"`
+
+	// Prompt, when saving, selects the longest cached prefix of the prompt
+	// to save, as it was sent to the model after its template was applied.
+	// If empty, everything cached for the last request is saved.
+	Prompt string `json:"prompt,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// SessionResponse is the response from [Client.SaveSession] and
+// [Client.LoadSession].
+type SessionResponse struct {
+	Model   string `json:"model"`
+	Session string `json:"session"`
+
+	// Tokens is the number of tokens that were saved or loaded.
+	Tokens int `json:"tokens"`
+
+	TotalDuration time.Duration `json:"total_duration,omitempty"`
+	LoadDuration  time.Duration `json:"load_duration,omitempty"`
+}
+
+// TokenizeRequest is the request passed to [Client.Tokenize].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Content is the text to tokenize. Special tokens in it, such as
+	// those of the template, are tokenized as special tokens.
+	Content string `json:"content"`
+
+	// AddSpecial adds the special tokens that the model adds to the start
+	// of a prompt, such as BOS.
+	AddSpecial bool `json:"add_special,omitempty"`
+
+	// Pieces also returns the text of each token.
+	Pieces bool `json:"pieces,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+
+	// Pieces is the text of each token if requested. A token can be part
+	// of a UTF-8 character, such as a byte of a character that isn't in
+	// the vocabulary, so only the text of whole runs of tokens is valid
+	// UTF-8. Use [Client.Detokenize] to get their text.
+	Pieces []string `json:"pieces,omitempty"`
+}
+
+// DetokenizeRequest is the request passed to [Client.Detokenize].
+type DetokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Tokens are the token ids to convert to text.
+	Tokens []int `json:"tokens"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]interface{} `json:"options"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Model   string `json:"model"`
+	Content string `json:"content"`
+}
+
 // CreateRequest is the request passed to [Client.Create].
 type CreateRequest struct {
 	Model    string `json:"model"`
@@ -303,6 +572,7 @@ type CreateRequest struct {
 	From       string            `json:"from,omitempty"`
 	Files      map[string]string `json:"files,omitempty"`
 	Adapters   map[string]string `json:"adapters,omitempty"`
+	Draft      string            `json:"draft,omitempty"`
 	Template   string            `json:"template,omitempty"`
 	License    any               `json:"license,omitempty"`
 	System     string            `json:"system,omitempty"`
@@ -399,6 +669,10 @@ type ListResponse struct {
 // ProcessResponse is the response from [Client.Process].
 type ProcessResponse struct {
 	Models []ProcessModelResponse `json:"models"`
+
+	// Queued is the number of requests of each priority waiting for a model
+	// to be loaded
+	Queued map[string]int `json:"queued,omitempty"`
 }
 
 // ListModelResponse is a single model description in [ListResponse].
@@ -420,6 +694,10 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+
+	// Queued is the number of requests of each priority waiting for the
+	// model to serve them
+	Queued map[string]int `json:"queued,omitempty"`
 }
 
 type RetrieveModelResponse struct {
@@ -438,6 +716,9 @@ type GenerateResponse struct {
 	// Model is the model name that generated the response.
 	Model string `json:"model"`
 
+	// ID identifies the request, as in [GenerateRequest].
+	ID string `json:"id,omitempty"`
+
 	// CreatedAt is the timestamp of the response.
 	CreatedAt time.Time `json:"created_at"`
 
@@ -454,9 +735,39 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Logprobs are those of the tokens of Response if the logprobs option is
+	// set.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// Sequences are the best completions of beam search, from the best, if
+	// the return_sequences option is set
+	Sequences []BeamSequence `json:"sequences,omitempty"`
+
+	// Queued is set on a response sent before generation begins if the
+	// request has to wait for the model
+	Queued *QueueStatus `json:"queued,omitempty"`
+
 	Metrics
 }
 
+// QueueStatus is the place of a request waiting for a model.
+type QueueStatus struct {
+	// Position is the place of the request in the queue, from 1 for the
+	// next request to be served.
+	Position int `json:"position"`
+
+	// EstimatedStart is when the request is expected to be served, from the
+	// rate at which the server has generated tokens.
+	EstimatedStart time.Time `json:"estimated_start"`
+}
+
+// BeamSequence is a completion found by beam search, with the sum of the log
+// probabilities of its tokens
+type BeamSequence struct {
+	Response string  `json:"response"`
+	Logprob  float64 `json:"logprob"`
+}
+
 // ModelDetails provides details about a model.
 type ModelDetails struct {
 	ParentModel       string   `json:"parent_model"`
@@ -480,6 +791,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "prompt eval count:    %d token(s)\n", m.PromptEvalCount)
 	}
 
+	if m.PromptCacheCount > 0 {
+		fmt.Fprintf(os.Stderr, "prompt cache count:   %d token(s)\n", m.PromptCacheCount)
+	}
+
 	if m.PromptEvalDuration > 0 {
 		fmt.Fprintf(os.Stderr, "prompt eval duration: %s\n", m.PromptEvalDuration)
 		fmt.Fprintf(os.Stderr, "prompt eval rate:     %.2f tokens/s\n", float64(m.PromptEvalCount)/m.PromptEvalDuration.Seconds())
@@ -493,6 +808,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "eval duration:        %s\n", m.EvalDuration)
 		fmt.Fprintf(os.Stderr, "eval rate:            %.2f tokens/s\n", float64(m.EvalCount)/m.EvalDuration.Seconds())
 	}
+
+	if m.DraftCount > 0 {
+		fmt.Fprintf(os.Stderr, "draft acceptance:     %.2f%% (%d/%d token(s))\n", 100*float64(m.DraftAcceptedCount)/float64(m.DraftCount), m.DraftAcceptedCount, m.DraftCount)
+	}
 }
 
 func (opts *Options) FromMap(m map[string]interface{}) error {
@@ -567,6 +886,21 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 					slice[i] = str
 				}
 				field.Set(reflect.ValueOf(slice))
+			case reflect.Map:
+				// JSON unmarshals to map[string]interface{} of float64
+				val, ok := val.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+				m := make(map[string]float32, len(val))
+				for k, item := range val {
+					f, ok := item.(float64)
+					if !ok {
+						return fmt.Errorf("option %q must be an object of numbers", key)
+					}
+					m[k] = float32(f)
+				}
+				field.Set(reflect.ValueOf(m))
 			case reflect.Pointer:
 				var b bool
 				if field.Type() == reflect.TypeOf(&b) {
@@ -609,6 +943,15 @@ func DefaultOptions() Options {
 		MirostatEta:      0.1,
 		Seed:             -1,
 
+		// speculative decoding only applies to models with a draft model
+		NumDraft: 4,
+
+		// DRY is disabled unless a multiplier is set
+		DRYBase:             1.75,
+		DRYAllowedLength:    2,
+		DRYPenaltyLastN:     -1,
+		DRYSequenceBreakers: []string{"\n", ":", "\"", "*"},
+
 		Runner: Runner{
 			// options set when the model is loaded
 			NumCtx:    int(envconfig.ContextLength()),
@@ -145,6 +145,20 @@ func TestUseMmapParsingFromJSON(t *testing.T) {
 	}
 }
 
+func TestLogitBiasParsingFromJSON(t *testing.T) {
+	var oMap map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"logit_bias": {"1234": -100, "yes": 5.5}}`), &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[string]float32{"1234": -100, "yes": 5.5}, opts.LogitBias)
+
+	for _, req := range []string{`{"logit_bias": [1]}`, `{"logit_bias": {"1": "x"}}`} {
+		require.NoError(t, json.Unmarshal([]byte(req), &oMap))
+		assert.Error(t, opts.FromMap(oMap), req)
+	}
+}
+
 func TestUseMmapFormatParams(t *testing.T) {
 	tr := true
 	fa := false
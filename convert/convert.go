@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"slices"
 	"strings"
 
 	"github.com/ollama/ollama/fs/ggml"
@@ -232,5 +233,11 @@ func ConvertModel(fsys fs.FS, ws io.WriteSeeker) error {
 		return err
 	}
 
-	return conv.writeFile(ws, conv.KV(t), conv.Tensors(ts))
+	kv := conv.KV(t)
+	if slices.ContainsFunc(ts, func(t Tensor) bool { return t.Kind() == tensorKindQ8_0 }) {
+		// FP8 weights are stored as Q8_0
+		kv["general.file_type"] = uint32(7)
+	}
+
+	return conv.writeFile(ws, kv, conv.Tensors(ts))
 }
@@ -32,6 +32,8 @@ func (t tensorBase) Shape() []uint64 {
 const (
 	tensorKindF32 uint32 = iota
 	tensorKindF16
+
+	tensorKindQ8_0 uint32 = 8
 )
 
 func (t tensorBase) Kind() uint32 {
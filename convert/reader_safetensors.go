@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"slices"
 	"strings"
 
@@ -24,6 +25,13 @@ type safetensorMetadata struct {
 
 func parseSafetensors(fsys fs.FS, replacer *strings.Replacer, ps ...string) ([]Tensor, error) {
 	var ts []Tensor
+
+	// weights are the indices in ts of each tensor by its name in the
+	// checkpoint, to which scales by the same name are attached. Scales may
+	// be in a different file than their weights.
+	weights := make(map[string]int)
+	scales := make(map[string]safetensor)
+
 	for _, p := range ps {
 		f, err := fsys.Open(p)
 		if err != nil {
@@ -53,6 +61,22 @@ func parseSafetensors(fsys fs.FS, replacer *strings.Replacer, ps ...string) ([]T
 
 		for _, key := range keys {
 			if value := headers[key]; value.Type != "" {
+				// scales of FP8 weights are applied when the weights are
+				// written and activation scales are unused
+				if strings.HasSuffix(key, ".weight_scale_inv") || strings.HasSuffix(key, ".weight_scale") {
+					scales[key] = safetensor{
+						fs:         fsys,
+						path:       p,
+						dtype:      value.Type,
+						offset:     safetensorsPad(n, value.Offsets[0]),
+						size:       safetensorsPad(n, value.Offsets[1]) - safetensorsPad(n, value.Offsets[0]),
+						tensorBase: &tensorBase{name: key, shape: value.Shape},
+					}
+					continue
+				} else if strings.HasSuffix(key, ".input_scale") {
+					continue
+				}
+
 				// bitsandbytes quantized models are unsupported
 				if len(value.Shape) == 0 {
 					return nil, errors.New("unsupported safetensors model")
@@ -62,6 +86,7 @@ func parseSafetensors(fsys fs.FS, replacer *strings.Replacer, ps ...string) ([]T
 					return nil, fmt.Errorf("duplicate tensor name '%s' was found for this model", ggufName)
 				}
 				names[ggufName] = struct{}{}
+				weights[key] = len(ts)
 				ts = append(ts, safetensor{
 					fs:     fsys,
 					path:   p,
@@ -77,6 +102,22 @@ func parseSafetensors(fsys fs.FS, replacer *strings.Replacer, ps ...string) ([]T
 		}
 	}
 
+	for key, scale := range scales {
+		name := strings.TrimSuffix(strings.TrimSuffix(key, "_inv"), "_scale")
+		i, ok := weights[name]
+		if !ok {
+			return nil, fmt.Errorf("scale '%s' has no weight", key)
+		}
+
+		st := ts[i].(safetensor)
+		if !strings.HasPrefix(st.dtype, "F8_") {
+			return nil, fmt.Errorf("scale '%s' of non-FP8 weight with data type %s", key, st.dtype)
+		}
+
+		st.scale = &scale
+		ts[i] = st
+	}
+
 	return ts, nil
 }
 
@@ -91,23 +132,72 @@ type safetensor struct {
 	dtype  string
 	offset int64
 	size   int64
+
+	// scale, if non-nil, multiplies the blocks of an FP8 weight. Its shape
+	// divides that of the weight into blocks of equal size.
+	scale *safetensor
+
 	*tensorBase
 }
 
+// Kind stores FP8 weights as Q8_0, which takes about half the space of F16.
+// ggml has no FP8 types so the weights are dequantized first, which is exact,
+// and then quantized in blocks of 32 along rows.
+func (st safetensor) Kind() uint32 {
+	kind := st.tensorBase.Kind()
+	if kind == tensorKindF16 && strings.HasPrefix(st.dtype, "F8_") && st.shape[len(st.shape)-1]%32 == 0 {
+		return tensorKindQ8_0
+	}
+
+	return kind
+}
+
 func (st safetensor) WriteTo(w io.Writer) (int64, error) {
-	f, err := st.fs.Open(st.path)
+	f32s, err := st.floats()
 	if err != nil {
 		return 0, err
 	}
+
+	if st.repacker != nil {
+		f32s, err = st.repacker(st.Name(), f32s, st.Shape())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	switch st.Kind() {
+	case tensorKindF32:
+		return 0, binary.Write(w, binary.LittleEndian, f32s)
+	case tensorKindF16:
+		f16s := make([]uint16, len(f32s))
+		for i := range f32s {
+			f16s[i] = float16.Fromfloat32(f32s[i]).Bits()
+		}
+
+		return 0, binary.Write(w, binary.LittleEndian, f16s)
+	case tensorKindQ8_0:
+		_, err := w.Write(quantizeQ8_0(f32s))
+		return 0, err
+	default:
+		return 0, fmt.Errorf("unknown storage type: %d", st.Kind())
+	}
+}
+
+// floats reads the tensor as float32, applying its scale if any
+func (st safetensor) floats() ([]float32, error) {
+	f, err := st.fs.Open(st.path)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 
 	if seeker, ok := f.(io.Seeker); ok {
 		if _, err := seeker.Seek(st.offset, io.SeekStart); err != nil {
-			return 0, err
+			return nil, err
 		}
 	} else {
 		if _, err := io.CopyN(io.Discard, f, st.offset); err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
 
@@ -116,12 +206,12 @@ func (st safetensor) WriteTo(w io.Writer) (int64, error) {
 	case "F32":
 		f32s = make([]float32, st.size/4)
 		if err = binary.Read(f, binary.LittleEndian, f32s); err != nil {
-			return 0, err
+			return nil, err
 		}
 	case "F16":
 		u16s := make([]uint16, st.size/2)
 		if err = binary.Read(f, binary.LittleEndian, u16s); err != nil {
-			return 0, err
+			return nil, err
 		}
 
 		f32s = make([]float32, len(u16s))
@@ -132,32 +222,127 @@ func (st safetensor) WriteTo(w io.Writer) (int64, error) {
 	case "BF16":
 		u8s := make([]uint8, st.size)
 		if err = binary.Read(f, binary.LittleEndian, u8s); err != nil {
-			return 0, err
+			return nil, err
 		}
 
 		f32s = bfloat16.DecodeFloat32(u8s)
+	case "F8_E4M3", "F8_E5M2":
+		u8s := make([]uint8, st.size)
+		if _, err = io.ReadFull(f, u8s); err != nil {
+			return nil, err
+		}
+
+		lut := &fp8E4M3
+		if st.dtype == "F8_E5M2" {
+			lut = &fp8E5M2
+		}
+
+		f32s = make([]float32, len(u8s))
+		for i, b := range u8s {
+			f32s[i] = lut[b]
+		}
 	default:
-		return 0, fmt.Errorf("unknown data type: %s", st.dtype)
+		return nil, fmt.Errorf("unknown data type: %s", st.dtype)
 	}
 
-	if st.repacker != nil {
-		f32s, err = st.repacker(st.Name(), f32s, st.Shape())
-		if err != nil {
-			return 0, err
+	if st.scale != nil {
+		if err := st.applyScale(f32s); err != nil {
+			return nil, err
 		}
 	}
 
-	switch st.Kind() {
-	case tensorKindF32:
-		return 0, binary.Write(w, binary.LittleEndian, f32s)
-	case tensorKindF16:
-		f16s := make([]uint16, len(f32s))
-		for i := range f32s {
-			f16s[i] = float16.Fromfloat32(f32s[i]).Bits()
+	return f32s, nil
+}
+
+// applyScale multiplies each block of f32s, with the shape of st, by its
+// scale. Weights and scales are treated as matrices of rows of the last
+// dimension, so a scale may be per-tensor, per-row or per 2D block, such as
+// the 128x128 blocks of DeepSeek-V3.
+func (st safetensor) applyScale(f32s []float32) error {
+	scales, err := st.scale.floats()
+	if err != nil {
+		return err
+	}
+
+	matrix := func(shape []uint64) (rows, cols int) {
+		rows, cols = 1, 1
+		for i, d := range shape {
+			if i == len(shape)-1 && len(shape) > 1 {
+				cols = int(d)
+			} else {
+				rows *= int(d)
+			}
 		}
+		return rows, cols
+	}
 
-		return 0, binary.Write(w, binary.LittleEndian, f16s)
-	default:
-		return 0, fmt.Errorf("unknown storage type: %d", st.Kind())
+	rows, cols := matrix(st.shape)
+	scaleRows, scaleCols := matrix(st.scale.shape)
+	if len(scales) != scaleRows*scaleCols || scaleRows == 0 || scaleCols == 0 || scaleRows > rows || scaleCols > cols {
+		return fmt.Errorf("invalid shape %v of scale '%s' for weight with shape %v", st.scale.shape, st.scale.name, st.shape)
+	}
+
+	blockRows, blockCols := (rows+scaleRows-1)/scaleRows, (cols+scaleCols-1)/scaleCols
+	for i := range rows {
+		for j := range cols {
+			f32s[i*cols+j] *= scales[i/blockRows*scaleCols+j/blockCols]
+		}
+	}
+
+	return nil
+}
+
+// fp8E4M3 and fp8E5M2 are the values of each FP8 bit pattern. E4M3 has no
+// infinities and only uses the largest pattern of each sign for NaN, while
+// E5M2 is the upper half of an IEEE F16.
+var fp8E4M3, fp8E5M2 = func() (e4m3, e5m2 [256]float32) {
+	for i := range 256 {
+		sign, exp, mantissa := i>>7, (i>>3)&0xf, i&0x7
+
+		var v float64
+		switch {
+		case exp == 0xf && mantissa == 0x7:
+			v = math.NaN()
+		case exp == 0:
+			v = math.Ldexp(float64(mantissa)/8, -6)
+		default:
+			v = math.Ldexp(1+float64(mantissa)/8, exp-7)
+		}
+
+		if sign == 1 {
+			v = -v
+		}
+
+		e4m3[i] = float32(v)
+		e5m2[i] = float16.Frombits(uint16(i) << 8).Float32()
 	}
+
+	return e4m3, e5m2
+}()
+
+// quantizeQ8_0 quantizes f32s, whose length is a multiple of 32, to blocks of
+// an F16 scale followed by 32 int8 values as in ggml's quantize_row_q8_0
+func quantizeQ8_0(f32s []float32) []byte {
+	const blockSize = 32
+
+	b := make([]byte, 0, len(f32s)/blockSize*(2+blockSize))
+	for block := range slices.Chunk(f32s, blockSize) {
+		var amax float32
+		for _, v := range block {
+			amax = max(amax, float32(math.Abs(float64(v))))
+		}
+
+		d := amax / 127
+		var id float32
+		if d != 0 {
+			id = 1 / d
+		}
+
+		b = binary.LittleEndian.AppendUint16(b, float16.Fromfloat32(d).Bits())
+		for _, v := range block {
+			b = append(b, byte(int8(math.Round(float64(v*id)))))
+		}
+	}
+
+	return b
 }
@@ -0,0 +1,331 @@
+package convert
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/x448/float16"
+)
+
+// writeSafetensors returns a safetensors file of tensors, whose data is
+// written in sorted order of name
+func writeSafetensors(t *testing.T, tensors map[string]safetensorMetadata, data map[string][]byte) []byte {
+	t.Helper()
+
+	var offset int64
+	for _, name := range slices.Sorted(maps.Keys(tensors)) {
+		md := tensors[name]
+		md.Offsets = []int64{offset, offset + int64(len(data[name]))}
+		tensors[name] = md
+		offset += int64(len(data[name]))
+	}
+
+	header, err := json.Marshal(tensors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, int64(len(header))); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Write(header)
+	for _, name := range slices.Sorted(maps.Keys(tensors)) {
+		b.Write(data[name])
+	}
+
+	return b.Bytes()
+}
+
+func TestFP8Values(t *testing.T) {
+	for _, tt := range []struct {
+		lut  *[256]float32
+		bits byte
+		want float32
+	}{
+		{&fp8E4M3, 0x38, 1},
+		{&fp8E4M3, 0xb8, -1},
+		{&fp8E4M3, 0x7e, 448},
+		{&fp8E4M3, 0x01, 1. / 512},
+		{&fp8E4M3, 0x08, 1. / 64},
+		{&fp8E5M2, 0x3c, 1},
+		{&fp8E5M2, 0x7b, 57344},
+		{&fp8E5M2, 0xc0, -2},
+	} {
+		if got := tt.lut[tt.bits]; got != tt.want {
+			t.Errorf("%#x = %v, want %v", tt.bits, got, tt.want)
+		}
+	}
+
+	if !math.IsNaN(float64(fp8E4M3[0x7f])) || !math.IsNaN(float64(fp8E4M3[0xff])) {
+		t.Error("E4M3 NaN is not NaN")
+	}
+}
+
+func TestSafetensorsFP8(t *testing.T) {
+	const rows, cols = 4, 64
+
+	r := rand.New(rand.NewPCG(1, 2))
+
+	weights := make([]byte, rows*cols)
+	for i := range weights {
+		// any value but NaN
+		weights[i] = byte(r.IntN(0x7f))
+		if r.IntN(2) == 1 {
+			weights[i] |= 0x80
+		}
+	}
+
+	// scales of blocks of 2x32
+	scales := []float32{0.5, 2, 0.125, 1}
+	var scaleBytes []byte
+	for _, s := range scales {
+		scaleBytes = binary.LittleEndian.AppendUint32(scaleBytes, math.Float32bits(s))
+	}
+
+	want := make([]float32, rows*cols)
+	for i := range rows {
+		for j := range cols {
+			want[i*cols+j] = fp8E4M3[weights[i*cols+j]] * scales[i/2*2+j/32]
+		}
+	}
+
+	fsys := fstest.MapFS{
+		"model.safetensors": &fstest.MapFile{Data: writeSafetensors(t,
+			map[string]safetensorMetadata{
+				"model.layers.0.mlp.up_proj.weight":           {Type: "F8_E4M3", Shape: []uint64{rows, cols}},
+				"model.layers.0.mlp.up_proj.weight_scale_inv": {Type: "F32", Shape: []uint64{2, 2}},
+				"model.layers.0.mlp.up_proj.input_scale":      {Type: "F32", Shape: []uint64{}},
+			},
+			map[string][]byte{
+				"model.layers.0.mlp.up_proj.weight":           weights,
+				"model.layers.0.mlp.up_proj.weight_scale_inv": scaleBytes,
+				"model.layers.0.mlp.up_proj.input_scale":      binary.LittleEndian.AppendUint32(nil, math.Float32bits(1)),
+			},
+		)},
+	}
+
+	ts, err := parseSafetensors(fsys, strings.NewReplacer("model.layers.", "blk.", "mlp.up_proj", "ffn_up"), "model.safetensors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ts) != 1 || ts[0].Name() != "blk.0.ffn_up.weight" {
+		t.Fatalf("unexpected tensors %v", ts)
+	}
+
+	if kind := ts[0].Kind(); kind != tensorKindQ8_0 {
+		t.Fatalf("kind is %v, want Q8_0", kind)
+	}
+
+	var b bytes.Buffer
+	if _, err := ts[0].WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	// about half the size of F16
+	if n := b.Len(); n != rows*cols/32*34 {
+		t.Fatalf("wrote %v bytes, want %v", n, rows*cols/32*34)
+	}
+
+	for i, block := range slices.Collect(slices.Chunk(b.Bytes(), 34)) {
+		d := float16.Frombits(binary.LittleEndian.Uint16(block)).Float32()
+		for j, q := range block[2:] {
+			got, want := d*float32(int8(q)), want[i*32+j]
+			if diff := math.Abs(float64(got - want)); diff > float64(d) {
+				t.Errorf("element %v is %v, want %v", i*32+j, got, want)
+			}
+		}
+	}
+}
+
+// fp8Reference decodes the FP8 bits b with exp exponent and man mantissa bits
+// as specified by the OCP 8-bit floating point formats. finite is whether the
+// format has no infinities, in which case only the largest pattern of each
+// sign is NaN, as in E4M3.
+func fp8Reference(b byte, exp, man int, finite bool) float64 {
+	bias := 1<<(exp-1) - 1
+	e, m := int(b>>man)&(1<<exp-1), int(b)&(1<<man-1)
+
+	var v float64
+	switch {
+	case finite && e == 1<<exp-1 && m == 1<<man-1:
+		return math.NaN()
+	case !finite && e == 1<<exp-1 && m != 0:
+		return math.NaN()
+	case !finite && e == 1<<exp-1:
+		v = math.Inf(1)
+	case e == 0:
+		v = float64(m) / float64(int(1)<<man) * math.Pow(2, float64(1-bias))
+	default:
+		v = (1 + float64(m)/float64(int(1)<<man)) * math.Pow(2, float64(e-bias))
+	}
+
+	if b&0x80 != 0 {
+		v = -v
+	}
+
+	return v
+}
+
+// TestSafetensorsFP8Accuracy checks that FP8 weights converted to Q8_0 match
+// the FP8 reference within the error of Q8_0, both for each weight and for
+// products with activations as in a linear layer
+func TestSafetensorsFP8Accuracy(t *testing.T) {
+	const rows, cols = 64, 256
+
+	for _, tt := range []struct {
+		dtype  string
+		exp    int
+		finite bool
+		lut    *[256]float32
+	}{
+		{"F8_E4M3", 4, true, &fp8E4M3},
+		{"F8_E5M2", 5, false, &fp8E5M2},
+	} {
+		t.Run(tt.dtype, func(t *testing.T) {
+			reference := make([]float64, 256)
+			for i := range reference {
+				reference[i] = fp8Reference(byte(i), tt.exp, 7-tt.exp, tt.finite)
+				if got := float64(tt.lut[i]); got != reference[i] && !(math.IsNaN(got) && math.IsNaN(reference[i])) {
+					t.Errorf("%#x = %v, want %v", i, got, reference[i])
+				}
+			}
+
+			// the finite patterns in order of their values
+			var codes []byte
+			for i, v := range reference {
+				if !math.IsNaN(v) && !math.IsInf(v, 0) {
+					codes = append(codes, byte(i))
+				}
+			}
+			slices.SortFunc(codes, func(a, b byte) int { return cmp.Compare(reference[a], reference[b]) })
+
+			// normally distributed weights rounded to the nearest FP8 value
+			// with a scale per row
+			r := rand.New(rand.NewPCG(3, 4))
+			weights, scales := make([]byte, rows*cols), make([]float32, rows)
+			for i := range weights {
+				v := r.NormFloat64() * 32
+				j, _ := slices.BinarySearchFunc(codes, v, func(c byte, v float64) int { return cmp.Compare(reference[c], v) })
+				if j == len(codes) || j > 0 && v-reference[codes[j-1]] < reference[codes[j]]-v {
+					j--
+				}
+				weights[i] = codes[j]
+			}
+
+			for i := range scales {
+				scales[i] = float32(math.Ldexp(1+r.Float64(), -12+r.IntN(8)))
+			}
+
+			var scaleBytes []byte
+			for _, s := range scales {
+				scaleBytes = binary.LittleEndian.AppendUint32(scaleBytes, math.Float32bits(s))
+			}
+
+			fsys := fstest.MapFS{
+				"model.safetensors": &fstest.MapFile{Data: writeSafetensors(t,
+					map[string]safetensorMetadata{
+						"a.weight":       {Type: tt.dtype, Shape: []uint64{rows, cols}},
+						"a.weight_scale": {Type: "F32", Shape: []uint64{rows, 1}},
+					},
+					map[string][]byte{"a.weight": weights, "a.weight_scale": scaleBytes},
+				)},
+			}
+
+			ts, err := parseSafetensors(fsys, strings.NewReplacer(), "model.safetensors")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if _, err := ts[0].WriteTo(&b); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]float64, 0, rows*cols)
+			for block := range slices.Chunk(b.Bytes(), 34) {
+				d := float64(float16.Frombits(binary.LittleEndian.Uint16(block)).Float32())
+				for _, q := range block[2:] {
+					got = append(got, d*float64(int8(q)))
+				}
+			}
+
+			want := make([]float64, rows*cols)
+			for i := range want {
+				want[i] = reference[weights[i]] * float64(scales[i/cols])
+			}
+
+			// each weight is rounded to half a step of its block, whose
+			// size is rounded to F16
+			for i := 0; i < len(want); i += 32 {
+				var amax float64
+				for _, v := range want[i : i+32] {
+					amax = max(amax, math.Abs(v))
+				}
+
+				for j := i; j < i+32; j++ {
+					if diff := math.Abs(got[j] - want[j]); diff > amax/127/2+amax/1024 {
+						t.Fatalf("weight %v is %v, want %v", j, got[j], want[j])
+					}
+				}
+			}
+
+			x := make([]float64, cols)
+			for i := range x {
+				x[i] = r.NormFloat64()
+			}
+
+			var errSq, normSq float64
+			for i := range rows {
+				var y, yRef float64
+				for j := range cols {
+					y += got[i*cols+j] * x[j]
+					yRef += want[i*cols+j] * x[j]
+				}
+
+				errSq += (y - yRef) * (y - yRef)
+				normSq += yRef * yRef
+			}
+
+			if rel := math.Sqrt(errSq / normSq); rel > 0.01 {
+				t.Errorf("relative error of the outputs is %v", rel)
+			}
+		})
+	}
+}
+
+func TestSafetensorsFP8InvalidScale(t *testing.T) {
+	for name, tensors := range map[string]map[string]safetensorMetadata{
+		"not fp8": {
+			"a.weight":       {Type: "BF16", Shape: []uint64{1, 32}},
+			"a.weight_scale": {Type: "F32", Shape: []uint64{1}},
+		},
+		"no weight": {
+			"a.weight":       {Type: "F8_E4M3", Shape: []uint64{1, 32}},
+			"b.weight_scale": {Type: "F32", Shape: []uint64{1}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := make(map[string][]byte)
+			for name := range tensors {
+				data[name] = make([]byte, 4)
+			}
+
+			fsys := fstest.MapFS{"model.safetensors": &fstest.MapFile{Data: writeSafetensors(t, tensors, data)}}
+			if _, err := parseSafetensors(fsys, strings.NewReplacer(), "model.safetensors"); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -167,6 +167,8 @@ var (
 	MultiUserCache = Bool("OLLAMA_MULTIUSER_CACHE")
 	// Enable the new Ollama engine
 	NewEngine = Bool("OLLAMA_NEW_ENGINE")
+	// CheckAttention checks the attention of the new engine for NaN and Inf
+	CheckAttention = Bool("OLLAMA_CHECK_ATTENTION")
 	// ContextLength sets the default context length
 	ContextLength = Uint("OLLAMA_CONTEXT_LENGTH", 2048)
 )
@@ -185,6 +187,11 @@ var (
 	RocrVisibleDevices    = String("ROCR_VISIBLE_DEVICES")
 	GpuDeviceOrdinal      = String("GPU_DEVICE_ORDINAL")
 	HsaOverrideGfxVersion = String("HSA_OVERRIDE_GFX_VERSION")
+
+	// GraphTrace is the path that the compute graph of each forward pass of
+	// the new engine is written to, as Graphviz if it ends in .dot and
+	// otherwise as JSON
+	GraphTrace = String("OLLAMA_GRAPH_TRACE")
 )
 
 func Uint(key string, defaultValue uint) func() uint {
@@ -256,6 +263,8 @@ func AsMap() map[string]EnvVar {
 		"OLLAMA_MULTIUSER_CACHE":   {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
 		"OLLAMA_CONTEXT_LENGTH":    {"OLLAMA_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 2048)"},
 		"OLLAMA_NEW_ENGINE":        {"OLLAMA_NEW_ENGINE", NewEngine(), "Enable the new Ollama engine"},
+		"OLLAMA_CHECK_ATTENTION":   {"OLLAMA_CHECK_ATTENTION", CheckAttention(), "Fail forward passes of the new engine whose attention produces NaN or Inf"},
+		"OLLAMA_GRAPH_TRACE":       {"OLLAMA_GRAPH_TRACE", GraphTrace(), "Write the compute graph of the new engine to a JSON or .dot file"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
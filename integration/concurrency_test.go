@@ -269,3 +269,58 @@ func TestMultiModelStress(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+// Sampling with a seed should give the same tokens when the same request runs
+// concurrently with itself and other requests
+func TestConcurrentSeed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	client, _, cleanup := InitServerConnection(ctx, t)
+	defer cleanup()
+
+	stream := false
+	seeded := api.GenerateRequest{
+		Model:     "orca-mini",
+		Prompt:    "write a short story about a lighthouse keeper",
+		Stream:    &stream,
+		KeepAlive: &api.Duration{Duration: 10 * time.Second},
+		Options: map[string]interface{}{
+			"seed":        1234,
+			"temperature": 1.0,
+			"num_predict": 64,
+		},
+	}
+	require.NoError(t, PullIfMissing(ctx, client, seeded.Model))
+
+	// other requests without a seed sample at the same time
+	noise, _ := GenerateRequests()
+	for i := range noise {
+		noise[i].Stream = &stream
+		noise[i].Options = map[string]interface{}{"temperature": 1.0, "num_predict": 64}
+	}
+
+	var wg sync.WaitGroup
+	var tokens [2][]int
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, client.Generate(ctx, &seeded, func(response api.GenerateResponse) error {
+				tokens[i] = response.Context
+				return nil
+			}))
+		}()
+	}
+
+	for _, req := range noise {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, client.Generate(ctx, &req, func(api.GenerateResponse) error { return nil }))
+		}()
+	}
+	wg.Wait()
+
+	require.NotEmpty(t, tokens[0])
+	require.Equal(t, tokens[0], tokens[1], "tokens of the same seed differ")
+}
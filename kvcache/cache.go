@@ -2,6 +2,7 @@ package kvcache
 
 import (
 	"errors"
+	"io"
 
 	"github.com/ollama/ollama/ml"
 )
@@ -9,6 +10,11 @@ import (
 var (
 	ErrKvCacheFull  = errors.New("could not find a kv cache slot")
 	ErrNotSupported = errors.New("model does not support operation")
+	ErrSinkTokens   = errors.New("cannot shift attention sink tokens out of the cache")
+
+	// ErrSnapshotMismatch is returned when loading a snapshot that was saved
+	// by a cache with a different type, capacity or layers
+	ErrSnapshotMismatch = errors.New("snapshot does not match the cache")
 )
 
 type Cache interface {
@@ -31,8 +37,11 @@ type Cache interface {
 
 	// ** cache management **
 
-	// Init sets up runtime parameters
-	Init(backend ml.Backend, dtype ml.DType, capacity int32)
+	// Init sets up runtime parameters. capacity is the number of tokens of
+	// up to maxSequences sequences that the cache must hold, and maxBatch is
+	// the largest number of tokens in a forward pass. Caches may allocate
+	// less than capacity if they don't need to hold every token.
+	Init(backend ml.Backend, dtype ml.DType, maxSequences int, capacity int32, maxBatch int)
 
 	// Close closes the cache and frees resources associated with it
 	Close()
@@ -45,6 +54,11 @@ type Cache interface {
 	// CopyPrefix copies tokens in the range [0, len) from srcSeq to dstSeq
 	CopyPrefix(srcSeq, dstSeq int, len int32)
 
+	// CanResume reports whether seq can continue from pos, which requires the
+	// cache to still hold the tokens before pos that later tokens attend to.
+	// Otherwise the sequence must be processed again from the start.
+	CanResume(seq int, pos int32) bool
+
 	// Remove deletes tokens in the range [beginIndex, endIndex) from seq. Set
 	// endIndex to math.MaxInt32 to remove everything starting at beginIndex.
 	//
@@ -52,3 +66,32 @@ type Cache interface {
 	// removed by calling Remove(seq, 0, math.MaxInt32)
 	Remove(seq int, beginIndex, endIndex int32) error
 }
+
+// Sinks is implemented by caches that pin the first tokens of each sequence
+// as attention sinks. Callers that shift the context must keep at least
+// SinkTokens tokens at the start of the sequence.
+type Sinks interface {
+	SinkTokens() int32
+}
+
+// MaskedQueries is implemented by caches whose masks may have queries that
+// can't attend to any key of the cache. Their rows of the mask are cleared and
+// MaskedQueries returns the queries that do attend to some key, as returned by
+// nn.UnmaskQueries, or nil if all of them do. Models pass it to Attention with
+// nn.WithMaskedQueries so that the output of the masked queries is zero
+// rather than NaN, which would spread to other sequences in later layers.
+type MaskedQueries interface {
+	MaskedQueries() ml.Tensor
+}
+
+// Snapshot is implemented by caches that can save the tokens of a sequence,
+// such as to disk, and load them again later so that the sequence continues
+// as if they had just been processed.
+type Snapshot interface {
+	// SaveSequence writes the tokens in the range [0, end) of seq to w
+	SaveSequence(w io.Writer, seq int, end int32) error
+
+	// LoadSequence replaces the contents of seq with tokens written by
+	// SaveSequence. If an error occurs, seq is left empty.
+	LoadSequence(r io.Reader, seq int) error
+}
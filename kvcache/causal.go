@@ -1,13 +1,16 @@
 package kvcache
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"math"
 	"slices"
 
 	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/nn"
 )
 
 type shiftFn func(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error)
@@ -22,6 +25,10 @@ type Causal struct {
 	Capacity   int32
 	windowSize int32
 
+	// number of tokens at the start of each sequence that are kept as
+	// attention sinks
+	sinkTokens int32
+
 	// ** current forward pass **
 
 	// the active layer for Get and Put
@@ -36,6 +43,9 @@ type Causal struct {
 	// mask of the cache as used by this batch
 	curMask ml.Tensor
 
+	// queries of this batch that attend to some key, or nil if all of them do
+	curAttends ml.Tensor
+
 	// locations in the cache that are needed for this batch
 	curCellRange cellRange
 
@@ -70,11 +80,35 @@ func NewCausalCache(shift shiftFn) *Causal {
 	return &Causal{windowSize: math.MaxInt32, shiftFn: shift}
 }
 
+// NewSWACache returns a cache for sliding window attention, where each token
+// attends to the windowSize tokens before it in addition to itself. Tokens
+// that fall out of the window of a sequence are evicted and their cells are
+// reused, so the cache only holds the window of each sequence and a batch
+// rather than the whole context.
 func NewSWACache(windowSize int32, shift shiftFn) *Causal {
 	return &Causal{windowSize: windowSize, shiftFn: shift}
 }
 
-func (c *Causal) Init(backend ml.Backend, dtype ml.DType, capacity int32) {
+// SetSinkTokens pins the first n positions of each sequence as attention
+// sinks, as in StreamingLLM. Sinks are visible to every later token in the
+// sequence, even outside of the sliding window, and cannot be removed by a
+// context shift. It must be called before Init.
+func (c *Causal) SetSinkTokens(n int32) {
+	c.sinkTokens = n
+}
+
+func (c *Causal) SinkTokens() int32 {
+	return c.sinkTokens
+}
+
+func (c *Causal) Init(backend ml.Backend, dtype ml.DType, maxSequences int, capacity int32, maxBatch int) {
+	if c.windowSize != math.MaxInt32 {
+		// tokens before the window of the first token of a batch are evicted
+		// before the batch is stored
+		window := int64(maxSequences)*int64(c.windowSize+c.sinkTokens) + int64(maxBatch)
+		capacity = int32(min(int64(capacity), window))
+	}
+
 	c.DType = dtype
 	c.Capacity = capacity
 	c.cells = make([]cacheCell, capacity)
@@ -90,6 +124,15 @@ func (c *Causal) Close() {
 func (c *Causal) StartForward(ctx ml.Context, positions []int32, seqs []int) error {
 	c.curBatchSize = len(positions)
 
+	c.evictWindow(positions, seqs)
+
+	// this is before the cells of the batch are assigned, so only graphs
+	// of earlier batches, which are computed before the moves, refer to
+	// the cells that are moved
+	if c.fragmented() {
+		c.defrag()
+	}
+
 	var err error
 	c.curLoc, err = c.findStartLoc()
 	if errors.Is(err, ErrKvCacheFull) {
@@ -127,11 +170,56 @@ func (c *Causal) StartForward(ctx ml.Context, positions []int32, seqs []int) err
 		c.cellRanges[seq] = seqRange
 	}
 
-	c.curMask, err = c.buildMask(ctx, positions, seqs)
+	c.curMask, c.curAttends, err = c.buildMask(ctx, positions, seqs)
 
 	return err
 }
 
+// evictWindow frees the cells of tokens that are before the sliding window of
+// every token of their sequence in the batch. These can never be attended to
+// again as positions only increase, except for the sinks. Cells that are
+// shared with other sequences are only freed once no sequence uses them.
+func (c *Causal) evictWindow(positions []int32, seqs []int) {
+	if c.windowSize == math.MaxInt32 {
+		return
+	}
+
+	lowest := make(map[int]int32)
+	for i, seq := range seqs {
+		if pos, ok := lowest[seq]; !ok || positions[i] < pos {
+			lowest[seq] = positions[i]
+		}
+	}
+
+	for seq, pos := range lowest {
+		oldRange, ok := c.cellRanges[seq]
+		if !ok {
+			continue
+		}
+
+		seqRange := newRange()
+		for i := oldRange.min; i <= oldRange.max; i++ {
+			if !slices.Contains(c.cells[i].sequences, seq) {
+				continue
+			}
+
+			if c.cells[i].pos < pos-c.windowSize && c.cells[i].pos >= c.sinkTokens {
+				c.cells[i].sequences = slices.DeleteFunc(c.cells[i].sequences, func(s int) bool { return s == seq })
+				continue
+			}
+
+			seqRange.min = min(seqRange.min, i)
+			seqRange.max = max(seqRange.max, i)
+		}
+
+		if seqRange == newRange() {
+			delete(c.cellRanges, seq)
+		} else {
+			c.cellRanges[seq] = seqRange
+		}
+	}
+}
+
 func newRange() cellRange {
 	return cellRange{
 		min: math.MaxInt,
@@ -159,8 +247,10 @@ func (c *Causal) findStartLoc() (int, error) {
 
 // Builds a mask of history x batch indicating whether for each token in the batch the
 // token in the history should apply. This is based on both the sequence and causality (the
-// position of the history is not ahead of the token in the batch).
-func (c *Causal) buildMask(ctx ml.Context, positions []int32, seqs []int) (ml.Tensor, error) {
+// position of the history is not ahead of the token in the batch). Sink tokens are not
+// subject to the sliding window. Also returns the queries that attend to some token, as
+// returned by nn.UnmaskQueries.
+func (c *Causal) buildMask(ctx ml.Context, positions []int32, seqs []int) (ml.Tensor, ml.Tensor, error) {
 	// TODO(jessegross): This does not do padding, which is required for flash attention
 	len := c.curCellRange.max - c.curCellRange.min + 1
 	mask := make([]float32, c.curBatchSize*len)
@@ -168,13 +258,50 @@ func (c *Causal) buildMask(ctx ml.Context, positions []int32, seqs []int) (ml.Te
 	for i := range c.curBatchSize {
 		for j := c.curCellRange.min; j <= c.curCellRange.max; j++ {
 			if !slices.Contains(c.cells[j].sequences, seqs[i]) || c.cells[j].pos > positions[i] ||
-				c.cells[j].pos < positions[i]-c.windowSize {
+				(c.cells[j].pos < positions[i]-c.windowSize && c.cells[j].pos >= c.sinkTokens) {
 				mask[i*len+(j-c.curCellRange.min)] = float32(math.Inf(-1))
 			}
 		}
 	}
 
-	return ctx.FromFloatSlice(mask, len, c.curBatchSize)
+	attends, err := nn.UnmaskQueries(ctx, mask, len, c.curBatchSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maskTensor, err := ctx.FromFloatSlice(mask, len, c.curBatchSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return maskTensor, attends, nil
+}
+
+// defragThreshold is the fraction of the cells up to the last one in use that
+// may be free before the cache is defragmented. Holes between the cells of a
+// sequence widen its mask, so attention also spans cells it doesn't use, and
+// a fragmented cache eventually has no run of free cells long enough for a
+// batch even though many cells are free.
+const defragThreshold = 0.25
+
+// defragMinCells is the number of free cells before the last one in use below
+// which the cache is not defragmented for exceeding defragThreshold, as moving
+// them isn't worth it
+const defragMinCells = 64
+
+// fragmented reports whether the free cells before the last one in use exceed
+// defragThreshold and defragMinCells
+func (c *Causal) fragmented() bool {
+	var used, end int
+	for i, cell := range c.cells {
+		if len(cell.sequences) > 0 {
+			used++
+			end = i + 1
+		}
+	}
+
+	free := end - used
+	return free >= defragMinCells && float64(free) > defragThreshold*float64(end)
 }
 
 func moveCell(ctx ml.Context, objs []ml.Tensor, src, dst, len int) {
@@ -190,15 +317,21 @@ func moveCell(ctx ml.Context, objs []ml.Tensor, src, dst, len int) {
 	}
 }
 
+// defrag moves the cells in use to the start of the cache, filling the free
+// cells before them. The moves are computed in order after any graphs that
+// have already been computed, so defrag must not be called between the
+// assignment of the cells of a batch in StartForward and the computation of
+// its graph.
 func (c *Causal) defrag() {
 	slog.Debug("defragmenting kv cache")
 
 	// Defrag strategy:
 	// - Search for empty holes at the beginning of the cache,
 	//   filling them with active data starting at the end
-	// - If there are contiguous elements that need to be moved,
-	//   combine them into a single operation by holding new moves
-	//   until we see that the next one is non-contiguous
+	// - Each move copies the run of active cells at the end of the
+	//   cache, or as much of it as fits in the hole, in a single
+	//   operation that preserves the order of the cells. The source
+	//   and destination never overlap, nor do those of different moves.
 	// - Fill up the context with the maximum number of operations it
 	//   can hold then compute that and continue with a new context
 	//
@@ -219,40 +352,48 @@ func (c *Causal) defrag() {
 		layers++
 	}
 
-	maxMoves := ctx.MaxTensors() / (6 * layers)
+	maxMoves := ctx.MaxTensors() / (6 * max(layers, 1))
 	moves := 0
 
-	var pendingSrc, pendingDst, pendingLen int
-	src := len(c.cells) - 1
-
-	for dst := 0; dst < src; dst++ {
-		if len(c.cells[dst].sequences) == 0 {
-			for ; src > dst; src-- {
-				if len(c.cells[src].sequences) != 0 {
-					c.cells[dst] = c.cells[src]
-					c.cells[src] = cacheCell{}
-
-					if pendingLen > 0 {
-						if src == pendingSrc-pendingLen && dst == pendingDst+pendingLen {
-							pendingSrc = src
-							pendingLen++
-							break
-						} else {
-							moveCell(ctx, c.keys, pendingSrc, pendingDst, pendingLen)
-							moveCell(ctx, c.values, pendingSrc, pendingDst, pendingLen)
-							moves++
-						}
-					}
+	used := func(i int) bool { return len(c.cells[i].sequences) != 0 }
 
-					pendingSrc = src
-					pendingDst = dst
-					pendingLen = 1
+	dst, end := 0, len(c.cells)
+	for {
+		for dst < end && used(dst) {
+			dst++
+		}
 
-					break
-				}
-			}
+		for end > dst && !used(end-1) {
+			end--
 		}
 
+		if dst >= end {
+			break
+		}
+
+		// the hole ends before the cell at end-1, which is in use, and the
+		// run at the end of the cache starts after the hole
+		var hole, run int
+		for !used(dst + hole) {
+			hole++
+		}
+
+		for end-run-1 >= dst+hole && used(end-run-1) {
+			run++
+		}
+
+		n := min(hole, run)
+		src := end - n
+
+		copy(c.cells[dst:dst+n], c.cells[src:end])
+		clear(c.cells[src:end])
+
+		moveCell(ctx, c.keys, src, dst, n)
+		moveCell(ctx, c.values, src, dst, n)
+		moves++
+
+		dst, end = dst+n, src
+
 		if moves >= maxMoves {
 			ctx.Compute()
 			ctx.Close()
@@ -262,12 +403,6 @@ func (c *Causal) defrag() {
 		}
 	}
 
-	if pendingLen > 0 {
-		moveCell(ctx, c.keys, pendingSrc, pendingDst, pendingLen)
-		moveCell(ctx, c.values, pendingSrc, pendingDst, pendingLen)
-		moves++
-	}
-
 	if moves > 0 {
 		ctx.Compute()
 	}
@@ -320,6 +455,10 @@ func (c *Causal) Get(ctx ml.Context) (ml.Tensor, ml.Tensor, ml.Tensor) {
 	return key, value, c.curMask
 }
 
+func (c *Causal) MaskedQueries() ml.Tensor {
+	return c.curAttends
+}
+
 func (c *Causal) Put(ctx ml.Context, key, value ml.Tensor) {
 	if c.curBatchSize != key.Dim(2) {
 		panic(fmt.Errorf("inconsistent batch sizes (layer: %v, batch size: %v layer batch size: %v)", c.curLayer, c.curBatchSize, key.Dim(2)))
@@ -357,6 +496,223 @@ func (c *Causal) CopyPrefix(srcSeq, dstSeq int, len int32) {
 	c.cellRanges[dstSeq] = seqRange
 }
 
+// CanResume reports whether the tokens of seq between the sinks and pos that
+// are within the window of the token at pos are still in the cache, as those
+// before the window of a sequence may have been evicted
+func (c *Causal) CanResume(seq int, pos int32) bool {
+	if c.windowSize == math.MaxInt32 {
+		return true
+	}
+
+	start := max(c.sinkTokens, pos-c.windowSize)
+	if start >= pos {
+		// only the sinks are needed, which are never evicted
+		return true
+	}
+
+	seqRange, ok := c.cellRanges[seq]
+	if !ok {
+		return false
+	}
+
+	first, last := int32(math.MaxInt32), int32(-1)
+	for i := seqRange.min; i <= seqRange.max; i++ {
+		if slices.Contains(c.cells[i].sequences, seq) && c.cells[i].pos >= c.sinkTokens {
+			first = min(first, c.cells[i].pos)
+			last = max(last, c.cells[i].pos)
+		}
+	}
+
+	return first <= start && last >= pos-1
+}
+
+// snapshotHeader starts each snapshot of a sequence. It is followed by the
+// position of each cell and then, for the keys and values of each layer, their
+// dimensions and the data of the cells.
+type snapshotHeader struct {
+	DType  uint32
+	Cells  uint32
+	Layers uint32
+}
+
+// SaveSequence writes the cells of seq with positions before end, which are
+// only those within the window of the last token for sliding window attention.
+// The data of the cells is copied as it is stored, so snapshots can only be
+// loaded by caches of the same type.
+func (c *Causal) SaveSequence(w io.Writer, seq int, end int32) error {
+	var positions []int32
+	var runs []cellRange
+	if seqRange, ok := c.cellRanges[seq]; ok {
+		for i := seqRange.min; i <= seqRange.max; i++ {
+			if !slices.Contains(c.cells[i].sequences, seq) || c.cells[i].pos >= end {
+				continue
+			}
+
+			positions = append(positions, c.cells[i].pos)
+
+			// cells that are next to each other are copied at once
+			if n := len(runs); n > 0 && runs[n-1].max == i-1 {
+				runs[n-1].max = i
+			} else {
+				runs = append(runs, cellRange{min: i, max: i})
+			}
+		}
+	}
+
+	if len(positions) == 0 {
+		return fmt.Errorf("no tokens of sequence %v before %v in the cache", seq, end)
+	}
+
+	for i := range c.keys {
+		for _, t := range []ml.Tensor{c.keys[i], c.values[i]} {
+			if _, ok := t.(ml.TensorData); t != nil && !ok {
+				return ErrNotSupported
+			}
+		}
+	}
+
+	header := snapshotHeader{DType: uint32(c.DType), Cells: uint32(len(positions)), Layers: uint32(len(c.keys))}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, positions); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for i := range c.keys {
+		for _, t := range []ml.Tensor{c.keys[i], c.values[i]} {
+			var dims [2]uint32
+			if t != nil {
+				dims = [2]uint32{uint32(t.Dim(0)), uint32(t.Dim(1))}
+			}
+
+			if err := binary.Write(w, binary.LittleEndian, dims); err != nil {
+				return err
+			}
+
+			if t == nil {
+				continue
+			}
+
+			for _, r := range runs {
+				n := t.Stride(2) * (r.max - r.min + 1)
+				if n > cap(buf) {
+					buf = make([]byte, n)
+				}
+
+				if _, err := t.(ml.TensorData).ReadAt(buf[:n], int64(t.Stride(2)*r.min)); err != nil {
+					return err
+				}
+
+				if _, err := w.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadSequence stores the cells of a snapshot written by SaveSequence next
+// to each other, making room by defragmenting the cache if needed. Layers that
+// don't have data yet are allocated as the snapshot requires.
+func (c *Causal) LoadSequence(r io.Reader, seq int) error {
+	// the cells are only assigned to seq once all of the data has been read,
+	// so an error leaves them free
+	for i := range c.cells {
+		c.cells[i].sequences = slices.DeleteFunc(c.cells[i].sequences, func(s int) bool { return s == seq })
+	}
+	delete(c.cellRanges, seq)
+
+	var header snapshotHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	if ml.DType(header.DType) != c.DType {
+		return fmt.Errorf("%w (dtype: %v, cache dtype: %v)", ErrSnapshotMismatch, header.DType, c.DType)
+	}
+
+	if header.Cells == 0 || header.Cells > uint32(c.Capacity) {
+		return fmt.Errorf("%w (cells: %v, capacity: %v)", ErrSnapshotMismatch, header.Cells, c.Capacity)
+	}
+
+	positions := make([]int32, header.Cells)
+	if err := binary.Read(r, binary.LittleEndian, positions); err != nil {
+		return err
+	}
+
+	c.curBatchSize = int(header.Cells)
+	loc, err := c.findStartLoc()
+	if errors.Is(err, ErrKvCacheFull) {
+		c.defrag()
+		loc, err = c.findStartLoc()
+	}
+	if err != nil {
+		return err
+	}
+
+	if int(header.Layers) > len(c.keys) {
+		c.keys = append(c.keys, make([]ml.Tensor, int(header.Layers)-len(c.keys))...)
+		c.values = append(c.values, make([]ml.Tensor, int(header.Layers)-len(c.values))...)
+	}
+
+	var buf []byte
+	for i := range c.keys {
+		for _, ts := range [][]ml.Tensor{c.keys, c.values} {
+			var dims [2]uint32
+			if i < int(header.Layers) {
+				if err := binary.Read(r, binary.LittleEndian, &dims); err != nil {
+					return err
+				}
+			}
+
+			t := ts[i]
+			if dims == [2]uint32{} {
+				if t != nil {
+					return fmt.Errorf("%w (layer %v is missing)", ErrSnapshotMismatch, i)
+				}
+				continue
+			}
+
+			if t == nil {
+				t = c.cacheCtx.Zeros(c.DType, int(dims[0]), int(dims[1]), int(c.Capacity))
+				ts[i] = t
+			} else if t.Dim(0) != int(dims[0]) || t.Dim(1) != int(dims[1]) {
+				return fmt.Errorf("%w (layer %v has shape %v, cache shape %v)", ErrSnapshotMismatch, i, dims, t.Shape())
+			}
+
+			data, ok := t.(ml.TensorData)
+			if !ok {
+				return ErrNotSupported
+			}
+
+			n := t.Stride(2) * int(header.Cells)
+			if n > cap(buf) {
+				buf = make([]byte, n)
+			}
+
+			if _, err := io.ReadFull(r, buf[:n]); err != nil {
+				return err
+			}
+
+			if _, err := data.WriteAt(buf[:n], int64(t.Stride(2)*loc)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, pos := range positions {
+		c.cells[loc+i] = cacheCell{pos: pos, sequences: []int{seq}}
+	}
+	c.cellRanges[seq] = cellRange{min: loc, max: loc + len(positions) - 1}
+
+	return nil
+}
+
 func (c *Causal) shift(seq int, beginIndex, offset int32) error {
 	if c.shiftFn == nil {
 		return ErrNotSupported
@@ -409,6 +765,10 @@ func (c *Causal) shift(seq int, beginIndex, offset int32) error {
 func (c *Causal) Remove(seq int, beginIndex, endIndex int32) error {
 	var offset int32
 	if endIndex != math.MaxInt32 {
+		if beginIndex < c.sinkTokens {
+			return fmt.Errorf("%w (sinks: %v, begin: %v)", ErrSinkTokens, c.sinkTokens, beginIndex)
+		}
+
 		offset = beginIndex - endIndex
 	}
 
@@ -1,7 +1,11 @@
 package kvcache
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"math"
+	"math/rand/v2"
 	"slices"
 	"testing"
 
@@ -24,7 +28,7 @@ func TestStore(t *testing.T) {
 	cache := NewCausalCache(nil)
 	defer cache.Close()
 
-	cache.Init(backend, ml.DTypeF16, 16)
+	cache.Init(backend, ml.DTypeF16, 1, 16, 16)
 
 	tests := []testCase{
 		{
@@ -57,7 +61,7 @@ func TestSWA(t *testing.T) {
 	cache := NewSWACache(1, nil)
 	defer cache.Close()
 
-	cache.Init(backend, ml.DTypeF32, 16)
+	cache.Init(backend, ml.DTypeF32, 1, 16, 16)
 
 	tests := []testCase{
 		{
@@ -75,12 +79,61 @@ func TestSWA(t *testing.T) {
 	testCache(t, backend, cache, tests)
 }
 
+func TestSinks(t *testing.T) {
+	backend := &testBackend{}
+	cache := NewSWACache(1, func(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
+		return key.Add(ctx, shift), nil
+	})
+	cache.SetSinkTokens(1)
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF32, 1, 4, 4)
+
+	tests := []testCase{
+		{
+			name:          "SlidingWindow",
+			in:            []float32{1, 2, 3, 4},
+			inShape:       []int{1, 1, 4},
+			seqs:          []int{0, 0, 0, 0},
+			pos:           []int32{0, 1, 2, 3},
+			expected:      []float32{1, 2, 3, 4},
+			expectedShape: []int{1, 1, 4},
+			expectedMask:  []float32{0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, 0, float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0, 0},
+		},
+	}
+
+	testCache(t, backend, cache, tests)
+
+	if err := cache.Remove(0, 0, 1); !errors.Is(err, ErrSinkTokens) {
+		t.Fatalf("Remove: have %v; want %v", err, ErrSinkTokens)
+	}
+
+	if err := cache.Remove(0, 1, 2); err != nil {
+		panic(err)
+	}
+
+	tests = []testCase{
+		{
+			name:          "Shifted",
+			in:            []float32{5},
+			inShape:       []int{1, 1, 1},
+			seqs:          []int{0},
+			pos:           []int32{3},
+			expected:      []float32{1, 5, 2, 3},
+			expectedShape: []int{1, 1, 4},
+			expectedMask:  []float32{0, 0, float32(math.Inf(-1)), 0},
+		},
+	}
+
+	testCache(t, backend, cache, tests)
+}
+
 func TestSequences(t *testing.T) {
 	backend := &testBackend{}
 	cache := NewCausalCache(nil)
 	defer cache.Close()
 
-	cache.Init(backend, ml.DTypeF16, 16)
+	cache.Init(backend, ml.DTypeF16, 1, 16, 16)
 
 	tests := []testCase{
 		{
@@ -115,7 +168,7 @@ func TestRemove(t *testing.T) {
 	})
 	defer cache.Close()
 
-	cache.Init(backend, ml.DTypeF16, 16)
+	cache.Init(backend, ml.DTypeF16, 1, 16, 16)
 
 	tests := []testCase{
 		{
@@ -180,7 +233,7 @@ func TestDefrag(t *testing.T) {
 	})
 	defer cache.Close()
 
-	cache.Init(backend, ml.DTypeF16, 16)
+	cache.Init(backend, ml.DTypeF16, 1, 16, 16)
 
 	tests := []testCase{
 		{
@@ -223,12 +276,106 @@ func TestDefrag(t *testing.T) {
 	testCache(t, backend, cache, tests)
 }
 
+// TestDefragStress interleaves the batches of short and long sequences that
+// finish at different times, leaving holes throughout the cache as they are
+// removed, and checks that batches are always stored, and that each cell of
+// the cache still holds the data of the token it is recorded for
+func TestDefragStress(t *testing.T) {
+	const capacity, sequences, maxBatch = 256, 8, 16
+
+	backend := &testBackend{}
+	cache := NewCausalCache(nil)
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF32, sequences, capacity, maxBatch)
+
+	value := func(seq int, pos int32) float32 {
+		return float32(seq*1000) + float32(pos) + 1
+	}
+
+	// each sequence runs until it reaches its length, which is short or
+	// long, and then finishes. the lengths never add up to more than the
+	// capacity of the cache.
+	r := rand.New(rand.NewPCG(1, 2))
+	lengths := make([]int32, sequences)
+	next := make([]int32, sequences)
+	for seq := range lengths {
+		lengths[seq] = 1 + int32(r.IntN(capacity/sequences))
+	}
+
+	for step := range 2000 {
+		var pos []int32
+		var seqs []int
+		var in []float32
+		for seq := range sequences {
+			if next[seq] == lengths[seq] {
+				if err := cache.Remove(seq, 0, math.MaxInt32); err != nil {
+					t.Fatal(err)
+				}
+
+				next[seq] = 0
+				if r.IntN(2) == 0 {
+					lengths[seq] = 1 + int32(r.IntN(2))
+				} else {
+					lengths[seq] = capacity/sequences - int32(r.IntN(4))
+				}
+			}
+
+			for n := r.IntN(4); n > 0 && next[seq] < lengths[seq] && len(pos) < maxBatch; n-- {
+				pos = append(pos, next[seq])
+				seqs = append(seqs, seq)
+				in = append(in, value(seq, next[seq]))
+				next[seq]++
+			}
+		}
+
+		if len(pos) == 0 {
+			continue
+		}
+
+		ctx := backend.NewContext()
+		if err := cache.StartForward(ctx, pos, seqs); err != nil {
+			t.Fatalf("step %d: %v", step, err)
+		}
+
+		cache.SetLayer(0)
+		tensor, _ := ctx.FromFloatSlice(in, 1, 1, len(in))
+		cache.Put(ctx, tensor, tensor)
+		_, _, mask := cache.Get(ctx)
+
+		keys := cache.keys[0].Floats()
+		for i, cell := range cache.cells {
+			if len(cell.sequences) > 0 && keys[i] != value(cell.sequences[0], cell.pos) {
+				t.Fatalf("step %d: cell %d of sequence %d at position %d has %v", step, i, cell.sequences[0], cell.pos, keys[i])
+			}
+		}
+
+		// each token attends to every earlier token of its sequence
+		m := mask.Floats()
+		n := len(m) / len(pos)
+		for i := range pos {
+			var visible int32
+			for _, v := range m[i*n : (i+1)*n] {
+				if v == 0 {
+					visible++
+				}
+			}
+
+			if visible != pos[i]+1 {
+				t.Fatalf("step %d: token of sequence %d at position %d attends to %d tokens", step, seqs[i], pos[i], visible)
+			}
+		}
+
+		ctx.Close()
+	}
+}
+
 func TestCopy(t *testing.T) {
 	backend := &testBackend{}
 	cache := NewCausalCache(func(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) { return key, nil })
 	defer cache.Close()
 
-	cache.Init(backend, ml.DTypeF16, 16)
+	cache.Init(backend, ml.DTypeF16, 1, 16, 16)
 
 	tests := []testCase{
 		{
@@ -263,6 +410,246 @@ func TestCopy(t *testing.T) {
 	testCache(t, backend, cache, tests)
 }
 
+func TestSWAEviction(t *testing.T) {
+	backend := &testBackend{}
+	cache := NewSWACache(2, nil)
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF32, 2, 64, 4)
+
+	// the window of both sequences and a batch
+	if cache.Capacity != 2*2+4 {
+		t.Fatalf("Capacity: have %v; want %v", cache.Capacity, 2*2+4)
+	}
+
+	// value returns the value stored for the token of seq at pos, tokens of
+	// the prefix are shared by both sequences
+	value := func(seq int, pos int32) float32 {
+		if pos < 4 {
+			seq = 0
+		}
+		return float32(100*seq) + float32(pos) + 1
+	}
+
+	owners, positions := make(map[float32][]int), make(map[float32]int32)
+	forward := func(seqs []int, pos []int32) {
+		t.Helper()
+
+		ctx := backend.NewContext()
+		defer ctx.Close()
+
+		if err := cache.StartForward(ctx, pos, seqs); err != nil {
+			t.Fatal(err)
+		}
+
+		in := make([]float32, len(pos))
+		for i := range pos {
+			in[i] = value(seqs[i], pos[i])
+			owners[in[i]], positions[in[i]] = []int{seqs[i]}, pos[i]
+		}
+
+		cache.SetLayer(0)
+		tensor, _ := ctx.FromFloatSlice(in, 1, 1, len(in))
+		cache.Put(ctx, tensor, tensor)
+
+		out, _, mask := cache.Get(ctx)
+		values, masks := out.Floats(), mask.Floats()
+
+		// every token in the window, and only those, must be visible
+		for i := range pos {
+			var visible int
+			for j, v := range values {
+				want := slices.Contains(owners[v], seqs[i]) && positions[v] <= pos[i] && positions[v] >= pos[i]-2
+				if got := masks[i*len(values)+j] == 0; got != want {
+					t.Errorf("seq %v pos %v: mask of %v is %v", seqs[i], pos[i], v, masks[i*len(values)+j])
+				} else if got {
+					visible++
+				}
+			}
+
+			if want := min(3, int(pos[i])+1); visible != want {
+				t.Errorf("seq %v pos %v: %v visible tokens; want %v", seqs[i], pos[i], visible, want)
+			}
+		}
+	}
+
+	forward([]int{0, 0, 0, 0}, []int32{0, 1, 2, 3})
+
+	cache.CopyPrefix(0, 1, 4)
+	for v := range owners {
+		owners[v] = []int{0, 1}
+	}
+
+	// generate past 4 times the window for both sequences at once
+	for pos := int32(4); pos < 12; pos++ {
+		forward([]int{0, 1}, []int32{pos, pos})
+	}
+
+	// resuming from pos attends to the tokens in the window before it
+	if !cache.CanResume(0, 12) || !cache.CanResume(1, 11) {
+		t.Error("CanResume: have false for tokens within the window; want true")
+	}
+
+	if cache.CanResume(0, 10) || cache.CanResume(1, 1) {
+		t.Error("CanResume: have true for evicted tokens; want false")
+	}
+}
+
+func TestWrapperHybrid(t *testing.T) {
+	backend := &testBackend{}
+	shift := func(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
+		return key.Add(ctx, shift), nil
+	}
+
+	// layer 0 uses a sliding window and layer 1 global attention
+	cache := NewWrapperCache(NewSWACache(1, shift), NewCausalCache(shift))
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF32, 1, 16, 4)
+
+	inf := float32(math.Inf(-1))
+	forward := func(in []float32, pos []int32, want [2][]float32, wantMask [2][]float32) {
+		t.Helper()
+
+		ctx := backend.NewContext()
+		defer ctx.Close()
+
+		if err := cache.StartForward(ctx, pos, slices.Repeat([]int{0}, len(pos))); err != nil {
+			t.Fatal(err)
+		}
+
+		for layer := range 2 {
+			cache.SetLayer(layer)
+			cache.SetLayerType(layer)
+
+			tensor, _ := ctx.FromFloatSlice(in, 1, 1, len(in))
+			cache.Put(ctx, tensor, tensor)
+
+			out, _, mask := cache.Get(ctx)
+			if !slices.Equal(out.Floats(), want[layer]) || !slices.Equal(mask.Floats(), wantMask[layer]) {
+				t.Errorf("layer %d: have %v mask %v; want %v mask %v", layer, out.Floats(), mask.Floats(), want[layer], wantMask[layer])
+			}
+		}
+	}
+
+	forward([]float32{1, 2, 3}, []int32{0, 1, 2},
+		[2][]float32{{1, 2, 3}, {1, 2, 3}},
+		[2][]float32{
+			{0, inf, inf, 0, 0, inf, inf, 0, 0},
+			{0, inf, inf, 0, 0, inf, 0, 0, 0},
+		})
+
+	// both caches shift the token after the removed one, which the shift
+	// function changes from 3 to 2. the new token takes the place of the
+	// removed one, or of the first token once it is out of the window.
+	if err := cache.Remove(0, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	forward([]float32{4}, []int32{2},
+		[2][]float32{{4, 2, 2}, {1, 4, 2}},
+		[2][]float32{
+			{0, inf, 0},
+			{0, 0, 0},
+		})
+}
+
+func TestSnapshot(t *testing.T) {
+	backend := &testBackend{}
+	inf := float32(math.Inf(-1))
+
+	newCache := func(dtype ml.DType) *Causal {
+		cache := NewCausalCache(nil)
+		cache.Init(backend, dtype, 2, 16, 16)
+		t.Cleanup(cache.Close)
+		return cache
+	}
+
+	src := newCache(ml.DTypeF16)
+
+	// the cells of the sequences are interleaved so that each cell of
+	// sequence 0 is copied separately
+	testCache(t, backend, src, []testCase{
+		{
+			name:          "Interleaved",
+			in:            []float32{1, 101, 2, 102, 3},
+			inShape:       []int{1, 1, 5},
+			seqs:          []int{0, 1, 0, 1, 0},
+			pos:           []int32{0, 0, 1, 1, 2},
+			expected:      []float32{1, 101, 2, 102, 3},
+			expectedShape: []int{1, 1, 5},
+			expectedMask: []float32{
+				0, inf, inf, inf, inf,
+				inf, 0, inf, inf, inf,
+				0, inf, 0, inf, inf,
+				inf, 0, inf, 0, inf,
+				0, inf, 0, inf, 0,
+			},
+		},
+	})
+
+	var b bytes.Buffer
+	if err := src.SaveSequence(&b, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.SaveSequence(&bytes.Buffer{}, 2, 2); err == nil {
+		t.Error("SaveSequence of an empty sequence: have no error; want error")
+	}
+
+	snapshot := b.Bytes()
+
+	t.Run("Mismatch", func(t *testing.T) {
+		if err := newCache(ml.DTypeF32).LoadSequence(bytes.NewReader(snapshot), 0); !errors.Is(err, ErrSnapshotMismatch) {
+			t.Errorf("LoadSequence: have %v; want %v", err, ErrSnapshotMismatch)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		dst := newCache(ml.DTypeF16)
+		if err := dst.LoadSequence(bytes.NewReader(snapshot[:len(snapshot)-1]), 0); err == nil {
+			t.Error("LoadSequence: have no error; want error")
+		}
+
+		if _, ok := dst.cellRanges[0]; ok {
+			t.Error("LoadSequence: sequence is not empty after error")
+		}
+	})
+
+	// the loaded sequence continues after the tokens before the end of the
+	// snapshot, next to the tokens of another sequence
+	dst := newCache(ml.DTypeF16)
+	testCache(t, backend, dst, []testCase{
+		{
+			name:          "Other",
+			in:            []float32{201},
+			inShape:       []int{1, 1, 1},
+			seqs:          []int{1},
+			pos:           []int32{0},
+			expected:      []float32{201},
+			expectedShape: []int{1, 1, 1},
+			expectedMask:  []float32{0},
+		},
+	})
+
+	if err := dst.LoadSequence(bytes.NewReader(snapshot), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	testCache(t, backend, dst, []testCase{
+		{
+			name:          "Continue",
+			in:            []float32{4},
+			inShape:       []int{1, 1, 1},
+			seqs:          []int{0},
+			pos:           []int32{2},
+			expected:      []float32{1, 2, 4},
+			expectedShape: []int{1, 1, 3},
+			expectedMask:  []float32{0, 0, 0},
+		},
+	})
+}
+
 func testCache(t *testing.T, backend ml.Backend, cache Cache, tests []testCase) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -305,6 +692,18 @@ func (b *testBackend) NewContext() ml.Context {
 	return &testContext{}
 }
 
+func (b *testBackend) SupportsFlashAttention(headDim int) bool {
+	return false
+}
+
+func (b *testBackend) DeviceMemory() (free, total uint64) {
+	return 0, 0
+}
+
+func (b *testBackend) Workspace() uint64 {
+	return 0
+}
+
 func (b *testBackend) SystemInfo() string {
 	return "not implemented"
 }
@@ -386,6 +785,22 @@ func (t *testTensor) Bytes() []byte {
 	panic("not implemented")
 }
 
+func (t *testTensor) ReadAt(p []byte, off int64) (int, error) {
+	for i := range len(p) / t.elementSize {
+		binary.LittleEndian.PutUint32(p[i*t.elementSize:], math.Float32bits(t.data[int(off)/t.elementSize+i]))
+	}
+
+	return len(p), nil
+}
+
+func (t *testTensor) WriteAt(p []byte, off int64) (int, error) {
+	for i := range len(p) / t.elementSize {
+		t.data[int(off)/t.elementSize+i] = math.Float32frombits(binary.LittleEndian.Uint32(p[i*t.elementSize:]))
+	}
+
+	return len(p), nil
+}
+
 func (t *testTensor) Floats() []float32 {
 	out := make([]float32, len(t.data))
 	copy(out, t.data)
@@ -438,6 +853,22 @@ func (t *testTensor) RoPE(ctx ml.Context, positionIDs, ropeFactors ml.Tensor, di
 	panic("not implemented")
 }
 
+func (t *testTensor) TopK(ctx ml.Context, k int) (ml.Tensor, ml.Tensor) {
+	panic("not implemented")
+}
+
+func (t *testTensor) ArgSort(ctx ml.Context, descending bool) ml.Tensor {
+	panic("not implemented")
+}
+
+func (t *testTensor) RoPEScaled(ctx ml.Context, positionIDs, ropeFactors ml.Tensor, dim uint32, base float32, scaling ml.RoPEScaling) ml.Tensor {
+	panic("not implemented")
+}
+
+func (t *testTensor) Clamp(ctx ml.Context, min, max float32) ml.Tensor {
+	panic("not implemented")
+}
+
 func (t *testTensor) Tanh(ctx ml.Context) ml.Tensor {
 	panic("not implemented")
 }
@@ -446,10 +877,18 @@ func (t *testTensor) GELU(ctx ml.Context) ml.Tensor {
 	panic("not implemented")
 }
 
+func (t *testTensor) RELU(ctx ml.Context) ml.Tensor {
+	panic("not implemented")
+}
+
 func (t *testTensor) SILU(ctx ml.Context) ml.Tensor {
 	panic("not implemented")
 }
 
+func (t *testTensor) Sigmoid(ctx ml.Context) ml.Tensor {
+	panic("not implemented")
+}
+
 func (t *testTensor) Reshape(ctx ml.Context, shape ...int) ml.Tensor {
 	panic("not implemented")
 }
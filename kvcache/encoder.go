@@ -39,7 +39,7 @@ func NewEncoderCache() *EncoderCache {
 	return &EncoderCache{}
 }
 
-func (c *EncoderCache) Init(backend ml.Backend, dtype ml.DType, capacity int32) {
+func (c *EncoderCache) Init(backend ml.Backend, dtype ml.DType, maxSequences int, capacity int32, maxBatch int) {
 	c.cacheCtx = backend.NewContext()
 }
 
@@ -88,6 +88,12 @@ func (c *EncoderCache) CopyPrefix(srcSeq, dstSeq int, len int32) {
 	panic("encoder cache does not support multiple sequences")
 }
 
+// CanResume always succeeds as the encoder output is kept until it is
+// removed
+func (c *EncoderCache) CanResume(seq int, pos int32) bool {
+	return true
+}
+
 func (c *EncoderCache) Remove(seq int, beginIndex, endIndex int32) error {
 	if c.encoderPos >= beginIndex && c.encoderPos < endIndex {
 		c.encoderCached = false
@@ -1,13 +1,16 @@
 package kvcache
 
 import (
+	"io"
 	"math"
 
 	"github.com/ollama/ollama/ml"
 )
 
 // Wrapper cache is a container for multiple types of caches,
-// such as for the encoding and decoding portions of a model.
+// such as for the encoding and decoding portions of a model, or
+// for layers with sliding window and global attention. Models
+// select the cache of each layer with SetLayerType.
 type WrapperCache struct {
 	// caches we are wrapping
 	caches []Cache
@@ -22,9 +25,20 @@ func NewWrapperCache(caches ...Cache) *WrapperCache {
 	}
 }
 
-func (c *WrapperCache) Init(backend ml.Backend, dtype ml.DType, capacity int32) {
+func (c *WrapperCache) SinkTokens() int32 {
+	var sinks int32
 	for _, cache := range c.caches {
-		cache.Init(backend, dtype, capacity)
+		if cache, ok := cache.(Sinks); ok {
+			sinks = max(sinks, cache.SinkTokens())
+		}
+	}
+
+	return sinks
+}
+
+func (c *WrapperCache) Init(backend ml.Backend, dtype ml.DType, maxSequences int, capacity int32, maxBatch int) {
+	for _, cache := range c.caches {
+		cache.Init(backend, dtype, maxSequences, capacity, maxBatch)
 	}
 }
 
@@ -70,6 +84,14 @@ func (c *WrapperCache) Get(ctx ml.Context) (ml.Tensor, ml.Tensor, ml.Tensor) {
 	return c.caches[c.curType].Get(ctx)
 }
 
+func (c *WrapperCache) MaskedQueries() ml.Tensor {
+	if cache, ok := c.caches[c.curType].(MaskedQueries); ok {
+		return cache.MaskedQueries()
+	}
+
+	return nil
+}
+
 func (c *WrapperCache) Put(ctx ml.Context, key, value ml.Tensor) {
 	c.caches[c.curType].Put(ctx, key, value)
 }
@@ -80,6 +102,16 @@ func (c *WrapperCache) CopyPrefix(srcSeq, dstSeq int, len int32) {
 	}
 }
 
+func (c *WrapperCache) CanResume(seq int, pos int32) bool {
+	for _, cache := range c.caches {
+		if !cache.CanResume(seq, pos) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (c *WrapperCache) Remove(seq int, beginIndex, endIndex int32) error {
 	// If the one of these fails, the caller is supposed to retry with endIndex set to math.MaxInt32, which should not fail
 	for _, cache := range c.caches {
@@ -91,3 +123,53 @@ func (c *WrapperCache) Remove(seq int, beginIndex, endIndex int32) error {
 
 	return nil
 }
+
+// snapshots returns the caches as Snapshots, or ErrNotSupported if any of
+// them can't be saved, such as those of encoders
+func (c *WrapperCache) snapshots() ([]Snapshot, error) {
+	snapshots := make([]Snapshot, len(c.caches))
+	for i, cache := range c.caches {
+		s, ok := cache.(Snapshot)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+
+		snapshots[i] = s
+	}
+
+	return snapshots, nil
+}
+
+func (c *WrapperCache) SaveSequence(w io.Writer, seq int, end int32) error {
+	snapshots, err := c.snapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range snapshots {
+		if err := s.SaveSequence(w, seq, end); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *WrapperCache) LoadSequence(r io.Reader, seq int) error {
+	snapshots, err := c.snapshots()
+	if err != nil {
+		return err
+	}
+
+	for i, s := range snapshots {
+		if err := s.LoadSequence(r, seq); err != nil {
+			// keep the caches consistent, removing everything does not fail
+			for _, cache := range c.caches[:i] {
+				_ = cache.Remove(seq, 0, math.MaxInt32)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -39,6 +39,7 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"runtime"
 	"runtime/cgo"
@@ -634,6 +635,19 @@ type SamplingParams struct {
 	PenalizeNl     bool
 	Seed           uint32
 	Grammar        string
+
+	// LogitBias adds biases to logits by token id. A bias of -100 or less
+	// bans a token, and one of 100 or more restricts sampling to the tokens
+	// with such a bias.
+	LogitBias map[int]float32
+
+	// DRY penalizes tokens that extend repeated sequences, which llama.cpp
+	// ends at the tokens of the model that contain DRYSequenceBreakers
+	DRYMultiplier       float32
+	DRYBase             float32
+	DRYAllowedLength    int
+	DRYPenaltyLastN     int
+	DRYSequenceBreakers []string
 }
 
 func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext, error) {
@@ -646,7 +660,11 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	cparams.penalty_last_n = C.int32_t(params.RepeatLastN)
 	cparams.penalty_repeat = C.float(params.PenaltyRepeat)
 	cparams.penalty_freq = C.float(params.PenaltyFreq)
-	cparams.penalty_present = C.float(params.PenaltyFreq)
+	cparams.penalty_present = C.float(params.PenaltyPresent)
+	cparams.dry_multiplier = C.float(params.DRYMultiplier)
+	cparams.dry_base = C.float(params.DRYBase)
+	cparams.dry_allowed_length = C.int32_t(params.DRYAllowedLength)
+	cparams.dry_penalty_last_n = C.int32_t(params.DRYPenaltyLastN)
 	cparams.mirostat = C.int32_t(params.Mirostat)
 	cparams.mirostat_tau = C.float(params.MirostatTau)
 	cparams.mirostat_eta = C.float(params.MirostatEta)
@@ -656,6 +674,32 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	defer C.free(unsafe.Pointer(grammar))
 
 	cparams.grammar = grammar
+
+	// the sampler copies the biases
+	if biases := logitBiases(params.LogitBias, model.NumVocab()); len(biases) > 0 {
+		p := (*C.struct_llama_logit_bias)(C.malloc(C.size_t(len(biases)) * C.size_t(unsafe.Sizeof(C.struct_llama_logit_bias{}))))
+		defer C.free(unsafe.Pointer(p))
+
+		copy(unsafe.Slice(p, len(biases)), biases)
+		cparams.logit_bias = p
+		cparams.n_logit_bias = C.int32_t(len(biases))
+	}
+
+	// the sampler copies the sequence breakers too
+	if n := len(params.DRYSequenceBreakers); n > 0 {
+		p := (**C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+		defer C.free(unsafe.Pointer(p))
+
+		breakers := unsafe.Slice(p, n)
+		for i, breaker := range params.DRYSequenceBreakers {
+			breakers[i] = C.CString(breaker)
+			defer C.free(unsafe.Pointer(breakers[i]))
+		}
+
+		cparams.dry_sequence_breakers = p
+		cparams.n_dry_sequence_breakers = C.int32_t(n)
+	}
+
 	context := &SamplingContext{c: C.common_sampler_cinit(model.c, &cparams)}
 	if context.c == nil {
 		return nil, errors.New("unable to create sampling context")
@@ -666,6 +710,35 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	return context, nil
 }
 
+// logitBiases returns the biases of llama.cpp for bias, where banned tokens
+// have a bias of -Inf, as do all but the forced tokens if there are any
+func logitBiases(bias map[int]float32, numVocab int) []C.struct_llama_logit_bias {
+	var forced []int
+	var biases []C.struct_llama_logit_bias
+	for id, b := range bias {
+		switch {
+		case id < 0 || id >= numVocab:
+		case b <= -100:
+			biases = append(biases, C.struct_llama_logit_bias{token: C.llama_token(id), bias: C.float(math.Inf(-1))})
+		case b >= 100:
+			forced = append(forced, id)
+		default:
+			biases = append(biases, C.struct_llama_logit_bias{token: C.llama_token(id), bias: C.float(b)})
+		}
+	}
+
+	if len(forced) > 0 {
+		biases = biases[:0]
+		for id := range numVocab {
+			if !slices.Contains(forced, id) {
+				biases = append(biases, C.struct_llama_logit_bias{token: C.llama_token(id), bias: C.float(math.Inf(-1))})
+			}
+		}
+	}
+
+	return biases
+}
+
 func (s *SamplingContext) Reset() {
 	C.common_sampler_creset(s.c)
 }
@@ -15,11 +15,19 @@ struct common_sampler *common_sampler_cinit(const struct llama_model *model, str
         sparams.penalty_repeat = params->penalty_repeat;
         sparams.penalty_freq = params->penalty_freq;
         sparams.penalty_present = params->penalty_present;
+        sparams.dry_multiplier = params->dry_multiplier;
+        sparams.dry_base = params->dry_base;
+        sparams.dry_allowed_length = params->dry_allowed_length;
+        sparams.dry_penalty_last_n = params->dry_penalty_last_n;
+        sparams.dry_sequence_breakers.assign(params->dry_sequence_breakers, params->dry_sequence_breakers + params->n_dry_sequence_breakers);
         sparams.mirostat = params->mirostat;
         sparams.mirostat_tau = params->mirostat_tau;
         sparams.mirostat_eta = params->mirostat_eta;
         sparams.seed = params->seed;
         sparams.grammar = params->grammar;
+        if (params->n_logit_bias > 0) {
+            sparams.logit_bias.assign(params->logit_bias, params->logit_bias + params->n_logit_bias);
+        }
         sparams.xtc_probability = 0.0;
         sparams.xtc_threshold = 0.5;
         return common_sampler_init(model, sparams);
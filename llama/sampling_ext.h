@@ -20,11 +20,19 @@ extern "C"
         float penalty_repeat;
         float penalty_freq;
         float penalty_present;
+        float dry_multiplier;
+        float dry_base;
+        int32_t dry_allowed_length;
+        int32_t dry_penalty_last_n;
+        const char **dry_sequence_breakers;
+        int32_t n_dry_sequence_breakers;
         int32_t mirostat;
         float mirostat_tau;
         float mirostat_eta;
         uint32_t seed;
         char *grammar;
+        const struct llama_logit_bias *logit_bias;
+        int32_t n_logit_bias;
     };
 
     struct common_sampler *common_sampler_cinit(const struct llama_model *model, struct common_sampler_cparams *params);
@@ -12,15 +12,17 @@ import (
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/nn"
 )
 
 // This algorithm looks for a complete fit to determine if we need to unload other models
-func PredictServerFit(allGpus discover.GpuInfoList, f *ggml.GGML, adapters, projectors []string, opts api.Options) (bool, uint64) {
+func PredictServerFit(allGpus discover.GpuInfoList, f *ggml.GGML, adapters, projectors []string, draft string, opts api.Options, numParallel int) (bool, uint64) {
 	// Split up the GPUs by type and try them
 	var estimatedVRAM uint64
 	for _, gpus := range allGpus.ByLibrary() {
 		var layerCount int
-		estimate := EstimateGPULayers(gpus, f, projectors, opts)
+		estimate := EstimateGPULayers(gpus, f, projectors, draft, opts, numParallel)
 		layerCount, estimatedVRAM = estimate.Layers, estimate.VRAMSize
 		if opts.NumGPU < 0 {
 			if layerCount > 0 && layerCount >= int(f.KV().BlockCount()+1) {
@@ -67,11 +69,13 @@ type MemoryEstimate struct {
 	graphPartialOffload uint64
 
 	projectorWeights, projectorGraph uint64
+
+	draftWeights, draftKV, draftGraph uint64
 }
 
 // Given a model and one or more GPU targets, predict how many layers and bytes we can load, and the total size
 // The GPUs provided must all be the same Library
-func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []string, opts api.Options) MemoryEstimate {
+func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []string, draft string, opts api.Options, numParallel int) MemoryEstimate {
 	// Graph size for a partial offload, applies to all GPUs
 	var graphPartialOffload uint64
 
@@ -85,6 +89,9 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	var projectorWeights uint64
 	var projectorGraph uint64
 
+	// Draft model loaded into GPU0 only
+	var draftWeights, draftKV, draftGraph uint64
+
 	// Conditional output size on GPU 0
 	var memoryLayerOutput uint64
 
@@ -116,25 +123,68 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 		opts.NumCtx = max(opts.NumCtx, 2048)
 	}
 
+	// weights placed on the CPU by the user don't use GPU memory. They are
+	// already validated when the server starts.
+	var placement []ml.TensorPlacement
+	if envconfig.NewEngine() {
+		placement, _ = ml.ParseTensorPlacement(opts.TensorPlacement)
+	}
+
+	// The size of the weights placed on the CPU
+	var memoryCPUWeights uint64
+
+	// gpuSize returns the size of the weights of a layer that are placed on
+	// GPUs, if they fit
+	gpuSize := func(layer ggml.Layer) (size uint64) {
+		for _, t := range layer {
+			if ml.TensorDevice(placement, t.Name) != "cpu" {
+				size += t.Size()
+			}
+		}
+
+		return size
+	}
+
 	layers := f.Tensors().GroupLayers()
+	for _, layer := range layers {
+		memoryCPUWeights += layer.Size() - gpuSize(layer)
+	}
+
 	// add one layer worth of memory as a buffer
 	if blk0, ok := layers["blk.0"]; ok {
-		layerSize = blk0.Size()
+		layerSize = gpuSize(blk0)
 	} else {
 		slog.Warn("model missing blk.0 layer size")
 	}
 
-	var kvct string
-	if envconfig.FlashAttention() &&
+	flashAttention := envconfig.FlashAttention() &&
 		discover.GetGPUInfo().FlashAttentionSupported() &&
-		f.SupportsFlashAttention() {
+		f.SupportsFlashAttention()
+
+	var kvct string
+	if envconfig.NewEngine() || flashAttention {
 		requested := strings.ToLower(envconfig.KvCacheType())
 		if requested != "" && f.SupportsKVCacheType(requested) {
 			kvct = requested
 		}
 	}
 
+	// the attention scores of the new engine are bounded by the memory of the
+	// smallest device, as in the backend
+	var workspace uint64
+	for _, gpu := range gpus {
+		if w := ml.WorkspaceMemory(gpu.TotalMemory); w > 0 && (workspace == 0 || w < workspace) {
+			workspace = w
+		}
+	}
+
 	kv, graphPartialOffload, graphFullOffload := f.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), kvct)
+	if envconfig.NewEngine() {
+		// the graphs of the new engine are built from the same layers for
+		// all models, so their size is estimated from the configuration
+		estimate := nn.TransformerMemory(f.KV(), numParallel, min(opts.NumCtx, opts.NumBatch), opts.NumCtx, kvCacheType(kvct), flashAttention, workspace)
+		kv, graphPartialOffload, graphFullOffload = estimate.KV, estimate.Graph, estimate.Graph
+	}
 
 	// KV is proportional to the number of layers
 	layerSize += kv / f.KV().BlockCount()
@@ -155,16 +205,20 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	}
 
 	if layer, ok := layers["output_norm"]; ok {
-		memoryLayerOutput += layer.Size()
+		memoryLayerOutput += gpuSize(layer)
 	}
 	if layer, ok := layers["output"]; ok {
-		memoryLayerOutput += layer.Size()
+		memoryLayerOutput += gpuSize(layer)
 	} else if layer, ok := layers["token_embd"]; ok {
-		memoryLayerOutput += layer.Size()
+		memoryLayerOutput += gpuSize(layer)
+	}
+
+	if draft != "" {
+		draftWeights, draftKV, draftGraph = draftMemoryRequirements(draft, opts, numParallel, kvct, flashAttention, workspace)
 	}
 
 	// Output layer handled at the end if we have space
-	gpuZeroOverhead := projectorWeights + projectorGraph
+	gpuZeroOverhead := projectorWeights + projectorGraph + draftWeights + draftKV + draftGraph
 
 	// Reduce set of GPUs to only those that have sufficient space to fit overhead and at least one layer
 	var layerCount int
@@ -207,13 +261,16 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	if len(gpusWithSpace) > 0 {
 		gpuZeroID = gpusWithSpace[0].i
 		gpuAllocations[gpuZeroID] += gpuZeroOverhead
+	} else {
+		// the draft model is loaded into system memory with the model
+		overflow += draftWeights + draftKV + draftGraph
 	}
 
 	// For all the layers, find where they can fit on the GPU(s)
 	for i := range int(f.KV().BlockCount()) {
 		// Some models have inconsistent layer sizes
 		if blk, ok := layers[fmt.Sprintf("blk.%d", i)]; ok {
-			layerSize = blk.Size()
+			layerSize = gpuSize(blk)
 			layerSize += kv / f.KV().BlockCount()
 		}
 		memoryWeights += layerSize
@@ -286,7 +343,8 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 	for i := range gpuAllocations {
 		memoryRequiredPartial += gpuAllocations[i]
 	}
-	memoryRequiredTotal = memoryRequiredPartial + overflow
+	memoryRequiredTotal = memoryRequiredPartial + overflow + memoryCPUWeights
+	memoryWeights += memoryCPUWeights
 
 	tensorSplit := ""
 	if len(gpus) > 1 {
@@ -320,6 +378,9 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 		graphPartialOffload: graphPartialOffload,
 		projectorWeights:    projectorWeights,
 		projectorGraph:      projectorGraph,
+		draftWeights:        draftWeights,
+		draftKV:             draftKV,
+		draftGraph:          draftGraph,
 	}
 
 	if gpus[0].Library == "cpu" {
@@ -395,9 +456,31 @@ func (m MemoryEstimate) LogValue() slog.Value {
 		))
 	}
 
+	if m.draftWeights > 0 {
+		attrs = append(attrs, slog.Group(
+			"draft",
+			"weights", format.HumanBytes2(m.draftWeights),
+			"kv", format.HumanBytes2(m.draftKV),
+			"graph", format.HumanBytes2(m.draftGraph),
+		))
+	}
+
 	return slog.GroupValue(attrs...)
 }
 
+// kvCacheType returns the dtype of the KV cache type kvct, as used by the
+// runner
+func kvCacheType(kvct string) ml.DType {
+	switch kvct {
+	case "q8_0":
+		return ml.DTypeQ80
+	case "q4_0":
+		return ml.DTypeQ40
+	default:
+		return ml.DTypeF16
+	}
+}
+
 func projectorMemoryRequirements(filename string) (weights, graphSize uint64) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -446,3 +529,26 @@ func projectorMemoryRequirements(filename string) (weights, graphSize uint64) {
 
 	return weights, graphSize
 }
+
+// draftMemoryRequirements returns the memory of the draft model in filename,
+// which has a cache of the same size and type as the model and is always loaded
+// by the new engine. workspace is that of nn.TransformerMemory.
+func draftMemoryRequirements(filename string, opts api.Options, numParallel int, kvct string, flashAttention bool, workspace uint64) (weights, kv, graphSize uint64) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, 0
+	}
+	defer file.Close()
+
+	f, _, err := ggml.Decode(file, 0)
+	if err != nil {
+		return 0, 0, 0
+	}
+
+	for _, layer := range f.Tensors().GroupLayers() {
+		weights += layer.Size()
+	}
+
+	estimate := nn.TransformerMemory(f.KV(), numParallel, min(opts.NumCtx, opts.NumBatch), opts.NumCtx, kvCacheType(kvct), flashAttention, workspace)
+	return weights, estimate.KV, estimate.Graph
+}
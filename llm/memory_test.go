@@ -61,7 +61,7 @@ func TestEstimateGPULayers(t *testing.T) {
 	projectors := []string{}
 	opts := api.DefaultOptions()
 	t.Run("cpu", func(t *testing.T) {
-		estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
+		estimate := EstimateGPULayers(gpus, ggml, projectors, "", opts, 1)
 		assert.Equal(t, 0, estimate.Layers)
 		assert.Equal(t, uint64(0), estimate.Graph)
 	})
@@ -112,7 +112,7 @@ func TestEstimateGPULayers(t *testing.T) {
 			gpus[1].FreeMemory += gpuMinimumMemory + layerSize + s.layer1*layerSize + 1
 			gpus[0].FreeMemory += max(graphFullOffload, graphPartialOffload)
 			gpus[1].FreeMemory += max(graphFullOffload, graphPartialOffload)
-			estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
+			estimate := EstimateGPULayers(gpus, ggml, projectors, "", opts, 1)
 			assert.Equal(t, int(s.expect0+s.expect1), estimate.Layers, "scenario %d: %v", i, s)
 			assert.Equal(t, fmt.Sprintf("%d,%d", s.expect0, s.expect1), estimate.TensorSplit, "scenario %d: %v", i, s)
 			var layerSums uint64
@@ -128,4 +128,40 @@ func TestEstimateGPULayers(t *testing.T) {
 			}
 		})
 	}
+	t.Run("tensor placement", func(t *testing.T) {
+		t.Setenv("OLLAMA_NEW_ENGINE", "1")
+
+		gpus[0].FreeMemory, gpus[1].FreeMemory = 1<<32, 0
+
+		full := EstimateGPULayers(gpus, ggml, projectors, "", opts, 1)
+
+		opts := opts
+		opts.TensorPlacement = "blk.0.*=gpu,blk.*.attn.weight=cpu"
+		split := EstimateGPULayers(gpus, ggml, projectors, "", opts, 1)
+
+		// four layers of attention weights stay on the CPU, but still count
+		// toward the total
+		assert.Equal(t, inputLayerCount+1, split.Layers)
+		assert.Equal(t, full.VRAMSize-4*4, split.VRAMSize)
+		assert.Equal(t, full.TotalSize, split.TotalSize)
+	})
+
+	t.Run("draft", func(t *testing.T) {
+		gpus[0].FreeMemory, gpus[1].FreeMemory = 1<<32, 0
+
+		// the model is its own draft model
+		full := EstimateGPULayers(gpus, ggml, projectors, "", opts, 1)
+		draft := EstimateGPULayers(gpus, ggml, projectors, f.Name(), opts, 1)
+
+		assert.Equal(t, uint64(6*4), draft.draftWeights)
+		assert.Positive(t, draft.draftKV)
+		assert.Equal(t, full.Layers, draft.Layers)
+		assert.Equal(t, full.VRAMSize+draft.draftWeights+draft.draftKV+draft.draftGraph, draft.VRAMSize)
+
+		// without a GPU, the draft model needs system memory
+		cpu := []discover.GpuInfo{{Library: "cpu"}}
+		full = EstimateGPULayers(cpu, ggml, projectors, "", opts, 1)
+		draft = EstimateGPULayers(cpu, ggml, projectors, f.Name(), opts, 1)
+		assert.Equal(t, full.TotalSize+draft.draftWeights+draft.draftKV+draft.draftGraph, draft.TotalSize)
+	})
 }
@@ -22,27 +22,33 @@ import (
 	"sync"
 	"time"
 
-	"golang.org/x/sync/semaphore"
-
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/runner/common"
+	"github.com/ollama/ollama/sample"
 )
 
 type LlamaServer interface {
 	Ping(ctx context.Context) error
 	WaitUntilRunning(ctx context.Context) error
 	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
-	Embedding(ctx context.Context, input string) ([]float32, error)
+	Embed(ctx context.Context, inputs []string, pooling string) ([][]float32, error)
+	Score(ctx context.Context, input string) ([]float32, error)
+	SaveSession(ctx context.Context, req SessionRequest) (int, error)
+	LoadSession(ctx context.Context, req SessionRequest) (int, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
+	Encode(ctx context.Context, req TokenizeRequest) (*TokenizeResponse, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
 	Close() error
 	EstimatedVRAM() uint64 // Total VRAM across all GPUs
 	EstimatedTotal() uint64
 	EstimatedVRAMByGPU(gpuID string) uint64
+	Waiting() map[common.Priority]int // Requests of each priority waiting for the runner
 }
 
 // llmServer is an instance of the llama.cpp server
@@ -64,7 +70,9 @@ type llmServer struct {
 	loadDuration time.Duration        // Record how long it took the model to load
 	loadProgress float32
 
-	sem *semaphore.Weighted
+	// sem limits the requests to the runner to numParallel of each
+	// priority, as the runner preempts those of lower priorities
+	sem *common.PrioritySemaphore
 }
 
 // LoadModel will load a model from disk. The model must be in the GGML format.
@@ -89,7 +97,7 @@ func LoadModel(model string, maxArraySize int) (*ggml.GGML, error) {
 
 // NewLlamaServer will run a server for the given GPUs
 // The gpu list must be a single family.
-func NewLlamaServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
+func NewLlamaServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters, projectors []string, draft string, opts api.Options, numParallel int) (LlamaServer, error) {
 	systemInfo := discover.GetSystemInfo()
 	systemTotalMemory := systemInfo.System.TotalMemory
 	systemFreeMemory := systemInfo.System.FreeMemory
@@ -101,7 +109,22 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapt
 		gpus = discover.GetCPUInfo()
 	}
 
-	estimate := EstimateGPULayers(gpus, f, projectors, opts)
+	if opts.TensorPlacement != "" {
+		if !envconfig.NewEngine() {
+			return nil, errors.New("tensor_placement requires the new engine")
+		}
+
+		if _, err := ml.ParseTensorPlacement(opts.TensorPlacement); err != nil {
+			return nil, err
+		}
+	}
+
+	if draft != "" && !envconfig.NewEngine() {
+		slog.Warn("draft models require the new engine, disabling speculative decoding")
+		draft = ""
+	}
+
+	estimate := EstimateGPULayers(gpus, f, projectors, draft, opts, numParallel)
 	if len(gpus) > 1 || gpus[0].Library != "cpu" {
 		switch {
 		case gpus[0].Library == "metal" && estimate.VRAMSize > systemTotalMemory:
@@ -147,6 +170,10 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapt
 		params = append(params, "--main-gpu", strconv.Itoa(opts.MainGPU))
 	}
 
+	if opts.TensorPlacement != "" {
+		params = append(params, "--tensor-placement", opts.TensorPlacement)
+	}
+
 	if len(adapters) > 0 {
 		for _, adapter := range adapters {
 			params = append(params, "--lora", adapter)
@@ -158,6 +185,10 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapt
 		params = append(params, "--mmproj", projectors[0])
 	}
 
+	if draft != "" {
+		params = append(params, "--draft-model", draft)
+	}
+
 	defaultThreads := systemInfo.GetOptimalThreadCount()
 	if opts.NumThread > 0 {
 		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
@@ -189,6 +220,9 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapt
 		} else {
 			slog.Warn("kv cache type not supported by model", "type", kvct)
 		}
+	} else if envconfig.NewEngine() && kvct != "" && f.SupportsKVCacheType(kvct) {
+		// the Ollama engine can quantize the kv cache without flash attention
+		params = append(params, "--kv-cache-type", kvct)
 	} else if kvct != "" && kvct != "f16" {
 		slog.Warn("quantized kv cache requested but flash attention disabled", "type", kvct)
 	}
@@ -333,7 +367,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapt
 			modelPath:   model,
 			estimate:    estimate,
 			numParallel: numParallel,
-			sem:         semaphore.NewWeighted(int64(numParallel)),
+			sem:         common.NewPrioritySemaphore(int64(numParallel), true),
 			totalLayers: f.KV().BlockCount() + 1,
 			gpus:        gpus,
 			done:        make(chan error, 1),
@@ -644,17 +678,24 @@ type ImageData struct {
 }
 
 type completion struct {
-	Content      string `json:"content"`
-	Model        string `json:"model"`
-	Prompt       string `json:"prompt"`
-	Stop         bool   `json:"stop"`
-	StoppedLimit bool   `json:"stopped_limit"`
+	Content      string             `json:"content"`
+	Error        string             `json:"error"`
+	Logprobs     []api.Logprob      `json:"logprobs"`
+	Sequences    []api.BeamSequence `json:"sequences"`
+	Model        string             `json:"model"`
+	Prompt       string             `json:"prompt"`
+	Stop         bool               `json:"stop"`
+	StoppedLimit bool               `json:"stopped_limit"`
 
 	Timings struct {
 		PredictedN  int     `json:"predicted_n"`
 		PredictedMS float64 `json:"predicted_ms"`
 		PromptN     int     `json:"prompt_n"`
 		PromptMS    float64 `json:"prompt_ms"`
+		CacheN      int     `json:"cache_n"`
+
+		DraftN         int `json:"draft_n"`
+		DraftAcceptedN int `json:"draft_n_accepted"`
 	}
 }
 
@@ -663,41 +704,62 @@ type CompletionRequest struct {
 	Format  json.RawMessage
 	Images  []ImageData
 	Options *api.Options
+
+	// Queued, if non-nil, is called with the position of the request in
+	// the queue if it has to wait for the runner
+	Queued func(position int)
 }
 
 type CompletionResponse struct {
 	Content            string
+	Logprobs           []api.Logprob
+	Sequences          []api.BeamSequence
 	DoneReason         string
 	Done               bool
 	PromptEvalCount    int
 	PromptEvalDuration time.Duration
+	PromptCacheCount   int
 	EvalCount          int
 	EvalDuration       time.Duration
+	DraftCount         int
+	DraftAcceptedCount int
 }
 
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
 	request := map[string]any{
-		"prompt":            req.Prompt,
-		"stream":            true,
-		"n_predict":         req.Options.NumPredict,
-		"n_keep":            req.Options.NumKeep,
-		"main_gpu":          req.Options.MainGPU,
-		"temperature":       req.Options.Temperature,
-		"top_k":             req.Options.TopK,
-		"top_p":             req.Options.TopP,
-		"min_p":             req.Options.MinP,
-		"typical_p":         req.Options.TypicalP,
-		"repeat_last_n":     req.Options.RepeatLastN,
-		"repeat_penalty":    req.Options.RepeatPenalty,
-		"presence_penalty":  req.Options.PresencePenalty,
-		"frequency_penalty": req.Options.FrequencyPenalty,
-		"mirostat":          req.Options.Mirostat,
-		"mirostat_tau":      req.Options.MirostatTau,
-		"mirostat_eta":      req.Options.MirostatEta,
-		"seed":              req.Options.Seed,
-		"stop":              req.Options.Stop,
-		"image_data":        req.Images,
-		"cache_prompt":      true,
+		"prompt":                req.Prompt,
+		"stream":                true,
+		"n_predict":             req.Options.NumPredict,
+		"n_keep":                req.Options.NumKeep,
+		"context_shift":         req.Options.ContextShift,
+		"main_gpu":              req.Options.MainGPU,
+		"temperature":           req.Options.Temperature,
+		"top_k":                 req.Options.TopK,
+		"top_p":                 req.Options.TopP,
+		"min_p":                 req.Options.MinP,
+		"typical_p":             req.Options.TypicalP,
+		"repeat_last_n":         req.Options.RepeatLastN,
+		"repeat_penalty":        req.Options.RepeatPenalty,
+		"presence_penalty":      req.Options.PresencePenalty,
+		"frequency_penalty":     req.Options.FrequencyPenalty,
+		"mirostat":              req.Options.Mirostat,
+		"mirostat_tau":          req.Options.MirostatTau,
+		"mirostat_eta":          req.Options.MirostatEta,
+		"seed":                  req.Options.Seed,
+		"stop":                  req.Options.Stop,
+		"dry_multiplier":        req.Options.DRYMultiplier,
+		"dry_base":              req.Options.DRYBase,
+		"dry_allowed_length":    req.Options.DRYAllowedLength,
+		"dry_penalty_last_n":    req.Options.DRYPenaltyLastN,
+		"dry_sequence_breakers": req.Options.DRYSequenceBreakers,
+		"logprobs":              req.Options.Logprobs,
+		"top_logprobs":          req.Options.TopLogprobs,
+		"logprobs_temperature":  req.Options.LogprobsTemperature,
+		"num_beams":             req.Options.NumBeams,
+		"return_sequences":      req.Options.ReturnSequences,
+		"num_draft":             req.Options.NumDraft,
+		"image_data":            req.Images,
+		"cache_prompt":          true,
 	}
 
 	if len(req.Format) > 0 {
@@ -713,16 +775,29 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				return fmt.Errorf("invalid format: %q; expected \"json\" or a valid JSON Schema object", req.Format)
 			}
 
-			// User provided a JSON schema
-			g := llama.SchemaToGrammar(req.Format)
-			if g == nil {
-				return fmt.Errorf("invalid JSON schema in format")
+			// User provided a JSON schema, which falls back to JSON
+			// if it can't be enforced
+			g, err := sample.SchemaGrammar(req.Format)
+			var uerr *sample.UnsupportedSchemaError
+			switch {
+			case errors.As(err, &uerr):
+				slog.Warn("JSON schema in format is not supported, falling back to JSON", "error", err)
+				g = grammarJSON
+			case err != nil:
+				return fmt.Errorf("invalid JSON schema in format: %w", err)
 			}
-			request["grammar"] = string(g)
+			request["grammar"] = g
 		}
 	}
 
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+	// the grammar of the model or request applies only without a format
+	if _, ok := request["grammar"]; !ok && req.Options.Grammar != "" {
+		request["grammar"] = req.Options.Grammar
+	}
+
+	priority, since := common.PriorityFrom(ctx)
+	admitted, err := s.sem.AcquireQueued(ctx, 1, priority, since, req.Queued)
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -730,7 +805,11 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		}
 		return err
 	}
-	defer s.sem.Release(1)
+	defer s.sem.Release(1, admitted)
+
+	// the runner orders the requests that wait for a place in its batch
+	// by the priority that this one was admitted with
+	request["priority"] = admitted
 
 	// put an upper limit on num_predict to avoid the model running on forever
 	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
@@ -745,6 +824,14 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
+	if len(req.Options.LogitBias) > 0 {
+		logitBias, err := s.logitBias(ctx, req.Options.LogitBias)
+		if err != nil {
+			return err
+		}
+		request["logit_bias"] = logitBias
+	}
+
 	// Handling JSON marshaling with special characters unescaped.
 	buffer := &bytes.Buffer{}
 	enc := json.NewEncoder(buffer)
@@ -805,6 +892,12 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			if err := json.Unmarshal(evt, &c); err != nil {
 				return fmt.Errorf("error unmarshalling llm prediction response: %v", err)
 			}
+
+			// the runner fails the requests of a batch that the model
+			// can't process without stopping
+			if c.Error != "" {
+				return fmt.Errorf("an error was encountered while running the model: %s", c.Error)
+			}
 			switch {
 			case strings.TrimSpace(c.Content) == lastToken:
 				tokenRepeat++
@@ -819,9 +912,10 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				return ctx.Err()
 			}
 
-			if c.Content != "" {
+			if c.Content != "" || len(c.Logprobs) > 0 {
 				fn(CompletionResponse{
-					Content: c.Content,
+					Content:  c.Content,
+					Logprobs: c.Logprobs,
 				})
 			}
 
@@ -832,12 +926,16 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				}
 
 				fn(CompletionResponse{
+					Sequences:          c.Sequences,
 					Done:               true,
 					DoneReason:         doneReason,
 					PromptEvalCount:    c.Timings.PromptN,
 					PromptEvalDuration: parseDurationMs(c.Timings.PromptMS),
+					PromptCacheCount:   c.Timings.CacheN,
 					EvalCount:          c.Timings.PredictedN,
 					EvalDuration:       parseDurationMs(c.Timings.PredictedMS),
+					DraftCount:         c.Timings.DraftN,
+					DraftAcceptedCount: c.Timings.DraftAcceptedN,
 				})
 				return nil
 			}
@@ -863,15 +961,24 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 }
 
 type EmbeddingRequest struct {
-	Content string `json:"content"`
+	Contents []string `json:"contents"`
+	Pooling  string   `json:"pooling,omitempty"`
+
+	Priority common.Priority `json:"priority,omitempty"`
 }
 
 type EmbeddingResponse struct {
-	Embedding []float32 `json:"embedding"`
+	Embeddings [][]float32 `json:"embeddings"`
 }
 
-func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, error) {
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+// Embed computes the embeddings of inputs in a single request, so that the
+// runner can process them together rather than one at a time. The embeddings
+// are in the order of inputs. pooling, if not empty, overrides the pooling of
+// the model.
+func (s *llmServer) Embed(ctx context.Context, inputs []string, pooling string) ([][]float32, error) {
+	priority, since := common.PriorityFrom(ctx)
+	admitted, err := s.sem.Acquire(ctx, 1, priority, since)
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting embedding request due to client closing the connection")
 		} else {
@@ -879,7 +986,7 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		}
 		return nil, err
 	}
-	defer s.sem.Release(1)
+	defer s.sem.Release(1, admitted)
 
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
@@ -889,7 +996,7 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
-	data, err := json.Marshal(EmbeddingRequest{Content: input})
+	data, err := json.Marshal(EmbeddingRequest{Contents: inputs, Pooling: pooling, Priority: admitted})
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling embed data: %w", err)
 	}
@@ -918,25 +1025,246 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 
 	var e EmbeddingResponse
 	if err := json.Unmarshal(body, &e); err != nil {
-		return nil, fmt.Errorf("unmarshal tokenize response: %w", err)
+		return nil, fmt.Errorf("unmarshal embedding response: %w", err)
+	}
+
+	if len(e.Embeddings) != len(inputs) {
+		return nil, fmt.Errorf("runner returned %d embeddings for %d inputs", len(e.Embeddings), len(inputs))
+	}
+
+	return e.Embeddings, nil
+}
+
+type ScoreRequest struct {
+	Content string `json:"content"`
+}
+
+type ScoreResponse struct {
+	Scores []float32 `json:"scores"`
+}
+
+// Score returns the scores of the classification head of the model for
+// input, such as the relevance of a query and document pair for a reranker
+func (s *llmServer) Score(ctx context.Context, input string) ([]float32, error) {
+	priority, since := common.PriorityFrom(ctx)
+	admitted, err := s.sem.Acquire(ctx, 1, priority, since)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting score request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire semaphore", "error", err)
+		}
+		return nil, err
+	}
+	defer s.sem.Release(1, admitted)
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return nil, err
+	} else if status != ServerStatusReady {
+		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	data, err := json.Marshal(ScoreRequest{Content: input})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling score data: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/score", s.port), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("error creating score request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("do score request: %w", err)
 	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading score response: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.New("model runner does not support scoring")
+	} else if resp.StatusCode >= 400 {
+		log.Printf("llm score error: %s", body)
+		return nil, fmt.Errorf("%s", body)
+	}
+
+	var sr ScoreResponse
+	if err := json.Unmarshal(body, &sr); err != nil {
+		return nil, fmt.Errorf("unmarshal score response: %w", err)
+	}
+
+	return sr.Scores, nil
+}
+
+// ErrInvalidSession is returned when loading a session that was saved for a
+// different model or type of KV cache
+var ErrInvalidSession = errors.New("invalid session")
+
+// sessionError is the message of the runner for a session that it rejected
+type sessionError string
+
+func (e sessionError) Error() string {
+	return string(e)
+}
+
+func (e sessionError) Is(target error) bool {
+	return target == ErrInvalidSession
+}
+
+type SessionRequest struct {
+	// Path is the file of the session
+	Path string `json:"path"`
+
+	// Digest identifies the model, which a session must be loaded by
+	Digest string `json:"digest"`
 
-	return e.Embedding, nil
+	// Prompt selects the longest cached prefix of it to save. If empty, all
+	// of the inputs that were cached for the last request are saved.
+	Prompt string `json:"prompt,omitempty"`
+}
+
+type SessionResponse struct {
+	Inputs int `json:"inputs"`
+}
+
+// SaveSession writes the cached inputs of a prompt and their KV cache to a
+// file, returning the number of inputs that were saved
+func (s *llmServer) SaveSession(ctx context.Context, req SessionRequest) (int, error) {
+	return s.session(ctx, "save", req)
+}
+
+// LoadSession loads a file written by SaveSession into the KV cache, so that
+// prompts that start with its inputs continue from them without processing
+// them again. Returns the number of inputs that were loaded.
+func (s *llmServer) LoadSession(ctx context.Context, req SessionRequest) (int, error) {
+	return s.session(ctx, "load", req)
+}
+
+func (s *llmServer) session(ctx context.Context, op string, req SessionRequest) (int, error) {
+	priority, since := common.PriorityFrom(ctx)
+	admitted, err := s.sem.Acquire(ctx, 1, priority, since)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting session request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire semaphore", "error", err)
+		}
+		return 0, err
+	}
+	defer s.sem.Release(1, admitted)
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return 0, err
+	} else if status != ServerStatusReady {
+		return 0, fmt.Errorf("unexpected server status: %s", status.ToString())
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling session data: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/session/%s", s.port, op), bytes.NewBuffer(data))
+	if err != nil {
+		return 0, fmt.Errorf("error creating session request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return 0, fmt.Errorf("do session request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading session response: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return 0, errors.New("model runner does not support sessions")
+	case resp.StatusCode == http.StatusBadRequest:
+		return 0, sessionError(bytes.TrimSpace(body))
+	case resp.StatusCode >= 400:
+		log.Printf("llm session error: %s", body)
+		return 0, fmt.Errorf("%s", body)
+	}
+
+	var sr SessionResponse
+	if err := json.Unmarshal(body, &sr); err != nil {
+		return 0, fmt.Errorf("unmarshal session response: %w", err)
+	}
+
+	return sr.Inputs, nil
 }
 
 type TokenizeRequest struct {
 	Content string `json:"content"`
+
+	// AddSpecial adds the special tokens that the model adds to the start
+	// of a prompt, such as BOS
+	AddSpecial bool `json:"add_special,omitempty"`
+
+	// Pieces returns the text of each token as well as its id
+	Pieces bool `json:"pieces,omitempty"`
 }
 
 type TokenizeResponse struct {
-	Tokens []int `json:"tokens"`
+	Tokens []int    `json:"tokens"`
+	Pieces []string `json:"pieces,omitempty"`
+}
+
+// logitBias returns the biases of logit_bias by token id, tokenizing keys that
+// aren't token ids, which must be a single token of the model
+func (s *llmServer) logitBias(ctx context.Context, bias map[string]float32) (map[string]float32, error) {
+	ids := make(map[string]float32, len(bias))
+	for key, b := range bias {
+		if id, err := strconv.ParseInt(key, 10, 32); err == nil {
+			ids[strconv.FormatInt(id, 10)] += b
+			continue
+		}
+
+		tokens, err := s.Tokenize(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(tokens) != 1 {
+			return nil, fmt.Errorf("logit_bias %q is %d tokens; expected a single token", key, len(tokens))
+		}
+
+		ids[strconv.Itoa(tokens[0])] += b
+	}
+
+	return ids, nil
 }
 
 func (s *llmServer) Tokenize(ctx context.Context, content string) ([]int, error) {
+	resp, err := s.Encode(ctx, TokenizeRequest{Content: content})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Tokens, nil
+}
+
+// Encode tokenizes the content of req with the tokenizer of the model, which
+// is that of the runner, without needing a slot for a sequence
+func (s *llmServer) Encode(ctx context.Context, req TokenizeRequest) (*TokenizeResponse, error) {
 	s.modelLock.Lock()
 	defer s.modelLock.Unlock()
 	if s.model != nil {
-		return s.model.Tokenize(content, false, true)
+		return encode(s.model, req)
 	}
 
 	// Make sure the server is ready
@@ -947,18 +1275,18 @@ func (s *llmServer) Tokenize(ctx context.Context, content string) ([]int, error)
 		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
-	data, err := json.Marshal(TokenizeRequest{Content: content})
+	data, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling encode data: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/tokenize", s.port), bytes.NewBuffer(data))
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/tokenize", s.port), bytes.NewBuffer(data))
 	if err != nil {
 		return nil, fmt.Errorf("encode request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := http.DefaultClient.Do(r)
 	if err != nil {
 		return nil, fmt.Errorf("do encode request: %w", err)
 	}
@@ -972,7 +1300,7 @@ func (s *llmServer) Tokenize(ctx context.Context, content string) ([]int, error)
 			}
 			s.model = m
 		}
-		return s.model.Tokenize(content, false, true)
+		return encode(s.model, req)
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -990,7 +1318,25 @@ func (s *llmServer) Tokenize(ctx context.Context, content string) ([]int, error)
 		return nil, fmt.Errorf("unmarshal encode response: %w", err)
 	}
 
-	return encoded.Tokens, nil
+	return &encoded, nil
+}
+
+// encode tokenizes the content of req with the vocabulary of m
+func encode(m *llama.Model, req TokenizeRequest) (*TokenizeResponse, error) {
+	tokens, err := m.Tokenize(req.Content, req.AddSpecial, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := TokenizeResponse{Tokens: tokens}
+	if req.Pieces {
+		resp.Pieces = make([]string, len(tokens))
+		for i, token := range tokens {
+			resp.Pieces[i] = m.TokenToPiece(token)
+		}
+	}
+
+	return &resp, nil
 }
 
 type DetokenizeRequest struct {
@@ -1005,11 +1351,7 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 	s.modelLock.Lock()
 	defer s.modelLock.Unlock()
 	if s.model != nil {
-		var resp string
-		for _, token := range tokens {
-			resp += s.model.TokenToPiece(token)
-		}
-		return resp, nil
+		return decode(s.model, tokens)
 	}
 	// Make sure the server is ready
 	status, err := s.getServerStatus(ctx)
@@ -1044,11 +1386,7 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 			}
 			s.model = m
 		}
-		var resp string
-		for _, token := range tokens {
-			resp += s.model.TokenToPiece(token)
-		}
-		return resp, nil
+		return decode(s.model, tokens)
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -1069,6 +1407,20 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 	return decoded.Content, nil
 }
 
+// decode converts tokens to text with the vocabulary of m
+func decode(m *llama.Model, tokens []int) (string, error) {
+	var sb strings.Builder
+	for _, token := range tokens {
+		if token < 0 || token >= m.NumVocab() {
+			return "", fmt.Errorf("invalid token %d", token)
+		}
+
+		sb.WriteString(m.TokenToPiece(token))
+	}
+
+	return sb.String(), nil
+}
+
 func (s *llmServer) Close() error {
 	s.modelLock.Lock()
 	if s.model != nil {
@@ -1113,6 +1465,10 @@ func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
 	return 0
 }
 
+func (s *llmServer) Waiting() map[common.Priority]int {
+	return s.sem.Waiting()
+}
+
 func parseDurationMs(ms float64) time.Duration {
 	dur, err := time.ParseDuration(fmt.Sprintf("%fms", ms))
 	if err != nil {
@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"strings"
 	"testing"
 
 	"github.com/ollama/ollama/api"
-	"golang.org/x/sync/semaphore"
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/runner/common"
+	"github.com/ollama/ollama/sample"
 )
 
 func TestLLMServerCompletionFormat(t *testing.T) {
@@ -18,7 +21,7 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &llmServer{
-		sem: semaphore.NewWeighted(1), // required to prevent nil panic
+		sem: common.NewPrioritySemaphore(1, false), // required to prevent nil panic
 	}
 
 	checkInvalid := func(format string) {
@@ -37,6 +40,14 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 	checkInvalid("X")   // invalid format
 	checkInvalid(`"X"`) // invalid JSON Schema
 
+	err := s.Completion(ctx, CompletionRequest{
+		Options: new(api.Options),
+		Format:  []byte(`{"type":"list"}`),
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid JSON schema in format") {
+		t.Fatalf("err = %v; want invalid JSON schema", err)
+	}
+
 	cancel() // prevent further processing if request makes it past the format check
 
 	checkValid := func(err error) {
@@ -55,6 +66,9 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 		// JSON
 		`"json"`,
 		`{"type":"object"}`,
+
+		// falls back to JSON
+		`{"type":"string","pattern":"^a"}`,
 	}
 	for _, valid := range valids {
 		err := s.Completion(ctx, CompletionRequest{
@@ -64,9 +78,32 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 		checkValid(err)
 	}
 
-	err := s.Completion(ctx, CompletionRequest{
+	err = s.Completion(ctx, CompletionRequest{
 		Options: new(api.Options),
 		Format:  nil, // missing format
 	}, nil)
 	checkValid(err)
 }
+
+func TestLLMServerCompletionGrammar(t *testing.T) {
+	// the grammars of formats are also parsed by the new engine
+	for _, g := range []string{grammarJSON, string(llama.SchemaToGrammar([]byte(`{"type":"object","properties":{"date":{"type":"string","format":"date"}}}`)))} {
+		if _, err := sample.ParseGrammar(g); err != nil {
+			t.Errorf("%v\n%s", err, g)
+		}
+	}
+}
+
+func TestLLMServerLogitBias(t *testing.T) {
+	s := &llmServer{}
+
+	// token ids aren't tokenized, and the same id in different forms adds up
+	got, err := s.logitBias(context.Background(), map[string]float32{"12": 1, "012": 2, "-1": -100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]float32{"12": 3, "-1": -100}; !maps.Equal(got, want) {
+		t.Errorf("logit bias = %v; want %v", got, want)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -24,6 +26,29 @@ type Backend interface {
 	Get(name string) Tensor
 	NewContext() Context
 	SystemInfo() string
+
+	// SupportsFlashAttention reports whether flash attention is enabled and
+	// supported for attention heads of size headDim on all of the devices
+	// used by the backend
+	SupportsFlashAttention(headDim int) bool
+
+	// DeviceMemory returns the free and total memory of the GPUs used by the
+	// backend, or of the CPU if there are none
+	DeviceMemory() (free, total uint64)
+
+	// Workspace returns the memory that the intermediate tensors of a single
+	// operation may use, or 0 if it isn't known. See WorkspaceMemory.
+	Workspace() uint64
+}
+
+// GraphMemory is the memory a model needs in addition to its weights
+type GraphMemory struct {
+	// KV is the size of the KV cache of all layers
+	KV uint64
+
+	// Graph is the size of the compute buffers for the largest batch, such
+	// as the attention logits
+	Graph uint64
 }
 
 // BackendParams controls how the backend loads and executes models
@@ -39,6 +64,75 @@ type BackendParams struct {
 
 	// TensorSplit is the fraction of the model to offload to each GPU
 	TensorSplit []float32
+
+	// FlashAttention computes fused attention with flash attention kernels
+	// where they are supported
+	FlashAttention bool
+
+	// KVCacheType is the dtype of the KV cache, which defaults to F16. It is
+	// only used to estimate memory.
+	KVCacheType DType
+
+	// TensorPlacement places weights on devices by name. Weights that don't
+	// match any rule are placed as if there were no rules, and the KV cache
+	// stays on the GPU regardless.
+	TensorPlacement []TensorPlacement
+}
+
+// TensorPlacement places the weights whose names match Pattern, as in
+// path.Match, on Device, which is "cpu" or "gpu"
+type TensorPlacement struct {
+	Pattern string
+	Device  string
+}
+
+// placementAliases are patterns for groups of weights that are named the same
+// in all architectures
+var placementAliases = map[string]string{
+	// the weights of the experts of mixture of experts models, but not their
+	// routers, which are small and needed by every token
+	"experts": "blk.*.ffn_*_exps.*",
+}
+
+// ParseTensorPlacement parses a comma separated list of pattern=device rules,
+// such as "experts=cpu,output.weight=gpu". A pattern may be "experts" for the
+// expert weights of mixture of experts models.
+func ParseTensorPlacement(s string) ([]TensorPlacement, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var placement []TensorPlacement
+	for _, rule := range strings.Split(s, ",") {
+		pattern, device, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok || (device != "cpu" && device != "gpu") {
+			return nil, fmt.Errorf("invalid tensor placement %q, expected pattern=cpu or pattern=gpu", rule)
+		}
+
+		if alias, ok := placementAliases[pattern]; ok {
+			pattern = alias
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid tensor placement pattern %q: %w", pattern, err)
+		}
+
+		placement = append(placement, TensorPlacement{Pattern: pattern, Device: device})
+	}
+
+	return placement, nil
+}
+
+// TensorDevice returns the device of the first rule of placement that matches
+// name, or "" if none do
+func TensorDevice(placement []TensorPlacement, name string) string {
+	for _, p := range placement {
+		if ok, _ := path.Match(p.Pattern, name); ok {
+			return p.Device
+		}
+	}
+
+	return ""
 }
 
 var backends = make(map[string]func(*os.File, BackendParams) (Backend, error))
@@ -70,6 +164,42 @@ type Context interface {
 	Close()
 }
 
+// FlashAttention is implemented by contexts whose ScaledDotProductAttention
+// may use flash attention kernels. These kernels typically only support some
+// head sizes, so attention with other head sizes should be computed without
+// the fused implementation when flash attention is enabled.
+type FlashAttention interface {
+	FlashAttentionEnabled() bool
+	SupportsFlashAttention(headDim int) bool
+}
+
+// Workspace is implemented by contexts that know how much memory the
+// intermediate tensors of a single operation of their graphs, such as the
+// attention scores of a layer, may use. It's typically WorkspaceMemory of the
+// smallest device used by the backend.
+type Workspace interface {
+	Workspace() uint64
+}
+
+// WorkspaceMemory returns the size in bytes that the intermediate tensors of a
+// single operation may use on a device with total bytes of memory. The rest is
+// left to the weights, the cache and the other tensors of the graph.
+func WorkspaceMemory(total uint64) uint64 {
+	return total / 16
+}
+
+// Dropout is implemented by contexts whose backend generates the masks of
+// inverted dropout as part of the graph, rather than on the host. See
+// nn.AttentionWithDropout.
+type Dropout interface {
+	// DropoutMask returns an F32 tensor with the given shape whose elements
+	// are 1/(1-p), or 0 with probability p. Each element is kept if the top
+	// 32 bits of SplitMix64(seed + (i+1)·0x9e3779b97f4a7c15), for its index i
+	// in row-major order, are at least p·2³², so that the same seed gives
+	// the same mask on every backend.
+	DropoutMask(seed uint64, p float64, shape ...int) Tensor
+}
+
 type Tensor interface {
 	Dim(n int) int
 	Stride(n int) int
@@ -85,30 +215,76 @@ type Tensor interface {
 	Mulmat(ctx Context, t2 Tensor) Tensor
 	MulmatFullPrec(ctx Context, t2 Tensor) Tensor
 
+	// Softmax normalizes each row along the first dimension. Implementations
+	// must subtract the maximum of each row before exponentiating so that
+	// logits of any finite magnitude don't overflow.
 	Softmax(ctx Context) Tensor
 	LayerNorm(ctx Context, weight, bias Tensor, eps float32) Tensor
 	RMSNorm(ctx Context, weight Tensor, eps float32) Tensor
 	Scale(ctx Context, s float64) Tensor
+	Clamp(ctx Context, min, max float32) Tensor
 
 	Conv2D(ctx Context, weight Tensor, s0, s1, p0, p1, d0, d1 int) Tensor
 	RoPE(ctx Context, positionIDs, ropeFactors Tensor, dim uint32, base, scale float32) Tensor
+	RoPEScaled(ctx Context, positionIDs, ropeFactors Tensor, dim uint32, base float32, scaling RoPEScaling) Tensor
 
 	Tanh(ctx Context) Tensor
 	GELU(ctx Context) Tensor
 	SILU(ctx Context) Tensor
+	RELU(ctx Context) Tensor
+	Sigmoid(ctx Context) Tensor
 
 	Reshape(ctx Context, shape ...int) Tensor
 	View(ctx Context, offset int, shape ...int) Tensor
 	Permute(ctx Context, shape ...int) Tensor
 	Contiguous(ctx Context) Tensor
 
-	Pad(ctx Context, shape ...int) Tensor
-	Unpad(ctx Context, shape ...int) Tensor
+	// Pad appends pads[i] zeros to dimension i, for up to four dimensions,
+	// such as to round the length of the keys up to a multiple of a block
+	// size. Unpad removes them again.
+	Pad(ctx Context, pads ...int) Tensor
+	Unpad(ctx Context, pads ...int) Tensor
 
 	Stack(ctx Context, dim int, s ...Tensor) Tensor
+
+	// Concat appends t2 to t along dimension dim, such as to splice image
+	// embeddings into the embeddings of a prompt along the sequence
+	// dimension. Either tensor may be a non-contiguous view. The other
+	// dimensions and the dtypes of t and t2 must match.
 	Concat(ctx Context, t2 Tensor, dim int) Tensor
 	Rows(ctx Context, t2 Tensor) Tensor
 	Copy(ctx Context, t2 Tensor) Tensor
+
+	// TopK returns the k largest elements of each row along the first
+	// dimension and their I32 indices, from largest to smallest. Equal
+	// elements are ordered as by ArgSort.
+	TopK(ctx Context, k int) (values, indices Tensor)
+
+	// ArgSort returns the I32 indices that sort each row along the first
+	// dimension in ascending order, or descending order if descending is
+	// true. Equal elements are in the order of their indices, so that
+	// sampling is reproducible across devices.
+	ArgSort(ctx Context, descending bool) Tensor
+}
+
+// RoPEScaling are the parameters of rotary position embeddings that extend the
+// context length of a model beyond that of training. RoPE is equivalent to
+// RoPEScaled with only FreqScale set.
+type RoPEScaling struct {
+	// FreqScale multiplies the positions, which is 1/factor for linear and
+	// YaRN scaling
+	FreqScale float32
+
+	// ExtFactor mixes interpolated and extrapolated frequencies as in YaRN,
+	// where 0 only interpolates. AttnFactor scales the magnitude of the
+	// rotated channels, which YaRN further scales by 1 + 0.1 ln(1/FreqScale)
+	// when ExtFactor is non-zero.
+	ExtFactor, AttnFactor float32
+
+	// BetaFast and BetaSlow bound the number of rotations within
+	// OriginalContextLength between which YaRN interpolates
+	BetaFast, BetaSlow    float32
+	OriginalContextLength int
 }
 
 // ScaledDotProductAttention implements a fused attention
@@ -119,6 +295,14 @@ type Tensor interface {
 //
 // kq = kq.Scale(ctx, scale)
 //
+//	if opts.Softcap != 0 {
+//		kq = kq.Scale(ctx, 1/opts.Softcap).Tanh(ctx).Scale(ctx, opts.Softcap)
+//	}
+//
+//	if mask != nil && opts.MaxBias != 0 {
+//		// multiply the mask of head h by nn.ALiBiSlopes(heads, opts.MaxBias)[h]
+//	}
+//
 //	if mask != nil {
 //		kq = kq.Add(ctx, mask)
 //	}
@@ -128,7 +312,67 @@ type Tensor interface {
 // kqv := value.Mulmat(ctx, kq)
 // return kqv.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
 type ScaledDotProductAttention interface {
-	ScaledDotProductAttention(ctx Context, key, value, mask Tensor, scale float64) Tensor
+	ScaledDotProductAttention(ctx Context, key, value, mask Tensor, scale float64, opts AttentionOptions) Tensor
+}
+
+// AttentionOptions are optional parameters of scaled dot product attention
+// that fused implementations must honor. The zero value is plain attention.
+type AttentionOptions struct {
+	// Softcap caps the scaled attention logits to softcap * tanh(logits / softcap)
+	// before the mask is added. Zero disables capping.
+	Softcap float64
+
+	// MaxBias enables attention with linear biases (ALiBi). The mask is
+	// multiplied by a per-head slope derived from MaxBias, as computed by
+	// nn.ALiBiSlopes, before it is added to the logits. Zero disables ALiBi.
+	MaxBias float64
+
+	// FullPrec multiplies the attention weights and values with the same
+	// precision as MulmatFullPrec rather than Mulmat.
+	FullPrec bool
+}
+
+// MulmatID is implemented by tensors of stacked matrices, such as the
+// weights of the experts of a mixture of experts, to multiply only the
+// matrices selected for each column. For t with shape [K, M, n] and ids with
+// shape [k, N] selecting among the n matrices, it is equivalent to the
+// following code, where t2 has shape [K, k, N] or [K, 1, N] if all selected
+// matrices multiply the same column:
+//
+//	for i := range N {
+//		for j := range k {
+//			out[:, j, i] = t[:, :, ids[j, i]].Mulmat(ctx, t2[:, j or 0, i])
+//		}
+//	}
+//
+// The result has shape [M, k, N].
+type MulmatID interface {
+	MulmatID(ctx Context, t2, ids Tensor) Tensor
+}
+
+// GELUErf is implemented by tensors whose backend can compute GELU exactly as
+// x·Φ(x) = 0.5·x·(1 + erf(x/√2)), rather than the tanh approximation of
+// Tensor.GELU. See nn.GELUExact.
+type GELUErf interface {
+	GELUErf(ctx Context) Tensor
+}
+
+// IsContiguous is implemented by tensors that can report whether their
+// elements are stored in order without gaps, as they are after
+// Tensor.Contiguous. Changes of layout that don't move any elements of such
+// tensors can then be done with Tensor.Reshape instead of a copy.
+type IsContiguous interface {
+	IsContiguous() bool
+}
+
+// TensorData is implemented by tensors whose bytes can be copied directly to
+// and from host memory, without computing a graph, such as to save the KV
+// cache to disk. Offsets are in bytes from the start of the tensor, which
+// must have been allocated, as by Context.Zeros. Implementations wait for
+// graphs that are still being computed before copying.
+type TensorData interface {
+	io.ReaderAt
+	io.WriterAt
 }
 
 type number interface {
@@ -238,4 +482,23 @@ const (
 	DTypeF32
 	DTypeF16
 	DTypeI32
+	DTypeQ80
+	DTypeQ40
 )
+
+func (d DType) String() string {
+	switch d {
+	case DTypeF32:
+		return "F32"
+	case DTypeF16:
+		return "F16"
+	case DTypeI32:
+		return "I32"
+	case DTypeQ80:
+		return "Q80"
+	case DTypeQ40:
+		return "Q40"
+	default:
+		return "Other"
+	}
+}
@@ -0,0 +1,8 @@
+package ggml
+
+import "github.com/ollama/ollama/ml"
+
+// GraphMemory returns the size of the compute buffers of b
+func GraphMemory(b ml.Backend) uint64 {
+	return b.(*Backend).graphMemory()
+}
@@ -2,8 +2,10 @@ package ggml
 
 /*
 #cgo CPPFLAGS: -I${SRCDIR}/ggml/include
+#include <math.h>
 #include <stdlib.h>
 #include <stdint.h>
+#include <string.h>
 #include "ggml.h"
 #include "ggml-cpu.h"
 #include "ggml-backend.h"
@@ -21,13 +23,131 @@ COMPILER inline get_compiler() {
 #endif
 }
 
+
+// gelu_erf computes GELU with erf for the rows of a that are assigned to
+// thread ith of nth. dst is contiguous but a may be a strided view.
+void gelu_erf(struct ggml_tensor * dst, const struct ggml_tensor * a, int ith, int nth, void * userdata) {
+	const int64_t rows = ggml_nrows(a);
+	for (int64_t r = ith; r < rows; r += nth) {
+		const int64_t i1 = r % a->ne[1], i2 = r / a->ne[1] % a->ne[2], i3 = r / (a->ne[1] * a->ne[2]);
+		const char * src = (const char *) a->data + i1*a->nb[1] + i2*a->nb[2] + i3*a->nb[3];
+		float * out = (float *) ((char *) dst->data + i1*dst->nb[1] + i2*dst->nb[2] + i3*dst->nb[3]);
+		for (int64_t i0 = 0; i0 < a->ne[0]; i0++) {
+			const float x = *(const float *) (src + i0*a->nb[0]);
+			out[i0] = 0.5f*x*(1.0f + erff(x*0.70710678118654752440f));
+		}
+	}
+}
+
+// argsort sorts the indices of the rows of src that are assigned to thread ith
+// of nth into dst, with a merge sort that keeps equal elements in the order of
+// their indices. src may be a strided view.
+static void argsort(struct ggml_tensor * dst, const struct ggml_tensor * src, int ith, int nth, int descending) {
+	const int64_t n = src->ne[0];
+	const int64_t rows = ggml_nrows(src);
+	int32_t * tmp = malloc(n * sizeof(int32_t));
+	for (int64_t r = ith; r < rows; r += nth) {
+		const int64_t i1 = r % src->ne[1], i2 = r / src->ne[1] % src->ne[2], i3 = r / (src->ne[1] * src->ne[2]);
+		const char * row = (const char *) src->data + i1*src->nb[1] + i2*src->nb[2] + i3*src->nb[3];
+		int32_t * out = (int32_t *) ((char *) dst->data + i1*dst->nb[1] + i2*dst->nb[2] + i3*dst->nb[3]);
+		for (int64_t i = 0; i < n; i++) {
+			out[i] = i;
+		}
+
+		int32_t * a = out, * b = tmp;
+		for (int64_t width = 1; width < n; width *= 2) {
+			for (int64_t lo = 0; lo < n; lo += 2*width) {
+				const int64_t mid = lo + width < n ? lo + width : n, hi = lo + 2*width < n ? lo + 2*width : n;
+				int64_t i = lo, j = mid, k = lo;
+				while (i < mid && j < hi) {
+					const float x = *(const float *) (row + a[i]*src->nb[0]), y = *(const float *) (row + a[j]*src->nb[0]);
+					b[k++] = (descending ? y > x : y < x) ? a[j++] : a[i++];
+				}
+				while (i < mid) b[k++] = a[i++];
+				while (j < hi) b[k++] = a[j++];
+			}
+
+			int32_t * swap = a; a = b; b = swap;
+		}
+
+		if (a != out) {
+			memcpy(out, a, n * sizeof(int32_t));
+		}
+	}
+	free(tmp);
+}
+
+// top_k selects the indices of the dst->ne[0] largest elements of the rows of
+// b that are assigned to thread ith of nth into dst, from largest to smallest.
+// Later elements only displace earlier ones that are strictly smaller, so
+// equal elements are in the order of their indices as with argsort.
+void top_k(struct ggml_tensor * dst, const struct ggml_tensor * a, const struct ggml_tensor * b, int ith, int nth, void * userdata) {
+	const int64_t n = b->ne[0], k = dst->ne[0];
+	const int64_t rows = ggml_nrows(b);
+	for (int64_t r = ith; r < rows; r += nth) {
+		const int64_t i1 = r % b->ne[1], i2 = r / b->ne[1] % b->ne[2], i3 = r / (b->ne[1] * b->ne[2]);
+		const char * row = (const char *) b->data + i1*b->nb[1] + i2*b->nb[2] + i3*b->nb[3];
+		int32_t * out = (int32_t *) ((char *) dst->data + i1*dst->nb[1] + i2*dst->nb[2] + i3*dst->nb[3]);
+
+		int64_t m = 0;
+		for (int64_t i = 0; i < n; i++) {
+			const float x = *(const float *) (row + i*b->nb[0]);
+			if (m == k && !(x > *(const float *) (row + out[k-1]*b->nb[0]))) {
+				continue;
+			}
+
+			int64_t j = m < k ? m++ : k - 1;
+			for (; j > 0 && x > *(const float *) (row + out[j-1]*b->nb[0]); j--) {
+				out[j] = out[j-1];
+			}
+			out[j] = i;
+		}
+	}
+}
+
+// argsort_asc and argsort_desc sort b into dst, which has the type and shape
+// of a
+void argsort_asc(struct ggml_tensor * dst, const struct ggml_tensor * a, const struct ggml_tensor * b, int ith, int nth, void * userdata) {
+	argsort(dst, b, ith, nth, 0);
+}
+
+void argsort_desc(struct ggml_tensor * dst, const struct ggml_tensor * a, const struct ggml_tensor * b, int ith, int nth, void * userdata) {
+	argsort(dst, b, ith, nth, 1);
+}
+
+// dropout_mask fills the rows of dst, which is contiguous, that are assigned
+// to thread ith of nth with the mask of ml.Dropout. b holds the seed, the
+// threshold of the hashes of kept elements and their value.
+void dropout_mask(struct ggml_tensor * dst, const struct ggml_tensor * a, const struct ggml_tensor * b, int ith, int nth, void * userdata) {
+	const uint32_t * params = (const uint32_t *) b->data;
+	const uint64_t seed = (uint64_t) params[0] | (uint64_t) params[1] << 32;
+	const uint32_t threshold = params[2];
+	float keep;
+	memcpy(&keep, &params[3], sizeof(keep));
+
+	const int64_t n = dst->ne[0];
+	const int64_t rows = ggml_nrows(dst);
+	for (int64_t r = ith; r < rows; r += nth) {
+		float * out = (float *) dst->data + r*n;
+		for (int64_t i = 0; i < n; i++) {
+			uint64_t z = seed + (uint64_t) (r*n + i + 1) * 0x9e3779b97f4a7c15ull;
+			z = (z ^ z >> 30) * 0xbf58476d1ce4e5b9ull;
+			z = (z ^ z >> 27) * 0x94d049bb133111ebull;
+			z = z ^ z >> 31;
+			out[i] = (uint32_t) (z >> 32) >= threshold ? keep : 0;
+		}
+	}
+}
 */
 import "C"
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"os"
 	"sync"
 	"unsafe"
@@ -84,6 +204,18 @@ type Backend struct {
 	tensors    map[string]*Context
 
 	sched *C.struct_ggml_backend_sched
+
+	flashAttention bool
+	kvCacheType    ml.DType
+
+	// flashAttentionHeadDims caches whether flash attention is supported
+	// for each head size
+	flashAttentionMu       sync.Mutex
+	flashAttentionHeadDims map[int]bool
+
+	// workspace is the memory that the intermediate tensors of a single
+	// operation may use, see ml.WorkspaceMemory
+	workspace uint64
 }
 
 func New(r *os.File, params ml.BackendParams) (ml.Backend, error) {
@@ -137,7 +269,12 @@ func New(r *os.File, params ml.BackendParams) (ml.Backend, error) {
 
 	tensors := make(map[*fs.Tensor]*Context, len(meta.Tensors().Items()))
 	for _, t := range meta.Tensors().Items() {
-		c, err := ctxFunc(append(gpus, cpus...))
+		devices := append(gpus, cpus...)
+		if ml.TensorDevice(params.TensorPlacement, t.Name) == "cpu" {
+			devices = cpus
+		}
+
+		c, err := ctxFunc(devices)
 		if err != nil {
 			return nil, err
 		}
@@ -191,7 +328,7 @@ func New(r *os.File, params ml.BackendParams) (ml.Backend, error) {
 		bufts[i] = C.ggml_backend_get_default_buffer_type(c.backend)
 	}
 
-	return &Backend{
+	b := &Backend{
 		meta: meta,
 		cpus: cpus,
 		gpus: gpus,
@@ -199,10 +336,41 @@ func New(r *os.File, params ml.BackendParams) (ml.Backend, error) {
 			(*C.ggml_backend_t)(unsafe.Pointer(&backends[0])),
 			(*C.ggml_backend_buffer_type_t)(unsafe.Pointer(&bufts[0])),
 			C.int(len(backends)),
-			C.size_t(max(8192, len(meta.Tensors().Items())*5)),
+			C.size_t(graphNodes(meta)),
 			true,
 		),
-	}, nil
+		flashAttention:         params.FlashAttention,
+		kvCacheType:            cmp.Or(params.KVCacheType, ml.DTypeF16),
+		flashAttentionHeadDims: make(map[int]bool),
+	}
+
+	// intermediate tensors are bounded by the smallest device as a layer
+	// may be placed on any of them. Devices that don't report their memory
+	// leave the default of nn.Attention.
+	devices := b.gpus
+	if len(devices) == 0 {
+		devices = b.cpus
+	}
+
+	for _, c := range devices {
+		var free, total C.size_t
+		C.ggml_backend_dev_memory(C.ggml_backend_get_device(c.backend), &free, &total)
+		if w := ml.WorkspaceMemory(uint64(total)); w > 0 && (b.workspace == 0 || w < b.workspace) {
+			b.workspace = w
+		}
+	}
+
+	return b, nil
+}
+
+// attentionBlockNodes is the number of nodes that unfused attention may add
+// to the graph of each layer when it processes a large batch in blocks of
+// queries, about 16 for each of up to 64 blocks
+const attentionBlockNodes = 1024
+
+// graphNodes returns the maximum number of nodes of the graphs of the model
+func graphNodes(meta *fs.GGML) int {
+	return max(8192, len(meta.Tensors().Items())*5) + int(meta.KV().BlockCount())*attentionBlockNodes
 }
 
 func init() {
@@ -226,8 +394,86 @@ func (b *Backend) Get(name string) ml.Tensor {
 	return nil
 }
 
+func (b *Backend) DeviceMemory() (free, total uint64) {
+	devices := b.gpus
+	if len(devices) == 0 {
+		devices = b.cpus
+	}
+
+	for _, c := range devices {
+		var f, t C.size_t
+		C.ggml_backend_dev_memory(C.ggml_backend_get_device(c.backend), &f, &t)
+		free += uint64(f)
+		total += uint64(t)
+	}
+
+	return free, total
+}
+
+func (b *Backend) Workspace() uint64 {
+	return b.workspace
+}
+
+// graphMemory returns the size of the compute buffers that the scheduler has
+// allocated for the largest graph computed so far
+func (b *Backend) graphMemory() (size uint64) {
+	for _, c := range append(b.gpus, b.cpus...) {
+		size += uint64(C.ggml_backend_sched_get_buffer_size(b.sched, c.backend))
+	}
+
+	return size
+}
+
+func (b *Backend) SupportsFlashAttention(headDim int) bool {
+	if !b.flashAttention {
+		return false
+	}
+
+	b.flashAttentionMu.Lock()
+	defer b.flashAttentionMu.Unlock()
+
+	if supported, ok := b.flashAttentionHeadDims[headDim]; ok {
+		return supported
+	}
+
+	// ask each device whether it supports a representative flash attention
+	// operation with the same layout as in ScaledDotProductAttention, and
+	// keys and values of the type of the cache if it's quantized
+	c := C.ggml_init(C.struct_ggml_init_params{
+		mem_size: C.size_t(5) * C.ggml_tensor_overhead(),
+		no_alloc: true,
+	})
+	defer C.ggml_free(c)
+
+	var kvType uint32 = C.GGML_TYPE_F16
+	switch b.kvCacheType {
+	case ml.DTypeQ80:
+		kvType = C.GGML_TYPE_Q8_0
+	case ml.DTypeQ40:
+		kvType = C.GGML_TYPE_Q4_0
+	}
+
+	q := C.ggml_new_tensor_3d(c, C.GGML_TYPE_F32, C.int64_t(headDim), 1, 1)
+	k := C.ggml_new_tensor_3d(c, kvType, C.int64_t(headDim), C.GGML_KQ_MASK_PAD, 1)
+	v := C.ggml_new_tensor_3d(c, kvType, C.int64_t(headDim), C.GGML_KQ_MASK_PAD, 1)
+	mask := C.ggml_new_tensor_2d(c, C.GGML_TYPE_F16, C.GGML_KQ_MASK_PAD, C.GGML_KQ_MASK_PAD)
+	op := C.ggml_flash_attn_ext(c, q, k, v, mask, 1, 0, 0)
+	C.ggml_flash_attn_ext_set_prec(op, C.GGML_PREC_F32)
+
+	supported := true
+	for _, d := range append(b.gpus, b.cpus...) {
+		if !C.ggml_backend_supports_op(d.backend, op) {
+			supported = false
+			break
+		}
+	}
+
+	b.flashAttentionHeadDims[headDim] = supported
+	return supported
+}
+
 func (b *Backend) NewContext() ml.Context {
-	nodes := max(8192, len(b.meta.Tensors().Items())*5)
+	nodes := graphNodes(b.meta)
 	c := C.ggml_init(C.struct_ggml_init_params{
 		mem_buffer: nil,
 		mem_size:   C.size_t(nodes)*C.ggml_tensor_overhead() + C.ggml_graph_overhead_custom(C.size_t(nodes), false),
@@ -243,6 +489,7 @@ func (b *Backend) NewContext() ml.Context {
 		b:       b,
 		ctx:     c,
 		backend: backends[0],
+		graph:   C.ggml_new_graph_custom(c, C.size_t(nodes), false),
 		nodes:   nodes,
 	}
 }
@@ -252,16 +499,78 @@ type Context struct {
 	ctx     *C.struct_ggml_context
 	backend *C.struct_ggml_backend
 
+	// graph is shared with contexts returned by Name, which differ only in
+	// the label of the tensors they create
 	graph *C.struct_ggml_cgraph
 	nodes int
+	label string
 }
 
 func (c *Context) Forward(t ml.Tensor) {
-	if c.graph == nil {
-		c.graph = C.ggml_new_graph_custom(c.ctx, C.size_t(c.nodes), false)
+	C.ggml_build_forward_expand(c.graph, t.(*Tensor).t)
+}
+
+func (c *Context) Name(label string) ml.Context {
+	named := *c
+	if named.label != "" {
+		label = named.label + "." + label
 	}
 
-	C.ggml_build_forward_expand(c.graph, t.(*Tensor).t)
+	named.label = label
+	return &named
+}
+
+// Trace returns all tensors created by operations of the context, whether or
+// not they are part of the graph yet, so that a trace can be written for a
+// graph that failed to build
+func (c *Context) Trace() *ml.Trace {
+	var trace ml.Trace
+	ids := make(map[*C.struct_ggml_tensor]int)
+
+	var visit func(t *C.struct_ggml_tensor) int
+	visit = func(t *C.struct_ggml_tensor) int {
+		if id, ok := ids[t]; ok {
+			return id
+		}
+
+		var inputs []int
+		for _, src := range t.src {
+			if src != nil {
+				inputs = append(inputs, visit(src))
+			}
+		}
+
+		tt := Tensor{t: t}
+		id := len(trace.Tensors)
+		ids[t] = id
+		trace.Tensors = append(trace.Tensors, ml.TraceTensor{
+			ID:     id,
+			Op:     C.GoString(C.ggml_op_desc(t)),
+			Name:   C.GoString(C.ggml_get_name(t)),
+			DType:  C.GoString(C.ggml_type_name(t._type)),
+			Shape:  tt.Shape(),
+			Inputs: inputs,
+		})
+		return id
+	}
+
+	for t := C.ggml_get_first_tensor(c.ctx); t != nil; t = C.ggml_get_next_tensor(c.ctx, t) {
+		visit(t)
+	}
+
+	return &trace
+}
+
+// newTensor wraps the result of an operation, labeling it with the label of
+// ctx if there is one
+func newTensor(ctx ml.Context, t *C.struct_ggml_tensor) *Tensor {
+	if label := ctx.(*Context).label; label != "" {
+		name := C.CString(label)
+		defer C.free(unsafe.Pointer(name))
+		C.ggml_set_name(t, name)
+	}
+
+	return &Tensor{t: t}
 }
 
 func (c *Context) Compute(tensors ...ml.Tensor) {
@@ -283,6 +592,41 @@ func (c *Context) Compute(tensors ...ml.Tensor) {
 	}
 }
 
+func (c *Context) FlashAttentionEnabled() bool {
+	return c.b.flashAttention
+}
+
+func (c *Context) SupportsFlashAttention(headDim int) bool {
+	return c.b.SupportsFlashAttention(headDim)
+}
+
+func (c *Context) Workspace() uint64 {
+	return c.b.Workspace()
+}
+
+// DropoutMask generates the mask as a custom operation, whose parameters are
+// passed in a tensor rather than as user data, which can't point to Go
+// memory. Custom operations run on the CPU.
+func (c *Context) DropoutMask(seed uint64, p float64, shape ...int) ml.Tensor {
+	if len(shape) < 1 || len(shape) > 4 {
+		panic("unsupported number of dimensions")
+	}
+
+	threshold := uint32(min(p*(1<<32), math.MaxUint32))
+	params, err := c.FromIntSlice([]int32{
+		int32(uint32(seed)),
+		int32(uint32(seed >> 32)),
+		int32(threshold),
+		int32(math.Float32bits(float32(1 / (1 - p)))),
+	}, 4)
+	if err != nil {
+		panic(err)
+	}
+
+	mask := C.ggml_new_tensor(c.ctx, C.GGML_TYPE_F32, C.int(len(shape)), shapeToGGML(shape))
+	return newTensor(c, C.ggml_map_custom2(c.ctx, mask, params.(*Tensor).t, C.ggml_custom2_op_t(C.dropout_mask), C.GGML_N_TASKS_MAX, nil))
+}
+
 func (c *Context) MaxTensors() int {
 	return c.nodes
 }
@@ -315,6 +659,10 @@ func (c Context) Zeros(dtype ml.DType, shape ...int) ml.Tensor {
 		t = C.ggml_new_tensor(c.ctx, C.GGML_TYPE_F16, C.int(len(shape)), shapeToGGML(shape))
 	case ml.DTypeI32:
 		t = C.ggml_new_tensor(c.ctx, C.GGML_TYPE_I32, C.int(len(shape)), shapeToGGML(shape))
+	case ml.DTypeQ80:
+		t = C.ggml_new_tensor(c.ctx, C.GGML_TYPE_Q8_0, C.int(len(shape)), shapeToGGML(shape))
+	case ml.DTypeQ40:
+		t = C.ggml_new_tensor(c.ctx, C.GGML_TYPE_Q4_0, C.int(len(shape)), shapeToGGML(shape))
 	default:
 		panic("unsupported dtype")
 	}
@@ -322,7 +670,7 @@ func (c Context) Zeros(dtype ml.DType, shape ...int) ml.Tensor {
 	b := C.ggml_backend_alloc_buffer(c.backend, C.ggml_nbytes(t))
 	C.ggml_backend_tensor_alloc(b, t, C.ggml_backend_buffer_get_base(b))
 	C.ggml_set_zero(t)
-	return &Tensor{t: t}
+	return &Tensor{b: c.b, t: t}
 }
 
 func fromSlice[S ~[]E, E float32 | int32](ctx Context, s S, shape []int, dtype uint32) (ml.Tensor, error) {
@@ -364,6 +712,10 @@ func (c *Context) Close() {
 }
 
 type Tensor struct {
+	// b is the backend of tensors that outlive a graph, such as those of the
+	// KV cache, which may still be written by a graph being computed
+	b *Backend
+
 	t    *C.struct_ggml_tensor
 	sync func()
 }
@@ -423,15 +775,17 @@ func (t *Tensor) DType() ml.DType {
 		return ml.DTypeF16
 	case C.GGML_TYPE_I32:
 		return ml.DTypeI32
+	case C.GGML_TYPE_Q8_0:
+		return ml.DTypeQ80
+	case C.GGML_TYPE_Q4_0:
+		return ml.DTypeQ40
 	default:
 		return ml.DTypeOther
 	}
 }
 
 func (t *Tensor) Add(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_add(ctx.(*Context).ctx, t.t, t2.(*Tensor).t),
-	}
+	return newTensor(ctx, C.ggml_add(ctx.(*Context).ctx, t.t, t2.(*Tensor).t))
 }
 
 func (t *Tensor) Stack(ctx ml.Context, dim int, s ...ml.Tensor) ml.Tensor {
@@ -443,40 +797,84 @@ func (t *Tensor) Stack(ctx ml.Context, dim int, s ...ml.Tensor) ml.Tensor {
 }
 
 func (t *Tensor) Concat(ctx ml.Context, t2 ml.Tensor, dim int) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_concat(ctx.(*Context).ctx, t.t, t2.(*Tensor).t, C.int(dim)),
+	a, b := t.t, t2.(*Tensor).t
+	if dim < 0 || dim >= C.GGML_MAX_DIMS {
+		panic(fmt.Errorf("invalid dimension %v to concat", dim))
 	}
+
+	if a._type != b._type {
+		panic(fmt.Errorf("concat of tensors of different types %v and %v", C.GoString(C.ggml_type_name(a._type)), C.GoString(C.ggml_type_name(b._type))))
+	}
+
+	for d := range C.GGML_MAX_DIMS {
+		if d != dim && a.ne[d] != b.ne[d] {
+			panic(fmt.Errorf("concat along dimension %v of tensors with shapes %v and %v that differ in dimension %v", dim, t.Shape(), t2.Shape(), d))
+		}
+	}
+
+	// the kernels only support F32 and I32
+	c := ctx.(*Context)
+	if a._type == C.GGML_TYPE_F16 {
+		a, b = C.ggml_cast(c.ctx, a, C.GGML_TYPE_F32), C.ggml_cast(c.ctx, b, C.GGML_TYPE_F32)
+	}
+
+	out := C.ggml_concat(c.ctx, contiguousRows(c, a), contiguousRows(c, b), C.int(dim))
+	if t.t._type == C.GGML_TYPE_F16 {
+		out = C.ggml_cast(c.ctx, out, C.GGML_TYPE_F16)
+	}
+
+	return newTensor(ctx, out)
+}
+
+// contiguousRows returns t, or a contiguous copy of t if its elements aren't
+// adjacent within rows, which the kernels of operations such as concat and
+// pad require
+func contiguousRows(ctx *Context, t *C.struct_ggml_tensor) *C.struct_ggml_tensor {
+	if t.nb[0] != C.ggml_type_size(t._type) {
+		return C.ggml_cont(ctx.ctx, t)
+	}
+
+	return t
 }
 
+// Contiguous copies t to a contiguous tensor. Quantized tensors, such as
+// permuted views of a quantized cache, are returned as they are, since the
+// CPU backend can't copy them when blocks are split across rows. The
+// operations that take them, such as Mulmat and flash attention, accept views
+// whose rows are intact.
 func (t *Tensor) Contiguous(ctx ml.Context) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_cont(ctx.(*Context).ctx, t.t),
+	if C.ggml_is_quantized(t.t._type) {
+		return t
 	}
+
+	return newTensor(ctx, C.ggml_cont(ctx.(*Context).ctx, t.t))
 }
 
 func (t *Tensor) Mul(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_mul(ctx.(*Context).ctx, t.t, t2.(*Tensor).t),
-	}
+	return newTensor(ctx, C.ggml_mul(ctx.(*Context).ctx, t.t, t2.(*Tensor).t))
 }
 
 func (t *Tensor) Mulmat(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_mul_mat(ctx.(*Context).ctx, t.t, t2.(*Tensor).t),
-	}
+	return newTensor(ctx, C.ggml_mul_mat(ctx.(*Context).ctx, t.t, t2.(*Tensor).t))
 }
 
 func (t *Tensor) MulmatFullPrec(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
 	mul := C.ggml_mul_mat(ctx.(*Context).ctx, t.t, t2.(*Tensor).t)
 	C.ggml_mul_mat_set_prec(mul, C.GGML_PREC_F32)
 
-	return &Tensor{
-		t: mul,
-	}
+	return newTensor(ctx, mul)
+}
+
+func (t *Tensor) MulmatID(ctx ml.Context, t2, ids ml.Tensor) ml.Tensor {
+	return newTensor(ctx, C.ggml_mul_mat_id(ctx.(*Context).ctx, t.t, t2.(*Tensor).t, ids.(*Tensor).t))
 }
 
 func (t *Tensor) LayerNorm(ctx ml.Context, w, b ml.Tensor, eps float32) ml.Tensor {
-	tt := (&Tensor{t: C.ggml_norm(ctx.(*Context).ctx, t.t, C.float(eps))}).Mul(ctx, w)
+	var tt ml.Tensor = newTensor(ctx, C.ggml_norm(ctx.(*Context).ctx, t.t, C.float(eps)))
+	if w != nil {
+		tt = tt.Mul(ctx, w)
+	}
+
 	if b != nil {
 		tt = tt.Add(ctx, b)
 	}
@@ -485,17 +883,46 @@ func (t *Tensor) LayerNorm(ctx ml.Context, w, b ml.Tensor, eps float32) ml.Tenso
 }
 
 func (t *Tensor) RMSNorm(ctx ml.Context, w ml.Tensor, eps float32) ml.Tensor {
-	return (&Tensor{t: C.ggml_rms_norm(ctx.(*Context).ctx, t.t, C.float(eps))}).Mul(ctx, w)
+	var tt ml.Tensor = newTensor(ctx, C.ggml_rms_norm(ctx.(*Context).ctx, t.t, C.float(eps)))
+	if w != nil {
+		tt = tt.Mul(ctx, w)
+	}
+
+	return tt
 }
 
-func (t *Tensor) Pad(ctx ml.Context, shape ...int) ml.Tensor {
-	if len(shape) != 4 {
-		panic("expected 4 dimensions")
+func (t *Tensor) Pad(ctx ml.Context, pads ...int) ml.Tensor {
+	p := padding(pads)
+
+	// the kernels only support F32
+	c := ctx.(*Context)
+	src := t.t
+	if src._type == C.GGML_TYPE_F16 {
+		src = C.ggml_cast(c.ctx, src, C.GGML_TYPE_F32)
+	}
+
+	out := C.ggml_pad(c.ctx, contiguousRows(c, src), C.int(p[0]), C.int(p[1]), C.int(p[2]), C.int(p[3]))
+	if t.t._type == C.GGML_TYPE_F16 {
+		out = C.ggml_cast(c.ctx, out, C.GGML_TYPE_F16)
+	}
+
+	return newTensor(ctx, out)
+}
+
+// padding returns the padding of each of the four dimensions of pads
+func padding(pads []int) (p [C.GGML_MAX_DIMS]int) {
+	if len(pads) > len(p) {
+		panic(fmt.Errorf("padding of %v dimensions", len(pads)))
 	}
 
-	return &Tensor{
-		t: C.ggml_pad(ctx.(*Context).ctx, t.t, C.int(shape[0]), C.int(shape[1]), C.int(shape[2]), C.int(shape[3])),
+	for i, pad := range pads {
+		if pad < 0 {
+			panic(fmt.Errorf("negative padding %v of dimension %v", pad, i))
+		}
 	}
+
+	copy(p[:], pads)
+	return p
 }
 
 func (t *Tensor) Permute(ctx ml.Context, shape ...int) ml.Tensor {
@@ -503,101 +930,159 @@ func (t *Tensor) Permute(ctx ml.Context, shape ...int) ml.Tensor {
 		panic("expected 4 dimensions")
 	}
 
-	return &Tensor{
-		t: C.ggml_permute(ctx.(*Context).ctx, t.t, C.int(shape[0]), C.int(shape[1]), C.int(shape[2]), C.int(shape[3])),
+	return newTensor(ctx, C.ggml_permute(ctx.(*Context).ctx, t.t, C.int(shape[0]), C.int(shape[1]), C.int(shape[2]), C.int(shape[3])))
+}
+
+// dequantize converts a quantized tensor with up to 3 dimensions to F32 by
+// gathering all of its rows, as the CPU backend can't copy quantized tensors
+// to other types
+func dequantize(ctx *Context, t *C.struct_ggml_tensor) *C.struct_ggml_tensor {
+	if t.ne[3] != 1 {
+		panic("unsupported number of dimensions for dequantization")
+	}
+
+	rows := make([]int32, t.ne[1]*t.ne[2])
+	for i := range rows {
+		rows[i] = int32(i % int(t.ne[1]))
+	}
+
+	ids, err := fromSlice(*ctx, rows, []int{int(t.ne[1]), int(t.ne[2])}, C.GGML_TYPE_I32)
+	if err != nil {
+		panic(err)
 	}
+
+	return C.ggml_get_rows(ctx.ctx, t, ids.(*Tensor).t)
 }
 
 func (t *Tensor) Rows(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_get_rows(ctx.(*Context).ctx, t.t, t2.(*Tensor).t),
-	}
+	return newTensor(ctx, C.ggml_get_rows(ctx.(*Context).ctx, t.t, t2.(*Tensor).t))
 }
 
 func (t *Tensor) Copy(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_cpy(ctx.(*Context).ctx, t.t, t2.(*Tensor).t),
+	src := t.t
+	if C.ggml_is_quantized(src._type) && src._type != t2.(*Tensor).t._type {
+		src = dequantize(ctx.(*Context), src)
 	}
+
+	return newTensor(ctx, C.ggml_cpy(ctx.(*Context).ctx, src, t2.(*Tensor).t))
 }
 
 func (t *Tensor) Reshape(ctx ml.Context, shape ...int) ml.Tensor {
 	switch len(shape) {
 	case 1:
-		return &Tensor{
-			t: C.ggml_reshape_1d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0])),
-		}
+		return newTensor(ctx, C.ggml_reshape_1d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0])))
 	case 2:
-		return &Tensor{
-			t: C.ggml_reshape_2d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0]), C.int64_t(shape[1])),
-		}
+		return newTensor(ctx, C.ggml_reshape_2d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0]), C.int64_t(shape[1])))
 	case 3:
-		return &Tensor{
-			t: C.ggml_reshape_3d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0]), C.int64_t(shape[1]), C.int64_t(shape[2])),
-		}
+		return newTensor(ctx, C.ggml_reshape_3d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0]), C.int64_t(shape[1]), C.int64_t(shape[2])))
 	case 4:
-		return &Tensor{
-			t: C.ggml_reshape_4d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0]), C.int64_t(shape[1]), C.int64_t(shape[2]), C.int64_t(shape[3])),
-		}
+		return newTensor(ctx, C.ggml_reshape_4d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0]), C.int64_t(shape[1]), C.int64_t(shape[2]), C.int64_t(shape[3])))
 	default:
 		panic("unsupported number of dimensions")
 	}
 }
 
 func (t *Tensor) Scale(ctx ml.Context, s float64) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_scale(ctx.(*Context).ctx, t.t, (C.float)(s)),
-	}
+	return newTensor(ctx, C.ggml_scale(ctx.(*Context).ctx, t.t, (C.float)(s)))
 }
 
-func (t *Tensor) Softmax(ctx ml.Context) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_soft_max(ctx.(*Context).ctx, t.t),
-	}
+func (t *Tensor) Clamp(ctx ml.Context, min, max float32) ml.Tensor {
+	c := ctx.(*Context).ctx
+
+	// ggml_clamp modifies its input in place, and the CPU only clamps the
+	// rows of the first thread, so it is applied to a single row
+	x := C.ggml_reshape_1d(c, C.ggml_dup(c, t.t), C.ggml_nelements(t.t))
+	x = C.ggml_clamp(c, x, C.float(min), C.float(max))
+	return newTensor(ctx, C.ggml_reshape_4d(c, x, t.t.ne[0], t.t.ne[1], t.t.ne[2], t.t.ne[3]))
 }
 
-func (t *Tensor) Tanh(ctx ml.Context) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_tanh_inplace(ctx.(*Context).ctx, t.t),
+func (t *Tensor) ArgSort(ctx ml.Context, descending bool) ml.Tensor {
+	c := ctx.(*Context)
+
+	// ggml_argsort is quadratic in the length of the rows on the CPU and
+	// limited to rows that fit in shared memory on GPUs, such as not the
+	// logits of a large vocabulary, and isn't stable on either. custom
+	// operations run on the CPU, so rows on a GPU are copied to the host
+	src := t.t
+	if src._type != C.GGML_TYPE_F32 {
+		src = C.ggml_cast(c.ctx, src, C.GGML_TYPE_F32)
+	}
+
+	fn := C.ggml_custom2_op_t(C.argsort_asc)
+	if descending {
+		fn = C.ggml_custom2_op_t(C.argsort_desc)
 	}
+
+	indices := C.ggml_new_tensor(c.ctx, C.GGML_TYPE_I32, 4, &src.ne[0])
+	return newTensor(ctx, C.ggml_map_custom2(c.ctx, indices, src, fn, C.GGML_N_TASKS_MAX, nil))
 }
 
-func (t *Tensor) Unpad(ctx ml.Context, shape ...int) ml.Tensor {
-	if len(shape) != 4 {
-		panic("expected 4 dimensions")
+func (t *Tensor) TopK(ctx ml.Context, k int) (ml.Tensor, ml.Tensor) {
+	c := ctx.(*Context)
+	if k < 1 || k > t.Dim(0) {
+		panic(fmt.Errorf("invalid k %v for rows of %v elements", k, t.Dim(0)))
 	}
 
-	return &Tensor{
-		t: C.ggml_unpad(ctx.(*Context).ctx, t.t, C.int(shape[0]), C.int(shape[1]), C.int(shape[2]), C.int(shape[3])),
+	src := t.t
+	if !C.ggml_is_contiguous(src) {
+		src = C.ggml_cont(c.ctx, src)
 	}
+
+	if src._type != C.GGML_TYPE_F32 {
+		src = C.ggml_cast(c.ctx, src, C.GGML_TYPE_F32)
+	}
+
+	// selecting the top k is linear in the length of the rows rather than
+	// sorting them, and stable, as in ArgSort
+	indices := C.ggml_new_tensor_4d(c.ctx, C.GGML_TYPE_I32, C.int64_t(k), src.ne[1], src.ne[2], src.ne[3])
+	indices = C.ggml_map_custom2(c.ctx, indices, src, C.ggml_custom2_op_t(C.top_k), C.GGML_N_TASKS_MAX, nil)
+
+	// each row is gathered from a matrix of its own, as in Rows
+	rows := C.ggml_nrows(src)
+	values := C.ggml_get_rows(c.ctx,
+		C.ggml_reshape_3d(c.ctx, src, 1, src.ne[0], rows),
+		C.ggml_reshape_2d(c.ctx, indices, C.int64_t(k), rows))
+	values = C.ggml_reshape_4d(c.ctx, values, indices.ne[0], indices.ne[1], indices.ne[2], indices.ne[3])
+
+	return newTensor(ctx, values), newTensor(ctx, indices)
+}
+
+func (t *Tensor) Softmax(ctx ml.Context) ml.Tensor {
+	// ggml_soft_max subtracts the maximum of each row
+	return newTensor(ctx, C.ggml_soft_max(ctx.(*Context).ctx, t.t))
+}
+
+func (t *Tensor) Tanh(ctx ml.Context) ml.Tensor {
+	return newTensor(ctx, C.ggml_tanh_inplace(ctx.(*Context).ctx, t.t))
+}
+
+func (t *Tensor) Unpad(ctx ml.Context, pads ...int) ml.Tensor {
+	p := padding(pads)
+	return newTensor(ctx, C.ggml_unpad(ctx.(*Context).ctx, t.t, C.int(p[0]), C.int(p[1]), C.int(p[2]), C.int(p[3])))
 }
 
 func (t *Tensor) View(ctx ml.Context, offset int, shape ...int) ml.Tensor {
 	switch len(shape) {
 	case 1:
-		return &Tensor{
-			t: C.ggml_view_1d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0]), C.size_t(offset)),
-		}
+		return newTensor(ctx, C.ggml_view_1d(ctx.(*Context).ctx, t.t, C.int64_t(shape[0]), C.size_t(offset)))
 	case 3:
-		return &Tensor{
-			t: C.ggml_view_2d(ctx.(*Context).ctx, t.t,
-				C.int64_t(shape[0]), C.int64_t(shape[2]),
-				C.size_t(shape[1]),
-				C.size_t(offset)),
-		}
+		return newTensor(ctx, C.ggml_view_2d(ctx.(*Context).ctx, t.t,
+			C.int64_t(shape[0]), C.int64_t(shape[2]),
+			C.size_t(shape[1]),
+			C.size_t(offset),
+		))
 	case 5:
-		return &Tensor{
-			t: C.ggml_view_3d(ctx.(*Context).ctx, t.t,
-				C.int64_t(shape[0]), C.int64_t(shape[2]), C.int64_t(shape[4]),
-				C.size_t(shape[1]), C.size_t(shape[3]),
-				C.size_t(offset)),
-		}
+		return newTensor(ctx, C.ggml_view_3d(ctx.(*Context).ctx, t.t,
+			C.int64_t(shape[0]), C.int64_t(shape[2]), C.int64_t(shape[4]),
+			C.size_t(shape[1]), C.size_t(shape[3]),
+			C.size_t(offset),
+		))
 	case 7:
-		return &Tensor{
-			t: C.ggml_view_4d(ctx.(*Context).ctx, t.t,
-				C.int64_t(shape[0]), C.int64_t(shape[2]), C.int64_t(shape[4]), C.int64_t(shape[6]),
-				C.size_t(shape[1]), C.size_t(shape[3]), C.size_t(shape[5]),
-				C.size_t(offset)),
-		}
+		return newTensor(ctx, C.ggml_view_4d(ctx.(*Context).ctx, t.t,
+			C.int64_t(shape[0]), C.int64_t(shape[2]), C.int64_t(shape[4]), C.int64_t(shape[6]),
+			C.size_t(shape[1]), C.size_t(shape[3]), C.size_t(shape[5]),
+			C.size_t(offset),
+		))
 	default:
 		panic("unsupported number of dimensions")
 	}
@@ -608,64 +1093,189 @@ const (
 )
 
 func (t *Tensor) RoPE(ctx ml.Context, positionIDs, ropeFactors ml.Tensor, ropeDim uint32, ropeBase, ropeScale float32) ml.Tensor {
+	return t.RoPEScaled(ctx, positionIDs, ropeFactors, ropeDim, ropeBase, ml.RoPEScaling{
+		FreqScale:             ropeScale,
+		AttnFactor:            1,
+		BetaFast:              32,
+		BetaSlow:              1,
+		OriginalContextLength: 131072,
+	})
+}
+
+func (t *Tensor) RoPEScaled(ctx ml.Context, positionIDs, ropeFactors ml.Tensor, ropeDim uint32, ropeBase float32, scaling ml.RoPEScaling) ml.Tensor {
 	if ropeFactors == nil {
 		ropeFactors = &Tensor{}
 	}
 
 	dequant := t.t
 	if C.ggml_is_quantized(t.t._type) {
-		dequant = C.ggml_cast(ctx.(*Context).ctx, t.t, C.GGML_TYPE_F32)
-	}
-
-	return &Tensor{
-		t: C.ggml_rope_ext(
-			ctx.(*Context).ctx, dequant, positionIDs.(*Tensor).t, ropeFactors.(*Tensor).t,
-			C.int(ropeDim),
-			131072,       // YaRN n_ctx_train
-			ropeTypeNorm, // ROPE_TYPE_NORM
-			C.float(ropeBase),
-			C.float(ropeScale),
-			0.,  // YaRN ext_factor
-			1.,  // YaRN attn_factor
-			32., // YaRN beta_fast
-			1.,  // YaRN beta_slow
-		),
+		dequant = dequantize(ctx.(*Context), t.t)
 	}
+
+	return newTensor(ctx, C.ggml_rope_ext(
+		ctx.(*Context).ctx, dequant, positionIDs.(*Tensor).t, ropeFactors.(*Tensor).t,
+		C.int(ropeDim),
+		ropeTypeNorm, // ROPE_TYPE_NORM
+		C.int(scaling.OriginalContextLength),
+		C.float(ropeBase),
+		C.float(scaling.FreqScale),
+		C.float(scaling.ExtFactor),
+		C.float(scaling.AttnFactor),
+		C.float(scaling.BetaFast),
+		C.float(scaling.BetaSlow),
+	))
 }
 
 func (t *Tensor) GELU(ctx ml.Context) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_gelu_inplace(ctx.(*Context).ctx, t.t),
+	return newTensor(ctx, C.ggml_gelu_inplace(ctx.(*Context).ctx, t.t))
+}
+
+func (t *Tensor) IsContiguous() bool {
+	return bool(C.ggml_is_contiguous(t.t))
+}
+
+// data returns a pointer to p after checking that the range of len(p) bytes
+// at off is within the allocated data of t, and waiting for graphs that may
+// use t to finish
+func (t *Tensor) data(p []byte, off int64) (unsafe.Pointer, error) {
+	buffer := t.t.buffer
+	if t.t.view_src != nil {
+		buffer = t.t.view_src.buffer
+	}
+
+	if buffer == nil {
+		return nil, errors.New("tensor is not allocated")
+	}
+
+	if off < 0 || off+int64(len(p)) > int64(C.ggml_nbytes(t.t)) {
+		return nil, fmt.Errorf("range of %d bytes at %d is outside of tensor of %d bytes", len(p), off, C.ggml_nbytes(t.t))
 	}
+
+	if t.b != nil {
+		C.ggml_backend_sched_synchronize(t.b.sched)
+	}
+
+	return unsafe.Pointer(unsafe.SliceData(p)), nil
 }
 
-func (t *Tensor) SILU(ctx ml.Context) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_silu_inplace(ctx.(*Context).ctx, t.t),
+func (t *Tensor) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	data, err := t.data(p, off)
+	if err != nil {
+		return 0, err
 	}
+
+	C.ggml_backend_tensor_get(t.t, data, C.size_t(off), C.size_t(len(p)))
+	return len(p), nil
 }
 
-func (t *Tensor) Conv2D(ctx ml.Context, t2 ml.Tensor, s0, s1, p0, p1, d0, d1 int) ml.Tensor {
-	return &Tensor{
-		t: C.ggml_conv_2d(ctx.(*Context).ctx, t.t, t2.(*Tensor).t, C.int(s0), C.int(s1), C.int(p0), C.int(p1), C.int(d0), C.int(d1)),
+func (t *Tensor) WriteAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	data, err := t.data(p, off)
+	if err != nil {
+		return 0, err
+	}
+
+	C.ggml_backend_tensor_set(t.t, data, C.size_t(off), C.size_t(len(p)))
+	return len(p), nil
+}
+
+// GELUErf computes GELU with erf as a custom operation, as ggml only
+// implements the tanh approximation. Custom operations run on the CPU.
+func (t *Tensor) GELUErf(ctx ml.Context) ml.Tensor {
+	src := t.t
+	if src._type != C.GGML_TYPE_F32 {
+		src = C.ggml_cast(ctx.(*Context).ctx, src, C.GGML_TYPE_F32)
 	}
+
+	return newTensor(ctx, C.ggml_map_custom1(ctx.(*Context).ctx, src, C.ggml_custom1_op_t(C.gelu_erf), C.GGML_N_TASKS_MAX, nil))
+}
+
+func (t *Tensor) SILU(ctx ml.Context) ml.Tensor {
+	return newTensor(ctx, C.ggml_silu_inplace(ctx.(*Context).ctx, t.t))
+}
+
+func (t *Tensor) RELU(ctx ml.Context) ml.Tensor {
+	return newTensor(ctx, C.ggml_relu_inplace(ctx.(*Context).ctx, t.t))
+}
+
+func (t *Tensor) Sigmoid(ctx ml.Context) ml.Tensor {
+	return newTensor(ctx, C.ggml_sigmoid_inplace(ctx.(*Context).ctx, t.t))
 }
 
-func (t *Tensor) ScaledDotProductAttention(ctx ml.Context, key, value, mask ml.Tensor, scale float64) ml.Tensor {
+func (t *Tensor) Conv2D(ctx ml.Context, t2 ml.Tensor, s0, s1, p0, p1, d0, d1 int) ml.Tensor {
+	return newTensor(ctx, C.ggml_conv_2d(ctx.(*Context).ctx, t.t, t2.(*Tensor).t, C.int(s0), C.int(s1), C.int(p0), C.int(p1), C.int(d0), C.int(d1)))
+}
+
+func (t *Tensor) ScaledDotProductAttention(ctx ml.Context, key, value, mask ml.Tensor, scale float64, opts ml.AttentionOptions) ml.Tensor {
+	if c := ctx.(*Context); value.Dim(1) == t.Dim(0) && c.SupportsFlashAttention(t.Dim(0)) {
+		return t.flashAttention(c, key, value, mask, scale, opts)
+	}
+
 	var kqMask *C.struct_ggml_tensor
 	if mask != nil {
 		kqMask = mask.(*Tensor).t
 	}
 
 	kq := key.MulmatFullPrec(ctx, t)
-	kq = &Tensor{
-		t: C.ggml_soft_max_ext(ctx.(*Context).ctx, kq.(*Tensor).t, kqMask, C.float(scale), 0),
+	if opts.Softcap != 0 {
+		// softmax(softcap * tanh(kq * scale / softcap) + mask)
+		kq = kq.Scale(ctx, scale/opts.Softcap).Tanh(ctx)
+		scale = opts.Softcap
 	}
 
-	kqv := value.Mulmat(ctx, kq)
+	kq = newTensor(ctx, C.ggml_soft_max_ext(ctx.(*Context).ctx, kq.(*Tensor).t, kqMask, C.float(scale), C.float(opts.MaxBias)))
+
+	var kqv ml.Tensor
+	if opts.FullPrec {
+		kqv = value.MulmatFullPrec(ctx, kq)
+	} else {
+		kqv = value.Mulmat(ctx, kq)
+	}
 	return kqv.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
 }
 
+// flashAttention computes ScaledDotProductAttention with flash attention
+// kernels, which require F16 or quantized keys, values that aren't transposed
+// and an F16 mask that is padded to a multiple of GGML_KQ_MASK_PAD queries.
+// Quantized keys and values of a cache are passed to the kernels as they are.
+func (t *Tensor) flashAttention(ctx *Context, key, value, mask ml.Tensor, scale float64, opts ml.AttentionOptions) ml.Tensor {
+	toF16 := func(t ml.Tensor) ml.Tensor {
+		if t.DType() == ml.DTypeF16 || C.ggml_is_quantized(t.(*Tensor).t._type) {
+			return t
+		}
+
+		return t.Copy(ctx, ctx.Zeros(ml.DTypeF16, t.Shape()...))
+	}
+
+	var kqMask *C.struct_ggml_tensor
+	if mask != nil {
+		if mask.DType() != ml.DTypeF32 {
+			mask = mask.Copy(ctx, ctx.Zeros(ml.DTypeF32, mask.Shape()...))
+		}
+
+		if pad := (C.GGML_KQ_MASK_PAD - mask.Dim(1)%C.GGML_KQ_MASK_PAD) % C.GGML_KQ_MASK_PAD; pad > 0 {
+			mask = mask.Pad(ctx, 0, pad, 0, 0)
+		}
+
+		kqMask = toF16(mask).(*Tensor).t
+	}
+
+	key = toF16(key)
+	value = toF16(value.Permute(ctx, 1, 0, 2, 3).Contiguous(ctx))
+
+	kqv := C.ggml_flash_attn_ext(ctx.ctx, t.t, key.(*Tensor).t, value.(*Tensor).t, kqMask, C.float(scale), C.float(opts.MaxBias), C.float(opts.Softcap))
+	C.ggml_flash_attn_ext_set_prec(kqv, C.GGML_PREC_F32)
+
+	return newTensor(ctx, kqv)
+}
+
 func (b *Backend) SystemInfo() string {
 	var compiler string
 	switch C.get_compiler() {
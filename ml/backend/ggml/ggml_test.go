@@ -0,0 +1,1277 @@
+package ggml
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	fs "github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/nn"
+	"github.com/ollama/ollama/ml/nn/nntest"
+	"github.com/ollama/ollama/sample"
+)
+
+// newTestBackend loads a backend with F32 tensors of the given shapes, filled
+// with small distinct values
+func newTestBackend(t testing.TB, shapes map[string][]uint64) ml.Backend {
+	t.Helper()
+
+	var tensors []fs.Tensor
+	for name, shape := range shapes {
+		n := uint64(1)
+		for _, dim := range shape {
+			n *= dim
+		}
+
+		data := make([]float32, n)
+		for i := range data {
+			data[i] = float32(i%7) / 7
+		}
+
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+			t.Fatal(err)
+		}
+
+		tensors = append(tensors, fs.Tensor{Name: name, Kind: 0, Shape: shape, WriterTo: &buf})
+	}
+
+	slices.SortFunc(tensors, func(a, b fs.Tensor) int { return strings.Compare(a.Name, b.Name) })
+
+	f, err := os.CreateTemp(t.TempDir(), "*.gguf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fs.WriteGGUF(f, fs.KV{"general.architecture": "test", "test.block_count": uint32(2)}, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(f, ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestTrace(t *testing.T) {
+	const hidden, ffn = 4, 8
+
+	// shapes of GGUF tensors are in the PyTorch order
+	shapes := make(map[string][]uint64)
+	for i := range 2 {
+		shapes[fmt.Sprintf("blk.%d.ffn_norm.weight", i)] = []uint64{hidden}
+		shapes[fmt.Sprintf("blk.%d.ffn_gate.weight", i)] = []uint64{ffn, hidden}
+		shapes[fmt.Sprintf("blk.%d.ffn_up.weight", i)] = []uint64{ffn, hidden}
+		shapes[fmt.Sprintf("blk.%d.ffn_down.weight", i)] = []uint64{hidden, ffn}
+	}
+
+	b := newTestBackend(t, shapes)
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	hiddenState, err := ctx.FromFloatSlice(make([]float32, hidden*3), hidden, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		layerCtx := ml.Name(ctx, fmt.Sprintf("blk.%d", i))
+		get := func(name string) ml.Tensor { return b.Get(fmt.Sprintf("blk.%d.%s.weight", i, name)) }
+
+		norm := nn.RMSNorm{Weight: get("ffn_norm")}
+		mlp := nn.GLUFFN{
+			Gate: &nn.Linear{Weight: get("ffn_gate")},
+			Up:   &nn.Linear{Weight: get("ffn_up")},
+			Down: &nn.Linear{Weight: get("ffn_down")},
+		}
+
+		residual := hiddenState
+		hiddenState = norm.Forward(ml.Name(layerCtx, "ffn_norm"), hiddenState, 1e-6)
+		hiddenState = mlp.Forward(layerCtx, hiddenState)
+		hiddenState = hiddenState.Add(ml.Name(layerCtx, "l_out"), residual)
+	}
+
+	ctx.Forward(hiddenState)
+
+	trace := ctx.(ml.Tracer).Trace()
+
+	layer := []string{"RMS_NORM", "MUL", "MUL_MAT", "MUL_MAT", "SILU", "MUL", "MUL_MAT", "ADD"}
+	if ops, want := trace.Ops(), append(slices.Clone(layer), layer...); !slices.Equal(ops, want) {
+		t.Errorf("unexpected ops %v, want %v", ops, want)
+	}
+
+	var names []string
+	for _, tt := range trace.Tensors {
+		if len(tt.Inputs) > 0 && strings.HasPrefix(tt.Name, "blk.1.") {
+			names = append(names, tt.Name)
+		}
+	}
+
+	want := []string{
+		"blk.1.ffn_norm", "blk.1.ffn_norm",
+		"blk.1.ffn_gate", "blk.1.ffn_up", "blk.1.ffn_act", "blk.1.ffn_act",
+		"blk.1.ffn_down",
+		"blk.1.l_out",
+	}
+	if !slices.Equal(names, want) {
+		t.Errorf("unexpected names %v, want %v", names, want)
+	}
+
+	last := trace.Tensors[len(trace.Tensors)-1]
+	if last.DType != "f32" || !slices.Equal(last.Shape, []int{hidden, 3}) {
+		t.Errorf("unexpected output %+v", last)
+	}
+
+	for _, input := range last.Inputs {
+		if input >= last.ID {
+			t.Errorf("input %v of %v is not in topological order", input, last.ID)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := trace.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded ml.Trace
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(decoded.Ops(), trace.Ops()) {
+		t.Errorf("unexpected ops after decoding %v", decoded.Ops())
+	}
+
+	buf.Reset()
+	if err := trace.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if dot := buf.String(); !strings.HasPrefix(dot, "digraph {") || !strings.Contains(dot, "blk.0.ffn_down") {
+		t.Errorf("unexpected graph %s", dot)
+	}
+}
+
+func TestGELUErf(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	var x []float32
+	for i := -40; i < 40; i++ {
+		x = append(x, float32(i)/8)
+	}
+
+	// a transposed view, to check strided inputs
+	in, err := ctx.FromFloatSlice(x, 8, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := nn.GELUExact(ctx, in.Permute(ctx, 1, 0, 2, 3))
+	ctx.Forward(out)
+	ctx.Compute(out)
+
+	got := out.Floats()
+	for i := range 8 {
+		for j := range 10 {
+			v := float64(x[j*8+i])
+			want := 0.5 * v * (1 + math.Erf(v/math.Sqrt2))
+			if d := math.Abs(float64(got[i*10+j]) - want); d > 1e-6 {
+				t.Errorf("GELU(%v) = %v, want %v", v, got[i*10+j], want)
+			}
+		}
+	}
+}
+
+func TestClamp(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	var x []float32
+	for i := range 64 {
+		x = append(x, float32(i%16-8))
+	}
+
+	// more rows than threads, in a transposed view
+	in, err := ctx.FromFloatSlice(x, 4, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := in.Permute(ctx, 1, 0, 2, 3).Clamp(ctx, -2, 3)
+	ctx.Forward(out)
+	ctx.Compute(out)
+
+	if got := out.Shape(); !slices.Equal(got, []int{16, 4}) {
+		t.Fatalf("have shape %v; want [16 4]", got)
+	}
+
+	got := out.Floats()
+	for i := range 16 {
+		for j := range 4 {
+			if want := min(max(x[i*4+j], -2), 3); got[j*16+i] != want {
+				t.Errorf("Clamp(%v) = %v, want %v", x[i*4+j], got[j*16+i], want)
+			}
+		}
+	}
+}
+
+func TestDropoutMask(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	const p, seed = 0.25, 0x0123456789abcdef
+
+	out := ctx.(ml.Dropout).DropoutMask(seed, p, 64, 8, 4)
+	ctx.Forward(out)
+	ctx.Compute(out)
+
+	if got := out.Shape(); !slices.Equal(got, []int{64, 8, 4}) {
+		t.Fatalf("have shape %v; want [64 8 4]", got)
+	}
+
+	// the mask is that described by ml.Dropout, as on the host
+	var dropped int
+	for i, got := range out.Floats() {
+		z := seed + uint64(i+1)*0x9e3779b97f4a7c15
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		z = z ^ z>>31
+
+		var want float32
+		if uint32(z>>32) >= 1<<30 {
+			want = 1 / (1 - p)
+		} else {
+			dropped++
+		}
+
+		if got != want {
+			t.Fatalf("element %v is %v, want %v", i, got, want)
+		}
+	}
+
+	if n := 64 * 8 * 4; math.Abs(float64(dropped)/float64(n)-p) > 0.05 {
+		t.Errorf("dropped %v of %v elements, want about %v", dropped, n, p)
+	}
+}
+
+func TestEmbeddingPadding(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	// d_model = 2, vocab_size = 3
+	weight, err := ctx.FromFloatSlice([]float32{1, 2, 3, 4, 5, 6}, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := nn.Embedding{Weight: weight, Padding: true, PaddingIdx: 1}
+	out, err := m.ForwardIDs(ctx, []int32{2, 1, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.Forward(out)
+	ctx.Compute(out)
+
+	if got, want := out.Floats(), []float32{5, 6, 0, 0, 1, 2}; !slices.Equal(got, want) {
+		t.Errorf("have %v; want %v", got, want)
+	}
+}
+
+func TestConv1D(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	// the input has length 4 and 2 channels, and the kernel has size 2 and 1
+	// output channel
+	input, err := ctx.FromFloatSlice([]float32{1, 2, 3, 4, 5, 6, 7, 8}, 4, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weight, err := ctx.FromFloatSlice([]float32{1, -1, 2, 0}, 2, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bias, err := ctx.FromFloatSlice([]float32{0.5}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := nn.Conv1D{Weight: weight, Bias: bias, Stride: 2, Padding: 1}
+	out := m.Forward(ctx, input)
+
+	ctx.Forward(out)
+	ctx.Compute(out)
+
+	// the kernel covers positions -1 and 0, 1 and 2, and 3 and 4 of the
+	// input, which is zero outside of it
+	if got, want := out.Floats(), []float32{-0.5, 11.5, 20.5}; !slices.Equal(got, want) {
+		t.Errorf("have %v; want %v", got, want)
+	}
+}
+
+func TestRingCache(t *testing.T) {
+	const dim, heads = 4, 2
+
+	vals := func(seed, n int) []float32 {
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(float64(seed*100 + i)))
+		}
+		return s
+	}
+
+	cases := []struct {
+		name string
+		new  func(ml.Backend) *nn.RingCache
+
+		// batches are the positions of each batch
+		batches [][]int32
+
+		// visible reports whether the query at position q attends to the
+		// key at position k, given the positions in the cache
+		visible func(cached []int, q, k int) bool
+	}{
+		{
+			// the third batch wraps around and evicts the first two tokens
+			name:    "ring",
+			new:     func(b ml.Backend) *nn.RingCache { return nn.NewRingCache(b, ml.DTypeF32, 4) },
+			batches: [][]int32{{0, 1, 2}, {3}, {4, 5}},
+			visible: func(cached []int, q, k int) bool { return k <= q && slices.Contains(cached, k) },
+		},
+		{
+			// generation continues well past the window, with the same
+			// result as attending to all keys with a sliding window mask
+			name:    "sliding window",
+			new:     func(b ml.Backend) *nn.RingCache { return nn.NewSlidingWindowCache(b, ml.DTypeF32, 3, 2) },
+			batches: [][]int32{{0, 1}, {2}, {3, 4}, {5}, {6}, {7, 8}, {9, 10}, {11}},
+			visible: func(_ []int, q, k int) bool { return k <= q && k >= q-3 },
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBackend(t, map[string][]uint64{"x": {1}})
+			cache := tt.new(b)
+			defer cache.Close()
+
+			// the keys and values of all tokens, with a single kv head
+			last := tt.batches[len(tt.batches)-1]
+			n := int(last[len(last)-1]) + 1
+			keys, values := vals(1, dim*n), vals(2, dim*n)
+
+			var cached []int
+			for i, batch := range tt.batches {
+				ctx := b.NewContext()
+
+				first := int(batch[0])
+				key, err := ctx.FromFloatSlice(keys[first*dim:(first+len(batch))*dim], dim, 1, len(batch))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				value, err := ctx.FromFloatSlice(values[first*dim:(first+len(batch))*dim], dim, 1, len(batch))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				q := vals(3+i, dim*heads*len(batch))
+				query, err := ctx.FromFloatSlice(q, dim, heads, len(batch))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cache.Put(ctx, key, value, batch)
+				out := nn.CachedAttention(ctx, cache, query, 0.5)
+				ctx.Forward(out)
+				ctx.Compute(out)
+
+				for _, pos := range batch {
+					cached = append(cached, int(pos))
+				}
+				cached = cached[max(0, len(cached)-4):]
+
+				var want []float32
+				for j, pos := range batch {
+					for h := range heads {
+						qh := q[(j*heads+h)*dim : (j*heads+h+1)*dim]
+
+						var visible []int
+						for k := range n {
+							if tt.visible(cached, int(pos), k) {
+								visible = append(visible, k)
+							}
+						}
+
+						scores := make([]float64, len(visible))
+						var maxScore, sum float64 = math.Inf(-1), 0
+						for k, c := range visible {
+							for d := range dim {
+								scores[k] += 0.5 * float64(qh[d]*keys[c*dim+d])
+							}
+							maxScore = max(maxScore, scores[k])
+						}
+
+						for k := range scores {
+							scores[k] = math.Exp(scores[k] - maxScore)
+							sum += scores[k]
+						}
+
+						for d := range dim {
+							var o float64
+							for k, c := range visible {
+								o += scores[k] / sum * float64(values[c*dim+d])
+							}
+							want = append(want, float32(o))
+						}
+					}
+				}
+
+				got := out.Floats()
+				if len(got) != len(want) {
+					t.Fatalf("batch %v: unexpected output size %v, want %v", batch, len(got), len(want))
+				}
+
+				for j := range want {
+					if d := math.Abs(float64(got[j] - want[j])); d > 1e-5 {
+						t.Errorf("batch %v: output %v = %v, want %v", batch, j, got[j], want[j])
+					}
+				}
+
+				ctx.Close()
+			}
+		})
+	}
+}
+
+func TestSlidingWindowCacheMemory(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	cache := nn.NewSlidingWindowCache(b, ml.DTypeF32, 3, 2)
+	defer cache.Close()
+
+	for pos := range int32(20) {
+		ctx := b.NewContext()
+		kv := ctx.Zeros(ml.DTypeF32, 4, 1, 1)
+		cache.Put(ctx, kv, kv, []int32{pos})
+
+		// the keys of the window and a batch
+		if key, _, _ := cache.Get(ctx); key.Dim(1) > 5 {
+			t.Errorf("cache holds %v keys at position %v", key.Dim(1), pos)
+		}
+		ctx.Close()
+	}
+}
+
+// copies returns the number of copies in the graph of ctx and the number of
+// elements that they copy
+func copies(ctx ml.Context) (n, elements int) {
+	for _, tt := range ctx.(ml.Tracer).Trace().Tensors {
+		if tt.Op == "CONT" {
+			size := 1
+			for _, d := range tt.Shape {
+				size *= d
+			}
+
+			n, elements = n+1, elements+size
+		}
+	}
+
+	return n, elements
+}
+
+func TestRingCacheValues(t *testing.T) {
+	const dim, heads, kvHeads, n = 4, 4, 2, 5
+
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	cache := nn.NewRingCache(b, ml.DTypeF32, 8)
+	defer cache.Close()
+
+	// k and v hold the keys and values of each token with shape [dim,
+	// kv_heads, n], as they are put in the cache
+	q, k, v, _ := decodeData(dim, heads, kvHeads, n)
+
+	put := func(ctx ml.Context, batch []int32) {
+		first, size := int(batch[0]), len(batch)
+		key, err := ctx.FromFloatSlice(k[first*dim*kvHeads:(first+size)*dim*kvHeads], dim, kvHeads, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := ctx.FromFloatSlice(v[first*dim*kvHeads:(first+size)*dim*kvHeads], dim, kvHeads, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cache.Put(ctx, key, value, batch)
+	}
+
+	ctx := b.NewContext()
+	put(ctx, []int32{0, 1, 2, 3})
+	ctx.Compute()
+	ctx.Close()
+
+	// decode the last token
+	ctx = b.NewContext()
+	defer ctx.Close()
+
+	put(ctx, []int32{4})
+	query, err := ctx.FromFloatSlice(q, dim, heads, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, values, _ := cache.Get(ctx)
+	out := nn.CachedAttention(ctx, cache, query, 0.5)
+	ctx.Forward(out)
+
+	// the values are stored in the layout of attention, so they are used in
+	// place rather than copied
+	for _, tt := range ctx.(ml.Tracer).Trace().Tensors {
+		if tt.Op == "CONT" && slices.Equal(tt.Shape, []int{n, dim, kvHeads}) {
+			t.Errorf("values are copied: %v", tt)
+		}
+	}
+
+	values = values.Contiguous(ctx)
+	ctx.Forward(values)
+	ctx.Compute(out, values)
+
+	// the keys and values in the layout of attention
+	var keys, vals []float32
+	for h := range kvHeads {
+		for i := range n {
+			keys = append(keys, k[(i*kvHeads+h)*dim:(i*kvHeads+h+1)*dim]...)
+		}
+
+		for d := range dim {
+			for i := range n {
+				vals = append(vals, v[(i*kvHeads+h)*dim+d])
+			}
+		}
+	}
+
+	if have := values.Floats(); !slices.Equal(have, vals) {
+		t.Errorf("have values %v, want %v", have, vals)
+	}
+
+	want := nntest.AttentionReference(q, keys, vals, nil, nntest.AttentionShape{
+		KeyDim: dim, ValueDim: dim,
+		SeqLenQ: 1, SeqLenK: n,
+		Heads: heads, KVHeads: kvHeads,
+	}, 0.5)
+
+	for i, have := range out.Floats() {
+		if math.Abs(float64(have-want[i])) > 1e-5 {
+			t.Errorf("output %d: have %v, want %v", i, have, want[i])
+		}
+	}
+}
+
+// BenchmarkCachedAttentionDecode measures decoding a token at a time with a
+// RingCache, reporting the copies in the graph of each step
+func BenchmarkCachedAttentionDecode(b *testing.B) {
+	const dim, heads, kvHeads, seqLenK = 128, 32, 8, 4096
+
+	backend := newTestBackend(b, map[string][]uint64{"x": {1}})
+	cache := nn.NewRingCache(backend, ml.DTypeF32, seqLenK)
+	defer cache.Close()
+
+	q, k, v, _ := decodeData(dim, heads, kvHeads, seqLenK)
+
+	ctx := backend.NewContext()
+	key, err := ctx.FromFloatSlice(k, dim, kvHeads, seqLenK)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	value, err := ctx.FromFloatSlice(v, dim, kvHeads, seqLenK)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	positions := make([]int32, seqLenK)
+	for i := range positions {
+		positions[i] = int32(i)
+	}
+
+	cache.Put(ctx, key, value, positions)
+	ctx.Compute()
+	ctx.Close()
+
+	var n, elements int
+	pos := int32(seqLenK)
+	for b.Loop() {
+		ctx := backend.NewContext()
+
+		key, value := ctx.Zeros(ml.DTypeF32, dim, kvHeads, 1), ctx.Zeros(ml.DTypeF32, dim, kvHeads, 1)
+		query, err := ctx.FromFloatSlice(q, dim, heads, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		cache.Put(ctx, key, value, []int32{pos})
+		out := nn.CachedAttention(ctx, cache, query, 0.5)
+		ctx.Forward(out)
+		n, elements = copies(ctx)
+
+		ctx.Compute(out)
+		out.Floats()
+		ctx.Close()
+		pos++
+	}
+
+	b.ReportMetric(float64(n), "copies/op")
+	b.ReportMetric(float64(elements), "copied/op")
+}
+
+// attentionInputs creates the query, keys, values and mask of attention for
+// seqLenQ queries
+func attentionInputs(tb testing.TB, ctx ml.Context, q, k, v, m []float32, dim, heads, kvHeads, seqLenQ, seqLenK int) (query, key, value, mask ml.Tensor) {
+	tb.Helper()
+
+	var err error
+	if query, err = ctx.FromFloatSlice(q, dim, seqLenQ, heads); err != nil {
+		tb.Fatal(err)
+	}
+
+	if key, err = ctx.FromFloatSlice(k, dim, seqLenK, kvHeads); err != nil {
+		tb.Fatal(err)
+	}
+
+	if value, err = ctx.FromFloatSlice(v, seqLenK, dim, kvHeads); err != nil {
+		tb.Fatal(err)
+	}
+
+	if mask, err = ctx.FromFloatSlice(m, seqLenK, seqLenQ); err != nil {
+		tb.Fatal(err)
+	}
+
+	return query, key, value, mask
+}
+
+// attentionGraph builds the unfused implementation of attention, as used when
+// the attention weights are requested, for seqLenQ queries and returns its
+// output and the number of copies in its graph
+func attentionGraph(tb testing.TB, ctx ml.Context, q, k, v, m []float32, dim, heads, kvHeads, seqLenQ, seqLenK int) (ml.Tensor, int) {
+	tb.Helper()
+
+	query, key, value, mask := attentionInputs(tb, ctx, q, k, v, m, dim, heads, kvHeads, seqLenQ, seqLenK)
+	out, _ := nn.AttentionWithWeights(ctx, query, key, value, mask, 0.5)
+	ctx.Forward(out)
+
+	var copies int
+	for _, tt := range ctx.(ml.Tracer).Trace().Tensors {
+		if tt.Op == "CONT" {
+			copies++
+		}
+	}
+
+	return out, copies
+}
+
+func TestAttentionLayout(t *testing.T) {
+	const dim, heads, kvHeads, seqLenK = 4, 4, 2, 6
+
+	vals := func(seed, n int) []float32 {
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(float64(seed*100 + i)))
+		}
+		return s
+	}
+
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+
+	// permuting the output only moves elements if there are several queries
+	for _, tt := range []struct{ seqLenQ, copies int }{{1, 0}, {3, 1}} {
+		t.Run(fmt.Sprint(tt.seqLenQ), func(t *testing.T) {
+			q, k, v := vals(1, dim*tt.seqLenQ*heads), vals(2, dim*seqLenK*kvHeads), vals(3, seqLenK*dim*kvHeads)
+
+			// causal, with the queries at the end of the sequence
+			m := make([]float32, seqLenK*tt.seqLenQ)
+			for i := range tt.seqLenQ {
+				for j := range seqLenK {
+					if j > seqLenK-tt.seqLenQ+i {
+						m[i*seqLenK+j] = float32(math.Inf(-1))
+					}
+				}
+			}
+
+			ctx := b.NewContext()
+			defer ctx.Close()
+
+			out, copies := attentionGraph(t, ctx, q, k, v, m, dim, heads, kvHeads, tt.seqLenQ, seqLenK)
+			if copies != tt.copies {
+				t.Errorf("unexpected number of copies %d, want %d", copies, tt.copies)
+			}
+
+			ctx.Compute(out)
+
+			want := nntest.AttentionReference(q, k, v, m, nntest.AttentionShape{
+				KeyDim: dim, ValueDim: dim,
+				SeqLenQ: tt.seqLenQ, SeqLenK: seqLenK,
+				Heads: heads, KVHeads: kvHeads,
+			}, 0.5)
+
+			for i, have := range out.Floats() {
+				if math.Abs(float64(have-want[i])) > 1e-5 {
+					t.Errorf("output %d: have %v, want %v", i, have, want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAttentionBooleanMask(t *testing.T) {
+	const dim, seqLen = 2, 3
+
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	q, k, v := []float32{1, 0, 0.5, 1, -1, 2}, []float32{0, 1, 2, -1, 1, 1}, []float32{1, 2, 3, 4, 5, 6}
+
+	// causal
+	inf := float32(math.Inf(-1))
+	m := []float32{0, inf, inf, 0, 0, inf, 0, 0, 0}
+
+	query, err := ctx.FromFloatSlice(q, dim, seqLen, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ctx.FromFloatSlice(k, dim, seqLen, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := ctx.FromFloatSlice(v, seqLen, dim, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mask, err := ctx.FromIntSlice([]int32{1, 0, 0, 1, 1, 0, 1, 1, 1}, seqLen, seqLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := nn.Attention(ctx, query, key, value, mask, 0.5)
+	ctx.Forward(out)
+	ctx.Compute(out)
+
+	want := nntest.AttentionReference(q, k, v, m, nntest.AttentionShape{
+		KeyDim: dim, ValueDim: dim,
+		SeqLenQ: seqLen, SeqLenK: seqLen,
+		Heads: 1, KVHeads: 1,
+	}, 0.5)
+
+	for i, have := range out.Floats() {
+		if math.Abs(float64(have-want[i])) > 1e-5 {
+			t.Errorf("output %d: have %v, want %v", i, have, want[i])
+		}
+	}
+}
+
+// broadcastAttention is attention for a single query as composed before the
+// query heads were grouped, multiplying each query head with its key and
+// value head separately
+func broadcastAttention(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64) ml.Tensor {
+	kq := key.MulmatFullPrec(ctx, query).Scale(ctx, scale).Add(ctx, mask).Softmax(ctx)
+	return value.Mulmat(ctx, kq).Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+}
+
+// decodeData returns the query, keys, values and mask of attention for a
+// single query
+func decodeData(dim, heads, kvHeads, seqLenK int) (q, k, v, m []float32) {
+	q, k, v, m = make([]float32, dim*heads), make([]float32, dim*seqLenK*kvHeads), make([]float32, seqLenK*dim*kvHeads), make([]float32, seqLenK)
+	for i := range q {
+		q[i] = float32(math.Sin(float64(3 * i)))
+	}
+
+	for i := range k {
+		k[i], v[i] = float32(math.Sin(float64(i))), float32(math.Cos(float64(i)))
+	}
+
+	return q, k, v, m
+}
+
+func TestAttentionDecode(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+
+	for _, kvHeads := range []int{1, 2, 8} {
+		t.Run(fmt.Sprint(kvHeads), func(t *testing.T) {
+			ctx := b.NewContext()
+			defer ctx.Close()
+
+			q, k, v, m := decodeData(64, 8, kvHeads, 256)
+			out, _ := attentionGraph(t, ctx, q, k, v, m, 64, 8, kvHeads, 1, 256)
+
+			query, key, value, mask := attentionInputs(t, ctx, q, k, v, m, 64, 8, kvHeads, 1, 256)
+			want := broadcastAttention(ctx, query, key, value, mask, 0.5)
+			ctx.Forward(want)
+			ctx.Compute(out, want)
+
+			if have, want := out.Floats(), want.Floats(); !slices.Equal(have, want) {
+				t.Errorf("have %v, want %v", have, want)
+			}
+		})
+	}
+}
+
+// BenchmarkAttentionDecode measures the unfused implementation of attention
+// for a single query, reporting the copies in its graph, and the same
+// attention composed without grouping the query heads
+func BenchmarkAttentionDecode(b *testing.B) {
+	const dim, heads, kvHeads, seqLenK = 128, 32, 8, 4096
+
+	backend := newTestBackend(b, map[string][]uint64{"x": {1}})
+
+	q, k, v, m := decodeData(dim, heads, kvHeads, seqLenK)
+
+	b.Run("Attention", func(b *testing.B) {
+		var copies int
+		for b.Loop() {
+			ctx := backend.NewContext()
+
+			var out ml.Tensor
+			out, copies = attentionGraph(b, ctx, q, k, v, m, dim, heads, kvHeads, 1, seqLenK)
+			ctx.Compute(out)
+			out.Floats()
+			ctx.Close()
+		}
+
+		b.ReportMetric(float64(copies), "copies/op")
+	})
+
+	b.Run("Broadcast", func(b *testing.B) {
+		for b.Loop() {
+			ctx := backend.NewContext()
+
+			query, key, value, mask := attentionInputs(b, ctx, q, k, v, m, dim, heads, kvHeads, 1, seqLenK)
+			out := broadcastAttention(ctx, query, key, value, mask, 0.5)
+			ctx.Forward(out)
+			ctx.Compute(out)
+			out.Floats()
+			ctx.Close()
+		}
+	})
+}
+
+// BenchmarkAttentionPrompt measures the unfused implementation of attention
+// for a prompt of 8k tokens, reporting the peak size of the compute buffers
+// with the default block size and with fixed ones
+func BenchmarkAttentionPrompt(b *testing.B) {
+	const dim, heads, kvHeads, seqLen = 64, 4, 4, 8192
+
+	q, k, v := make([]float32, dim*seqLen*heads), make([]float32, dim*seqLen*kvHeads), make([]float32, seqLen*dim*kvHeads)
+	for i := range q {
+		q[i] = float32(math.Sin(float64(3 * i)))
+	}
+
+	for i := range k {
+		k[i], v[i] = float32(math.Sin(float64(i))), float32(math.Cos(float64(i)))
+	}
+
+	for _, blockSize := range []int{0, 128, 1024, seqLen} {
+		b.Run(fmt.Sprintf("blockSize=%d", blockSize), func(b *testing.B) {
+			// the compute buffers only grow so each block size has its own
+			backend := newTestBackend(b, map[string][]uint64{"x": {1}})
+
+			for b.Loop() {
+				ctx := backend.NewContext()
+
+				query, err := ctx.FromFloatSlice(q, dim, seqLen, heads)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				key, err := ctx.FromFloatSlice(k, dim, seqLen, kvHeads)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				value, err := ctx.FromFloatSlice(v, seqLen, dim, kvHeads)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// sigmoid attention always uses the unfused implementation
+				out := nn.Attention(ctx, query, key, value, nil, 0.125, nn.WithSigmoid(-9), nn.WithBlockSize(blockSize))
+				ctx.Forward(out)
+				ctx.Compute(out)
+				ctx.Close()
+			}
+
+			b.ReportMetric(float64(GraphMemory(backend)), "peak-bytes")
+		})
+	}
+}
+
+func TestArgSort(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+
+	// rows with ties, including a row of equal elements
+	const n, rows = 37, 4
+	x := make([]float32, n*rows)
+	for i := range x {
+		x[i] = float32(i*7%5) - float32(i/n)
+	}
+	for i := range n {
+		x[3*n+i] = 1
+	}
+
+	for _, descending := range []bool{false, true} {
+		ctx := b.NewContext()
+
+		// a transposed view, to check strided inputs
+		in, err := ctx.FromFloatSlice(x, rows, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in = in.Permute(ctx, 1, 0, 2, 3)
+
+		values, indices := in.TopK(ctx, 5)
+		sorted := in.ArgSort(ctx, descending)
+		for _, t := range []ml.Tensor{sorted, values, indices} {
+			ctx.Forward(t)
+		}
+		ctx.Compute(sorted, values, indices)
+
+		got := bytesToInts(sorted.Bytes())
+		topValues, topIndices := values.Floats(), bytesToInts(indices.Bytes())
+		for row := range rows {
+			at := func(i int) float32 { return x[i*rows+row] }
+
+			want := make([]int32, n)
+			for i := range want {
+				want[i] = int32(i)
+			}
+
+			slices.SortStableFunc(want, func(a, b int32) int {
+				if descending {
+					return cmp.Compare(at(int(b)), at(int(a)))
+				}
+				return cmp.Compare(at(int(a)), at(int(b)))
+			})
+
+			if !slices.Equal(got[row*n:(row+1)*n], want) {
+				t.Errorf("descending %v: unexpected order of row %v: %v, want %v", descending, row, got[row*n:(row+1)*n], want)
+			}
+
+			slices.SortStableFunc(want, func(a, b int32) int { return cmp.Compare(at(int(b)), at(int(a))) })
+			if !slices.Equal(topIndices[row*5:(row+1)*5], want[:5]) {
+				t.Errorf("unexpected top indices of row %v: %v, want %v", row, topIndices[row*5:(row+1)*5], want[:5])
+			}
+
+			for i, idx := range want[:5] {
+				if topValues[row*5+i] != at(int(idx)) {
+					t.Errorf("unexpected top value %v of row %v: %v, want %v", i, row, topValues[row*5+i], at(int(idx)))
+				}
+			}
+		}
+
+		ctx.Close()
+	}
+}
+
+// TestTopKVocab checks ArgSort and TopK on a GPU over the logits of a large
+// vocabulary, whose rows don't fit in the shared memory of a block
+func TestTopKVocab(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	if len(b.(*Backend).gpus) == 0 {
+		t.Skip("no GPU")
+	}
+
+	const vocab, rows, k = 128 * 1024, 2, 40
+
+	// few distinct values, so that there are many ties
+	x := make([]float32, vocab*rows)
+	for i := range x {
+		x[i] = float32(i * 7919 % 1009)
+	}
+
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	in, err := ctx.FromFloatSlice(x, vocab, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sorted := in.ArgSort(ctx, true)
+	values, indices := in.TopK(ctx, k)
+	for _, t := range []ml.Tensor{sorted, values, indices} {
+		ctx.Forward(t)
+	}
+	ctx.Compute(sorted, values, indices)
+
+	got := bytesToInts(sorted.Bytes())
+	topValues, topIndices := values.Floats(), bytesToInts(indices.Bytes())
+	for row := range rows {
+		x := x[row*vocab : (row+1)*vocab]
+
+		want := make([]int32, vocab)
+		for i := range want {
+			want[i] = int32(i)
+		}
+		slices.SortStableFunc(want, func(a, b int32) int { return cmp.Compare(x[b], x[a]) })
+
+		for i, idx := range want {
+			if got[row*vocab+i] != idx {
+				t.Errorf("row %v: have index %v at %v; want %v", row, got[row*vocab+i], i, idx)
+				break
+			}
+		}
+
+		if !slices.Equal(topIndices[row*k:(row+1)*k], want[:k]) {
+			t.Errorf("row %v: have top indices %v; want %v", row, topIndices[row*k:(row+1)*k], want[:k])
+		}
+
+		for i, idx := range want[:k] {
+			if topValues[row*k+i] != x[idx] {
+				t.Errorf("row %v: have top value %v at %v; want %v", row, topValues[row*k+i], i, x[idx])
+			}
+		}
+	}
+}
+
+func bytesToInts(b []byte) []int32 {
+	s := make([]int32, len(b)/4)
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, s); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// BenchmarkTopK compares top-k selection over the logits of a large
+// vocabulary in the graph with copying the logits to the host and selecting
+// them with the sampler
+func BenchmarkTopK(b *testing.B) {
+	const vocab, k = 128 * 1024, 40
+
+	backend := newTestBackend(b, map[string][]uint64{"x": {1}})
+
+	logits := make([]float32, vocab)
+	for i := range logits {
+		logits[i] = float32(math.Sin(float64(i)))
+	}
+
+	b.Run("graph", func(b *testing.B) {
+		for b.Loop() {
+			ctx := backend.NewContext()
+			t, err := ctx.FromFloatSlice(logits, vocab)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			values, indices := t.TopK(ctx, k)
+			ctx.Forward(values)
+			ctx.Forward(indices)
+			ctx.Compute(values, indices)
+			values.Floats()
+			indices.Bytes()
+			ctx.Close()
+		}
+	})
+
+	b.Run("host", func(b *testing.B) {
+		for b.Loop() {
+			ctx := backend.NewContext()
+			t, err := ctx.FromFloatSlice(logits, vocab)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			// the scale stands in for the output layer that computes logits
+			t = t.Scale(ctx, 1)
+			ctx.Forward(t)
+			ctx.Compute(t)
+
+			f := t.Floats()
+			f64 := make([]float64, len(f))
+			for i, v := range f {
+				f64[i] = float64(v)
+			}
+
+			sample.TopK(k).Apply(f64)
+			ctx.Close()
+		}
+	})
+}
+
+func TestConcat(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+
+	// values of a tensor of shape [4, 3, 2] identifying its elements
+	values := func(base float32, ne [3]int) []float32 {
+		s := make([]float32, ne[0]*ne[1]*ne[2])
+		for i := range s {
+			s[i] = base + float32(i)
+		}
+		return s
+	}
+
+	for dim := range 3 {
+		for _, transposed := range []bool{false, true} {
+			for _, dtype := range []ml.DType{ml.DTypeF32, ml.DTypeF16} {
+				t.Run(fmt.Sprintf("dim=%d transposed=%v dtype=%v", dim, transposed, dtype), func(t *testing.T) {
+					ctx := b.NewContext()
+					defer ctx.Close()
+
+					ne1, ne2 := [3]int{4, 3, 2}, [3]int{4, 3, 2}
+					ne2[dim] = 1
+
+					x1, x2 := values(0, ne1), values(100, ne2)
+
+					// the inputs are transposed views of tensors with the
+					// first two dimensions swapped
+					tensor := func(s []float32, ne [3]int) ml.Tensor {
+						shape := ne[:]
+						if transposed {
+							shape = []int{ne[1], ne[0], ne[2]}
+							swapped := make([]float32, len(s))
+							for i2 := range ne[2] {
+								for i1 := range ne[1] {
+									for i0 := range ne[0] {
+										swapped[(i2*ne[0]+i0)*ne[1]+i1] = s[(i2*ne[1]+i1)*ne[0]+i0]
+									}
+								}
+							}
+							s = swapped
+						}
+
+						t1, err := ctx.FromFloatSlice(s, shape...)
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						if dtype == ml.DTypeF16 {
+							t1 = t1.Copy(ctx, ctx.Zeros(ml.DTypeF16, shape...))
+						}
+
+						if transposed {
+							t1 = t1.Permute(ctx, 1, 0, 2, 3)
+						}
+						return t1
+					}
+
+					out := tensor(x1, ne1).Concat(ctx, tensor(x2, ne2), dim)
+					if dtype == ml.DTypeF16 {
+						out = out.Copy(ctx, ctx.Zeros(ml.DTypeF32, out.Shape()...))
+					}
+
+					ctx.Forward(out)
+					ctx.Compute(out)
+
+					ne := ne1
+					ne[dim] += ne2[dim]
+					if !slices.Equal(out.Shape(), ne[:]) {
+						t.Fatalf("unexpected shape %v, want %v", out.Shape(), ne)
+					}
+
+					var want []float32
+					for i2 := range ne[2] {
+						for i1 := range ne[1] {
+							for i0 := range ne[0] {
+								idx := [3]int{i0, i1, i2}
+								s, n := x1, ne1
+								if idx[dim] >= ne1[dim] {
+									s, n = x2, ne2
+									idx[dim] -= ne1[dim]
+								}
+								want = append(want, s[(idx[2]*n[1]+idx[1])*n[0]+idx[0]])
+							}
+						}
+					}
+
+					if got := out.Floats(); !slices.Equal(got, want) {
+						t.Errorf("unexpected values %v, want %v", got, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestConcatShapeMismatch(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+	ctx := b.NewContext()
+	defer ctx.Close()
+
+	x := ctx.Zeros(ml.DTypeF32, 4, 3)
+	y := ctx.Zeros(ml.DTypeF32, 4, 2)
+
+	defer func() {
+		err, _ := recover().(error)
+		if err == nil || err.Error() != "concat along dimension 0 of tensors with shapes [4 3] and [4 2] that differ in dimension 1" {
+			t.Errorf("unexpected error %v", err)
+		}
+	}()
+
+	x.Concat(ctx, y, 0)
+}
+
+func TestPad(t *testing.T) {
+	b := newTestBackend(t, map[string][]uint64{"x": {1}})
+
+	for _, dtype := range []ml.DType{ml.DTypeF32, ml.DTypeF16} {
+		ctx := b.NewContext()
+
+		x, err := ctx.FromFloatSlice([]float32{1, 2, 3, 4, 5, 6}, 3, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dtype == ml.DTypeF16 {
+			x = x.Copy(ctx, ctx.Zeros(ml.DTypeF16, 3, 2))
+		}
+
+		// a transposed view of shape [2, 3], padded to [4, 4]
+		out := x.Permute(ctx, 1, 0, 2, 3).Pad(ctx, 2, 1)
+		if out.DType() != dtype {
+			t.Errorf("unexpected dtype %v, want %v", out.DType(), dtype)
+		}
+
+		if dtype == ml.DTypeF16 {
+			out = out.Copy(ctx, ctx.Zeros(ml.DTypeF32, out.Shape()...))
+		}
+
+		ctx.Forward(out)
+		ctx.Compute(out)
+
+		want := []float32{
+			1, 4, 0, 0,
+			2, 5, 0, 0,
+			3, 6, 0, 0,
+			0, 0, 0, 0,
+		}
+		if got := out.Floats(); !slices.Equal(got, want) {
+			t.Errorf("%v: unexpected values %v, want %v", dtype, got, want)
+		}
+
+		ctx.Close()
+	}
+}
@@ -0,0 +1,458 @@
+package ggml_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	fs "github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/kvcache"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/backend/ggml"
+	"github.com/ollama/ollama/ml/nn"
+	"github.com/ollama/ollama/model"
+	_ "github.com/ollama/ollama/model/models/llama"
+)
+
+type llamaConfig struct {
+	layers, hidden, heads, kvHeads, ffn, vocab int
+
+	// window, if positive, is the size of the sliding window of attention,
+	// which the last of every pattern layers doesn't use if pattern is set
+	window, pattern int
+}
+
+// writeLlama writes a llama model with small weights, which only depend on
+// the shapes of the tensors
+func writeLlama(t *testing.T, c llamaConfig) string {
+	t.Helper()
+
+	tokens := make([]string, c.vocab)
+	types := make([]int32, c.vocab)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("<%d>", i)
+		types[i] = 1
+	}
+
+	kv := fs.KV{
+		"general.architecture":                   "llama",
+		"llama.block_count":                      uint32(c.layers),
+		"llama.context_length":                   uint32(4096),
+		"llama.embedding_length":                 uint32(c.hidden),
+		"llama.feed_forward_length":              uint32(c.ffn),
+		"llama.attention.head_count":             uint32(c.heads),
+		"llama.attention.head_count_kv":          uint32(c.kvHeads),
+		"llama.attention.layer_norm_rms_epsilon": float32(1e-5),
+		"llama.rope.freq_base":                   float32(10000),
+		"tokenizer.ggml.model":                   "gpt2",
+		"tokenizer.ggml.tokens":                  tokens,
+		"tokenizer.ggml.token_type":              types,
+		"tokenizer.ggml.merges":                  []string{},
+	}
+
+	if c.window > 0 {
+		kv["llama.attention.sliding_window"] = uint32(c.window)
+	}
+
+	if c.pattern > 0 {
+		kv["llama.attention.sliding_window_pattern"] = uint32(c.pattern)
+	}
+
+	headDim := c.hidden / c.heads
+	shapes := []struct {
+		name  string
+		shape []uint64
+	}{
+		{"token_embd.weight", []uint64{uint64(c.vocab), uint64(c.hidden)}},
+		{"output_norm.weight", []uint64{uint64(c.hidden)}},
+		{"output.weight", []uint64{uint64(c.vocab), uint64(c.hidden)}},
+	}
+	for i := range c.layers {
+		for _, s := range []struct {
+			name  string
+			shape []uint64
+		}{
+			{"attn_norm", []uint64{uint64(c.hidden)}},
+			{"attn_q", []uint64{uint64(c.hidden), uint64(c.hidden)}},
+			{"attn_k", []uint64{uint64(c.kvHeads * headDim), uint64(c.hidden)}},
+			{"attn_v", []uint64{uint64(c.kvHeads * headDim), uint64(c.hidden)}},
+			{"attn_output", []uint64{uint64(c.hidden), uint64(c.hidden)}},
+			{"ffn_norm", []uint64{uint64(c.hidden)}},
+			{"ffn_gate", []uint64{uint64(c.ffn), uint64(c.hidden)}},
+			{"ffn_up", []uint64{uint64(c.ffn), uint64(c.hidden)}},
+			{"ffn_down", []uint64{uint64(c.hidden), uint64(c.ffn)}},
+		} {
+			shapes = append(shapes, struct {
+				name  string
+				shape []uint64
+			}{fmt.Sprintf("blk.%d.%s.weight", i, s.name), s.shape})
+		}
+	}
+
+	var tensors []fs.Tensor
+	for _, s := range shapes {
+		n := uint64(1)
+		for _, d := range s.shape {
+			n *= d
+		}
+
+		var buf bytes.Buffer
+		data := make([]float32, n)
+		for i := range data {
+			data[i] = float32(math.Sin(float64(i))) / 8
+		}
+
+		if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+			t.Fatal(err)
+		}
+		tensors = append(tensors, fs.Tensor{Name: s.name, Kind: 0, Shape: s.shape, WriterTo: &buf})
+	}
+
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fs.WriteGGUF(f, kv, tensors); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestEstimateGraphMemory(t *testing.T) {
+	cases := []struct {
+		name      string
+		config    llamaConfig
+		cacheType ml.DType
+		flash     bool
+		batch     int
+		ctxLen    int
+		kv        uint64
+	}{
+		{
+			name:      "f16",
+			config:    llamaConfig{layers: 2, hidden: 64, heads: 4, kvHeads: 4, ffn: 128, vocab: 512},
+			cacheType: ml.DTypeF16,
+			batch:     128,
+			ctxLen:    256,
+			kv:        2 * 256 * 4 * (16 + 16) * 2,
+		},
+		{
+			name:      "q8_0 gqa",
+			config:    llamaConfig{layers: 3, hidden: 192, heads: 6, kvHeads: 2, ffn: 256, vocab: 1000},
+			cacheType: ml.DTypeQ80,
+			batch:     128,
+			ctxLen:    256,
+			kv:        3 * 256 * 2 * (32 + 32) * 34 / 32,
+		},
+		{
+			name:      "q4_0 gqa",
+			config:    llamaConfig{layers: 3, hidden: 192, heads: 6, kvHeads: 2, ffn: 256, vocab: 1000},
+			cacheType: ml.DTypeQ40,
+			batch:     128,
+			ctxLen:    256,
+			kv:        3 * 256 * 2 * (32 + 32) * 18 / 32,
+		},
+		{
+			name:      "flash attention",
+			config:    llamaConfig{layers: 3, hidden: 192, heads: 6, kvHeads: 2, ffn: 256, vocab: 1000},
+			cacheType: ml.DTypeF16,
+			flash:     true,
+			batch:     128,
+			ctxLen:    256,
+			kv:        3 * 256 * 2 * (32 + 32) * 2,
+		},
+		{
+			// the cache only holds the window and a batch, while the loop
+			// below generates past 4 times the window
+			name:      "sliding window",
+			config:    llamaConfig{layers: 2, hidden: 64, heads: 4, kvHeads: 4, ffn: 128, vocab: 512, window: 32},
+			cacheType: ml.DTypeF16,
+			batch:     16,
+			ctxLen:    256,
+			kv:        2 * (32 + 16) * 4 * (16 + 16) * 2,
+		},
+		{
+			// every other layer uses global attention, as in Gemma 2
+			name:      "hybrid",
+			config:    llamaConfig{layers: 4, hidden: 64, heads: 4, kvHeads: 4, ffn: 128, vocab: 512, window: 32, pattern: 2},
+			cacheType: ml.DTypeF16,
+			batch:     64,
+			ctxLen:    256,
+			kv:        (2*(32+64) + 2*256) * 4 * (16 + 16) * 2,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := model.New(writeLlama(t, tt.config), ml.BackendParams{FlashAttention: tt.flash, KVCacheType: tt.cacheType})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			estimate := nn.BackendMemory(m.Backend(), 1, tt.batch, tt.ctxLen, tt.cacheType)
+			if estimate.KV != tt.kv {
+				t.Errorf("unexpected kv cache size %d, want %d", estimate.KV, tt.kv)
+			}
+
+			cache := m.Config().Cache
+			cache.Init(m.Backend(), tt.cacheType, 1, int32(tt.ctxLen), tt.batch)
+			defer cache.Close()
+
+			// fill the cache, as the graph grows with the number of keys
+			for start := 0; start < tt.ctxLen; start += tt.batch {
+				var opts model.Options
+				for i := range tt.batch {
+					opts.Inputs = append(opts.Inputs, int32(i%tt.config.vocab))
+					opts.Positions = append(opts.Positions, int32(start+i))
+					opts.Sequences = append(opts.Sequences, 0)
+					opts.Outputs = append(opts.Outputs, int32(i))
+				}
+
+				ctx := m.Backend().NewContext()
+				if _, err := model.Forward(ctx, m, opts); err != nil {
+					t.Fatal(err)
+				}
+				ctx.Close()
+			}
+
+			if tt.config.window > 0 && tt.config.pattern == 0 {
+				if c := cache.(*kvcache.Causal); c.Capacity != int32(tt.config.window+tt.batch) {
+					t.Errorf("unexpected cache capacity %d, want %d", c.Capacity, tt.config.window+tt.batch)
+				}
+			}
+
+			measured := ggml.GraphMemory(m.Backend())
+			if d := math.Abs(float64(estimate.Graph)-float64(measured)) / float64(measured); d > 0.1 {
+				t.Errorf("estimated graph memory %d differs from measured %d by %.1f%%", estimate.Graph, measured, 100*d)
+			}
+		})
+	}
+}
+
+// TestSlidingWindowLogits checks that a model whose layers mix sliding window
+// and global attention has the same logits as with a full cache for every
+// layer while the prompt fits in the window
+func TestSlidingWindowLogits(t *testing.T) {
+	const window, batch = 32, 8
+
+	config := llamaConfig{layers: 4, hidden: 64, heads: 4, kvHeads: 2, ffn: 128, vocab: 512}
+
+	logits := func(config llamaConfig) []float32 {
+		m, err := model.New(writeLlama(t, config), ml.BackendParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cache := m.Config().Cache
+		cache.Init(m.Backend(), ml.DTypeF16, 1, 256, batch)
+		defer cache.Close()
+
+		var all []float32
+		for start := 0; start < window; start += batch {
+			var opts model.Options
+			for i := range batch {
+				opts.Inputs = append(opts.Inputs, int32((start+i)*37%config.vocab))
+				opts.Positions = append(opts.Positions, int32(start+i))
+				opts.Sequences = append(opts.Sequences, 0)
+				opts.Outputs = append(opts.Outputs, int32(i))
+			}
+
+			ctx := m.Backend().NewContext()
+			out, err := model.Forward(ctx, m, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx.Compute(out)
+			all = append(all, out.Floats()...)
+			ctx.Close()
+		}
+
+		return all
+	}
+
+	want := logits(config)
+
+	config.window, config.pattern = window, 2
+	if got := logits(config); !slices.Equal(got, want) {
+		t.Errorf("logits with a hybrid cache differ from those with a full cache")
+	}
+}
+
+// TestSnapshotLogits checks that a sequence loaded from a snapshot continues
+// exactly as it would have in the cache it was saved from
+func TestSnapshotLogits(t *testing.T) {
+	const prompt, batch = 24, 8
+
+	path := writeLlama(t, llamaConfig{layers: 2, hidden: 64, heads: 4, kvHeads: 2, ffn: 128, vocab: 512})
+
+	newModel := func(dtype ml.DType) (model.Model, kvcache.Cache) {
+		m, err := model.New(path, ml.BackendParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cache := m.Config().Cache
+		cache.Init(m.Backend(), dtype, 2, 64, batch)
+		t.Cleanup(cache.Close)
+		return m, cache
+	}
+
+	forward := func(m model.Model, seq int, start, n int) []float32 {
+		var opts model.Options
+		for i := range n {
+			opts.Inputs = append(opts.Inputs, int32((start+i)*37%512))
+			opts.Positions = append(opts.Positions, int32(start+i))
+			opts.Sequences = append(opts.Sequences, seq)
+			opts.Outputs = append(opts.Outputs, int32(i))
+		}
+
+		ctx := m.Backend().NewContext()
+		defer ctx.Close()
+
+		out, err := model.Forward(ctx, m, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx.Compute(out)
+		return out.Floats()
+	}
+
+	for name, dtype := range map[string]ml.DType{"f16": ml.DTypeF16, "f32": ml.DTypeF32} {
+		t.Run(name, func(t *testing.T) {
+			src, cache := newModel(dtype)
+			for start := 0; start < prompt; start += batch {
+				forward(src, 0, start, batch)
+			}
+
+			var b bytes.Buffer
+			if err := cache.(kvcache.Snapshot).SaveSequence(&b, 0, prompt); err != nil {
+				t.Fatal(err)
+			}
+
+			want := forward(src, 0, prompt, 1)
+
+			// the snapshot is loaded into another sequence of a cache that
+			// hasn't allocated any layers yet
+			dst, cache := newModel(dtype)
+			if err := cache.(kvcache.Snapshot).LoadSequence(&b, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := forward(dst, 1, prompt, 1); !slices.Equal(got, want) {
+				t.Errorf("logits after loading a snapshot differ from those of the saved cache")
+			}
+		})
+	}
+}
+
+// TestQuantizedCachePerplexity checks that the perplexity of a prompt and its
+// logits with a quantized cache are within the tolerances documented in
+// docs/faq.md of those with an F16 cache, with and without flash attention.
+// The weights of the test model make its perplexity close to the size of its
+// vocabulary, so the error of the logits is the more sensitive measure.
+func TestQuantizedCachePerplexity(t *testing.T) {
+	const prompt, batch, vocab = 64, 16, 512
+
+	path := writeLlama(t, llamaConfig{layers: 2, hidden: 128, heads: 4, kvHeads: 2, ffn: 256, vocab: vocab})
+
+	inputs := make([]int32, prompt)
+	for i := range inputs {
+		inputs[i] = int32(i * 37 % vocab)
+	}
+
+	logits := func(dtype ml.DType, flash bool) []float32 {
+		m, err := model.New(path, ml.BackendParams{FlashAttention: flash, KVCacheType: dtype})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cache := m.Config().Cache
+		cache.Init(m.Backend(), dtype, 1, prompt, batch)
+		defer cache.Close()
+
+		var all []float32
+		for start := 0; start < prompt; start += batch {
+			var opts model.Options
+			for i := range batch {
+				opts.Inputs = append(opts.Inputs, inputs[start+i])
+				opts.Positions = append(opts.Positions, int32(start+i))
+				opts.Sequences = append(opts.Sequences, 0)
+				opts.Outputs = append(opts.Outputs, int32(i))
+			}
+
+			ctx := m.Backend().NewContext()
+			out, err := model.Forward(ctx, m, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx.Compute(out)
+			all = append(all, out.Floats()...)
+			ctx.Close()
+		}
+
+		return all
+	}
+
+	// perplexity is that of each next token of the prompt
+	perplexity := func(logits []float32) float64 {
+		var nll float64
+		for i := range prompt - 1 {
+			row := logits[i*vocab : (i+1)*vocab]
+			maxLogit := slices.Max(row)
+
+			var sum float64
+			for _, l := range row {
+				sum += math.Exp(float64(l - maxLogit))
+			}
+
+			nll += math.Log(sum) - float64(row[inputs[i+1]]-maxLogit)
+		}
+
+		return math.Exp(nll / (prompt - 1))
+	}
+
+	want := logits(ml.DTypeF16, false)
+	for _, tt := range []struct {
+		name               string
+		dtype              ml.DType
+		perplexity, logits float64
+	}{
+		{"q8_0", ml.DTypeQ80, 0.001, 0.001},
+		{"q4_0", ml.DTypeQ40, 0.005, 0.01},
+	} {
+		for _, flash := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s flash=%v", tt.name, flash), func(t *testing.T) {
+				got := logits(tt.dtype, flash)
+
+				// the root mean square error of the logits relative to
+				// their root mean square
+				var se, ss float64
+				for i := range want {
+					se += math.Pow(float64(got[i]-want[i]), 2)
+					ss += math.Pow(float64(want[i]), 2)
+				}
+
+				if d := math.Sqrt(se / ss); d > tt.logits {
+					t.Errorf("logits have a relative error of %.3f%%, want at most %v%%", 100*d, 100*tt.logits)
+				}
+
+				p, q := perplexity(got), perplexity(want)
+				if d := math.Abs(p-q) / q; d > tt.perplexity {
+					t.Errorf("perplexity %v differs from %v with an f16 cache by %.3f%%, want at most %v%%", p, q, 100*d, 100*tt.perplexity)
+				}
+			})
+		}
+	}
+}
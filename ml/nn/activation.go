@@ -0,0 +1,62 @@
+package nn
+
+import "github.com/ollama/ollama/ml"
+
+// GELU applies the Gaussian error linear unit with its tanh approximation,
+// 0.5·x·(1 + tanh(√(2/π)·(x + 0.044715·x³))). This is what models expect
+// whose Hugging Face configuration has a hidden_act of gelu_pytorch_tanh or
+// gelu_new, such as GPT-2, Gemma and SigLIP. Models trained with the exact
+// GELU should use GELUExact, as the approximation differs by up to about
+// 5e-4 per activation, which accumulates over layers.
+func GELU(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	return t.GELU(ctx)
+}
+
+// gelu are the coefficients of the odd polynomial q such that x·sigmoid(q(x))
+// approximates the exact GELU to within 3e-6 for inputs clamped to
+// [-geluClamp, geluClamp], in increasing order of degree
+var gelu = []float32{1.5956563, 0.072937579, -2.4972130e-4, -6.1162416e-5, 2.2381882e-6}
+
+// geluClamp bounds the input of q, where Φ(x) is within 3e-7 of 0 or 1
+const geluClamp = 5
+
+// GELUExact applies the Gaussian error linear unit x·Φ(x) = 0.5·x·(1 +
+// erf(x/√2)), where Φ is the cumulative distribution function of the
+// standard normal distribution. This is what models expect whose Hugging Face
+// configuration has a hidden_act of gelu, such as BERT, RoBERTa, ViT and
+// Whisper.
+//
+// Backends that implement ml.GELUErf compute erf directly. Otherwise GELU is
+// composed of elementwise operations, which are within 3e-6 of the exact
+// values.
+func GELUExact(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	if e, ok := t.(ml.GELUErf); ok {
+		return e.GELUErf(ctx)
+	}
+
+	x := t.Clamp(ctx, -geluClamp, geluClamp)
+	x2 := x.Mul(ctx, x)
+
+	// Horner's method in x², from the highest degree
+	q := x2.Scale(ctx, float64(gelu[len(gelu)-1]))
+	for i := len(gelu) - 2; i >= 0; i-- {
+		c, err := ctx.FromFloatSlice([]float32{gelu[i]}, 1)
+		if err != nil {
+			panic(err)
+		}
+
+		q = q.Add(ctx, c)
+		if i > 0 {
+			q = q.Mul(ctx, x2)
+		}
+	}
+
+	return t.Mul(ctx, q.Mul(ctx, x).Sigmoid(ctx))
+}
+
+// SiLU applies the sigmoid linear unit x·sigmoid(x), also known as swish.
+// This is the activation of the gate of the SwiGLU feed-forward networks of
+// LLaMA, Mistral and Qwen, with a hidden_act of silu.
+func SiLU(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	return t.SILU(ctx)
+}
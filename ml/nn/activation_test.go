@@ -0,0 +1,52 @@
+package nn
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+)
+
+func TestActivations(t *testing.T) {
+	ctx := &testContext{}
+
+	var x []float32
+	for i := -100; i <= 100; i++ {
+		x = append(x, float32(i)/10)
+	}
+
+	for name, tt := range map[string]struct {
+		fn        func(ml.Context, ml.Tensor) ml.Tensor
+		want      func(float64) float64
+		tolerance float64
+	}{
+		"gelu": {
+			GELU,
+			func(v float64) float64 { return 0.5 * v * (1 + math.Tanh(math.Sqrt(2/math.Pi)*(v+0.044715*v*v*v))) },
+			1e-6,
+		},
+		"gelu exact": {
+			GELUExact,
+			func(v float64) float64 { return 0.5 * v * (1 + math.Erf(v/math.Sqrt2)) },
+			5e-6,
+		},
+		"silu": {
+			SiLU,
+			func(v float64) float64 { return v / (1 + math.Exp(-v)) },
+			1e-6,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			want := make([]float32, len(x))
+			for i, v := range x {
+				want[i] = float32(tt.want(float64(v)))
+			}
+
+			assertFloats(t, want, tt.fn(ctx, ctx.fromFloats(x, len(x))).Floats(), tt.tolerance)
+		})
+	}
+
+	// the exact GELU is the identity for large inputs and zero for large
+	// negative inputs, beyond where its input is clamped
+	assertFloats(t, []float32{0, 1000}, GELUExact(ctx, ctx.fromFloats([]float32{-1000, 1000}, 2)).Floats(), 1e-3)
+}
@@ -1,11 +1,338 @@
 package nn
 
 import (
+	"cmp"
 	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ollama/ollama/ml"
 )
 
+// AttentionOption configures optional behavior of Attention
+type AttentionOption func(*attentionOptions)
+
+type attentionOptions struct {
+	// options that are passed through to fused implementations
+	ml.AttentionOptions
+
+	// valueDim is the expected d_v of value, if non-zero
+	valueDim int
+
+	// slopes are per-head ALiBi slopes that override those derived from MaxBias
+	slopes []float32
+
+	// keyPositions and queryPositions, if non-nil, are the positions from
+	// which the ALiBi bias is built
+	keyPositions, queryPositions []int32
+
+	// temperature divides the attention logits, if not 0 or 1
+	temperature float64
+
+	// blockSize is the number of queries processed at a time by the unfused
+	// implementation, if positive
+	blockSize int
+
+	// weights, if non-nil, receives the post-softmax attention weights. This
+	// requires the unfused implementation.
+	weights *ml.Tensor
+
+	// sigmoid replaces the softmax with sigmoid(logits + sigmoidBias), which
+	// requires the unfused implementation
+	sigmoid     bool
+	sigmoidBias float64
+
+	// bias is sigmoidBias as a tensor that broadcasts to the logits
+	bias ml.Tensor
+
+	// modifier, if non-nil, transforms the attention scores before the
+	// softmax, which requires the unfused implementation
+	modifier ScoreModifier
+
+	// halfPrecSoftmax computes the softmax of F16 logits in F16 rather than
+	// converting them to F32
+	halfPrecSoftmax bool
+
+	// scales, if non-nil, multiplies the attention logits in addition to the
+	// scalar scale. It broadcasts to [seq_len_k, seq_len_q, heads].
+	scales ml.Tensor
+
+	// logitBias, if non-nil, is added to the attention logits separately from
+	// the mask. It broadcasts to [seq_len_k, seq_len_q, heads].
+	logitBias ml.Tensor
+
+	// dropout is the probability of zeroing each attention weight, which
+	// requires the unfused implementation. dropoutSeed seeds the choice of
+	// weights if non-nil.
+	dropout     float64
+	dropoutSeed *uint64
+
+	// keep is the dropout mask with shape [seq_len_k, seq_len_q, heads],
+	// which is 0 for dropped weights and 1/(1-dropout) for others
+	keep ml.Tensor
+
+	// check, if non-nil, checks the weights of the unfused implementation
+	// or the output of the fused implementation for NaN and Inf. checkOnes
+	// sums the rows of the weights and checkOffset is the first query of
+	// the block.
+	check       *attentionCall
+	checkOnes   ml.Tensor
+	checkOffset int
+
+	// relPos, if non-nil, are the relative position embeddings of
+	// RelativePositionAttention and relPosOffset is the position of the
+	// first query of the block in the keys
+	relPos       ml.Tensor
+	relPosOffset int
+
+	// outputDType, if not DTypeOther, is the dtype that the output is
+	// converted to
+	outputDType ml.DType
+
+	// attends, if non-nil, is 0 for the queries whose output and weights
+	// are zeroed and 1 for others
+	attends ml.Tensor
+}
+
+func (o *attentionOptions) alibi() bool {
+	return o.MaxBias != 0 || o.slopes != nil
+}
+
+// WithValueDim validates that the value tensor has a d_v of valueDim. This
+// catches value tensors that have been reshaped or permuted incorrectly, which
+// would otherwise produce an output of the wrong size.
+func WithValueDim(valueDim int) AttentionOption {
+	return func(o *attentionOptions) {
+		o.valueDim = valueDim
+	}
+}
+
+// WithSoftcap caps the attention logits to softcap * tanh(logits / softcap)
+// after scaling and before the mask is added, as used by Gemma 2. A softcap of
+// zero disables capping.
+func WithSoftcap(softcap float64) AttentionOption {
+	return func(o *attentionOptions) {
+		o.Softcap = softcap
+	}
+}
+
+// WithTemperature divides the attention logits by temperature before the
+// softmax, after any softcap and before the mask is added. Temperatures above
+// 1 flatten the attention distribution and those below 1 sharpen it. A
+// temperature of 0 or 1 has no effect.
+func WithTemperature(temperature float64) AttentionOption {
+	return func(o *attentionOptions) {
+		o.temperature = temperature
+	}
+}
+
+// foldTemperature returns scale divided by the temperature if that is
+// equivalent to applying it, which is the case without a softcap, and clears
+// the temperature
+func (o *attentionOptions) foldTemperature(scale float64) float64 {
+	if o.temperature != 0 && (o.temperature == 1 || o.Softcap == 0) {
+		scale /= o.temperature
+		o.temperature = 0
+	}
+
+	return scale
+}
+
+// WithFullPrec accumulates the product of the attention weights and values
+// in full precision, as is always done for the product of keys and queries.
+// On backends that otherwise accumulate in half precision, such as CUDA, this
+// reduces drift in the output over very long contexts at the cost of slower
+// attention, which is worthwhile for evaluations that need reproducible
+// logits. The CPU backend ignores the requested precision.
+func WithFullPrec() AttentionOption {
+	return func(o *attentionOptions) {
+		o.FullPrec = true
+	}
+}
+
+// WithHalfPrecSoftmax computes the softmax of the attention logits in their
+// own precision when attention is not computed by a fused backend
+// implementation. By default, logits in F16, such as those of keys in F16 on
+// backends that multiply in the precision of their inputs, are converted to
+// F32 for the softmax and the weights converted back. The sum of the softmax
+// otherwise loses precision over long contexts, as F16 can't add small
+// weights to a sum of thousands of them. This skips the conversions for
+// models that don't need the precision.
+func WithHalfPrecSoftmax() AttentionOption {
+	return func(o *attentionOptions) {
+		o.halfPrecSoftmax = true
+	}
+}
+
+// WithBlockSize processes blockSize queries at a time when attention is not
+// computed by a fused backend implementation. This bounds the memory used by
+// the attention scores to [seq_len_k, blockSize, heads] at the cost of
+// additional operations, without changing the result.
+//
+// By default, queries are processed in blocks once the scores for all of them
+// would be too large. A blockSize <= 0 uses the default.
+func WithBlockSize(blockSize int) AttentionOption {
+	return func(o *attentionOptions) {
+		o.blockSize = blockSize
+	}
+}
+
+// WithBias adds bias to the attention logits, such as the learned relative
+// position bias of T5 or DeBERTa. Unlike the mask, which should only mask
+// keys, the bias isn't scaled by ALiBi slopes. It is added after the logits
+// are scaled, capped and divided by the temperature, and must broadcast to
+// [seq_len_k, seq_len_q, heads], so it may be shared by all heads or differ
+// for each.
+//
+// Fused backend implementations only add the mask, so attention with a bias
+// always uses the unfused implementation. A mask can still be passed alongside
+// the bias rather than folded into it. A nil bias has no effect.
+func WithBias(bias ml.Tensor) AttentionOption {
+	return func(o *attentionOptions) {
+		o.logitBias = bias
+	}
+}
+
+// WithSigmoid replaces the softmax over the attention logits with an
+// elementwise sigmoid of the logits plus bias, as in sigmoid attention. The
+// bias is added after the mask, so masked keys still receive a weight of
+// zero. Unlike the softmax, the weights of each query don't sum to 1 and a
+// bias of about -log(seq_len_k) keeps them at a similar scale.
+//
+// Sigmoid attention always uses the unfused implementation.
+func WithSigmoid(bias float64) AttentionOption {
+	return func(o *attentionOptions) {
+		o.sigmoid = true
+		o.sigmoidBias = bias
+	}
+}
+
+// ScoreModifier transforms the attention scores with shape [seq_len_k,
+// seq_len_q, heads] and returns scores of the same shape
+type ScoreModifier func(ctx ml.Context, scores ml.Tensor) ml.Tensor
+
+// WithScoreModifier applies modifier to the attention scores after they are
+// scaled and the mask and any bias are added, and before the softmax or
+// sigmoid. This allows experimenting with transformations of the scores, such
+// as top-k sparsification, without reimplementing attention. When queries are
+// processed in blocks, modifier is called for each block with the scores of
+// its queries.
+//
+// Supplying a modifier forces the unfused implementation, as fused backend
+// implementations don't expose the scores. A nil modifier has no effect.
+func WithScoreModifier(modifier ScoreModifier) AttentionOption {
+	return func(o *attentionOptions) {
+		o.modifier = modifier
+	}
+}
+
+// WithOutputDType converts the attention output to dtype, which must be F32
+// or F16. Otherwise, the output has the dtype of the product of the attention
+// weights and values, which depends on the dtypes of the inputs and the
+// backend. This allows an F32 output for operations that need the precision,
+// such as a normalization, or an F16 output to save memory before the
+// residual connection. No conversion is done if the output already has
+// dtype.
+func WithOutputDType(dtype ml.DType) AttentionOption {
+	return func(o *attentionOptions) {
+		o.outputDType = dtype
+	}
+}
+
+// WithMaskedQueries zeros the attention output and weights of the queries
+// that can't attend to any key, such as padding in a batch of sequences.
+// Their output would otherwise be NaN, which propagates to other sequences
+// through later layers. attends has shape [1, seq_len_q, heads], where heads
+// may be 1, and is 0 for these queries and 1 for others, as returned by
+// UnmaskQueries. The mask must leave some keys of these queries unmasked so
+// that their softmax is finite, which UnmaskQueries also ensures.
+func WithMaskedQueries(attends ml.Tensor) AttentionOption {
+	return func(o *attentionOptions) {
+		o.attends = attends
+	}
+}
+
+// WithDropoutSeed seeds the random choice of attention weights dropped by
+// AttentionWithDropout for the given layer and training step, so that the
+// same weights are dropped each time while different layers and steps drop
+// different weights. Otherwise, a different random seed is used for each
+// call.
+func WithDropoutSeed(seed uint64, layer, step int) AttentionOption {
+	return func(o *attentionOptions) {
+		seed := splitMix64(splitMix64(seed^uint64(layer)) ^ uint64(step))
+		o.dropoutSeed = &seed
+	}
+}
+
+// WithALiBi adds attention with linear biases (ALiBi) as used by models such
+// as MPT and BLOOM. Each head h adds ALiBiSlopes(heads, maxBias)[h] times the
+// negated distance between the query and key positions to the attention
+// logits. Queries are assumed to correspond to the last seq_len_q keys unless
+// their positions are given by WithALiBiPositions.
+//
+// The mask passed to Attention should only contain 0 and -Inf, as it is
+// scaled by the slopes along with the position bias. A maxBias of zero
+// disables ALiBi.
+func WithALiBi(maxBias float64) AttentionOption {
+	return func(o *attentionOptions) {
+		o.MaxBias = maxBias
+	}
+}
+
+// WithALiBiPositions gives the positions of the keys and queries from which
+// the ALiBi bias is built, as for PositionMask, rather than assuming that the
+// queries are the last seq_len_q keys in order. This is needed for caches
+// with gaps or shifts and for batches of several sequences. keyPositions must
+// have seq_len_k elements and queryPositions seq_len_q. AttentionWithPositions
+// passes its positions with this option.
+func WithALiBiPositions(keyPositions, queryPositions []int32) AttentionOption {
+	return func(o *attentionOptions) {
+		o.keyPositions, o.queryPositions = keyPositions, queryPositions
+	}
+}
+
+// ALiBiSlopes returns the per-head slopes of attention with linear biases for
+// the given number of heads. maxBias is typically 8.
+func ALiBiSlopes(heads int, maxBias float64) []float32 {
+	headsLog2 := 1 << int(math.Floor(math.Log2(float64(heads))))
+
+	m0 := math.Pow(2, -maxBias/float64(headsLog2))
+	m1 := math.Pow(2, -maxBias/2/float64(headsLog2))
+
+	slopes := make([]float32, heads)
+	for h := range slopes {
+		if h < headsLog2 {
+			slopes[h] = float32(math.Pow(m0, float64(h+1)))
+		} else {
+			slopes[h] = float32(math.Pow(m1, float64(2*(h-headsLog2)+1)))
+		}
+	}
+
+	return slopes
+}
+
+// ShapeMismatchError reports that a dimension of one of the tensors passed to
+// an operation is inconsistent with the other tensors
+type ShapeMismatchError struct {
+	// Op is the name of the operation, such as attention
+	Op string
+
+	// Dim is the name of the mismatched dimension, such as d_k or seq_len_k
+	Dim string
+
+	// Operand is the tensor with the mismatched dimension and Got is its size.
+	// Want is the size of the same dimension in the tensor named by Other.
+	Operand, Other string
+	Got, Want      int
+}
+
+func (e *ShapeMismatchError) Error() string {
+	return fmt.Sprintf("%s in %s operation does not match between %s(%v) and %s(%v)", e.Dim, e.Op, e.Other, e.Want, e.Operand, e.Got)
+}
+
 // Attention implements scaled dot-product attention for transformer models:
 // Attention(Q, K, V) = softmax(QK^T/√d_k)V
 //
@@ -15,45 +342,1221 @@ import (
 //   - key: Key tensor (K) with shape [d_k, seq_len_k, kv_heads]
 //   - value: Value tensor (V) with shape [seq_len_k, d_v, kv_heads]
 //   - mask: Optional attention mask that is added to the attention score. If
-//     provided, should broadcast to [seq_len_k, seq_len_q, heads]
-//   - scale: Scaling factor, typically 1/√d_k where d_k is the key dimension
+//     provided, should broadcast to [seq_len_k, seq_len_q, heads]. An I32
+//     mask is instead boolean, with 1 for the keys that each query attends
+//     to and 0 for those it doesn't, and is converted to an additive mask
+//   - scale: Scaling factor, typically 1/√d_k where d_k is the key dimension.
+//     Zero uses DefaultAttentionScale(query), while any other value overrides
+//     it for models with nonstandard scaling
+//   - opts: Optional modifications to the attention computation, such as WithSoftcap
 //
 // Returns:
 //
 //	Attention output with shape [d_v, heads, seq_len_q]
-func Attention(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64) ml.Tensor {
+//
+// heads must be a multiple of kv_heads. For grouped-query attention, each
+// key and value head h is broadcast to the query heads in
+// [h*heads/kv_heads, (h+1)*heads/kv_heads).
+//
+// query and key must have floating point or quantized dtypes. If they differ,
+// the one with lower precision is upcast to the dtype of the other before
+// their product, such as an F16 key to F32 for an F32 query. A quantized key,
+// such as that of a quantized cache, is kept as it is and multiplied with an
+// F32 query instead, which dequantizes it a block at a time. Quantized values
+// are likewise dequantized a block of keys at a time rather than copied in
+// full. Fused implementations take mixed dtypes as they are.
+//
+// Variants of attention are selected with options rather than separate
+// functions. For example, Gemma 2 caps the logits with WithSoftcap, sigmoid
+// attention replaces the softmax with WithSigmoid, WithTemperature divides
+// the logits independently of scale and WithFullPrec accumulates the output
+// in full precision. Grouped-query attention needs no option.
+//
+// Attention panics if the shapes of the tensors are inconsistent. Use
+// AttentionErr to handle these cases as errors.
+func Attention(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, opts ...AttentionOption) ml.Tensor {
+	kqv, err := AttentionErr(ctx, query, key, value, mask, scale, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	return kqv
+}
+
+// DefaultAttentionScale returns 1/√d_k, the standard scale of the attention
+// logits for query with shape [d_k, seq_len_q, heads]. This is the key
+// dimension of each head rather than that of the values or of all heads.
+func DefaultAttentionScale(query ml.Tensor) float64 {
+	return 1 / math.Sqrt(float64(query.Dim(0)))
+}
+
+// AttentionErr is like Attention but returns an error instead of panicking if
+// the shapes of the tensors are inconsistent. Mismatched dimensions are
+// reported as a *ShapeMismatchError.
+func AttentionErr(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, opts ...AttentionOption) (ml.Tensor, error) {
+	var o attentionOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	if query.Dim(0) != key.Dim(0) {
-		panic(fmt.Errorf("d_k in attention operation does not match between query(%v) and key(%v)", query.Dim(0), key.Dim(0)))
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "d_k", Other: "query", Want: query.Dim(0), Operand: "key", Got: key.Dim(0)}
 	}
 
 	if mask != nil && query.Dim(1) != mask.Dim(1) {
-		panic(fmt.Errorf("seq_len_q in attention operation does not match between query(%v) and mask(%v)", query.Dim(1), mask.Dim(1)))
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "seq_len_q", Other: "query", Want: query.Dim(1), Operand: "mask", Got: mask.Dim(1)}
 	}
 
 	if key.Dim(1) != value.Dim(0) {
-		panic(fmt.Errorf("seq_len_k in attention operation does not match between key(%v) and value(%v)", key.Dim(1), value.Dim(0)))
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "seq_len_k", Other: "key", Want: key.Dim(1), Operand: "value", Got: value.Dim(0)}
 	}
 
 	if mask != nil && key.Dim(1) != mask.Dim(0) {
-		panic(fmt.Errorf("seq_len_k in attention operation does not match between key(%v) and mask(%v)", key.Dim(1), mask.Dim(0)))
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "seq_len_k", Other: "key", Want: key.Dim(1), Operand: "mask", Got: mask.Dim(0)}
 	}
 
 	if key.Dim(2) != value.Dim(2) {
-		panic(fmt.Errorf("kv_heads in attention operation does not match between key(%v) and value(%v)", key.Dim(2), value.Dim(2)))
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "kv_heads", Other: "key", Want: key.Dim(2), Operand: "value", Got: value.Dim(2)}
+	}
+
+	if heads, kvHeads := query.Dim(2), key.Dim(2); kvHeads == 0 || heads%kvHeads != 0 {
+		return nil, fmt.Errorf("heads(%v) in attention operation is not a multiple of kv_heads(%v)", heads, kvHeads)
+	}
+
+	if query.DType() == ml.DTypeI32 || key.DType() == ml.DTypeI32 {
+		return nil, fmt.Errorf("dtypes in attention operation are not floating point: query(%v) and key(%v)", query.DType(), key.DType())
+	}
+
+	if o.outputDType != ml.DTypeOther && o.outputDType != ml.DTypeF32 && o.outputDType != ml.DTypeF16 {
+		return nil, fmt.Errorf("output dtype of attention operation is not F32 or F16: %v", o.outputDType)
+	}
+
+	if o.attends != nil && o.attends.Dim(1) != query.Dim(1) {
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "seq_len_q", Other: "query", Want: query.Dim(1), Operand: "masked queries", Got: o.attends.Dim(1)}
+	}
+
+	if o.valueDim != 0 && value.Dim(1) != o.valueDim {
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "d_v", Other: "expected", Want: o.valueDim, Operand: "value", Got: value.Dim(1)}
+	}
+
+	if o.slopes != nil && len(o.slopes) != query.Dim(2) {
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "heads", Other: "query", Want: query.Dim(2), Operand: "slopes", Got: len(o.slopes)}
+	}
+
+	if o.keyPositions != nil && len(o.keyPositions) != key.Dim(1) {
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "seq_len_k", Other: "key", Want: key.Dim(1), Operand: "key positions", Got: len(o.keyPositions)}
+	}
+
+	if o.queryPositions != nil && len(o.queryPositions) != query.Dim(1) {
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "seq_len_q", Other: "query", Want: query.Dim(1), Operand: "query positions", Got: len(o.queryPositions)}
+	}
+
+	if o.logitBias != nil {
+		logits := [4]int{key.Dim(1), query.Dim(1), query.Dim(2), 1}
+		for d, want := range logits {
+			if n := o.logitBias.Dim(d); n != 1 && n != want {
+				return nil, &ShapeMismatchError{Op: "attention", Dim: maskDims[d], Other: "logits", Want: want, Operand: "bias", Got: n}
+			}
+		}
+	}
+
+	if o.relPos != nil {
+		if o.relPos.Dim(0) != query.Dim(0) {
+			return nil, &ShapeMismatchError{Op: "attention", Dim: "d_k", Other: "query", Want: query.Dim(0), Operand: "relative positions", Got: o.relPos.Dim(0)}
+		}
+
+		if want := 2*key.Dim(1) - 1; o.relPos.Dim(1) != want {
+			return nil, &ShapeMismatchError{Op: "attention", Dim: "2*seq_len_k-1", Other: "key", Want: want, Operand: "relative positions", Got: o.relPos.Dim(1)}
+		}
+
+		if n := o.relPos.Dim(2); n != 1 && n != query.Dim(2) {
+			return nil, &ShapeMismatchError{Op: "attention", Dim: "heads", Other: "query", Want: query.Dim(2), Operand: "relative positions", Got: n}
+		}
+
+		o.relPosOffset = key.Dim(1) - query.Dim(1)
+	}
+
+	if scale == 0 {
+		scale = DefaultAttentionScale(query)
+	}
+
+	scale = o.foldTemperature(scale)
+
+	if c := attentionChecks.Load(); c != nil {
+		o.check = c.call(query, key)
+	}
+
+	// intermediate tensors are labeled within attn, such as attn.kq for the
+	// logits, when tracing the graph
+	ctx = ml.Name(ctx, "attn")
+	maskCtx := ml.Name(ctx, "kq_mask")
+
+	if mask != nil && mask.DType() == ml.DTypeI32 {
+		var err error
+		mask, err = additiveMask(maskCtx, mask)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.alibi() {
+		keyPositions, queryPositions := o.keyPositions, o.queryPositions
+		if keyPositions == nil {
+			keyPositions = make([]int32, key.Dim(1))
+			for i := range keyPositions {
+				keyPositions[i] = int32(i)
+			}
+		}
+
+		if queryPositions == nil {
+			queryPositions = make([]int32, query.Dim(1))
+			for i := range queryPositions {
+				queryPositions[i] = int32(key.Dim(1) - query.Dim(1) + i)
+			}
+		}
+
+		bias, err := distanceMask(maskCtx, keyPositions, queryPositions)
+		if err != nil {
+			return nil, err
+		}
+
+		if mask != nil {
+			mask = mask.Add(maskCtx, bias)
+		} else {
+			mask = bias
+		}
+	}
+
+	kqv, err := o.forward(ctx, query, key, value, mask, scale)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.attends != nil {
+		if o.weights != nil {
+			*o.weights = (*o.weights).Mul(ml.Name(ctx, "kq_softmax"), o.attends)
+		}
+
+		outCtx := ml.Name(ctx, "kqv_out")
+		kqv = kqv.Mul(outCtx, permute(outCtx, o.attends, 0, 2, 1, 3))
+	}
+
+	if o.outputDType != ml.DTypeOther && kqv.DType() != o.outputDType {
+		outCtx := ml.Name(ctx, "kqv_out")
+		kqv = kqv.Copy(outCtx, outCtx.Zeros(o.outputDType, kqv.Shape()...))
+	}
+
+	return kqv, nil
+}
+
+// AttentionConfig configures the attention of layers that share a shape,
+// which is usually all of the layers of a model. The values derived from it,
+// such as the scale, are validated and computed once on first use, so a model
+// should construct one for each shape of attention and reuse it across layers
+// and forward passes. It must not be changed after it has been used.
+type AttentionConfig struct {
+	// HeadDim is d_k, the key dimension of each head, which queries must have
+	HeadDim int
+
+	// Scale is the scale of the attention logits, or 0 for 1/√HeadDim
+	Scale float64
+
+	// Causal masks the keys after each query if Attention is passed a nil
+	// mask. Queries are assumed to correspond to the last seq_len_q keys.
+	Causal bool
+
+	// Window, if positive, also masks the keys more than Window positions
+	// before each query, as in SlidingWindowMask. It implies Causal.
+	Window int
+
+	// Softcap caps the attention logits as in WithSoftcap
+	Softcap float64
+
+	once  sync.Once
+	err   error
+	scale float64
+	opts  []AttentionOption
+}
+
+func (c *AttentionConfig) init() error {
+	c.once.Do(func() {
+		switch {
+		case c.HeadDim <= 0:
+			c.err = fmt.Errorf("invalid attention head dimension %v", c.HeadDim)
+		case c.Scale < 0 || math.IsNaN(c.Scale) || math.IsInf(c.Scale, 0):
+			c.err = fmt.Errorf("invalid attention scale %v", c.Scale)
+		case c.Window < 0:
+			c.err = fmt.Errorf("invalid attention window %v", c.Window)
+		case c.Softcap < 0:
+			c.err = fmt.Errorf("invalid attention softcap %v", c.Softcap)
+		}
+
+		c.scale = cmp.Or(c.Scale, 1/math.Sqrt(float64(c.HeadDim)))
+		if c.Softcap != 0 {
+			c.opts = []AttentionOption{WithSoftcap(c.Softcap)}
+		}
+	})
+
+	return c.err
+}
+
+// Mask builds the mask that Attention uses for a nil mask, which is causal
+// or a sliding window, or returns nil if c is neither. Models can build it
+// once for each forward pass and pass it to the Attention of every layer.
+func (c *AttentionConfig) Mask(ctx ml.Context, seqLenQ, seqLenK int) (ml.Tensor, error) {
+	if !c.Causal && c.Window <= 0 {
+		return nil, nil
+	}
+
+	return SlidingWindowMask(ctx, seqLenQ, seqLenK, c.Window, nil)
+}
+
+// Attention computes attention as the function Attention does, with the
+// scale and softcap of c. A nil mask is replaced by that built by Mask, while
+// any other mask, such as that of a KV cache, is used as is and should already
+// be causal if needed. opts are applied after those of c, so they override
+// them.
+//
+// Attention panics if c is invalid or the shapes of the tensors are
+// inconsistent with each other or with c.
+func (c *AttentionConfig) Attention(ctx ml.Context, query, key, value, mask ml.Tensor, opts ...AttentionOption) ml.Tensor {
+	kqv, err := c.AttentionErr(ctx, query, key, value, mask, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	return kqv
+}
+
+// AttentionErr is like Attention but returns an error instead of panicking.
+func (c *AttentionConfig) AttentionErr(ctx ml.Context, query, key, value, mask ml.Tensor, opts ...AttentionOption) (ml.Tensor, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	if query.Dim(0) != c.HeadDim {
+		return nil, &ShapeMismatchError{Op: "attention", Dim: "d_k", Other: "config", Want: c.HeadDim, Operand: "query", Got: query.Dim(0)}
+	}
+
+	if mask == nil {
+		var err error
+		mask, err = c.Mask(ctx, query.Dim(1), key.Dim(1))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.opts != nil {
+		opts = append(c.opts[:len(c.opts):len(c.opts)], opts...)
+	}
+
+	return AttentionErr(ctx, query, key, value, mask, c.scale, opts...)
+}
+
+// forward computes attention with the fused implementation if possible and
+// otherwise with the unfused implementation
+func (o *attentionOptions) forward(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64) (ml.Tensor, error) {
+	reason := o.fallback(ctx, query, value, mask)
+	if reason == "" {
+		kqv := query.(ml.ScaledDotProductAttention).ScaledDotProductAttention(ml.Name(ctx, "kqv"), key, value, mask, scale, o.AttentionOptions)
+		if o.check != nil {
+			ones, err := ctx.FromFloatSlice(slices.Repeat([]float32{1}, kqv.Dim(0)), kqv.Dim(0))
+			if err != nil {
+				return nil, err
+			}
+
+			o.check.check(ctx, "output", kqv, ones, 0)
+		}
+
+		return kqv, nil
+	}
+
+	if hook := fallbackHook.Load(); hook != nil {
+		(*hook)(reason)
+	}
+
+	query, key = upcast(ml.Name(ctx, "kq"), query, key)
+
+	var slopes, inverse ml.Tensor
+	if o.alibi() {
+		s := o.slopes
+		if s == nil {
+			s = ALiBiSlopes(query.Dim(2), o.MaxBias)
+		}
+
+		inv := make([]float32, len(s))
+		for i := range s {
+			inv[i] = 1 / s[i]
+		}
+
+		var err error
+		slopes, err = ctx.FromFloatSlice(s, 1, 1, len(s))
+		if err != nil {
+			return nil, err
+		}
+
+		inverse, err = ctx.FromFloatSlice(inv, 1, 1, len(inv))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.sigmoid {
+		bias, err := ctx.FromFloatSlice([]float32{float32(o.sigmoidBias)}, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		o.bias = bias
+	}
+
+	if o.dropout > 0 {
+		keep, err := dropoutMask(ctx, key.Dim(1), query.Dim(1), query.Dim(2), o.dropout, o.dropoutSeed)
+		if err != nil {
+			return nil, err
+		}
+
+		o.keep = keep
+	}
+
+	if o.check != nil {
+		ones, err := ctx.FromFloatSlice(slices.Repeat([]float32{1}, key.Dim(1)), key.Dim(1))
+		if err != nil {
+			return nil, err
+		}
+
+		o.checkOnes = ones
+	}
+
+	seqLenQ := query.Dim(1)
+
+	blockSize := o.blockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize(seqLenQ, key.Dim(1), query.Dim(2), workspace(ctx))
+	}
+
+	if o.weights != nil || blockSize >= seqLenQ {
+		return o.attention(ctx, query, key, value, mask, scale, slopes, inverse), nil
+	}
+
+	// process blocks of queries to bound the size of the attention scores.
+	// each query attends to all keys so the blocks are independent and the
+	// results are the same as attending to all queries at once.
+	var blocks []ml.Tensor
+	for i := 0; i < seqLenQ; i += blockSize {
+		n := min(blockSize, seqLenQ-i)
+
+		q := query.View(ctx, query.Stride(1)*i,
+			query.Dim(0), query.Stride(1),
+			n, query.Stride(2),
+			query.Dim(2),
+		)
+
+		var m ml.Tensor
+		if mask != nil {
+			m = mask.View(ctx, mask.Stride(1)*i,
+				mask.Dim(0), mask.Stride(1),
+				n, mask.Stride(2),
+				mask.Dim(2),
+			)
+		}
+
+		// scales that differ between queries are split in the same way
+		bo := *o
+		bo.checkOffset = i
+		bo.relPosOffset = o.relPosOffset + i
+		if o.scales != nil && o.scales.Dim(1) != 1 {
+			bo.scales = o.scales.View(ctx, o.scales.Stride(1)*i,
+				o.scales.Dim(0), o.scales.Stride(1),
+				n, o.scales.Stride(2),
+				o.scales.Dim(2),
+			)
+		}
+
+		if o.logitBias != nil && o.logitBias.Dim(1) != 1 {
+			bo.logitBias = o.logitBias.View(ctx, o.logitBias.Stride(1)*i,
+				o.logitBias.Dim(0), o.logitBias.Stride(1),
+				n, o.logitBias.Stride(2),
+				o.logitBias.Dim(2),
+			)
+		}
+
+		if o.keep != nil {
+			bo.keep = o.keep.View(ctx, o.keep.Stride(1)*i,
+				o.keep.Dim(0), o.keep.Stride(1),
+				n, o.keep.Stride(2),
+				o.keep.Dim(2),
+			)
+		}
+
+		blocks = append(blocks, bo.attention(ctx, q, key, value, m, scale, slopes, inverse))
+	}
+
+	return blocks[0].Stack(ctx, 2, blocks[1:]...), nil
+}
+
+// fallback returns why attention can't be computed by a fused
+// implementation, or "" if it can. value may be nil if it isn't known yet.
+func (o *attentionOptions) fallback(ctx ml.Context, query, value, mask ml.Tensor) string {
+	if _, ok := query.(ml.ScaledDotProductAttention); !ok {
+		return "backend has no fused attention"
+	}
+
+	// fused implementations only support scalar scales, slopes derived from
+	// MaxBias and masks shared by all heads, don't add a bias other than the
+	// mask, don't expose the attention weights or scores, can't apply a
+	// temperature after capping, always use the softmax and don't drop weights
+	switch {
+	case o.scales != nil:
+		return "per-head scales"
+	case o.logitBias != nil:
+		return "attention bias"
+	case o.relPos != nil:
+		return "relative positions"
+	case o.slopes != nil:
+		return "custom ALiBi slopes"
+	case o.weights != nil:
+		return "attention weights requested"
+	case o.temperature != 0:
+		return "temperature with softcap"
+	case o.sigmoid:
+		return "sigmoid attention"
+	case o.modifier != nil:
+		return "score modifier"
+	case o.dropout > 0:
+		return "dropout"
+	case mask != nil && mask.Dim(2) != 1:
+		return "per-head mask"
+	}
+
+	// flash attention kernels may not support all head sizes, such as those
+	// that aren't a power of two, which would otherwise fail when the graph
+	// is computed
+	fa, ok := ctx.(ml.FlashAttention)
+	flash := ok && fa.FlashAttentionEnabled()
+	if flash && !fa.SupportsFlashAttention(query.Dim(0)) {
+		return fmt.Sprintf("flash attention doesn't support head size %v", query.Dim(0))
+	}
+
+	// without flash attention, fused implementations multiply the weights
+	// by the transposed values, which can't be done for quantized values
+	// until they are dequantized
+	if value != nil && quantized(value.DType()) && (!flash || value.Dim(1) != query.Dim(0)) {
+		return "quantized values without flash attention"
+	}
+
+	return ""
+}
+
+// SupportsFusedAttention reports whether Attention computes attention for
+// query with a fused backend implementation given opts and a mask that is
+// shared by all heads. Otherwise, attention is composed of tensor operations,
+// which is slower and uses more memory.
+func SupportsFusedAttention(ctx ml.Context, query ml.Tensor, opts ...AttentionOption) bool {
+	var o attentionOptions
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	if sdpa, ok := query.(ml.ScaledDotProductAttention); ok {
-		return sdpa.ScaledDotProductAttention(ctx, key, value, mask, scale)
+	o.foldTemperature(1)
+	return o.fallback(ctx, query, nil, nil) == ""
+}
+
+var fallbackHook atomic.Pointer[func(reason string)]
+
+// SetAttentionFallbackHook sets fn to be called with the reason, such as
+// "per-head scales", whenever Attention falls back from the fused backend
+// implementation to the unfused implementation. This is called while the
+// graph is built, so once per layer of each forward pass. A nil fn removes
+// the hook.
+func SetAttentionFallbackHook(fn func(reason string)) {
+	if fn == nil {
+		fallbackHook.Store(nil)
 	} else {
-		kq := key.MulmatFullPrec(ctx, query)
+		fallbackHook.Store(&fn)
+	}
+}
+
+// defaultWorkspace is the memory that the attention scores may use if the
+// context doesn't implement ml.Workspace
+const defaultWorkspace = 1 << 28
+
+// maxAttentionBlocks bounds the number of blocks, as each one adds operations
+// to the graph. Backends size their graphs for this many blocks per layer.
+const maxAttentionBlocks = 64
+
+// workspace returns the memory that the attention scores may use in ctx
+func workspace(ctx ml.Context) uint64 {
+	if w, ok := ctx.(ml.Workspace); ok && w.Workspace() > 0 {
+		return w.Workspace()
+	}
+
+	return defaultWorkspace
+}
+
+// defaultBlockSize returns the number of queries to process at a time so that
+// their F32 scores fit in workspace bytes
+func defaultBlockSize(seqLenQ, seqLenK, heads int, workspace uint64) int {
+	scores := int(workspace / 4)
+	if seqLenQ*seqLenK*heads <= scores {
+		return seqLenQ
+	}
+
+	blockSize := max(1, scores/(seqLenK*heads))
+	return max(blockSize, (seqLenQ+maxAttentionBlocks-1)/maxAttentionBlocks)
+}
+
+// attention is the unfused implementation of attention, composed of tensor
+// operations. slopes and inverse are the ALiBi slopes and their reciprocals
+// with shape [1, 1, heads] if ALiBi is enabled.
+func (o *attentionOptions) attention(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, slopes, inverse ml.Tensor) ml.Tensor {
+	kqCtx := ml.Name(ctx, "kq")
+
+	seqLenQ, heads, kvHeads := query.Dim(1), query.Dim(2), key.Dim(2)
+	grouped := groupHeads(seqLenQ, heads, kvHeads)
+	if grouped {
+		query = contiguous(kqCtx, query)
+	}
+
+	if foldScale(query, key, scale) {
+		query, scale = query.Scale(kqCtx, scale), 1
+	}
+
+	// the scores of the relative positions are computed from the same
+	// query, so they're scaled along with the logits
+	var pos ml.Tensor
+	if o.relPos != nil {
+		pos = skew(kqCtx, o.relPos.MulmatFullPrec(kqCtx, query), key.Dim(1), o.relPosOffset)
+	}
+
+	var kq ml.Tensor
+	if grouped {
+		// the queries of the heads that share each key head are adjacent,
+		// so the logits of each group are a single matrix product with its
+		// key head
+		query = query.Reshape(kqCtx, query.Dim(0), seqLenQ*heads/kvHeads, kvHeads)
+		kq = key.MulmatFullPrec(kqCtx, query).Reshape(kqCtx, key.Dim(1), seqLenQ, heads)
+	} else {
+		kq = key.MulmatFullPrec(kqCtx, query)
+	}
+
+	if pos != nil {
+		kq = kq.Add(kqCtx, pos)
+	}
+
+	return o.attend(ctx, kq, value, mask, scale, slopes, inverse)
+}
+
+// precision orders the dtypes that query and key can have from the lowest
+// to the highest precision, with 0 for dtypes that aren't ordered
+func precision(dtype ml.DType) int {
+	switch dtype {
+	case ml.DTypeQ40:
+		return 1
+	case ml.DTypeQ80:
+		return 2
+	case ml.DTypeF16:
+		return 3
+	case ml.DTypeF32:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// quantized reports whether dtype is quantized in blocks
+func quantized(dtype ml.DType) bool {
+	return dtype == ml.DTypeQ40 || dtype == ml.DTypeQ80
+}
+
+// upcast copies the one of query and key with lower precision to the dtype
+// of the other, or both to F32 if the higher precision is quantized, so that
+// their product is computed in the higher precision. They are returned as
+// they are if their dtypes match or either is unknown. A quantized key is
+// kept as it is, as backends multiply it by an F32 query a block at a time,
+// so only the query is copied to F32 if needed.
+func upcast(ctx ml.Context, query, key ml.Tensor) (ml.Tensor, ml.Tensor) {
+	if quantized(key.DType()) && precision(query.DType()) > precision(key.DType()) {
+		if query.DType() != ml.DTypeF32 {
+			query = query.Copy(ctx, ctx.Zeros(ml.DTypeF32, query.Shape()...))
+		}
+
+		return query, key
+	}
+
+	q, k := precision(query.DType()), precision(key.DType())
+	if q == k || q == 0 || k == 0 {
+		return query, key
+	}
+
+	dtype := query.DType()
+	if k > q {
+		dtype = key.DType()
+	}
+
+	if dtype != ml.DTypeF16 {
+		dtype = ml.DTypeF32
+	}
+
+	if query.DType() != dtype {
+		query = query.Copy(ctx, ctx.Zeros(dtype, query.Shape()...))
+	}
+
+	if key.DType() != dtype {
+		key = key.Copy(ctx, ctx.Zeros(dtype, key.Shape()...))
+	}
+
+	return query, key
+}
+
+// foldScale reports whether the unfused implementation scales the query
+// rather than the logits, which is the same product with fewer
+// multiplications when d_k is less than seq_len_k. This is only done for F32
+// queries, as scaling a half precision query before the product could
+// overflow its range or round small values away, and for contiguous queries,
+// which backends may require to scale a tensor without copying it first.
+func foldScale(query, key ml.Tensor, scale float64) bool {
+	if scale == 1 || query.DType() != ml.DTypeF32 || query.Dim(0) >= key.Dim(1) {
+		return false
+	}
+
+	c, ok := query.(ml.IsContiguous)
+	return ok && c.IsContiguous()
+}
+
+// attend computes the attention output from the attention logits kq with
+// shape [seq_len_k, seq_len_q, heads], which are yet to be scaled by scale
+func (o *attentionOptions) attend(ctx ml.Context, kq, value, mask ml.Tensor, scale float64, slopes, inverse ml.Tensor) ml.Tensor {
+	kqCtx, weightsCtx, kqvCtx := ml.Name(ctx, "kq"), ml.Name(ctx, "kq_softmax"), ml.Name(ctx, "kqv")
+
+	if scale != 1 {
+		kq = kq.Scale(kqCtx, scale)
+	}
+	if o.scales != nil {
+		kq = kq.Mul(kqCtx, o.scales)
+	}
+
+	if o.Softcap != 0 {
+		kq = kq.Scale(kqCtx, 1/o.Softcap).Tanh(kqCtx).Scale(kqCtx, o.Softcap)
+	}
+
+	if o.temperature != 0 && o.temperature != 1 {
+		kq = kq.Scale(kqCtx, 1/o.temperature)
+	}
+
+	if o.logitBias != nil {
+		kq = kq.Add(kqCtx, o.logitBias)
+	}
+
+	if slopes != nil {
+		// kq + slope * mask, computed as slope * (kq / slope + mask) so that
+		// the mask only needs to broadcast over heads
+		kq = kq.Mul(kqCtx, inverse).Add(kqCtx, mask).Mul(kqCtx, slopes)
+	} else if mask != nil {
+		kq = kq.Add(kqCtx, mask)
+	}
+
+	if o.modifier != nil {
+		kq = o.modifier(kqCtx, kq)
+	}
+
+	if o.sigmoid {
+		kq = kq.Add(weightsCtx, o.bias).Sigmoid(weightsCtx)
+	} else {
+		kq = o.softmax(weightsCtx, kq)
+	}
+
+	if o.keep != nil {
+		kq = kq.Mul(weightsCtx, o.keep)
+	}
+
+	if o.check != nil {
+		o.check.check(ctx, "weights", kq, o.checkOnes, o.checkOffset)
+	}
+
+	if o.weights != nil {
+		*o.weights = kq
+	}
+
+	if quantized(value.DType()) {
+		return permute(ml.Name(ctx, "kqv_out"), mulmatQuantized(kqvCtx, value, kq), 0, 2, 1, 3)
+	}
+
+	seqLenQ, heads, kvHeads := kq.Dim(1), kq.Dim(2), value.Dim(2)
+	grouped := groupHeads(seqLenQ, heads, kvHeads)
+	if grouped {
+		// as for the logits, multiply the weights of each group of heads
+		// with their value head at once
+		kq = kq.Reshape(kqvCtx, kq.Dim(0), seqLenQ*heads/kvHeads, kvHeads)
+	}
+
+	var kqv ml.Tensor
+	if o.FullPrec {
+		kqv = value.MulmatFullPrec(kqvCtx, kq)
+	} else {
+		kqv = value.Mulmat(kqvCtx, kq)
+	}
+
+	if grouped {
+		kqv = kqv.Reshape(kqvCtx, kqv.Dim(0), seqLenQ, heads)
+	}
+
+	return permute(ml.Name(ctx, "kqv_out"), kqv, 0, 2, 1, 3)
+}
+
+// groupHeads reports whether the unfused implementation multiplies the query
+// heads that share a key and value head with it in a single matrix product,
+// rather than broadcasting it as a separate product for each head, which reads
+// the keys and values of the head again for each query head. This requires
+// the queries of each group to be adjacent, which they are with a single key
+// and value head, as in multi-query attention, or a single query, as when
+// decoding a token.
+func groupHeads(seqLenQ, heads, kvHeads int) bool {
+	return kvHeads < heads && (kvHeads == 1 || seqLenQ == 1)
+}
+
+// softmax normalizes the attention logits kq, in F32 if they are in F16
+// unless WithHalfPrecSoftmax is set. The weights have the dtype of kq.
+func (o *attentionOptions) softmax(ctx ml.Context, kq ml.Tensor) ml.Tensor {
+	// Softmax subtracts the maximum logit of each query, so large logits
+	// don't overflow
+	if o.halfPrecSoftmax || kq.DType() != ml.DTypeF16 {
+		return kq.Softmax(ctx)
+	}
+
+	kq = kq.Copy(ctx, ctx.Zeros(ml.DTypeF32, kq.Shape()...)).Softmax(ctx)
+	return kq.Copy(ctx, ctx.Zeros(ml.DTypeF16, kq.Shape()...))
+}
+
+// permute is t.Permute(ctx, order...).Contiguous(ctx), except that a
+// contiguous t is reshaped instead of copied if no element moves, as when
+// only dimensions of size 1 change places. This is the case for the outputs
+// of attention while decoding a single token. Otherwise, the permuted view is
+// only copied if its strides aren't already those of a contiguous tensor, as
+// for a view that transposed t.
+func permute(ctx ml.Context, t ml.Tensor, order ...int) ml.Tensor {
+	if c, ok := t.(ml.IsContiguous); ok && c.IsContiguous() {
+		shape := make([]int, len(order))
+		moved, last := false, -1
+		for i, d := range order {
+			shape[d] = t.Dim(i)
+			if t.Dim(i) > 1 {
+				// elements keep their order if the dimensions with more
+				// than one element do
+				moved = moved || d < last
+				last = d
+			}
+		}
+
+		if !moved {
+			for len(shape) > 1 && shape[len(shape)-1] == 1 {
+				shape = shape[:len(shape)-1]
+			}
+
+			return t.Reshape(ctx, shape...)
+		}
+	}
+
+	return contiguous(ctx, t.Permute(ctx, order...))
+}
+
+// contiguous is t.Contiguous(ctx) but returns t if it is already contiguous
+func contiguous(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	if c, ok := t.(ml.IsContiguous); ok && c.IsContiguous() {
+		return t
+	}
+
+	return t.Contiguous(ctx)
+}
+
+// AttentionWithALiBi is like Attention with WithALiBi but uses the given
+// per-head slopes instead of the standard geometric sequence. There must be
+// one positive slope for each query head.
+//
+// The position bias of each head is slopes[h] times the negated distance
+// between the query and key positions, where queries are assumed to
+// correspond to the last seq_len_q keys unless opts include
+// WithALiBiPositions. An optional mask, such as a causal
+// mask, is combined with the bias and so should only contain 0 and -Inf.
+func AttentionWithALiBi(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, slopes []float64, opts ...AttentionOption) ml.Tensor {
+	if len(slopes) != query.Dim(2) {
+		panic(&ShapeMismatchError{Op: "attention", Dim: "heads", Other: "query", Want: query.Dim(2), Operand: "slopes", Got: len(slopes)})
+	}
+
+	s := make([]float32, len(slopes))
+	for i, slope := range slopes {
+		if slope <= 0 {
+			panic(fmt.Errorf("ALiBi slope for head %v must be positive, got %v", i, slope))
+		}
+
+		s[i] = float32(slope)
+	}
+
+	return Attention(ctx, query, key, value, mask, scale, append([]AttentionOption{func(o *attentionOptions) {
+		o.slopes = s
+	}}, opts...)...)
+}
+
+// AttentionPerHeadScale is like Attention but multiplies the attention logits
+// by the tensor scale instead of a scalar, such as learned per-head
+// temperatures. scale must broadcast to the shape of the logits, [seq_len_k,
+// seq_len_q, heads], and is typically [1, 1, heads] to give each head its own
+// scale. Any softcap is applied to the scaled logits.
+//
+// Fused backend implementations only support scalar scales, so this always
+// uses the unfused implementation. AttentionPerHeadScale panics with a
+// *ShapeMismatchError if scale doesn't broadcast to the logits.
+func AttentionPerHeadScale(ctx ml.Context, query, key, value, mask, scale ml.Tensor, opts ...AttentionOption) ml.Tensor {
+	logits := [4]int{key.Dim(1), query.Dim(1), query.Dim(2), 1}
+	for d, want := range logits {
+		if n := scale.Dim(d); n != 1 && n != want {
+			panic(&ShapeMismatchError{Op: "attention", Dim: maskDims[d], Other: "logits", Want: want, Operand: "scale", Got: n})
+		}
+	}
+
+	return Attention(ctx, query, key, value, mask, 1, append([]AttentionOption{func(o *attentionOptions) {
+		o.scales = scale
+	}}, opts...)...)
+}
+
+// AttentionWithWeights is like Attention but also returns the post-softmax
+// attention weights with shape [seq_len_k, seq_len_q, heads], matching the
+// layout of output_attentions in Hugging Face transformers. The weights
+// include the effects of opts such as WithSoftcap and WithALiBi.
+//
+// This is intended for debugging and inspecting models. It always uses the
+// unfused implementation, which is slower and uses more memory than the fused
+// attention provided by some backends.
+func AttentionWithWeights(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, opts ...AttentionOption) (ml.Tensor, ml.Tensor) {
+	var weights ml.Tensor
+	kqv := Attention(ctx, query, key, value, mask, scale, append([]AttentionOption{func(o *attentionOptions) {
+		o.weights = &weights
+	}}, opts...)...)
+
+	return kqv, weights
+}
+
+// AttentionWithDropout is like Attention but, if training is true, zeroes
+// each attention weight with probability dropoutProb after the softmax and
+// scales the remaining weights by 1/(1-dropoutProb), as in inverted dropout.
+// The weights to drop are chosen on the device if the context implements
+// ml.Dropout, and on the host otherwise, using the seed set by
+// WithDropoutSeed if any. If training is false, this behaves identically to
+// Attention.
+//
+// Dropout always uses the unfused implementation. AttentionWithDropout panics
+// if dropoutProb is not in [0, 1).
+func AttentionWithDropout(ctx ml.Context, query, key, value, mask ml.Tensor, scale, dropoutProb float64, training bool, opts ...AttentionOption) ml.Tensor {
+	if dropoutProb < 0 || dropoutProb >= 1 {
+		panic(fmt.Errorf("invalid attention dropout probability %v", dropoutProb))
+	}
+
+	if !training {
+		return Attention(ctx, query, key, value, mask, scale, opts...)
+	}
+
+	return Attention(ctx, query, key, value, mask, scale, append([]AttentionOption{func(o *attentionOptions) {
+		o.dropout = dropoutProb
+	}}, opts...)...)
+}
+
+// dropoutMask returns the mask that keeps attention weights of shape
+// [seqLenK, seqLenQ, heads] with probability 1-p, as described by ml.Dropout
+func dropoutMask(ctx ml.Context, seqLenK, seqLenQ, heads int, p float64, seed *uint64) (ml.Tensor, error) {
+	s := rand.Uint64()
+	if seed != nil {
+		s = *seed
+	}
+
+	if d, ok := ctx.(ml.Dropout); ok {
+		return d.DropoutMask(s, p, seqLenK, seqLenQ, heads), nil
+	}
+
+	threshold := uint32(min(p*(1<<32), math.MaxUint32))
+	keep := make([]float32, seqLenK*seqLenQ*heads)
+	for i := range keep {
+		if uint32(splitMix64(s+uint64(i+1)*0x9e3779b97f4a7c15)>>32) >= threshold {
+			keep[i] = float32(1 / (1 - p))
+		}
+	}
+
+	return ctx.FromFloatSlice(keep, seqLenK, seqLenQ, heads)
+}
+
+// splitMix64 is the finalizer of the SplitMix64 generator, which maps
+// consecutive inputs to uncorrelated outputs
+func splitMix64(z uint64) uint64 {
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+// ChunkedAttention is like Attention but processes chunkSize queries at a
+// time, so that the attention scores use memory proportional to chunkSize
+// rather than seq_len_q. The output is the same as that of Attention. This is
+// equivalent to Attention with WithBlockSize and has no effect when attention
+// is computed by a fused backend implementation, which already avoids
+// materializing all of the scores.
+//
+// ChunkedAttention panics if chunkSize is not positive.
+func ChunkedAttention(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, chunkSize int, opts ...AttentionOption) ml.Tensor {
+	if chunkSize <= 0 {
+		panic(fmt.Errorf("invalid attention chunk size %v", chunkSize))
+	}
+
+	return Attention(ctx, query, key, value, mask, scale, append([]AttentionOption{WithBlockSize(chunkSize)}, opts...)...)
+}
+
+// MultiQueryAttention is like AttentionErr but requires a single key and
+// value head that is shared by all of the query heads, as in multi-query
+// attention (MQA). For other numbers of kv_heads, it returns a
+// *ShapeMismatchError.
+//
+// When attention is not computed by a fused backend implementation, the
+// shared head is multiplied with the queries of all heads in a single matrix
+// product rather than by broadcasting it over each head as for grouped-query
+// attention. This is correct on any backend that implements Mulmat and is
+// typically faster than broadcasting, which backends may implement as a
+// separate product for each head. Attention uses the same strategy whenever
+// kv_heads is 1, and for the heads that share each key and value head when
+// there is a single query.
+func MultiQueryAttention(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, opts ...AttentionOption) (ml.Tensor, error) {
+	if key.Dim(2) != 1 {
+		return nil, &ShapeMismatchError{Op: "multi-query attention", Dim: "kv_heads", Other: "expected", Want: 1, Operand: "key", Got: key.Dim(2)}
+	}
+
+	return AttentionErr(ctx, query, key, value, mask, scale, opts...)
+}
+
+// RepeatKV repeats each head of t, which has shape [n, m, kv_heads], nRep
+// times to produce a tensor of shape [n, m, kv_heads*nRep]. Head h of the
+// result is head h/nRep of t, matching the grouping of query heads used by
+// Attention. This is only needed by operations that can't broadcast key and
+// value heads, as Attention does. The repeated heads are copied, so this uses
+// nRep times the memory of t. If nRep is 1, t is returned unchanged.
+func RepeatKV(ctx ml.Context, t ml.Tensor, nRep int) ml.Tensor {
+	if nRep < 1 {
+		panic(fmt.Errorf("invalid number of repetitions %v", nRep))
+	} else if nRep == 1 {
+		return t
+	}
+
+	// broadcast each head over a new dimension of size nRep, which is then
+	// merged with the heads
+	n, m, kvHeads := t.Dim(0), t.Dim(1), t.Dim(2)
+	t = contiguous(ctx, t).Reshape(ctx, n*m, 1, kvHeads)
+	t = ctx.Zeros(t.DType(), n*m, nRep, kvHeads).Add(ctx, t)
+
+	return t.Reshape(ctx, n, m, nRep*kvHeads)
+}
+
+// CrossAttention implements attention from the queries of a decoder to the
+// memory of an encoder, as in encoder-decoder models such as T5 and Whisper
+// or the cross attention layers of Llama 3.2 Vision. Unlike self-attention,
+// seq_len_q and the encoder length are independent and no causal mask is
+// applied.
+//
+// Parameters:
+//   - query: Query tensor with shape [d_k, seq_len_q, heads]
+//   - encoderKey: Encoder key tensor with shape [d_k, enc_len, kv_heads]
+//   - encoderValue: Encoder value tensor with shape [enc_len, d_v, kv_heads]
+//   - mask: Optional mask added to the attention score. This is typically nil
+//     or a padding mask of shape [enc_len, 1, 1] that excludes encoder padding
+//     for all queries and heads but may be any mask that broadcasts to
+//     [enc_len, seq_len_q, heads]
+//
+// CrossAttention panics if encoderKey and encoderValue have a different
+// number of heads or are otherwise inconsistent, which usually means that
+// they have been swapped.
+func CrossAttention(ctx ml.Context, query, encoderKey, encoderValue, mask ml.Tensor, scale float64, opts ...AttentionOption) ml.Tensor {
+	if encoderKey.Dim(2) != encoderValue.Dim(2) {
+		panic(&ShapeMismatchError{Op: "cross attention", Dim: "kv_heads", Other: "encoderKey", Want: encoderKey.Dim(2), Operand: "encoderValue", Got: encoderValue.Dim(2)})
+	}
+
+	// fused implementations require a mask for each query so expand padding masks
+	if mask != nil && mask.Dim(1) == 1 && query.Dim(1) != 1 {
+		mask = ctx.Zeros(mask.DType(), mask.Dim(0), query.Dim(1)).Add(ctx, mask)
+	}
+
+	return Attention(ctx, query, encoderKey, encoderValue, mask, scale, opts...)
+}
+
+// BatchedAttention computes Attention for several sequences that are packed
+// into one batch for throughput, where tokens only attend to tokens of their
+// own sequence. The sequences are concatenated along seq_len in the order of
+// seqLens, which holds the length of each one, in query with shape [d_k,
+// seq_len, heads], key with shape [d_k, seq_len, kv_heads] and value with
+// shape [seq_len, d_v, kv_heads]. Attention within a sequence isn't causal;
+// for causal attention, pass the combination of BlockDiagonalMask and
+// CausalMask to Attention.
+//
+// BatchedAttention panics if seqLens doesn't sum to the seq_len of query or
+// key.
+//
+// Returns:
+//
+//	Attention output with shape [d_v, heads, seq_len]
+func BatchedAttention(ctx ml.Context, query, key, value ml.Tensor, scale float64, seqLens []int, opts ...AttentionOption) ml.Tensor {
+	var seqLen int
+	for _, n := range seqLens {
+		seqLen += n
+	}
+
+	if query.Dim(1) != seqLen {
+		panic(&ShapeMismatchError{Op: "batched attention", Dim: "seq_len", Other: "seqLens", Want: seqLen, Operand: "query", Got: query.Dim(1)})
+	}
+
+	if key.Dim(1) != seqLen {
+		panic(&ShapeMismatchError{Op: "batched attention", Dim: "seq_len", Other: "seqLens", Want: seqLen, Operand: "key", Got: key.Dim(1)})
+	}
+
+	mask, err := BlockDiagonalMask(ctx, seqLens)
+	if err != nil {
+		panic(err)
+	}
+
+	return Attention(ctx, query, key, value, mask, scale, opts...)
+}
+
+// SlidingWindowAttention implements local attention where each query only
+// attends to the window keys before it in addition to its own position,
+// matching the behavior of kvcache.NewSWACache. Queries are assumed to
+// correspond to the last seq_len_q keys.
+//
+// The window is applied on top of mask rather than replacing it: keys outside
+// of the window are excluded and the remaining keys are subject to mask as in
+// Attention. To get causal sliding window attention, pass a causal mask. A
+// window <= 0 disables windowing, which is equivalent to calling Attention.
+//
+// The first sinkTokens keys are attention sinks, as in StreamingLLM, which
+// are attended to by every query however far the window has moved past them.
+// They are still subject to mask. This expects key and value to start with
+// the sink tokens, such as the first tokens of the sequence, followed by at
+// least the keys of the window of the first query. A cache that evicts old
+// keys must therefore keep the sink tokens in place.
+func SlidingWindowAttention(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, window, sinkTokens int, opts ...AttentionOption) ml.Tensor {
+	if window > 0 && window+sinkTokens < key.Dim(1) {
+		windowed, err := windowMask(ctx, query.Dim(1), key.Dim(1), window, max(sinkTokens, 0))
+		if err != nil {
+			panic(err)
+		}
 
-		kq = kq.Scale(ctx, scale)
 		if mask != nil {
-			kq = kq.Add(ctx, mask)
+			mask = mask.Add(ctx, windowed)
+		} else {
+			mask = windowed
+		}
+	}
+
+	return Attention(ctx, query, key, value, mask, scale, opts...)
+}
+
+// AttentionWithPositions computes causal attention, optionally with a sliding
+// window, where the mask is built from the positions of the keys and queries
+// rather than their indices, as PositionMask does. This is needed for caches
+// with gaps, such as those that evict or compact keys, where the key at an
+// index is not at that position and the queries are not the last keys.
+//
+// keyPositions must have seq_len_k elements and queryPositions seq_len_q. mask,
+// if not nil, is combined with the positional mask, such as to keep the
+// sequences of a batch apart.
+//
+// AttentionWithPositions panics if the number of positions doesn't match the
+// shapes of the tensors.
+func AttentionWithPositions(ctx ml.Context, query, key, value, mask ml.Tensor, scale float64, keyPositions, queryPositions []int32, window int, opts ...AttentionOption) ml.Tensor {
+	if len(keyPositions) != key.Dim(1) {
+		panic(&ShapeMismatchError{Op: "attention", Dim: "seq_len_k", Other: "key", Want: key.Dim(1), Operand: "keyPositions", Got: len(keyPositions)})
+	}
+
+	if len(queryPositions) != query.Dim(1) {
+		panic(&ShapeMismatchError{Op: "attention", Dim: "seq_len_q", Other: "query", Want: query.Dim(1), Operand: "queryPositions", Got: len(queryPositions)})
+	}
+
+	positional, err := PositionMask(ctx, keyPositions, queryPositions, window)
+	if err != nil {
+		panic(err)
+	}
+
+	mask, err = CombineMasks(ctx, mask, positional)
+	if err != nil {
+		panic(err)
+	}
+
+	return Attention(ctx, query, key, value, mask, scale, append([]AttentionOption{WithALiBiPositions(keyPositions, queryPositions)}, opts...)...)
+}
+
+// slidingWindowPatterns are the default attention.sliding_window_pattern of
+// architectures whose layers alternate between sliding window and global
+// attention, as their GGUF files don't always record it
+var slidingWindowPatterns = map[string]uint32{"gemma2": 2, "cohere2": 4}
+
+// SlidingWindowLayer reports whether layer of a model with the configuration
+// c uses sliding window attention with a window of attention.sliding_window
+// tokens. With attention.sliding_window_pattern n, the last of every n layers
+// uses global attention instead, as in Gemma 2 (n = 2) and Command R7B
+// (n = 4). Otherwise every layer uses the window if there is one.
+func SlidingWindowLayer(c ml.Config, layer int) bool {
+	if c.Uint("attention.sliding_window") == 0 {
+		return false
+	}
+
+	pattern := int(c.Uint("attention.sliding_window_pattern", slidingWindowPatterns[c.Architecture()]))
+	return pattern <= 1 || layer%pattern < pattern-1
+}
+
+// valueBlockSize is the number of keys whose quantized values the unfused
+// implementation dequantizes at a time, unless there would be more than
+// maxValueBlocks blocks
+var valueBlockSize = 4096
+
+// maxValueBlocks bounds the number of blocks of values, as each one adds
+// operations to the graph
+const maxValueBlocks = 8
+
+// mulmatQuantized multiplies the attention weights kq with shape [seq_len_k,
+// seq_len_q, heads] by the quantized value with shape [seq_len_k, d_v,
+// kv_heads]. value is a transposed view of values stored as rows of d_v
+// elements, as in a cache, so it can only be multiplied once it's
+// dequantized. This is done for a block of keys at a time so that the values
+// aren't copied in full, and the products of the blocks are summed.
+func mulmatQuantized(ctx ml.Context, value, kq ml.Tensor) ml.Tensor {
+	rows := value.Permute(ctx, 1, 0, 2, 3)
+	seqLenK, kvHeads := rows.Dim(1), rows.Dim(2)
+
+	blockSize := max(valueBlockSize, (seqLenK+maxValueBlocks-1)/maxValueBlocks)
+
+	var kqv ml.Tensor
+	for i := 0; i < seqLenK; i += blockSize {
+		n := min(blockSize, seqLenK-i)
+
+		ids := make([]int32, n*kvHeads)
+		for j := range ids {
+			ids[j] = int32(j % n)
+		}
+
+		t, err := ctx.FromIntSlice(ids, n, kvHeads)
+		if err != nil {
+			panic(err)
 		}
-		kq = kq.Softmax(ctx)
 
-		kqv := value.Mulmat(ctx, kq)
-		return kqv.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+		v := rows.View(ctx, rows.Stride(1)*i,
+			rows.Dim(0), rows.Stride(1),
+			n, rows.Stride(2),
+			kvHeads,
+		).Rows(ctx, t).Permute(ctx, 1, 0, 2, 3).Contiguous(ctx)
+
+		w := kq.View(ctx, kq.Stride(0)*i,
+			n, kq.Stride(1),
+			kq.Dim(1), kq.Stride(2),
+			kq.Dim(2),
+		)
+
+		if kqv == nil {
+			kqv = v.Mulmat(ctx, w)
+		} else {
+			kqv = kqv.Add(ctx, v.Mulmat(ctx, w))
+		}
 	}
+
+	return kqv
 }
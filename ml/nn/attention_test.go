@@ -0,0 +1,2547 @@
+package nn
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/x448/float16"
+
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/nn/nntest"
+)
+
+func TestAttentionSoftcap(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// seq_len_k = 3, seq_len_q = 2
+	mask := ctx.fromFloats([]float32{0, 0, float32(math.Inf(-1)), 0, 0, 0}, 3, 2)
+
+	for _, softcap := range []float64{0, 5, 50} {
+		unfused := Attention(ctx, query, key, value, mask, 0.7, WithSoftcap(softcap))
+		fused := Attention(ctx, &testSDPATensor{query}, key, value, mask, 0.7, WithSoftcap(softcap))
+
+		want := referenceAttention(query, key, value, mask, 0.7, ml.AttentionOptions{Softcap: softcap})
+		assertFloats(t, want, unfused.Floats(), 1e-5)
+		assertFloats(t, want, fused.Floats(), 1e-5)
+	}
+
+	capped := Attention(ctx, query, key, value, mask, 0.7, WithSoftcap(1)).Floats()
+	uncapped := Attention(ctx, query, key, value, mask, 0.7).Floats()
+	if diff(capped, uncapped) < 1e-3 {
+		t.Errorf("softcap of 1 did not change the output")
+	}
+}
+
+func TestDefaultAttentionScale(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 4, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2, 0, 1, -3, 2, 1, 1, -1, 0.5}, 4, 2, 2)
+	// d_k = 4, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5, 1, -1, 2, 0, 1, 3}, 4, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1, so the scale isn't 1/√d_v
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+
+	if scale := DefaultAttentionScale(query); scale != 0.5 {
+		t.Fatalf("DefaultAttentionScale: have %v; want 0.5", scale)
+	}
+
+	want := referenceAttention(query, key, value, nil, 0.5, ml.AttentionOptions{})
+	assertFloats(t, want, Attention(ctx, query, key, value, nil, 0).Floats(), 1e-6)
+	assertFloats(t, want, Attention(ctx, &testSDPATensor{query}, key, value, nil, 0).Floats(), 1e-6)
+
+	// an explicit scale overrides the default
+	if diff(want, Attention(ctx, query, key, value, nil, 0.7).Floats()) < 1e-3 {
+		t.Errorf("explicit scale did not change the output")
+	}
+}
+
+func TestAttentionTemperature(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// seq_len_k = 3, seq_len_q = 2
+	mask := ctx.fromFloats([]float32{0, 0, float32(math.Inf(-1)), 0, 0, 0}, 3, 2)
+
+	for _, temp := range []float64{0, 1, 0.5, 4} {
+		unfused := Attention(ctx, query, key, value, mask, 0.7, WithTemperature(temp))
+		fused := Attention(ctx, &testSDPATensor{query}, key, value, mask, 0.7, WithTemperature(temp))
+
+		scale := 0.7
+		if temp != 0 {
+			scale /= temp
+		}
+
+		want := referenceAttention(query, key, value, mask, scale, ml.AttentionOptions{})
+		assertFloats(t, want, unfused.Floats(), 1e-5)
+		assertFloats(t, want, fused.Floats(), 1e-5)
+	}
+
+	// the temperature is applied after the softcap. The expected weights are
+	// derived from the capped weights as softmax(log(p) / temp) = softmax(s / temp)
+	_, weights := AttentionWithWeights(ctx, query, key, value, mask, 0.7, WithSoftcap(1), WithTemperature(0.5))
+	want := referenceWeights(query, key, nil, 0.7, ml.AttentionOptions{Softcap: 1})
+	for h := range 2 {
+		for i := range 2 {
+			row := want[i*3+h*6 : i*3+h*6+3]
+			if i == 0 {
+				row[2] = 0
+			}
+
+			scores := make([]float64, 3)
+			for j := range scores {
+				scores[j] = math.Log(float64(row[j])) / 0.5
+			}
+
+			for j, p := range softmax(scores) {
+				row[j] = float32(p)
+			}
+		}
+	}
+	assertFloats(t, want, weights.Floats(), 1e-5)
+
+	fused := Attention(ctx, &testSDPATensor{query}, key, value, mask, 0.7, WithTemperature(0.5), WithSoftcap(1))
+	unfused := Attention(ctx, query, key, value, mask, 0.7, WithTemperature(0.5), WithSoftcap(1))
+	assertFloats(t, unfused.Floats(), fused.Floats(), 0)
+}
+
+func TestAttentionSigmoid(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 1
+	query := ctx.fromFloats([]float32{1, 0, 0, 2}, 2, 2, 1)
+	// d_k = 2, seq_len_k = 2, kv_heads = 1
+	key := ctx.fromFloats([]float32{2, 0, 0, 1}, 2, 2, 1)
+	// seq_len_k = 2, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 3, 2, -1}, 2, 2, 1)
+	// the second query can't attend to the second key
+	mask := ctx.fromFloats([]float32{0, 0, 0, float32(math.Inf(-1))}, 2, 2)
+
+	// the scaled logits minus the bias are [0, -1] for the first query and
+	// [-1, 0] for the second, so the weights are [σ(0), σ(-1)] and [σ(-1), 0]
+	s0, s1 := float32(0.5), float32(1/(1+math.E))
+	want := []float32{
+		s0*1 + s1*3, s0*2 + s1*-1,
+		s1 * 1, s1 * 2,
+	}
+
+	for _, query := range []ml.Tensor{query, &testSDPATensor{query}} {
+		out := Attention(ctx, query, key, value, mask, 0.5, WithSigmoid(-1))
+		if shape := out.Shape(); shape[0] != 2 || shape[1] != 1 || shape[2] != 2 {
+			t.Fatalf("unexpected shape %v", shape)
+		}
+
+		assertFloats(t, want, out.Floats(), 1e-6)
+	}
+
+	_, weights := AttentionWithWeights(ctx, query, key, value, mask, 0.5, WithSigmoid(-1))
+	assertFloats(t, []float32{s0, s1, s1, 0}, weights.Floats(), 1e-6)
+}
+
+func TestAttentionDropout(t *testing.T) {
+	ctx := &testContext{}
+
+	const dk, seqLenQ, seqLenK, heads, dv = 2, 4, 4, 2, 2
+
+	vals := func(n int) []float32 {
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(float64(i)))
+		}
+		return s
+	}
+
+	query := ctx.fromFloats(vals(dk*seqLenQ*heads), dk, seqLenQ, heads)
+	key := ctx.fromFloats(vals(dk*seqLenK*heads), dk, seqLenK, heads)
+	value := ctx.fromFloats(vals(seqLenK*dv*heads), seqLenK, dv, heads)
+
+	want, weights := AttentionWithWeights(ctx, query, key, value, nil, 0.7)
+
+	// dropout has no effect during inference
+	assertFloats(t, want.Floats(), AttentionWithDropout(ctx, &testSDPATensor{query}, key, value, nil, 0.7, 0.5, false).Floats(), 1e-6)
+
+	var dropped ml.Tensor
+	out := AttentionWithDropout(ctx, &testSDPATensor{query}, key, value, nil, 0.7, 0.5, true, WithDropoutSeed(1, 0, 0), func(o *attentionOptions) {
+		o.weights = &dropped
+	})
+
+	// each weight is either dropped or scaled by 1/(1-p)
+	var zeros int
+	w, d := weights.Floats(), dropped.Floats()
+	for i := range w {
+		if d[i] == 0 {
+			zeros++
+		} else if math.Abs(float64(d[i]-2*w[i])) > 1e-6 {
+			t.Errorf("weight %v is %v, want 0 or %v", i, d[i], 2*w[i])
+		}
+	}
+
+	if zeros == 0 || zeros == len(w) {
+		t.Errorf("expected some but not all weights to be dropped, got %v of %v", zeros, len(w))
+	}
+
+	// the output is the product of the dropped weights and the values
+	v := value.Floats()
+	expected := make([]float32, dv*heads*seqLenQ)
+	for q := range seqLenQ {
+		for h := range heads {
+			for j := range dv {
+				for k := range seqLenK {
+					expected[(q*heads+h)*dv+j] += d[(h*seqLenQ+q)*seqLenK+k] * v[(h*dv+j)*seqLenK+k]
+				}
+			}
+		}
+	}
+
+	assertFloats(t, expected, out.Floats(), 1e-5)
+
+	// the same seed drops the same weights, including in blocks of queries
+	for _, opts := range [][]AttentionOption{nil, {WithBlockSize(1)}} {
+		got := AttentionWithDropout(ctx, query, key, value, nil, 0.7, 0.5, true, append(opts, WithDropoutSeed(1, 0, 0))...)
+		assertFloats(t, out.Floats(), got.Floats(), 1e-6)
+	}
+
+	// while other layers and steps drop other weights
+	for _, seed := range []AttentionOption{WithDropoutSeed(1, 1, 0), WithDropoutSeed(1, 0, 1)} {
+		var other ml.Tensor
+		AttentionWithDropout(ctx, query, key, value, nil, 0.7, 0.5, true, seed, func(o *attentionOptions) {
+			o.weights = &other
+		})
+
+		if slices.Equal(d, other.Floats()) {
+			t.Error("expected different layers and steps to drop different weights")
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a dropout probability of 1")
+		}
+	}()
+
+	AttentionWithDropout(ctx, query, key, value, nil, 0.7, 1, true)
+}
+
+func TestAttentionPerHeadScale(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// seq_len_k = 3, seq_len_q = 2
+	mask := ctx.fromFloats([]float32{0, 0, float32(math.Inf(-1)), 0, 0, 0}, 3, 2)
+
+	// the output has shape [d_v, heads, seq_len_q], so select the outputs
+	// of the head or query that each scale applies to
+	pick := func(want []float32, fn func(h, i int) bool, scale float64, opts ml.AttentionOptions) {
+		ref := referenceAttention(query, key, value, mask, scale, opts)
+		for i := range 2 {
+			for h := range 2 {
+				if fn(h, i) {
+					copy(want[h*2+i*4:h*2+i*4+2], ref[h*2+i*4:h*2+i*4+2])
+				}
+			}
+		}
+	}
+
+	cases := []struct {
+		name  string
+		scale *testTensor
+		opts  []AttentionOption
+
+		// applies reports whether scale n applies to head h of query i
+		applies func(n, h, i int) bool
+	}{
+		{"heads", ctx.fromFloats([]float32{0.7, 0.3}, 1, 1, 2), nil, func(n, h, i int) bool { return h == n }},
+		{"queries", ctx.fromFloats([]float32{0.7, 0.3}, 1, 2, 1), []AttentionOption{WithBlockSize(1)}, func(n, h, i int) bool { return i == n }},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			want := make([]float32, 8)
+			for n, scale := range tt.scale.data {
+				pick(want, func(h, i int) bool { return tt.applies(n, h, i) }, float64(scale), ml.AttentionOptions{})
+			}
+
+			for _, query := range []ml.Tensor{query, &testSDPATensor{query}} {
+				got := AttentionPerHeadScale(ctx, query, key, value, mask, tt.scale, tt.opts...)
+				assertFloats(t, want, got.Floats(), 1e-5)
+			}
+		})
+	}
+
+	// the softcap applies to the scaled logits
+	want := make([]float32, 8)
+	pick(want, func(h, i int) bool { return h == 0 }, 0.7, ml.AttentionOptions{Softcap: 1})
+	pick(want, func(h, i int) bool { return h == 1 }, 0.3, ml.AttentionOptions{Softcap: 1})
+	got := AttentionPerHeadScale(ctx, query, key, value, mask, cases[0].scale, WithSoftcap(1))
+	assertFloats(t, want, got.Floats(), 1e-5)
+
+	defer func() {
+		var sme *ShapeMismatchError
+		if err, ok := recover().(error); !ok || !errors.As(err, &sme) || sme.Dim != "heads" || sme.Got != 3 {
+			t.Errorf("expected heads mismatch, got %v", err)
+		}
+	}()
+
+	AttentionPerHeadScale(ctx, query, key, value, mask, ctx.fromFloats([]float32{1, 2, 3}, 1, 1, 3))
+}
+
+func TestAttentionBias(t *testing.T) {
+	ctx := &testContext{}
+	inf := float32(math.Inf(-1))
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// seq_len_k = 3, seq_len_q = 2
+	mask := ctx.fromFloats([]float32{0, 0, inf, 0, 0, 0}, 3, 2)
+	// seq_len_k = 3, seq_len_q = 2, heads = 2
+	bias := ctx.fromFloats([]float32{0.5, -1, 2, 0, 1.5, -0.5, -2, 1, 0, 3, 0.25, -1}, 3, 2, 2)
+
+	// the bias is the same as a mask for each head that it was added to
+	combined := ctx.fromFloats(make([]float32, 12), 3, 2, 2)
+	combined.each(func(j, i, h, _ int) {
+		combined.data[combined.index(j, i, h, 0)] = mask.at(j, i) + bias.at(j, i, h)
+	})
+
+	for _, tt := range []struct {
+		name string
+		opts ml.AttentionOptions
+		with []AttentionOption
+	}{
+		{"bias", ml.AttentionOptions{}, nil},
+		{"softcap", ml.AttentionOptions{Softcap: 1}, []AttentionOption{WithSoftcap(1)}},
+		{"blocks", ml.AttentionOptions{}, []AttentionOption{WithBlockSize(1)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			want := referenceAttention(query, key, value, combined, 0.5, tt.opts)
+			for _, query := range []ml.Tensor{query, &testSDPATensor{query}} {
+				got := Attention(ctx, query, key, value, mask, 0.5, append(tt.with, WithBias(bias))...)
+				assertFloats(t, want, got.Floats(), 1e-5)
+			}
+		})
+	}
+
+	// a bias shared by all heads broadcasts like the mask
+	shared := ctx.fromFloats(bias.data[:6], 3, 2)
+	want := referenceAttention(query, key, value, ctx.fromFloats([]float32{0.5, -1, inf, 0, 1.5, -0.5}, 3, 2), 0.5, ml.AttentionOptions{})
+	assertFloats(t, want, Attention(ctx, query, key, value, mask, 0.5, WithBias(shared)).Floats(), 1e-5)
+
+	_, err := AttentionErr(ctx, query, key, value, mask, 0.5, WithBias(ctx.fromFloats(make([]float32, 4), 2, 2)))
+	var sme *ShapeMismatchError
+	if !errors.As(err, &sme) || sme.Dim != "seq_len_k" || sme.Operand != "bias" || sme.Got != 2 || sme.Want != 3 {
+		t.Errorf("expected seq_len_k mismatch, got %v", err)
+	}
+}
+
+func TestAttentionScoreModifier(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// seq_len_k = 3, seq_len_q = 2
+	mask := ctx.fromFloats([]float32{0, 0, float32(math.Inf(-1)), 0, 0, 0}, 3, 2)
+	// seq_len_k = 3, seq_len_q = 1, heads = 2
+	bias := ctx.fromFloats([]float32{0.5, -1, 2, -2, 1, 0}, 3, 1, 2)
+
+	// a modifier that adds a bias is the same as adding the bias
+	var calls int
+	add := func(ctx ml.Context, scores ml.Tensor) ml.Tensor {
+		calls++
+		return scores.Add(ctx, bias)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		with  []AttentionOption
+		calls int
+	}{
+		{"modifier", nil, 1},
+		{"blocks", []AttentionOption{WithBlockSize(1)}, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			want := Attention(ctx, query, key, value, mask, 0.5, WithBias(bias)).Floats()
+			for _, query := range []ml.Tensor{query, &testSDPATensor{query}} {
+				calls, ctx.fused = 0, 0
+				got := Attention(ctx, query, key, value, mask, 0.5, append(tt.with, WithScoreModifier(add))...)
+				assertFloats(t, want, got.Floats(), 1e-6)
+
+				if calls != tt.calls || ctx.fused != 0 {
+					t.Errorf("modifier called %v times and fused %v times, want %v and 0", calls, ctx.fused, tt.calls)
+				}
+			}
+		})
+	}
+
+	// a nil modifier has no effect
+	ctx.fused = 0
+	want := referenceAttention(query, key, value, mask, 0.5, ml.AttentionOptions{})
+	assertFloats(t, want, Attention(ctx, &testSDPATensor{query}, key, value, mask, 0.5, WithScoreModifier(nil)).Floats(), 1e-5)
+	if ctx.fused != 1 {
+		t.Errorf("fused %v times with a nil modifier, want 1", ctx.fused)
+	}
+}
+
+func TestAttentionLargeLogits(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 1
+	query := ctx.fromFloats([]float32{1e4, 0, -1e4, 1e4}, 2, 2, 1)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{1e4, 0, -1e4, 0, 0, 1e4}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	mask := ctx.fromFloats([]float32{0, 0, 0, 0, 0, float32(math.Inf(-1))}, 3, 2)
+
+	// the logits are ±1e8, so each query only attends to the key with the
+	// largest logit that isn't masked: the first key for the first query and
+	// the second key for the second query
+	want := []float32{1, -1, 2, 0}
+
+	for _, opts := range [][]AttentionOption{nil, {WithBlockSize(1)}, {WithTemperature(2), WithSoftcap(1e9)}} {
+		got := Attention(ctx, query, key, value, mask, 1, opts...).Floats()
+		for i, v := range got {
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				t.Fatalf("output %v is %v", i, v)
+			}
+		}
+
+		assertFloats(t, want, got, 1e-6)
+	}
+}
+
+func TestAttentionHalfPrecSoftmax(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+
+	// a context of 4096 keys with small logits, whose weights are too
+	// small to add to their sum in F16 once it is large enough
+	const seqLenK = 4096
+	keys := make([]float32, 2*seqLenK)
+	values := make([]float32, seqLenK*2)
+	for i := range seqLenK {
+		keys[2*i] = float32(math.Sin(float64(i))) / 16
+		keys[2*i+1] = float32(math.Cos(float64(3*i))) / 16
+		values[i] = float32(math.Sin(float64(7 * i)))
+		values[seqLenK+i] = float32(i%5) - 2
+	}
+
+	// d_k = 2, seq_len_k = 4096, kv_heads = 1
+	key := ctx.fromFloats(keys, 2, seqLenK, 1)
+	// seq_len_k = 4096, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats(values, seqLenK, 2, 1)
+
+	want := referenceAttention(query, key, value, nil, 0.7, ml.AttentionOptions{})
+
+	// queries and keys in F16 give logits in F16 in the test backend. The
+	// values of the query are exact in F16.
+	query.dtype = ml.DTypeF16
+	key.dtype = ml.DTypeF16
+	for i, v := range key.data {
+		key.data[i] = float16.Fromfloat32(v).Float32()
+	}
+
+	full := Attention(ctx, query, key, value, nil, 0.7).Floats()
+	half := Attention(ctx, query, key, value, nil, 0.7, WithHalfPrecSoftmax()).Floats()
+
+	// the weights themselves are still rounded to F16
+	assertFloats(t, want, full, 1e-4)
+	if d := diff(want, half); d < 10*diff(want, full) {
+		t.Errorf("softmax in F16 differs by %v, want more than for F32 (%v)", d, diff(want, full))
+	}
+
+	// the weights have the dtype of the logits
+	_, weights := AttentionWithWeights(ctx, query, key, value, nil, 0.7)
+	if dtype := weights.DType(); dtype != ml.DTypeF16 {
+		t.Errorf("weights have dtype %v, want %v", dtype, ml.DTypeF16)
+	}
+
+	// logits in F32 are normalized in F32 either way
+	query.dtype = ml.DTypeF32
+	key.dtype = ml.DTypeF32
+	assertFloats(t, Attention(ctx, query, key, value, nil, 0.7).Floats(), Attention(ctx, query, key, value, nil, 0.7, WithHalfPrecSoftmax()).Floats(), 0)
+}
+
+func TestAttentionMaskedQueries(t *testing.T) {
+	inf := float32(math.Inf(-1))
+
+	// two layers of self-attention over tokens with d = 2, where masks
+	// have shape [seq_len_k, seq_len_q]
+	forward := func(ctx *testContext, tokens []float32, mask *testTensor, opts ...AttentionOption) []float32 {
+		n := len(tokens) / 2
+		hidden := ctx.fromFloats(tokens, 2, n, 1)
+		for range 2 {
+			value := hidden.Permute(ctx, 1, 0, 2, 3).Contiguous(ctx)
+			out := Attention(ctx, hidden, hidden, value, mask, 0.7, opts...)
+			hidden = out.Reshape(ctx, 2, n, 1).(*testTensor)
+		}
+
+		return hidden.data
+	}
+
+	a := []float32{1, 0, 0.5, 1}
+	b := []float32{2, -1, -1, 1, 0, 3}
+
+	// sequence a alone with a causal mask
+	ctx := &testContext{}
+	want := forward(ctx, a, ctx.fromFloats([]float32{0, inf, 0, 0}, 2, 2))
+
+	// a batch of a, b and a padding token, where each sequence can only
+	// attend to its own tokens and the padding can't attend to any
+	batch := slices.Concat(a, b, []float32{0, 0})
+	mask := make([]float32, 6*6)
+	for i := range 6 {
+		for j := range 6 {
+			sameSeq := (i < 2 && j < 2) || (i >= 2 && i < 5 && j >= 2 && j < 5)
+			if !sameSeq || j > i {
+				mask[i*6+j] = inf
+			}
+		}
+	}
+
+	// the row of the padding is cleared so that its softmax is finite
+	attends, err := UnmaskQueries(ctx, mask, 6, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertFloats(t, []float32{1, 1, 1, 1, 1, 0}, attends.Floats(), 0)
+	assertFloats(t, make([]float32, 6), mask[30:], 0)
+
+	for _, opts := range [][]AttentionOption{nil, {WithBlockSize(2)}} {
+		opts = append(opts, WithMaskedQueries(attends))
+		got := forward(ctx, batch, ctx.fromFloats(mask, 6, 6), opts...)
+		for i, v := range got {
+			if math.IsNaN(float64(v)) {
+				t.Fatalf("output %v is NaN", i)
+			}
+		}
+
+		assertFloats(t, want, got[:4], 1e-6)
+		assertFloats(t, []float32{0, 0}, got[10:], 0)
+	}
+
+	// the weights of the padding are also zero
+	ctx = &testContext{}
+	query := ctx.fromFloats(batch, 2, 6, 1)
+	_, weights := AttentionWithWeights(ctx, query, query, query.Permute(ctx, 1, 0, 2, 3).Contiguous(ctx), ctx.fromFloats(mask, 6, 6), 0.7, WithMaskedQueries(attends))
+	assertFloats(t, make([]float32, 6), weights.Floats()[30:], 0)
+
+	// as is the output of fused implementations
+	fused := Attention(ctx, &testSDPATensor{query}, query, query.Permute(ctx, 1, 0, 2, 3).Contiguous(ctx), ctx.fromFloats(mask, 6, 6), 0.7, WithMaskedQueries(attends))
+	if ctx.fused != 1 {
+		t.Fatal("expected fused attention")
+	}
+
+	assertFloats(t, []float32{0, 0}, fused.Floats()[10:], 0)
+
+	// masks where every query attends to a key need no option
+	if attends, err := UnmaskQueries(ctx, mask[:30], 6, 5); err != nil || attends != nil {
+		t.Errorf("have %v, %v; want no masked queries", attends, err)
+	}
+
+	if _, err := AttentionErr(ctx, query, query, query.Permute(ctx, 1, 0, 2, 3).Contiguous(ctx), nil, 0.7, WithMaskedQueries(ctx.fromFloats(make([]float32, 5), 1, 5))); err == nil {
+		t.Error("expected an error for masked queries that don't match the queries")
+	}
+}
+
+func TestAttentionBooleanMask(t *testing.T) {
+	ctx := &testContext{}
+
+	// the last query attends to no keys, as with padding, so its row of the
+	// mask is cleared, or attends to every key in the boolean mask, and its
+	// output is zeroed
+	inf := float32(math.Inf(-1))
+	mask := []float32{0, inf, inf, 0, 0, inf, inf, inf, inf}
+	attends, err := UnmaskQueries(ctx, mask, 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	additive := ctx.fromFloats(mask, 3, 3)
+	boolean, err := ctx.FromIntSlice([]int32{1, 0, 0, 1, 1, 0, 1, 1, 1}, 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := ctx.fromFloats([]float32{1, 0, 0.5, 1, -1, 2}, 2, 3, 1)
+	key := ctx.fromFloats([]float32{0, 1, 2, -1, 1, 1}, 2, 3, 1)
+	value := ctx.fromFloats([]float32{1, 2, 3, 4, 5, 6}, 3, 2, 1)
+
+	want := Attention(ctx, query, key, value, additive, 0.7, WithMaskedQueries(attends)).Floats()
+	got := Attention(ctx, query, key, value, boolean, 0.7, WithMaskedQueries(attends)).Floats()
+	assertFloats(t, want, got, 0)
+	assertFloats(t, []float32{0, 0}, got[4:], 0)
+
+	fused := Attention(ctx, &testSDPATensor{query}, key, value, boolean, 0.7, WithMaskedQueries(attends))
+	if ctx.fused != 1 {
+		t.Fatal("expected fused attention")
+	}
+
+	assertFloats(t, want, fused.Floats(), 1e-6)
+}
+
+func TestAttentionBlocks(t *testing.T) {
+	ctx := &testContext{}
+
+	inf := float32(math.Inf(-1))
+
+	// d_k = 2, seq_len_q = 5, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2, 0, 1, 1, -3, 2, 2, 0.5, -1, 4, 0, -2, 1}, 2, 5, 2)
+	// d_k = 2, seq_len_k = 6, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5, 1, 1, 0, 2, -1, 3}, 2, 6, 1)
+	// seq_len_k = 6, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1, 2, 0, -1, 1, 3, 1}, 6, 2, 1)
+
+	// causal mask where queries are the last 5 keys
+	causal := make([]float32, 6*5)
+	for i := range 5 {
+		for j := range 6 {
+			if j > i+1 {
+				causal[i*6+j] = inf
+			}
+		}
+	}
+	mask := ctx.fromFloats(causal, 6, 5)
+
+	for _, opts := range [][]AttentionOption{nil, {WithSoftcap(2)}, {WithALiBi(8)}, {WithTemperature(2), WithSoftcap(1)}} {
+		want := Attention(ctx, query, key, value, mask, 0.7, opts...).Floats()
+
+		for _, blockSize := range []int{1, 2, 3, 5, 8} {
+			got := Attention(ctx, query, key, value, mask, 0.7, append(opts, WithBlockSize(blockSize))...)
+			if shape := got.Shape(); shape[0] != 2 || shape[1] != 2 || shape[2] != 5 {
+				t.Fatalf("unexpected shape %v with block size %v", shape, blockSize)
+			}
+
+			assertFloats(t, want, got.Floats(), 1e-6)
+			assertFloats(t, want, ChunkedAttention(ctx, query, key, value, mask, 0.7, blockSize, opts...).Floats(), 1e-6)
+		}
+	}
+
+	// fused implementations already bound memory use so aren't chunked
+	fused := ChunkedAttention(ctx, &testSDPATensor{query}, key, value, mask, 0.7, 2)
+	assertFloats(t, referenceAttention(query, key, value, mask, 0.7, ml.AttentionOptions{}), fused.Floats(), 0)
+
+	// attention whose scores exceed the workspace is split into blocks by
+	// default
+	ctx.workspace = 4 * 6 * 2 * 2
+	if n := defaultBlockSize(5, 6, 2, ctx.workspace); n != 2 {
+		t.Errorf("default block size is %v, want 2", n)
+	}
+
+	// but into no more than maxAttentionBlocks
+	if n := defaultBlockSize(8*maxAttentionBlocks, 6, 2, ctx.workspace); n != 8 {
+		t.Errorf("default block size is %v, want 8", n)
+	}
+
+	want := referenceAttention(query, key, value, mask, 0.7, ml.AttentionOptions{})
+	assertFloats(t, want, Attention(ctx, query, key, value, mask, 0.7).Floats(), 1e-5)
+}
+
+func TestAttentionFlashAttentionHeadDims(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		flashAttention []int
+		fused          []int
+	}{
+		{"disabled", nil, []int{64, 72, 80, 96, 128}},
+		{"enabled", []int{64, 80, 96, 112, 128, 256}, []int{64, 80, 96, 128}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, headDim := range []int{64, 72, 80, 96, 128} {
+				ctx := &testContext{flashAttention: tt.flashAttention}
+
+				s := make([]float32, headDim*2*3)
+				for i := range s {
+					s[i] = float32(math.Sin(float64(i)))
+				}
+
+				// d_k = headDim, seq_len = 3, heads = 2
+				query := ctx.fromFloats(s, headDim, 3, 2)
+				key := ctx.fromFloats(s, headDim, 3, 2)
+				// seq_len_k = 3, d_v = headDim, kv_heads = 2
+				value := ctx.fromFloats(s, 3, headDim, 2)
+
+				scale := 1 / math.Sqrt(float64(headDim))
+				got := Attention(ctx, &testSDPATensor{query}, key, value, nil, scale)
+
+				if fused := ctx.fused == 1; fused != slices.Contains(tt.fused, headDim) {
+					t.Errorf("head dim %v: fused is %v", headDim, fused)
+				}
+
+				want := referenceAttention(query, key, value, nil, scale, ml.AttentionOptions{})
+				assertFloats(t, want, got.Floats(), 1e-5)
+			}
+		})
+	}
+}
+
+// TestAttentionQuantizedCache checks that a quantized key and values are
+// passed to flash attention as they are, and are otherwise dequantized a
+// block of keys at a time
+func TestAttentionQuantizedCache(t *testing.T) {
+	defer func(n int) { valueBlockSize = n }(valueBlockSize)
+	valueBlockSize = 3
+
+	s := make([]float32, 4*8*4)
+	for i := range s {
+		s[i] = float32(math.Sin(float64(i)))
+	}
+
+	for _, tt := range []struct {
+		name           string
+		flashAttention []int
+		fused          bool
+	}{
+		{"flash attention", []int{4}, true},
+		{"unfused", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &testContext{flashAttention: tt.flashAttention}
+
+			// d_k = 4, seq_len_q = 2, heads = 4
+			query := ctx.fromFloats(s[:4*2*4], 4, 2, 4)
+			// d_k = 4, seq_len_k = 8, kv_heads = 2
+			key := ctx.fromFloats(s[:4*8*2], 4, 8, 2)
+			// seq_len_k = 8, d_v = 4, kv_heads = 2
+			value := ctx.fromFloats(s[4*8*2:], 8, 4, 2)
+
+			want := referenceAttention(query, key, value, nil, 0.5, ml.AttentionOptions{})
+
+			key.dtype, value.dtype = ml.DTypeQ80, ml.DTypeQ80
+			got := Attention(ctx, &testSDPATensor{query}, key, value, nil, 0.5)
+			if fused := ctx.fused == 1; fused != tt.fused {
+				t.Errorf("fused is %v, want %v", fused, tt.fused)
+			}
+
+			assertFloats(t, want, got.Floats(), 1e-5)
+		})
+	}
+}
+
+// TestAttentionReference checks both the fused and unfused implementations
+// against nntest.AttentionReference
+func TestAttentionReference(t *testing.T) {
+	const dk, dv, seqQ, seqK, heads = 4, 3, 3, 5, 4
+	inf := float32(math.Inf(-1))
+
+	vals := func(seed, n int) []float32 {
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(float64(seed*100 + i)))
+		}
+		return s
+	}
+
+	// causal, with the queries at the end of the sequence, and the last
+	// query attending to no keys
+	causal := make([]float32, seqK*seqQ)
+	for i := range seqQ {
+		for j := range seqK {
+			if j > seqK-seqQ+i || i == seqQ-1 {
+				causal[i*seqK+j] = inf
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		kvHeads int
+		mask    []float32
+		opts    []AttentionOption
+	}{
+		{name: "no mask", kvHeads: heads},
+		{name: "causal", kvHeads: heads, mask: causal},
+		{name: "grouped query", kvHeads: 2, mask: causal},
+		{name: "multi query", kvHeads: 1, mask: causal},
+		{name: "per-head mask", kvHeads: 2, mask: vals(4, seqK*seqQ*heads)},
+		{name: "blocks", kvHeads: 2, mask: causal, opts: []AttentionOption{WithBlockSize(1)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &testContext{}
+			q, k, v := vals(1, dk*seqQ*heads), vals(2, dk*seqK*tt.kvHeads), vals(3, seqK*dv*tt.kvHeads)
+
+			want := nntest.AttentionReference(q, k, v, tt.mask, nntest.AttentionShape{
+				KeyDim: dk, ValueDim: dv,
+				SeqLenQ: seqQ, SeqLenK: seqK,
+				Heads: heads, KVHeads: tt.kvHeads,
+			}, 0.5)
+
+			// the reference output of the query that attends to no keys is
+			// zero, as with WithMaskedQueries
+			var mask ml.Tensor
+			opts := tt.opts
+			if tt.mask != nil {
+				m := slices.Clone(tt.mask)
+				attends, err := UnmaskQueries(ctx, m, seqK, seqQ)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if attends != nil {
+					opts = append(slices.Clone(opts), WithMaskedQueries(attends))
+				}
+
+				mask = ctx.fromFloats(m, seqK, seqQ, len(m)/(seqK*seqQ))
+			}
+
+			query := ctx.fromFloats(q, dk, seqQ, heads)
+			key := ctx.fromFloats(k, dk, seqK, tt.kvHeads)
+			value := ctx.fromFloats(v, seqK, dv, tt.kvHeads)
+
+			for _, query := range []ml.Tensor{query, &testSDPATensor{query}} {
+				got := Attention(ctx, query, key, value, mask, 0.5, opts...)
+				assertFloats(t, want, got.Floats(), 1e-5)
+			}
+		})
+	}
+}
+
+func TestSupportsFusedAttention(t *testing.T) {
+	ctx := &testContext{flashAttention: []int{2}}
+
+	s := []float32{1, 2, 3, 4, -1, 0.5, 2, -2}
+
+	// d_k = 2, seq_len = 2, heads = 2
+	query := ctx.fromFloats(s, 2, 2, 2)
+	key := ctx.fromFloats(s, 2, 2, 2)
+	value := ctx.fromFloats(s, 2, 2, 2)
+
+	var reasons []string
+	SetAttentionFallbackHook(func(reason string) { reasons = append(reasons, reason) })
+	defer SetAttentionFallbackHook(nil)
+
+	for _, tt := range []struct {
+		name   string
+		query  ml.Tensor
+		opts   []AttentionOption
+		reason string
+	}{
+		{name: "fused", query: &testSDPATensor{query}},
+		{name: "softcap", query: &testSDPATensor{query}, opts: []AttentionOption{WithSoftcap(30)}},
+		{name: "temperature", query: &testSDPATensor{query}, opts: []AttentionOption{WithTemperature(2)}},
+		{name: "no fused attention", query: query, reason: "backend has no fused attention"},
+		{
+			name:   "temperature with softcap",
+			query:  &testSDPATensor{query},
+			opts:   []AttentionOption{WithSoftcap(30), WithTemperature(2)},
+			reason: "temperature with softcap",
+		},
+		{name: "sigmoid", query: &testSDPATensor{query}, opts: []AttentionOption{WithSigmoid(0)}, reason: "sigmoid attention"},
+		{
+			name:   "bias",
+			query:  &testSDPATensor{query},
+			opts:   []AttentionOption{WithBias(ctx.fromFloats([]float32{1, 0, 0, 1}, 2, 2))},
+			reason: "attention bias",
+		},
+		{
+			name:   "score modifier",
+			query:  &testSDPATensor{query},
+			opts:   []AttentionOption{WithScoreModifier(func(ctx ml.Context, scores ml.Tensor) ml.Tensor { return scores })},
+			reason: "score modifier",
+		},
+		{
+			name:   "head size",
+			query:  &testSDPATensor{ctx.fromFloats(append(s, s...), 4, 2, 2)},
+			reason: "flash attention doesn't support head size 4",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SupportsFusedAttention(ctx, tt.query, tt.opts...); got != (tt.reason == "") {
+				t.Errorf("SupportsFusedAttention = %v, want %v", got, tt.reason == "")
+			}
+
+			k := key
+			if tt.query.Dim(0) != k.Dim(0) {
+				k = ctx.fromFloats(append(s, s...), 4, 2, 2)
+			}
+
+			reasons, ctx.fused = nil, 0
+			Attention(ctx, tt.query, k, value, nil, 1, tt.opts...)
+
+			if tt.reason == "" {
+				if ctx.fused != 1 || len(reasons) > 0 {
+					t.Errorf("fused %v times, fell back for %q", ctx.fused, reasons)
+				}
+			} else if ctx.fused != 0 || !slices.Equal(reasons, []string{tt.reason}) {
+				t.Errorf("fused %v times, fell back for %q, want %q", ctx.fused, reasons, tt.reason)
+			}
+		})
+	}
+}
+
+// testFullPrecTensor records whether it was multiplied with MulmatFullPrec
+type testFullPrecTensor struct {
+	*testTensor
+	fullPrec bool
+}
+
+func (t *testFullPrecTensor) MulmatFullPrec(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
+	t.fullPrec = true
+	return t.testTensor.MulmatFullPrec(ctx, t2)
+}
+
+func TestAttentionFullPrec(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+
+	want := referenceAttention(query, key, value, nil, 0.7, ml.AttentionOptions{})
+	for _, fullPrec := range []bool{false, true} {
+		v := &testFullPrecTensor{testTensor: value}
+
+		var kqv ml.Tensor
+		if fullPrec {
+			kqv = Attention(ctx, query, key, v, nil, 0.7, WithFullPrec())
+		} else {
+			kqv = Attention(ctx, query, key, v, nil, 0.7)
+		}
+
+		assertFloats(t, want, kqv.Floats(), 1e-5)
+		if v.fullPrec != fullPrec {
+			t.Errorf("value multiplied in full precision: %v, want %v", v.fullPrec, fullPrec)
+		}
+	}
+}
+
+func TestAttentionErr(t *testing.T) {
+	ctx := &testContext{}
+
+	zeros := func(shape ...int) *testTensor {
+		return ctx.Zeros(ml.DTypeF32, shape...).(*testTensor)
+	}
+
+	cases := []struct {
+		name                    string
+		query, key, value, mask *testTensor
+		opts                    []AttentionOption
+		dim, operand            string
+		got, want               int
+	}{
+		{"d_k", zeros(4, 2, 2), zeros(3, 5, 2), zeros(5, 4, 2), nil, nil, "d_k", "key", 3, 4},
+		{"seq_len_q", zeros(4, 2, 2), zeros(4, 5, 2), zeros(5, 4, 2), zeros(5, 3), nil, "seq_len_q", "mask", 3, 2},
+		{"seq_len_k value", zeros(4, 2, 2), zeros(4, 5, 2), zeros(6, 4, 2), nil, nil, "seq_len_k", "value", 6, 5},
+		{"seq_len_k mask", zeros(4, 2, 2), zeros(4, 5, 2), zeros(5, 4, 2), zeros(6, 2), nil, "seq_len_k", "mask", 6, 5},
+		{"kv_heads", zeros(4, 2, 2), zeros(4, 5, 2), zeros(5, 4, 1), nil, nil, "kv_heads", "value", 1, 2},
+		{"d_v", zeros(4, 2, 2), zeros(4, 5, 2), zeros(5, 4, 2), nil, []AttentionOption{WithValueDim(8)}, "d_v", "value", 4, 8},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var mask ml.Tensor
+			if tt.mask != nil {
+				mask = tt.mask
+			}
+
+			// AttentionErr must report the mismatch without panicking
+			_, err := AttentionErr(ctx, tt.query, tt.key, tt.value, mask, 1, tt.opts...)
+
+			var e *ShapeMismatchError
+			if !errors.As(err, &e) {
+				t.Fatalf("expected ShapeMismatchError, got %v", err)
+			}
+
+			if e.Dim != tt.dim || e.Operand != tt.operand || e.Got != tt.got || e.Want != tt.want {
+				t.Errorf("unexpected error %+v", e)
+			}
+
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("expected Attention to panic")
+				}
+			}()
+			Attention(ctx, tt.query, tt.key, tt.value, mask, 1, tt.opts...)
+		})
+	}
+}
+
+func TestGroupedQueryAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	cases := []struct {
+		heads, kvHeads int
+		valid          bool
+	}{
+		{4, 4, true},
+		{4, 2, true},
+		{4, 1, true},
+		{4, 3, false},
+		{2, 4, false},
+	}
+
+	for _, tt := range cases {
+		query := ctx.Zeros(ml.DTypeF32, 2, 1, tt.heads)
+		key := ctx.Zeros(ml.DTypeF32, 2, 3, tt.kvHeads)
+		value := ctx.Zeros(ml.DTypeF32, 3, 2, tt.kvHeads)
+
+		_, err := AttentionErr(ctx, query, key, value, nil, 1)
+		if tt.valid && err != nil {
+			t.Errorf("heads %d kv_heads %d: unexpected error %v", tt.heads, tt.kvHeads, err)
+		} else if !tt.valid && err == nil {
+			t.Errorf("heads %d kv_heads %d: expected error", tt.heads, tt.kvHeads)
+		}
+	}
+}
+
+func TestMultiQueryAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 3
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2, 0, 1, 1, -3}, 2, 2, 3)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// seq_len_k = 3, seq_len_q = 2
+	mask := ctx.fromFloats([]float32{0, 0, float32(math.Inf(-1)), 0, 0, 0}, 3, 2)
+
+	want := referenceAttention(query, key, value, mask, 0.7, ml.AttentionOptions{})
+	for _, opts := range [][]AttentionOption{nil, {WithBlockSize(1)}, {WithFullPrec()}} {
+		got, err := MultiQueryAttention(ctx, query, key, value, mask, 0.7, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if shape := got.Shape(); shape[0] != 2 || shape[1] != 3 || shape[2] != 2 {
+			t.Fatalf("unexpected shape %v", shape)
+		}
+
+		assertFloats(t, want, got.Floats(), 1e-5)
+	}
+
+	key = ctx.fromFloats(append(key.data, key.data...), 2, 3, 2)
+	value = ctx.fromFloats(append(value.data, value.data...), 3, 2, 2)
+	_, err := MultiQueryAttention(ctx, query, key, value, mask, 0.7)
+
+	var sme *ShapeMismatchError
+	if !errors.As(err, &sme) || sme.Dim != "kv_heads" || sme.Got != 2 {
+		t.Fatalf("expected kv_heads mismatch, got %v", err)
+	}
+}
+
+func TestAttentionSingleQuery(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 1, heads = 4
+	q := []float32{1, 2, 3, 4, -1, 0.5, 2, -2}
+	query := ctx.fromFloats(q, 2, 1, 4)
+	// d_k = 2, seq_len_k = 3, kv_heads = 2
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5, 1, -1, 2, 0, -3, 1}, 2, 3, 2)
+	// seq_len_k = 3, d_v = 2, kv_heads = 2
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1, 2, 0, -2, 1, 1, 3}, 3, 2, 2)
+	mask := ctx.fromFloats([]float32{0, float32(math.Inf(-1)), 0}, 3, 1)
+
+	// the same query twice is computed without grouping the heads
+	var q2 []float32
+	for h := range 4 {
+		q2 = append(q2, q[2*h:2*h+2]...)
+		q2 = append(q2, q[2*h:2*h+2]...)
+	}
+	query2 := ctx.fromFloats(q2, 2, 2, 4)
+	mask2 := ctx.fromFloats(append(slices.Clone(mask.data), mask.data...), 3, 2)
+
+	for _, softcap := range []float64{0, 5} {
+		opts := []AttentionOption{WithSoftcap(softcap)}
+		got := Attention(ctx, query, key, value, mask, 0.7, opts...)
+		if shape := got.Shape(); shape[0] != 2 || shape[1] != 4 {
+			t.Fatalf("unexpected shape %v", shape)
+		}
+
+		want := referenceAttention(query, key, value, mask, 0.7, ml.AttentionOptions{Softcap: softcap})
+		assertFloats(t, want, got.Floats(), 1e-5)
+
+		general := Attention(ctx, query2, key, value, mask2, 0.7, opts...).Floats()
+		assertFloats(t, general[:len(want)], got.Floats(), 0)
+	}
+
+	_, weights := AttentionWithWeights(ctx, query, key, value, mask, 0.7)
+	assertFloats(t, referenceWeights(query, key, mask, 0.7, ml.AttentionOptions{}), weights.Floats(), 1e-5)
+}
+
+func TestAttentionMixedDTypes(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	q := []float32{1, 2, 3, 4, -1, 0.5, 2, -2}
+	// d_k = 2, seq_len_k = 4, kv_heads = 1
+	k := []float32{4, 1, -2, 3, 0.5, 5, 1, -1}
+	// seq_len_k = 4, d_v = 2, kv_heads = 1
+	v := []float32{1, 2, 3, -1, 0, 1, 2, -3}
+
+	value := ctx.fromFloats(v, 4, 2, 1)
+	want := referenceAttention(ctx.fromFloats(q, 2, 2, 2), ctx.fromFloats(k, 2, 4, 1), value, nil, 0.7, ml.AttentionOptions{})
+
+	tests := []struct {
+		name   string
+		query  ml.DType
+		key    ml.DType
+		logits ml.DType
+	}{
+		{"F16Key", ml.DTypeF32, ml.DTypeF16, ml.DTypeF32},
+		{"F16Query", ml.DTypeF16, ml.DTypeF32, ml.DTypeF32},
+		{"F16", ml.DTypeF16, ml.DTypeF16, ml.DTypeF16},
+		// quantized keys are kept and multiplied by an F32 query
+		{"Q80Key", ml.DTypeF16, ml.DTypeQ80, ml.DTypeF32},
+		// tensors can't be copied to a quantized dtype, so both are upcast
+		{"Quantized", ml.DTypeQ40, ml.DTypeQ80, ml.DTypeF32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the values are exact in F16
+			query, key := ctx.fromFloats(q, 2, 2, 2), ctx.fromFloats(k, 2, 4, 1)
+			query.dtype, key.dtype = tt.query, tt.key
+
+			// the logits have the dtype of the key in the test backend, which
+			// is that of both operands once they're upcast
+			kqv, weights := AttentionWithWeights(ctx, query, key, value, nil, 0.7)
+			if dtype := weights.DType(); dtype != tt.logits {
+				t.Errorf("logits have dtype %v, want %v", dtype, tt.logits)
+			}
+
+			assertFloats(t, want, kqv.Floats(), 1e-3)
+		})
+	}
+
+	t.Run("Integer", func(t *testing.T) {
+		key := ctx.fromFloats(k, 2, 4, 1)
+		key.dtype = ml.DTypeI32
+
+		_, err := AttentionErr(ctx, ctx.fromFloats(q, 2, 2, 2), key, value, nil, 0.7)
+		if err == nil || !strings.Contains(err.Error(), "key(I32)") {
+			t.Errorf("have error %v; want one for the I32 key", err)
+		}
+	})
+}
+
+func TestAttentionOutputDType(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	q := []float32{1, 2, 3, 4, -1, 0.5, 2, -2}
+	// d_k = 2, seq_len_k = 4, kv_heads = 1
+	k := []float32{4, 1, -2, 3, 0.5, 5, 1, -1}
+	// seq_len_k = 4, d_v = 2, kv_heads = 1
+	v := []float32{1, 2, 3, -1, 0, 1, 2, -3}
+
+	want := referenceAttention(ctx.fromFloats(q, 2, 2, 2), ctx.fromFloats(k, 2, 4, 1), ctx.fromFloats(v, 4, 2, 1), nil, 0.7, ml.AttentionOptions{})
+
+	tests := []struct {
+		name   string
+		value  ml.DType
+		fused  bool
+		opts   []AttentionOption
+		output ml.DType
+	}{
+		{"Unset", ml.DTypeF16, false, nil, ml.DTypeF16},
+		{"F32", ml.DTypeF16, false, []AttentionOption{WithOutputDType(ml.DTypeF32)}, ml.DTypeF32},
+		{"F16", ml.DTypeF32, false, []AttentionOption{WithOutputDType(ml.DTypeF16)}, ml.DTypeF16},
+		{"Same", ml.DTypeF32, false, []AttentionOption{WithOutputDType(ml.DTypeF32)}, ml.DTypeF32},
+		{"Fused", ml.DTypeF32, true, []AttentionOption{WithOutputDType(ml.DTypeF16)}, ml.DTypeF16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := ctx.fromFloats(v, 4, 2, 1)
+			value.dtype = tt.value
+
+			var query ml.Tensor = ctx.fromFloats(q, 2, 2, 2)
+			if tt.fused {
+				query = &testSDPATensor{query.(*testTensor)}
+			}
+
+			kqv := Attention(ctx, query, ctx.fromFloats(k, 2, 4, 1), value, nil, 0.7, tt.opts...)
+			if dtype := kqv.DType(); dtype != tt.output {
+				t.Errorf("output has dtype %v, want %v", dtype, tt.output)
+			}
+
+			assertFloats(t, want, kqv.Floats(), 1e-2)
+		})
+	}
+
+	t.Run("Quantized", func(t *testing.T) {
+		_, err := AttentionErr(ctx, ctx.fromFloats(q, 2, 2, 2), ctx.fromFloats(k, 2, 4, 1), ctx.fromFloats(v, 4, 2, 1), nil, 0.7, WithOutputDType(ml.DTypeQ80))
+		if err == nil || !strings.Contains(err.Error(), "Q80") {
+			t.Errorf("have error %v; want one for the Q80 output", err)
+		}
+	})
+}
+
+func TestAttentionFoldScale(t *testing.T) {
+	// d_k = 2, seq_len_q = 2, heads = 2
+	q := []float32{1, 2, 3, 4, -1, 0.5, 2, -2}
+	// d_k = 2, seq_len_k = 4, kv_heads = 1
+	k := []float32{4, 1, -2, 3, 0.5, 5, 1, -1}
+	// seq_len_k = 4, d_v = 2, kv_heads = 1
+	v := []float32{1, 2, 3, -1, 0, 1, 2, -3}
+
+	ctx := &testContext{}
+	query, key := ctx.fromFloats(q, 2, 2, 2), ctx.fromFloats(k, 2, 4, 1)
+	half := query.Copy(ctx, ctx.Zeros(ml.DTypeF16, query.Shape()...))
+
+	tests := []struct {
+		name  string
+		query ml.Tensor
+		key   ml.Tensor
+		scale float64
+		want  bool
+	}{
+		{"Query", query, key, 0.7, true},
+		{"ShortKeys", query, ctx.fromFloats(k[:4], 2, 2, 1), 0.7, false},
+		{"One", query, key, 1, false},
+		{"F16", half, key, 0.7, false},
+		// a query that can't report whether it is contiguous
+		{"Unknown", struct{ ml.Tensor }{query}, key, 0.7, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if have := foldScale(tt.query, tt.key, tt.scale); have != tt.want {
+				t.Errorf("have %v; want %v", have, tt.want)
+			}
+		})
+	}
+
+	// the scale is applied to the 8 elements of the query rather than the
+	// 16 logits, with the same output
+	for _, softcap := range []float64{0, 5} {
+		ctx := &testContext{}
+		query, key, value := ctx.fromFloats(q, 2, 2, 2), ctx.fromFloats(k, 2, 4, 1), ctx.fromFloats(v, 4, 2, 1)
+		got := Attention(ctx, query, key, value, nil, 0.7, WithSoftcap(softcap))
+
+		want := referenceAttention(query, key, value, nil, 0.7, ml.AttentionOptions{Softcap: softcap})
+		assertFloats(t, want, got.Floats(), 1e-6)
+
+		// a softcap scales the logits twice more
+		if want := 8 + 2*16*min(1, int(softcap)); ctx.scaled != want {
+			t.Errorf("softcap %v: have %d elements scaled; want %d", softcap, ctx.scaled, want)
+		}
+	}
+}
+
+func TestPermute(t *testing.T) {
+	ctx := &testContext{}
+
+	var orders [][]int
+	var permutations func(order []int)
+	permutations = func(order []int) {
+		if len(order) == 4 {
+			orders = append(orders, order)
+			return
+		}
+
+		for d := range 4 {
+			if !slices.Contains(order, d) {
+				permutations(append(slices.Clone(order), d))
+			}
+		}
+	}
+	permutations(nil)
+
+	for _, shape := range [][]int{{4, 1, 3}, {4, 3, 1}, {1, 4, 3}, {4, 3, 2}, {4, 1, 1, 2}} {
+		n := 1
+		for _, d := range shape {
+			n *= d
+		}
+
+		data := make([]float32, n)
+		for i := range data {
+			data[i] = float32(i)
+		}
+		x := ctx.fromFloats(data, shape...)
+
+		for _, order := range orders {
+			want := x.Permute(ctx, order...).Contiguous(ctx)
+			got := permute(ctx, x, order...)
+
+			for d := range 4 {
+				if got.Dim(d) != want.Dim(d) {
+					t.Fatalf("shape %v order %v: dimension %d is %d, want %d", shape, order, d, got.Dim(d), want.Dim(d))
+				}
+			}
+
+			if !slices.Equal(got.Floats(), want.Floats()) {
+				t.Errorf("shape %v order %v: have %v, want %v", shape, order, got.Floats(), want.Floats())
+			}
+		}
+	}
+}
+
+func TestRepeatKV(t *testing.T) {
+	ctx := &testContext{}
+
+	random := func(seed float64, shape ...int) *testTensor {
+		n := 1
+		for _, s := range shape {
+			n *= s
+		}
+
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(seed + float64(i)))
+		}
+		return ctx.fromFloats(s, shape...)
+	}
+
+	cases := []struct {
+		name           string
+		heads, kvHeads int
+	}{
+		{"MHA", 4, 4},
+		{"MQA", 4, 1},
+		{"GQA", 32, 8},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			query := random(1, 4, 2, tt.heads)
+			key := random(2, 4, 3, tt.kvHeads)
+			value := random(3, 3, 2, tt.kvHeads)
+
+			nRep := tt.heads / tt.kvHeads
+			k := RepeatKV(ctx, key, nRep)
+			if nRep == 1 && k != ml.Tensor(key) {
+				t.Errorf("expected key to be unchanged")
+			}
+
+			if shape := k.Shape(); shape[0] != 4 || shape[1] != 3 || shape[2] != tt.heads {
+				t.Fatalf("unexpected shape %v", shape)
+			}
+
+			for h := range tt.heads {
+				for i := range 3 {
+					for d := range 4 {
+						if got, want := asTestTensor(k).at(d, i, h), key.at(d, i, h/nRep); got != want {
+							t.Fatalf("head %v is %v at (%v, %v), want %v", h, got, d, i, want)
+						}
+					}
+				}
+			}
+
+			want := Attention(ctx, query, key, value, nil, 0.5).Floats()
+			got := Attention(ctx, query, k, RepeatKV(ctx, value, nRep), nil, 0.5).Floats()
+			assertFloats(t, want, got, 1e-6)
+		})
+	}
+
+	_, err := AttentionErr(ctx, random(1, 4, 2, 6), random(2, 4, 3, 4), random(3, 3, 2, 4), nil, 0.5)
+	if err == nil {
+		t.Error("expected heads that are not a multiple of kv_heads to fail")
+	}
+}
+
+func TestBatchedAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	const dim, heads = 2, 2
+	seqLens := []int{3, 1, 2}
+
+	// tensor returns a tensor with shape [dim, seqLen, heads] of the tokens of
+	// the packed batch from start, or [seqLen, dim, heads] if transposed
+	tensor := func(seed, start, seqLen int, transposed bool) *testTensor {
+		var s []float32
+		for h := range heads {
+			if transposed {
+				for d := range dim {
+					for i := range seqLen {
+						s = append(s, float32(math.Sin(float64(seed*100+h*10+(start+i)*dim+d))))
+					}
+				}
+			} else {
+				for i := range seqLen {
+					for d := range dim {
+						s = append(s, float32(math.Sin(float64(seed*100+h*10+(start+i)*dim+d))))
+					}
+				}
+			}
+		}
+
+		if transposed {
+			return ctx.fromFloats(s, seqLen, dim, heads)
+		}
+
+		return ctx.fromFloats(s, dim, seqLen, heads)
+	}
+
+	// the same as attending to each sequence separately
+	var want []float32
+	var start int
+	for _, n := range seqLens {
+		out := Attention(ctx, tensor(1, start, n, false), tensor(2, start, n, false), tensor(3, start, n, true), nil, 0.5)
+		want = append(want, out.Floats()...)
+		start += n
+	}
+
+	got := BatchedAttention(ctx, tensor(1, 0, start, false), tensor(2, 0, start, false), tensor(3, 0, start, true), 0.5, seqLens)
+	if got.Dim(0) != dim || got.Dim(1) != heads || got.Dim(2) != start {
+		t.Errorf("shape is %v, want %v", got.Shape(), []int{dim, heads, start})
+	}
+
+	assertFloats(t, want, got.Floats(), 1e-5)
+
+	defer func() {
+		var err *ShapeMismatchError
+		if r := recover(); r == nil {
+			t.Error("expected sequence lengths that don't sum to seq_len to panic")
+		} else if e, ok := r.(error); !ok || !errors.As(e, &err) {
+			t.Errorf("unexpected panic %v", r)
+		}
+	}()
+	BatchedAttention(ctx, tensor(1, 0, start, false), tensor(2, 0, start, false), tensor(3, 0, start, true), 0.5, []int{3, 2})
+}
+
+func TestCrossAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 1, heads = 2
+	query := ctx.fromFloats([]float32{1, -1, 0.5, 2}, 2, 1, 2)
+	// d_k = 2, enc_len = 3, kv_heads = 2
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5, 1, 1, 0, 2, -1, 3}, 2, 3, 2)
+	// enc_len = 3, d_v = 1, kv_heads = 2
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 1, 2)
+
+	want := referenceAttention(query, key, value, nil, 0.5, ml.AttentionOptions{})
+	assertFloats(t, want, CrossAttention(ctx, query, key, value, nil, 0.5).Floats(), 1e-5)
+	assertFloats(t, want, CrossAttention(ctx, &testSDPATensor{query}, key, value, nil, 0.5).Floats(), 1e-5)
+
+	// padding masks broadcast over queries and heads
+	inf := float32(math.Inf(-1))
+	queries := ctx.fromFloats([]float32{1, -1, 3, 0, 0.5, 2, -2, 1}, 2, 2, 2)
+	padding := ctx.fromFloats([]float32{0, 0, inf}, 3, 1, 1)
+
+	want = referenceAttention(queries, key, value, ctx.fromFloats([]float32{0, 0, inf, 0, 0, inf}, 3, 2, 1), 0.5, ml.AttentionOptions{})
+	assertFloats(t, want, CrossAttention(ctx, queries, key, value, padding, 0.5).Floats(), 1e-5)
+	assertFloats(t, want, CrossAttention(ctx, &testSDPATensor{queries}, key, value, padding, 0.5).Floats(), 1e-5)
+
+	defer func() {
+		var e *ShapeMismatchError
+		if err, ok := recover().(error); !ok || !errors.As(err, &e) || e.Dim != "kv_heads" {
+			t.Errorf("expected kv_heads ShapeMismatchError, got %v", err)
+		}
+	}()
+	CrossAttention(ctx, query, key, ctx.fromFloats(make([]float32, 3), 3, 1, 1), nil, 0.5)
+}
+
+func TestAttentionWithWeights(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// seq_len_k = 3, seq_len_q = 2
+	mask := ctx.fromFloats([]float32{0, 0, float32(math.Inf(-1)), 0, 0, 0}, 3, 2)
+
+	out, weights := AttentionWithWeights(ctx, &testSDPATensor{query}, key, value, mask, 0.7)
+	if weights == nil {
+		t.Fatal("expected attention weights")
+	}
+
+	if shape := weights.Shape(); len(shape) < 3 || shape[0] != 3 || shape[1] != 2 || shape[2] != 2 {
+		t.Fatalf("unexpected weights shape %v", shape)
+	}
+
+	w := weights.Floats()
+	for row := range len(w) / 3 {
+		var sum float32
+		for _, v := range w[row*3 : row*3+3] {
+			sum += v
+		}
+
+		if math.Abs(float64(sum-1)) > 1e-5 {
+			t.Errorf("weights row %v sums to %v", row, sum)
+		}
+	}
+
+	// the masked key must not receive any weight
+	if w[2] != 0 {
+		t.Errorf("masked weight is %v", w[2])
+	}
+
+	fused := Attention(ctx, &testSDPATensor{query}, key, value, mask, 0.7)
+	assertFloats(t, fused.Floats(), out.Floats(), 1e-5)
+
+	// weights reflect options that modify the attention logits
+	for _, opts := range []ml.AttentionOptions{{}, {Softcap: 1}, {MaxBias: 8}} {
+		_, weights := AttentionWithWeights(ctx, query, key, value, mask, 0.7, WithSoftcap(opts.Softcap), WithALiBi(opts.MaxBias))
+
+		causal := ctx.fromFloats([]float32{0, 0, float32(math.Inf(-1)), 0, 0, 0}, 3, 2)
+		if opts.MaxBias != 0 {
+			// queries are the last seq_len_q keys
+			causal = ctx.fromFloats([]float32{-1, 0, float32(math.Inf(-1)), -2, -1, 0}, 3, 2)
+		}
+
+		assertFloats(t, referenceWeights(query, key, causal, 0.7, opts), weights.Floats(), 1e-5)
+	}
+}
+
+func TestSlidingWindowAttention(t *testing.T) {
+	ctx := &testContext{}
+	inf := float32(math.Inf(-1))
+
+	// d_k = 2, seq_len_q = 2, heads = 1
+	query := ctx.fromFloats([]float32{1, 2, 3, 4}, 2, 2, 1)
+	// d_k = 2, seq_len_k = 4, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5, 1, 1}, 2, 4, 1)
+	// seq_len_k = 4, d_v = 1, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, 4}, 4, 1, 1)
+	// causal mask with queries at positions 2 and 3
+	causal := ctx.fromFloats([]float32{0, 0, 0, inf, 0, 0, 0, 0}, 4, 2)
+
+	cases := []struct {
+		name   string
+		window int
+		sinks  int
+		mask   *testTensor
+		want   *testTensor
+	}{
+		{"full", 0, 0, causal, causal},
+		{"window", 1, 0, causal, ctx.fromFloats([]float32{inf, 0, 0, inf, inf, inf, 0, 0}, 4, 2)},
+		{"no mask", 1, 0, nil, ctx.fromFloats([]float32{inf, 0, 0, 0, inf, inf, 0, 0}, 4, 2)},
+		{"large window", 8, 0, causal, causal},
+		// the first key stays attended after the window has moved past it
+		{"sink", 1, 1, causal, ctx.fromFloats([]float32{0, 0, 0, inf, 0, inf, 0, 0}, 4, 2)},
+		{"sinks without window", 0, 1, causal, causal},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var mask ml.Tensor
+			if tt.mask != nil {
+				mask = tt.mask
+			}
+
+			got := SlidingWindowAttention(ctx, query, key, value, mask, 0.5, tt.window, tt.sinks)
+			assertFloats(t, referenceAttention(query, key, value, tt.want, 0.5, ml.AttentionOptions{}), got.Floats(), 1e-5)
+		})
+	}
+}
+
+func TestSlidingWindowAttentionSinks(t *testing.T) {
+	ctx := &testContext{}
+
+	const seqLen, window, sinks = 8, 2, 2
+
+	s, c := make([]float32, 2*seqLen), make([]float32, 2*seqLen)
+	for i := range s {
+		s[i], c[i] = float32(math.Sin(float64(i))), float32(math.Cos(float64(i)))
+	}
+
+	// d_k = 2, seq_len = 8, heads = 1
+	query := ctx.fromFloats(s, 2, seqLen, 1)
+	key := ctx.fromFloats(c, 2, seqLen, 1)
+	// seq_len_k = 8, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats(s, seqLen, 2, 1)
+
+	// as the window slides, each query attends to the sinks and the keys of its
+	// window but not to those in between
+	causal := make([]float32, seqLen*seqLen)
+	want := make([]float32, seqLen*seqLen)
+	for i := range seqLen {
+		for j := range seqLen {
+			if j > i {
+				causal[i*seqLen+j] = float32(math.Inf(-1))
+			}
+
+			if j > i || (j >= sinks && j < i-window) {
+				want[i*seqLen+j] = float32(math.Inf(-1))
+			}
+		}
+	}
+
+	got := SlidingWindowAttention(ctx, query, key, value, ctx.fromFloats(causal, seqLen, seqLen), 0.5, window, sinks)
+	assertFloats(t, referenceAttention(query, key, value, ctx.fromFloats(want, seqLen, seqLen), 0.5, ml.AttentionOptions{}), got.Floats(), 1e-5)
+}
+
+func TestAttentionWithPositions(t *testing.T) {
+	ctx := &testContext{}
+
+	// the keys at positions 0, 2, 4 and 5 after 1 and 3 were evicted, in the
+	// order rows[i] that they were compacted into the cache
+	positions := []int32{4, 0, 5, 2}
+	rows := []int{2, 0, 3, 1}
+
+	k := []float32{4, 1, -2, 3, 0.5, 5, 1, 1}
+	v := []float32{1, 2, 3, 4}
+
+	var compactedK, compactedV []float32
+	for _, r := range rows {
+		compactedK = append(compactedK, k[2*r:2*r+2]...)
+		compactedV = append(compactedV, v[r])
+	}
+
+	// d_k = 2, seq_len_q = 2, heads = 1
+	query := ctx.fromFloats([]float32{1, 2, 3, 4}, 2, 2, 1)
+
+	// the same as causal attention over the keys in order, where the queries
+	// are the last keys
+	want := Attention(ctx, query, ctx.fromFloats(k, 2, 4, 1), ctx.fromFloats(v, 4, 1, 1), CausalMask(ctx, 2, 4, 1, float32(math.Inf(-1))), 0.5)
+
+	key := ctx.fromFloats(compactedK, 2, 4, 1)
+	value := ctx.fromFloats(compactedV, 4, 1, 1)
+
+	got := AttentionWithPositions(ctx, query, key, value, nil, 0.5, positions, []int32{4, 5}, 0)
+	assertFloats(t, want.Floats(), got.Floats(), 1e-5)
+
+	// a mask is combined with that of the positions
+	inf := float32(math.Inf(-1))
+	mask := ctx.fromFloats([]float32{0, inf, 0, 0, 0, inf, 0, 0}, 4, 2)
+	got = AttentionWithPositions(ctx, query, key, value, mask, 0.5, positions, []int32{4, 5}, 0)
+	assertFloats(t, referenceAttention(query, key, value, ctx.fromFloats([]float32{0, inf, inf, 0, 0, inf, 0, 0}, 4, 2), 0.5, ml.AttentionOptions{}), got.Floats(), 1e-5)
+
+	for _, tt := range []struct {
+		name          string
+		keys, queries []int32
+		dim           string
+	}{
+		{"keys", positions[:3], []int32{4, 5}, "seq_len_k"},
+		{"queries", positions, []int32{5}, "seq_len_q"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				var e *ShapeMismatchError
+				if err, ok := recover().(error); !ok || !errors.As(err, &e) || e.Dim != tt.dim {
+					t.Errorf("expected a %s mismatch, got %v", tt.dim, err)
+				}
+			}()
+			AttentionWithPositions(ctx, query, key, value, nil, 0.5, tt.keys, tt.queries, 0)
+		})
+	}
+}
+
+func TestAttentionConfig(t *testing.T) {
+	ctx := &testContext{}
+	inf := float32(math.Inf(-1))
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// the queries are at positions 1 and 2
+	causal := ctx.fromFloats([]float32{0, 0, inf, 0, 0, 0}, 3, 2)
+	window := ctx.fromFloats([]float32{0, 0, inf, inf, 0, 0}, 3, 2)
+
+	scale := 1 / math.Sqrt(2)
+	cases := []struct {
+		name   string
+		config *AttentionConfig
+		mask   *testTensor
+		want   []float32
+	}{
+		{"default", &AttentionConfig{HeadDim: 2}, nil, referenceAttention(query, key, value, nil, scale, ml.AttentionOptions{})},
+		{"scale", &AttentionConfig{HeadDim: 2, Scale: 0.7}, nil, referenceAttention(query, key, value, nil, 0.7, ml.AttentionOptions{})},
+		{"causal", &AttentionConfig{HeadDim: 2, Causal: true}, nil, referenceAttention(query, key, value, causal, scale, ml.AttentionOptions{})},
+		{"window", &AttentionConfig{HeadDim: 2, Window: 1}, nil, referenceAttention(query, key, value, window, scale, ml.AttentionOptions{})},
+		{"softcap", &AttentionConfig{HeadDim: 2, Causal: true, Softcap: 1}, nil, referenceAttention(query, key, value, causal, scale, ml.AttentionOptions{Softcap: 1})},
+		// a mask replaces the causal mask of the config
+		{"mask", &AttentionConfig{HeadDim: 2, Causal: true}, window, referenceAttention(query, key, value, window, scale, ml.AttentionOptions{})},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var mask ml.Tensor
+			if tt.mask != nil {
+				mask = tt.mask
+			}
+
+			// the config is reused by each layer and by both implementations
+			for range 2 {
+				assertFloats(t, tt.want, tt.config.Attention(ctx, query, key, value, mask).Floats(), 1e-5)
+				assertFloats(t, tt.want, tt.config.Attention(ctx, &testSDPATensor{query}, key, value, mask).Floats(), 1e-5)
+			}
+		})
+	}
+
+	// options passed to Attention override those of the config
+	config := AttentionConfig{HeadDim: 2, Softcap: 1}
+	assertFloats(t, referenceAttention(query, key, value, nil, scale, ml.AttentionOptions{Softcap: 5}), config.Attention(ctx, query, key, value, nil, WithSoftcap(5)).Floats(), 1e-5)
+
+	for _, config := range []*AttentionConfig{
+		{},
+		{HeadDim: 2, Scale: math.NaN()},
+		{HeadDim: 2, Window: -1},
+		{HeadDim: 2, Softcap: -1},
+	} {
+		if _, err := config.AttentionErr(ctx, query, key, value, nil); err == nil {
+			t.Errorf("%+v: expected error", config)
+		}
+	}
+
+	config = AttentionConfig{HeadDim: 4}
+	_, err := config.AttentionErr(ctx, query, key, value, nil)
+
+	var e *ShapeMismatchError
+	if !errors.As(err, &e) || e.Dim != "d_k" || e.Operand != "query" || e.Got != 2 || e.Want != 4 {
+		t.Errorf("expected d_k mismatch, got %v", err)
+	}
+}
+
+func TestALiBiSlopes(t *testing.T) {
+	// slopes from the ALiBi paper are 2^(-8/n), 2^(-16/n), ... for n heads
+	assertFloats(t, []float32{1. / 2, 1. / 4, 1. / 8, 1. / 16, 1. / 32, 1. / 64, 1. / 128, 1. / 256}, ALiBiSlopes(8, 8), 1e-7)
+
+	// heads that are not a power of two interleave slopes from the next power of two
+	assertFloats(t, []float32{1. / 4, 1. / 16, 1. / 64, 1. / 256, 1. / 2, 1. / 8}, ALiBiSlopes(6, 8), 1e-7)
+}
+
+func TestAttentionALiBi(t *testing.T) {
+	ctx := &testContext{}
+	inf := float32(math.Inf(-1))
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// causal mask with queries at positions 1 and 2
+	causal := ctx.fromFloats([]float32{0, 0, inf, 0, 0, 0}, 3, 2)
+
+	// explicit per-head bias with slopes 1/16 and 1/256 for a max bias of 8
+	bias := ctx.fromFloats([]float32{
+		-1. / 16, 0, inf, -2. / 16, -1. / 16, 0,
+		-1. / 256, 0, inf, -2. / 256, -1. / 256, 0,
+	}, 3, 2, 2)
+	want := referenceAttention(query, key, value, bias, 1, ml.AttentionOptions{})
+
+	unfused := Attention(ctx, query, key, value, causal, 1, WithALiBi(8))
+	assertFloats(t, want, unfused.Floats(), 1e-5)
+
+	fused := Attention(ctx, &testSDPATensor{query}, key, value, causal, 1, WithALiBi(8))
+	assertFloats(t, want, fused.Floats(), 1e-5)
+
+	slopes := AttentionWithALiBi(ctx, &testSDPATensor{query}, key, value, causal, 1, []float64{1. / 16, 1. / 256})
+	assertFloats(t, want, slopes.Floats(), 1e-5)
+
+	// custom slopes without a mask attend bidirectionally
+	bias = ctx.fromFloats([]float32{
+		-0.5, 0, -0.5, -1, -0.5, 0,
+		-1.5, 0, -1.5, -3, -1.5, 0,
+	}, 3, 2, 2)
+	slopes = AttentionWithALiBi(ctx, query, key, value, nil, 1, []float64{0.5, 1.5})
+	assertFloats(t, referenceAttention(query, key, value, bias, 1, ml.AttentionOptions{}), slopes.Floats(), 1e-5)
+
+	for _, slopes := range [][]float64{{1}, {1, 0}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected invalid slopes %v to panic", slopes)
+				}
+			}()
+			AttentionWithALiBi(ctx, query, key, value, causal, 1, slopes)
+		}()
+	}
+
+	// a cache whose keys are at positions 4, 0 and 5, such as after a
+	// shift, with queries at positions 5 and 4
+	bias = ctx.fromFloats([]float32{
+		-1. / 16, -5. / 16, 0, 0, -4. / 16, -1. / 16,
+		-1. / 256, -5. / 256, 0, 0, -4. / 256, -1. / 256,
+	}, 3, 2, 2)
+	want = referenceAttention(query, key, value, bias, 1, ml.AttentionOptions{})
+
+	keyPositions, queryPositions := []int32{4, 0, 5}, []int32{5, 4}
+	for _, query := range []ml.Tensor{query, &testSDPATensor{query}} {
+		got := Attention(ctx, query, key, value, nil, 1, WithALiBi(8), WithALiBiPositions(keyPositions, queryPositions))
+		assertFloats(t, want, got.Floats(), 1e-5)
+	}
+
+	// AttentionWithPositions also masks the key after the second query
+	causal = ctx.fromFloats([]float32{0, 0, 0, 0, 0, inf}, 3, 2)
+	want = referenceAttention(query, key, value, bias.Add(ctx, causal).(*testTensor), 1, ml.AttentionOptions{})
+	got := AttentionWithPositions(ctx, query, key, value, nil, 1, keyPositions, queryPositions, 0, WithALiBi(8))
+	assertFloats(t, want, got.Floats(), 1e-5)
+
+	_, err := AttentionErr(ctx, query, key, value, nil, 1, WithALiBi(8), WithALiBiPositions(keyPositions[:2], queryPositions))
+	var sme *ShapeMismatchError
+	if !errors.As(err, &sme) || sme.Operand != "key positions" {
+		t.Errorf("have error %v; want a shape mismatch of the key positions", err)
+	}
+
+	// custom slopes must match the heads however they are passed
+	_, err = AttentionErr(ctx, query, key, value, nil, 1, func(o *attentionOptions) { o.slopes = []float32{1} })
+	if !errors.As(err, &sme) || sme.Operand != "slopes" || sme.Dim != "heads" {
+		t.Errorf("have error %v; want a shape mismatch of the slopes", err)
+	}
+}
+
+// referenceAttention computes attention directly from the tensor data without
+// composing tensor operations
+func referenceAttention(query, key, value, mask *testTensor, scale float64, opts ml.AttentionOptions) []float32 {
+	seqQ, heads := query.shape[1], query.shape[2]
+	seqK, dv, kvHeads := value.shape[0], value.shape[1], value.shape[2]
+
+	weights := referenceWeights(query, key, mask, scale, opts)
+
+	out := make([]float32, dv*heads*seqQ)
+	for h := range heads {
+		kvh := h / (heads / kvHeads)
+		for i := range seqQ {
+			for d := range dv {
+				var o float64
+				for j := range seqK {
+					o += float64(weights[j+i*seqK+h*seqK*seqQ]) * float64(value.at(j, d, kvh))
+				}
+				out[d+h*dv+i*dv*heads] = float32(o)
+			}
+		}
+	}
+
+	return out
+}
+
+// referenceWeights returns the post-softmax attention weights with shape
+// [seq_len_k, seq_len_q, heads]
+func referenceWeights(query, key, mask *testTensor, scale float64, opts ml.AttentionOptions) []float32 {
+	dk, seqQ, heads := query.shape[0], query.shape[1], query.shape[2]
+	seqK, kvHeads := key.shape[1], key.shape[2]
+
+	weights := make([]float32, seqK*seqQ*heads)
+	for h := range heads {
+		kvh := h / (heads / kvHeads)
+		for i := range seqQ {
+			scores := make([]float64, seqK)
+			for j := range seqK {
+				var s float64
+				for d := range dk {
+					s += float64(query.at(d, i, h)) * float64(key.at(d, j, kvh))
+				}
+				s *= scale
+				if opts.Softcap != 0 {
+					s = opts.Softcap * math.Tanh(s/opts.Softcap)
+				}
+				if mask != nil {
+					m := float64(mask.at(j, i, h%mask.Dim(2)))
+					if opts.MaxBias != 0 {
+						m *= float64(ALiBiSlopes(heads, opts.MaxBias)[h])
+					}
+					s += m
+				}
+				scores[j] = s
+			}
+
+			for j, p := range softmax(scores) {
+				weights[j+i*seqK+h*seqK*seqQ] = float32(p)
+			}
+		}
+	}
+
+	return weights
+}
+
+func softmax(s []float64) []float64 {
+	maxv := math.Inf(-1)
+	for _, v := range s {
+		maxv = max(maxv, v)
+	}
+
+	var sum float64
+	out := make([]float64, len(s))
+	for i, v := range s {
+		out[i] = math.Exp(v - maxv)
+		sum += out[i]
+	}
+
+	for i := range out {
+		out[i] /= sum
+	}
+
+	return out
+}
+
+// softmaxF16 is softmax rounding each operation to F16
+func softmaxF16(out, s []float32) {
+	f16 := func(v float32) float32 { return float16.Fromfloat32(v).Float32() }
+
+	maxv := float32(math.Inf(-1))
+	for _, v := range s {
+		maxv = max(maxv, v)
+	}
+
+	var sum float32
+	for i, v := range s {
+		out[i] = f16(float32(math.Exp(float64(f16(v - maxv)))))
+		sum = f16(sum + out[i])
+	}
+
+	for i := range out {
+		out[i] = f16(out[i] / sum)
+	}
+}
+
+// diff returns the largest absolute difference between the elements of a
+// and b. It is +Inf where only one of them is NaN or where one is infinite
+// and the other isn't the same infinity, which max would otherwise ignore.
+func diff(a, b []float32) float64 {
+	var d float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		switch {
+		case x == y, math.IsNaN(x) && math.IsNaN(y):
+			continue
+		case math.IsNaN(x), math.IsNaN(y):
+			return math.Inf(1)
+		}
+
+		d = max(d, math.Abs(x-y))
+	}
+	return d
+}
+
+func assertFloats(t *testing.T, want, got []float32, tolerance float64) {
+	t.Helper()
+
+	if len(want) != len(got) {
+		t.Fatalf("length mismatch: want %d, got %d", len(want), len(got))
+	}
+
+	if d := diff(want, got); d > tolerance {
+		t.Errorf("values differ by %v: want %v, got %v", d, want, got)
+	}
+}
+
+type testContext struct {
+	// flashAttention, if non-nil, enables flash attention for these head sizes
+	flashAttention []int
+
+	// fused counts the calls to ScaledDotProductAttention
+	fused int
+
+	// scaled counts the elements multiplied by Scale
+	scaled int
+
+	// workspace, if non-zero, is the memory reported by Workspace
+	workspace uint64
+}
+
+func (c *testContext) Workspace() uint64 {
+	return c.workspace
+}
+
+func (c *testContext) fromFloats(s []float32, shape ...int) *testTensor {
+	t, err := c.FromFloatSlice(s, shape...)
+	if err != nil {
+		panic(err)
+	}
+
+	return t.(*testTensor)
+}
+
+func (c *testContext) Zeros(dtype ml.DType, shape ...int) ml.Tensor {
+	n := 1
+	for _, s := range shape {
+		n *= s
+	}
+
+	return &testTensor{dtype: dtype, data: make([]float32, n), shape: shape}
+}
+
+func (c *testContext) FromFloatSlice(s []float32, shape ...int) (ml.Tensor, error) {
+	t := c.Zeros(ml.DTypeF32, shape...).(*testTensor)
+	if len(s) != len(t.data) {
+		return nil, fmt.Errorf("invalid shape %v for %d elements", shape, len(s))
+	}
+
+	copy(t.data, s)
+	return t, nil
+}
+
+func (c *testContext) FromIntSlice(s []int32, shape ...int) (ml.Tensor, error) {
+	f := make([]float32, len(s))
+	for i := range f {
+		f[i] = float32(s[i])
+	}
+
+	t, err := c.FromFloatSlice(f, shape...)
+	if err != nil {
+		return nil, err
+	}
+
+	t.(*testTensor).dtype = ml.DTypeI32
+	return t, nil
+}
+
+func (c *testContext) Forward(ml.Tensor) {}
+
+func (c *testContext) Compute(...ml.Tensor) {}
+
+func (c *testContext) MaxTensors() int { return 0 }
+
+func (c *testContext) FlashAttentionEnabled() bool { return c.flashAttention != nil }
+
+func (c *testContext) SupportsFlashAttention(headDim int) bool {
+	return slices.Contains(c.flashAttention, headDim)
+}
+
+func (c *testContext) Close() {}
+
+// testTensor is a contiguous float32 tensor that implements tensor operations
+// on the CPU following ggml semantics
+type testTensor struct {
+	dtype ml.DType
+	data  []float32
+	shape []int
+}
+
+// ne returns the size of all four dimensions
+func (t *testTensor) ne() [4]int {
+	ne := [4]int{1, 1, 1, 1}
+	copy(ne[:], t.shape)
+	return ne
+}
+
+func (t *testTensor) index(i ...int) int {
+	ne := t.ne()
+
+	var idx, stride int = 0, 1
+	for d := range 4 {
+		if d < len(i) {
+			idx += i[d] * stride
+		}
+		stride *= ne[d]
+	}
+
+	return idx
+}
+
+func (t *testTensor) at(i ...int) float32 {
+	return t.data[t.index(i...)]
+}
+
+func (t *testTensor) like(shape ...int) *testTensor {
+	return (&testContext{}).Zeros(t.dtype, shape...).(*testTensor)
+}
+
+// each calls fn with the coordinates of every element of t
+func (t *testTensor) each(fn func(i0, i1, i2, i3 int)) {
+	ne := t.ne()
+	for i3 := range ne[3] {
+		for i2 := range ne[2] {
+			for i1 := range ne[1] {
+				for i0 := range ne[0] {
+					fn(i0, i1, i2, i3)
+				}
+			}
+		}
+	}
+}
+
+func (t *testTensor) unary(fn func(float32) float32) *testTensor {
+	out := t.like(t.shape...)
+	for i, v := range t.data {
+		out.data[i] = fn(v)
+	}
+	return out
+}
+
+// binary applies fn elementwise, repeating t2 to match the shape of t
+func (t *testTensor) binary(t2 ml.Tensor, fn func(a, b float32) float32) *testTensor {
+	b := asTestTensor(t2)
+	bne := b.ne()
+
+	out := t.like(t.shape...)
+	t.each(func(i0, i1, i2, i3 int) {
+		out.data[t.index(i0, i1, i2, i3)] = fn(t.at(i0, i1, i2, i3), b.at(i0%bne[0], i1%bne[1], i2%bne[2], i3%bne[3]))
+	})
+	return out
+}
+
+func asTestTensor(t ml.Tensor) *testTensor {
+	if sdpa, ok := t.(*testSDPATensor); ok {
+		return sdpa.testTensor
+	}
+
+	return t.(*testTensor)
+}
+
+func (t *testTensor) Dim(n int) int { return t.ne()[n] }
+
+func (t *testTensor) Stride(n int) int {
+	stride := 4
+	for i := range n {
+		stride *= t.Dim(i)
+	}
+	return stride
+}
+
+func (t *testTensor) Shape() []int { return t.shape }
+
+func (t *testTensor) DType() ml.DType { return t.dtype }
+
+func (t *testTensor) Bytes() []byte { panic("not implemented") }
+
+func (t *testTensor) Floats() []float32 {
+	out := make([]float32, len(t.data))
+	copy(out, t.data)
+	return out
+}
+
+func (t *testTensor) Add(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
+	return t.binary(t2, func(a, b float32) float32 { return a + b })
+}
+
+func (t *testTensor) Mul(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
+	return t.binary(t2, func(a, b float32) float32 { return a * b })
+}
+
+// Mulmat computes t2 · tᵀ, broadcasting t over dimensions 2 and 3 of t2
+func (t *testTensor) Mulmat(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
+	b := asTestTensor(t2)
+	ane, bne := t.ne(), b.ne()
+	if ane[0] != bne[0] || bne[2]%ane[2] != 0 || bne[3]%ane[3] != 0 {
+		panic(fmt.Errorf("incompatible shapes for mulmat %v and %v", t.shape, b.shape))
+	}
+
+	// as in ggml, quantized tensors are multiplied by F32 tensors and their
+	// products are F32
+	out := t.like(ane[1], bne[1], bne[2], bne[3])
+	if quantized(t.dtype) {
+		if b.dtype != ml.DTypeF32 {
+			panic(fmt.Errorf("mulmat of %v by %v", t.dtype, b.dtype))
+		}
+
+		out.dtype = ml.DTypeF32
+	}
+
+	r2, r3 := bne[2]/ane[2], bne[3]/ane[3]
+	out.each(func(i0, i1, i2, i3 int) {
+		var sum float32
+		for k := range ane[0] {
+			sum += t.at(k, i0, i2/r2, i3/r3) * b.at(k, i1, i2, i3)
+		}
+		out.data[out.index(i0, i1, i2, i3)] = sum
+	})
+	return out
+}
+
+func (t *testTensor) MulmatFullPrec(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
+	return t.Mulmat(ctx, t2)
+}
+
+// Softmax computes tensors in F16 with F16 arithmetic and others in float64
+func (t *testTensor) Softmax(ctx ml.Context) ml.Tensor {
+	ne := t.ne()
+	out := t.like(t.shape...)
+	for row := 0; row < len(t.data); row += ne[0] {
+		if t.dtype == ml.DTypeF16 {
+			softmaxF16(out.data[row:row+ne[0]], t.data[row:row+ne[0]])
+			continue
+		}
+
+		s := make([]float64, ne[0])
+		for i := range s {
+			s[i] = float64(t.data[row+i])
+		}
+		for i, p := range softmax(s) {
+			out.data[row+i] = float32(p)
+		}
+	}
+	return out
+}
+
+func (t *testTensor) LayerNorm(ctx ml.Context, weight, bias ml.Tensor, eps float32) ml.Tensor {
+	ne := t.ne()
+	out := t.like(t.shape...)
+	for row := 0; row < len(t.data); row += ne[0] {
+		var mean float64
+		for _, v := range t.data[row : row+ne[0]] {
+			mean += float64(v)
+		}
+		mean /= float64(ne[0])
+
+		var variance float64
+		for _, v := range t.data[row : row+ne[0]] {
+			variance += (float64(v) - mean) * (float64(v) - mean)
+		}
+		variance /= float64(ne[0])
+
+		norm := 1 / math.Sqrt(variance+float64(eps))
+		for i, v := range t.data[row : row+ne[0]] {
+			out.data[row+i] = float32((float64(v) - mean) * norm)
+		}
+	}
+
+	var tt ml.Tensor = out
+	if weight != nil {
+		tt = tt.Mul(ctx, weight)
+	}
+
+	if bias != nil {
+		tt = tt.Add(ctx, bias)
+	}
+
+	return tt
+}
+
+func (t *testTensor) RMSNorm(ctx ml.Context, weight ml.Tensor, eps float32) ml.Tensor {
+	ne := t.ne()
+	out := t.like(t.shape...)
+	for row := 0; row < len(t.data); row += ne[0] {
+		var sum float64
+		for _, v := range t.data[row : row+ne[0]] {
+			sum += float64(v) * float64(v)
+		}
+
+		norm := 1 / math.Sqrt(sum/float64(ne[0])+float64(eps))
+		for i, v := range t.data[row : row+ne[0]] {
+			out.data[row+i] = float32(float64(v) * norm)
+		}
+	}
+
+	if weight != nil {
+		return out.Mul(ctx, weight)
+	}
+
+	return out
+}
+
+func (t *testTensor) Scale(ctx ml.Context, s float64) ml.Tensor {
+	if c, ok := ctx.(*testContext); ok {
+		c.scaled += len(t.data)
+	}
+
+	return t.unary(func(v float32) float32 { return float32(float64(v) * s) })
+}
+
+// Conv2D convolves weight with shape [width, height, in_channels, batch] by
+// the kernel t with shape [kernel_width, kernel_height, in_channels,
+// out_channels], as in ggml_conv_2d
+func (t *testTensor) Conv2D(ctx ml.Context, weight ml.Tensor, s0, s1, p0, p1, d0, d1 int) ml.Tensor {
+	in := asTestTensor(weight)
+	kne, ine := t.ne(), in.ne()
+
+	outW := (ine[0]+2*p0-d0*(kne[0]-1)-1)/s0 + 1
+	outH := (ine[1]+2*p1-d1*(kne[1]-1)-1)/s1 + 1
+
+	out := t.like(outW, outH, kne[3], ine[3])
+	out.each(func(x, y, oc, n int) {
+		var sum float32
+		for ic := range kne[2] {
+			for ky := range kne[1] {
+				for kx := range kne[0] {
+					ix, iy := x*s0+kx*d0-p0, y*s1+ky*d1-p1
+					if ix >= 0 && ix < ine[0] && iy >= 0 && iy < ine[1] {
+						sum += t.at(kx, ky, ic, oc) * in.at(ix, iy, ic, n)
+					}
+				}
+			}
+		}
+		out.data[out.index(x, y, oc, n)] = sum
+	})
+	return out
+}
+
+// RoPE rotates adjacent pairs of the first dim elements of each row of t, as
+// in ggml's normal RoPE mode. positionIDs has an entry for each element of
+// dimension 2 of t.
+func (t *testTensor) RoPE(ctx ml.Context, positionIDs, ropeFactors ml.Tensor, dim uint32, base, scale float32) ml.Tensor {
+	return t.RoPEScaled(ctx, positionIDs, ropeFactors, dim, base, ml.RoPEScaling{FreqScale: scale, AttnFactor: 1, BetaFast: 32, BetaSlow: 1})
+}
+
+// RoPEScaled is RoPE with the frequency factors and YaRN scaling of
+// ggml_rope_ext
+func (t *testTensor) RoPEScaled(ctx ml.Context, positionIDs, ropeFactors ml.Tensor, dim uint32, base float32, scaling ml.RoPEScaling) ml.Tensor {
+	positions := asTestTensor(positionIDs)
+
+	// the range of pairs between which YaRN mixes interpolated and
+	// extrapolated frequencies
+	corrDim := func(rotations float32) float64 {
+		return float64(dim) * math.Log(float64(scaling.OriginalContextLength)/(float64(rotations)*2*math.Pi)) / (2 * math.Log(float64(base)))
+	}
+	low := max(0, math.Floor(corrDim(scaling.BetaFast)))
+	high := min(float64(dim-1), math.Ceil(corrDim(scaling.BetaSlow)))
+
+	mscale := float64(scaling.AttnFactor)
+	if scaling.ExtFactor != 0 {
+		mscale *= 1 + 0.1*math.Log(1/float64(scaling.FreqScale))
+	}
+
+	out := t.like(t.shape...)
+	copy(out.data, t.data)
+	t.each(func(i0, i1, i2, i3 int) {
+		if i0%2 != 0 || i0 >= int(dim) {
+			return
+		}
+
+		extrap := float64(positions.data[i2]) * math.Pow(float64(base), -float64(i0)/float64(dim))
+		if ropeFactors != nil {
+			extrap /= float64(asTestTensor(ropeFactors).data[i0/2])
+		}
+
+		interp := extrap * float64(scaling.FreqScale)
+		ramp := (1 - min(1, max(0, (float64(i0/2)-low)/max(0.001, high-low)))) * float64(scaling.ExtFactor)
+		theta := interp*(1-ramp) + extrap*ramp
+
+		sin, cos := math.Sincos(theta)
+		sin, cos = sin*mscale, cos*mscale
+
+		x0, x1 := float64(t.at(i0, i1, i2, i3)), float64(t.at(i0+1, i1, i2, i3))
+		out.data[out.index(i0, i1, i2, i3)] = float32(x0*cos - x1*sin)
+		out.data[out.index(i0+1, i1, i2, i3)] = float32(x0*sin + x1*cos)
+	})
+	return out
+}
+
+func (t *testTensor) Clamp(ctx ml.Context, min, max float32) ml.Tensor {
+	return t.unary(func(v float32) float32 { return float32(math.Max(math.Min(float64(v), float64(max)), float64(min))) })
+}
+
+func (t *testTensor) Tanh(ctx ml.Context) ml.Tensor {
+	return t.unary(func(v float32) float32 { return float32(math.Tanh(float64(v))) })
+}
+
+// GELU is the tanh approximation of GELU, as in ggml
+func (t *testTensor) GELU(ctx ml.Context) ml.Tensor {
+	return t.unary(func(v float32) float32 {
+		x := float64(v)
+		return float32(0.5 * x * (1 + math.Tanh(math.Sqrt(2/math.Pi)*(x+0.044715*x*x*x))))
+	})
+}
+
+func (t *testTensor) RELU(ctx ml.Context) ml.Tensor {
+	return t.unary(func(v float32) float32 { return max(v, 0) })
+}
+
+func (t *testTensor) SILU(ctx ml.Context) ml.Tensor {
+	return t.unary(func(v float32) float32 { return float32(float64(v) / (1 + math.Exp(-float64(v)))) })
+}
+
+func (t *testTensor) Sigmoid(ctx ml.Context) ml.Tensor {
+	return t.unary(func(v float32) float32 { return float32(1 / (1 + math.Exp(-float64(v)))) })
+}
+
+func (t *testTensor) Reshape(ctx ml.Context, shape ...int) ml.Tensor {
+	out := t.like(shape...)
+	if len(out.data) != len(t.data) {
+		panic(fmt.Errorf("cannot reshape %v to %v", t.shape, shape))
+	}
+
+	copy(out.data, t.data)
+	return out
+}
+
+// View returns a contiguous copy of the elements selected by the view
+func (t *testTensor) View(ctx ml.Context, offset int, shape ...int) ml.Tensor {
+	dims := []int{shape[0]}
+	strides := []int{4}
+	for i := 1; i+1 < len(shape); i += 2 {
+		strides = append(strides, shape[i])
+		dims = append(dims, shape[i+1])
+	}
+
+	out := t.like(dims...)
+	out.each(func(i0, i1, i2, i3 int) {
+		pos := offset
+		for d, v := range []int{i0, i1, i2, i3}[:len(dims)] {
+			pos += v * strides[d]
+		}
+		out.data[out.index(i0, i1, i2, i3)] = t.data[pos/4]
+	})
+	return out
+}
+
+// Permute moves dimension i of t to dimension shape[i] of the result
+func (t *testTensor) Permute(ctx ml.Context, shape ...int) ml.Tensor {
+	ne := t.ne()
+
+	var outShape [4]int
+	for i, d := range shape {
+		outShape[d] = ne[i]
+	}
+
+	out := t.like(outShape[:]...)
+	t.each(func(i0, i1, i2, i3 int) {
+		var idx [4]int
+		for i, v := range []int{i0, i1, i2, i3} {
+			idx[shape[i]] = v
+		}
+		out.data[out.index(idx[:]...)] = t.at(i0, i1, i2, i3)
+	})
+	return out
+}
+
+func (t *testTensor) Contiguous(ctx ml.Context) ml.Tensor {
+	return t.unary(func(v float32) float32 { return v })
+}
+
+// IsContiguous is always true as every operation of the fake returns a copy
+func (t *testTensor) IsContiguous() bool {
+	return true
+}
+
+func (t *testTensor) Pad(ctx ml.Context, shape ...int) ml.Tensor {
+	panic("not implemented")
+}
+
+func (t *testTensor) Unpad(ctx ml.Context, shape ...int) ml.Tensor {
+	panic("not implemented")
+}
+
+func (t *testTensor) Stack(ctx ml.Context, dim int, s ...ml.Tensor) ml.Tensor {
+	if len(s) > 0 {
+		return t.Concat(ctx, s[0].Stack(ctx, dim, s[1:]...), dim)
+	}
+
+	return t
+}
+
+func (t *testTensor) Concat(ctx ml.Context, t2 ml.Tensor, dim int) ml.Tensor {
+	other := asTestTensor(t2)
+
+	ne := t.ne()
+	ne[dim] += other.Dim(dim)
+
+	out := t.like(ne[:]...)
+	out.each(func(i0, i1, i2, i3 int) {
+		idx := []int{i0, i1, i2, i3}
+		if idx[dim] < t.Dim(dim) {
+			out.data[out.index(idx...)] = t.at(idx...)
+		} else {
+			idx[dim] -= t.Dim(dim)
+			out.data[out.index(i0, i1, i2, i3)] = other.at(idx...)
+		}
+	})
+	return out
+}
+
+// Rows gathers the rows of t at ids. As in ggml, if ids has shape [m, b] and
+// t has shape [n, rows, b], column i of ids selects among the rows of matrix
+// i of t. Rows of quantized tensors are dequantized to F32.
+func (t *testTensor) Rows(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
+	ids := asTestTensor(t2)
+
+	n, rows, m := t.Dim(0), t.Dim(1), ids.Dim(0)
+
+	out := t.like(n, len(ids.data))
+	if len(t.shape) > 2 {
+		out = t.like(n, m, ids.Dim(1))
+	}
+
+	if quantized(t.dtype) {
+		out.dtype = ml.DTypeF32
+	}
+
+	for i, id := range ids.data {
+		src := int(id) * n
+		if len(t.shape) > 2 {
+			src += i / m * rows * n
+		}
+
+		copy(out.data[i*n:(i+1)*n], t.data[src:src+n])
+	}
+	return out
+}
+
+func (t *testTensor) TopK(ctx ml.Context, k int) (ml.Tensor, ml.Tensor) {
+	sorted := t.ArgSort(ctx, true).(*testTensor)
+
+	n := t.Dim(0)
+	shape := append([]int{k}, t.shape[1:]...)
+	values, indices := t.like(shape...), t.like(shape...)
+	indices.dtype = ml.DTypeI32
+	for row := range len(t.data) / n {
+		for i := range k {
+			idx := sorted.data[row*n+i]
+			indices.data[row*k+i] = idx
+			values.data[row*k+i] = t.data[row*n+int(idx)]
+		}
+	}
+	return values, indices
+}
+
+// ArgSort is the reference implementation of sorting, which keeps equal
+// elements in the order of their indices
+func (t *testTensor) ArgSort(ctx ml.Context, descending bool) ml.Tensor {
+	n := t.Dim(0)
+	out := t.like(t.shape...)
+	out.dtype = ml.DTypeI32
+	for row := range len(t.data) / n {
+		idx := make([]int, n)
+		for i := range idx {
+			idx[i] = i
+		}
+
+		values := t.data[row*n : (row+1)*n]
+		slices.SortStableFunc(idx, func(a, b int) int {
+			if descending {
+				return cmp.Compare(values[b], values[a])
+			}
+			return cmp.Compare(values[a], values[b])
+		})
+
+		for i, v := range idx {
+			out.data[row*n+i] = float32(v)
+		}
+	}
+	return out
+}
+
+// Copy converts the elements to the dtype of t2, rounding them for F16
+func (t *testTensor) Copy(ctx ml.Context, t2 ml.Tensor) ml.Tensor {
+	out := asTestTensor(t2)
+	copy(out.data, t.data)
+	if out.dtype == ml.DTypeF16 {
+		for i, v := range out.data {
+			out.data[i] = float16.Fromfloat32(v).Float32()
+		}
+	}
+	return out
+}
+
+// testSDPATensor is a query tensor that computes attention with a fused
+// implementation instead of composing tensor operations
+type testSDPATensor struct {
+	*testTensor
+}
+
+func (t *testSDPATensor) ScaledDotProductAttention(ctx ml.Context, key, value, mask ml.Tensor, scale float64, opts ml.AttentionOptions) ml.Tensor {
+	ctx.(*testContext).fused++
+
+	var m *testTensor
+	if mask != nil {
+		m = mask.(*testTensor)
+	}
+
+	return ctx.(*testContext).fromFloats(
+		referenceAttention(t.testTensor, key.(*testTensor), value.(*testTensor), m, scale, opts),
+		value.Dim(1), t.Dim(2), t.Dim(1),
+	)
+}
@@ -0,0 +1,179 @@
+package nn
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// Cache stores the keys and values of previous tokens for incremental
+// decoding, so that CachedAttention can attend to them without callers
+// managing the history themselves.
+type Cache interface {
+	// Put appends key with shape [d_k, kv_heads, batch] and value with shape
+	// [d_v, kv_heads, batch] for the tokens at positions, which has an entry
+	// for each token of the batch
+	Put(ctx ml.Context, key, value ml.Tensor, positions []int32)
+
+	// Get returns the cached keys with shape [d_k, seq_len_k, kv_heads] and
+	// values with shape [seq_len_k, d_v, kv_heads], as expected by Attention,
+	// and a causal mask with shape [seq_len_k, batch] for the queries of the
+	// batch of the last call to Put
+	Get(ctx ml.Context) (key, value, mask ml.Tensor)
+}
+
+// RingCache is a Cache of a single sequence that holds the keys and values of
+// up to capacity tokens. Once it is full, the oldest tokens are evicted, so
+// attention is limited to a sliding window of about capacity tokens.
+//
+// The tokens of a batch are stored before any of its queries attend to the
+// cache, so earlier queries of a batch that fills the cache may only see
+// capacity-batch+1 of the preceding tokens.
+type RingCache struct {
+	ctx      ml.Context
+	dtype    ml.DType
+	capacity int
+
+	// windowSize, if positive, limits each query to the keys at most
+	// windowSize positions before it
+	windowSize int
+
+	// keys has shape [d_k, kv_heads, capacity]. values is stored transposed,
+	// with shape [capacity, d_v, kv_heads], so that Get returns them as
+	// Attention expects without copying all of them for every batch.
+	keys, values ml.Tensor
+
+	// cells are the positions of the tokens stored in each cell, of which
+	// only the first len(cells) have been filled
+	cells []int32
+
+	// next is the cell where the next token is stored
+	next int
+
+	// queries are the positions of the last batch
+	queries []int32
+}
+
+// NewRingCache returns a RingCache that stores up to capacity tokens of type
+// dtype in memory allocated from backend. It must be closed to free the
+// memory.
+func NewRingCache(backend ml.Backend, dtype ml.DType, capacity int) *RingCache {
+	if capacity < 1 {
+		panic(fmt.Errorf("invalid cache capacity %v", capacity))
+	}
+
+	return &RingCache{
+		ctx:      backend.NewContext(),
+		dtype:    dtype,
+		capacity: capacity,
+		cells:    make([]int32, 0, capacity),
+	}
+}
+
+// NewSlidingWindowCache returns a RingCache for sliding window attention,
+// where each query attends to the windowSize keys before it in addition to
+// its own, as in kvcache.NewSWACache. Only the keys that are within the
+// window of a batch of up to batchSize tokens are kept, which bounds the
+// memory of the cache regardless of the length of the sequence.
+func NewSlidingWindowCache(backend ml.Backend, dtype ml.DType, windowSize, batchSize int) *RingCache {
+	if windowSize < 1 || batchSize < 1 {
+		panic(fmt.Errorf("invalid window size %v or batch size %v", windowSize, batchSize))
+	}
+
+	c := NewRingCache(backend, dtype, windowSize+batchSize)
+	c.windowSize = windowSize
+	return c
+}
+
+// Close frees the memory of the cache
+func (c *RingCache) Close() {
+	c.ctx.Close()
+}
+
+func (c *RingCache) Put(ctx ml.Context, key, value ml.Tensor, positions []int32) {
+	batchSize := key.Dim(2)
+	if batchSize != len(positions) || batchSize != value.Dim(2) {
+		panic(fmt.Errorf("inconsistent batch sizes (key: %v, value: %v, positions: %v)", batchSize, value.Dim(2), len(positions)))
+	}
+
+	if batchSize > c.capacity-c.windowSize {
+		panic(fmt.Errorf("batch size %v exceeds cache capacity %v", batchSize, c.capacity-c.windowSize))
+	}
+
+	if c.keys == nil || c.values == nil {
+		c.keys = c.ctx.Zeros(c.dtype, key.Dim(0), key.Dim(1), c.capacity)
+		c.values = c.ctx.Zeros(c.dtype, c.capacity, value.Dim(0), value.Dim(1))
+	}
+
+	// the batch is split in two where it wraps around the end of the cache
+	for i := 0; i < batchSize; {
+		n := min(batchSize-i, c.capacity-c.next)
+
+		src := key.View(ctx, key.Stride(2)*i, key.Dim(0), key.Stride(1), key.Dim(1), key.Stride(2), n)
+		dst := c.keys.View(ctx, c.keys.Stride(2)*c.next, c.keys.Dim(0), c.keys.Stride(1), c.keys.Dim(1), c.keys.Stride(2), n)
+		ctx.Forward(src.Copy(ctx, dst))
+
+		src = value.View(ctx, value.Stride(2)*i, value.Dim(0), value.Stride(1), value.Dim(1), value.Stride(2), n)
+		dst = c.values.View(ctx, c.values.Stride(0)*c.next, n, c.values.Stride(1), c.values.Dim(1), c.values.Stride(2), c.values.Dim(2))
+		ctx.Forward(src.Permute(ctx, 1, 2, 0, 3).Copy(ctx, dst))
+
+		for _, pos := range positions[i : i+n] {
+			if c.next < len(c.cells) {
+				c.cells[c.next] = pos
+			} else {
+				c.cells = append(c.cells, pos)
+			}
+			c.next++
+		}
+
+		c.next %= c.capacity
+		i += n
+	}
+
+	c.queries = slices.Clone(positions)
+}
+
+func (c *RingCache) Get(ctx ml.Context) (ml.Tensor, ml.Tensor, ml.Tensor) {
+	if c.keys == nil {
+		panic("get from empty cache")
+	}
+
+	n := len(c.cells)
+	key := c.keys.View(ctx, 0, c.keys.Dim(0), c.keys.Stride(1), c.keys.Dim(1), c.keys.Stride(2), n)
+	value := c.values.View(ctx, 0, n, c.values.Stride(1), c.values.Dim(1), c.values.Stride(2), c.values.Dim(2))
+
+	// cells may be in any order as each key is masked by its own position.
+	// keys that have moved out of the window of a query are masked until
+	// they are overwritten, the oldest first.
+	mask := make([]float32, n*len(c.queries))
+	for i, q := range c.queries {
+		for j, k := range c.cells {
+			if k > q || (c.windowSize > 0 && k < q-int32(c.windowSize)) {
+				mask[i*n+j] = float32(math.Inf(-1))
+			}
+		}
+	}
+
+	m, err := ctx.FromFloatSlice(mask, n, len(c.queries))
+	if err != nil {
+		panic(err)
+	}
+
+	return permute(ctx, key, 0, 2, 1, 3), value, m
+}
+
+// CachedAttention computes Attention for query, with shape [d_k, heads,
+// seq_len_q], over the keys and values of cache, including those of the
+// current batch, which must already have been stored with Put. The mask
+// comes from the cache, so each query only attends to keys at or before its
+// position.
+//
+// Returns:
+//
+//	Attention output with shape [d_v, heads, seq_len_q]
+func CachedAttention(ctx ml.Context, cache Cache, query ml.Tensor, scale float64, opts ...AttentionOption) ml.Tensor {
+	key, value, mask := cache.Get(ctx)
+	return Attention(ctx, permute(ctx, query, 0, 2, 1, 3), key, value, mask, scale, opts...)
+}
@@ -0,0 +1,170 @@
+package nn
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// attentionChecks, if set, adds checks to the graphs built by Attention
+var attentionChecks atomic.Pointer[AttentionChecks]
+
+// SetAttentionChecks adds the checks of c to every graph built by Attention
+// from now on, until it is called with nil. Checks are off by default as they
+// add operations to the graph and results that are copied to the host.
+func SetAttentionChecks(c *AttentionChecks) {
+	attentionChecks.Store(c)
+}
+
+// AttentionChecks checks the attention weights of graphs for NaN and Inf, to
+// find the first call of Attention where a model with bad weights or that
+// overflows produces them rather than discovering them in its output. The
+// fused implementation doesn't expose the weights, so its output is checked
+// instead.
+type AttentionChecks struct {
+	mu sync.Mutex
+
+	// calls is the number of calls of Attention in the graph
+	calls  int
+	checks []attentionCheck
+}
+
+// attentionCall identifies a call of Attention in an error
+type attentionCall struct {
+	checks     *AttentionChecks
+	index      int
+	query, key []int
+}
+
+type attentionCheck struct {
+	*attentionCall
+
+	// tensor is "weights" or "output"
+	tensor string
+
+	// offset is the first query of the block that the check covers
+	offset int
+
+	// sums are the sums of the rows of tensor, which are NaN or Inf if any
+	// of their elements are, with shape [1, seq_len_q, heads] for the
+	// weights and [1, heads, seq_len_q] for the output
+	sums ml.Tensor
+}
+
+// call identifies a new call of Attention for query and key
+func (c *AttentionChecks) call(query, key ml.Tensor) *attentionCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	call := &attentionCall{checks: c, index: c.calls, query: query.Shape(), key: key.Shape()}
+	c.calls++
+	return call
+}
+
+// check adds a check of the rows of t, the weights or output of the call,
+// along the first dimension by multiplying them with the vector ones
+func (call *attentionCall) check(ctx ml.Context, tensor string, t, ones ml.Tensor, offset int) {
+	sums := ones.Mulmat(ml.Name(ctx, "attn_check"), t)
+	ctx.Forward(sums)
+
+	c := call.checks
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, attentionCheck{attentionCall: call, tensor: tensor, offset: offset, sums: sums})
+}
+
+// Tensors returns the results of the checks of the graph built so far, which
+// must be passed to ml.Context.Compute along with the outputs of the graph. It
+// returns nil for a nil c.
+func (c *AttentionChecks) Tensors() []ml.Tensor {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tensors := make([]ml.Tensor, len(c.checks))
+	for i, check := range c.checks {
+		tensors[i] = check.sums
+	}
+
+	return tensors
+}
+
+// Err returns a *NonFiniteError for the first call of Attention in the
+// computed graph whose weights or output contain NaN or Inf, or nil if
+// there are none or c is nil. It then resets c to check the next graph.
+func (c *AttentionChecks) Err() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	checks := c.checks
+	c.checks, c.calls = nil, 0
+
+	var first *NonFiniteError
+	for _, check := range checks {
+		if first != nil && check.index >= first.Call {
+			continue
+		}
+
+		// the rows are of each query and head of the weights, or of each
+		// head and query of the output
+		rows := check.sums.Dim(1)
+		for i, v := range check.sums.Floats() {
+			if !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0) {
+				continue
+			}
+
+			query, head := i%rows, i/rows
+			if check.tensor == "output" {
+				query, head = head, query
+			}
+
+			first = &NonFiniteError{
+				Call:   check.index,
+				Query:  check.query,
+				Key:    check.key,
+				Tensor: check.tensor,
+				Row:    [2]int{check.offset + query, head},
+				Value:  v,
+			}
+			break
+		}
+	}
+
+	if first == nil {
+		return nil
+	}
+
+	return first
+}
+
+// NonFiniteError reports that the weights or output of a call of Attention
+// contain NaN or Inf
+type NonFiniteError struct {
+	// Call is the index of the call of Attention in the graph, which is
+	// usually that of the layer, and Query and Key are the shapes passed
+	Call       int
+	Query, Key []int
+
+	// Tensor is "weights" or "output"
+	Tensor string
+
+	// Row is the first query and head whose weights or output contain
+	// Value, which is NaN or ±Inf
+	Row   [2]int
+	Value float32
+}
+
+func (e *NonFiniteError) Error() string {
+	return fmt.Sprintf("attention %d (query %v, key %v) has %v in the %s of query %d head %d", e.Call, e.Query, e.Key, e.Value, e.Tensor, e.Row[0], e.Row[1])
+}
@@ -0,0 +1,93 @@
+package nn
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+)
+
+func TestAttentionChecks(t *testing.T) {
+	ctx := &testContext{}
+	inf := float32(math.Inf(-1))
+	nan := float32(math.NaN())
+
+	// d_k = 2, seq_len_q = 2, heads = 2
+	query := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, 2, -2}, 2, 2, 2)
+	// the second query of the second head overflows
+	overflow := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0.5, nan, -2}, 2, 2, 2)
+	// d_k = 2, seq_len_k = 3, kv_heads = 1
+	key := ctx.fromFloats([]float32{4, 1, -2, 3, 0.5, 5}, 2, 3, 1)
+	// seq_len_k = 3, d_v = 2, kv_heads = 1
+	value := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 1}, 3, 2, 1)
+	// the second query can't attend to any key, which isn't an error
+	masked := []float32{0, 0, inf, inf, inf, inf}
+	attends, err := UnmaskQueries(ctx, masked, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mask := ctx.fromFloats(masked, 3, 2)
+
+	checks := &AttentionChecks{}
+	SetAttentionChecks(checks)
+	defer SetAttentionChecks(nil)
+
+	for _, tt := range []struct {
+		name   string
+		query  *testTensor
+		fused  bool
+		with   []AttentionOption
+		tensor string
+	}{
+		{"weights", overflow, false, nil, "weights"},
+		{"blocks", overflow, false, []AttentionOption{WithBlockSize(1)}, "weights"},
+		{"output", overflow, true, nil, "output"},
+		{"finite", query, false, nil, ""},
+		{"finite fused", query, true, nil, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var q ml.Tensor = tt.query
+			if tt.fused {
+				q = &testSDPATensor{tt.query}
+			}
+
+			// the first layer is finite, so the error is of the second
+			Attention(ctx, query, key, value, mask, 0.5, WithMaskedQueries(attends))
+			Attention(ctx, q, key, value, nil, 0.5, tt.with...)
+
+			if n := len(checks.Tensors()); n < 2 {
+				t.Errorf("have %v checks; want at least 2", n)
+			}
+
+			err := checks.Err()
+			if tt.tensor == "" {
+				if err != nil {
+					t.Errorf("have %v; want nil", err)
+				}
+				return
+			}
+
+			var nfe *NonFiniteError
+			if !errors.As(err, &nfe) {
+				t.Fatalf("have %v; want NonFiniteError", err)
+			}
+
+			if nfe.Call != 1 || nfe.Tensor != tt.tensor || nfe.Row != [2]int{1, 1} || !math.IsNaN(float64(nfe.Value)) {
+				t.Errorf("have %v; want NaN in %v of query 1 head 1 of attention 1", err, tt.tensor)
+			}
+
+			// the checks are reset for the next graph
+			if err := checks.Err(); err != nil {
+				t.Errorf("have %v after reset; want nil", err)
+			}
+		})
+	}
+
+	SetAttentionChecks(nil)
+	Attention(ctx, overflow, key, value, nil, 0.5)
+	if n := len(checks.Tensors()); n != 0 {
+		t.Errorf("have %v checks while disabled; want 0", n)
+	}
+}
@@ -1,11 +1,177 @@
 package nn
 
-import "github.com/ollama/ollama/ml"
+import (
+	"fmt"
+	"math"
 
+	"github.com/ollama/ollama/ml"
+)
+
+// Conv2D is a 2D convolution, as used for the patch embeddings of vision
+// encoders
 type Conv2D struct {
+	// Weight has shape [kernel_width, kernel_height, in_channels, out_channels]
 	Weight ml.Tensor `gguf:"weight"`
+
+	// Bias, if non-nil, has shape [out_channels]
+	Bias ml.Tensor `gguf:"bias"`
 }
 
+// Forward convolves t with shape [width, height, in_channels, batch] with
+// stride (s0, s1), padding (p0, p1) and dilation (d0, d1) along the width and
+// height. The result has shape [out_width, out_height, out_channels, batch].
 func (m *Conv2D) Forward(ctx ml.Context, t ml.Tensor, s0, s1, p0, p1, d0, d1 int) ml.Tensor {
-	return m.Weight.Conv2D(ctx, t, s0, s1, p0, p1, d0, d1)
+	t = m.Weight.Conv2D(ctx, t, s0, s1, p0, p1, d0, d1)
+	if m.Bias != nil {
+		t = t.Add(ctx, m.Bias.Reshape(ctx, 1, 1, m.Bias.Dim(0)))
+	}
+
+	return t
+}
+
+// PatchEmbed embeds the non-overlapping square patches of pixelValues with
+// shape [width, height, channels, batch], where the kernel of m is the size of
+// a patch. The result has shape [out_channels, patches, batch] with the
+// patches in row-major order, as in CLIP and SigLIP.
+func (m *Conv2D) PatchEmbed(ctx ml.Context, pixelValues ml.Tensor, patchSize int) ml.Tensor {
+	t := m.Forward(ctx, pixelValues, patchSize, patchSize, 0, 0, 1, 1)
+	t = t.Reshape(ctx, t.Dim(0)*t.Dim(1), t.Dim(2), t.Dim(3))
+	return t.Permute(ctx, 1, 0, 2, 3).Contiguous(ctx)
+}
+
+// Conv1D is a 1D convolution, as used for the audio front ends of encoders
+// such as Whisper. Stride, Padding and Dilation configure the convolution
+// along the length, with zero stride and dilation meaning 1. Models set them
+// when allocating the module, such as &nn.Conv1D{Stride: 2, Padding: 1}.
+type Conv1D struct {
+	// Weight has shape [kernel_size, in_channels, out_channels]
+	Weight ml.Tensor `gguf:"weight"`
+
+	// Bias, if non-nil, has shape [out_channels]
+	Bias ml.Tensor `gguf:"bias"`
+
+	Stride, Padding, Dilation int
+}
+
+// Forward convolves t with shape [length, in_channels, batch], the transpose
+// of the (batch, in_channels, length) of PyTorch. The result has shape
+// [out_length, out_channels, batch], where out_length is
+// (length + 2*padding - dilation*(kernel_size-1) - 1)/stride + 1.
+//
+// The convolution is a Conv2D with a height of 1, so it uses the convolution
+// of the backend.
+func (m *Conv1D) Forward(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	kernelSize, inChannels, outChannels := m.Weight.Dim(0), m.Weight.Dim(1), m.Weight.Dim(2)
+	if t.Dim(1) != inChannels {
+		panic(&ShapeMismatchError{Op: "conv1d", Dim: "in_channels", Other: "weight", Want: inChannels, Operand: "input", Got: t.Dim(1)})
+	}
+
+	if m.Bias != nil && m.Bias.Dim(0) != outChannels {
+		panic(&ShapeMismatchError{Op: "conv1d", Dim: "out_channels", Other: "weight", Want: outChannels, Operand: "bias", Got: m.Bias.Dim(0)})
+	}
+
+	stride, dilation := max(m.Stride, 1), max(m.Dilation, 1)
+	if span := dilation*(kernelSize-1) + 1; t.Dim(0)+2*m.Padding < span {
+		panic(fmt.Errorf("conv1d input of length %v with padding %v is shorter than the kernel spanning %v", t.Dim(0), m.Padding, span))
+	}
+
+	batch := t.Dim(2)
+	t = t.Reshape(ctx, t.Dim(0), 1, inChannels, batch)
+	weight := m.Weight.Reshape(ctx, kernelSize, 1, inChannels, outChannels)
+
+	t = weight.Conv2D(ctx, t, stride, 1, m.Padding, 0, dilation, 1)
+	t = t.Reshape(ctx, t.Dim(0), outChannels, batch)
+	if m.Bias != nil {
+		t = t.Add(ctx, m.Bias.Reshape(ctx, 1, outChannels))
+	}
+
+	return t
+}
+
+// InterpolatePositionEmbedding resizes the learned position embeddings of a
+// vision encoder to a grid of height×width patches, for images of a
+// different resolution than in training. positions has shape [dim, prefix +
+// patches], where the first prefix embeddings, such as the class embedding of
+// CLIP, are kept as is and the others form a square grid in row-major order.
+//
+// The grid is resized by bicubic interpolation, matching
+// torch.nn.functional.interpolate with mode="bicubic" and
+// align_corners=False. The result has shape [dim, prefix + height*width].
+func InterpolatePositionEmbedding(ctx ml.Context, positions ml.Tensor, prefix, height, width int) (ml.Tensor, error) {
+	dim, numPatches := positions.Dim(0), positions.Dim(1)-prefix
+
+	grid := int(math.Sqrt(float64(numPatches)))
+	if numPatches <= 0 || grid*grid != numPatches {
+		return nil, fmt.Errorf("position embeddings of %v patches are not a square grid", numPatches)
+	}
+
+	if grid == height && grid == width {
+		return positions, nil
+	}
+
+	if positions.DType() != ml.DTypeF32 {
+		positions = positions.Copy(ctx, ctx.Zeros(ml.DTypeF32, positions.Shape()...))
+	}
+
+	// the interpolation is separable, so the width and then the height are
+	// resized by multiplying with the weights from each source row or column
+	wx, err := ctx.FromFloatSlice(bicubicWeights(grid, width), grid, width)
+	if err != nil {
+		return nil, err
+	}
+
+	wy, err := ctx.FromFloatSlice(bicubicWeights(grid, height), grid, height)
+	if err != nil {
+		return nil, err
+	}
+
+	t := positions.View(ctx, positions.Stride(1)*prefix, dim, positions.Stride(1), numPatches).Contiguous(ctx)
+	t = t.Reshape(ctx, dim, grid, grid).Permute(ctx, 1, 0, 2, 3).Contiguous(ctx)
+
+	// [width, dim, grid] -> [grid, dim, width]
+	t = wx.Mulmat(ctx, t).Permute(ctx, 2, 1, 0, 3).Contiguous(ctx)
+
+	// [height, dim, width] -> [dim, width, height]
+	t = wy.Mulmat(ctx, t).Permute(ctx, 2, 0, 1, 3).Contiguous(ctx)
+	t = t.Reshape(ctx, dim, width*height)
+
+	if prefix > 0 {
+		t = positions.View(ctx, 0, dim, positions.Stride(1), prefix).Contiguous(ctx).Concat(ctx, t, 1)
+	}
+
+	return t, nil
+}
+
+// bicubicWeights returns the weights of each of n source positions for m
+// destination positions, in row-major order with shape [n, m]. This follows
+// upsample_bicubic2d of PyTorch, which uses the cubic convolution kernel with
+// a = -0.75 and repeats the border.
+func bicubicWeights(n, m int) []float32 {
+	const a = -0.75
+
+	kernel := func(x float64) float64 {
+		x = math.Abs(x)
+		switch {
+		case x <= 1:
+			return ((a+2)*x-(a+3))*x*x + 1
+		case x < 2:
+			return ((a*x-5*a)*x+8*a)*x - 4*a
+		default:
+			return 0
+		}
+	}
+
+	scale := float64(n) / float64(m)
+
+	weights := make([]float32, n*m)
+	for i := range m {
+		src := scale*(float64(i)+0.5) - 0.5
+		j := math.Floor(src)
+		for k := -1; k <= 2; k++ {
+			idx := min(max(int(j)+k, 0), n-1)
+			weights[i*n+idx] += float32(kernel(src - j - float64(k)))
+		}
+	}
+
+	return weights
 }
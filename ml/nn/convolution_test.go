@@ -0,0 +1,258 @@
+package nn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConv2D(t *testing.T) {
+	ctx := &testContext{}
+
+	// input with shape [5, 4, 2, 1] and kernel with shape [3, 3, 2, 2]
+	input := make([]float32, 5*4*2)
+	for i := range input {
+		input[i] = float32(i%7 - 3)
+	}
+
+	kernel := make([]float32, 3*3*2*2)
+	for i := range kernel {
+		kernel[i] = float32(i%5 - 2)
+	}
+
+	m := Conv2D{
+		Weight: ctx.fromFloats(kernel, 3, 3, 2, 2),
+		Bias:   ctx.fromFloats([]float32{0.5, -1}, 2),
+	}
+
+	// reference outputs computed in Python following torch.nn.functional.conv2d
+	cases := []struct {
+		s0, s1, p0, p1, d0, d1 int
+		shape                  []int
+		want                   []float32
+	}{
+		{1, 1, 0, 0, 1, 1, []int{3, 2, 2, 1}, []float32{48.5, 3.5, -20.5, -1.5, 9.5, 48.5, -29, -28, -6, 18, -9, -29}},
+		{2, 2, 1, 1, 1, 1, []int{3, 2, 2, 1}, []float32{-2.5, -19.5, 12.5, -6.5, 9.5, 1.5, -15, 37, -8, 7, -9, -17}},
+		{1, 2, 1, 0, 2, 1, []int{3, 1, 2, 1}, []float32{18.5, 12.5, -6.5, -23, -24, -8}},
+	}
+
+	for _, tt := range cases {
+		out := m.Forward(ctx, ctx.fromFloats(input, 5, 4, 2, 1), tt.s0, tt.s1, tt.p0, tt.p1, tt.d0, tt.d1)
+		if shape := out.(*testTensor).ne(); shape != [4]int(tt.shape) {
+			t.Fatalf("unexpected shape %v, want %v", shape, tt.shape)
+		}
+
+		assertFloats(t, tt.want, out.Floats(), 1e-5)
+	}
+}
+
+func TestPatchEmbed(t *testing.T) {
+	ctx := &testContext{}
+
+	const size, patchSize, channels, hidden = 4, 2, 3, 2
+
+	pixels := make([]float32, size*size*channels)
+	for i := range pixels {
+		pixels[i] = float32(i % 11)
+	}
+
+	kernel := make([]float32, patchSize*patchSize*channels*hidden)
+	for i := range kernel {
+		kernel[i] = float32(i%3 - 1)
+	}
+
+	m := Conv2D{Weight: ctx.fromFloats(kernel, patchSize, patchSize, channels, hidden)}
+
+	out := m.PatchEmbed(ctx, ctx.fromFloats(pixels, size, size, channels, 1), patchSize)
+	if shape := out.(*testTensor).ne(); shape != [4]int{hidden, 4, 1, 1} {
+		t.Fatalf("unexpected shape %v", shape)
+	}
+
+	// each patch is the dot product of its pixels with the kernel of each
+	// output channel, with patches in row-major order
+	var want []float32
+	for py := range size / patchSize {
+		for px := range size / patchSize {
+			for h := range hidden {
+				var sum float32
+				for c := range channels {
+					for y := range patchSize {
+						for x := range patchSize {
+							sum += kernel[((h*channels+c)*patchSize+y)*patchSize+x] * pixels[(c*size+py*patchSize+y)*size+px*patchSize+x]
+						}
+					}
+				}
+				want = append(want, sum)
+			}
+		}
+	}
+
+	assertFloats(t, want, out.Floats(), 1e-5)
+}
+
+func TestInterpolatePositionEmbedding(t *testing.T) {
+	ctx := &testContext{}
+
+	// a class embedding followed by a 3×3 grid with dim 2
+	positions := ctx.fromFloats([]float32{
+		7, 8,
+		0.1, -0.9, 0.4, -1.6, 0.9, -2.1,
+		1.6, -2.4, 2.5, -2.5, 3.6, -2.4,
+		4.9, -2.1, 6.4, -1.6, 8.1, -0.9,
+	}, 2, 10)
+
+	// reference outputs computed in Python following upsample_bicubic2d of
+	// PyTorch, which torch.nn.functional.interpolate uses with mode="bicubic"
+	// and align_corners=False in interpolate_pos_encoding of CLIP in Hugging
+	// Face transformers
+	cases := []struct {
+		height, width int
+		want          []float32
+	}{
+		{2, 4, []float32{
+			7, 8,
+			0.294052, -1.208390, 0.521634, -1.582370, 1.005808, -2.038626, 1.397647, -2.248349,
+			4.105655, -2.248349, 4.916941, -2.038626, 6.313626, -1.582370, 7.289169, -1.208390,
+		}},
+		{5, 5, []float32{
+			7, 8,
+			-0.067270, -0.683270, 0.018198, -1.009802, 0.198400, -1.513600, 0.486602, -1.909398, 0.683270, -2.124730,
+			0.397398, -1.454602, 0.584714, -1.679286, 0.934000, -2.014000, 1.391286, -2.240714, 1.689802, -2.354198,
+			1.513600, -2.390400, 1.870000, -2.446000, 2.500000, -2.500000, 3.238000, -2.446000, 3.705600, -2.390400,
+			3.601802, -2.354198, 4.127286, -2.240714, 5.038000, -2.014000, 6.056714, -1.679286, 6.693398, -1.454602,
+			5.067270, -2.124730, 5.694602, -1.909398, 6.774400, -1.513600, 7.962198, -1.009802, 8.700730, -0.683270,
+		}},
+	}
+
+	for _, tt := range cases {
+		out, err := InterpolatePositionEmbedding(ctx, positions, 1, tt.height, tt.width)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if shape := out.(*testTensor).ne(); shape != [4]int{2, 1 + tt.height*tt.width, 1, 1} {
+			t.Fatalf("unexpected shape %v", shape)
+		}
+
+		assertFloats(t, tt.want, out.Floats(), 1e-5)
+	}
+
+	// the original grid size is unchanged
+	if out, err := InterpolatePositionEmbedding(ctx, positions, 1, 3, 3); err != nil {
+		t.Fatal(err)
+	} else if out != positions {
+		t.Error("expected positions to be returned as is")
+	}
+
+	// without a class embedding the patches don't form a square grid
+	if _, err := InterpolatePositionEmbedding(ctx, positions, 0, 4, 4); err == nil {
+		t.Error("expected error for non-square grid")
+	}
+}
+
+// conv1d computes the convolution of input with shape [length, in, batch] and
+// kernel with shape [size, in, out] directly, as torch.nn.functional.conv1d
+func conv1d(input []float32, length, in, batch int, kernel []float32, size, out, s, p, d int) []float32 {
+	outLength := (length+2*p-d*(size-1)-1)/s + 1
+
+	var result []float32
+	for b := range batch {
+		for o := range out {
+			for x := range outLength {
+				var sum float32
+				for c := range in {
+					for k := range size {
+						if i := x*s - p + k*d; i >= 0 && i < length {
+							sum += kernel[(o*in+c)*size+k] * input[(b*in+c)*length+i]
+						}
+					}
+				}
+				result = append(result, sum)
+			}
+		}
+	}
+
+	return result
+}
+
+func TestConv1D(t *testing.T) {
+	ctx := &testContext{}
+
+	const length, in, out, size, batch = 7, 3, 2, 3, 2
+
+	input := make([]float32, length*in*batch)
+	for i := range input {
+		input[i] = float32(i%5 - 2)
+	}
+
+	kernel := make([]float32, size*in*out)
+	for i := range kernel {
+		kernel[i] = float32(i%4 - 1)
+	}
+
+	for _, tt := range []struct {
+		stride, padding, dilation int
+		outLength                 int
+	}{
+		{0, 0, 0, 5},
+		{1, 1, 1, 7},
+		{2, 1, 1, 4},
+		{1, 2, 2, 7},
+		{3, 0, 2, 1},
+	} {
+		m := Conv1D{
+			Weight:   ctx.fromFloats(kernel, size, in, out),
+			Bias:     ctx.fromFloats([]float32{0.5, -1}, out),
+			Stride:   tt.stride,
+			Padding:  tt.padding,
+			Dilation: tt.dilation,
+		}
+
+		got := m.Forward(ctx, ctx.fromFloats(input, length, in, batch))
+		if shape := got.(*testTensor).ne(); shape != [4]int{tt.outLength, out, batch, 1} {
+			t.Fatalf("%+v: have shape %v; want [%v %v %v 1]", tt, shape, tt.outLength, out, batch)
+		}
+
+		want := conv1d(input, length, in, batch, kernel, size, out, max(tt.stride, 1), tt.padding, max(tt.dilation, 1))
+		for i := range want {
+			want[i] += []float32{0.5, -1}[i/tt.outLength%out]
+		}
+
+		assertFloats(t, want, got.Floats(), 1e-5)
+	}
+}
+
+func TestConv1DShapeMismatch(t *testing.T) {
+	ctx := &testContext{}
+
+	m := Conv1D{
+		Weight: ctx.fromFloats(make([]float32, 3*2*4), 3, 2, 4),
+		Bias:   ctx.fromFloats(make([]float32, 4), 4),
+	}
+
+	for _, tt := range []struct {
+		name  string
+		m     Conv1D
+		input []int
+		err   string
+	}{
+		{"in_channels", m, []int{5, 3, 1}, "in_channels in conv1d operation does not match between weight(2) and input(3)"},
+		{"out_channels", Conv1D{Weight: m.Weight, Bias: ctx.fromFloats(make([]float32, 2), 2)}, []int{5, 2, 1}, "out_channels in conv1d operation does not match between weight(4) and bias(2)"},
+		{"length", Conv1D{Weight: m.Weight, Dilation: 3}, []int{6, 2, 1}, "shorter than the kernel spanning 7"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				err, _ := recover().(error)
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("have panic %v; want %q", err, tt.err)
+				}
+			}()
+
+			n := 1
+			for _, d := range tt.input {
+				n *= d
+			}
+
+			tt.m.Forward(ctx, ctx.fromFloats(make([]float32, n), tt.input...))
+		})
+	}
+}
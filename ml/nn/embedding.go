@@ -1,11 +1,85 @@
 package nn
 
-import "github.com/ollama/ollama/ml"
+import (
+	"fmt"
+	"slices"
 
+	"github.com/ollama/ollama/ml"
+)
+
+// Embedding looks up the embeddings of tokens by their ids
 type Embedding struct {
+	// Weight has shape [d_model, vocab_size]
 	Weight ml.Tensor `gguf:"weight"`
+
+	// Padding gives the token PaddingIdx an embedding of zero regardless of
+	// its weight, as for padding_idx in PyTorch. Models set it before loading
+	// by allocating the module, such as &nn.Embedding{Padding: true,
+	// PaddingIdx: 1}.
+	Padding    bool
+	PaddingIdx int32
+}
+
+// Forward gathers the embeddings of ids with shape [seq_len]. The result has
+// shape [d_model, seq_len]. The ids aren't validated as they are only known
+// once the graph is computed; use ForwardIDs for ids that are on the host.
+func (m *Embedding) Forward(ctx ml.Context, ids ml.Tensor) ml.Tensor {
+	t := m.Weight.Rows(ctx, ids)
+	if !m.Padding {
+		return t
+	}
+
+	// the weights of the embeddings are 1 except for the padding token
+	keep := slices.Repeat([]float32{1}, m.Weight.Dim(1))
+	if m.PaddingIdx >= 0 && int(m.PaddingIdx) < len(keep) {
+		keep[m.PaddingIdx] = 0
+	}
+
+	weights, err := ctx.FromFloatSlice(keep, 1, len(keep))
+	if err != nil {
+		panic(err)
+	}
+
+	return t.Mul(ctx, weights.Rows(ctx, ids))
 }
 
-func (m *Embedding) Forward(ctx ml.Context, hiddenState ml.Tensor) ml.Tensor {
-	return m.Weight.Rows(ctx, hiddenState)
+// ForwardIDs is like Forward for ids on the host, which it checks are in
+// [0, vocab_size) before building the graph. Backends may otherwise read
+// past the end of the weight or fail while computing the graph.
+func (m *Embedding) ForwardIDs(ctx ml.Context, ids []int32) (ml.Tensor, error) {
+	vocabSize := m.Weight.Dim(1)
+	for i, id := range ids {
+		if id < 0 || int(id) >= vocabSize {
+			return nil, fmt.Errorf("token id %v at %v is out of range for a vocabulary of %v", id, i, vocabSize)
+		}
+	}
+
+	t, err := ctx.FromIntSlice(ids, len(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Forward(ctx, t), nil
+}
+
+// Linear returns a layer that projects hidden states to logits over the
+// vocabulary with the weight of m, for models that tie their embeddings with
+// their output. The layer reuses the tensor of m rather than copying it. It
+// isn't transposed either: a weight of shape [d_model, vocab_size] is already
+// that of a linear layer from d_model to vocab_size, which multiplies by its
+// transpose as part of Mulmat.
+func (m *Embedding) Linear() *Linear {
+	return &Linear{Weight: m.Weight}
+}
+
+// Logits projects hidden states with shape [d_model, ...] to logits with shape
+// [vocab_size, ...] with output or, if it is nil as for models whose output is
+// tied with their embeddings, with the weight of embedding. Models declare
+// both so that either kind of model uses the same call site.
+func Logits(ctx ml.Context, hiddenState ml.Tensor, output *Linear, embedding *Embedding) ml.Tensor {
+	if output == nil {
+		output = embedding.Linear()
+	}
+
+	return output.Forward(ctx, hiddenState)
 }
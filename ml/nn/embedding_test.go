@@ -0,0 +1,70 @@
+package nn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmbedding(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_model = 2, vocab_size = 3
+	weight := ctx.fromFloats([]float32{1, 2, 3, 4, 5, 6}, 2, 3)
+	ids, err := ctx.FromIntSlice([]int32{2, 0, 1, 2}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Embedding{Weight: weight}
+	got := m.Forward(ctx, ids)
+	if got.Dim(0) != 2 || got.Dim(1) != 4 {
+		t.Fatalf("have shape %v; want [2 4]", got.Shape())
+	}
+
+	assertFloats(t, []float32{5, 6, 1, 2, 3, 4, 5, 6}, got.Floats(), 0)
+
+	// the padding token has an embedding of zero, including the first
+	for idx, want := range map[int32][]float32{
+		2: {0, 0, 1, 2, 3, 4, 0, 0},
+		0: {5, 6, 0, 0, 3, 4, 5, 6},
+	} {
+		m := Embedding{Weight: weight, Padding: true, PaddingIdx: idx}
+		assertFloats(t, want, m.Forward(ctx, ids).Floats(), 0)
+	}
+
+	got, err = m.ForwardIDs(ctx, []int32{1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertFloats(t, []float32{3, 4, 3, 4}, got.Floats(), 0)
+
+	for _, ids := range [][]int32{{0, 3}, {-1}} {
+		if _, err := m.ForwardIDs(ctx, ids); err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%v: have error %v; want out of range", ids, err)
+		}
+	}
+}
+
+func TestLogits(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_model = 2, vocab_size = 3
+	embedding := &Embedding{Weight: ctx.fromFloats([]float32{1, 2, 3, 4, 5, 6}, 2, 3)}
+	hidden := ctx.fromFloats([]float32{1, 0, 0, 1}, 2, 2)
+
+	if m := embedding.Linear(); m.Weight != embedding.Weight {
+		t.Error("tied output doesn't share the weight of the embedding")
+	}
+
+	got := Logits(ctx, hidden, nil, embedding)
+	if got.Dim(0) != 3 || got.Dim(1) != 2 {
+		t.Fatalf("have shape %v; want [3 2]", got.Shape())
+	}
+
+	assertFloats(t, []float32{1, 3, 5, 2, 4, 6}, got.Floats(), 0)
+
+	// an untied output takes precedence over the embedding
+	output := &Linear{Weight: ctx.fromFloats([]float32{1, 1}, 2, 1)}
+	assertFloats(t, []float32{1, 1}, Logits(ctx, hidden, output, embedding).Floats(), 0)
+}
@@ -0,0 +1,81 @@
+package nn
+
+import (
+	"fmt"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// Activation is the activation function of the gate of a GLUFFN
+type Activation int
+
+const (
+	// ActivationSiLU gates with SiLU, as in SwiGLU
+	ActivationSiLU Activation = iota
+
+	// ActivationGELU gates with the tanh approximation of GELU, as in GeGLU
+	// and the gelu_pytorch_tanh activation of Gemma. Backends implement GELU
+	// with this approximation.
+	ActivationGELU
+
+	// ActivationReLUSquared gates with the square of ReLU
+	ActivationReLUSquared
+
+	// ActivationGELUExact gates with the exact GELU of GELUExact, for GeGLU
+	// models with a hidden_act of gelu
+	ActivationGELUExact
+)
+
+func (a Activation) forward(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	switch a {
+	case ActivationSiLU:
+		return SiLU(ctx, t)
+	case ActivationGELU:
+		return GELU(ctx, t)
+	case ActivationGELUExact:
+		return GELUExact(ctx, t)
+	case ActivationReLUSquared:
+		t = t.RELU(ctx)
+		return t.Mul(ctx, t)
+	default:
+		panic(fmt.Errorf("unsupported activation %v", int(a)))
+	}
+}
+
+// GLUFFN is a gated feed-forward network, which computes
+// Down(activation(Gate(x)) * Up(x)) as in most transformer models. With the
+// default ActivationSiLU, this is the SwiGLU MLP of LLaMA.
+//
+// Some models store the gate and up projections as a single tensor. If Gate
+// is nil, the output of Up has twice the feed-forward size, with the gate
+// projection first followed by the up projection.
+type GLUFFN struct {
+	Gate *Linear `gguf:"ffn_gate"`
+	Up   *Linear `gguf:"ffn_up"`
+	Down *Linear `gguf:"ffn_down"`
+
+	// Activation is the activation of the gate. Models set it before loading
+	// by allocating the module, such as MLP: &nn.GLUFFN{Activation:
+	// nn.ActivationGELU}.
+	Activation Activation
+}
+
+// Forward computes the network for hiddenState with shape [hidden, seq_len]
+func (m *GLUFFN) Forward(ctx ml.Context, hiddenState ml.Tensor) ml.Tensor {
+	gateCtx, upCtx := ml.Name(ctx, "ffn_gate"), ml.Name(ctx, "ffn_up")
+
+	var gate, up ml.Tensor
+	if m.Gate != nil {
+		gate = m.Gate.Forward(gateCtx, hiddenState)
+		up = m.Up.Forward(upCtx, hiddenState)
+	} else {
+		gateUp := m.Up.Forward(ml.Name(ctx, "ffn_gate_up"), hiddenState)
+
+		ffn, seqLen := gateUp.Dim(0)/2, gateUp.Dim(1)
+		gate = gateUp.View(gateCtx, 0, ffn, gateUp.Stride(1), seqLen).Contiguous(gateCtx)
+		up = gateUp.View(upCtx, gateUp.Stride(0)*ffn, ffn, gateUp.Stride(1), seqLen).Contiguous(upCtx)
+	}
+
+	actCtx := ml.Name(ctx, "ffn_act")
+	return m.Down.Forward(ml.Name(ctx, "ffn_down"), m.Activation.forward(actCtx, gate).Mul(actCtx, up))
+}
@@ -0,0 +1,74 @@
+package nn
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGLUFFN(t *testing.T) {
+	ctx := &testContext{}
+
+	const hidden, ffn, seqLen = 3, 2, 2
+
+	vals := func(seed, n int) []float32 {
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(float64(seed*100 + i)))
+		}
+		return s
+	}
+
+	gate, up, down, x := vals(1, hidden*ffn), vals(2, hidden*ffn), vals(3, ffn*hidden), vals(4, hidden*seqLen)
+
+	separate := &GLUFFN{
+		Gate: &Linear{Weight: ctx.fromFloats(gate, hidden, ffn)},
+		Up:   &Linear{Weight: ctx.fromFloats(up, hidden, ffn)},
+		Down: &Linear{Weight: ctx.fromFloats(down, ffn, hidden)},
+	}
+
+	// the gate and up projections concatenated along dimension 1
+	fused := &GLUFFN{
+		Up:   &Linear{Weight: ctx.fromFloats(append(append([]float32{}, gate...), up...), hidden, 2*ffn)},
+		Down: separate.Down,
+	}
+
+	activations := map[Activation]func(float64) float64{
+		ActivationSiLU: func(v float64) float64 { return v / (1 + math.Exp(-v)) },
+		ActivationGELU: func(v float64) float64 {
+			return 0.5 * v * (1 + math.Tanh(math.Sqrt(2/math.Pi)*(v+0.044715*v*v*v)))
+		},
+		ActivationReLUSquared: func(v float64) float64 { return max(v, 0) * max(v, 0) },
+		ActivationGELUExact:   func(v float64) float64 { return 0.5 * v * (1 + math.Erf(v/math.Sqrt2)) },
+	}
+
+	for activation, fn := range activations {
+		var want []float32
+		for token := range seqLen {
+			xt := x[token*hidden : (token+1)*hidden]
+
+			h := make([]float64, ffn)
+			for j := range h {
+				var g, u float64
+				for i, v := range xt {
+					g += float64(gate[j*hidden+i] * v)
+					u += float64(up[j*hidden+i] * v)
+				}
+				h[j] = fn(g) * u
+			}
+
+			for j := range hidden {
+				var sum float64
+				for i, v := range h {
+					sum += float64(down[j*ffn+i]) * v
+				}
+				want = append(want, float32(sum))
+			}
+		}
+
+		for _, m := range []*GLUFFN{separate, fused} {
+			m.Activation = activation
+			got := m.Forward(ctx, ctx.fromFloats(x, hidden, seqLen))
+			assertFloats(t, want, got.Floats(), 1e-5)
+		}
+	}
+}
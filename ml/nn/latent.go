@@ -0,0 +1,266 @@
+package nn
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// MultiHeadLatentAttention implements multi-head latent attention (MLA) as
+// used by DeepSeek V2 and V3. Keys and values are compressed into a low-rank
+// latent that is shared by all heads, and only the latent and the rotary part
+// of the keys are stored in the cache. Full keys and values are decompressed
+// from the cached latent in each forward pass.
+//
+// Queries are either projected directly by Query or through a low-rank
+// compression by QueryA, QueryANorm and QueryB.
+type MultiHeadLatentAttention struct {
+	Query      *Linear  `gguf:"attn_q"`
+	QueryA     *Linear  `gguf:"attn_q_a"`
+	QueryANorm *RMSNorm `gguf:"attn_q_a_norm"`
+	QueryB     *Linear  `gguf:"attn_q_b"`
+
+	// KVA compresses the hidden state into the latent, followed by the shared
+	// rotary part of the keys
+	KVA     *Linear  `gguf:"attn_kv_a_mqa"`
+	KVANorm *RMSNorm `gguf:"attn_kv_a_norm"`
+
+	// KVB decompresses the latent into the non-rotary part of the keys and the
+	// values for each head
+	KVB *Linear `gguf:"attn_kv_b"`
+
+	Output *Linear `gguf:"attn_output"`
+}
+
+// LatentCache stores the rotary part of the keys and the latent of previous
+// tokens for MultiHeadLatentAttention, as kvcache.Cache does
+type LatentCache interface {
+	Put(ctx ml.Context, key, value ml.Tensor)
+	Get(ctx ml.Context) (key, value, mask ml.Tensor)
+}
+
+// LatentAttentionOptions are the hyperparameters of MultiHeadLatentAttention
+type LatentAttentionOptions struct {
+	Heads int
+
+	// NopeDim and RopeDim are the sizes of the parts of each query and key
+	// head without and with rotary position embeddings. ValueDim is the size
+	// of each value head.
+	NopeDim, RopeDim, ValueDim int
+
+	Eps float32
+
+	RopeFactors         ml.Tensor
+	RopeBase, RopeScale float32
+
+	// Scale is the attention scale. Zero uses 1/√(NopeDim+RopeDim).
+	Scale float64
+}
+
+// Forward computes attention for hiddenState with shape [hidden, seq_len] at
+// positionIDs. Each layer stores keys of shape [RopeDim, 1, seq_len] and
+// values of shape [kv_lora_rank, 1, seq_len] in cache instead of full keys and
+// values, so it is typically a kvcache.Causal that shifts keys with RoPE using
+// the same parameters as opts.
+//
+// Attention is computed by LatentAttention from the cached latent, with the
+// rotary parts of the keys shared by all heads.
+func (m *MultiHeadLatentAttention) Forward(ctx ml.Context, hiddenState, positionIDs ml.Tensor, cache LatentCache, opts *LatentAttentionOptions) ml.Tensor {
+	seqLen := hiddenState.Dim(1)
+
+	var query ml.Tensor
+	if m.QueryA != nil {
+		query = m.QueryA.Forward(ctx, hiddenState)
+		query = m.QueryANorm.Forward(ctx, query, opts.Eps)
+		query = m.QueryB.Forward(ctx, query)
+	} else {
+		query = m.Query.Forward(ctx, hiddenState)
+	}
+
+	query = query.Reshape(ctx, opts.NopeDim+opts.RopeDim, opts.Heads, seqLen)
+
+	queryNope := query.View(ctx, 0,
+		opts.NopeDim, query.Stride(1),
+		opts.Heads, query.Stride(2),
+		seqLen,
+	)
+
+	queryRope := query.View(ctx, query.Stride(0)*opts.NopeDim,
+		opts.RopeDim, query.Stride(1),
+		opts.Heads, query.Stride(2),
+		seqLen,
+	).Contiguous(ctx)
+	queryRope = queryRope.RoPE(ctx, positionIDs, opts.RopeFactors, uint32(opts.RopeDim), opts.RopeBase, opts.RopeScale)
+	query = queryNope.Concat(ctx, queryRope, 0)
+
+	compressed := m.KVA.Forward(ctx, hiddenState)
+	kvLoraRank := compressed.Dim(0) - opts.RopeDim
+
+	latent := compressed.View(ctx, 0, kvLoraRank, compressed.Stride(1), seqLen).Contiguous(ctx)
+	latent = m.KVANorm.Forward(ctx, latent, opts.Eps)
+	latent = latent.Reshape(ctx, kvLoraRank, 1, seqLen)
+
+	keyRope := compressed.View(ctx, compressed.Stride(0)*kvLoraRank, opts.RopeDim, compressed.Stride(1), seqLen).Contiguous(ctx)
+	keyRope = keyRope.Reshape(ctx, opts.RopeDim, 1, seqLen)
+	keyRope = keyRope.RoPE(ctx, positionIDs, opts.RopeFactors, uint32(opts.RopeDim), opts.RopeBase, opts.RopeScale)
+
+	cache.Put(ctx, keyRope, latent)
+	keyRope, latent, mask := cache.Get(ctx)
+
+	historyLen := latent.Dim(2)
+	latent = latent.Reshape(ctx, kvLoraRank, historyLen)
+	keyRope = keyRope.Reshape(ctx, opts.RopeDim, historyLen)
+
+	kqv := LatentAttention(ctx, query, latent, keyRope, m.KVB, mask, opts)
+	kqv = kqv.Reshape(ctx, opts.ValueDim*opts.Heads, seqLen)
+
+	return m.Output.Forward(ctx, kqv)
+}
+
+// LatentAttention computes attention with keys and values that are
+// decompressed from a latent by the up-projection kvB, as in multi-head
+// latent attention. Only the number of heads, the sizes of the heads and the
+// scale of opts are used, as RoPE is applied by the caller.
+//
+// Parameters:
+//   - query: Query tensor with shape [NopeDim+RopeDim, heads, seq_len_q]. The
+//     first NopeDim channels of each head attend to the keys decompressed
+//     from latent and the last RopeDim channels, which should already have
+//     RoPE applied, to keyRope
+//   - latent: Compressed keys and values with shape [kv_lora_rank, seq_len_k]
+//   - keyRope: Rotary part of the keys with shape [RopeDim, seq_len_k], with
+//     RoPE applied, which is shared by all heads. It may be nil if RopeDim is 0
+//   - kvB: Up-projection of latent to [heads*(NopeDim+ValueDim), seq_len_k],
+//     with the non-rotary part of the keys of each head followed by its values
+//   - mask: Optional attention mask, as in Attention
+//
+// Returns:
+//
+//	Attention output with shape [ValueDim, heads, seq_len_q]
+//
+// A RopeDim of 0 uses no position embeddings for any channel, while a NopeDim
+// of 0 decompresses only the values. LatentAttention panics if the shapes of
+// the tensors are inconsistent. Use LatentAttentionErr to handle these cases
+// as errors.
+func LatentAttention(ctx ml.Context, query, latent, keyRope ml.Tensor, kvB *Linear, mask ml.Tensor, opts *LatentAttentionOptions) ml.Tensor {
+	kqv, err := LatentAttentionErr(ctx, query, latent, keyRope, kvB, mask, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return kqv
+}
+
+// LatentAttentionErr is like LatentAttention but returns an error if the
+// shapes of the tensors are inconsistent
+func LatentAttentionErr(ctx ml.Context, query, latent, keyRope ml.Tensor, kvB *Linear, mask ml.Tensor, opts *LatentAttentionOptions) (ml.Tensor, error) {
+	headDim := opts.NopeDim + opts.RopeDim
+	seqLenQ, seqLenK := query.Dim(2), latent.Dim(1)
+
+	if query.Dim(0) != headDim {
+		return nil, &ShapeMismatchError{Op: "latent attention", Dim: "d_k", Other: "options", Want: headDim, Operand: "query", Got: query.Dim(0)}
+	}
+
+	if query.Dim(1) != opts.Heads {
+		return nil, &ShapeMismatchError{Op: "latent attention", Dim: "heads", Other: "options", Want: opts.Heads, Operand: "query", Got: query.Dim(1)}
+	}
+
+	if kv := opts.Heads * (opts.NopeDim + opts.ValueDim); kvB.Weight.Dim(1) != kv {
+		return nil, &ShapeMismatchError{Op: "latent attention", Dim: "heads*(d_nope+d_v)", Other: "options", Want: kv, Operand: "kv_b", Got: kvB.Weight.Dim(1)}
+	}
+
+	if kvB.Weight.Dim(0) != latent.Dim(0) {
+		return nil, &ShapeMismatchError{Op: "latent attention", Dim: "kv_lora_rank", Other: "latent", Want: latent.Dim(0), Operand: "kv_b", Got: kvB.Weight.Dim(0)}
+	}
+
+	if opts.RopeDim > 0 {
+		if keyRope == nil {
+			return nil, fmt.Errorf("latent attention with rope_dim(%v) requires rotary keys", opts.RopeDim)
+		}
+
+		if keyRope.Dim(0) != opts.RopeDim {
+			return nil, &ShapeMismatchError{Op: "latent attention", Dim: "d_rope", Other: "options", Want: opts.RopeDim, Operand: "key", Got: keyRope.Dim(0)}
+		}
+
+		if keyRope.Dim(1) != seqLenK {
+			return nil, &ShapeMismatchError{Op: "latent attention", Dim: "seq_len_k", Other: "latent", Want: seqLenK, Operand: "key", Got: keyRope.Dim(1)}
+		}
+	}
+
+	if mask != nil && mask.Dim(0) != seqLenK {
+		return nil, &ShapeMismatchError{Op: "latent attention", Dim: "seq_len_k", Other: "latent", Want: seqLenK, Operand: "mask", Got: mask.Dim(0)}
+	}
+
+	if mask != nil && mask.Dim(1) != seqLenQ {
+		return nil, &ShapeMismatchError{Op: "latent attention", Dim: "seq_len_q", Other: "query", Want: seqLenQ, Operand: "mask", Got: mask.Dim(1)}
+	}
+
+	if mask != nil && mask.DType() == ml.DTypeI32 {
+		var err error
+		mask, err = additiveMask(ml.Name(ctx, "kq_mask"), mask)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the cached latent may be stored in reduced precision, which can't be
+	// multiplied with quantized weights
+	if latent.DType() != ml.DTypeF32 {
+		latent = latent.Copy(ctx, ctx.Zeros(ml.DTypeF32, latent.Dim(0), seqLenK))
+	} else {
+		latent = contiguous(ctx, latent)
+	}
+
+	kv := kvB.Forward(ctx, latent)
+	kv = kv.Reshape(ctx, opts.NopeDim+opts.ValueDim, opts.Heads, seqLenK)
+
+	value := kv.View(ctx, kv.Stride(0)*opts.NopeDim,
+		opts.ValueDim, kv.Stride(1),
+		opts.Heads, kv.Stride(2),
+		seqLenK,
+	)
+	value = value.Permute(ctx, 1, 2, 0, 3).Contiguous(ctx)
+
+	// the logits are the sum of those of the non-rotary and rotary parts of
+	// each head, which avoids repeating the shared rotary keys for each head
+	var kq ml.Tensor
+	if opts.NopeDim > 0 {
+		queryNope := query.View(ctx, 0,
+			opts.NopeDim, query.Stride(1),
+			opts.Heads, query.Stride(2),
+			seqLenQ,
+		).Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+
+		keyNope := kv.View(ctx, 0,
+			opts.NopeDim, kv.Stride(1),
+			opts.Heads, kv.Stride(2),
+			seqLenK,
+		).Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+
+		kq = keyNope.MulmatFullPrec(ctx, queryNope)
+	}
+
+	if opts.RopeDim > 0 {
+		queryRope := query.View(ctx, query.Stride(0)*opts.NopeDim,
+			opts.RopeDim, query.Stride(1),
+			opts.Heads, query.Stride(2),
+			seqLenQ,
+		).Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+
+		rope := contiguous(ctx, keyRope).Reshape(ctx, opts.RopeDim, seqLenK, 1).MulmatFullPrec(ctx, queryRope)
+		if kq != nil {
+			kq = kq.Add(ctx, rope)
+		} else {
+			kq = rope
+		}
+	}
+
+	scale := opts.Scale
+	if scale == 0 {
+		scale = 1 / math.Sqrt(float64(headDim))
+	}
+
+	var o attentionOptions
+	return o.attend(ctx, kq, value, mask, scale, nil, nil), nil
+}
@@ -0,0 +1,259 @@
+package nn
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// testCache stores the most recent keys and values and returns them with a
+// fixed mask
+type testCache struct {
+	key, value, mask ml.Tensor
+}
+
+func (c *testCache) SetLayer(int) {}
+
+func (c *testCache) Get(ml.Context) (ml.Tensor, ml.Tensor, ml.Tensor) {
+	return c.key, c.value, c.mask
+}
+
+func (c *testCache) Put(_ ml.Context, key, value ml.Tensor) {
+	c.key, c.value = key, value
+}
+
+func (c *testCache) Init(ml.Backend, ml.DType, int, int32, int) {}
+
+func (c *testCache) Close() {}
+
+func (c *testCache) StartForward(ml.Context, []int32, []int) error { return nil }
+
+func (c *testCache) CopyPrefix(int, int, int32) {}
+
+func (c *testCache) Remove(int, int32, int32) error { return nil }
+
+func (c *testCache) CanResume(int, int32) bool { return true }
+
+func TestMultiHeadLatentAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	const (
+		hidden, heads, seqLen              = 4, 2, 3
+		nopeDim, ropeDim, valueDim         = 2, 2, 3
+		kvLoraRank, headDim                = 3, nopeDim + ropeDim
+		ropeBase, ropeScale        float32 = 10000, 1
+	)
+
+	weight := func(seed float64, shape ...int) *testTensor {
+		n := 1
+		for _, s := range shape {
+			n *= s
+		}
+
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(seed + float64(i)))
+		}
+		return ctx.fromFloats(s, shape...)
+	}
+
+	ones := func(n int) *testTensor {
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = 1
+		}
+		return ctx.fromFloats(s, n)
+	}
+
+	opts := &LatentAttentionOptions{
+		Heads:    heads,
+		NopeDim:  nopeDim,
+		RopeDim:  ropeDim,
+		ValueDim: valueDim,
+		Eps:      1e-6,
+		RopeBase: ropeBase, RopeScale: ropeScale,
+	}
+
+	inf := float32(math.Inf(-1))
+	mask := ctx.fromFloats([]float32{0, inf, inf, 0, 0, inf, 0, 0, 0}, seqLen, seqLen)
+	positions := ctx.fromFloats([]float32{0, 1, 2}, seqLen)
+	hiddenState := weight(7, hidden, seqLen)
+
+	for _, lowRankQuery := range []bool{false, true} {
+		m := &MultiHeadLatentAttention{
+			KVA:     &Linear{Weight: weight(2, hidden, kvLoraRank+ropeDim)},
+			KVANorm: &RMSNorm{Weight: ones(kvLoraRank)},
+			KVB:     &Linear{Weight: weight(3, kvLoraRank, heads*(nopeDim+valueDim))},
+			Output:  &Linear{Weight: weight(4, heads*valueDim, hidden)},
+		}
+
+		if lowRankQuery {
+			m.QueryA = &Linear{Weight: weight(5, hidden, 3)}
+			m.QueryANorm = &RMSNorm{Weight: ones(3)}
+			m.QueryB = &Linear{Weight: weight(6, 3, heads*headDim)}
+		} else {
+			m.Query = &Linear{Weight: weight(1, hidden, heads*headDim)}
+		}
+
+		cache := &testCache{mask: mask}
+		got := m.Forward(ctx, hiddenState, positions, cache, opts)
+
+		if shape := cache.key.Shape(); shape[0] != ropeDim || shape[1] != 1 || shape[2] != seqLen {
+			t.Errorf("unexpected cached key shape %v", shape)
+		}
+
+		if shape := cache.value.Shape(); shape[0] != kvLoraRank || shape[1] != 1 || shape[2] != seqLen {
+			t.Errorf("unexpected cached value shape %v", shape)
+		}
+
+		// full queries, keys and values
+		var q ml.Tensor
+		if lowRankQuery {
+			q = m.QueryB.Forward(ctx, m.QueryANorm.Forward(ctx, m.QueryA.Forward(ctx, hiddenState), opts.Eps))
+		} else {
+			q = m.Query.Forward(ctx, hiddenState)
+		}
+		q = q.Reshape(ctx, headDim, heads, seqLen)
+
+		qNope := q.View(ctx, 0, nopeDim, q.Stride(1), heads, q.Stride(2), seqLen)
+		qRope := q.View(ctx, q.Stride(0)*nopeDim, ropeDim, q.Stride(1), heads, q.Stride(2), seqLen)
+		q = qNope.Concat(ctx, qRope.RoPE(ctx, positions, nil, ropeDim, ropeBase, ropeScale), 0)
+
+		compressed := m.KVA.Forward(ctx, hiddenState)
+		latent := m.KVANorm.Forward(ctx, compressed.View(ctx, 0, kvLoraRank, compressed.Stride(1), seqLen), opts.Eps)
+		kRope := compressed.View(ctx, compressed.Stride(0)*kvLoraRank, ropeDim, compressed.Stride(1), seqLen).Reshape(ctx, ropeDim, 1, seqLen)
+		kRope = kRope.RoPE(ctx, positions, nil, ropeDim, ropeBase, ropeScale)
+
+		kv := m.KVB.Forward(ctx, latent).Reshape(ctx, nopeDim+valueDim, heads, seqLen)
+		kNope := kv.View(ctx, 0, nopeDim, kv.Stride(1), heads, kv.Stride(2), seqLen)
+		v := kv.View(ctx, kv.Stride(0)*nopeDim, valueDim, kv.Stride(1), heads, kv.Stride(2), seqLen)
+		k := kNope.Concat(ctx, kRope.Concat(ctx, kRope, 1), 0)
+
+		q = q.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+		k = k.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+		v = v.Permute(ctx, 1, 2, 0, 3).Contiguous(ctx)
+
+		kqv := Attention(ctx, q, k, v, mask, 1/math.Sqrt(headDim))
+		want := m.Output.Forward(ctx, kqv.Reshape(ctx, valueDim*heads, seqLen))
+
+		assertFloats(t, want.Floats(), got.Floats(), 1e-5)
+	}
+}
+
+func TestLatentAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	const heads, seqLen, valueDim, kvLoraRank = 2, 3, 3, 3
+
+	weight := func(seed float64, shape ...int) *testTensor {
+		n := 1
+		for _, s := range shape {
+			n *= s
+		}
+
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(seed + float64(i)))
+		}
+		return ctx.fromFloats(s, shape...)
+	}
+
+	inf := float32(math.Inf(-1))
+	mask := ctx.fromFloats([]float32{0, inf, inf, 0, 0, inf, 0, 0, 0}, seqLen, seqLen)
+	boolean, err := ctx.FromIntSlice([]int32{1, 0, 0, 1, 1, 0, 1, 1, 1}, seqLen, seqLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name             string
+		nopeDim, ropeDim int
+	}{
+		{"split", 2, 2},
+		{"rope", 0, 4},
+		{"nope", 4, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			headDim := tt.nopeDim + tt.ropeDim
+			opts := &LatentAttentionOptions{Heads: heads, NopeDim: tt.nopeDim, RopeDim: tt.ropeDim, ValueDim: valueDim}
+
+			query := weight(1, headDim, heads, seqLen)
+			latent := weight(2, kvLoraRank, seqLen)
+			kvB := &Linear{Weight: weight(3, kvLoraRank, heads*(tt.nopeDim+valueDim))}
+
+			var keyRope ml.Tensor
+			if tt.ropeDim > 0 {
+				keyRope = weight(4, tt.ropeDim, seqLen)
+			}
+
+			// the keys of each head are the decompressed and rotary parts
+			kv := kvB.Forward(ctx, latent).Reshape(ctx, tt.nopeDim+valueDim, heads, seqLen)
+			v := kv.View(ctx, kv.Stride(0)*tt.nopeDim, valueDim, kv.Stride(1), heads, kv.Stride(2), seqLen)
+
+			var k ml.Tensor
+			if tt.nopeDim > 0 {
+				k = kv.View(ctx, 0, tt.nopeDim, kv.Stride(1), heads, kv.Stride(2), seqLen)
+			}
+
+			if tt.ropeDim > 0 {
+				kRope := keyRope.Reshape(ctx, tt.ropeDim, 1, seqLen)
+				kRope = kRope.Concat(ctx, kRope, 1)
+				if k != nil {
+					k = k.Concat(ctx, kRope, 0)
+				} else {
+					k = kRope
+				}
+			}
+
+			q := query.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+			k = k.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+			v = v.Permute(ctx, 1, 2, 0, 3).Contiguous(ctx)
+			want := Attention(ctx, q, k, v, mask, 1/math.Sqrt(float64(headDim)))
+
+			for _, m := range []ml.Tensor{mask, boolean} {
+				got := LatentAttention(ctx, query, latent, keyRope, kvB, m, opts)
+				if shape := got.(*testTensor).ne(); shape != [4]int{valueDim, heads, seqLen, 1} {
+					t.Fatalf("have shape %v; want [%v %v %v 1]", shape, valueDim, heads, seqLen)
+				}
+
+				assertFloats(t, want.Floats(), got.Floats(), 1e-5)
+			}
+		})
+	}
+}
+
+func TestLatentAttentionShapes(t *testing.T) {
+	ctx := &testContext{}
+
+	zeros := func(shape ...int) ml.Tensor {
+		return ctx.Zeros(ml.DTypeF32, shape...)
+	}
+
+	opts := &LatentAttentionOptions{Heads: 2, NopeDim: 2, RopeDim: 2, ValueDim: 3}
+	kvB := &Linear{Weight: zeros(3, 2*(2+3))}
+
+	for _, tt := range []struct {
+		name                string
+		query, latent, rope ml.Tensor
+		kvB                 *Linear
+		mask                ml.Tensor
+		err                 string
+	}{
+		{"d_k", zeros(3, 2, 4), zeros(3, 5), zeros(2, 5), kvB, nil, "d_k in latent attention operation does not match between options(4) and query(3)"},
+		{"heads", zeros(4, 3, 4), zeros(3, 5), zeros(2, 5), kvB, nil, "heads in latent attention operation does not match between options(2) and query(3)"},
+		{"kv_b", zeros(4, 2, 4), zeros(3, 5), zeros(2, 5), &Linear{Weight: zeros(3, 8)}, nil, "heads*(d_nope+d_v) in latent attention operation does not match between options(10) and kv_b(8)"},
+		{"kv_lora_rank", zeros(4, 2, 4), zeros(4, 5), zeros(2, 5), kvB, nil, "kv_lora_rank in latent attention operation does not match between latent(4) and kv_b(3)"},
+		{"rope", zeros(4, 2, 4), zeros(3, 5), nil, kvB, nil, "latent attention with rope_dim(2) requires rotary keys"},
+		{"d_rope", zeros(4, 2, 4), zeros(3, 5), zeros(3, 5), kvB, nil, "d_rope in latent attention operation does not match between options(2) and key(3)"},
+		{"seq_len_k", zeros(4, 2, 4), zeros(3, 5), zeros(2, 4), kvB, nil, "seq_len_k in latent attention operation does not match between latent(5) and key(4)"},
+		{"mask", zeros(4, 2, 4), zeros(3, 5), zeros(2, 5), kvB, zeros(5, 3), "seq_len_q in latent attention operation does not match between query(4) and mask(3)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LatentAttentionErr(ctx, tt.query, tt.latent, tt.rope, tt.kvB, tt.mask, opts)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("have error %v; want %q", err, tt.err)
+			}
+		})
+	}
+}
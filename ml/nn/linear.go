@@ -2,16 +2,46 @@ package nn
 
 import "github.com/ollama/ollama/ml"
 
+// Linear is a fully connected layer which computes x·Wᵀ + b. The weight may
+// be quantized, in which case the backend dequantizes it as part of the
+// multiplication.
 type Linear struct {
+	// Weight has shape [in_features, out_features]
 	Weight ml.Tensor `gguf:"weight"`
-	Bias   ml.Tensor `gguf:"bias"`
+
+	// Bias, if non-nil, has shape [out_features]
+	Bias ml.Tensor `gguf:"bias"`
 }
 
+// Forward computes the layer for t with shape [in_features, ...]. The result
+// has shape [out_features, ...].
 func (m *Linear) Forward(ctx ml.Context, t ml.Tensor) ml.Tensor {
-	t = m.Weight.Mulmat(ctx, t)
+	m.checkShape(t)
+	return m.addBias(ctx, m.Weight.Mulmat(ctx, t))
+}
+
+// ForwardFullPrec is like Forward but accumulates in full precision, as
+// Attention does for K·Q, for layers whose outputs overflow half precision
+func (m *Linear) ForwardFullPrec(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	m.checkShape(t)
+	return m.addBias(ctx, m.Weight.MulmatFullPrec(ctx, t))
+}
+
+func (m *Linear) addBias(ctx ml.Context, t ml.Tensor) ml.Tensor {
 	if m.Bias != nil {
 		t = t.Add(ctx, m.Bias)
 	}
 
 	return t
 }
+
+// checkShape panics if t or the bias don't match the shape of the weight
+func (m *Linear) checkShape(t ml.Tensor) {
+	if t.Dim(0) != m.Weight.Dim(0) {
+		panic(&ShapeMismatchError{Op: "linear", Dim: "in_features", Other: "weight", Want: m.Weight.Dim(0), Operand: "input", Got: t.Dim(0)})
+	}
+
+	if m.Bias != nil && m.Bias.Dim(0) != m.Weight.Dim(1) {
+		panic(&ShapeMismatchError{Op: "linear", Dim: "out_features", Other: "weight", Want: m.Weight.Dim(1), Operand: "bias", Got: m.Bias.Dim(0)})
+	}
+}
@@ -0,0 +1,54 @@
+package nn
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLinear(t *testing.T) {
+	ctx := &testContext{}
+
+	// weight with 3 inputs and 2 outputs, applied to 2 tokens
+	weight := ctx.fromFloats([]float32{1, 0, -1, 2, 0.5, 1}, 3, 2)
+	x := ctx.fromFloats([]float32{1, 2, 3, -1, 0, 4}, 3, 2)
+
+	want := []float32{-2, 6, -5, 2}
+
+	m := Linear{Weight: weight}
+	assertFloats(t, want, m.Forward(ctx, x).Floats(), 1e-6)
+	assertFloats(t, want, m.ForwardFullPrec(ctx, x).Floats(), 1e-6)
+
+	m.Bias = ctx.fromFloats([]float32{0.5, -1}, 2)
+	assertFloats(t, []float32{-1.5, 5, -4.5, 1}, m.Forward(ctx, x).Floats(), 1e-6)
+	assertFloats(t, []float32{-1.5, 5, -4.5, 1}, m.ForwardFullPrec(ctx, x).Floats(), 1e-6)
+}
+
+func TestLinearShapeMismatch(t *testing.T) {
+	ctx := &testContext{}
+
+	weight := ctx.fromFloats(make([]float32, 6), 3, 2)
+
+	for name, tt := range map[string]struct {
+		m         Linear
+		x         *testTensor
+		got, want int
+	}{
+		"input": {Linear{Weight: weight}, ctx.fromFloats(make([]float32, 8), 4, 2), 4, 3},
+		"bias":  {Linear{Weight: weight, Bias: ctx.fromFloats(make([]float32, 3), 3)}, ctx.fromFloats(make([]float32, 6), 3, 2), 3, 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				var err *ShapeMismatchError
+				if r, ok := recover().(error); !ok || !errors.As(r, &err) {
+					t.Fatalf("expected a shape mismatch, got %v", r)
+				}
+
+				if err.Operand != name || err.Got != tt.got || err.Want != tt.want {
+					t.Errorf("unexpected error %v", err)
+				}
+			}()
+
+			tt.m.Forward(ctx, tt.x)
+		})
+	}
+}
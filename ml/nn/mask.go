@@ -0,0 +1,280 @@
+package nn
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// windowMask builds an additive mask of shape [seq_len_k, seq_len_q] that
+// prevents each query from attending to keys more than window positions
+// before it, except for the first sinks keys. Queries are assumed to
+// correspond to the last seq_len_q keys.
+func windowMask(ctx ml.Context, seqLenQ, seqLenK, window, sinks int) (ml.Tensor, error) {
+	offset := seqLenK - seqLenQ
+
+	mask := make([]float32, seqLenK*seqLenQ)
+	for i := range seqLenQ {
+		for j := sinks; j < seqLenK; j++ {
+			if j < i+offset-window {
+				mask[i*seqLenK+j] = float32(math.Inf(-1))
+			}
+		}
+	}
+
+	return ctx.FromFloatSlice(mask, seqLenK, seqLenQ)
+}
+
+// distanceMask builds a mask of shape [seq_len_k, seq_len_q] holding the
+// negated distance between the position of each query and key, where
+// keyPositions and queryPositions hold the absolute position of each key and
+// query as in PositionMask
+func distanceMask(ctx ml.Context, keyPositions, queryPositions []int32) (ml.Tensor, error) {
+	seqLenK, seqLenQ := len(keyPositions), len(queryPositions)
+
+	mask := make([]float32, seqLenK*seqLenQ)
+	for i, q := range queryPositions {
+		for j, k := range keyPositions {
+			mask[i*seqLenK+j] = -float32(max(q-k, k-q))
+		}
+	}
+
+	return ctx.FromFloatSlice(mask, seqLenK, seqLenQ)
+}
+
+// CausalMask builds an additive causal mask with shape [seq_len_k, seq_len_q,
+// heads] that can be passed to Attention. Each query attends to the keys up to
+// and including its own position and negInf is used for the keys after it,
+// typically float32(math.Inf(-1)). The queries are the last seq_len_q keys, as
+// when decoding with a KV cache.
+//
+// The mask is the same for every head so heads should normally be 1, which
+// broadcasts over all heads and is required by fused implementations of
+// attention.
+//
+// CausalMask panics if seqLenQ is greater than seqLenK.
+func CausalMask(ctx ml.Context, seqLenQ, seqLenK, heads int, negInf float32) ml.Tensor {
+	if seqLenQ > seqLenK {
+		panic(fmt.Errorf("seq_len_q(%v) must not be greater than seq_len_k(%v)", seqLenQ, seqLenK))
+	}
+
+	heads = max(heads, 1)
+	offset := seqLenK - seqLenQ
+
+	mask := make([]float32, seqLenK*seqLenQ*heads)
+	for h := range heads {
+		for i := range seqLenQ {
+			for j := i + offset + 1; j < seqLenK; j++ {
+				mask[(h*seqLenQ+i)*seqLenK+j] = negInf
+			}
+		}
+	}
+
+	t, err := ctx.FromFloatSlice(mask, seqLenK, seqLenQ, heads)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// SlidingWindowMask builds an additive mask with shape [seq_len_k, seq_len_q, 1]
+// for causal sliding window attention that can be passed to Attention. Each
+// query attends to keys at its own position and the window positions before
+// it. A window of 0 builds a fully causal mask.
+//
+// positions holds the absolute position of each key, which allows the mask to
+// be built for caches that have been shifted or have gaps. The queries are
+// the last seq_len_q keys. If positions is nil, the position of each key is
+// its index.
+func SlidingWindowMask(ctx ml.Context, seqLenQ, seqLenK, window int, positions []int32) (ml.Tensor, error) {
+	if seqLenQ > seqLenK {
+		return nil, fmt.Errorf("seq_len_q(%v) must not be greater than seq_len_k(%v)", seqLenQ, seqLenK)
+	}
+
+	if positions == nil {
+		positions = make([]int32, seqLenK)
+		for i := range positions {
+			positions[i] = int32(i)
+		}
+	} else if len(positions) != seqLenK {
+		return nil, &ShapeMismatchError{Op: "mask", Dim: "seq_len_k", Other: "key", Want: seqLenK, Operand: "positions", Got: len(positions)}
+	}
+
+	return PositionMask(ctx, positions, positions[seqLenK-seqLenQ:], window)
+}
+
+// PositionMask builds an additive mask with shape [seq_len_k, seq_len_q, 1]
+// for causal attention between keys and queries at arbitrary positions, such
+// as those of a cache that has evicted or compacted keys. keyPositions and
+// queryPositions hold the absolute position of each key and query, so seq_len_k
+// is len(keyPositions) and seq_len_q is len(queryPositions). Each query attends
+// to the keys at or before its position, and if window is positive, only to
+// those at most window positions before it, as in SlidingWindowMask.
+//
+// Unlike the other masks, the queries don't need to be the last keys and the
+// keys don't need to be in order.
+func PositionMask(ctx ml.Context, keyPositions, queryPositions []int32, window int) (ml.Tensor, error) {
+	seqLenK, seqLenQ := len(keyPositions), len(queryPositions)
+
+	mask := make([]float32, seqLenK*seqLenQ)
+	for i, pos := range queryPositions {
+		for j, k := range keyPositions {
+			if k > pos || (window > 0 && k < pos-int32(window)) {
+				mask[i*seqLenK+j] = float32(math.Inf(-1))
+			}
+		}
+	}
+
+	t, err := ctx.FromFloatSlice(mask, seqLenK, seqLenQ, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// BlockDiagonalMask builds an additive mask with shape [seq_len, seq_len, 1]
+// for a batch of sequences that are packed one after another, with the
+// lengths seqLens that sum to seq_len. Each token attends to all tokens of its
+// own sequence and none of the others. Combine it with CausalMask for causal
+// attention within each sequence.
+func BlockDiagonalMask(ctx ml.Context, seqLens []int) (ml.Tensor, error) {
+	var seqLen int
+	for _, n := range seqLens {
+		if n < 1 {
+			return nil, fmt.Errorf("invalid sequence lengths %v", seqLens)
+		}
+
+		seqLen += n
+	}
+
+	mask := make([]float32, seqLen*seqLen)
+	for i := range mask {
+		mask[i] = float32(math.Inf(-1))
+	}
+
+	var start int
+	for _, n := range seqLens {
+		for i := start; i < start+n; i++ {
+			clear(mask[i*seqLen+start : i*seqLen+start+n])
+		}
+
+		start += n
+	}
+
+	t, err := ctx.FromFloatSlice(mask, seqLen, seqLen, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// CombineMasks adds together additive attention masks, such as a causal mask
+// and a padding mask, into one that can be passed to Attention. Each dimension
+// of the masks must either be the same size or 1, in which case the mask is
+// broadcast over that dimension. The result has the largest size of each
+// dimension. nil masks are ignored and if there are no other masks, the result
+// is nil.
+func CombineMasks(ctx ml.Context, masks ...ml.Tensor) (ml.Tensor, error) {
+	masks = slices.DeleteFunc(slices.Clone(masks), func(m ml.Tensor) bool { return m == nil })
+	if len(masks) == 0 {
+		return nil, nil
+	}
+
+	// the combined shape and the mask that determined each dimension
+	var shape, from [4]int
+	for i, mask := range masks {
+		for d := range shape {
+			n := mask.Dim(d)
+			if i == 0 || shape[d] == 1 {
+				shape[d], from[d] = n, i
+			} else if n != 1 && n != shape[d] {
+				return nil, &ShapeMismatchError{
+					Op:      "mask",
+					Dim:     maskDims[d],
+					Other:   fmt.Sprintf("mask %v", from[d]),
+					Want:    shape[d],
+					Operand: fmt.Sprintf("mask %v", i),
+					Got:     n,
+				}
+			}
+		}
+	}
+
+	// masks can only be added to masks that are at least as large in every
+	// dimension, so start with one that has the combined shape if possible
+	i := slices.IndexFunc(masks, func(m ml.Tensor) bool {
+		return m.Dim(0) == shape[0] && m.Dim(1) == shape[1] && m.Dim(2) == shape[2] && m.Dim(3) == shape[3]
+	})
+
+	var combined ml.Tensor
+	if i >= 0 {
+		combined = masks[i]
+		masks = slices.Delete(masks, i, i+1)
+	} else {
+		combined = ctx.Zeros(masks[0].DType(), shape[:]...)
+	}
+
+	for _, mask := range masks {
+		combined = combined.Add(ctx, mask)
+	}
+
+	return combined, nil
+}
+
+// UnmaskQueries finds the queries that can't attend to any key in mask, the
+// data of an additive mask with shape [seqLenK, seqLenQ, heads] that is being
+// built on the host, such as for padding in a batch of sequences. Their
+// softmax would be NaN, so their rows are cleared in place. It returns a
+// tensor with shape [1, seqLenQ, heads] to pass to WithMaskedQueries, which
+// zeros their output, or nil if every query attends to at least one key.
+func UnmaskQueries(ctx ml.Context, mask []float32, seqLenK, seqLenQ int) (ml.Tensor, error) {
+	if seqLenK < 1 || seqLenQ < 1 || len(mask)%(seqLenK*seqLenQ) != 0 {
+		return nil, fmt.Errorf("invalid shape [%v, %v] for a mask of %d elements", seqLenK, seqLenQ, len(mask))
+	}
+
+	attends := make([]float32, len(mask)/seqLenK)
+	var masked bool
+	for i := range attends {
+		row := mask[i*seqLenK : (i+1)*seqLenK]
+		if slices.ContainsFunc(row, func(v float32) bool { return !math.IsInf(float64(v), -1) }) {
+			attends[i] = 1
+		} else {
+			clear(row)
+			masked = true
+		}
+	}
+
+	if !masked {
+		return nil, nil
+	}
+
+	return ctx.FromFloatSlice(attends, 1, seqLenQ, len(attends)/seqLenQ)
+}
+
+// maskDims are the names of the dimensions of an attention mask
+var maskDims = [4]string{"seq_len_k", "seq_len_q", "heads", "batch"}
+
+// additiveMask converts a boolean mask of I32 ones for the keys that are
+// attended to and zeros for those that are masked into an additive mask of
+// zeros and -Inf
+func additiveMask(ctx ml.Context, mask ml.Tensor) (ml.Tensor, error) {
+	values, err := ctx.FromFloatSlice([]float32{float32(math.Inf(-1)), 0}, 1, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	shape := mask.Shape()
+
+	n := 1
+	for _, s := range shape {
+		n *= s
+	}
+
+	t := values.Rows(ctx, contiguous(ctx, mask).Reshape(ctx, n))
+	return t.Reshape(ctx, shape...), nil
+}
@@ -0,0 +1,265 @@
+package nn
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+)
+
+func TestSlidingWindowMask(t *testing.T) {
+	// bruteForce checks every key against the position of every query
+	bruteForce := func(seqLenQ int, window int, positions []int32) []float32 {
+		var mask []float32
+		for _, q := range positions[len(positions)-seqLenQ:] {
+			for _, k := range positions {
+				attend := k <= q
+				if window > 0 {
+					attend = attend && q-k <= int32(window)
+				}
+
+				if attend {
+					mask = append(mask, 0)
+				} else {
+					mask = append(mask, float32(math.Inf(-1)))
+				}
+			}
+		}
+		return mask
+	}
+
+	sequential := func(start, n int) []int32 {
+		s := make([]int32, n)
+		for i := range s {
+			s[i] = int32(start + i)
+		}
+		return s
+	}
+
+	cases := []struct {
+		name      string
+		seqLenQ   int
+		positions []int32
+	}{
+		{"prompt", 6, sequential(0, 6)},
+		{"decode", 1, sequential(0, 6)},
+		{"batch", 3, sequential(0, 8)},
+		{"shifted", 2, sequential(10, 6)},
+		{"gaps", 2, []int32{0, 1, 4, 5, 9, 10}},
+	}
+
+	for _, tt := range cases {
+		for _, window := range []int{0, 1, 2, 4} {
+			mask, err := SlidingWindowMask(&testContext{}, tt.seqLenQ, len(tt.positions), window, tt.positions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := bruteForce(tt.seqLenQ, window, tt.positions); !slices.Equal(mask.Floats(), want) {
+				t.Errorf("%s window %d: have %v; want %v", tt.name, window, mask.Floats(), want)
+			}
+
+			if want := []int{len(tt.positions), tt.seqLenQ, 1}; !slices.Equal(mask.Shape(), want) {
+				t.Errorf("%s window %d: have shape %v; want %v", tt.name, window, mask.Shape(), want)
+			}
+		}
+	}
+
+	nilPositions, err := SlidingWindowMask(&testContext{}, 2, 4, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := bruteForce(2, 1, sequential(0, 4)); !slices.Equal(nilPositions.Floats(), want) {
+		t.Errorf("nil positions: have %v; want %v", nilPositions.Floats(), want)
+	}
+
+	if _, err := SlidingWindowMask(&testContext{}, 2, 4, 1, sequential(0, 3)); err == nil {
+		t.Errorf("expected error for mismatched positions")
+	}
+}
+
+func TestPositionMask(t *testing.T) {
+	inf := float32(math.Inf(-1))
+
+	// a compacted cache with the keys out of order, and queries that aren't
+	// the last keys
+	keys := []int32{7, 0, 9, 3}
+	queries := []int32{3, 8}
+
+	cases := []struct {
+		window int
+		want   []float32
+	}{
+		{0, []float32{inf, 0, inf, 0, 0, 0, inf, 0}},
+		{1, []float32{inf, inf, inf, 0, 0, inf, inf, inf}},
+		{5, []float32{inf, 0, inf, 0, 0, inf, inf, 0}},
+	}
+
+	for _, tt := range cases {
+		mask, err := PositionMask(&testContext{}, keys, queries, tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(mask.Floats(), tt.want) {
+			t.Errorf("window %d: have %v; want %v", tt.window, mask.Floats(), tt.want)
+		}
+
+		if want := []int{len(keys), len(queries), 1}; !slices.Equal(mask.Shape(), want) {
+			t.Errorf("window %d: have shape %v; want %v", tt.window, mask.Shape(), want)
+		}
+	}
+}
+
+func TestCausalMask(t *testing.T) {
+	ctx := &testContext{}
+
+	const x = -1e9
+
+	cases := []struct {
+		name                    string
+		seqLenQ, seqLenK, heads int
+		want                    []float32
+		shape                   []int
+	}{
+		{"prompt", 3, 3, 1, []float32{0, x, x, 0, 0, x, 0, 0, 0}, []int{3, 3, 1}},
+		{"decode", 1, 4, 1, []float32{0, 0, 0, 0}, []int{4, 1, 1}},
+		{"batch", 2, 4, 0, []float32{0, 0, 0, x, 0, 0, 0, 0}, []int{4, 2, 1}},
+		{"heads", 2, 3, 2, []float32{0, 0, x, 0, 0, 0, 0, 0, x, 0, 0, 0}, []int{3, 2, 2}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mask := CausalMask(ctx, tt.seqLenQ, tt.seqLenK, tt.heads, x)
+			if !slices.Equal(mask.Shape(), tt.shape) {
+				t.Errorf("shape is %v, want %v", mask.Shape(), tt.shape)
+			}
+
+			if !slices.Equal(mask.Floats(), tt.want) {
+				t.Errorf("mask is %v, want %v", mask.Floats(), tt.want)
+			}
+		})
+	}
+
+	// matches the equivalent sliding window mask
+	causal := CausalMask(ctx, 3, 5, 1, float32(math.Inf(-1)))
+	window, err := SlidingWindowMask(ctx, 3, 5, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(causal.Floats(), window.Floats()) {
+		t.Errorf("causal mask %v does not match %v", causal.Floats(), window.Floats())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected seq_len_q > seq_len_k to panic")
+		}
+	}()
+	CausalMask(ctx, 3, 2, 1, x)
+}
+
+func TestBlockDiagonalMask(t *testing.T) {
+	ctx := &testContext{}
+	inf := float32(math.Inf(-1))
+
+	mask, err := BlockDiagonalMask(ctx, []int{2, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []float32{
+		0, 0, inf, inf,
+		0, 0, inf, inf,
+		inf, inf, 0, inf,
+		inf, inf, inf, 0,
+	}
+
+	if !slices.Equal(mask.Shape(), []int{4, 4, 1}) {
+		t.Errorf("shape is %v, want [4 4 1]", mask.Shape())
+	}
+
+	if !slices.Equal(mask.Floats(), want) {
+		t.Errorf("mask is %v, want %v", mask.Floats(), want)
+	}
+
+	if _, err := BlockDiagonalMask(ctx, []int{2, 0}); err == nil {
+		t.Error("expected error for empty sequence")
+	}
+}
+
+func TestCombineMasks(t *testing.T) {
+	ctx := &testContext{}
+
+	inf := float32(math.Inf(-1))
+	causal := ctx.fromFloats([]float32{0, inf, inf, 0, 0, inf}, 3, 2)
+	padding := ctx.fromFloats([]float32{inf, 0, 0}, 3, 1)
+	heads := ctx.fromFloats([]float32{0, 0, 0, inf, inf, inf}, 3, 1, 2)
+
+	cases := []struct {
+		name  string
+		masks []ml.Tensor
+		want  []float32
+		shape []int
+	}{
+		{"none", nil, nil, nil},
+		{"nil", []ml.Tensor{nil, nil}, nil, nil},
+		{"single", []ml.Tensor{causal}, causal.Floats(), []int{3, 2, 1}},
+		{"padding", []ml.Tensor{padding, nil, causal}, []float32{inf, inf, inf, inf, 0, inf}, []int{3, 2, 1}},
+		{"expanded", []ml.Tensor{causal, heads}, []float32{0, inf, inf, 0, 0, inf, inf, inf, inf, inf, inf, inf}, []int{3, 2, 2}},
+		{"broadcast", []ml.Tensor{padding, heads}, []float32{inf, 0, 0, inf, inf, inf}, []int{3, 1, 2}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mask, err := CombineMasks(ctx, tt.masks...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == nil {
+				if mask != nil {
+					t.Errorf("expected nil mask, got %v", mask.Floats())
+				}
+				return
+			}
+
+			if !slices.Equal(mask.Floats(), tt.want) || mask.Dim(0) != tt.shape[0] || mask.Dim(1) != tt.shape[1] || mask.Dim(2) != tt.shape[2] {
+				t.Errorf("mask is %v (shape %v), want %v (shape %v)", mask.Floats(), mask.Shape(), tt.want, tt.shape)
+			}
+		})
+	}
+
+	_, err := CombineMasks(ctx, causal, ctx.fromFloats(make([]float32, 4), 4, 1))
+	var e *ShapeMismatchError
+	if !errors.As(err, &e) || e.Dim != "seq_len_k" || e.Got != 4 || e.Want != 3 {
+		t.Errorf("expected seq_len_k mismatch, got %v", err)
+	}
+}
+
+func TestAdditiveMask(t *testing.T) {
+	ctx := &testContext{}
+
+	boolean, err := ctx.FromIntSlice([]int32{1, 0, 0, 1, 1, 0}, 3, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mask, err := additiveMask(ctx, boolean)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shape := mask.Shape(); !slices.Equal(shape, []int{3, 2, 1}) {
+		t.Errorf("shape is %v, want [3 2 1]", shape)
+	}
+
+	inf := float32(math.Inf(-1))
+	if want := []float32{0, inf, inf, 0, 0, inf}; !slices.Equal(mask.Floats(), want) {
+		t.Errorf("mask is %v, want %v", mask.Floats(), want)
+	}
+}
@@ -0,0 +1,142 @@
+package nn
+
+import (
+	"cmp"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// maskPad is the number of queries that masks are padded to for flash
+// attention kernels
+const maskPad = 32
+
+// bytesPerElement returns the average size in bytes of an element of dtype,
+// including the scales of quantized blocks of 32 elements
+func bytesPerElement(dtype ml.DType) float64 {
+	switch dtype {
+	case ml.DTypeF32, ml.DTypeI32:
+		return 4
+	case ml.DTypeQ80:
+		return 34. / 32
+	case ml.DTypeQ40:
+		return 18. / 32
+	default:
+		return 2
+	}
+}
+
+// AttentionMemory estimates the size in bytes of the intermediate tensors of
+// Attention for seqLenQ queries attending to seqLenK keys of a cache of type
+// cacheType.
+//
+// Without flash attention, the attention scores dominate, and queries are
+// processed in blocks to bound them. The keys and values are also copied out
+// of the cache, unless the cache is quantized, in which case only a block of
+// values is dequantized to F32 and transposed at a time. Flash attention only
+// needs the mask and a transposed copy of the values, and takes those of a
+// quantized cache as they are.
+//
+// workspace is the memory that the scores of a block may use, as reported by
+// ml.Workspace, or 0 for the default.
+func AttentionMemory(seqLenQ, seqLenK, heads, kvHeads, keyDim, valueDim int, cacheType ml.DType, flashAttention bool, workspace uint64) uint64 {
+	if flashAttention {
+		padded := (seqLenQ + maskPad - 1) / maskPad * maskPad
+		size := 2 * seqLenK * padded
+		if !quantized(cacheType) {
+			size += 2 * seqLenK * kvHeads * valueDim
+		}
+
+		return uint64(size)
+	}
+
+	blockSize := min(seqLenQ, defaultBlockSize(seqLenQ, seqLenK, heads, cmp.Or(workspace, defaultWorkspace)))
+	size := 4 * seqLenK * blockSize * heads
+	if quantized(cacheType) {
+		// the blocks of values are multiplied with views of the scores,
+		// which stay alive until the last block
+		n := min(seqLenK, max(valueBlockSize, (seqLenK+maxValueBlocks-1)/maxValueBlocks))
+		size += 2*4*n*kvHeads*valueDim + 4*seqLenK*seqLenQ
+	} else {
+		size += seqLenK * kvHeads * (keyDim + valueDim) * int(bytesPerElement(cacheType))
+	}
+
+	return uint64(size)
+}
+
+// shiftMemory estimates the size in bytes of the intermediate tensors of
+// shifting the positions of seqLenK keys of a cache of type cacheType, which
+// are rotated in F32 if the cache is quantized
+func shiftMemory(seqLenK, kvHeads, keyDim int, cacheType ml.DType) uint64 {
+	if !quantized(cacheType) {
+		return 0
+	}
+
+	// the dequantized keys of a layer and their rotation
+	return uint64(2 * 4 * seqLenK * kvHeads * keyDim)
+}
+
+// TransformerMemory estimates the memory needed by a decoder only transformer
+// with the configuration c, in addition to its weights, for a cache of ctxLen
+// tokens of type cacheType shared by up to sequences sequences and batches of
+// up to batch tokens. Logits are assumed to be computed for every token of the
+// batch, the worst case.
+//
+// The cache of layers that use sliding window attention, as reported by
+// SlidingWindowLayer, only holds the window of each sequence and a batch, as
+// in kvcache.NewSWACache.
+//
+// The estimate is only as accurate as the model's graph is similar to that of
+// llama. The largest tensors that are alive at once are those of attention,
+// the feed-forward network, which also holds a few copies of the hidden states
+// such as the residual, the logits or, for a quantized cache, shifting the
+// keys of a layer. workspace is that of AttentionMemory.
+func TransformerMemory(c ml.Config, sequences, batch, ctxLen int, cacheType ml.DType, flashAttention bool, workspace uint64) ml.GraphMemory {
+	layers := int(c.Uint("block_count"))
+	hidden := int(c.Uint("embedding_length"))
+	heads := int(max(1, c.Uint("attention.head_count", 1)))
+	kvHeads := int(c.Uint("attention.head_count_kv", uint32(heads)))
+	keyDim := int(c.Uint("attention.key_length", uint32(hidden/heads)))
+	valueDim := int(c.Uint("attention.value_length", uint32(hidden/heads)))
+	ffn := int(c.Uint("feed_forward_length")) * int(max(1, c.Uint("expert_used_count", 1)))
+	vocab := len(c.Strings("tokenizer.ggml.tokens"))
+
+	batch = min(batch, ctxLen)
+
+	// the keys of the largest layer, which bounds the attention scores
+	var cells, allCells int
+	for layer := range layers {
+		n := ctxLen
+		if SlidingWindowLayer(c, layer) {
+			n = min(ctxLen, max(1, sequences)*int(c.Uint("attention.sliding_window"))+batch)
+		}
+
+		cells = max(cells, n)
+		allCells += n
+	}
+
+	kv := float64(allCells*kvHeads*(keyDim+valueDim)) * bytesPerElement(cacheType)
+
+	// flash attention kernels need keys and values of the same size
+	attention := AttentionMemory(batch, cells, heads, kvHeads, keyDim, valueDim, cacheType, flashAttention && keyDim == valueDim, workspace)
+
+	return ml.GraphMemory{
+		KV: uint64(kv),
+		Graph: max(
+			attention+uint64(4*batch*(hidden+ffn)),
+			uint64(4*batch*(3*hidden+2*ffn)),
+			uint64(4*batch*(4*hidden+vocab)),
+			shiftMemory(cells, kvHeads, keyDim, cacheType),
+		),
+	}
+}
+
+// BackendMemory estimates with TransformerMemory the memory needed by the
+// model loaded by b, for a cache of type cacheType. Flash attention is used if
+// b supports it for the model's keys, and blocks of attention fit in b's
+// workspace.
+func BackendMemory(b ml.Backend, sequences, batch, ctxLen int, cacheType ml.DType) ml.GraphMemory {
+	c := b.Config()
+	heads := max(1, c.Uint("attention.head_count", 1))
+	keyDim := c.Uint("attention.key_length", c.Uint("embedding_length")/heads)
+	return TransformerMemory(c, sequences, batch, ctxLen, cacheType, b.SupportsFlashAttention(int(keyDim)), b.Workspace())
+}
@@ -0,0 +1,55 @@
+package nn
+
+import (
+	"testing"
+
+	fs "github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/ml"
+)
+
+func TestTransformerMemorySlidingWindow(t *testing.T) {
+	// Gemma 2 9B, where every other layer uses a window of 4096 tokens
+	kv := fs.KV{
+		"general.architecture":           "gemma2",
+		"gemma2.block_count":             uint32(42),
+		"gemma2.embedding_length":        uint32(3584),
+		"gemma2.feed_forward_length":     uint32(14336),
+		"gemma2.attention.head_count":    uint32(16),
+		"gemma2.attention.head_count_kv": uint32(8),
+		"gemma2.attention.key_length":    uint32(256),
+		"gemma2.attention.value_length":  uint32(256),
+	}
+
+	const ctxLen, batch = 32768, 512
+	perToken := uint64(8 * (256 + 256) * 2)
+
+	full := TransformerMemory(kv, 1, batch, ctxLen, ml.DTypeF16, false, 0)
+	if want := 42 * ctxLen * perToken; full.KV != want {
+		t.Errorf("unexpected kv cache size %d without a window, want %d", full.KV, want)
+	}
+
+	kv["gemma2.attention.sliding_window"] = uint32(4096)
+
+	for _, sequences := range []int{1, 4} {
+		hybrid := TransformerMemory(kv, sequences, batch, ctxLen, ml.DTypeF16, false, 0)
+		if want := 21*ctxLen*perToken + 21*uint64(min(ctxLen, sequences*4096+batch))*perToken; hybrid.KV != want {
+			t.Errorf("unexpected kv cache size %d for %d sequences, want %d", hybrid.KV, sequences, want)
+		}
+	}
+
+	// global layers still attend to the whole context
+	if hybrid := TransformerMemory(kv, 1, batch, ctxLen, ml.DTypeF16, false, 0); hybrid.Graph != full.Graph {
+		t.Errorf("unexpected graph size %d, want %d", hybrid.Graph, full.Graph)
+	}
+
+	for layer, want := range []bool{true, false, true, false} {
+		if got := SlidingWindowLayer(kv, layer); got != want {
+			t.Errorf("layer %d: have sliding window %v, want %v", layer, got, want)
+		}
+	}
+
+	kv["gemma2.attention.sliding_window_pattern"] = uint32(1)
+	if all := TransformerMemory(kv, 1, batch, ctxLen, ml.DTypeF16, false, 0); all.KV != 42*(4096+batch)*perToken {
+		t.Errorf("unexpected kv cache size %d with every layer sliding, want %d", all.KV, 42*(4096+batch)*perToken)
+	}
+}
@@ -0,0 +1,122 @@
+package nn
+
+import (
+	"fmt"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// SparseMoE is a sparse mixture of experts feed-forward layer as used by
+// Mixtral, Qwen MoE and DeepSeek MoE. A router chooses the top experts for
+// each token, which are SiLU-gated feed-forward networks, and the output is
+// the sum of their outputs weighted by the router. Optional shared experts
+// process every token.
+type SparseMoE struct {
+	Router *Linear `gguf:"ffn_gate_inp"`
+
+	// Gate and Up have shape [hidden, ffn, experts] and Down has shape
+	// [ffn, hidden, experts]
+	Gate ml.Tensor `gguf:"ffn_gate_exps.weight"`
+	Up   ml.Tensor `gguf:"ffn_up_exps.weight"`
+	Down ml.Tensor `gguf:"ffn_down_exps.weight"`
+
+	SharedGate *Linear `gguf:"ffn_gate_shexp"`
+	SharedUp   *Linear `gguf:"ffn_up_shexp"`
+	SharedDown *Linear `gguf:"ffn_down_shexp"`
+
+	// SharedExpertGate, if non-nil, scales the output of the shared experts
+	// of each token by a sigmoid, as in Qwen MoE
+	SharedExpertGate *Linear `gguf:"ffn_gate_inp_shexp"`
+}
+
+// MoEOptions are the hyperparameters of SparseMoE
+type MoEOptions struct {
+	// ExpertsUsed is the number of experts chosen for each token
+	ExpertsUsed int
+
+	// NormalizeTopK computes the softmax of the router logits after choosing
+	// the experts, so that the weights of the chosen experts sum to 1, as in
+	// Mixtral. Otherwise, the softmax is over all experts before choosing, as
+	// in DeepSeek MoE.
+	NormalizeTopK bool
+}
+
+// Route returns the experts chosen for each token of hiddenState with shape
+// [hidden, seq_len] and their weights, both with shape [ExpertsUsed,
+// seq_len]. Experts are ordered from the largest weight to the smallest.
+func (m *SparseMoE) Route(ctx ml.Context, hiddenState ml.Tensor, opts *MoEOptions) (experts, weights ml.Tensor) {
+	ctx = ml.Name(ctx, "ffn_moe_router")
+	logits := m.Router.Forward(ctx, hiddenState)
+
+	numExperts := logits.Dim(0)
+	if opts.ExpertsUsed <= 0 || opts.ExpertsUsed > numExperts {
+		panic(fmt.Errorf("invalid number of experts used %v for %v experts", opts.ExpertsUsed, numExperts))
+	}
+
+	if !opts.NormalizeTopK {
+		logits = logits.Softmax(ctx)
+	}
+
+	weights, experts = logits.TopK(ctx, opts.ExpertsUsed)
+	if opts.NormalizeTopK {
+		weights = weights.Softmax(ctx)
+	}
+
+	return experts, weights
+}
+
+// Forward computes the layer for hiddenState with shape [hidden, seq_len]
+func (m *SparseMoE) Forward(ctx ml.Context, hiddenState ml.Tensor, opts *MoEOptions) ml.Tensor {
+	experts, weights := m.Route(ctx, hiddenState, opts)
+
+	hidden, seqLen := hiddenState.Dim(0), hiddenState.Dim(1)
+	x := hiddenState.Reshape(ctx, hidden, 1, seqLen)
+
+	gateCtx, upCtx, downCtx := ml.Name(ctx, "ffn_moe_gate"), ml.Name(ctx, "ffn_moe_up"), ml.Name(ctx, "ffn_moe_down")
+	t := mulmatExperts(gateCtx, m.Gate, x, experts).SILU(gateCtx).Mul(upCtx, mulmatExperts(upCtx, m.Up, x, experts))
+	t = mulmatExperts(downCtx, m.Down, t, experts)
+
+	outCtx := ml.Name(ctx, "ffn_moe_out")
+	t = t.Mul(outCtx, weights.Reshape(outCtx, 1, opts.ExpertsUsed, seqLen))
+
+	out := t.View(outCtx, 0, t.Dim(0), t.Stride(2), seqLen)
+	for i := 1; i < opts.ExpertsUsed; i++ {
+		out = out.Add(outCtx, t.View(outCtx, t.Stride(1)*i, t.Dim(0), t.Stride(2), seqLen))
+	}
+
+	if m.SharedUp != nil {
+		sharedCtx := ml.Name(ctx, "ffn_shexp")
+		shared := m.SharedGate.Forward(sharedCtx, hiddenState).SILU(sharedCtx).Mul(sharedCtx, m.SharedUp.Forward(sharedCtx, hiddenState))
+		shared = m.SharedDown.Forward(sharedCtx, shared)
+		if m.SharedExpertGate != nil {
+			shared = shared.Mul(sharedCtx, m.SharedExpertGate.Forward(sharedCtx, hiddenState).Sigmoid(sharedCtx))
+		}
+
+		out = out.Add(outCtx, shared)
+	}
+
+	return out
+}
+
+// mulmatExperts multiplies t with shape [K, k or 1, seq_len] by the experts of
+// w with shape [K, M, experts] chosen by ids with shape [k, seq_len], using
+// the backend's batched implementation if available. The result has shape
+// [M, k, seq_len].
+func mulmatExperts(ctx ml.Context, w, t, ids ml.Tensor) ml.Tensor {
+	if w, ok := w.(ml.MulmatID); ok {
+		return w.MulmatID(ctx, t, ids)
+	}
+
+	// otherwise gather the chosen experts for each token and multiply them
+	// as a batch of matrices
+	k, seqLen := ids.Dim(0), ids.Dim(1)
+	selected := w.Reshape(ctx, w.Dim(0)*w.Dim(1), w.Dim(2)).Rows(ctx, ids.Contiguous(ctx).Reshape(ctx, k*seqLen))
+	selected = selected.Reshape(ctx, w.Dim(0), w.Dim(1), k*seqLen)
+
+	if t.Dim(1) != k {
+		t = ctx.Zeros(ml.DTypeF32, t.Dim(0), k, seqLen).Add(ctx, t)
+	}
+
+	t = selected.Mulmat(ctx, t.Reshape(ctx, t.Dim(0), 1, k*seqLen))
+	return t.Reshape(ctx, w.Dim(1), k, seqLen)
+}
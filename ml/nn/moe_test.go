@@ -0,0 +1,144 @@
+package nn
+
+import (
+	"math"
+	"testing"
+)
+
+// testMoE returns a SparseMoE with 4 experts for a hidden size of 3 and an ffn
+// size of 2, and a hidden state of 3 tokens
+func testMoE(ctx *testContext) (*SparseMoE, *testTensor) {
+	vals := func(seed, n int) []float32 {
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(float64(seed*100 + i)))
+		}
+		return s
+	}
+
+	const hidden, ffn, experts, seqLen = 3, 2, 4, 3
+
+	m := &SparseMoE{
+		Router:           &Linear{Weight: ctx.fromFloats(vals(1, hidden*experts), hidden, experts)},
+		Gate:             ctx.fromFloats(vals(2, hidden*ffn*experts), hidden, ffn, experts),
+		Up:               ctx.fromFloats(vals(3, hidden*ffn*experts), hidden, ffn, experts),
+		Down:             ctx.fromFloats(vals(4, ffn*hidden*experts), ffn, hidden, experts),
+		SharedGate:       &Linear{Weight: ctx.fromFloats(vals(5, hidden*ffn), hidden, ffn)},
+		SharedUp:         &Linear{Weight: ctx.fromFloats(vals(6, hidden*ffn), hidden, ffn)},
+		SharedDown:       &Linear{Weight: ctx.fromFloats(vals(7, ffn*hidden), ffn, hidden)},
+		SharedExpertGate: &Linear{Weight: ctx.fromFloats(vals(8, hidden), hidden, 1)},
+	}
+
+	return m, ctx.fromFloats(vals(9, hidden*seqLen), hidden, seqLen)
+}
+
+func TestSparseMoERoute(t *testing.T) {
+	ctx := &testContext{}
+	m, hiddenState := testMoE(ctx)
+
+	logits := m.Router.Forward(ctx, hiddenState).Floats()
+
+	for _, normalize := range []bool{true, false} {
+		experts, weights := m.Route(ctx, hiddenState, &MoEOptions{ExpertsUsed: 2, NormalizeTopK: normalize})
+		if shape := experts.Shape(); shape[0] != 2 || shape[1] != 3 {
+			t.Fatalf("unexpected experts shape %v", shape)
+		}
+
+		e, w := experts.Floats(), weights.Floats()
+		for token := range 3 {
+			row := logits[token*4 : token*4+4]
+
+			var sum float32
+			for i := range 2 {
+				sum += w[token*2+i]
+			}
+
+			// the chosen experts have the largest logits
+			first, second := int(e[token*2]), int(e[token*2+1])
+			for expert, logit := range row {
+				if expert != first && expert != second && (logit > row[first] || logit > row[second]) {
+					t.Errorf("token %v chose experts %v and %v over %v", token, first, second, expert)
+				}
+			}
+
+			probs := softmax([]float64{float64(row[0]), float64(row[1]), float64(row[2]), float64(row[3])})
+			if normalize {
+				if math.Abs(float64(sum-1)) > 1e-6 {
+					t.Errorf("weights of token %v sum to %v", token, sum)
+				}
+			} else {
+				assertFloats(t, []float32{float32(probs[first]), float32(probs[second])}, w[token*2:token*2+2], 1e-6)
+			}
+		}
+	}
+}
+
+func TestSparseMoE(t *testing.T) {
+	ctx := &testContext{}
+	m, hiddenState := testMoE(ctx)
+
+	opts := &MoEOptions{ExpertsUsed: 2, NormalizeTopK: true}
+	experts, weights := m.Route(ctx, hiddenState, opts)
+
+	silu := func(v float32) float32 { return float32(float64(v) / (1 + math.Exp(-float64(v)))) }
+	sigmoid := func(v float32) float32 { return float32(1 / (1 + math.Exp(-float64(v)))) }
+
+	// ffn computes a SiLU-gated feed-forward network of x with weights at
+	// offsets of gate, up and down
+	ffn := func(gate, up, down []float32, x []float32) []float32 {
+		h := make([]float32, 2)
+		for j := range h {
+			var g, u float32
+			for i := range x {
+				g += gate[j*3+i] * x[i]
+				u += up[j*3+i] * x[i]
+			}
+			h[j] = silu(g) * u
+		}
+
+		out := make([]float32, 3)
+		for j := range out {
+			for i := range h {
+				out[j] += down[j*2+i] * h[i]
+			}
+		}
+		return out
+	}
+
+	x, e, w := hiddenState.Floats(), experts.Floats(), weights.Floats()
+	gate, up, down := m.Gate.Floats(), m.Up.Floats(), m.Down.Floats()
+
+	var want []float32
+	for token := range 3 {
+		xt := x[token*3 : token*3+3]
+
+		out := make([]float32, 3)
+		for i := range 2 {
+			expert := int(e[token*2+i])
+			y := ffn(gate[expert*6:expert*6+6], up[expert*6:expert*6+6], down[expert*6:expert*6+6], xt)
+			for j := range out {
+				out[j] += w[token*2+i] * y[j]
+			}
+		}
+
+		shared := ffn(m.SharedGate.Weight.Floats(), m.SharedUp.Weight.Floats(), m.SharedDown.Weight.Floats(), xt)
+
+		var g float32
+		for i, v := range m.SharedExpertGate.Weight.Floats() {
+			g += v * xt[i]
+		}
+
+		for j := range out {
+			out[j] += sigmoid(g) * shared[j]
+		}
+
+		want = append(want, out...)
+	}
+
+	got := m.Forward(ctx, hiddenState, opts)
+	if shape := got.Shape(); shape[0] != 3 || shape[1] != 3 {
+		t.Fatalf("unexpected shape %v", shape)
+	}
+
+	assertFloats(t, want, got.Floats(), 1e-5)
+}
@@ -0,0 +1,55 @@
+package nn
+
+import (
+	"cmp"
+	"fmt"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// MultiHeadAttention is self-attention with query, key, value and output
+// projections, for layers that attend to all of their inputs without a cache
+// or position embeddings, such as vision encoders. Layers that need them can
+// instead project and reshape the heads themselves and call Attention.
+type MultiHeadAttention struct {
+	Query  *Linear `gguf:"attn_q"`
+	Key    *Linear `gguf:"attn_k"`
+	Value  *Linear `gguf:"attn_v"`
+	Output *Linear `gguf:"attn_output"`
+
+	// Heads is the number of query heads and KVHeads that of key and value
+	// heads, which must divide Heads. Zero KVHeads is the same as Heads.
+	Heads, KVHeads int
+}
+
+// Forward computes attention for hiddenState with shape [hidden, seq_len].
+// The size of each head is that of the projections divided by the number of
+// heads. mask and scale are as in Attention, as are opts, so the mask should
+// broadcast to [seq_len, seq_len, heads].
+//
+// The result has the shape [out_features, seq_len] of Output. Forward panics
+// if the sizes of the projections aren't multiples of the number of heads.
+func (m *MultiHeadAttention) Forward(ctx ml.Context, hiddenState, mask ml.Tensor, scale float64, opts ...AttentionOption) ml.Tensor {
+	seqLen := hiddenState.Dim(1)
+	kvHeads := cmp.Or(m.KVHeads, m.Heads)
+
+	query := splitHeads(ctx, "query", m.Query.Forward(ctx, hiddenState), m.Heads, 0, 2, 1, 3)
+	key := splitHeads(ctx, "key", m.Key.Forward(ctx, hiddenState), kvHeads, 0, 2, 1, 3)
+	value := splitHeads(ctx, "value", m.Value.Forward(ctx, hiddenState), kvHeads, 1, 2, 0, 3)
+
+	kqv := Attention(ctx, query, key, value, mask, scale, opts...)
+	kqv = kqv.Reshape(ctx, kqv.Dim(0)*kqv.Dim(1), seqLen)
+
+	return m.Output.Forward(ctx, kqv)
+}
+
+// splitHeads splits the projection t with shape [heads*head_dim, seq_len]
+// into heads and permutes them into order for Attention
+func splitHeads(ctx ml.Context, name string, t ml.Tensor, heads int, order ...int) ml.Tensor {
+	if heads <= 0 || t.Dim(0)%heads != 0 {
+		panic(fmt.Errorf("%s of size %v in multi-head attention is not a multiple of heads(%v)", name, t.Dim(0), heads))
+	}
+
+	t = t.Reshape(ctx, t.Dim(0)/heads, heads, t.Dim(1))
+	return permute(ctx, t, order...)
+}
@@ -0,0 +1,109 @@
+package nn
+
+import (
+	"cmp"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+)
+
+func TestMultiHeadAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	const hidden, headDim, seqLen = 4, 2, 3
+
+	weight := func(seed float64, shape ...int) *testTensor {
+		n := 1
+		for _, s := range shape {
+			n *= s
+		}
+
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(seed + float64(i)))
+		}
+		return ctx.fromFloats(s, shape...)
+	}
+
+	inf := float32(math.Inf(-1))
+	mask := ctx.fromFloats([]float32{0, inf, inf, 0, 0, inf, 0, 0, 0}, seqLen, seqLen)
+	hiddenState := weight(7, hidden, seqLen)
+
+	for _, tt := range []struct {
+		heads, kvHeads int
+		mask           ml.Tensor
+	}{
+		{2, 0, nil},
+		{2, 2, mask},
+		{4, 2, mask},
+		{4, 1, nil},
+	} {
+		kvHeads := cmp.Or(tt.kvHeads, tt.heads)
+
+		m := &MultiHeadAttention{
+			Query:   &Linear{Weight: weight(1, hidden, tt.heads*headDim), Bias: weight(5, tt.heads*headDim)},
+			Key:     &Linear{Weight: weight(2, hidden, kvHeads*headDim)},
+			Value:   &Linear{Weight: weight(3, hidden, kvHeads*headDim)},
+			Output:  &Linear{Weight: weight(4, tt.heads*headDim, hidden)},
+			Heads:   tt.heads,
+			KVHeads: tt.kvHeads,
+		}
+
+		got := m.Forward(ctx, hiddenState, tt.mask, 0)
+		if shape := got.(*testTensor).ne(); shape != [4]int{hidden, seqLen, 1, 1} {
+			t.Fatalf("heads %d kv_heads %d: have shape %v; want [%v %v 1 1]", tt.heads, tt.kvHeads, shape, hidden, seqLen)
+		}
+
+		q := m.Query.Forward(ctx, hiddenState).Reshape(ctx, headDim, tt.heads, seqLen)
+		k := m.Key.Forward(ctx, hiddenState).Reshape(ctx, headDim, kvHeads, seqLen)
+		v := m.Value.Forward(ctx, hiddenState).Reshape(ctx, headDim, kvHeads, seqLen)
+
+		q = q.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+		k = k.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
+		v = v.Permute(ctx, 1, 2, 0, 3).Contiguous(ctx)
+
+		kqv := Attention(ctx, q, k, v, tt.mask, 1/math.Sqrt(headDim))
+		want := m.Output.Forward(ctx, kqv.Reshape(ctx, headDim*tt.heads, seqLen))
+		assertFloats(t, want.Floats(), got.Floats(), 1e-5)
+	}
+}
+
+func TestMultiHeadAttentionHeads(t *testing.T) {
+	ctx := &testContext{}
+
+	linear := func(in, out int) *Linear {
+		return &Linear{Weight: ctx.fromFloats(make([]float32, in*out), in, out)}
+	}
+
+	for _, tt := range []struct {
+		name           string
+		heads, kvHeads int
+		err            string
+	}{
+		{"heads", 3, 0, "query of size 4 in multi-head attention is not a multiple of heads(3)"},
+		{"kv_heads", 2, 3, "key of size 4 in multi-head attention is not a multiple of heads(3)"},
+		{"missing", 0, 0, "query of size 4 in multi-head attention is not a multiple of heads(0)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				err, _ := recover().(error)
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("have panic %v; want %q", err, tt.err)
+				}
+			}()
+
+			m := &MultiHeadAttention{
+				Query:   linear(2, 4),
+				Key:     linear(2, 4),
+				Value:   linear(2, 4),
+				Output:  linear(4, 2),
+				Heads:   tt.heads,
+				KVHeads: tt.kvHeads,
+			}
+
+			m.Forward(ctx, ctx.fromFloats(make([]float32, 2*3), 2, 3), nil, 0)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Package nntest provides reference implementations of the layers of package
+// nn, computed directly on slices without a backend, so that the output of
+// backends can be compared against them in tests.
+package nntest
+
+import (
+	"fmt"
+	"math"
+)
+
+// AttentionShape holds the dimensions of the tensors of attention, named as
+// in the documentation of nn.Attention
+type AttentionShape struct {
+	// KeyDim and ValueDim are d_k and d_v, the sizes of each head of the
+	// queries and keys and of the values
+	KeyDim, ValueDim int
+
+	SeqLenQ, SeqLenK int
+
+	// Heads must be a multiple of KVHeads
+	Heads, KVHeads int
+}
+
+// AttentionReference computes softmax(QKᵀ·scale + mask)V in float64, with the
+// same shapes and layouts as nn.Attention:
+//
+//   - query has shape [d_k, seq_len_q, heads]
+//   - key has shape [d_k, seq_len_k, kv_heads]
+//   - value has shape [seq_len_k, d_v, kv_heads]
+//   - mask, if non-nil, has shape [seq_len_k, seq_len_q] or, to differ for
+//     each head, [seq_len_k, seq_len_q, heads]
+//
+// where the first dimension varies the fastest. Query head h attends to key
+// and value head h/(heads/kv_heads). The output has shape [d_v, heads,
+// seq_len_q], as returned by nn.Attention, and queries that can't attend to
+// any key have an output of zero.
+//
+// AttentionReference panics if the length of a slice doesn't match its shape.
+func AttentionReference(query, key, value, mask []float32, shape AttentionShape, scale float64) []float32 {
+	dk, dv := shape.KeyDim, shape.ValueDim
+	seqQ, seqK := shape.SeqLenQ, shape.SeqLenK
+	heads, kvHeads := shape.Heads, shape.KVHeads
+
+	if kvHeads < 1 || heads%kvHeads != 0 {
+		panic(fmt.Errorf("heads %v must be a multiple of kv_heads %v", heads, kvHeads))
+	}
+
+	for _, t := range []struct {
+		name string
+		s    []float32
+		n    int
+	}{
+		{"query", query, dk * seqQ * heads},
+		{"key", key, dk * seqK * kvHeads},
+		{"value", value, seqK * dv * kvHeads},
+	} {
+		if len(t.s) != t.n {
+			panic(fmt.Errorf("%v has %v elements, want %v", t.name, len(t.s), t.n))
+		}
+	}
+
+	maskHeads := 0
+	switch len(mask) {
+	case 0:
+	case seqK * seqQ:
+		maskHeads = 1
+	case seqK * seqQ * heads:
+		maskHeads = heads
+	default:
+		panic(fmt.Errorf("mask has %v elements, want %v or %v", len(mask), seqK*seqQ, seqK*seqQ*heads))
+	}
+
+	out := make([]float32, dv*heads*seqQ)
+	scores := make([]float64, seqK)
+	for h := range heads {
+		kvh := h / (heads / kvHeads)
+		for i := range seqQ {
+			maxScore := math.Inf(-1)
+			for j := range seqK {
+				var s float64
+				for d := range dk {
+					s += float64(query[d+dk*(i+seqQ*h)]) * float64(key[d+dk*(j+seqK*kvh)])
+				}
+
+				s *= scale
+				if maskHeads > 0 {
+					s += float64(mask[j+seqK*(i+seqQ*(h%maskHeads))])
+				}
+
+				scores[j] = s
+				maxScore = max(maxScore, s)
+			}
+
+			if math.IsInf(maxScore, -1) {
+				continue
+			}
+
+			var sum float64
+			for j, s := range scores {
+				scores[j] = math.Exp(s - maxScore)
+				sum += scores[j]
+			}
+
+			for d := range dv {
+				var o float64
+				for j, p := range scores {
+					o += p / sum * float64(value[j+seqK*(d+dv*kvh)])
+				}
+
+				out[d+dv*(h+heads*i)] = float32(o)
+			}
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,39 @@
+package nntest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAttentionReference(t *testing.T) {
+	inf := float32(math.Inf(-1))
+
+	// d_k = 1, seq_len_q = 2, heads = 2
+	query := []float32{1, 0, 2, 1}
+	// d_k = 1, seq_len_k = 2, kv_heads = 1
+	key := []float32{math.Ln2, 0}
+	// seq_len_k = 2, d_v = 1, kv_heads = 1
+	value := []float32{3, 6}
+	// the second query of the second head can't attend to any key
+	mask := []float32{0, 0, 0, 0, 0, 0, inf, inf}
+
+	shape := AttentionShape{KeyDim: 1, ValueDim: 1, SeqLenQ: 2, SeqLenK: 2, Heads: 2, KVHeads: 1}
+
+	// logits of ln 2 and 0 weight the values by 2/3 and 1/3, and 2·ln 2 and
+	// 0 by 4/5 and 1/5. the output has shape [d_v, heads, seq_len_q].
+	want := []float32{4, 3.6, 4.5, 0}
+	got := AttentionReference(query, key, value, mask, shape, 1)
+	for i := range want {
+		if math.Abs(float64(got[i]-want[i])) > 1e-6 {
+			t.Errorf("output %d: have %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for mask of the wrong length")
+		}
+	}()
+
+	AttentionReference(query, key, value, mask[:6], shape, 1)
+}
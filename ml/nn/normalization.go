@@ -4,19 +4,119 @@ import (
 	"github.com/ollama/ollama/ml"
 )
 
+// LayerNorm is layer normalization, which normalizes each row of its input
+// along the first dimension to a mean of 0 and a variance of 1. This is the
+// last dimension in the PyTorch order of dimensions.
 type LayerNorm struct {
 	Weight ml.Tensor `gguf:"weight"`
-	Bias   ml.Tensor `gguf:"bias"`
+
+	// Bias, if non-nil, is added after scaling by Weight
+	Bias ml.Tensor `gguf:"bias"`
 }
 
-func (m *LayerNorm) Forward(ctx ml.Context, t ml.Tensor, eps float32) ml.Tensor {
-	return t.LayerNorm(ctx, m.Weight, m.Bias, eps)
+// Forward computes (t - mean(t)) / √(var(t) + eps) * Weight + Bias. It panics
+// with a *ShapeMismatchError if Weight or Bias don't have an element for each
+// element of the normalized dimension.
+func (m *LayerNorm) Forward(ctx ml.Context, t ml.Tensor, eps float32, opts ...NormOption) ml.Tensor {
+	var o normOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	checkNormShape("layer norm", t, m.Weight, m.Bias)
+	return o.input(ctx, t).LayerNorm(ctx, m.Weight, m.Bias, eps)
 }
 
+// RMSNorm is root mean square normalization, which normalizes each row of
+// its input along the first dimension, such as the hidden dimension of a
+// hidden state with shape [hidden, seq_len] or d_k of queries and keys with
+// shape [d_k, heads, seq_len] before Attention. This is the last dimension in
+// the PyTorch order of dimensions.
 type RMSNorm struct {
 	Weight ml.Tensor `gguf:"weight"`
+
+	// Bias, if non-nil, is added after scaling by Weight
+	Bias ml.Tensor `gguf:"bias"`
+}
+
+// Forward computes t / √(mean(t²) + eps) * Weight + Bias, where Weight may
+// be offset by WithWeightOffset. Like LayerNorm, it panics if Weight or Bias
+// don't match the normalized dimension.
+func (m *RMSNorm) Forward(ctx ml.Context, t ml.Tensor, eps float32, opts ...NormOption) ml.Tensor {
+	var o normOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	checkNormShape("rms norm", t, m.Weight, m.Bias)
+
+	t = o.input(ctx, t)
+	if o.weightOffset == 0 {
+		t = t.RMSNorm(ctx, m.Weight, eps)
+	} else {
+		// x * (w + offset) = x * w + x * offset, which avoids a tensor for
+		// the offset
+		t = t.RMSNorm(ctx, nil, eps)
+		t = t.Mul(ctx, m.Weight).Add(ctx, t.Scale(ctx, float64(o.weightOffset)))
+	}
+
+	if m.Bias != nil {
+		t = t.Add(ctx, m.Bias)
+	}
+
+	return t
+}
+
+// NormOption modifies the computation of LayerNorm and RMSNorm
+type NormOption func(*normOptions)
+
+type normOptions struct {
+	weightOffset  float32
+	fullPrecision bool
+}
+
+// WithWeightOffset adds offset to the weight of RMSNorm, as in Gemma models
+// which scale by (1 + weight). GGUF conversion typically adds the offset to
+// the stored weights already, so this is only needed for weights that are
+// stored as trained.
+func WithWeightOffset(offset float32) NormOption {
+	return func(o *normOptions) {
+		o.weightOffset = offset
+	}
+}
+
+// WithFullPrecision normalizes in F32 even if the input has a lower
+// precision, which avoids overflow in the sum of squares
+func WithFullPrecision() NormOption {
+	return func(o *normOptions) {
+		o.fullPrecision = true
+	}
 }
 
-func (m *RMSNorm) Forward(ctx ml.Context, t ml.Tensor, eps float32) ml.Tensor {
-	return t.RMSNorm(ctx, m.Weight, eps)
+func (o *normOptions) input(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	if o.fullPrecision && t.DType() != ml.DTypeF32 {
+		t = t.Copy(ctx, ctx.Zeros(ml.DTypeF32, t.Shape()...))
+	}
+
+	return t
+}
+
+// checkNormShape panics if the first dimension of weight or bias, which may be
+// nil, doesn't match that of t
+func checkNormShape(op string, t, weight, bias ml.Tensor) {
+	for _, operand := range []struct {
+		name string
+		t    ml.Tensor
+	}{
+		{"weight", weight},
+		{"bias", bias},
+	} {
+		if operand.t == nil {
+			continue
+		}
+
+		if operand.t.Dim(0) != t.Dim(0) {
+			panic(&ShapeMismatchError{Op: op, Dim: "hidden", Other: "input", Want: t.Dim(0), Operand: operand.name, Got: operand.t.Dim(0)})
+		}
+	}
 }
@@ -0,0 +1,94 @@
+package nn
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+)
+
+func TestRMSNorm(t *testing.T) {
+	ctx := &testContext{}
+
+	x := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0, 0.5, 2}, 4, 2)
+	m := RMSNorm{Weight: ctx.fromFloats([]float32{0.5, 1, -1, 2}, 4)}
+
+	assertFloats(t, []float32{
+		0.182574, 0.730297, -1.095445, 2.921187,
+		-0.436436, 0, -0.436436, 3.491485,
+	}, m.Forward(ctx, x, 1e-6).Floats(), 1e-5)
+
+	// Gemma scales by (1 + weight)
+	assertFloats(t, []float32{
+		0.547723, 1.460593, 0, 4.38178,
+		-1.309307, 0, 0, 5.237227,
+	}, m.Forward(ctx, x, 1e-6, WithWeightOffset(1)).Floats(), 1e-5)
+
+	m.Bias = ctx.fromFloats([]float32{0.1, 0, 0, -0.1}, 4)
+	assertFloats(t, []float32{
+		0.282574, 0.730297, -1.095445, 2.821187,
+		-0.336436, 0, -0.436436, 3.391485,
+	}, m.Forward(ctx, x, 1e-6).Floats(), 1e-5)
+}
+
+func TestLayerNorm(t *testing.T) {
+	ctx := &testContext{}
+
+	x := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0, 0.5, 2}, 4, 2)
+	m := LayerNorm{
+		Weight: ctx.fromFloats([]float32{0.5, 1, -1, 2}, 4),
+		Bias:   ctx.fromFloats([]float32{0.1, 0, 0, -0.1}, 4),
+	}
+
+	assertFloats(t, []float32{
+		-0.57082, -0.447213, -0.447213, 2.58328,
+		-0.535085, -0.34641, -0.11547, 2.90222,
+	}, m.Forward(ctx, x, 1e-6).Floats(), 1e-5)
+}
+
+func TestNormShapeMismatch(t *testing.T) {
+	ctx := &testContext{}
+
+	x := ctx.fromFloats([]float32{1, 2, 3, 4, -1, 0, 0.5, 2}, 4, 2)
+	weight := ctx.fromFloats([]float32{1, 1, 1, 1}, 4)
+	short := ctx.fromFloats([]float32{1, 1}, 2)
+
+	for name, forward := range map[string]func(){
+		"layer norm weight": func() { (&LayerNorm{Weight: short}).Forward(ctx, x, 1e-6) },
+		"layer norm bias":   func() { (&LayerNorm{Weight: weight, Bias: short}).Forward(ctx, x, 1e-6) },
+		"rms norm weight":   func() { (&RMSNorm{Weight: short}).Forward(ctx, x, 1e-6) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				var err *ShapeMismatchError
+				if r, ok := recover().(error); !ok || !errors.As(r, &err) {
+					t.Fatalf("expected a shape mismatch, got %v", r)
+				}
+
+				if err.Got != 2 || err.Want != 4 {
+					t.Errorf("unexpected error %v", err)
+				}
+			}()
+
+			forward()
+		})
+	}
+
+	// the bias is optional
+	(&LayerNorm{Weight: weight}).Forward(ctx, x, 1e-6)
+}
+
+func TestNormFullPrecision(t *testing.T) {
+	ctx := &testContext{}
+
+	x := ctx.Zeros(ml.DTypeF16, 4, 2)
+	m := RMSNorm{Weight: ctx.fromFloats([]float32{1, 1, 1, 1}, 4)}
+
+	if dtype := m.Forward(ctx, x, 1e-6).DType(); dtype != ml.DTypeF16 {
+		t.Errorf("expected %v, got %v", ml.DTypeF16, dtype)
+	}
+
+	if dtype := m.Forward(ctx, x, 1e-6, WithFullPrecision()).DType(); dtype != ml.DTypeF32 {
+		t.Errorf("expected %v, got %v", ml.DTypeF32, dtype)
+	}
+}
@@ -0,0 +1,174 @@
+package nn
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// Pooler reduces the hidden states of each sequence to a single vector, for
+// embedding and classification models. PoolerFromConfig maps the
+// pooling_type of GGUF models to a Pooler.
+type Pooler int
+
+const (
+	// PoolerNone keeps the hidden state of every token, so it can't be used
+	// to pool a sequence
+	PoolerNone Pooler = iota
+
+	// PoolerMean averages the hidden states of all tokens
+	PoolerMean
+
+	// PoolerCLS takes the hidden state of the first token, the CLS token of
+	// BERT-style encoders
+	PoolerCLS
+
+	// PoolerLast takes the hidden state of the last token, as in decoder
+	// models where only the last token attends to the whole sequence
+	PoolerLast
+
+	// PoolerRank marks rerankers, which score sequences with a
+	// classification head. Models choose the token that is scored.
+	PoolerRank
+)
+
+// PoolerFromConfig reads the pooling type of a model from the pooling_type of
+// its metadata, or returns pooler if the model has none
+func PoolerFromConfig(c ml.Config, pooler Pooler) (Pooler, error) {
+	const unset = math.MaxUint32
+
+	// the values of llama_pooling_type in llama.cpp
+	switch v := c.Uint("pooling_type", unset); v {
+	case unset:
+		return pooler, nil
+	case 0:
+		return PoolerNone, nil
+	case 1:
+		return PoolerMean, nil
+	case 2:
+		return PoolerCLS, nil
+	case 3:
+		return PoolerLast, nil
+	case 4:
+		return PoolerRank, nil
+	default:
+		return PoolerNone, fmt.Errorf("unknown pooling_type %d", v)
+	}
+}
+
+// ParsePooler returns the pooling named s, which is "none", "mean", "cls" or
+// "last" as in the pooling option of embedding requests
+func ParsePooler(s string) (Pooler, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return PoolerNone, nil
+	case "mean":
+		return PoolerMean, nil
+	case "cls":
+		return PoolerCLS, nil
+	case "last":
+		return PoolerLast, nil
+	default:
+		return PoolerNone, fmt.Errorf("unknown pooling type %q", s)
+	}
+}
+
+func (p Pooler) String() string {
+	switch p {
+	case PoolerNone:
+		return "none"
+	case PoolerMean:
+		return "mean"
+	case PoolerCLS:
+		return "cls"
+	case PoolerLast:
+		return "last"
+	case PoolerRank:
+		return "rank"
+	default:
+		return fmt.Sprintf("Pooler(%d)", int(p))
+	}
+}
+
+// Forward pools hiddenState with shape [hidden, batch], where sequences is
+// the sequence of each token in the batch. Each sequence must be entirely
+// within the batch. The result has shape [hidden, num_sequences] with the
+// sequences in the order they first appear.
+func (p Pooler) Forward(ctx ml.Context, hiddenState ml.Tensor, sequences []int) (ml.Tensor, error) {
+	if len(sequences) != hiddenState.Dim(1) {
+		return nil, fmt.Errorf("length of sequences (%v) must match batch size (%v)", len(sequences), hiddenState.Dim(1))
+	}
+
+	// the tokens of each sequence in the order they first appear
+	var order []int
+	tokens := make(map[int][]int)
+	for i, seq := range sequences {
+		if _, ok := tokens[seq]; !ok {
+			order = append(order, seq)
+		}
+
+		tokens[seq] = append(tokens[seq], i)
+	}
+
+	switch p {
+	case PoolerCLS, PoolerLast:
+		ids := make([]int32, len(order))
+		for i, seq := range order {
+			if p == PoolerCLS {
+				ids[i] = int32(tokens[seq][0])
+			} else {
+				ids[i] = int32(tokens[seq][len(tokens[seq])-1])
+			}
+		}
+
+		t, err := ctx.FromIntSlice(ids, len(ids))
+		if err != nil {
+			return nil, err
+		}
+
+		return hiddenState.Rows(ctx, t), nil
+	case PoolerMean:
+		// the mean of each sequence is the product with a matrix whose
+		// column is 1/n for the n tokens of the sequence
+		weights := make([]float32, len(sequences)*len(order))
+		for i, seq := range order {
+			for _, token := range tokens[seq] {
+				weights[i*len(sequences)+token] = 1 / float32(len(tokens[seq]))
+			}
+		}
+
+		t, err := ctx.FromFloatSlice(weights, len(sequences), len(order))
+		if err != nil {
+			return nil, err
+		}
+
+		return hiddenState.Permute(ctx, 1, 0, 2, 3).Contiguous(ctx).Mulmat(ctx, t), nil
+	default:
+		return nil, fmt.Errorf("unsupported pooling type %v", p)
+	}
+}
+
+// ClassificationHead scores pooled hidden states, as in cross-encoder
+// rerankers and sequence classification models. If Dense is non-nil, the
+// input is first projected and passed through tanh, as in the pooler of BERT
+// and the classifier of RoBERTa.
+type ClassificationHead struct {
+	Dense  *Linear `gguf:"cls"`
+	Output *Linear `gguf:"cls.output"`
+}
+
+// Forward computes the scores of t with shape [hidden, num_sequences]. The
+// result has shape [labels, num_sequences].
+func (m *ClassificationHead) Forward(ctx ml.Context, t ml.Tensor) ml.Tensor {
+	if m.Dense != nil {
+		t = m.Dense.Forward(ctx, t).Tanh(ctx)
+	}
+
+	if m.Output != nil {
+		t = m.Output.Forward(ctx, t)
+	}
+
+	return t
+}
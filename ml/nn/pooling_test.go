@@ -0,0 +1,119 @@
+package nn
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+// TestPooler checks each pooling against its definition. Comparisons with
+// the embeddings of sentence-transformers models would need their weights
+// and a Python reference at test time, which the tests don't have.
+func TestPooler(t *testing.T) {
+	ctx := &testContext{}
+
+	// two tokens of sequence 3 followed by three tokens of sequence 1
+	hiddenState := ctx.fromFloats([]float32{
+		1, 2,
+		3, 4,
+		-1, 0,
+		5, 1,
+		2, -4,
+	}, 2, 5)
+	sequences := []int{3, 3, 1, 1, 1}
+
+	cases := []struct {
+		pooler Pooler
+		want   []float32
+	}{
+		{PoolerMean, []float32{2, 3, 2, -1}},
+		{PoolerCLS, []float32{1, 2, -1, 0}},
+		{PoolerLast, []float32{3, 4, 2, -4}},
+	}
+
+	for _, tt := range cases {
+		out, err := tt.pooler.Forward(ctx, hiddenState, sequences)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if shape := out.(*testTensor).ne(); shape != [4]int{2, 2, 1, 1} {
+			t.Fatalf("unexpected shape %v", shape)
+		}
+
+		assertFloats(t, tt.want, out.Floats(), 1e-6)
+	}
+
+	for _, p := range []Pooler{PoolerNone, PoolerRank} {
+		if _, err := p.Forward(ctx, hiddenState, sequences); err == nil {
+			t.Errorf("expected error for pooling %v", p)
+		}
+	}
+
+	if _, err := PoolerCLS.Forward(ctx, hiddenState, sequences[:4]); err == nil {
+		t.Error("expected error for mismatched sequences")
+	}
+}
+
+func TestClassificationHead(t *testing.T) {
+	ctx := &testContext{}
+
+	pooled := ctx.fromFloats([]float32{1, -1, 0.5, 2}, 2, 2)
+	output := &Linear{Weight: ctx.fromFloats([]float32{1, 2}, 2, 1), Bias: ctx.fromFloats([]float32{0.25}, 1)}
+
+	m := ClassificationHead{Output: output}
+	assertFloats(t, []float32{-0.75, 4.75}, m.Forward(ctx, pooled).Floats(), 1e-6)
+
+	m.Dense = &Linear{Weight: ctx.fromFloats([]float32{1, 0, 1, 1}, 2, 2)}
+
+	tanh := func(v float64) float32 { return float32(math.Tanh(v)) }
+	want := []float32{
+		tanh(1) + 2*tanh(0) + 0.25,
+		tanh(0.5) + 2*tanh(2.5) + 0.25,
+	}
+	assertFloats(t, want, m.Forward(ctx, pooled).Floats(), 1e-6)
+}
+
+func TestParsePooler(t *testing.T) {
+	for _, p := range []Pooler{PoolerNone, PoolerMean, PoolerCLS, PoolerLast} {
+		if got, err := ParsePooler(p.String()); err != nil || got != p {
+			t.Errorf("ParsePooler(%q) = %v, %v; want %v", p.String(), got, err, p)
+		}
+	}
+
+	for _, s := range []string{"max", "rank"} {
+		if _, err := ParsePooler(s); err == nil {
+			t.Errorf("expected error for pooling %q", s)
+		}
+	}
+}
+
+func TestPoolerFromConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		kv   ggml.KV
+		want Pooler
+	}{
+		{"unset", ggml.KV{}, PoolerLast},
+		{"none", ggml.KV{"llama.pooling_type": uint32(0)}, PoolerNone},
+		{"mean", ggml.KV{"llama.pooling_type": uint32(1)}, PoolerMean},
+		{"cls", ggml.KV{"llama.pooling_type": uint32(2)}, PoolerCLS},
+		{"last", ggml.KV{"llama.pooling_type": uint32(3)}, PoolerLast},
+		{"rank", ggml.KV{"llama.pooling_type": uint32(4)}, PoolerRank},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.kv["general.architecture"] = "llama"
+			if got, err := PoolerFromConfig(tt.kv, PoolerLast); err != nil || got != tt.want {
+				t.Errorf("got %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	kv := ggml.KV{"general.architecture": "llama", "llama.pooling_type": uint32(5)}
+	if _, err := PoolerFromConfig(kv, PoolerLast); err == nil {
+		t.Error("expected error for unknown pooling_type")
+	}
+}
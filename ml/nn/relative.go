@@ -0,0 +1,144 @@
+package nn
+
+import (
+	"math"
+	"slices"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// RelativePositionBias is the learned relative position bias of T5 and
+// related encoder-decoder models. Instead of position embeddings, each head
+// adds a bias to the attention logits that depends on the distance between the
+// query and key, bucketed so that nearby distances are distinguished exactly
+// and distant ones logarithmically.
+type RelativePositionBias struct {
+	// Weight has shape [heads, buckets]
+	Weight ml.Tensor `gguf:"weight"`
+
+	// the bucket indices of the last call to Forward, which are reused by
+	// other layers in the same context
+	ctx              ml.Context
+	seqLenQ, seqLenK int
+	opts             RelativePositionBiasOptions
+	buckets          ml.Tensor
+}
+
+// RelativePositionBiasOptions are the hyperparameters of RelativePositionBias
+type RelativePositionBiasOptions struct {
+	// Bidirectional splits the buckets between keys before and after the
+	// query, as in encoders. Otherwise, as in decoders, all keys after the
+	// query share a bucket with the query itself.
+	Bidirectional bool
+
+	// MaxDistance is the distance from which all keys share the last bucket,
+	// typically 128
+	MaxDistance int
+}
+
+// Forward returns the bias for seqLenQ queries attending to seqLenK keys with
+// shape [seq_len_k, seq_len_q, heads], which can be passed to Attention as the
+// mask or combined with other masks using CombineMasks. Queries are assumed
+// to correspond to the last seq_len_q keys.
+//
+// The bias differs between heads, so attention is computed by the unfused
+// implementation.
+func (m *RelativePositionBias) Forward(ctx ml.Context, seqLenQ, seqLenK int, opts RelativePositionBiasOptions) (ml.Tensor, error) {
+	heads, numBuckets := m.Weight.Dim(0), m.Weight.Dim(1)
+
+	if m.buckets == nil || m.ctx != ctx || m.seqLenQ != seqLenQ || m.seqLenK != seqLenK || m.opts != opts {
+		offset := seqLenK - seqLenQ
+
+		buckets := make([]int32, seqLenK*seqLenQ)
+		for i := range seqLenQ {
+			for j := range seqLenK {
+				buckets[i*seqLenK+j] = relativePositionBucket(j-i-offset, opts.Bidirectional, numBuckets, opts.MaxDistance)
+			}
+		}
+
+		t, err := ctx.FromIntSlice(buckets, len(buckets))
+		if err != nil {
+			return nil, err
+		}
+
+		m.ctx, m.seqLenQ, m.seqLenK, m.opts, m.buckets = ctx, seqLenQ, seqLenK, opts, t
+	}
+
+	bias := m.Weight.Rows(ctx, m.buckets)
+	bias = bias.Reshape(ctx, heads, seqLenK, seqLenQ)
+	return bias.Permute(ctx, 2, 0, 1, 3).Contiguous(ctx), nil
+}
+
+// relativePositionBucket returns the bucket of a key at relativePosition from
+// a query, where keys after the query have positive positions. This matches
+// _relative_position_bucket of T5 in Hugging Face transformers.
+func relativePositionBucket(relativePosition int, bidirectional bool, numBuckets, maxDistance int) int32 {
+	var bucket int
+	if bidirectional {
+		numBuckets /= 2
+		if relativePosition > 0 {
+			bucket += numBuckets
+		}
+
+		relativePosition = max(relativePosition, -relativePosition)
+	} else {
+		relativePosition = -min(relativePosition, 0)
+	}
+
+	// half of the buckets are for exact distances and the rest are for
+	// logarithmically larger distances up to maxDistance
+	maxExact := numBuckets / 2
+	if relativePosition < maxExact {
+		return int32(bucket + relativePosition)
+	}
+
+	large := maxExact + int(math.Log(float64(relativePosition)/float64(maxExact))/math.Log(float64(maxDistance)/float64(maxExact))*float64(numBuckets-maxExact))
+	return int32(bucket + min(large, numBuckets-1))
+}
+
+// RelativePositionAttention is Attention with the relative position
+// embeddings of Shaw et al. (2018), where the logit of query i and key j is
+//
+//	q_i·k_j + q_i·a_(j-i)
+//
+// before it is scaled, and a_r is the embedding of the key at relative
+// position r from the query. The same terms are the position scores of
+// Transformer-XL, whose global biases can be added to the query by the model.
+//
+// relPosEmbeddings has shape [d_k, 2*seq_len_k-1, heads] or [d_k,
+// 2*seq_len_k-1, 1] to share the embeddings between heads. Its rows are the
+// relative positions from -(seq_len_k-1) to seq_len_k-1, so row
+// seq_len_k-1 is that of a key at the same position as the query. Queries are
+// assumed to correspond to the last seq_len_q keys. Models that clip the
+// relative positions to k, as Shaw et al. do, gather the rows of their 2k+1
+// learned embeddings for each position with Rows.
+//
+// Relative positions always use the unfused implementation. Like Attention,
+// RelativePositionAttention panics if the shapes of the tensors are
+// inconsistent.
+func RelativePositionAttention(ctx ml.Context, query, key, value, relPosEmbeddings, mask ml.Tensor, scale float64, opts ...AttentionOption) ml.Tensor {
+	return Attention(ctx, query, key, value, mask, scale, slices.Concat(opts, []AttentionOption{
+		func(o *attentionOptions) {
+			o.relPos = relPosEmbeddings
+		},
+	})...)
+}
+
+// skew returns the scores of each query for each key from pos, the scores
+// of each query for each relative position with shape [2*seq_len_k-1,
+// seq_len_q, heads], where offset is the position of the first query in the
+// keys.
+//
+// Key j is at relative position j-offset-i from query i, so the scores of
+// each query are the slice of its row that starts one position before that
+// of the previous query. This is the shift of Transformer-XL, done by
+// viewing pos with rows that are one element shorter rather than by padding
+// and reshaping it.
+func skew(ctx ml.Context, pos ml.Tensor, seqLenK, offset int) ml.Tensor {
+	elem := pos.Stride(0)
+	return pos.View(ctx, (seqLenK-1-offset)*elem,
+		seqLenK, pos.Stride(1)-elem,
+		pos.Dim(1), pos.Stride(2),
+		pos.Dim(2),
+	)
+}
@@ -0,0 +1,181 @@
+package nn
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+)
+
+func TestRelativePositionBucket(t *testing.T) {
+	// buckets computed by _relative_position_bucket of T5 in Hugging Face
+	// transformers with the default 32 buckets and max_distance of 128
+	cases := []struct {
+		relativePosition      int
+		bidirectional, causal int32
+	}{
+		{-500, 15, 31},
+		{-128, 15, 31},
+		{-127, 15, 31},
+		{-64, 14, 26},
+		{-45, 12, 23},
+		{-32, 12, 21},
+		{-16, 10, 16},
+		{-12, 9, 12},
+		{-8, 8, 8},
+		{-1, 1, 1},
+		{0, 0, 0},
+		{1, 17, 0},
+		{8, 24, 0},
+		{12, 25, 0},
+		{16, 26, 0},
+		{32, 28, 0},
+		{64, 30, 0},
+		{100, 31, 0},
+		{128, 31, 0},
+		{500, 31, 0},
+	}
+
+	for _, tt := range cases {
+		if got := relativePositionBucket(tt.relativePosition, true, 32, 128); got != tt.bidirectional {
+			t.Errorf("bidirectional bucket of %v is %v, want %v", tt.relativePosition, got, tt.bidirectional)
+		}
+
+		if got := relativePositionBucket(tt.relativePosition, false, 32, 128); got != tt.causal {
+			t.Errorf("causal bucket of %v is %v, want %v", tt.relativePosition, got, tt.causal)
+		}
+	}
+}
+
+func TestRelativePositionBias(t *testing.T) {
+	ctx := &testContext{}
+
+	const heads, buckets = 2, 8
+
+	weight := make([]float32, heads*buckets)
+	for i := range weight {
+		weight[i] = float32(i)
+	}
+
+	m := RelativePositionBias{Weight: ctx.fromFloats(weight, heads, buckets)}
+
+	for _, tt := range []struct {
+		seqLenQ, seqLenK int
+		opts             RelativePositionBiasOptions
+	}{
+		{4, 4, RelativePositionBiasOptions{Bidirectional: true, MaxDistance: 16}},
+		{2, 5, RelativePositionBiasOptions{MaxDistance: 16}},
+		{1, 20, RelativePositionBiasOptions{MaxDistance: 16}},
+	} {
+		bias, err := m.Forward(ctx, tt.seqLenQ, tt.seqLenK, tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if shape := bias.Shape(); shape[0] != tt.seqLenK || shape[1] != tt.seqLenQ || shape[2] != heads {
+			t.Fatalf("unexpected shape %v", shape)
+		}
+
+		offset := tt.seqLenK - tt.seqLenQ
+		want := make([]float32, 0, tt.seqLenK*tt.seqLenQ*heads)
+		for h := range heads {
+			for i := range tt.seqLenQ {
+				for j := range tt.seqLenK {
+					bucket := relativePositionBucket(j-i-offset, tt.opts.Bidirectional, buckets, tt.opts.MaxDistance)
+					want = append(want, weight[int(bucket)*heads+h])
+				}
+			}
+		}
+
+		assertFloats(t, want, bias.Floats(), 0)
+
+		// the buckets are reused by later layers
+		cached := m.buckets
+		if _, err := m.Forward(ctx, tt.seqLenQ, tt.seqLenK, tt.opts); err != nil {
+			t.Fatal(err)
+		} else if m.buckets != cached {
+			t.Error("expected buckets to be reused")
+		}
+	}
+}
+
+func TestRelativePositionAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	const dk, seqLenK, dv = 2, 5, 2
+
+	values := func(n int, f func(int) float64) []float32 {
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(f(i))
+		}
+		return s
+	}
+
+	for _, tt := range []struct {
+		name                    string
+		seqLenQ, heads, kvHeads int
+		relHeads                int
+		causal                  bool
+		opts                    []AttentionOption
+	}{
+		{name: "Shared", seqLenQ: 5, heads: 2, kvHeads: 2, relHeads: 1},
+		{name: "PerHead", seqLenQ: 5, heads: 2, kvHeads: 2, relHeads: 2},
+		{name: "Grouped", seqLenQ: 3, heads: 4, kvHeads: 2, relHeads: 4, causal: true},
+		{name: "Decode", seqLenQ: 1, heads: 2, kvHeads: 1, relHeads: 1, causal: true},
+		// blocks of queries are offset from the first query
+		{name: "Blocks", seqLenQ: 3, heads: 2, kvHeads: 1, relHeads: 2, causal: true, opts: []AttentionOption{WithBlockSize(1)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			query := ctx.fromFloats(values(dk*tt.seqLenQ*tt.heads, func(i int) float64 { return math.Sin(float64(i)) }), dk, tt.seqLenQ, tt.heads)
+			key := ctx.fromFloats(values(dk*seqLenK*tt.kvHeads, func(i int) float64 { return math.Cos(float64(3 * i)) }), dk, seqLenK, tt.kvHeads)
+			value := ctx.fromFloats(values(seqLenK*dv*tt.kvHeads, func(i int) float64 { return float64(i%7) - 3 }), seqLenK, dv, tt.kvHeads)
+			rel := ctx.fromFloats(values(dk*(2*seqLenK-1)*tt.relHeads, func(i int) float64 { return math.Sin(float64(5*i)) / 2 }), dk, 2*seqLenK-1, tt.relHeads)
+
+			const scale = 0.7
+
+			// the position scores, scaled as the logits are, with the causal
+			// mask as a bias for the reference
+			offset := seqLenK - tt.seqLenQ
+			bias := ctx.Zeros(ml.DTypeF32, seqLenK, tt.seqLenQ, tt.heads).(*testTensor)
+			bias.each(func(j, i, h, _ int) {
+				var score float64
+				for d := range dk {
+					score += float64(query.at(d, i, h) * rel.at(d, j-offset-i+seqLenK-1, h%tt.relHeads))
+				}
+
+				if tt.causal && j > offset+i {
+					score = math.Inf(-1)
+				}
+				bias.data[bias.index(j, i, h)] = float32(scale * score)
+			})
+
+			var mask ml.Tensor
+			if tt.causal {
+				mask = CausalMask(ctx, tt.seqLenQ, seqLenK, 1, float32(math.Inf(-1)))
+			}
+
+			want := referenceAttention(query, key, value, bias, scale, ml.AttentionOptions{})
+			got := RelativePositionAttention(ctx, query, key, value, rel, mask, scale, tt.opts...)
+			assertFloats(t, want, got.Floats(), 1e-5)
+		})
+	}
+
+	t.Run("Shape", func(t *testing.T) {
+		defer func() {
+			var sme *ShapeMismatchError
+			if err, ok := recover().(error); !ok || !errors.As(err, &sme) || sme.Operand != "relative positions" || sme.Got != seqLenK {
+				t.Errorf("have %v; want a mismatch of the relative positions", err)
+			}
+		}()
+
+		query := ctx.fromFloats(make([]float32, dk*2), dk, 1, 2)
+		key := ctx.fromFloats(make([]float32, dk*seqLenK), dk, seqLenK, 1)
+		value := ctx.fromFloats(make([]float32, seqLenK*dv), seqLenK, dv, 1)
+
+		// one embedding for each key rather than each relative position
+		rel := ctx.fromFloats(make([]float32, dk*seqLenK), dk, seqLenK, 1)
+		RelativePositionAttention(ctx, query, key, value, rel, nil, 0)
+	})
+}
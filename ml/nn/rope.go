@@ -0,0 +1,228 @@
+package nn
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// RoPE applies rotary position embeddings to t with shape [d_k, heads,
+// seq_len], such as queries or keys before Attention. Adjacent pairs of the
+// first dim channels of the token at positions[i] are rotated by
+// positions[i] * base^(-2j/dim), where j is the index of the pair, and the
+// remaining channels are unchanged for partial rotary embeddings.
+//
+// The backend computes the sines and cosines from the positions, which are
+// converted to a tensor once and shared by all layers that apply RoPE with the
+// same positions in ctx.
+//
+// RoPE panics if there isn't a position for each token or if dim is larger
+// than d_k.
+func RoPE(ctx ml.Context, t ml.Tensor, positions []int32, dim int, base float64) ml.Tensor {
+	return RoPEWithOptions(ctx, t, positions, RoPEOptions{Dim: dim, Base: base})
+}
+
+// RoPEWithOptions is like RoPE but also scales the frequencies as described
+// by opts, such as to extend the context length of a model
+func RoPEWithOptions(ctx ml.Context, t ml.Tensor, positions []int32, opts RoPEOptions) ml.Tensor {
+	if len(positions) != t.Dim(2) {
+		panic(&ShapeMismatchError{Op: "rope", Dim: "seq_len", Other: "t", Want: t.Dim(2), Operand: "positions", Got: len(positions)})
+	}
+
+	p, err := ropePositions.get(ctx, positions)
+	if err != nil {
+		panic(err)
+	}
+
+	return opts.Forward(ctx, t, p)
+}
+
+// RoPE scaling types, as in the rope.scaling.type metadata of models
+const (
+	RoPEScalingNone   = "none"
+	RoPEScalingLinear = "linear"
+	RoPEScalingNTK    = "ntk"
+	RoPEScalingYaRN   = "yarn"
+	RoPEScalingLlama3 = "llama3"
+)
+
+// RoPEOptions are the parameters of rotary position embeddings
+//
+// Linear scaling divides the positions by Factor. NTK-aware scaling instead
+// multiplies Base by Factor^(dim/(dim-2)), which interpolates low frequencies
+// by about Factor while keeping high frequencies. YaRN interpolates low
+// frequencies and extrapolates high ones, and also scales the rotated
+// channels of queries and keys by MScale, which scales their attention
+// logits by MScale². The scale passed to Attention should therefore not
+// include this correction, unlike models whose reference implementation
+// multiplies the softmax scale by it instead.
+type RoPEOptions struct {
+	// Dim is the number of rotated channels, or all channels if zero, and
+	// Base is the base frequency
+	Dim  int
+	Base float64
+
+	// ScalingType is one of the RoPEScaling types, where empty is the same as
+	// RoPEScalingNone. Factor is the ratio of the extended context length to
+	// OriginalContextLength, the context length of training.
+	ScalingType           string
+	Factor                float64
+	OriginalContextLength int
+
+	// BetaFast and BetaSlow bound the frequencies that YaRN interpolates,
+	// which are 32 and 1 if zero
+	BetaFast, BetaSlow float64
+
+	// AttentionFactor additionally scales the rotated channels, as in the
+	// rope.scaling.attn_factor metadata, and is 1 if zero. YaRN always scales
+	// by 1 + 0.1 ln(Factor).
+	AttentionFactor float64
+
+	// LowFreqFactor and HighFreqFactor bound the wavelengths that Llama 3
+	// scaling smoothly interpolates, which are 1 and 4 if zero
+	LowFreqFactor, HighFreqFactor float64
+
+	// Factors, if non-nil, divides the frequency of each pair of channels,
+	// such as the rope_freqs.weight tensor of Llama 3 models, which is used
+	// instead of the factors derived from LowFreqFactor and HighFreqFactor
+	Factors ml.Tensor
+}
+
+// RoPEOptionsFromConfig reads the RoPE parameters of a model from its
+// metadata, where rope.freq_scale without a scaling type is linear scaling
+func RoPEOptionsFromConfig(c ml.Config) RoPEOptions {
+	opts := RoPEOptions{
+		Dim:                   int(c.Uint("rope.dimension_count")),
+		Base:                  float64(c.Float("rope.freq_base", 10000)),
+		ScalingType:           c.String("rope.scaling.type"),
+		Factor:                float64(c.Float("rope.scaling.factor")),
+		OriginalContextLength: int(c.Uint("rope.scaling.original_context_length", c.Uint("context_length"))),
+		BetaFast:              float64(c.Float("rope.scaling.yarn_beta_fast")),
+		BetaSlow:              float64(c.Float("rope.scaling.yarn_beta_slow")),
+		AttentionFactor:       float64(c.Float("rope.scaling.attn_factor")),
+	}
+
+	if opts.ScalingType == "" {
+		if scale := c.Float("rope.freq_scale", 1); opts.Factor == 0 && scale != 1 {
+			opts.Factor = 1 / float64(scale)
+		}
+
+		if opts.Factor != 0 {
+			opts.ScalingType = RoPEScalingLinear
+		}
+	}
+
+	return opts
+}
+
+// Forward applies rotary position embeddings to t with shape [d_k, heads,
+// seq_len] at positionIDs, which has an entry for each token
+func (o *RoPEOptions) Forward(ctx ml.Context, t, positionIDs ml.Tensor) ml.Tensor {
+	dim := cmp.Or(o.Dim, t.Dim(0))
+	if dim < 0 || dim > t.Dim(0) || dim%2 != 0 {
+		panic(fmt.Errorf("invalid rope dimension %v for d_k(%v)", dim, t.Dim(0)))
+	}
+
+	scaling := ml.RoPEScaling{
+		FreqScale:             1,
+		AttnFactor:            float32(cmp.Or(o.AttentionFactor, 1)),
+		BetaFast:              float32(cmp.Or(o.BetaFast, 32)),
+		BetaSlow:              float32(cmp.Or(o.BetaSlow, 1)),
+		OriginalContextLength: o.OriginalContextLength,
+	}
+
+	base := o.Base
+	factors := o.Factors
+	switch o.ScalingType {
+	case "", RoPEScalingNone:
+	case RoPEScalingLinear:
+		scaling.FreqScale = float32(1 / cmp.Or(o.Factor, 1))
+	case RoPEScalingNTK:
+		if dim > 2 {
+			base *= math.Pow(cmp.Or(o.Factor, 1), float64(dim)/float64(dim-2))
+		}
+	case RoPEScalingYaRN:
+		scaling.FreqScale = float32(1 / cmp.Or(o.Factor, 1))
+		scaling.ExtFactor = 1
+	case RoPEScalingLlama3:
+		if factors == nil {
+			var err error
+			factors, err = ctx.FromFloatSlice(o.llama3Factors(dim), dim/2)
+			if err != nil {
+				panic(err)
+			}
+		}
+	default:
+		panic(fmt.Errorf("unsupported rope scaling type %q", o.ScalingType))
+	}
+
+	return t.RoPEScaled(ml.Name(ctx, "rope"), positionIDs, factors, uint32(dim), float32(base), scaling)
+}
+
+// MScale returns the scale of the magnitude of the rotated channels, which is
+// 1 + 0.1 ln(Factor) for YaRN times AttentionFactor
+func (o *RoPEOptions) MScale() float64 {
+	mscale := cmp.Or(o.AttentionFactor, 1)
+	if o.ScalingType == RoPEScalingYaRN {
+		mscale *= 1 + 0.1*math.Log(cmp.Or(o.Factor, 1))
+	}
+
+	return mscale
+}
+
+// llama3Factors returns the divisors of the frequency of each pair of channels
+// for Llama 3 scaling, which interpolates low frequencies by Factor, keeps
+// high frequencies and smoothly interpolates between them
+func (o *RoPEOptions) llama3Factors(dim int) []float32 {
+	factor := cmp.Or(o.Factor, 1)
+	low, high := cmp.Or(o.LowFreqFactor, 1), cmp.Or(o.HighFreqFactor, 4)
+	contextLength := float64(o.OriginalContextLength)
+
+	factors := make([]float32, dim/2)
+	for i := range factors {
+		wavelength := 2 * math.Pi * math.Pow(o.Base, float64(2*i)/float64(dim))
+		switch {
+		case wavelength < contextLength/high:
+			factors[i] = 1
+		case wavelength > contextLength/low:
+			factors[i] = float32(factor)
+		default:
+			smooth := (contextLength/wavelength - low) / (high - low)
+			factors[i] = float32(1 / ((1-smooth)/factor + smooth))
+		}
+	}
+
+	return factors
+}
+
+// ropePositions caches the positions tensor of the last call to RoPE, which
+// typically has the same positions for each layer of a forward pass
+var ropePositions positionCache
+
+type positionCache struct {
+	mu        sync.Mutex
+	ctx       ml.Context
+	positions []int32
+	t         ml.Tensor
+}
+
+func (c *positionCache) get(ctx ml.Context, positions []int32) (ml.Tensor, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.t != nil && c.ctx == ctx && slices.Equal(c.positions, positions) {
+		return c.t, nil
+	}
+
+	t, err := ctx.FromIntSlice(positions, len(positions))
+	if err != nil {
+		return nil, err
+	}
+
+	c.ctx, c.positions, c.t = ctx, slices.Clone(positions), t
+	return t, nil
+}
@@ -0,0 +1,172 @@
+package nn
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+func TestRoPE(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 6, heads = 1, seq_len = 2, of which the first 4 channels are
+	// rotated
+	x := ctx.fromFloats([]float32{0.5, -1, 2, 0.25, 1, -2, 1, 2, 3, 4, 5, 6}, 6, 1, 2)
+
+	assertFloats(t, []float32{
+		-0.353876, 1.060553, 1.991601, 0.309879, 1, -2,
+		-0.560071, 2.164791, 2.712882, 4.200033, 5, 6,
+	}, RoPE(ctx, x, []int32{3, 7}, 4, 10000).Floats(), 1e-5)
+
+	// the positions are shared by later layers
+	cached := ropePositions.t
+	RoPE(ctx, x, []int32{3, 7}, 4, 10000)
+	if ropePositions.t != cached {
+		t.Error("expected positions to be reused")
+	}
+
+	RoPE(ctx, x, []int32{4, 8}, 4, 10000)
+	if ropePositions.t == cached {
+		t.Error("expected new positions")
+	}
+
+	for _, tt := range []struct {
+		positions []int32
+		dim       int
+	}{
+		{[]int32{0}, 4},
+		{[]int32{0, 1}, 8},
+		{[]int32{0, 1}, 3},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a panic for %v positions and dim %v", len(tt.positions), tt.dim)
+				}
+			}()
+
+			RoPE(ctx, x, tt.positions, tt.dim, 10000)
+		}()
+	}
+}
+
+func TestRoPEScaling(t *testing.T) {
+	ctx := &testContext{}
+
+	// d_k = 8, heads = 1, seq_len = 2
+	x := ctx.fromFloats([]float32{0.5, -1, 2, 0.25, 1, -2, 0.75, 1.5, 1, 2, 3, 4, 5, 6, 7, 8}, 8, 1, 2)
+	positions := []int32{100, 5000}
+
+	// computed with the rope_init_fn of each type in Hugging Face transformers
+	cases := []struct {
+		name string
+		opts RoPEOptions
+		want []float32
+	}{
+		{
+			"linear",
+			RoPEOptions{Dim: 8, Base: 10000, ScalingType: RoPEScalingLinear, Factor: 2},
+			[]float32{
+				0.22011, -1.09615, 0.80706, -1.84693, 1.83643, -1.27574, 0.67409, 1.53561,
+				2.06008, 0.86952, 4.60508, -1.94763, 5.75012, 5.28546, -10.39578, -2.21984,
+			},
+		},
+		{
+			"ntk",
+			RoPEOptions{Dim: 8, Base: 10000, ScalingType: RoPEScalingNTK, Factor: 4},
+			[]float32{
+				-0.07521, -1.1155, 1.99563, 0.2828, 1.69531, -1.45805, 0.71227, 1.51828,
+				2.1306, -0.67863, -0.88283, 4.92144, -2.29479, 7.46552, -5.38462, 9.16547,
+			},
+		},
+		{
+			"yarn",
+			RoPEOptions{Dim: 8, Base: 10000, ScalingType: RoPEScalingYaRN, Factor: 4, OriginalContextLength: 4096},
+			[]float32{
+				-0.08563, -1.27014, -1.75592, -1.47772, 2.2558, -1.18056, 0.81101, 1.72876,
+				2.42597, -0.77271, -0.88866, -5.62336, 6.74333, 5.79763, -6.13109, 10.43608,
+			},
+		},
+		{
+			"llama3",
+			RoPEOptions{Dim: 8, Base: 500000, ScalingType: RoPEScalingLlama3, Factor: 8, OriginalContextLength: 8192},
+			[]float32{
+				-0.07521, -1.1155, -1.48385, -1.36407, 1.10354, -1.94479, 0.749, 1.5005,
+				2.1306, -0.67863, 4.47606, 2.22821, -7.31317, -2.74182, 6.73027, 8.22821,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assertFloats(t, tt.want, RoPEWithOptions(ctx, x, positions, tt.opts).Floats(), 1e-4)
+		})
+	}
+}
+
+func TestRoPEOptionsFromConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		kv   ggml.KV
+		want RoPEOptions
+	}{
+		{
+			"none",
+			ggml.KV{"llama.rope.dimension_count": uint32(128), "llama.rope.freq_base": float32(500000), "llama.context_length": uint32(8192)},
+			RoPEOptions{Dim: 128, Base: 500000, OriginalContextLength: 8192},
+		},
+		{
+			"freq scale",
+			ggml.KV{"llama.rope.dimension_count": uint32(128), "llama.rope.freq_scale": float32(0.25)},
+			RoPEOptions{Dim: 128, Base: 10000, ScalingType: RoPEScalingLinear, Factor: 4},
+		},
+		{
+			"yarn",
+			ggml.KV{
+				"llama.rope.dimension_count":                 uint32(128),
+				"llama.rope.freq_base":                       float32(1000000),
+				"llama.context_length":                       uint32(131072),
+				"llama.rope.scaling.type":                    "yarn",
+				"llama.rope.scaling.factor":                  float32(4),
+				"llama.rope.scaling.original_context_length": uint32(32768),
+			},
+			RoPEOptions{Dim: 128, Base: 1000000, ScalingType: RoPEScalingYaRN, Factor: 4, OriginalContextLength: 32768},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.kv["general.architecture"] = "llama"
+			if got := RoPEOptionsFromConfig(tt.kv); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoPEMScale(t *testing.T) {
+	ctx := &testContext{}
+
+	opts := RoPEOptions{Dim: 2, Base: 10000, ScalingType: RoPEScalingYaRN, Factor: 4, OriginalContextLength: 4096}
+	if mscale, want := opts.MScale(), 1+0.1*math.Log(4); math.Abs(mscale-want) > 1e-9 {
+		t.Fatalf("mscale is %v, want %v", mscale, want)
+	}
+
+	// the logits of a query and key at the same position are only scaled by
+	// mscale², so Attention needs no further correction
+	q := ctx.fromFloats([]float32{1, 2}, 2, 1, 1)
+	k := ctx.fromFloats([]float32{3, -1}, 2, 1, 1)
+	q = RoPEWithOptions(ctx, q, []int32{9}, opts).(*testTensor)
+	k = RoPEWithOptions(ctx, k, []int32{9}, opts).(*testTensor)
+
+	logit := k.Mulmat(ctx, q).Floats()[0]
+	want := (1*3 + 2*-1) * opts.MScale() * opts.MScale()
+	if math.Abs(float64(logit)-want) > 1e-5 {
+		t.Errorf("logit is %v, want %v", logit, want)
+	}
+
+	if mscale := (&RoPEOptions{ScalingType: RoPEScalingLinear, Factor: 4}).MScale(); mscale != 1 {
+		t.Errorf("linear scaling has mscale %v", mscale)
+	}
+}
@@ -0,0 +1,236 @@
+package nn
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+
+	"github.com/ollama/ollama/ml"
+)
+
+// SparsePattern describes the blocks of keys that each block of queries
+// attends to in block-sparse attention, as in BigBird and Longformer. The
+// sequence is split into blocks of BlockSize tokens and each query block
+// attends to the global blocks, the blocks within its window and a number of
+// random blocks.
+type SparsePattern struct {
+	// BlockSize is the number of tokens in each block, which must divide
+	// seq_len
+	BlockSize int
+
+	// Global is the number of blocks at the start of the sequence that
+	// attend to every block and are attended to by every block, such as
+	// those holding a classification token
+	Global int
+
+	// Window is the number of blocks on each side of a query block that it
+	// attends to in addition to its own block
+	Window int
+
+	// Random is the number of other blocks that each query block attends to,
+	// chosen at random
+	Random int
+
+	// Seed seeds the choice of random blocks, so that the same blocks are
+	// chosen by each layer and forward pass
+	Seed uint64
+
+	// Causal masks the keys after each query, including those of blocks
+	// after the query block
+	Causal bool
+}
+
+func (p SparsePattern) validate(seqLen int) error {
+	if p.BlockSize <= 0 || seqLen%p.BlockSize != 0 {
+		return fmt.Errorf("block size(%v) in sparse attention does not divide seq_len(%v)", p.BlockSize, seqLen)
+	}
+
+	if p.Global < 0 || p.Window < 0 || p.Random < 0 {
+		return fmt.Errorf("invalid sparse attention pattern %+v", p)
+	}
+
+	return nil
+}
+
+// Blocks returns the key blocks attended to by each of n query blocks in
+// ascending order
+func (p SparsePattern) Blocks(n int) [][]int {
+	r := rand.New(rand.NewPCG(p.Seed, 0))
+
+	blocks := make([][]int, n)
+	for i := range blocks {
+		last := n - 1
+		if p.Causal {
+			last = i
+		}
+
+		if i < p.Global {
+			for j := range last + 1 {
+				blocks[i] = append(blocks[i], j)
+			}
+			continue
+		}
+
+		attends := make([]bool, last+1)
+		for j := range min(p.Global, last+1) {
+			attends[j] = true
+		}
+
+		for j := max(i-p.Window, 0); j <= min(i+p.Window, last); j++ {
+			attends[j] = true
+		}
+
+		var candidates []int
+		for j, ok := range attends {
+			if !ok {
+				candidates = append(candidates, j)
+			}
+		}
+
+		r.Shuffle(len(candidates), func(a, b int) { candidates[a], candidates[b] = candidates[b], candidates[a] })
+		for _, j := range candidates[:min(p.Random, len(candidates))] {
+			attends[j] = true
+		}
+
+		for j, ok := range attends {
+			if ok {
+				blocks[i] = append(blocks[i], j)
+			}
+		}
+	}
+
+	return blocks
+}
+
+// BlockSparseMask builds an additive mask with shape [seq_len, seq_len, 1]
+// for the keys attended to by each query according to pattern, which can be
+// passed to Attention. This computes the scores of every key, so
+// BlockSparseAttention is faster for long sequences.
+func BlockSparseMask(ctx ml.Context, seqLen int, pattern SparsePattern) (ml.Tensor, error) {
+	if err := pattern.validate(seqLen); err != nil {
+		return nil, err
+	}
+
+	mask := make([]float32, seqLen*seqLen)
+	for i := range mask {
+		mask[i] = float32(math.Inf(-1))
+	}
+
+	size := pattern.BlockSize
+	for i, blocks := range pattern.Blocks(seqLen / size) {
+		for q := i * size; q < (i+1)*size; q++ {
+			for _, j := range blocks {
+				end := (j + 1) * size
+				if pattern.Causal {
+					end = min(end, q+1)
+				}
+
+				clear(mask[q*seqLen+j*size : q*seqLen+end])
+			}
+		}
+	}
+
+	t, err := ctx.FromFloatSlice(mask, seqLen, seqLen, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// BlockSparseAttention computes self-attention where each block of queries
+// only attends to the blocks of keys given by pattern, as in BigBird and
+// Longformer. Rather than masking the other keys, each query block attends
+// to its key blocks alone, so the cost grows with the number of blocks that
+// are attended to instead of with the square of seq_len.
+//
+// query has shape [d_k, seq_len, heads], key [d_k, seq_len, kv_heads] and
+// value [seq_len, d_v, kv_heads] as in Attention, with the queries and keys
+// at the same positions. opts are passed to Attention for each query block.
+// The result is the same as Attention with BlockSparseMask.
+//
+// BlockSparseAttention panics if the shapes of the tensors are inconsistent
+// or pattern.BlockSize doesn't divide seq_len.
+//
+// Returns:
+//
+//	Attention output with shape [d_v, heads, seq_len]
+func BlockSparseAttention(ctx ml.Context, query, key, value ml.Tensor, scale float64, pattern SparsePattern, opts ...AttentionOption) ml.Tensor {
+	seqLen := query.Dim(1)
+	if key.Dim(1) != seqLen {
+		panic(&ShapeMismatchError{Op: "block sparse attention", Dim: "seq_len", Other: "query", Want: seqLen, Operand: "key", Got: key.Dim(1)})
+	}
+
+	if value.Dim(0) != seqLen {
+		panic(&ShapeMismatchError{Op: "block sparse attention", Dim: "seq_len", Other: "query", Want: seqLen, Operand: "value", Got: value.Dim(0)})
+	}
+
+	if err := pattern.validate(seqLen); err != nil {
+		panic(err)
+	}
+
+	size := pattern.BlockSize
+
+	var outputs []ml.Tensor
+	for i, blocks := range pattern.Blocks(seqLen / size) {
+		q := query.View(ctx, query.Stride(1)*i*size,
+			query.Dim(0), query.Stride(1),
+			size, query.Stride(2),
+			query.Dim(2),
+		)
+
+		// consecutive key blocks are viewed together, so attending to a
+		// window only takes a single view
+		var k, v ml.Tensor
+		var positions []int32
+		for len(blocks) > 0 {
+			n := 1
+			for n < len(blocks) && blocks[n] == blocks[0]+n {
+				n++
+			}
+
+			start, length := blocks[0]*size, n*size
+			kr := key.View(ctx, key.Stride(1)*start,
+				key.Dim(0), key.Stride(1),
+				length, key.Stride(2),
+				key.Dim(2),
+			)
+
+			vr := value.View(ctx, value.Stride(0)*start,
+				length, value.Stride(1),
+				value.Dim(1), value.Stride(2),
+				value.Dim(2),
+			)
+
+			if k == nil {
+				k, v = kr, vr
+			} else {
+				k, v = k.Concat(ctx, kr, 1), v.Concat(ctx, vr, 0)
+			}
+
+			for j := range length {
+				positions = append(positions, int32(start+j))
+			}
+
+			blocks = blocks[n:]
+		}
+
+		var mask ml.Tensor
+		if pattern.Causal {
+			queryPositions := make([]int32, size)
+			for j := range queryPositions {
+				queryPositions[j] = int32(i*size + j)
+			}
+
+			var err error
+			mask, err = PositionMask(ctx, positions, queryPositions, 0)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		outputs = append(outputs, Attention(ctx, q, k, v, mask, scale, opts...))
+	}
+
+	return outputs[0].Stack(ctx, 2, outputs[1:]...)
+}
@@ -0,0 +1,123 @@
+package nn
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestSparsePatternBlocks(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern SparsePattern
+		want    [][]int
+	}{
+		{
+			name:    "window",
+			pattern: SparsePattern{BlockSize: 1, Window: 1},
+			want:    [][]int{{0, 1}, {0, 1, 2}, {1, 2, 3}, {2, 3, 4}, {3, 4}},
+		},
+		{
+			name:    "global",
+			pattern: SparsePattern{BlockSize: 1, Global: 1},
+			want:    [][]int{{0, 1, 2, 3, 4}, {0, 1}, {0, 2}, {0, 3}, {0, 4}},
+		},
+		{
+			name:    "causal",
+			pattern: SparsePattern{BlockSize: 1, Global: 1, Window: 1, Causal: true},
+			want:    [][]int{{0}, {0, 1}, {0, 1, 2}, {0, 2, 3}, {0, 3, 4}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pattern.Blocks(5); !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("have %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	// random blocks are in addition to the others and depend on the seed
+	pattern := SparsePattern{BlockSize: 1, Global: 1, Window: 1, Random: 2, Seed: 1}
+	blocks := pattern.Blocks(16)
+	for i, b := range blocks[1:] {
+		i++
+		if !slices.IsSorted(b) || !slices.Contains(b, 0) || !slices.Contains(b, i) {
+			t.Errorf("block %v attends to %v", i, b)
+		}
+
+		if want := 1 + min(i+1, 15) - max(i-1, 1) + 1 + 2; len(b) != want {
+			t.Errorf("block %v attends to %v blocks, want %v", i, len(b), want)
+		}
+	}
+
+	if !slices.EqualFunc(blocks, pattern.Blocks(16), slices.Equal) {
+		t.Error("blocks differ with the same seed")
+	}
+
+	pattern.Seed = 2
+	if slices.EqualFunc(blocks, pattern.Blocks(16), slices.Equal) {
+		t.Error("blocks are the same with a different seed")
+	}
+}
+
+func TestBlockSparseAttention(t *testing.T) {
+	ctx := &testContext{}
+
+	const seqLen = 8
+
+	random := func(seed float64, shape ...int) *testTensor {
+		n := 1
+		for _, s := range shape {
+			n *= s
+		}
+
+		s := make([]float32, n)
+		for i := range s {
+			s[i] = float32(math.Sin(seed + float64(i)))
+		}
+		return ctx.fromFloats(s, shape...)
+	}
+
+	// d_k = 4, heads = 4, kv_heads = 2
+	query := random(1, 4, seqLen, 4)
+	key := random(2, 4, seqLen, 2)
+	value := random(3, seqLen, 3, 2)
+
+	for _, tt := range []struct {
+		name    string
+		pattern SparsePattern
+	}{
+		{"window", SparsePattern{BlockSize: 2, Window: 1}},
+		{"global", SparsePattern{BlockSize: 2, Global: 1}},
+		{"random", SparsePattern{BlockSize: 2, Window: 1, Random: 1, Seed: 3}},
+		{"causal", SparsePattern{BlockSize: 2, Global: 1, Window: 1, Random: 1, Causal: true}},
+		{"dense", SparsePattern{BlockSize: 8}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mask, err := BlockSparseMask(ctx, seqLen, tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := Attention(ctx, query, key, value, mask, 0.5).Floats()
+			got := BlockSparseAttention(ctx, query, key, value, 0.5, tt.pattern)
+			if got.Dim(0) != 3 || got.Dim(1) != 4 || got.Dim(2) != seqLen {
+				t.Errorf("shape is %v, want %v", got.Shape(), []int{3, 4, seqLen})
+			}
+
+			assertFloats(t, want, got.Floats(), 1e-5)
+		})
+	}
+
+	if _, err := BlockSparseMask(ctx, seqLen, SparsePattern{BlockSize: 3}); err == nil {
+		t.Error("expected a block size that doesn't divide seq_len to fail")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a block size that doesn't divide seq_len to panic")
+		}
+	}()
+	BlockSparseAttention(ctx, query, key, value, 0.5, SparsePattern{BlockSize: 3})
+}
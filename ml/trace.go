@@ -0,0 +1,85 @@
+package ml
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Tracer is implemented by contexts that can record their compute graph, for
+// debugging the architecture of a model
+type Tracer interface {
+	// Name returns a context whose operations label the tensors they create,
+	// nested within the label of this context. The returned context shares
+	// the graph of this context and must not be closed.
+	Name(label string) Context
+
+	// Trace returns the tensors of the graph built by Forward
+	Trace() *Trace
+}
+
+// Name returns a context that labels the tensors created by its operations,
+// such as "blk.0.attn_q", if ctx supports tracing. Otherwise it returns ctx.
+func Name(ctx Context, label string) Context {
+	if t, ok := ctx.(Tracer); ok {
+		return t.Name(label)
+	}
+
+	return ctx
+}
+
+// Trace is the compute graph of a context. Tensors are in topological order,
+// so the inputs of an operation precede it.
+type Trace struct {
+	Tensors []TraceTensor `json:"tensors"`
+}
+
+// TraceTensor is a tensor of a Trace, either an input such as a weight, with
+// an Op of NONE, or the result of an operation
+type TraceTensor struct {
+	ID    int    `json:"id"`
+	Op    string `json:"op"`
+	Name  string `json:"name,omitempty"`
+	DType string `json:"dtype"`
+	Shape []int  `json:"shape"`
+
+	// Inputs are the IDs of the operands of Op
+	Inputs []int `json:"inputs,omitempty"`
+}
+
+// Ops returns the operations of the trace in order, excluding inputs
+func (t *Trace) Ops() []string {
+	var ops []string
+	for _, tt := range t.Tensors {
+		if len(tt.Inputs) > 0 {
+			ops = append(ops, tt.Op)
+		}
+	}
+
+	return ops
+}
+
+// WriteJSON writes the trace as JSON to w
+func (t *Trace) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+// WriteDOT writes the trace as a Graphviz graph to w
+func (t *Trace) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph {\n\tnode [shape=record];\n")
+	for _, tt := range t.Tensors {
+		label := fmt.Sprintf("%s|%s|%s %v", tt.Op, tt.Name, tt.DType, tt.Shape)
+		fmt.Fprintf(&b, "\tt%d [label=%q];\n", tt.ID, label)
+		for _, input := range tt.Inputs {
+			fmt.Fprintf(&b, "\tt%d -> t%d;\n", input, tt.ID)
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
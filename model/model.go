@@ -8,6 +8,7 @@ import (
 	_ "image/png"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
@@ -16,9 +17,11 @@ import (
 	_ "golang.org/x/image/tiff"
 	_ "golang.org/x/image/webp"
 
+	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/kvcache"
 	"github.com/ollama/ollama/ml"
 	_ "github.com/ollama/ollama/ml/backend"
+	"github.com/ollama/ollama/ml/nn"
 )
 
 // Options contains the inputs for a model forward pass
@@ -29,6 +32,10 @@ type Options struct {
 	Outputs   []int32
 
 	Images []image.Image
+
+	// Pooling, if not nil, overrides the pooling of the hidden states of
+	// each sequence by embedding models
+	Pooling *nn.Pooler
 }
 
 type config struct {
@@ -58,6 +65,31 @@ type Model interface {
 	Config() config
 }
 
+// TextClassifier is a model with a classification head, such as a
+// cross-encoder reranker
+type TextClassifier interface {
+	Model
+
+	// Score computes the classification head for each sequence of opts, which
+	// must be entirely within the batch. The result has shape [labels,
+	// sequences] with the sequences in the order they first appear in
+	// opts.Sequences.
+	Score(ml.Context, Options) (ml.Tensor, error)
+}
+
+// TextEmbedder is a model that pools its hidden states into an embedding
+// of each sequence, such as a sentence embedding model
+type TextEmbedder interface {
+	Model
+
+	// Embed computes the pooled hidden states of each sequence of opts,
+	// which must be entirely within the batch, with opts.Pooling if set
+	// and otherwise the pooling of the model. The result has shape
+	// [hidden, sequences] with the sequences in the order they first appear
+	// in opts.Sequences.
+	Embed(ml.Context, Options) (ml.Tensor, error)
+}
+
 var models = make(map[string]func(ml.Config) (Model, error))
 
 // Register registers a model constructor for the given architecture
@@ -164,7 +196,9 @@ func populateFields(base Base, v reflect.Value, tags ...Tag) reflect.Value {
 				}
 			}
 
-			if !canNil(tt) || !vv.IsNil() {
+			// fields of basic types configure a module rather than being
+			// loaded, so a module without any of its tensors is still nil
+			if !canNil(tt) && !isBasic(tt) || canNil(tt) && !vv.IsNil() {
 				allNil = false
 			}
 		}
@@ -217,6 +251,18 @@ func ParseTags(s string) (tag Tag) {
 	return
 }
 
+func isBasic(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
 func canNil(t reflect.Type) bool {
 	return t.Kind() == reflect.Chan ||
 		t.Kind() == reflect.Func ||
@@ -227,6 +273,30 @@ func canNil(t reflect.Type) bool {
 }
 
 func Forward(ctx ml.Context, m Model, opts Options) (ml.Tensor, error) {
+	return compute(ctx, m, opts, m.Forward)
+}
+
+// Score computes the classification head of m for the sequences of opts
+func Score(ctx ml.Context, m Model, opts Options) (ml.Tensor, error) {
+	c, ok := m.(TextClassifier)
+	if !ok {
+		return nil, errors.New("model does not support classification")
+	}
+
+	return compute(ctx, m, opts, c.Score)
+}
+
+// Embed computes the embeddings of m for the sequences of opts
+func Embed(ctx ml.Context, m Model, opts Options) (ml.Tensor, error) {
+	e, ok := m.(TextEmbedder)
+	if !ok {
+		return nil, errors.New("model does not support embeddings")
+	}
+
+	return compute(ctx, m, opts, e.Embed)
+}
+
+func compute(ctx ml.Context, m Model, opts Options, fn func(ml.Context, Options) (ml.Tensor, error)) (ml.Tensor, error) {
 	if len(opts.Positions) != len(opts.Sequences) {
 		return nil, fmt.Errorf("length of positions (%v) must match length of seqs (%v)", len(opts.Positions), len(opts.Sequences))
 	}
@@ -235,6 +305,19 @@ func Forward(ctx ml.Context, m Model, opts Options) (ml.Tensor, error) {
 		return nil, errors.New("batch size cannot be less than 1")
 	}
 
+	if path := envconfig.GraphTrace(); path != "" {
+		// written even if building the graph panics, to find the operation
+		// with the wrong shape
+		defer writeTrace(ctx, path)
+	}
+
+	var checks *nn.AttentionChecks
+	if envconfig.CheckAttention() {
+		checks = &nn.AttentionChecks{}
+		nn.SetAttentionChecks(checks)
+		defer nn.SetAttentionChecks(nil)
+	}
+
 	cache := m.Config().Cache
 	if cache != nil {
 		err := cache.StartForward(ctx, opts.Positions, opts.Sequences)
@@ -243,13 +326,62 @@ func Forward(ctx ml.Context, m Model, opts Options) (ml.Tensor, error) {
 		}
 	}
 
-	t, err := m.Forward(ctx, opts)
+	t, err := build(ctx, opts, fn)
 	if err != nil {
 		return nil, err
 	}
 
 	ctx.Forward(t)
-	ctx.Compute(t)
+	ctx.Compute(append([]ml.Tensor{t}, checks.Tensors()...)...)
+
+	if err := checks.Err(); err != nil {
+		slog.Error("attention check failed", "error", err)
+		return nil, err
+	}
 
 	return t, nil
 }
+
+// build builds the graph of fn for the batch of opts. Models that panic while
+// building it, such as for a shape that nn.Attention doesn't accept, return
+// an error instead, so that only the requests of the batch fail rather than
+// the runner.
+func build(ctx ml.Context, opts Options, fn func(ml.Context, Options) (ml.Tensor, error)) (t ml.Tensor, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = fmt.Errorf("failed to build graph: %w", e)
+			} else {
+				err = fmt.Errorf("failed to build graph: %v", r)
+			}
+		}
+	}()
+
+	return fn(ctx, opts)
+}
+
+// writeTrace writes the graph of ctx to path if the backend supports tracing
+func writeTrace(ctx ml.Context, path string) {
+	tracer, ok := ctx.(ml.Tracer)
+	if !ok {
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		slog.Warn("failed to write graph trace", "path", path, "error", err)
+		return
+	}
+	defer f.Close()
+
+	trace := tracer.Trace()
+	if filepath.Ext(path) == ".dot" {
+		err = trace.WriteDOT(f)
+	} else {
+		err = trace.WriteJSON(f)
+	}
+
+	if err != nil {
+		slog.Warn("failed to write graph trace", "path", path, "error", err)
+	}
+}
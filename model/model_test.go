@@ -134,3 +134,36 @@ func TestPopulateFieldsAlternateName(t *testing.T) {
 		t.Errorf("populateFields() set incorrect values (-want +got):\n%s", diff)
 	}
 }
+
+func TestPopulateFieldsConfig(t *testing.T) {
+	type fakeModel struct {
+		MLP    *nn.GLUFFN `gguf:"mlp"`
+		Shared *nn.GLUFFN `gguf:"shared"`
+		Expert *nn.GLUFFN `gguf:"expert"`
+	}
+
+	m := fakeModel{
+		MLP:    &nn.GLUFFN{Activation: nn.ActivationGELU},
+		Expert: &nn.GLUFFN{Activation: nn.ActivationGELU},
+	}
+	v := reflect.ValueOf(&m)
+	v.Elem().Set(populateFields(Base{b: &fakeBackend{
+		names: []string{
+			"mlp.ffn_up.weight",
+			"mlp.ffn_down.weight",
+		},
+	}}, v.Elem()))
+
+	// modules only configured by basic fields are nil without their tensors,
+	// but the configuration of allocated modules is kept
+	if diff := cmp.Diff(fakeModel{
+		MLP: &nn.GLUFFN{
+			Up:         &nn.Linear{Weight: &fakeTensor{Name: "mlp.ffn_up.weight"}},
+			Down:       &nn.Linear{Weight: &fakeTensor{Name: "mlp.ffn_down.weight"}},
+			Activation: nn.ActivationGELU,
+		},
+		Expert: &nn.GLUFFN{Activation: nn.ActivationGELU},
+	}, m); diff != "" {
+		t.Errorf("populateFields() set incorrect values (-want +got):\n%s", diff)
+	}
+}
@@ -1,7 +1,8 @@
 package llama
 
 import (
-	"math"
+	"errors"
+	"fmt"
 
 	"github.com/ollama/ollama/kvcache"
 	"github.com/ollama/ollama/ml"
@@ -12,8 +13,24 @@ import (
 type Options struct {
 	RopeFactors                      ml.Tensor `gguf:"rope_freqs.weight"`
 	hiddenSize, numHeads, numKVHeads int
-	eps, ropeBase, ropeScale         float32
-	ropeDim                          uint32
+	eps                              float32
+	rope                             nn.RoPEOptions
+	moe                              nn.MoEOptions
+	pooler                           nn.Pooler
+
+	// attention is shared by all layers, which attend with the mask of the
+	// cache
+	attention nn.AttentionConfig
+
+	// slidingWindow reports whether each layer uses sliding window
+	// attention, if only some of them do
+	slidingWindow []bool
+}
+
+func (o *Options) applyRoPE(ctx ml.Context, t, positionIDs ml.Tensor) ml.Tensor {
+	rope := o.rope
+	rope.Factors = o.RopeFactors
+	return rope.Forward(ctx, t, positionIDs)
 }
 
 type Model struct {
@@ -23,12 +40,29 @@ type Model struct {
 	TokenEmbedding *nn.Embedding `gguf:"token_embd"`
 	Layers         []Layer       `gguf:"blk"`
 	OutputNorm     *nn.RMSNorm   `gguf:"output_norm"`
-	Output         *nn.Linear    `gguf:"output,alt:token_embd"`
+
+	// Output is nil if the model ties it with TokenEmbedding
+	Output *nn.Linear `gguf:"output"`
+
+	// Classifier, if non-nil, scores sequences as in rerankers
+	Classifier *nn.ClassificationHead
 
 	*Options
 }
 
+const (
+	slidingWindowLayer = iota
+	globalLayer
+)
+
 func New(c ml.Config) (model.Model, error) {
+	// decoder models pool the last token, which attends to the whole
+	// sequence
+	pooler, err := nn.PoolerFromConfig(c, nn.PoolerLast)
+	if err != nil {
+		return nil, err
+	}
+
 	m := Model{
 		BytePairEncoding: model.NewBytePairEncoding(
 			c.String("tokenizer.ggml.pretokenizer", `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`),
@@ -46,13 +80,37 @@ func New(c ml.Config) (model.Model, error) {
 			numHeads:   int(c.Uint("attention.head_count")),
 			numKVHeads: int(c.Uint("attention.head_count_kv")),
 			eps:        c.Float("attention.layer_norm_rms_epsilon"),
-			ropeBase:   c.Float("rope.freq_base"),
-			ropeScale:  c.Float("rope.freq_scale", 1),
-			ropeDim:    c.Uint("rope.dimension_count"),
+			rope:       nn.RoPEOptionsFromConfig(c),
+			moe:        nn.MoEOptions{ExpertsUsed: int(c.Uint("expert_used_count")), NormalizeTopK: true},
+			pooler:     pooler,
 		},
 	}
 
-	m.Cache = kvcache.NewCausalCache(m.Shift)
+	m.attention.HeadDim = m.hiddenSize / m.numHeads
+
+	var sliding int
+	for i := range m.Layers {
+		if nn.SlidingWindowLayer(c, i) {
+			sliding++
+		}
+	}
+
+	window := int32(c.Uint("attention.sliding_window"))
+	switch sliding {
+	case 0:
+		m.Cache = kvcache.NewCausalCache(m.Shift)
+	case len(m.Layers):
+		m.Cache = kvcache.NewSWACache(window, m.Shift)
+	default:
+		// layers with global attention need every token while the others
+		// only need their window
+		m.slidingWindow = make([]bool, len(m.Layers))
+		for i := range m.Layers {
+			m.slidingWindow[i] = nn.SlidingWindowLayer(c, i)
+		}
+
+		m.Cache = kvcache.NewWrapperCache(kvcache.NewSWACache(window, m.Shift), kvcache.NewCausalCache(m.Shift))
+	}
 
 	return &m, nil
 }
@@ -64,20 +122,23 @@ type SelfAttention struct {
 	Output *nn.Linear `gguf:"attn_output"`
 }
 
-func (sa *SelfAttention) Forward(ctx ml.Context, hiddenState, positionIDs ml.Tensor, cache kvcache.Cache, opts *Options) ml.Tensor {
+func (sa *SelfAttention) Forward(ctx ml.Context, hiddenState, positionIDs ml.Tensor, cache kvcache.Cache, opts *Options) (ml.Tensor, error) {
 	batchSize := hiddenState.Dim(1)
 	headDim := opts.hiddenSize / opts.numHeads
 
-	q := sa.Query.Forward(ctx, hiddenState)
-	q = q.Reshape(ctx, headDim, opts.numHeads, batchSize)
-	q = q.RoPE(ctx, positionIDs, opts.RopeFactors, opts.ropeDim, opts.ropeBase, opts.ropeScale)
+	qCtx := ml.Name(ctx, "attn_q")
+	q := sa.Query.Forward(qCtx, hiddenState)
+	q = q.Reshape(qCtx, headDim, opts.numHeads, batchSize)
+	q = opts.applyRoPE(qCtx, q, positionIDs)
 
-	k := sa.Key.Forward(ctx, hiddenState)
-	k = k.Reshape(ctx, headDim, opts.numKVHeads, batchSize)
-	k = k.RoPE(ctx, positionIDs, opts.RopeFactors, opts.ropeDim, opts.ropeBase, opts.ropeScale)
+	kCtx := ml.Name(ctx, "attn_k")
+	k := sa.Key.Forward(kCtx, hiddenState)
+	k = k.Reshape(kCtx, headDim, opts.numKVHeads, batchSize)
+	k = opts.applyRoPE(kCtx, k, positionIDs)
 
-	v := sa.Value.Forward(ctx, hiddenState)
-	v = v.Reshape(ctx, headDim, opts.numKVHeads, batchSize)
+	vCtx := ml.Name(ctx, "attn_v")
+	v := sa.Value.Forward(vCtx, hiddenState)
+	v = v.Reshape(vCtx, headDim, opts.numKVHeads, batchSize)
 
 	cache.Put(ctx, k, v)
 	k, v, mask := cache.Get(ctx)
@@ -86,40 +147,43 @@ func (sa *SelfAttention) Forward(ctx ml.Context, hiddenState, positionIDs ml.Ten
 	k = k.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
 	v = v.Permute(ctx, 1, 2, 0, 3).Contiguous(ctx)
 
-	scaleFactor := 1.0 / math.Sqrt(float64(headDim))
-	kqv := nn.Attention(ctx, q, k, v, mask, scaleFactor)
-	kqv = kqv.Reshape(ctx, opts.hiddenSize, batchSize)
+	var attnOpts []nn.AttentionOption
+	if c, ok := cache.(kvcache.MaskedQueries); ok {
+		attnOpts = append(attnOpts, nn.WithMaskedQueries(c.MaskedQueries()))
+	}
 
-	return sa.Output.Forward(ctx, kqv)
-}
+	kqv, err := opts.attention.AttentionErr(ctx, q, k, v, mask, attnOpts...)
+	if err != nil {
+		return nil, err
+	}
 
-func (m *Model) Shift(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
-	return key.RoPE(ctx, shift, m.Options.RopeFactors, m.Options.ropeDim, m.Options.ropeBase, m.Options.ropeScale), nil
-}
+	kqv = kqv.Reshape(ctx, opts.hiddenSize, batchSize)
 
-type MLP struct {
-	Up   *nn.Linear `gguf:"ffn_up"`
-	Down *nn.Linear `gguf:"ffn_down"`
-	Gate *nn.Linear `gguf:"ffn_gate"`
+	return sa.Output.Forward(ml.Name(ctx, "attn_output"), kqv), nil
 }
 
-func (mlp *MLP) Forward(ctx ml.Context, hiddenState ml.Tensor, opts *Options) ml.Tensor {
-	hiddenState = mlp.Gate.Forward(ctx, hiddenState).SILU(ctx).Mul(ctx, mlp.Up.Forward(ctx, hiddenState))
-	return mlp.Down.Forward(ctx, hiddenState)
+func (m *Model) Shift(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
+	return m.Options.applyRoPE(ctx, key, shift), nil
 }
 
 type Layer struct {
 	AttentionNorm *nn.RMSNorm `gguf:"attn_norm"`
 	SelfAttention *SelfAttention
 	MLPNorm       *nn.RMSNorm `gguf:"ffn_norm"`
-	MLP           *MLP
+	MLP           *nn.GLUFFN
+
+	// MoE replaces MLP in mixture of experts models
+	MoE *nn.SparseMoE
 }
 
-func (l *Layer) Forward(ctx ml.Context, hiddenState, positionIDs, outputs ml.Tensor, cache kvcache.Cache, opts *Options) ml.Tensor {
+func (l *Layer) Forward(ctx ml.Context, hiddenState, positionIDs, outputs ml.Tensor, cache kvcache.Cache, opts *Options) (ml.Tensor, error) {
 	residual := hiddenState
 
-	hiddenState = l.AttentionNorm.Forward(ctx, hiddenState, opts.eps)
-	hiddenState = l.SelfAttention.Forward(ctx, hiddenState, positionIDs, cache, opts)
+	hiddenState = l.AttentionNorm.Forward(ml.Name(ctx, "attn_norm"), hiddenState, opts.eps)
+	hiddenState, err := l.SelfAttention.Forward(ctx, hiddenState, positionIDs, cache, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	// In the final layer (outputs != nil), optimize by pruning to just the token positions
 	// we need logits for.
@@ -128,45 +192,111 @@ func (l *Layer) Forward(ctx ml.Context, hiddenState, positionIDs, outputs ml.Ten
 		residual = residual.Rows(ctx, outputs)
 	}
 
-	hiddenState = hiddenState.Add(ctx, residual)
+	hiddenState = hiddenState.Add(ml.Name(ctx, "ffn_inp"), residual)
 	residual = hiddenState
 
-	hiddenState = l.MLPNorm.Forward(ctx, hiddenState, opts.eps)
-	hiddenState = l.MLP.Forward(ctx, hiddenState, opts)
-	return hiddenState.Add(ctx, residual)
+	hiddenState = l.MLPNorm.Forward(ml.Name(ctx, "ffn_norm"), hiddenState, opts.eps)
+	if l.MoE != nil {
+		hiddenState = l.MoE.Forward(ctx, hiddenState, &opts.moe)
+	} else {
+		hiddenState = l.MLP.Forward(ctx, hiddenState)
+	}
+
+	return hiddenState.Add(ml.Name(ctx, "l_out"), residual), nil
 }
 
 func (m *Model) Forward(ctx ml.Context, opts model.Options) (ml.Tensor, error) {
-	inputs, err := ctx.FromIntSlice(opts.Inputs, len(opts.Inputs))
+	outputs, err := ctx.FromIntSlice(opts.Outputs, len(opts.Outputs))
 	if err != nil {
 		return nil, err
 	}
 
-	positions, err := ctx.FromIntSlice(opts.Positions, len(opts.Positions))
+	hiddenState, err := m.hiddenState(ctx, opts, outputs)
 	if err != nil {
 		return nil, err
 	}
 
-	outputs, err := ctx.FromIntSlice(opts.Outputs, len(opts.Outputs))
+	return nn.Logits(ml.Name(ctx, "output"), hiddenState, m.Output, m.TokenEmbedding), nil
+}
+
+func (m *Model) Score(ctx ml.Context, opts model.Options) (ml.Tensor, error) {
+	if m.Classifier == nil {
+		return nil, errors.New("model does not have a classification head")
+	}
+
+	hiddenState, err := m.hiddenState(ctx, opts, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	hiddenState := m.TokenEmbedding.Forward(ctx, inputs)
+	// rerankers score the last token like the other pooling of decoder
+	// models
+	pooler := m.pooler
+	if pooler == nn.PoolerRank {
+		pooler = nn.PoolerLast
+	}
+
+	pooled, err := pooler.Forward(ctx, hiddenState, opts.Sequences)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Classifier.Forward(ctx, pooled), nil
+}
+
+func (m *Model) Embed(ctx ml.Context, opts model.Options) (ml.Tensor, error) {
+	hiddenState, err := m.hiddenState(ctx, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pooler := m.pooler
+	if opts.Pooling != nil {
+		pooler = *opts.Pooling
+	} else if pooler == nn.PoolerNone || pooler == nn.PoolerRank {
+		return nil, fmt.Errorf("model has pooling type %v, which doesn't embed sequences; set a pooling option", pooler)
+	}
+
+	return pooler.Forward(ctx, hiddenState, opts.Sequences)
+}
+
+// hiddenState computes the final hidden state of the inputs of opts. If
+// outputs is non-nil, only those inputs are computed in the last layer.
+func (m *Model) hiddenState(ctx ml.Context, opts model.Options, outputs ml.Tensor) (ml.Tensor, error) {
+	positions, err := ctx.FromIntSlice(opts.Positions, len(opts.Positions))
+	if err != nil {
+		return nil, err
+	}
+
+	hiddenState, err := m.TokenEmbedding.ForwardIDs(ml.Name(ctx, "token_embd"), opts.Inputs)
+	if err != nil {
+		return nil, err
+	}
 
 	for i, layer := range m.Layers {
 		m.Cache.SetLayer(i)
+		if m.slidingWindow != nil {
+			layerType := globalLayer
+			if m.slidingWindow[i] {
+				layerType = slidingWindowLayer
+			}
+
+			m.Cache.(*kvcache.WrapperCache).SetLayerType(layerType)
+		}
 
 		var lastLayerOutputs ml.Tensor
 		if i == len(m.Layers)-1 {
 			lastLayerOutputs = outputs
 		}
 
-		hiddenState = layer.Forward(ctx, hiddenState, positions, lastLayerOutputs, m.Cache, m.Options)
+		layerCtx := ml.Name(ctx, fmt.Sprintf("blk.%d", i))
+		hiddenState, err = layer.Forward(layerCtx, hiddenState, positions, lastLayerOutputs, m.Cache, m.Options)
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
 	}
 
-	hiddenState = m.OutputNorm.Forward(ctx, hiddenState, m.eps)
-	return m.Output.Forward(ctx, hiddenState), nil
+	return m.OutputNorm.Forward(ml.Name(ctx, "output_norm"), hiddenState, m.eps), nil
 }
 
 func init() {
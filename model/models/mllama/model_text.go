@@ -1,7 +1,6 @@
 package mllama
 
 import (
-	"math"
 	"slices"
 
 	"github.com/ollama/ollama/kvcache"
@@ -22,11 +21,11 @@ func (sa *TextSelfAttention) Forward(ctx ml.Context, hiddenState, positions, _ m
 
 	query := sa.Query.Forward(ctx, hiddenState)
 	query = query.Reshape(ctx, headDim, opts.numHeads, batchSize)
-	query = query.RoPE(ctx, positions, opts.RopeFactors, opts.ropeDim, opts.ropeBase, opts.ropeScale)
+	query = opts.applyRoPE(ctx, query, positions)
 
 	key := sa.Key.Forward(ctx, hiddenState)
 	key = key.Reshape(ctx, headDim, opts.numKVHeads, batchSize)
-	key = key.RoPE(ctx, positions, opts.RopeFactors, opts.ropeDim, opts.ropeBase, opts.ropeScale)
+	key = opts.applyRoPE(ctx, key, positions)
 
 	value := sa.Value.Forward(ctx, hiddenState)
 	value = value.Reshape(ctx, headDim, opts.numKVHeads, batchSize)
@@ -38,8 +37,7 @@ func (sa *TextSelfAttention) Forward(ctx ml.Context, hiddenState, positions, _ m
 	key = key.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
 	value = value.Permute(ctx, 1, 2, 0, 3).Contiguous(ctx)
 
-	scaleFactor := 1.0 / math.Sqrt(float64(headDim))
-	attention := nn.Attention(ctx, query, key, value, mask, scaleFactor)
+	attention := nn.Attention(ctx, query, key, value, mask, nn.DefaultAttentionScale(query), nn.WithMaskedQueries(cache.MaskedQueries()))
 	attention = attention.Reshape(ctx, opts.hiddenSize, batchSize)
 
 	return sa.Output.Forward(ctx, attention)
@@ -47,18 +45,7 @@ func (sa *TextSelfAttention) Forward(ctx ml.Context, hiddenState, positions, _ m
 
 func (m *TextModel) Shift(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
 	// This will only get called for layers in the cache, which are just the self attention layers
-	return key.RoPE(ctx, shift, m.RopeFactors, m.ropeDim, m.ropeBase, m.ropeScale), nil
-}
-
-type TextMLP struct {
-	Up   *nn.Linear `gguf:"ffn_up"`
-	Down *nn.Linear `gguf:"ffn_down"`
-	Gate *nn.Linear `gguf:"ffn_gate"`
-}
-
-func (mlp *TextMLP) Forward(ctx ml.Context, hiddenState ml.Tensor, opts *TextModelOptions) ml.Tensor {
-	hiddenState = mlp.Gate.Forward(ctx, hiddenState).SILU(ctx).Mul(ctx, mlp.Up.Forward(ctx, hiddenState))
-	return mlp.Down.Forward(ctx, hiddenState)
+	return m.applyRoPE(ctx, key, shift), nil
 }
 
 type TextSelfAttentionDecoderLayer struct {
@@ -66,7 +53,7 @@ type TextSelfAttentionDecoderLayer struct {
 	SelfAttention *TextSelfAttention
 
 	MLPNorm *nn.RMSNorm `gguf:"ffn_norm"`
-	MLP     *TextMLP
+	MLP     *nn.GLUFFN
 }
 
 func (d *TextSelfAttentionDecoderLayer) Forward(ctx ml.Context, hiddenState, positions, outputs, mask, _, _ ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
@@ -86,7 +73,7 @@ func (d *TextSelfAttentionDecoderLayer) Forward(ctx ml.Context, hiddenState, pos
 	residual = hiddenState
 
 	hiddenState = d.MLPNorm.Forward(ctx, hiddenState, opts.eps)
-	hiddenState = d.MLP.Forward(ctx, hiddenState, opts)
+	hiddenState = d.MLP.Forward(ctx, hiddenState)
 	return hiddenState.Add(ctx, residual)
 }
 
@@ -127,8 +114,7 @@ func (ca *TextCrossAttention) Forward(ctx ml.Context, hiddenState, crossAttentio
 	key = key.Permute(ctx, 0, 2, 1, 3).Contiguous(ctx)
 	value = value.Permute(ctx, 1, 2, 0, 3).Contiguous(ctx)
 
-	scaleFactor := 1.0 / math.Sqrt(float64(headDim))
-	attention := nn.Attention(ctx, query, key, value, mask, scaleFactor)
+	attention := nn.CrossAttention(ctx, query, key, value, mask, nn.DefaultAttentionScale(query))
 	attention = attention.Reshape(ctx, opts.hiddenSize, batchSize)
 
 	return ca.Output.Forward(ctx, attention)
@@ -140,7 +126,7 @@ type TextCrossAttentionDecoderLayer struct {
 	AttentionGate  ml.Tensor `gguf:"cross_attn_attn_gate"`
 
 	MLPNorm *nn.RMSNorm `gguf:"ffn_norm"`
-	MLP     *TextMLP
+	MLP     *nn.GLUFFN
 	MLPGate ml.Tensor `gguf:"cross_attn_mlp_gate"`
 }
 
@@ -154,7 +140,7 @@ func (d *TextCrossAttentionDecoderLayer) Forward(ctx ml.Context, hiddenState, _,
 	residual = hiddenState
 
 	hiddenState = d.MLPNorm.Forward(ctx, hiddenState, opts.eps)
-	hiddenState = d.MLP.Forward(ctx, hiddenState, opts)
+	hiddenState = d.MLP.Forward(ctx, hiddenState)
 	hiddenState = hiddenState.Mul(ctx, d.MLPGate.Tanh(ctx))
 	return hiddenState.Add(ctx, residual)
 }
@@ -194,12 +180,18 @@ type TextModelOptions struct {
 	RopeFactors ml.Tensor `gguf:"rope_freqs.weight"`
 
 	hiddenSize, numHeads, numKVHeads int
-	eps, ropeBase, ropeScale         float32
-	ropeDim                          uint32
+	eps                              float32
+	rope                             nn.RoPEOptions
 
 	crossAttentionLayers []uint32
 }
 
+func (o *TextModelOptions) applyRoPE(ctx ml.Context, t, positionIDs ml.Tensor) ml.Tensor {
+	rope := o.rope
+	rope.Factors = o.RopeFactors
+	return rope.Forward(ctx, t, positionIDs)
+}
+
 type TextModel struct {
 	TokenEmbedding *nn.Embedding `gguf:"token_embd"`
 	Transformer    *TextDecoder  `gguf:"blk"`
@@ -236,9 +228,7 @@ func newTextModel(c ml.Config) *TextModel {
 			numHeads:             int(c.Uint("attention.head_count")),
 			numKVHeads:           int(c.Uint("attention.head_count_kv")),
 			eps:                  c.Float("attention.layer_norm_rms_epsilon"),
-			ropeBase:             c.Float("rope.freq_base"),
-			ropeScale:            c.Float("rope.freq_scale", 1),
-			ropeDim:              c.Uint("rope.dimension_count"),
+			rope:                 nn.RoPEOptionsFromConfig(c),
 			crossAttentionLayers: c.Uints("attention.cross_attention_layers"),
 		},
 	}
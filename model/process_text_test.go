@@ -137,6 +137,30 @@ func TestLlama(t *testing.T) {
 		}
 	})
 
+	t.Run("tilde", func(t *testing.T) {
+		t.Parallel()
+
+		// ~ is printable, so the byte-level encoding keeps it rather than
+		// mapping it to the rune of a space
+		cases := map[string][]int32{
+			"~":   {93},
+			" ~":  {4056},
+			"~~":  {5940},
+			"~ ~": {93, 4056},
+		}
+
+		for s, want := range cases {
+			ids, err := tokenizer.Encode(s)
+			if err != nil {
+				t.Error(err)
+			}
+
+			if diff := cmp.Diff(want, ids); diff != "" {
+				t.Errorf("%q no match (-theirs +ours):\n%s", s, diff)
+			}
+		}
+	})
+
 	t.Run("basic roundtrip", func(t *testing.T) {
 		t.Parallel()
 
@@ -149,6 +173,11 @@ func TestLlama(t *testing.T) {
 			" hello  ",
 			"hello world",
 			"请考试我的软件！12345",
+			// bytes that are mapped to other runes by the byte-level encoding
+			"~/.ollama",
+			"tab\tand\x7fdel",
+			"non\u00a0breaking\u00adsoft",
+			"🦙 llama",
 		}
 
 		for _, want := range cases {
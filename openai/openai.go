@@ -40,15 +40,32 @@ type Message struct {
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        Message         `json:"delta"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+type ChoiceLogprobs struct {
+	Content []Logprob `json:"content"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type Logprob struct {
+	TopLogprob
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
 }
 
 type CompleteChunkChoice struct {
@@ -58,9 +75,14 @@ type CompleteChunkChoice struct {
 }
 
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                  `json:"prompt_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
 }
 
 type ResponseFormat struct {
@@ -82,19 +104,23 @@ type StreamOptions struct {
 }
 
 type ChatCompletionRequest struct {
-	Model            string          `json:"model"`
-	Messages         []Message       `json:"messages"`
-	Stream           bool            `json:"stream"`
-	StreamOptions    *StreamOptions  `json:"stream_options"`
-	MaxTokens        *int            `json:"max_tokens"`
-	Seed             *int            `json:"seed"`
-	Stop             any             `json:"stop"`
-	Temperature      *float64        `json:"temperature"`
-	FrequencyPenalty *float64        `json:"frequency_penalty"`
-	PresencePenalty  *float64        `json:"presence_penalty"`
-	TopP             *float64        `json:"top_p"`
-	ResponseFormat   *ResponseFormat `json:"response_format"`
-	Tools            []api.Tool      `json:"tools"`
+	Model            string             `json:"model"`
+	Messages         []Message          `json:"messages"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	MaxTokens        *int               `json:"max_tokens"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Temperature      *float64           `json:"temperature"`
+	FrequencyPenalty *float64           `json:"frequency_penalty"`
+	PresencePenalty  *float64           `json:"presence_penalty"`
+	TopP             *float64           `json:"top_p"`
+	MinP             *float64           `json:"min_p"`
+	LogitBias        map[string]float32 `json:"logit_bias"`
+	Logprobs         bool               `json:"logprobs"`
+	TopLogprobs      int                `json:"top_logprobs"`
+	ResponseFormat   *ResponseFormat    `json:"response_format"`
+	Tools            []api.Tool         `json:"tools"`
 }
 
 type ChatCompletion struct {
@@ -119,18 +145,20 @@ type ChatCompletionChunk struct {
 
 // TODO (https://github.com/ollama/ollama/issues/5259): support []string, []int and [][]int
 type CompletionRequest struct {
-	Model            string         `json:"model"`
-	Prompt           string         `json:"prompt"`
-	FrequencyPenalty float32        `json:"frequency_penalty"`
-	MaxTokens        *int           `json:"max_tokens"`
-	PresencePenalty  float32        `json:"presence_penalty"`
-	Seed             *int           `json:"seed"`
-	Stop             any            `json:"stop"`
-	Stream           bool           `json:"stream"`
-	StreamOptions    *StreamOptions `json:"stream_options"`
-	Temperature      *float32       `json:"temperature"`
-	TopP             float32        `json:"top_p"`
-	Suffix           string         `json:"suffix"`
+	Model            string             `json:"model"`
+	Prompt           string             `json:"prompt"`
+	FrequencyPenalty float32            `json:"frequency_penalty"`
+	MaxTokens        *int               `json:"max_tokens"`
+	PresencePenalty  float32            `json:"presence_penalty"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	Temperature      *float32           `json:"temperature"`
+	TopP             float32            `json:"top_p"`
+	MinP             *float32           `json:"min_p"`
+	LogitBias        map[string]float32 `json:"logit_bias"`
+	Suffix           string             `json:"suffix"`
 }
 
 type Completion struct {
@@ -154,11 +182,11 @@ type CompletionChunk struct {
 }
 
 type ToolCall struct {
-	ID       string `json:"id"`
+	ID       string `json:"id,omitempty"`
 	Index    int    `json:"index"`
-	Type     string `json:"type"`
+	Type     string `json:"type,omitempty"`
 	Function struct {
-		Name      string `json:"name"`
+		Name      string `json:"name,omitempty"`
 		Arguments string `json:"arguments"`
 	} `json:"function"`
 }
@@ -208,11 +236,23 @@ func NewError(code int, message string) ErrorResponse {
 }
 
 func toUsage(r api.ChatResponse) Usage {
-	return Usage{
-		PromptTokens:     r.PromptEvalCount,
-		CompletionTokens: r.EvalCount,
-		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	return metricsUsage(r.Metrics)
+}
+
+// metricsUsage counts the tokens of the prompt that were in the cache, which
+// aren't evaluated, as prompt tokens
+func metricsUsage(m api.Metrics) Usage {
+	usage := Usage{
+		PromptTokens:     m.PromptEvalCount + m.PromptCacheCount,
+		CompletionTokens: m.EvalCount,
+		TotalTokens:      m.PromptEvalCount + m.PromptCacheCount + m.EvalCount,
 	}
+
+	if m.PromptCacheCount > 0 {
+		usage.PromptTokensDetails = &PromptTokensDetails{CachedTokens: m.PromptCacheCount}
+	}
+
+	return usage
 }
 
 func toolCallId() string {
@@ -243,6 +283,48 @@ func toToolCalls(tc []api.ToolCall) []ToolCall {
 	return toolCalls
 }
 
+// toToolCallDeltas converts the deltas of streamed tool calls, where only the
+// first delta of each call has its id, type and name
+func toToolCallDeltas(deltas []api.ToolCallDelta) []ToolCall {
+	toolCalls := make([]ToolCall, len(deltas))
+	for i, d := range deltas {
+		toolCalls[i].Index = d.Index
+		if d.Name != "" {
+			toolCalls[i].ID = toolCallId()
+			toolCalls[i].Type = "function"
+			toolCalls[i].Function.Name = d.Name
+		}
+		toolCalls[i].Function.Arguments = d.Arguments
+	}
+	return toolCalls
+}
+
+func toTopLogprob(l api.TokenLogprob) TopLogprob {
+	bytes := make([]int, len(l.Token))
+	for i, b := range []byte(l.Token) {
+		bytes[i] = int(b)
+	}
+
+	return TopLogprob{Token: l.Token, Logprob: l.Logprob, Bytes: bytes}
+}
+
+func toLogprobs(logprobs []api.Logprob) *ChoiceLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	content := make([]Logprob, len(logprobs))
+	for i, l := range logprobs {
+		content[i].TopLogprob = toTopLogprob(l.TokenLogprob)
+		content[i].TopLogprobs = make([]TopLogprob, len(l.TopLogprobs))
+		for j, top := range l.TopLogprobs {
+			content[i].TopLogprobs[j] = toTopLogprob(top)
+		}
+	}
+
+	return &ChoiceLogprobs{Content: content}
+}
+
 func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 	toolCalls := toToolCalls(r.Message.ToolCalls)
 	return ChatCompletion{
@@ -252,8 +334,9 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Message:  Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Logprobs: toLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(toolCalls) > 0 {
 					reason = "tool_calls"
@@ -269,7 +352,7 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 }
 
 func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChunk {
-	toolCalls := toToolCalls(r.Message.ToolCalls)
+	toolCalls := toToolCallDeltas(r.Message.ToolCallDeltas)
 	return ChatCompletionChunk{
 		Id:                id,
 		Object:            "chat.completion.chunk",
@@ -277,11 +360,12 @@ func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Delta:    Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Logprobs: toLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
-					if toolCallSent {
+					if toolCallSent || len(toolCalls) > 0 {
 						return &finishReasonToolCalls
 					}
 					return &reason
@@ -293,11 +377,7 @@ func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 }
 
 func toUsageGenerate(r api.GenerateResponse) Usage {
-	return Usage{
-		PromptTokens:     r.PromptEvalCount,
-		CompletionTokens: r.EvalCount,
-		TotalTokens:      r.PromptEvalCount + r.EvalCount,
-	}
+	return metricsUsage(r.Metrics)
 }
 
 func toCompletion(id string, r api.GenerateResponse) Completion {
@@ -508,6 +588,21 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["top_p"] = 1.0
 	}
 
+	// min_p isn't part of the OpenAI API, but is sent by clients that
+	// support other servers that implement it
+	if r.MinP != nil {
+		options["min_p"] = *r.MinP
+	}
+
+	if len(r.LogitBias) > 0 {
+		options["logit_bias"] = r.LogitBias
+	}
+
+	if r.Logprobs {
+		options["logprobs"] = true
+		options["top_logprobs"] = r.TopLogprobs
+	}
+
 	var format json.RawMessage
 	if r.ResponseFormat != nil {
 		switch strings.ToLower(strings.TrimSpace(r.ResponseFormat.Type)) {
@@ -573,6 +668,14 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 		options["top_p"] = 1.0
 	}
 
+	if r.MinP != nil {
+		options["min_p"] = *r.MinP
+	}
+
+	if len(r.LogitBias) > 0 {
+		options["logit_bias"] = r.LogitBias
+	}
+
 	return api.GenerateRequest{
 		Model:   r.Model,
 		Prompt:  r.Prompt,
@@ -640,6 +743,23 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 
 	// chat chunk
 	if w.stream {
+		// errors after the stream has started are sent as an event
+		var serr api.StatusError
+		if err := json.Unmarshal(data, &serr); err == nil && serr.ErrorMessage != "" {
+			d, err := json.Marshal(NewError(http.StatusInternalServerError, serr.ErrorMessage))
+			if err != nil {
+				return 0, err
+			}
+
+			w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+			_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+			if err != nil {
+				return 0, err
+			}
+
+			return len(data), nil
+		}
+
 		c := toChunk(w.id, chatResponse, w.toolCallSent)
 		d, err := json.Marshal(c)
 		if err != nil {
@@ -89,6 +89,10 @@ func TestChatMiddleware(t *testing.T) {
 				"frequency_penalty": 4.0,
 				"presence_penalty":  5.0,
 				"top_p":             6.0,
+				"min_p":             0.05,
+				"logit_bias":        {"9891": 100, "no": -100},
+				"logprobs":          true,
+				"top_logprobs":      2,
 				"response_format":   {"type": "json_object"}
 			}`,
 			req: api.ChatRequest{
@@ -107,6 +111,10 @@ func TestChatMiddleware(t *testing.T) {
 					"frequency_penalty": 4.0,
 					"presence_penalty":  5.0,
 					"top_p":             6.0,
+					"min_p":             0.05,
+					"logit_bias":        map[string]any{"9891": 100.0, "no": -100.0},
+					"logprobs":          true,
+					"top_logprobs":      2.0,
 				},
 				Format: json.RawMessage(`"json"`),
 				Stream: &True,
@@ -368,6 +376,141 @@ func TestChatMiddleware(t *testing.T) {
 	}
 }
 
+func TestChatLogprobs(t *testing.T) {
+	c := toChatCompletion("id", api.ChatResponse{
+		Message: api.Message{Role: "assistant", Content: "Hi"},
+		Logprobs: []api.Logprob{{
+			TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.25},
+			TopLogprobs:  []api.TokenLogprob{{Token: "Hi", Logprob: -0.25}, {Token: "é", Logprob: -2}},
+		}},
+	})
+
+	b, err := json.Marshal(c.Choices[0].Logprobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"content":[{"token":"Hi","logprob":-0.25,"bytes":[72,105],"top_logprobs":[{"token":"Hi","logprob":-0.25,"bytes":[72,105]},{"token":"é","logprob":-2,"bytes":[195,169]}]}]}`
+	if string(b) != want {
+		t.Errorf("logprobs = %s; want %s", b, want)
+	}
+
+	// logprobs are null unless they were requested
+	if c := toChunk("id", api.ChatResponse{Message: api.Message{Content: "Hi"}}, false); c.Choices[0].Logprobs != nil {
+		t.Errorf("logprobs = %v; want nil", c.Choices[0].Logprobs)
+	}
+}
+
+func TestChatStreamToolCalls(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	resp := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(resp)
+	w := &ChatWriter{stream: true, id: "id", BaseWriter: BaseWriter{ResponseWriter: c.Writer}}
+
+	for _, r := range []any{
+		api.ChatResponse{Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather"}}}},
+		api.ChatResponse{Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `{"location":`}}}},
+		api.ChatResponse{Message: api.Message{
+			Role:           "assistant",
+			ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `"Paris"}`}, {Index: 1, Name: "get_time", Arguments: `{}`}},
+			ToolCalls:      []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}}},
+		}},
+		gin.H{"error": "invalid tool call: unexpected end of response"},
+	} {
+		data, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var events []string
+	for _, line := range strings.Split(resp.Body.String(), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			events = append(events, data)
+		}
+	}
+
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d: %v", len(events), events)
+	}
+
+	type delta struct {
+		ID       string `json:"id"`
+		Index    int    `json:"index"`
+		Type     string `json:"type"`
+		Function struct {
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		} `json:"function"`
+	}
+
+	var calls []delta
+	for _, event := range events[:3] {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					ToolCalls []delta `json:"tool_calls"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(event), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		calls = append(calls, chunk.Choices[0].Delta.ToolCalls...)
+	}
+
+	// only the first delta of each call has its id, type and name, and
+	// complete calls aren't repeated
+	if len(calls) != 4 {
+		t.Fatalf("expected 4 tool call deltas, got %d: %+v", len(calls), calls)
+	}
+
+	for i, want := range []struct {
+		index           int
+		first           bool
+		name, arguments string
+	}{
+		{0, true, "get_weather", ""},
+		{0, false, "", `{"location":`},
+		{0, false, "", `"Paris"}`},
+		{1, true, "get_time", "{}"},
+	} {
+		call := calls[i]
+		if call.Index != want.index || (call.ID != "") != want.first || (call.Type == "function") != want.first ||
+			call.Function.Name != want.name || call.Function.Arguments != want.arguments {
+			t.Errorf("delta %d = %+v; want %+v", i, call, want)
+		}
+	}
+
+	var errResp ErrorResponse
+	if err := json.Unmarshal([]byte(events[3]), &errResp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(errResp.Error.Message, "unexpected end") {
+		t.Errorf("expected a final error event, got %s", events[3])
+	}
+}
+
+func TestUsageCachedTokens(t *testing.T) {
+	u := toUsage(api.ChatResponse{Metrics: api.Metrics{PromptEvalCount: 1, PromptCacheCount: 4096, EvalCount: 10}})
+
+	b, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"prompt_tokens":4097,"completion_tokens":10,"total_tokens":4107,"prompt_tokens_details":{"cached_tokens":4096}}`
+	if string(b) != want {
+		t.Errorf("usage = %s; want %s", b, want)
+	}
+}
+
 func TestCompletionsMiddleware(t *testing.T) {
 	type testCase struct {
 		name string
@@ -385,6 +528,7 @@ func TestCompletionsMiddleware(t *testing.T) {
 				"model": "test-model",
 				"prompt": "Hello",
 				"temperature": 0.8,
+				"min_p": 0.25,
 				"stop": ["\n", "stop"],
 				"suffix": "suffix"
 			}`,
@@ -396,6 +540,7 @@ func TestCompletionsMiddleware(t *testing.T) {
 					"presence_penalty":  0.0,
 					"temperature":       0.8,
 					"top_p":             1.0,
+					"min_p":             0.25,
 					"stop":              []any{"\n", "stop"},
 				},
 				Suffix: "suffix",
@@ -496,6 +496,14 @@ func TestParseFileParameters(t *testing.T) {
 		"repeat_penalty 1.0":           {"repeat_penalty", "1.0"},
 		"presence_penalty 1.0":         {"presence_penalty", "1.0"},
 		"frequency_penalty 1.0":        {"frequency_penalty", "1.0"},
+		"dry_multiplier 0.8":           {"dry_multiplier", "0.8"},
+		"dry_base 1.75":                {"dry_base", "1.75"},
+		"dry_allowed_length 2":         {"dry_allowed_length", "2"},
+		"dry_penalty_last_n -1":        {"dry_penalty_last_n", "-1"},
+		"dry_sequence_breakers ###":    {"dry_sequence_breakers", "###"},
+		"num_beams 4":                  {"num_beams", "4"},
+		"return_sequences 2":           {"return_sequences", "2"},
+		"num_draft 8":                  {"num_draft", "8"},
 		"mirostat 1":                   {"mirostat", "1"},
 		"mirostat_tau 1.0":             {"mirostat_tau", "1.0"},
 		"mirostat_eta 1.0":             {"mirostat_eta", "1.0"},
@@ -599,6 +607,11 @@ MESSAGE assistant Hello, I want to parse all the things!
 		`
 FROM foo
 SYSTEM ""
+`,
+		`
+FROM foo
+DRAFT bar
+PARAMETER num_draft 8
 `,
 	}
 
@@ -699,6 +712,17 @@ TEMPLATE some template
 		},
 		{
 			`FROM test
+DRAFT draft
+PARAMETER num_draft 8
+`,
+			&api.CreateRequest{
+				From:       "test",
+				Draft:      "draft",
+				Parameters: map[string]any{"num_draft": int64(8)},
+			},
+		},
+		{
+			`FROM test
 LICENSE single license
 PARAMETER temperature 0.5
 MESSAGE user Hello
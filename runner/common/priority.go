@@ -0,0 +1,307 @@
+package common
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Priority orders the requests that wait for a runner or for a place in its
+// batch. Requests of a higher priority are served first and may preempt
+// running requests of a lower priority.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+// AgingInterval is how long a request waits before its priority is raised by
+// a level, so that requests of low priority aren't starved by a steady stream
+// of requests of higher priority
+var AgingInterval = 10 * time.Second
+
+// ParsePriority parses the priority of a request, which is normal if s is
+// empty
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("invalid priority %q, expected low, normal or high", s)
+	}
+}
+
+func (p Priority) String() string {
+	switch {
+	case p < PriorityNormal:
+		return "low"
+	case p > PriorityNormal:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// Aged returns the priority of a request of priority p that has waited for
+// wait, which is raised by a level for each AgingInterval up to PriorityHigh
+func (p Priority) Aged(wait time.Duration) Priority {
+	if AgingInterval <= 0 || p >= PriorityHigh {
+		return p
+	}
+
+	return min(PriorityHigh, p+Priority(wait/AgingInterval))
+}
+
+type priorityKey struct{}
+
+type priorityValue struct {
+	priority Priority
+	since    time.Time
+}
+
+// WithPriority returns a context for a request of priority p that arrives now
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priorityValue{p, time.Now()})
+}
+
+// PriorityFrom returns the priority of the request of ctx and when it
+// arrived, which is normal and now if it doesn't have one
+func PriorityFrom(ctx context.Context) (Priority, time.Time) {
+	if v, ok := ctx.Value(priorityKey{}).(priorityValue); ok {
+		return v.priority, v.since
+	}
+
+	return PriorityNormal, time.Now()
+}
+
+// PrioritySemaphore is a weighted semaphore that admits the waiters with the
+// highest priority first, and those of the same priority in the order that
+// they arrived. Priorities are aged by the time the waiters have waited, and
+// waiters are admitted as soon as their aged priority lets them in, without
+// waiting for the semaphore to be acquired or released.
+//
+// If it's preemptive, waiters only wait for the holders of at least their
+// priority, as those of lower priorities are expected to be preempted to
+// make room for them, such as by a runner at the next token.
+type PrioritySemaphore struct {
+	size       int64
+	preemptive bool
+
+	mu      sync.Mutex
+	held    map[Priority]int64
+	waiters []*waiter
+
+	// aging re-runs notify when the aged priority of a waiter next changes
+	aging *time.Timer
+}
+
+type waiter struct {
+	n        int64
+	priority Priority
+	since    time.Time
+
+	// admitted is the aged priority of the waiter once ready is closed
+	admitted Priority
+	ready    chan struct{}
+}
+
+func NewPrioritySemaphore(size int64, preemptive bool) *PrioritySemaphore {
+	return &PrioritySemaphore{
+		size:       size,
+		preemptive: preemptive,
+		held:       make(map[Priority]int64),
+	}
+}
+
+// Acquire waits for n of the semaphore for a request of priority p that
+// arrived at since. It returns the aged priority that the request was
+// admitted with, which must be passed to Release. If ctx is done first, it
+// returns ctx.Err() and leaves the semaphore unchanged.
+func (s *PrioritySemaphore) Acquire(ctx context.Context, n int64, p Priority, since time.Time) (Priority, error) {
+	return s.AcquireQueued(ctx, n, p, since, nil)
+}
+
+// AcquireQueued is like Acquire, but if the request has to wait, it first
+// calls queued with its position among the waiters, from 1 for the next to
+// be admitted
+func (s *PrioritySemaphore) AcquireQueued(ctx context.Context, n int64, p Priority, since time.Time, queued func(position int)) (Priority, error) {
+	if err := ctx.Err(); err != nil {
+		return p, err
+	}
+
+	w := &waiter{n: n, priority: p, since: since, ready: make(chan struct{})}
+
+	s.mu.Lock()
+	s.waiters = append(s.waiters, w)
+	s.notify()
+	position := slices.Index(s.waiters, w) + 1
+	s.mu.Unlock()
+
+	if position > 0 && queued != nil {
+		queued(position)
+	}
+
+	select {
+	case <-w.ready:
+		return w.admitted, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		select {
+		case <-w.ready:
+			// admitted while ctx was done
+			s.held[w.admitted] -= n
+		default:
+			s.waiters = slices.DeleteFunc(s.waiters, func(o *waiter) bool { return o == w })
+		}
+
+		s.notify()
+		return p, ctx.Err()
+	}
+}
+
+// TryAcquire acquires n of the semaphore for a request of priority p without
+// waiting, and reports whether it did. It fails if there are waiters ahead
+// of it.
+func (s *PrioritySemaphore) TryAcquire(n int64, p Priority) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.waiters) > 0 || !s.fits(n, p) {
+		return false
+	}
+
+	s.held[p] += n
+	return true
+}
+
+// Release releases n of the semaphore held with priority p
+func (s *PrioritySemaphore) Release(n int64, p Priority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.held[p] < n {
+		panic("semaphore: released more than held")
+	}
+
+	s.held[p] -= n
+	s.notify()
+}
+
+// Waiting returns the number of waiters of each priority, before they're
+// aged
+func (s *PrioritySemaphore) Waiting() map[Priority]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waiting := make(map[Priority]int)
+	for _, w := range s.waiters {
+		waiting[w.priority]++
+	}
+
+	return waiting
+}
+
+// Highest returns the highest aged priority of the waiters, or false if
+// there aren't any
+func (s *PrioritySemaphore) Highest() (Priority, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.waiters) == 0 {
+		return PriorityNormal, false
+	}
+
+	now := time.Now()
+	highest := PriorityLow
+	for _, w := range s.waiters {
+		highest = max(highest, w.priority.Aged(now.Sub(w.since)))
+	}
+
+	return highest, true
+}
+
+// notify admits the waiters in order while they fit. A waiter that doesn't
+// fit blocks those after it, so that large requests aren't starved by
+// smaller ones.
+func (s *PrioritySemaphore) notify() {
+	now := time.Now()
+	aged := func(w *waiter) Priority {
+		return w.priority.Aged(now.Sub(w.since))
+	}
+
+	slices.SortStableFunc(s.waiters, func(a, b *waiter) int {
+		return cmp.Or(cmp.Compare(aged(b), aged(a)), a.since.Compare(b.since))
+	})
+
+	for len(s.waiters) > 0 {
+		w := s.waiters[0]
+		p := aged(w)
+		if !s.fits(w.n, p) {
+			break
+		}
+
+		s.held[p] += w.n
+		w.admitted = p
+		close(w.ready)
+		s.waiters = s.waiters[1:]
+	}
+
+	s.age(now)
+}
+
+// age schedules notify for when the aged priority of the next of the waiters
+// changes, as that may change their order or, if the semaphore is
+// preemptive, admit them
+func (s *PrioritySemaphore) age(now time.Time) {
+	if s.aging != nil {
+		s.aging.Stop()
+		s.aging = nil
+	}
+
+	if AgingInterval <= 0 {
+		return
+	}
+
+	var next time.Duration
+	for _, w := range s.waiters {
+		wait := now.Sub(w.since)
+		if w.priority.Aged(wait) >= PriorityHigh {
+			continue
+		}
+
+		if d := AgingInterval - wait%AgingInterval; next == 0 || d < next {
+			next = d
+		}
+	}
+
+	if next > 0 {
+		s.aging = time.AfterFunc(next, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.notify()
+		})
+	}
+}
+
+// fits reports whether n more of the semaphore can be held with priority p
+func (s *PrioritySemaphore) fits(n int64, p Priority) bool {
+	used := n
+	for q, m := range s.held {
+		if !s.preemptive || q >= p {
+			used += m
+		}
+	}
+
+	return used <= s.size
+}
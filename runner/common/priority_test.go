@@ -0,0 +1,217 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParsePriority(t *testing.T) {
+	for s, want := range map[string]Priority{"": PriorityNormal, "low": PriorityLow, "normal": PriorityNormal, "high": PriorityHigh} {
+		if p, err := ParsePriority(s); err != nil || p != want {
+			t.Errorf("priority %q is %v (%v); want %v", s, p, err, want)
+		}
+	}
+
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("expected an error for an unknown priority")
+	}
+}
+
+func TestPriorityAged(t *testing.T) {
+	cases := []struct {
+		p    Priority
+		wait time.Duration
+		want Priority
+	}{
+		{PriorityLow, 0, PriorityLow},
+		{PriorityLow, AgingInterval - 1, PriorityLow},
+		{PriorityLow, AgingInterval, PriorityNormal},
+		{PriorityLow, 5 * AgingInterval, PriorityHigh},
+		{PriorityNormal, AgingInterval, PriorityHigh},
+		{PriorityHigh, 5 * AgingInterval, PriorityHigh},
+	}
+
+	for _, tt := range cases {
+		if have := tt.p.Aged(tt.wait); have != tt.want {
+			t.Errorf("%v aged by %v is %v; want %v", tt.p, tt.wait, have, tt.want)
+		}
+	}
+}
+
+// acquire starts acquiring n of s in the background, returning a channel that
+// receives the admitted priority
+func acquire(t *testing.T, s *PrioritySemaphore, n int64, p Priority, since time.Time) chan Priority {
+	t.Helper()
+
+	ch := make(chan Priority, 1)
+	go func() {
+		admitted, err := s.Acquire(t.Context(), n, p, since)
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- admitted
+	}()
+
+	// wait for it to be queued, as the order of goroutines isn't defined
+	for {
+		s.mu.Lock()
+		queued := slices.ContainsFunc(s.waiters, func(w *waiter) bool { return w.since.Equal(since) })
+		s.mu.Unlock()
+
+		select {
+		case admitted := <-ch:
+			ch <- admitted
+			return ch
+		default:
+		}
+
+		if queued {
+			return ch
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrioritySemaphore(t *testing.T) {
+	s := NewPrioritySemaphore(1, false)
+	if !s.TryAcquire(1, PriorityLow) {
+		t.Fatal("expected to acquire the semaphore")
+	}
+
+	now := time.Now()
+	low := acquire(t, s, 1, PriorityLow, now)
+	normal := acquire(t, s, 1, PriorityNormal, now.Add(time.Millisecond))
+	high := acquire(t, s, 1, PriorityHigh, now.Add(2*time.Millisecond))
+
+	if have, want := s.Waiting(), map[Priority]int{PriorityLow: 1, PriorityNormal: 1, PriorityHigh: 1}; !maps.Equal(have, want) {
+		t.Errorf("have waiting %v; want %v", have, want)
+	}
+
+	if p, ok := s.Highest(); !ok || p != PriorityHigh {
+		t.Errorf("highest waiting is %v (%v); want %v", p, ok, PriorityHigh)
+	}
+
+	// a request of normal priority waits behind those of normal and high
+	// priority that are already waiting
+	ctx, cancel := context.WithCancel(t.Context())
+	_, err := s.AcquireQueued(ctx, 1, PriorityNormal, now.Add(3*time.Millisecond), func(position int) {
+		if position != 3 {
+			t.Errorf("queued at position %d; want 3", position)
+		}
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("have error %v; want %v", err, context.Canceled)
+	}
+
+	// the waiters are admitted from the highest priority to the lowest
+	s.Release(1, PriorityLow)
+	for _, ch := range []chan Priority{high, normal, low} {
+		p := <-ch
+		s.Release(1, p)
+	}
+
+	if _, ok := s.Highest(); ok {
+		t.Error("expected no waiters")
+	}
+}
+
+func TestPrioritySemaphoreAging(t *testing.T) {
+	s := NewPrioritySemaphore(1, false)
+	s.TryAcquire(1, PriorityNormal)
+
+	// a request of low priority that has waited long enough is admitted
+	// before one of high priority that just arrived
+	now := time.Now()
+	low := acquire(t, s, 1, PriorityLow, now.Add(-2*AgingInterval))
+	high := acquire(t, s, 1, PriorityHigh, now)
+
+	s.Release(1, PriorityNormal)
+	if p := <-low; p != PriorityHigh {
+		t.Errorf("low priority request was admitted with %v; want %v", p, PriorityHigh)
+	}
+
+	select {
+	case <-high:
+		t.Fatal("high priority request was admitted while the semaphore is held")
+	default:
+	}
+
+	s.Release(1, PriorityHigh)
+	<-high
+}
+
+func TestPrioritySemaphoreAgingTimer(t *testing.T) {
+	defer func(d time.Duration) { AgingInterval = d }(AgingInterval)
+	AgingInterval = 50 * time.Millisecond
+
+	s := NewPrioritySemaphore(1, true)
+	s.TryAcquire(1, PriorityNormal)
+
+	// a request of normal priority waits for the holder of normal priority
+	// until it's aged to high, and is then admitted without the semaphore
+	// being acquired or released
+	start := time.Now()
+	if p := <-acquire(t, s, 1, PriorityNormal, start); p != PriorityHigh {
+		t.Errorf("admitted with %v; want %v", p, PriorityHigh)
+	}
+
+	if d := time.Since(start); d < AgingInterval {
+		t.Errorf("admitted after %v, before it was aged", d)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aging != nil {
+		t.Error("expected no aging without waiters")
+	}
+}
+
+func TestPrioritySemaphorePreemptive(t *testing.T) {
+	s := NewPrioritySemaphore(2, true)
+	for range 2 {
+		if !s.TryAcquire(1, PriorityLow) {
+			t.Fatal("expected to acquire the semaphore")
+		}
+	}
+
+	// requests of low priority don't hold back those of higher priorities,
+	// which only wait for each other
+	now := time.Now()
+	for i := range 2 {
+		if p := <-acquire(t, s, 1, PriorityHigh, now.Add(time.Duration(i))); p != PriorityHigh {
+			t.Errorf("admitted with %v; want %v", p, PriorityHigh)
+		}
+	}
+
+	if s.TryAcquire(1, PriorityHigh) || s.TryAcquire(1, PriorityLow) {
+		t.Error("acquired more than the size of the semaphore for a priority")
+	}
+}
+
+func TestPrioritySemaphoreCancel(t *testing.T) {
+	s := NewPrioritySemaphore(1, false)
+	s.TryAcquire(1, PriorityNormal)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() {
+		_, err := s.Acquire(ctx, 1, PriorityHigh, time.Now())
+		done <- err
+	}()
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("have error %v; want %v", err, context.Canceled)
+	}
+
+	// the canceled request doesn't hold any of the semaphore
+	s.Release(1, PriorityNormal)
+	if !s.TryAcquire(1, PriorityLow) {
+		t.Error("expected to acquire the semaphore")
+	}
+}
@@ -20,7 +20,7 @@ import (
 	"time"
 	"unicode/utf8"
 
-	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llama"
@@ -84,11 +84,18 @@ type Sequence struct {
 
 	doneReason string
 
+	// priority is that of the request, which is aged from
+	// startProcessingTime while it waits for a place, and admitted is the
+	// aged priority that it took its place with
+	priority common.Priority
+	admitted common.Priority
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
 	numDecoded          int
 	numPromptInputs     int
+	numCachedInputs     int
 }
 
 type NewSequenceParams struct {
@@ -97,6 +104,7 @@ type NewSequenceParams struct {
 	numKeep        int
 	samplingParams *llama.SamplingParams
 	embedding      bool
+	priority       common.Priority
 }
 
 func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -157,6 +165,7 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
+		priority:            params.priority,
 	}, nil
 }
 
@@ -255,8 +264,8 @@ type Server struct {
 	seqs []*Sequence
 
 	// seqs can have a maximum of parallel entries, which
-	// is enfoced by seqSem
-	seqsSem *semaphore.Weighted
+	// is enfoced by seqSem in order of priority
+	seqsSem *common.PrioritySemaphore
 
 	// KV cache
 	cache *InputCache
@@ -309,7 +318,7 @@ func (s *Server) removeSequence(seqIndex int, reason string) {
 	close(seq.embedding)
 	seq.cache.InUse = false
 	s.seqs[seqIndex] = nil
-	s.seqsSem.Release(1)
+	s.seqsSem.Release(1, seq.admitted)
 }
 
 func (s *Server) run(ctx context.Context) {
@@ -548,6 +557,7 @@ type Options struct {
 	api.Runner
 
 	NumKeep          int      `json:"n_keep"`
+	ContextShift     bool     `json:"context_shift"`
 	Seed             int      `json:"seed"`
 	NumPredict       int      `json:"n_predict"`
 	TopK             int      `json:"top_k"`
@@ -563,6 +573,28 @@ type Options struct {
 	MirostatTau      float32  `json:"mirostat_tau"`
 	MirostatEta      float32  `json:"mirostat_eta"`
 	Stop             []string `json:"stop"`
+	Grammar          string   `json:"grammar"`
+
+	DRYMultiplier       float32  `json:"dry_multiplier"`
+	DRYBase             float32  `json:"dry_base"`
+	DRYAllowedLength    int      `json:"dry_allowed_length"`
+	DRYPenaltyLastN     int      `json:"dry_penalty_last_n"`
+	DRYSequenceBreakers []string `json:"dry_sequence_breakers"`
+
+	// LogitBias is by token id
+	LogitBias map[string]float32 `json:"logit_bias"`
+
+	Logprobs            bool `json:"logprobs"`
+	TopLogprobs         int  `json:"top_logprobs"`
+	LogprobsTemperature bool `json:"logprobs_temperature"`
+
+	NumBeams        int `json:"num_beams"`
+	ReturnSequences int `json:"return_sequences"`
+
+	NumDraft int `json:"num_draft"`
+
+	Pooling   string `json:"pooling"`
+	Normalize *bool  `json:"normalize"`
 }
 
 type ImageData struct {
@@ -577,6 +609,9 @@ type CompletionRequest struct {
 	Grammar     string      `json:"grammar"`
 	CachePrompt bool        `json:"cache_prompt"`
 
+	// Priority orders the requests that wait for a place in the batch
+	Priority common.Priority `json:"priority,omitempty"`
+
 	Options
 }
 
@@ -585,6 +620,7 @@ type Timings struct {
 	PredictedMS float64 `json:"predicted_ms"`
 	PromptN     int     `json:"prompt_n"`
 	PromptMS    float64 `json:"prompt_ms"`
+	CacheN      int     `json:"cache_n,omitempty"`
 }
 
 type CompletionResponse struct {
@@ -635,6 +671,22 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	samplingParams.MirostatEta = req.MirostatEta
 	samplingParams.Seed = uint32(req.Seed)
 	samplingParams.Grammar = req.Grammar
+	samplingParams.DRYMultiplier = req.DRYMultiplier
+	samplingParams.DRYBase = req.DRYBase
+	samplingParams.DRYAllowedLength = req.DRYAllowedLength
+	samplingParams.DRYPenaltyLastN = req.DRYPenaltyLastN
+	samplingParams.DRYSequenceBreakers = req.DRYSequenceBreakers
+
+	samplingParams.LogitBias = make(map[int]float32, len(req.LogitBias))
+	for key, bias := range req.LogitBias {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid token id %q in logit_bias", key), http.StatusBadRequest)
+			return
+		}
+
+		samplingParams.LogitBias[id] = bias
+	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
 		numPredict:     req.NumPredict,
@@ -642,6 +694,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		numKeep:        req.NumKeep,
 		samplingParams: &samplingParams,
 		embedding:      false,
+		priority:       req.Priority,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
@@ -649,7 +702,8 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	seq.admitted, err = s.seqsSem.Acquire(r.Context(), 1, seq.priority, seq.startProcessingTime)
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -669,6 +723,10 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			// only the inputs that aren't already in the cache are processed
+			seq.numCachedInputs = seq.numPromptInputs - len(seq.inputs)
+			seq.numPromptInputs = len(seq.inputs)
+
 			seq.crossAttention = s.image.NeedCrossAttention(seq.cache.Inputs...)
 
 			s.seqs[i] = seq
@@ -708,6 +766,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 					Timings: Timings{
 						PromptN:     seq.numPromptInputs,
 						PromptMS:    float64(seq.startGenerationTime.Sub(seq.startProcessingTime).Milliseconds()),
+						CacheN:      seq.numCachedInputs,
 						PredictedN:  seq.numDecoded,
 						PredictedMS: float64(time.Since(seq.startGenerationTime).Milliseconds()),
 					},
@@ -722,12 +781,19 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 }
 
 type EmbeddingRequest struct {
-	Content     string `json:"content"`
-	CachePrompt bool   `json:"cache_prompt"`
+	Contents    []string `json:"contents"`
+	CachePrompt bool     `json:"cache_prompt"`
+
+	// Priority orders the requests that wait for a place in the batch
+	Priority common.Priority `json:"priority,omitempty"`
+
+	// Pooling is not supported, as llama.cpp pools the embeddings of a
+	// context as it was created with
+	Pooling string `json:"pooling,omitempty"`
 }
 
 type EmbeddingResponse struct {
-	Embedding []float32 `json:"embedding"`
+	Embeddings [][]float32 `json:"embeddings"`
 }
 
 func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
@@ -737,35 +803,66 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Pooling != "" {
+		http.Error(w, "pooling is not supported by this model", http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
-	slog.Debug("embedding request", "content", req.Content)
+	slog.Debug("embedding request", "inputs", len(req.Contents))
+
+	// each input is a sequence of its own, which are batched together as
+	// they are processed
+	embeddings := make([][]float32, len(req.Contents))
+	g, ctx := errgroup.WithContext(r.Context())
+	for i, content := range req.Contents {
+		g.Go(func() (err error) {
+			embeddings[i], err = s.embedding(ctx, content, req.CachePrompt, req.Priority)
+			return err
+		})
+	}
+
+	if err := g.Wait(); errors.Is(err, context.Canceled) {
+		slog.Info("aborting embeddings request due to client closing the connection")
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	seq, err := s.NewSequence(req.Content, nil, NewSequenceParams{embedding: true})
+	if err := json.NewEncoder(w).Encode(&EmbeddingResponse{
+		Embeddings: embeddings,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// embedding computes the embedding of content in a sequence of its own
+func (s *Server) embedding(ctx context.Context, content string, cachePrompt bool, priority common.Priority) ([]float32, error) {
+	seq, err := s.NewSequence(content, nil, NewSequenceParams{embedding: true, priority: priority})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("Failed to create new sequence: %w", err)
 	}
 
 	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
-		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting embeddings request due to client closing the connection")
-		} else {
+	seq.admitted, err = s.seqsSem.Acquire(ctx, 1, seq.priority, seq.startProcessingTime)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
 			slog.Error("Failed to acquire semaphore", "error", err)
 		}
-		return
+		return nil, err
 	}
 
 	s.mu.Lock()
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, req.CachePrompt)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, cachePrompt)
 			if err != nil {
 				s.mu.Unlock()
-				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-				return
+				s.seqsSem.Release(1, seq.admitted)
+				return nil, fmt.Errorf("Failed to load cache: %w", err)
 			}
 			s.seqs[i] = seq
 			s.cond.Signal()
@@ -776,15 +873,84 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	s.mu.Unlock()
 
 	if !found {
-		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
+		s.seqsSem.Release(1, seq.admitted)
+		return nil, errors.New("could not find an available sequence")
+	}
+
+	return <-seq.embedding, nil
+}
+
+type TokenizeRequest struct {
+	Content    string `json:"content"`
+	AddSpecial bool   `json:"add_special"`
+	Pieces     bool   `json:"pieces"`
+}
+
+type TokenizeResponse struct {
+	Tokens []int    `json:"tokens"`
+	Pieces []string `json:"pieces,omitempty"`
+}
+
+// tokenize converts text to tokens with the vocabulary of the model. This
+// doesn't need a sequence, so it doesn't wait for those being processed.
+func (s *Server) tokenize(w http.ResponseWriter, r *http.Request) {
+	var req TokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
 		return
 	}
 
-	embedding := <-seq.embedding
+	s.ready.Wait()
 
-	if err := json.NewEncoder(w).Encode(&EmbeddingResponse{
-		Embedding: embedding,
-	}); err != nil {
+	tokens, err := s.model.Tokenize(req.Content, req.AddSpecial, true)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to tokenize: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	resp := TokenizeResponse{Tokens: tokens}
+	if req.Pieces {
+		for _, token := range tokens {
+			resp.Pieces = append(resp.Pieces, s.model.TokenToPiece(token))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+type DetokenizeRequest struct {
+	Tokens []int `json:"tokens"`
+}
+
+type DetokenizeResponse struct {
+	Content string `json:"content"`
+}
+
+// detokenize converts tokens to text, which is the reverse of tokenize
+func (s *Server) detokenize(w http.ResponseWriter, r *http.Request) {
+	var req DetokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.ready.Wait()
+
+	var sb strings.Builder
+	for _, token := range req.Tokens {
+		if token < 0 || token >= s.model.NumVocab() {
+			http.Error(w, fmt.Sprintf("invalid token %d", token), http.StatusBadRequest)
+			return
+		}
+
+		sb.WriteString(s.model.TokenToPiece(token))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&DetokenizeResponse{Content: sb.String()}); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
 }
@@ -938,7 +1104,7 @@ func Execute(args []string) error {
 		batchSize: *batchSize,
 		parallel:  *parallel,
 		seqs:      make([]*Sequence, *parallel),
-		seqsSem:   semaphore.NewWeighted(int64(*parallel)),
+		seqsSem:   common.NewPrioritySemaphore(int64(*parallel), false),
 		status:    ServerStatusLoadingModel,
 	}
 
@@ -984,6 +1150,8 @@ func Execute(args []string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/embedding", server.embeddings)
 	mux.HandleFunc("/completion", server.completion)
+	mux.HandleFunc("/tokenize", server.tokenize)
+	mux.HandleFunc("/detokenize", server.detokenize)
 	mux.HandleFunc("/health", server.health)
 
 	httpServer := http.Server{
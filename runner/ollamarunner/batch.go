@@ -0,0 +1,226 @@
+package ollamarunner
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/ollama/ollama/model"
+)
+
+// batch is the inputs of a forward pass of the model, with the sequences that
+// they are from
+type batch struct {
+	options model.Options
+
+	// classify is whether the sequences of the batch are classified, which
+	// are batched separately from those generating text as the model
+	// computes the classification head instead of logits
+	classify bool
+
+	// seqs are whether each sequence of the server has inputs in the batch
+	seqs []bool
+
+	// budget is the number of inputs that can still be added to the batch
+	budget int
+
+	// imgSeq is the sequence with images in the batch, or -1
+	imgSeq int
+
+	numClassify int
+}
+
+// nextBatch builds the next batch from the sequences being processed, with
+// up to batchSize inputs in total. Sequences join the batch that follows
+// their arrival and leave it as soon as they end, so each batch has the inputs
+// of every sequence that fits rather than waiting for the sequences before
+// them to finish.
+//
+// A token only costs a single input (or a few with beam search or a draft
+// model), so the sequences that are generating come first, and the rest of
+// the batch is shared by the sequences that are processing their prompts. A
+// prompt that needs less than an even share leaves the rest to the longer
+// prompts, which are processed in chunks over the following batches, so a
+// long prompt delays neither the tokens of the other sequences nor their
+// prompts.
+func (s *Server) nextBatch() (*batch, error) {
+	b := &batch{seqs: make([]bool, len(s.seqs)), budget: s.batchSize, imgSeq: -1}
+
+	var prompts []int
+	batched := false
+
+	seqIdx := s.nextSeq - 1
+	for range s.seqs {
+		seqIdx = (seqIdx + 1) % len(s.seqs)
+		seq := s.seqs[seqIdx]
+
+		if seq == nil {
+			continue
+		}
+
+		// the rest of the prompt of a sequence whose client has gone away
+		// is abandoned rather than processed
+		if seq.canceled() {
+			if err := s.abandonSequence(seqIdx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !batched {
+			b.classify = seq.classify
+			batched = true
+		} else if seq.classify != b.classify {
+			s.nextSeq = seqIdx
+			continue
+		}
+
+		// once the prompt is processed, each beam has the next input
+		if seq.beams != nil && len(seq.inputs) == 0 {
+			if len(seq.beams.Beams) > b.budget {
+				s.nextSeq = seqIdx
+				continue
+			}
+
+			for i, beam := range seq.beams.Beams {
+				slot := seq.beams.slots[i]
+				b.options.Inputs = append(b.options.Inputs, beam.Tokens[len(beam.Tokens)-1])
+				b.options.Positions = append(b.options.Positions, int32(len(slot.Inputs)))
+				b.options.Sequences = append(b.options.Sequences, slot.Id)
+				b.options.Outputs = append(b.options.Outputs, int32(len(b.options.Inputs)-1))
+				seq.beams.iBatch[i] = len(b.options.Outputs) - 1
+			}
+
+			b.budget -= len(seq.beams.Beams)
+			b.seqs[seqIdx] = true
+			continue
+		}
+
+		if !s.cache.enabled {
+			seq.inputs = append(seq.cache.Inputs, seq.inputs...)
+			seq.cache.Inputs = []input{}
+		}
+
+		if len(seq.inputs) > 1 {
+			prompts = append(prompts, seqIdx)
+			continue
+		}
+
+		if b.budget == 0 {
+			s.nextSeq = seqIdx
+			continue
+		}
+
+		if n := min(s.numDraft(seq), b.budget-1); n > 0 {
+			draft, err := s.draft.propose(seq.cache, seq.inputs[0], n)
+			if err != nil {
+				return nil, err
+			}
+
+			seq.draft = draft
+			for _, token := range draft {
+				seq.inputs = append(seq.inputs, input{token: token})
+			}
+		}
+
+		if err := s.addInputs(b, seqIdx, len(seq.inputs)); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortStableFunc(prompts, func(i, j int) int {
+		return cmp.Compare(len(s.seqs[i].inputs), len(s.seqs[j].inputs))
+	})
+
+	for i, seqIdx := range prompts {
+		seq := s.seqs[seqIdx]
+
+		n := b.budget / (len(prompts) - i)
+		if seq.classify || !s.cache.enabled {
+			// the whole input is processed in a single batch, which
+			// is only partial if it doesn't fit in any batch
+			if len(seq.inputs) > b.budget && b.budget < s.batchSize {
+				continue
+			}
+			n = b.budget
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		if err := s.addInputs(b, seqIdx, n); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// addInputs adds up to n of the next inputs of the sequence at seqIdx to b
+func (s *Server) addInputs(b *batch, seqIdx int, n int) error {
+	seq := s.seqs[seqIdx]
+
+	for i, input := range seq.inputs {
+		if int32(len(seq.cache.Inputs)+len(seq.pendingInputs)+1) > s.cache.numCtx {
+			if len(seq.pendingInputs) == 0 {
+				err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
+				if err != nil {
+					return err
+				}
+			} else {
+				break
+			}
+		}
+
+		if i >= n {
+			break
+		}
+
+		// TODO(jessegross): Image inputs need to be rethought - it's
+		// it doesn't work well for different types of models or multiple sequences
+		if input.image != nil {
+			if len(seq.pendingInputs) != len(b.options.Images) {
+				break
+			}
+
+			if b.imgSeq != seqIdx && b.imgSeq != -1 {
+				s.nextSeq = seqIdx
+				break
+			}
+
+			b.imgSeq = seqIdx
+			b.options.Images = append(b.options.Images, input.image)
+			seq.pendingInputs = append(seq.pendingInputs, input)
+			continue
+		}
+
+		b.options.Inputs = append(b.options.Inputs, input.token)
+		b.options.Positions = append(b.options.Positions, int32(len(seq.cache.Inputs)+len(seq.pendingInputs)))
+		b.options.Sequences = append(b.options.Sequences, seq.cache.Id)
+
+		// the proposals of the draft model are verified with the
+		// logits of each of them and of the input before them
+		if i+1 >= len(seq.inputs)-len(seq.draft) {
+			if !seq.classify && i+1 == len(seq.inputs)-len(seq.draft) {
+				seq.iBatch = len(b.options.Outputs)
+			}
+			b.options.Outputs = append(b.options.Outputs, int32(len(b.options.Inputs)-1))
+		}
+		seq.pendingInputs = append(seq.pendingInputs, input)
+	}
+
+	seq.inputs = seq.inputs[len(seq.pendingInputs):]
+	b.budget -= len(seq.pendingInputs)
+
+	if len(seq.pendingInputs) > 0 {
+		b.seqs[seqIdx] = true
+
+		// the scores are in the order that the sequences are in the batch
+		if seq.classify {
+			seq.iBatch = b.numClassify
+			b.numClassify++
+		}
+	}
+
+	return nil
+}
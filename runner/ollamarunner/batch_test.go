@@ -0,0 +1,508 @@
+package ollamarunner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	fs "github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/nn"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/runner/common"
+	"github.com/ollama/ollama/sample"
+)
+
+// inputsOf returns the number of inputs of each sequence in b
+func inputsOf(b *batch, n int) []int {
+	counts := make([]int, n)
+	for _, seq := range b.options.Sequences {
+		counts[seq]++
+	}
+	return counts
+}
+
+// forwardBatch moves the inputs of b to the cache, as processing the batch
+// does, and gives each sequence that processed its prompt a token to generate
+func forwardBatch(s *Server, b *batch) {
+	for i, seq := range s.seqs {
+		if seq == nil || !b.seqs[i] {
+			continue
+		}
+
+		seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
+		seq.pendingInputs = nil
+		if len(seq.inputs) == 0 {
+			seq.inputs = []input{{token: 1}}
+		}
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	newSeq := func(id, prompt int) *Sequence {
+		return &Sequence{
+			inputs: make([]input, prompt),
+			cache:  &InputCacheSlot{Id: id, Inputs: make([]input, 10)},
+		}
+	}
+
+	s := &Server{
+		batchSize: 16,
+		cache:     &InputCache{numCtx: 1024, enabled: true},
+		seqs:      []*Sequence{newSeq(0, 100), newSeq(1, 1), newSeq(2, 5), nil},
+	}
+
+	// the token of the generating sequence and the short prompt come first,
+	// and the long prompt has the rest of the batch
+	b, err := s.nextBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := inputsOf(b, 4), []int{10, 1, 5, 0}; !slices.Equal(have, want) {
+		t.Errorf("have inputs %v; want %v", have, want)
+	}
+
+	if len(b.options.Outputs) != 2 || s.seqs[1].iBatch != 0 || s.seqs[2].iBatch != 1 {
+		t.Errorf("have outputs %v with batch indices %d and %d; want the last inputs of sequences 1 and 2", b.options.Outputs, s.seqs[1].iBatch, s.seqs[2].iBatch)
+	}
+
+	forwardBatch(s, b)
+
+	// a short prompt that arrives while the long prompt is processed
+	// doesn't wait for it
+	for step := range 8 {
+		if s.seqs[3] == nil {
+			s.seqs[3] = newSeq(3, 3)
+		}
+
+		b, err := s.nextBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		have := inputsOf(b, 4)
+		if len(b.options.Inputs) > s.batchSize {
+			t.Fatalf("step %d: have %d inputs; want at most %d", step, len(b.options.Inputs), s.batchSize)
+		}
+
+		if have[1] != 1 || have[2] != 1 || have[3] != len(s.seqs[3].pendingInputs) || len(s.seqs[3].inputs) != 0 {
+			t.Fatalf("step %d: have inputs %v with %d left for the short prompt; want a token for each generating sequence and the whole short prompt", step, have, len(s.seqs[3].inputs))
+		}
+
+		if want := min(len(s.seqs[0].pendingInputs)+len(s.seqs[0].inputs), s.batchSize-2-have[3]); have[0] != want {
+			t.Fatalf("step %d: have %d inputs for the long prompt; want %d", step, have[0], want)
+		}
+
+		forwardBatch(s, b)
+
+		// the short sequence ends after its first token
+		if len(s.seqs[3].cache.Inputs) > 10+3 {
+			s.seqs[3] = nil
+		}
+	}
+}
+
+// writeModel writes a small llama model with weights that only depend on the
+// shapes of the tensors
+func writeModel(tb testing.TB, layers, hidden, heads, kvHeads, ffn, vocab int) string {
+	tb.Helper()
+
+	tokens := make([]string, vocab)
+	types := make([]int32, vocab)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("<%d>", i)
+		types[i] = 1
+	}
+
+	kv := fs.KV{
+		"general.architecture":                   "llama",
+		"llama.block_count":                      uint32(layers),
+		"llama.context_length":                   uint32(4096),
+		"llama.embedding_length":                 uint32(hidden),
+		"llama.feed_forward_length":              uint32(ffn),
+		"llama.attention.head_count":             uint32(heads),
+		"llama.attention.head_count_kv":          uint32(kvHeads),
+		"llama.attention.layer_norm_rms_epsilon": float32(1e-5),
+		"llama.rope.freq_base":                   float32(10000),
+		"tokenizer.ggml.model":                   "gpt2",
+		"tokenizer.ggml.tokens":                  tokens,
+		"tokenizer.ggml.token_type":              types,
+		"tokenizer.ggml.merges":                  []string{},
+		"tokenizer.ggml.eos_token_id":            uint32(vocab - 1),
+	}
+
+	kvDim := uint64(kvHeads * hidden / heads)
+	shapes := map[string][]uint64{
+		"token_embd.weight":  {uint64(vocab), uint64(hidden)},
+		"output_norm.weight": {uint64(hidden)},
+		"output.weight":      {uint64(vocab), uint64(hidden)},
+	}
+	for i := range layers {
+		for name, shape := range map[string][]uint64{
+			"attn_norm":   {uint64(hidden)},
+			"attn_q":      {uint64(hidden), uint64(hidden)},
+			"attn_k":      {kvDim, uint64(hidden)},
+			"attn_v":      {kvDim, uint64(hidden)},
+			"attn_output": {uint64(hidden), uint64(hidden)},
+			"ffn_norm":    {uint64(hidden)},
+			"ffn_gate":    {uint64(ffn), uint64(hidden)},
+			"ffn_up":      {uint64(ffn), uint64(hidden)},
+			"ffn_down":    {uint64(hidden), uint64(ffn)},
+		} {
+			shapes[fmt.Sprintf("blk.%d.%s.weight", i, name)] = shape
+		}
+	}
+
+	var tensors []fs.Tensor
+	for _, name := range slices.Sorted(maps.Keys(shapes)) {
+		n := uint64(1)
+		for _, d := range shapes[name] {
+			n *= d
+		}
+
+		data := make([]float32, n)
+		for i := range data {
+			data[i] = float32(math.Sin(float64(i))) / 8
+		}
+
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+			tb.Fatal(err)
+		}
+		tensors = append(tensors, fs.Tensor{Name: name, Kind: 0, Shape: shapes[name], WriterTo: &buf})
+	}
+
+	path := filepath.Join(tb.TempDir(), "model.gguf")
+	f, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fs.WriteGGUF(f, kv, tensors); err != nil {
+		tb.Fatal(err)
+	}
+
+	return path
+}
+
+// newModelServer returns a server for m with parallel sequences of numCtx
+// inputs and batches of batchSize inputs
+func newModelServer(tb testing.TB, m model.Model, parallel, batchSize, numCtx int) *Server {
+	tb.Helper()
+
+	cache, err := NewInputCache(m, "f16", int32(parallel*numCtx), parallel, batchSize, false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	s := &Server{
+		model:     m,
+		batchSize: batchSize,
+		cache:     cache,
+		seqs:      make([]*Sequence, parallel),
+		seqsSem:   common.NewPrioritySemaphore(int64(parallel), false),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// addSequence adds a sequence to s at seqIndex with a prompt of n tokens that
+// depend on seed, which generates numPredict tokens greedily
+func addSequence(tb testing.TB, s *Server, seqIndex, n, numPredict, seed int) *Sequence {
+	tb.Helper()
+
+	seq := &Sequence{
+		inputs:     make([]input, n),
+		numPredict: numPredict,
+		sampler:    sample.Greedy(),
+		responses:  make(chan response, numPredict+1),
+		quit:       make(chan bool),
+		scores:     make(chan []float32, 1),
+	}
+	for i := range seq.inputs {
+		seq.inputs[i].token = int32((seed + i*7) % 127)
+	}
+
+	var err error
+	seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	s.seqsSem.TryAcquire(1, seq.admitted)
+	s.seqs[seqIndex] = seq
+	return seq
+}
+
+func TestCancelPrefill(t *testing.T) {
+	m, err := model.New(writeModel(t, 1, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newModelServer(t, m, 2, 16, 256)
+	long := addSequence(t, s, 0, 200, 4, 0)
+	addSequence(t, s, 1, 4, 100, 1)
+
+	for range 2 {
+		if err := s.processBatch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slot := long.cache
+	if len(slot.Inputs) == 0 || len(long.inputs) == 0 {
+		t.Fatalf("have %d inputs processed and %d left; want the prompt partly processed", len(slot.Inputs), len(long.inputs))
+	}
+
+	// the client goes away in the middle of the prompt, so the next batch
+	// doesn't process any more of it
+	close(long.quit)
+	steps := s.steps
+	if err := s.processBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.seqs[0] != nil || long.doneReason != "connection" {
+		t.Errorf("have sequence %v with reason %q; want it removed for the connection", s.seqs[0], long.doneReason)
+	}
+
+	if slot.InUse || len(slot.Inputs) != 0 {
+		t.Errorf("have slot in use %v with %d inputs; want it free and empty", slot.InUse, len(slot.Inputs))
+	}
+
+	// the batch only has the next token of the other sequence, which has
+	// its prompt and the token of each batch after it in the cache
+	if s.steps != steps+1 || len(s.seqs[1].cache.Inputs) != 6 {
+		t.Errorf("have %d steps with %d inputs of the other sequence; want %d steps with 6", s.steps, len(s.seqs[1].cache.Inputs), steps+1)
+	}
+
+	// once no sequence is left, no batch is processed
+	close(s.seqs[1].quit)
+	steps = s.steps
+	if err := s.processBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.steps != steps || !s.allNil() {
+		t.Errorf("have %d steps; want %d with no sequences", s.steps, steps)
+	}
+}
+
+// faultyModel is a model whose graph has a shape bug while fail is set, as
+// models have had for some ragged batches
+type faultyModel struct {
+	model.Model
+	model.TextProcessor
+	fail bool
+}
+
+func (m *faultyModel) Forward(ctx ml.Context, opts model.Options) (ml.Tensor, error) {
+	if m.fail {
+		query := ctx.Zeros(ml.DTypeF32, 16, len(opts.Inputs), 4)
+		key := ctx.Zeros(ml.DTypeF32, 8, len(opts.Inputs), 2)
+		return nn.Attention(ctx, query, key, key.Permute(ctx, 1, 0, 2, 3), nil, 0), nil
+	}
+
+	return m.Model.Forward(ctx, opts)
+}
+
+// TestMalformedBatch fails the requests of a batch that the model can't build
+// the graph for, after which the runner serves other requests
+func TestMalformedBatch(t *testing.T) {
+	base, err := model.New(writeModel(t, 1, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &faultyModel{Model: base, TextProcessor: base.(model.TextProcessor)}
+	s := newModelServer(t, m, 2, 32, 256)
+
+	failed := addSequence(t, s, 0, 8, 16, 0)
+	if err := s.processBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.fail = true
+	if err := s.processBatch(); err != nil {
+		t.Fatalf("runner stopped: %v", err)
+	}
+
+	var serr *nn.ShapeMismatchError
+	if s.seqs[0] != nil || failed.doneReason != "error" || !errors.As(failed.err, &serr) {
+		t.Fatalf("have sequence %v with reason %q and error %v; want it removed with a shape mismatch", s.seqs[0], failed.doneReason, failed.err)
+	}
+
+	for range failed.responses {
+	}
+
+	if failed.cache.InUse {
+		t.Error("the slot of the failed sequence is still in use")
+	}
+
+	// the next request is served as usual
+	m.fail = false
+	seq := addSequence(t, s, 1, 8, 4, 1)
+	for !s.allNil() {
+		if err := s.processBatch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if seq.numPredicted != seq.numPredict || seq.doneReason != "limit" {
+		t.Errorf("have %d tokens with reason %q; want %d for the limit", seq.numPredicted, seq.doneReason, seq.numPredict)
+	}
+}
+
+// recordSampler samples greedily and records the logits of the last sample
+type recordSampler struct {
+	logits []float32
+}
+
+func (r *recordSampler) Sample(logits []float32) (int32, error) {
+	r.logits = slices.Clone(logits)
+	return sample.Greedy().Sample(logits)
+}
+
+// TestRaggedBatch checks that the logits of a short prompt are the same
+// whether it is processed alone or in a batch with a longer one
+func TestRaggedBatch(t *testing.T) {
+	m, err := model.New(writeModel(t, 2, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logits := func(long int) []float32 {
+		s := newModelServer(t, m, 2, 64, 256)
+		if long > 0 {
+			addSequence(t, s, 0, long, 1, 0)
+		}
+
+		var r recordSampler
+		addSequence(t, s, 1, 5, 1, 1).sampler = &r
+		for !s.allNil() {
+			if err := s.processBatch(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if s.steps != 1 {
+			t.Fatalf("have %d steps; want both prompts in one batch", s.steps)
+		}
+
+		return r.logits
+	}
+
+	want := logits(0)
+	got := logits(40)
+	if len(got) != len(want) {
+		t.Fatalf("have %d logits; want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		if math.IsNaN(float64(got[i])) || math.Abs(float64(got[i]-want[i])) > 1e-3 {
+			t.Fatalf("logit %d is %v in the batch and %v alone", i, got[i], want[i])
+		}
+	}
+}
+
+// BenchmarkBatching serves 8 concurrent clients, which each send requests one
+// after the other, and reports the tokens generated per second and the mean
+// time to the first token of the requests with short prompts. One of the
+// clients sends requests with long prompts. Static admits new requests only
+// once all sequences of the batch have ended, as with static batching, while
+// Continuous admits them as soon as a sequence ends.
+func BenchmarkBatching(b *testing.B) {
+	const parallel, batchSize, numCtx = 8, 32, 256
+
+	m, err := model.New(writeModel(b, 1, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// the prompts and numbers of tokens to predict of each client, where
+	// the first client has long prompts
+	type request struct{ prompt, numPredict int }
+	var requests [parallel][]request
+	for i := range requests {
+		for j := range 2 {
+			prompt := 4 + (i*13+j*29)%16
+			if i == 0 {
+				prompt = 192
+			}
+			requests[i] = append(requests[i], request{prompt, 4 + (i*7+j*11)%16})
+		}
+	}
+
+	for _, static := range []bool{true, false} {
+		name := "Continuous"
+		if static {
+			name = "Static"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var tokens, shortRequests int
+			var shortTTFT time.Duration
+			for b.Loop() {
+				s := newModelServer(b, m, parallel, batchSize, numCtx)
+
+				var next [parallel]int
+				var running, waiting [parallel]*Sequence
+				var arrived [parallel]time.Time
+				for {
+					if !static || s.allNil() {
+						for i := range s.seqs {
+							if s.seqs[i] != nil || next[i] == len(requests[i]) {
+								continue
+							}
+
+							r := requests[i][next[i]]
+							next[i]++
+
+							seq := addSequence(b, s, i, r.prompt, r.numPredict, i*31+next[i])
+							running[i], waiting[i] = seq, seq
+							arrived[i] = time.Now()
+						}
+					}
+
+					if s.allNil() {
+						break
+					}
+
+					if err := s.processBatch(); err != nil {
+						b.Fatal(err)
+					}
+
+					for i := range s.seqs {
+						if seq := waiting[i]; seq != nil && seq.numPredicted > 0 {
+							if i > 0 {
+								shortTTFT += time.Since(arrived[i])
+								shortRequests++
+							}
+							waiting[i] = nil
+						}
+
+						if seq := running[i]; seq != nil && s.seqs[i] == nil {
+							tokens += seq.numPredicted
+							running[i] = nil
+						}
+					}
+				}
+			}
+
+			b.ReportMetric(float64(tokens)/b.Elapsed().Seconds(), "tokens/s")
+			b.ReportMetric(float64(shortTTFT.Milliseconds())/float64(shortRequests), "short-ttft-ms")
+		})
+	}
+}
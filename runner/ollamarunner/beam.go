@@ -0,0 +1,179 @@
+package ollamarunner
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/runner/common"
+	"github.com/ollama/ollama/sample"
+)
+
+// beamSearch is the state of a sequence that is decoded with beam search.
+// Each beam has its own cache slot holding the prompt and the tokens of the
+// beam before the last, which is the next input. Beams that extend the same
+// hypothesis share the cache entries of its tokens rather than computing
+// them again.
+type beamSearch struct {
+	*sample.BeamSearch
+
+	// slots of the beams, in their order, followed by those that aren't
+	// used by a beam. The slot of the sequence is always one of them.
+	slots []*InputCacheSlot
+
+	// batch index of the logits of each beam
+	iBatch []int
+
+	// number of the best completions to return in addition to the text
+	returnSequences int
+}
+
+// freeSlots returns n cache slots that aren't in use, such as for the beams
+// of a sequence, and marks them as in use
+func (c *InputCache) freeSlots(n int) ([]*InputCacheSlot, error) {
+	var slots []*InputCacheSlot
+	for i := range c.slots {
+		if len(slots) == n {
+			break
+		}
+
+		if !c.slots[i].InUse {
+			slots = append(slots, &c.slots[i])
+		}
+	}
+
+	if len(slots) < n {
+		return nil, errors.New("not enough free cache slots")
+	}
+
+	for _, slot := range slots {
+		slot.InUse = true
+		slot.lastUsed = time.Now()
+	}
+
+	return slots, nil
+}
+
+// fork moves the slots of the beams after a step of the search, where
+// parents is the beam that each new beam extends. The first beam to extend
+// each parent keeps its slot, while the others take one that is no longer
+// used and share the cache entries of the parent.
+func (b *beamSearch) fork(cache *InputCache, parents []int) {
+	slots := make([]*InputCacheSlot, len(parents))
+	kept := make([]bool, len(b.slots))
+	for i, parent := range parents {
+		if !kept[parent] {
+			slots[i] = b.slots[parent]
+			kept[parent] = true
+		}
+	}
+
+	var free []*InputCacheSlot
+	for i, slot := range b.slots {
+		if !kept[i] {
+			free = append(free, slot)
+		}
+	}
+
+	// the free slots aren't the parent of any beam, so copying over them
+	// doesn't change the parents
+	for i, parent := range parents {
+		if slots[i] == nil {
+			slots[i], free = free[0], free[1:]
+
+			src := b.slots[parent]
+			cache.cache.CopyPrefix(src.Id, slots[i].Id, int32(len(src.Inputs)))
+			slots[i].Inputs = slices.Clone(src.Inputs)
+		}
+	}
+
+	b.slots = append(slots, free...)
+}
+
+// stepBeams extends the beams of the sequence at seqIndex with their logits
+// in a batch with vocabSize logits per output, and removes the sequence once
+// the search is done
+func (s *Server) stepBeams(seqIndex int, logits []float32, vocabSize int) error {
+	seq := s.seqs[seqIndex]
+	b := seq.beams
+
+	// completions are only returned at the end, so check if the connection
+	// has been closed
+	select {
+	case <-seq.quit:
+		s.removeSequence(seqIndex, "connection")
+		return nil
+	default:
+	}
+
+	rows := make([][]float32, len(b.Beams))
+	for i, beam := range b.Beams {
+		// the logits at the end of the prompt are those of the sequence,
+		// before the search starts
+		iBatch := seq.iBatch
+		if n := len(beam.Tokens); n > 0 {
+			b.slots[i].Inputs = append(b.slots[i].Inputs, input{token: beam.Tokens[n-1]})
+			iBatch = b.iBatch[i]
+		}
+
+		rows[i] = logits[iBatch*vocabSize : (iBatch+1)*vocabSize]
+	}
+
+	parents, err := b.Step(rows)
+	if err != nil {
+		return err
+	}
+
+	b.fork(s.cache, parents)
+
+	if b.Done() || seq.numPredict > 0 && seq.numPredicted >= seq.numPredict {
+		return s.finishBeams(seqIndex)
+	}
+
+	// the context can't be shifted for the beams separately
+	for _, slot := range b.slots[:len(b.Beams)] {
+		if int32(len(slot.Inputs)+1) > s.cache.numCtx {
+			return s.finishBeams(seqIndex)
+		}
+	}
+
+	return nil
+}
+
+// finishBeams returns the best completion of the beam search of the sequence
+// at seqIndex, and any others requested, and removes the sequence. Stop
+// sequences end the completions in which they occur.
+func (s *Server) finishBeams(seqIndex int) error {
+	seq := s.seqs[seqIndex]
+	reason := "stop"
+
+	results := seq.beams.Results()
+	for i, result := range results {
+		text, err := s.model.(model.TextProcessor).Decode(result.Tokens)
+		if err != nil {
+			return err
+		}
+
+		if ok, stop := common.FindStop(text, seq.stop); ok {
+			text, _, _ = strings.Cut(text, stop)
+			result.Done = true
+		}
+
+		if i == 0 {
+			seq.pendingResponses = append(seq.pendingResponses, text)
+			if !result.Done {
+				reason = "limit"
+			}
+		}
+
+		if i < seq.beams.returnSequences {
+			seq.sequences = append(seq.sequences, api.BeamSequence{Response: text, Logprob: result.Logprob})
+		}
+	}
+
+	s.removeSequence(seqIndex, reason)
+	return nil
+}
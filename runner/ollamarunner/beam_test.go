@@ -0,0 +1,101 @@
+package ollamarunner
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/kvcache"
+)
+
+// prefixCache records the copies of prefixes between sequences
+type prefixCache struct {
+	kvcache.Cache
+
+	copies [][3]int
+}
+
+func (c *prefixCache) CopyPrefix(srcSeq, dstSeq int, len int32) {
+	c.copies = append(c.copies, [3]int{srcSeq, dstSeq, int(len)})
+}
+
+func TestBeamFork(t *testing.T) {
+	cache := &prefixCache{}
+	c := &InputCache{
+		numCtx:  16,
+		enabled: true,
+		cache:   cache,
+		slots: []InputCacheSlot{
+			{Id: 0, Inputs: []input{{token: 1}, {token: 2}}, InUse: true},
+			{Id: 1},
+			{Id: 2, InUse: true},
+			{Id: 3},
+			{Id: 4},
+		},
+	}
+
+	slots, err := c.freeSlots(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slots[0].Id != 1 || slots[1].Id != 3 || !slots[0].InUse || !slots[1].InUse {
+		t.Fatalf("have free slots %v and %v; want slots 1 and 3 in use", slots[0].Id, slots[1].Id)
+	}
+
+	if _, err := c.freeSlots(2); err == nil {
+		t.Fatal("expected an error for too few free slots")
+	}
+
+	b := &beamSearch{slots: append([]*InputCacheSlot{&c.slots[0]}, slots...)}
+	ids := func() []int {
+		var ids []int
+		for _, slot := range b.slots {
+			ids = append(ids, slot.Id)
+		}
+		return ids
+	}
+
+	// all beams extend the prompt
+	b.fork(c, []int{0, 0, 0})
+	if want := []int{0, 1, 3}; !slices.Equal(ids(), want) {
+		t.Errorf("have slots %v; want %v", ids(), want)
+	}
+
+	if want := [][3]int{{0, 1, 2}, {0, 3, 2}}; !slices.Equal(cache.copies, want) {
+		t.Errorf("have copies %v; want %v", cache.copies, want)
+	}
+
+	for _, slot := range b.slots {
+		if len(slot.Inputs) != 2 {
+			t.Errorf("slot %v has %v inputs; want 2", slot.Id, len(slot.Inputs))
+		}
+	}
+
+	// each beam has a token more than the prompt
+	b.slots[0].Inputs = append(b.slots[0].Inputs, input{token: 3})
+	b.slots[1].Inputs = append(b.slots[1].Inputs, input{token: 4})
+	b.slots[2].Inputs = append(b.slots[2].Inputs, input{token: 5})
+
+	// the third beam extends twice and the second not at all, so its slot
+	// is reused
+	cache.copies = nil
+	b.fork(c, []int{2, 0, 2})
+	if want := []int{3, 0, 1}; !slices.Equal(ids(), want) {
+		t.Errorf("have slots %v; want %v", ids(), want)
+	}
+
+	if want := [][3]int{{3, 1, 3}}; !slices.Equal(cache.copies, want) {
+		t.Errorf("have copies %v; want %v", cache.copies, want)
+	}
+
+	if want := []input{{token: 1}, {token: 2}, {token: 5}}; !slices.Equal(b.slots[2].Inputs, want) {
+		t.Errorf("slot 1 has inputs %v; want %v", b.slots[2].Inputs, want)
+	}
+
+	// fewer beams leave the rest of the slots unused
+	cache.copies = nil
+	b.fork(c, []int{1})
+	if want := []int{0, 3, 1}; !slices.Equal(ids(), want) || len(cache.copies) != 0 {
+		t.Errorf("have slots %v with copies %v; want %v with none", ids(), cache.copies, want)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"math"
 	"reflect"
+	"slices"
 	"time"
 
 	"github.com/ollama/ollama/kvcache"
@@ -29,9 +30,16 @@ type InputCache struct {
 	multiUserCache bool
 
 	cache kvcache.Cache
+
+	// type of the data stored in the cache
+	dtype ml.DType
+
+	// prompt prefixes that have been processed, to find the slots that
+	// can be reused for a prompt
+	prefixes *prefixIndex
 }
 
-func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots int, multiUserCache bool) (*InputCache, error) {
+func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots int, batchSize int, multiUserCache bool) (*InputCache, error) {
 	if kvSize/int32(numSlots) < 1 {
 		return nil, fmt.Errorf("must have at least one kv cache entry per parallel sequence (kv: %v parallel: %v)", kvSize, numSlots)
 	}
@@ -45,9 +53,10 @@ func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots
 		}
 	}
 
+	dtype := kvCacheTypeFromStr(kvCacheType)
 	cache := model.Config().Cache
 	if cache != nil {
-		cache.Init(model.Backend(), kvCacheTypeFromStr(kvCacheType), kvSize)
+		cache.Init(model.Backend(), dtype, numSlots, kvSize, batchSize)
 	}
 
 	return &InputCache{
@@ -56,15 +65,17 @@ func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots
 		slots:          slots,
 		multiUserCache: multiUserCache,
 		cache:          cache,
+		dtype:          dtype,
+		prefixes:       newPrefixIndex(int(kvSize) / prefixBlockSize),
 	}, nil
 }
 
 func kvCacheTypeFromStr(s string) ml.DType {
 	switch s {
 	case "q8_0":
-		panic("kv cache quantization not yet implemented")
+		return ml.DTypeQ80
 	case "q4_0":
-		panic("kv cache quantization not yet implemented")
+		return ml.DTypeQ40
 	default:
 		return ml.DTypeF16
 	}
@@ -116,6 +127,7 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 
 	slot.InUse = true
 	slot.lastUsed = time.Now()
+	c.prefixes.put(prefixHashes(prompt), slot.Id)
 
 	if numPast == int32(len(prompt)) {
 		// Leave one input to sample so we can get a response
@@ -123,6 +135,12 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	}
 
 	if c.cache != nil {
+		if numPast > 0 && !c.cache.CanResume(slot.Id, numPast) {
+			// the tokens before numPast that the rest of the prompt attends
+			// to have been evicted from the cache
+			numPast = 0
+		}
+
 		err = c.cache.Remove(slot.Id, numPast, math.MaxInt32)
 		if err != nil {
 			// Some models don't support partial erasure
@@ -144,53 +162,55 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 }
 
 func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int32, error) {
-	longest := int32(-1)
-	var longestSlot *InputCacheSlot
+	longestSlot, longest := c.findPrefix(prompt)
+	if longestSlot != nil && !longestSlot.InUse {
+		return longestSlot, longest, nil
+	}
 
+	// the longest prefix is that of a slot in use by another sequence, so
+	// the free slot with the longest prefix shares its cache entries
+	count := int32(-1)
+	var slot *InputCacheSlot
 	for i, s := range c.slots {
 		if s.InUse {
 			continue
 		}
 
-		count := countCommonPrefix(s.Inputs, prompt)
-		if count > longest {
-			longest = count
-			longestSlot = &c.slots[i]
+		if n := countCommonPrefix(s.Inputs, prompt); n > count {
+			count = n
+			slot = &c.slots[i]
 		}
 	}
 
-	if longestSlot == nil {
+	if slot == nil {
 		return nil, 0, errors.New("no available cache slots")
 	}
 
-	return longestSlot, longest, nil
+	if longest > count {
+		c.forkSlot(longestSlot, slot, longest)
+		count = longest
+	}
+
+	return slot, count, nil
 }
 
 func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int32, error) {
 	oldest := time.Now()
 	var oldestSlot *InputCacheSlot
 
-	longest := int32(-1)
-	var longestSlot *InputCacheSlot
-
 	for i, s := range c.slots {
-		count := countCommonPrefix(s.Inputs, prompt)
-		if count > longest {
-			longest = count
-			longestSlot = &c.slots[i]
-		}
-
 		if s.lastUsed.Compare(oldest) < 0 && !s.InUse {
 			oldest = s.lastUsed
 			oldestSlot = &c.slots[i]
 		}
 	}
 
+	longestSlot, longest := c.findPrefix(prompt)
 	if longest == int32(len(longestSlot.Inputs)) && !longestSlot.InUse {
 		return longestSlot, longest, nil
 	}
 
-	if oldestSlot.InUse {
+	if oldestSlot == nil {
 		return nil, 0, errors.New("no available cache slots")
 	}
 
@@ -200,18 +220,23 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int32,
 	}
 
 	if longest > 0 && longestSlot != oldestSlot {
-		slog.Debug("forking cache slot", "src", longestSlot.Id, "dst", oldestSlot.Id, "inputs", longest, "total",
-			len(longestSlot.Inputs))
-		oldestSlot.Inputs = make([]input, longest)
-		copy(oldestSlot.Inputs, longestSlot.Inputs[:longest])
-		if c.cache != nil {
-			c.cache.CopyPrefix(longestSlot.Id, oldestSlot.Id, longest)
-		}
+		c.forkSlot(longestSlot, oldestSlot, longest)
 	}
 
 	return oldestSlot, longest, nil
 }
 
+// forkSlot replaces the inputs of dst with the first n inputs of src, which
+// share their cache entries until either slot changes them
+func (c *InputCache) forkSlot(src, dst *InputCacheSlot, n int32) {
+	slog.Debug("forking cache slot", "src", src.Id, "dst", dst.Id, "inputs", n, "total", len(src.Inputs))
+	dst.Inputs = make([]input, n)
+	copy(dst.Inputs, src.Inputs[:n])
+	if c.cache != nil {
+		c.cache.CopyPrefix(src.Id, dst.Id, n)
+	}
+}
+
 func countCommonPrefix(a []input, b []input) int32 {
 	var count int32
 
@@ -278,3 +303,49 @@ func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int32) error {
 
 	return nil
 }
+
+// ShiftPrompt shortens a prompt that doesn't fit in the context by discarding
+// inputs after the first numKeep, as a context shift would instead of
+// truncating the prompt. If an idle slot was shifted while processing an
+// earlier prompt that this one continues, such as the previous turn of a
+// chat, the same inputs are discarded so that the slot can be reused rather
+// than processing the whole prompt again. Any inputs that still don't fit are
+// discarded by shifting the slot while they are processed.
+func (c *InputCache) ShiftPrompt(prompt []input, numKeep int32) []input {
+	if int32(len(prompt)) <= c.numCtx {
+		return prompt
+	}
+
+	// find the slot and number of discarded inputs that leave the most of
+	// the inputs after numKeep in common with the slot
+	var discard, longest int32
+	for _, s := range c.slots {
+		if s.InUse || int32(len(s.Inputs)) <= numKeep || countCommonPrefix(s.Inputs[:numKeep], prompt) < numKeep {
+			continue
+		}
+
+		kept := s.Inputs[numKeep:]
+		for d := range int32(len(prompt)) - numKeep {
+			if !reflect.DeepEqual(kept[0], prompt[numKeep+d]) {
+				continue
+			}
+
+			if count := countCommonPrefix(kept, prompt[numKeep+d:]); count > longest {
+				discard, longest = d, count
+			}
+		}
+	}
+
+	// without a slot to continue from, or with more new inputs than fit in
+	// the context, processing inputs that would be discarded by a shift
+	// anyway is wasted, so rather discard them up front
+	if longest == 0 || int32(len(prompt))-discard-longest > c.numCtx {
+		discard = int32(len(prompt)) - c.numCtx
+		longest = 0
+	}
+
+	slog.Info("context limit hit - shifting prompt", "limit", c.numCtx, "prompt", len(prompt), "keep", numKeep,
+		"discard", discard, "cached", longest)
+
+	return slices.Concat(prompt[:numKeep], prompt[numKeep+discard:])
+}
@@ -2,6 +2,7 @@ package ollamarunner
 
 import (
 	"image"
+	"slices"
 	"testing"
 	"time"
 )
@@ -196,8 +197,9 @@ func TestFindCacheSlot(t *testing.T) {
 					lastUsed: time.Now().Add(-2 * time.Second),
 				},
 			}},
+			// the prefix of the slot in use is shared with the free slot
 			prompt:  []input{{token: 1}, {token: 2}},
-			longest: expected{result: 1, len: 1},
+			longest: expected{result: 1, len: 2},
 			best:    expected{result: 1, len: 2},
 		},
 	}
@@ -289,3 +291,86 @@ func TestShiftDiscard(t *testing.T) {
 		})
 	}
 }
+
+func TestShiftPrompt(t *testing.T) {
+	inputs := func(tokens ...int32) []input {
+		var inputs []input
+		for _, t := range tokens {
+			inputs = append(inputs, input{token: t})
+		}
+		return inputs
+	}
+
+	span := func(begin, end int32) []int32 {
+		var tokens []int32
+		for t := begin; t <= end; t++ {
+			tokens = append(tokens, t)
+		}
+		return tokens
+	}
+
+	tests := []struct {
+		name     string
+		slot     []input
+		inUse    bool
+		prompt   []input
+		expected []input
+	}{
+		{
+			name:     "Fits",
+			slot:     inputs(1, 2, 5, 6),
+			prompt:   inputs(span(1, 8)...),
+			expected: inputs(span(1, 8)...),
+		},
+		{
+			name:     "Truncate",
+			prompt:   inputs(span(1, 12)...),
+			expected: inputs(append([]int32{1, 2}, span(7, 12)...)...),
+		},
+		{
+			name:     "Continue",
+			slot:     inputs(1, 2, 5, 6, 7, 8),
+			prompt:   inputs(span(1, 10)...),
+			expected: inputs(append([]int32{1, 2}, span(5, 10)...)...),
+		},
+		{
+			name:     "Continue Over Limit",
+			slot:     inputs(1, 2, 5, 6, 7, 8),
+			prompt:   inputs(span(1, 12)...),
+			expected: inputs(append([]int32{1, 2}, span(5, 12)...)...),
+		},
+		{
+			name:     "In Use",
+			slot:     inputs(1, 2, 5, 6, 7, 8),
+			inUse:    true,
+			prompt:   inputs(span(1, 12)...),
+			expected: inputs(append([]int32{1, 2}, span(7, 12)...)...),
+		},
+		{
+			name:     "Different Keep",
+			slot:     inputs(9, 2, 5, 6, 7, 8),
+			prompt:   inputs(span(1, 12)...),
+			expected: inputs(append([]int32{1, 2}, span(7, 12)...)...),
+		},
+		{
+			name:     "Too Many New",
+			slot:     inputs(1, 2, 3, 4),
+			prompt:   inputs(span(1, 20)...),
+			expected: inputs(append([]int32{1, 2}, span(15, 20)...)...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := InputCache{
+				numCtx: 8,
+				slots:  []InputCacheSlot{{Id: 0, Inputs: tt.slot, InUse: tt.inUse}},
+			}
+
+			result := c.ShiftPrompt(tt.prompt, 2)
+			if !slices.Equal(result, tt.expected) {
+				t.Errorf("ShiftPrompt: have %v; want %v", result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package ollamarunner
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/sample"
+)
+
+// draftModel is a smaller model with the same vocabulary as the model, which
+// proposes the tokens that follow a sequence for the model to verify in a
+// single batch. This is speculative decoding: as the model reads its weights
+// once for the whole batch, it generates several tokens in about the time of
+// one whenever the draft model is right.
+type draftModel struct {
+	model model.Model
+
+	// cache of the draft model, with a slot for each slot of the cache of
+	// the model that holds the same inputs up to where they differ
+	cache *InputCache
+
+	batchSize int
+}
+
+func newDraftModel(mpath string, params ml.BackendParams, target model.Model, kvCacheType string, kvSize int32, parallel, batchSize int) (*draftModel, error) {
+	m, err := model.New(mpath, params)
+	if err != nil {
+		return nil, err
+	}
+
+	tp, ok := m.(model.TextProcessor)
+	if !ok {
+		return nil, errors.New("draft model does not generate text")
+	}
+
+	if have, want := len(tp.Vocabulary().Values), len(target.(model.TextProcessor).Vocabulary().Values); have != want {
+		return nil, fmt.Errorf("draft model has a vocabulary of %d tokens, but the model has %d", have, want)
+	}
+
+	cache, err := NewInputCache(m, kvCacheType, kvSize, parallel, batchSize, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cache.enabled {
+		return nil, errors.New("draft model does not support caching")
+	}
+
+	return &draftModel{model: m, cache: cache, batchSize: batchSize}, nil
+}
+
+// propose returns up to n tokens that the draft model predicts to follow the
+// inputs of slot, a slot of the cache of the model, and next, the input that
+// the model processes next. The draft model first processes whatever inputs it
+// doesn't have in its own cache, and then proposes its most likely tokens. As
+// the model samples the tokens itself, this doesn't change them.
+func (d *draftModel) propose(slot *InputCacheSlot, next input, n int) ([]int32, error) {
+	inputs := append(slices.Clip(slot.Inputs), next)
+
+	// the draft model only processes text
+	if slices.ContainsFunc(inputs, func(i input) bool { return i.image != nil }) {
+		return nil, nil
+	}
+
+	dslot := &d.cache.slots[slot.Id]
+
+	// the logits of the last input are needed even if it is in the cache
+	numPast := min(countCommonPrefix(dslot.Inputs, inputs), int32(len(inputs)-1))
+	if numPast > 0 && !d.cache.cache.CanResume(dslot.Id, numPast) {
+		numPast = 0
+	}
+
+	if err := d.cache.cache.Remove(dslot.Id, numPast, math.MaxInt32); err != nil {
+		if err := d.cache.cache.Remove(dslot.Id, 0, math.MaxInt32); err != nil {
+			return nil, err
+		}
+		numPast = 0
+	}
+
+	dslot.Inputs = dslot.Inputs[:numPast]
+
+	pending := inputs[numPast:]
+	var draft []int32
+	for len(draft) < n {
+		batch := pending[:min(len(pending), d.batchSize)]
+		pending = pending[len(batch):]
+
+		logits, err := d.forward(dslot, batch)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pending) > 0 {
+			continue
+		}
+
+		token, err := sample.Greedy().Sample(logits)
+		if err != nil {
+			return nil, err
+		}
+
+		draft = append(draft, token)
+		if d.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
+			break
+		}
+
+		pending = []input{{token: token}}
+	}
+
+	slog.Debug("draft", "slot", dslot.Id, "cached", numPast, "tokens", draft)
+	return draft, nil
+}
+
+// forward processes inputs after those in slot and returns the logits of the
+// last of them
+func (d *draftModel) forward(slot *InputCacheSlot, inputs []input) ([]float32, error) {
+	var options model.Options
+	for i, input := range inputs {
+		options.Inputs = append(options.Inputs, input.token)
+		options.Positions = append(options.Positions, int32(len(slot.Inputs)+i))
+		options.Sequences = append(options.Sequences, slot.Id)
+	}
+	options.Outputs = []int32{int32(len(inputs) - 1)}
+
+	ctx := d.model.Backend().NewContext()
+	defer ctx.Close()
+
+	t, err := model.Forward(ctx, d.model, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode draft batch: %w", err)
+	}
+
+	slot.Inputs = append(slot.Inputs, inputs...)
+	return t.Floats(), nil
+}
+
+// numDraft is the number of tokens that the draft model can propose for seq
+// in the next batch, which must fit in the batch and the context of the
+// sequence without shifting it, and not generate more than numPredict tokens
+func (s *Server) numDraft(seq *Sequence) int {
+	if s.draft == nil || seq.numDraft <= 0 || seq.beams != nil || seq.classify || len(seq.inputs) != 1 {
+		return 0
+	}
+
+	n := min(seq.numDraft, s.batchSize-1, int(s.cache.numCtx)-len(seq.cache.Inputs)-1)
+	if seq.numPredict > 0 {
+		n = min(n, seq.numPredict-seq.numPredicted-1)
+	}
+
+	return max(n, 0)
+}
+
+// verifyDraft samples the tokens of the sequence at seqIndex from the logits
+// of a batch with vocabSize logits per output, where the sequence has the
+// outputs of its next input and of each of the tokens proposed by the draft
+// model after it. Each token is sampled from the logits that follow the
+// tokens before it, so the proposals are accepted up to the first that
+// differs from the token sampled in its place, which is the last token.
+//
+// This is the rejection sampling of speculative decoding for a draft model
+// that proposes its most likely tokens: a proposal is accepted with the
+// probability of the model sampling it, and otherwise the token is sampled
+// from the other tokens by their probabilities. The tokens are thus exactly
+// those that would be sampled without the draft model.
+func (s *Server) verifyDraft(seqIndex int, logits []float32, vocabSize int) error {
+	seq := s.seqs[seqIndex]
+	slot := seq.cache
+	draft := seq.draft
+	seq.draft = nil
+	seq.numDrafted += len(draft)
+
+	// the proposals are only kept in the cache once they are accepted
+	slot.Inputs = slot.Inputs[:len(slot.Inputs)-len(draft)]
+
+	for i := range len(draft) + 1 {
+		if i > 0 {
+			seq.numPredicted++
+		}
+
+		iBatch := seq.iBatch + i
+		token, err := seq.sampler.Sample(logits[iBatch*vocabSize : (iBatch+1)*vocabSize])
+		if err != nil {
+			return fmt.Errorf("failed to sample token: %w", err)
+		}
+
+		accepted := i < len(draft) && token == draft[i]
+		if accepted {
+			seq.numAccepted++
+		}
+
+		ok, err := s.addToken(seqIndex, token)
+		if err != nil {
+			return err
+		}
+
+		if !ok || !accepted {
+			break
+		}
+
+		// the model processed the proposal in the batch with the rest
+		slot.Inputs = append(slot.Inputs, input{token: token})
+	}
+
+	return s.cache.cache.Remove(slot.Id, int32(len(slot.Inputs)), math.MaxInt32)
+}
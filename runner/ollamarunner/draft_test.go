@@ -0,0 +1,172 @@
+package ollamarunner
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/sample"
+)
+
+// textModel decodes each token as its id and never ends a sequence
+type textModel struct {
+	model.Model
+}
+
+func (textModel) Encode(string) ([]int32, error) { return nil, nil }
+
+func (textModel) Decode(tokens []int32) (string, error) {
+	var s string
+	for _, token := range tokens {
+		s += strconv.Itoa(int(token))
+	}
+	return s, nil
+}
+
+func (textModel) Is(int32, model.Special) bool { return false }
+
+func (textModel) Vocabulary() *model.Vocabulary { return &model.Vocabulary{} }
+
+// toyLogits are the logits of the next of 6 tokens after tokens, where
+// offset changes how likely the tokens are
+func toyLogits(tokens []input, offset float64) []float32 {
+	logits := make([]float32, 6)
+	for i := range logits {
+		logits[i] = float32(math.Sin(float64(len(tokens)*5+i*3) + offset))
+		for _, input := range tokens {
+			logits[i] += float32(0.5 * math.Cos(float64(input.token*int32(i+1))))
+		}
+	}
+
+	return logits
+}
+
+func TestVerifyDraft(t *testing.T) {
+	newSampler := func(temperature float32) sample.Sampler {
+		if temperature == 0 {
+			return sample.Greedy()
+		}
+
+		sampler, err := sample.NewSampler(temperature, 0, 0, 0, 42, nil, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sampler
+	}
+
+	prompt := []input{{token: 1}, {token: 2}}
+	const n = 24
+
+	for _, temperature := range []float32{0, 1} {
+		t.Run(strconv.FormatFloat(float64(temperature), 'f', -1, 32), func(t *testing.T) {
+			// the tokens sampled without a draft model
+			want := slices.Clone(prompt)
+			sampler := newSampler(temperature)
+			for range n {
+				token, err := sampler.Sample(toyLogits(want, 0))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, input{token: token})
+			}
+
+			s := &Server{
+				model: textModel{},
+				cache: &InputCache{numCtx: 64, enabled: true, cache: &snapshotCache{}},
+			}
+
+			slot := &InputCacheSlot{Inputs: slices.Clone(prompt[:1])}
+			seq := &Sequence{
+				inputs:    slices.Clone(prompt[1:]),
+				cache:     slot,
+				sampler:   newSampler(temperature),
+				responses: make(chan response, 2*n),
+			}
+			s.seqs = []*Sequence{seq}
+
+			for len(slot.Inputs)+1 < len(want) {
+				// the draft model proposes the most likely tokens of
+				// logits that are close to those of the model
+				var draft []int32
+				inputs := append(slices.Clone(slot.Inputs), seq.inputs[0])
+				for range 3 {
+					token, err := sample.Greedy().Sample(toyLogits(inputs, 0.3))
+					if err != nil {
+						t.Fatal(err)
+					}
+					draft = append(draft, token)
+					inputs = append(inputs, input{token: token})
+				}
+
+				// the batch has the next input and the proposals, with
+				// the logits of each of them
+				var logits []float32
+				for i := range len(draft) + 1 {
+					logits = append(logits, toyLogits(inputs[:len(slot.Inputs)+1+i], 0)...)
+				}
+
+				slot.Inputs = inputs
+				seq.draft = draft
+				seq.iBatch = 0
+				if err := s.verifyDraft(0, logits, 6); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			have := append(slices.Clone(slot.Inputs), seq.inputs...)
+			if !slices.Equal(have[:len(want)], want) {
+				t.Errorf("have tokens %v; want %v", have, want)
+			}
+
+			if seq.numAccepted == 0 || seq.numAccepted == seq.numDrafted {
+				t.Errorf("have %d of %d proposals accepted; want some but not all", seq.numAccepted, seq.numDrafted)
+			}
+
+			// the first token of each batch is counted with the batch
+			if seq.numPredicted != seq.numAccepted {
+				t.Errorf("have %d tokens predicted; want %d", seq.numPredicted, seq.numAccepted)
+			}
+		})
+	}
+}
+
+func TestNumDraft(t *testing.T) {
+	s := &Server{
+		draft:     &draftModel{},
+		batchSize: 8,
+		cache:     &InputCache{numCtx: 16},
+	}
+
+	tests := []struct {
+		name string
+		seq  Sequence
+		want int
+	}{
+		{"NumDraft", Sequence{numDraft: 4}, 4},
+		{"Disabled", Sequence{numDraft: 0}, 0},
+		{"Batch", Sequence{numDraft: 16}, 7},
+		{"Context", Sequence{numDraft: 4, cache: &InputCacheSlot{Inputs: make([]input, 13)}}, 2},
+		{"ContextFull", Sequence{numDraft: 4, cache: &InputCacheSlot{Inputs: make([]input, 15)}}, 0},
+		{"NumPredict", Sequence{numDraft: 4, numPredict: 10, numPredicted: 8}, 1},
+		{"Prompt", Sequence{numDraft: 4, inputs: make([]input, 2)}, 0},
+		{"Beams", Sequence{numDraft: 4, beams: &beamSearch{}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seq := tt.seq
+			if seq.cache == nil {
+				seq.cache = &InputCacheSlot{}
+			}
+			if seq.inputs == nil {
+				seq.inputs = []input{{token: 1}}
+			}
+
+			if got := s.numDraft(&seq); got != tt.want {
+				t.Errorf("have %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
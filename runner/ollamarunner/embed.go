@@ -0,0 +1,107 @@
+package ollamarunner
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+
+	"github.com/ollama/ollama/ml/nn"
+	"github.com/ollama/ollama/model"
+)
+
+// embeddingInputs returns the inputs of content to embed, truncated to the
+// context of a sequence
+func (s *Server) embeddingInputs(content string) ([]input, error) {
+	inputs, err := s.inputs(content, nil)
+	if err != nil {
+		return nil, err
+	} else if len(inputs) == 0 {
+		return nil, errors.New("no input provided")
+	}
+
+	if int32(len(inputs)) > s.cache.numCtx {
+		slog.Warn("truncating input prompt", "limit", s.cache.numCtx, "prompt", len(inputs))
+		inputs = inputs[:s.cache.numCtx]
+	}
+
+	return inputs, nil
+}
+
+// embed computes the embeddings of inputs, which are packed into batches of
+// up to batchSize inputs in total rather than processed one at a time, as
+// embedding models are typically given many short inputs. The hidden states
+// are pooled over the whole of each input, so an input that is longer than a
+// batch is processed in a batch of its own. The embeddings are in the order
+// of inputs. pooling, if not nil, overrides the pooling of the model.
+func (s *Server) embed(ctx context.Context, inputs [][]input, pooling *nn.Pooler) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(inputs))
+	for len(inputs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n, size := 1, len(inputs[0])
+		for n < len(inputs) && size+len(inputs[n]) <= s.batchSize {
+			size += len(inputs[n])
+			n++
+		}
+
+		batch, err := s.embedBatch(inputs[:n], pooling)
+		if err != nil {
+			return nil, err
+		}
+
+		embeddings = append(embeddings, batch...)
+		inputs = inputs[n:]
+	}
+
+	return embeddings, nil
+}
+
+// embedBatch computes the embeddings of inputs in a single batch. Each input
+// is a sequence of its own, after the ids of the slots of the cache, so the
+// inputs don't attend to each other and no slot is taken from the sequences
+// that are generating. The cells of the sequences are freed afterwards.
+func (s *Server) embedBatch(inputs [][]input, pooling *nn.Pooler) ([][]float32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := len(s.cache.slots)
+
+	opts := model.Options{Pooling: pooling}
+	for i, seq := range inputs {
+		for j, input := range seq {
+			opts.Inputs = append(opts.Inputs, input.token)
+			opts.Positions = append(opts.Positions, int32(j))
+			opts.Sequences = append(opts.Sequences, first+i)
+		}
+	}
+
+	ctx := s.model.Backend().NewContext()
+	defer ctx.Close()
+
+	t, err := model.Embed(ctx, s.model, opts)
+
+	if s.cache.cache != nil {
+		for i := range inputs {
+			if rerr := s.cache.cache.Remove(first+i, 0, math.MaxInt32); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := t.Dim(0)
+	values := t.Floats()
+
+	embeddings := make([][]float32, len(inputs))
+	for i := range embeddings {
+		embeddings[i] = values[i*hidden : (i+1)*hidden]
+	}
+
+	return embeddings, nil
+}
@@ -0,0 +1,180 @@
+package ollamarunner
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/nn"
+	"github.com/ollama/ollama/model"
+)
+
+// embeddingInputsOf returns n inputs of between 1 and max tokens that depend
+// on seed
+func embeddingInputsOf(n, max, seed int) [][]input {
+	inputs := make([][]input, n)
+	for i := range inputs {
+		inputs[i] = make([]input, 1+(seed+i*13)%max)
+		for j := range inputs[i] {
+			inputs[i][j].token = int32((seed + i*31 + j*7) % 127)
+		}
+	}
+	return inputs
+}
+
+func TestEmbed(t *testing.T) {
+	m, err := model.New(writeModel(t, 2, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the inputs are embedded twice, which only fits in the cache if the
+	// cells of each batch are freed afterwards
+	s := newModelServer(t, m, 1, 32, 64)
+
+	// the last input is longer than a batch
+	inputs := append(embeddingInputsOf(6, 12, 0), embeddingInputsOf(1, 40, 39)...)
+	if len(inputs[len(inputs)-1]) <= s.batchSize {
+		t.Fatalf("have %d inputs in the last input; want more than a batch", len(inputs[len(inputs)-1]))
+	}
+
+	packed, err := s.embed(context.Background(), inputs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packed) != len(inputs) {
+		t.Fatalf("have %d embeddings; want %d", len(packed), len(inputs))
+	}
+
+	// packing the inputs gives the embeddings of each of them on its own
+	for i, in := range inputs {
+		sequential, err := s.embed(context.Background(), [][]input{in}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(packed[i]) != 64 || len(sequential[0]) != 64 {
+			t.Fatalf("input %d: have %d and %d values; want 64", i, len(packed[i]), len(sequential[0]))
+		}
+
+		for j := range packed[i] {
+			if diff := math.Abs(float64(packed[i][j] - sequential[0][j])); diff > 1e-3 {
+				t.Fatalf("input %d: have %v at %d packed and %v on its own", i, packed[i][j], j, sequential[0][j])
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.embed(ctx, inputs, nil); err != context.Canceled {
+		t.Errorf("have error %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestEmbedPooling(t *testing.T) {
+	m, err := model.New(writeModel(t, 2, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newModelServer(t, m, 1, 32, 64)
+	inputs := embeddingInputsOf(3, 6, 5)
+
+	embed := func(inputs [][]input, pooling nn.Pooler) [][]float32 {
+		t.Helper()
+		embeddings, err := s.embed(context.Background(), inputs, &pooling)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return embeddings
+	}
+
+	equal := func(a, b []float32) bool {
+		for i := range a {
+			if math.Abs(float64(a[i]-b[i])) > 1e-3 {
+				return false
+			}
+		}
+		return len(a) == len(b)
+	}
+
+	// the model pools the last token without a pooling_type
+	last, err := s.embed(context.Background(), inputs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, e := range embed(inputs, nn.PoolerLast) {
+		if !equal(e, last[i]) {
+			t.Errorf("input %d: last pooling differs from the pooling of the model", i)
+		}
+	}
+
+	// the first token only attends to itself, so it is pooled as the last
+	// token of an input of just that token
+	for i, e := range embed(inputs, nn.PoolerCLS) {
+		if want := embed([][]input{inputs[i][:1]}, nn.PoolerLast)[0]; !equal(e, want) {
+			t.Errorf("input %d: cls pooling differs from the first token", i)
+		}
+	}
+
+	// the tokens of the other inputs in the batch are not averaged
+	for i, e := range embed(inputs, nn.PoolerMean) {
+		if want := embed([][]input{inputs[i]}, nn.PoolerMean)[0]; !equal(e, want) {
+			t.Errorf("input %d: mean pooling differs in a batch", i)
+		}
+
+		if len(inputs[i]) > 1 && equal(e, last[i]) {
+			t.Errorf("input %d: mean pooling is the same as last", i)
+		}
+	}
+
+	// no pooling is an override of its own rather than the pooling of the
+	// model, and can't embed a sequence
+	none := nn.PoolerNone
+	if _, err := s.embed(context.Background(), inputs, &none); err == nil {
+		t.Error("expected error for no pooling")
+	}
+}
+
+// BenchmarkEmbed embeds 1000 short inputs and reports the inputs embedded per
+// second. Packed embeds them in batches, as the runner does, while Sequential
+// embeds them one at a time.
+func BenchmarkEmbed(b *testing.B) {
+	m, err := model.New(writeModel(b, 2, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	s := newModelServer(b, m, 1, 512, 512)
+	inputs := embeddingInputsOf(1000, 16, 0)
+
+	for _, packed := range []bool{true, false} {
+		name := "Packed"
+		if !packed {
+			name = "Sequential"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var n int
+			for b.Loop() {
+				if packed {
+					if _, err := s.embed(b.Context(), inputs, nil); err != nil {
+						b.Fatal(err)
+					}
+				} else {
+					for _, in := range inputs {
+						if _, err := s.embed(b.Context(), [][]input{in}, nil); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				n += len(inputs)
+			}
+
+			b.ReportMetric(float64(n)/b.Elapsed().Seconds(), "inputs/s")
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package ollamarunner
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// preempt gives the place of a sequence to a request of higher priority that
+// is waiting for one. It's called between batches, so the sequence stops at a
+// token boundary with each of its inputs either in the cache or still to be
+// processed. Sequences of beam search and classification aren't preempted.
+func (s *Server) preempt() {
+	p, ok := s.seqsSem.Highest()
+	if !ok {
+		return
+	}
+
+	victim := -1
+	for i, seq := range s.seqs {
+		if seq == nil || seq.beams != nil || seq.classify || seq.admitted >= p {
+			continue
+		}
+
+		if victim < 0 || seq.admitted < s.seqs[victim].admitted {
+			victim = i
+		}
+	}
+
+	if victim < 0 {
+		return
+	}
+
+	seq := s.seqs[victim]
+	slog.Debug("preempting sequence", "priority", seq.admitted, "waiting", p, "inputs", len(seq.cache.Inputs))
+
+	// the request that takes the place of the sequence may also take its
+	// cache slot, so its inputs are kept to be processed again if they are
+	// replaced
+	seq.resume = slices.Concat(seq.cache.Inputs, seq.pendingInputs, seq.inputs)
+	seq.pendingInputs = nil
+	seq.cache.InUse = false
+	s.seqs[victim] = nil
+	s.seqsSem.Release(1, seq.admitted)
+
+	select {
+	case seq.preempted <- struct{}{}:
+	default:
+	}
+}
+
+// resumeSequence waits for a place for seq after it was preempted and adds it
+// back to the batch, continuing from the inputs that it had processed. These
+// are usually still in the cache, but are processed again if another
+// sequence replaced them. The priority of seq is aged from when it was
+// preempted.
+func (s *Server) resumeSequence(ctx context.Context, seq *Sequence) error {
+	admitted, err := s.seqsSem.Acquire(ctx, 1, seq.priority, time.Now())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.Index(s.seqs, nil)
+	if i < 0 {
+		s.seqsSem.Release(1, admitted)
+		return errors.New("could not find an available sequence")
+	}
+
+	cache, inputs, err := s.cache.LoadCacheSlot(seq.resume, true)
+	if err != nil {
+		s.seqsSem.Release(1, admitted)
+		return err
+	}
+
+	slog.Debug("resuming sequence", "priority", admitted, "inputs", len(seq.resume), "cached", len(seq.resume)-len(inputs))
+
+	seq.cache, seq.inputs, seq.resume, seq.admitted = cache, inputs, nil, admitted
+	s.seqs[i] = seq
+	s.cond.Signal()
+	return nil
+}
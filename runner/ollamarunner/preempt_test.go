@@ -0,0 +1,187 @@
+package ollamarunner
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/runner/common"
+)
+
+// TestPreempt serves a request of high priority while two of low priority,
+// such as bulk work, hold every place in the batch. The request of high
+// priority has its first token two batches after it arrives rather than once
+// one of the others ends, and the one that it preempts resumes afterwards.
+func TestPreempt(t *testing.T) {
+	m, err := model.New(writeModel(t, 1, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newModelServer(t, m, 2, 32, 256)
+
+	var low []*Sequence
+	for i := range 2 {
+		seq := addSequence(t, s, i, 8, 12, i)
+		s.seqsSem.Release(1, seq.admitted)
+		s.seqsSem.TryAcquire(1, common.PriorityLow)
+		seq.priority, seq.admitted = common.PriorityLow, common.PriorityLow
+		seq.preempted = make(chan struct{}, 1)
+		low = append(low, seq)
+	}
+
+	for range 2 {
+		if err := s.processBatch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the request of high priority waits for a place as the completion
+	// handler does
+	high := &Sequence{
+		inputs:     tokens(50, 8),
+		numPredict: 2,
+		sampler:    low[0].sampler,
+		responses:  make(chan response, 3),
+		quit:       make(chan bool),
+		scores:     make(chan []float32, 1),
+		priority:   common.PriorityHigh,
+	}
+
+	admitted := make(chan error)
+	go func() {
+		var err error
+		high.admitted, err = s.seqsSem.Acquire(t.Context(), 1, high.priority, time.Now())
+		if err == nil {
+			s.mu.Lock()
+			high.cache, high.inputs, err = s.cache.LoadCacheSlot(high.inputs, true)
+			s.seqs[slices.Index(s.seqs, nil)] = high
+			s.mu.Unlock()
+		}
+		admitted <- err
+	}()
+
+	for s.seqsSem.Waiting()[common.PriorityHigh] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the next batch preempts a sequence of low priority for it
+	if err := s.processBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-admitted; err != nil {
+		t.Fatal(err)
+	}
+
+	i := slices.IndexFunc(low, func(seq *Sequence) bool { return len(seq.preempted) > 0 })
+	if i < 0 {
+		t.Fatal("no sequence was preempted")
+	}
+	preempted, other := low[i], low[1-i]
+
+	// the preempted sequence waits to resume as the completion handler does
+	<-preempted.preempted
+	resumed := make(chan error)
+	go func() {
+		resumed <- s.resumeSequence(t.Context(), preempted)
+	}()
+
+	// the prompt of the request of high priority fits in the next batch
+	if err := s.processBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if high.numPredicted != 1 {
+		t.Errorf("request of high priority has %d tokens after its second batch; want 1", high.numPredicted)
+	}
+
+	for high.numPredicted < high.numPredict {
+		if err := s.processBatch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the other sequence kept generating throughout
+	if other.numPredicted != preempted.numPredicted+high.numPredict+1 {
+		t.Errorf("have %d tokens of the other sequence and %d of the preempted one; want %d more", other.numPredicted, preempted.numPredicted, high.numPredict+1)
+	}
+
+	if err := <-resumed; err != nil {
+		t.Fatal(err)
+	}
+
+	if preempted.admitted != common.PriorityLow || preempted.resume != nil {
+		t.Errorf("resumed with priority %v and %d inputs to resume; want %v and none", preempted.admitted, len(preempted.resume), common.PriorityLow)
+	}
+
+	// the preempted sequence continues from where it stopped, processing
+	// its inputs again as the request of high priority replaced them in
+	// its cache slot
+	numPredicted := preempted.numPredicted
+	if want := 8 + numPredicted; len(preempted.cache.Inputs)+len(preempted.inputs) != want {
+		t.Errorf("resumed with %d inputs; want %d", len(preempted.cache.Inputs)+len(preempted.inputs), want)
+	}
+
+	for !s.allNil() {
+		if err := s.processBatch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, seq := range low {
+		if seq.numPredicted != seq.numPredict || seq.doneReason != "limit" {
+			t.Errorf("have %d tokens with reason %q; want %d for the limit", seq.numPredicted, seq.doneReason, seq.numPredict)
+		}
+	}
+}
+
+func TestPreemptPriority(t *testing.T) {
+	m, err := model.New(writeModel(t, 1, 64, 4, 2, 128, 128), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newModelServer(t, m, 1, 32, 256)
+	seq := addSequence(t, s, 0, 8, 64, 0)
+
+	// a request waiting with the same priority doesn't preempt the sequence
+	done := make(chan error)
+	go func() {
+		_, err := s.seqsSem.Acquire(t.Context(), 1, common.PriorityNormal, time.Now())
+		done <- err
+	}()
+
+	for s.seqsSem.Waiting()[common.PriorityNormal] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := s.processBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.seqs[0] != seq {
+		t.Error("sequence was preempted by a request of the same priority")
+	}
+
+	// once the request has waited long enough, its priority is raised
+	// above that of the sequence
+	interval := common.AgingInterval
+	common.AgingInterval = time.Millisecond
+	defer func() { common.AgingInterval = interval }()
+	time.Sleep(2 * time.Millisecond)
+
+	if err := s.processBatch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if s.seqs[0] != nil || seq.resume == nil {
+		t.Error("sequence wasn't preempted by a request that waited")
+	}
+}
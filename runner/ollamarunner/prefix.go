@@ -0,0 +1,127 @@
+package ollamarunner
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// prefixBlockSize is the number of inputs in each block of a prompt. The
+// prefixes of a prompt that end at a block are hashed to find the slots that
+// have processed them.
+const prefixBlockSize = 64
+
+// prefixHashes returns the hashes of the prefixes of prompt that end at each
+// complete block, up to the first image
+func prefixHashes(prompt []input) []uint64 {
+	h := fnv.New64a()
+
+	var hashes []uint64
+	var b [4]byte
+	for i, input := range prompt {
+		if input.image != nil {
+			break
+		}
+
+		binary.LittleEndian.PutUint32(b[:], uint32(input.token))
+		h.Write(b[:])
+
+		if (i+1)%prefixBlockSize == 0 {
+			hashes = append(hashes, h.Sum64())
+		}
+	}
+
+	return hashes
+}
+
+// prefixIndex maps the hashes of prompt prefixes to the slot that last
+// processed them. Slots change without updating it, so the inputs of a slot
+// must be compared with the prompt before using it. Once it holds more than
+// capacity prefixes, the least recently used are evicted.
+type prefixIndex struct {
+	capacity int
+
+	prefixes map[uint64]*list.Element
+
+	// lru has the prefixes from the most to the least recently used
+	lru *list.List
+}
+
+type prefix struct {
+	hash uint64
+	slot int
+}
+
+func newPrefixIndex(capacity int) *prefixIndex {
+	return &prefixIndex{
+		capacity: max(capacity, 1),
+		prefixes: make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the slot that last processed the prefix with hash
+func (c *prefixIndex) get(hash uint64) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	e, ok := c.prefixes[hash]
+	if !ok {
+		return 0, false
+	}
+
+	c.lru.MoveToFront(e)
+	return e.Value.(prefix).slot, true
+}
+
+// put records that slot has processed the prefixes with hashes
+func (c *prefixIndex) put(hashes []uint64, slot int) {
+	if c == nil {
+		return
+	}
+
+	for _, hash := range hashes {
+		if e, ok := c.prefixes[hash]; ok {
+			e.Value = prefix{hash: hash, slot: slot}
+			c.lru.MoveToFront(e)
+			continue
+		}
+
+		c.prefixes[hash] = c.lru.PushFront(prefix{hash: hash, slot: slot})
+	}
+
+	for c.lru.Len() > c.capacity {
+		delete(c.prefixes, c.lru.Remove(c.lru.Back()).(prefix).hash)
+	}
+}
+
+// findPrefix returns the slot, whether or not it's in use, whose inputs have
+// the longest prefix in common with prompt and the length of that prefix
+func (c *InputCache) findPrefix(prompt []input) (*InputCacheSlot, int32) {
+	hashes := prefixHashes(prompt)
+	for i := len(hashes) - 1; i >= 0; i-- {
+		id, ok := c.prefixes.get(hashes[i])
+		if !ok {
+			continue
+		}
+
+		slot := &c.slots[id]
+		if count := countCommonPrefix(slot.Inputs, prompt); count >= int32((i+1)*prefixBlockSize) {
+			return slot, count
+		}
+	}
+
+	// prompts without a complete block in common with one that has been
+	// processed may still have a shorter prefix in common with a slot
+	longest := int32(-1)
+	var longestSlot *InputCacheSlot
+	for i, s := range c.slots {
+		if count := countCommonPrefix(s.Inputs, prompt); count > longest {
+			longest = count
+			longestSlot = &c.slots[i]
+		}
+	}
+
+	return longestSlot, longest
+}
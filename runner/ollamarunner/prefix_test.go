@@ -0,0 +1,131 @@
+package ollamarunner
+
+import (
+	"image"
+	"slices"
+	"testing"
+)
+
+// resumeCache is a prefixCache that can resume and remove any entries
+type resumeCache struct {
+	prefixCache
+}
+
+func (c *resumeCache) CanResume(seq int, pos int32) bool { return true }
+
+func (c *resumeCache) Remove(seq int, beginIndex, endIndex int32) error { return nil }
+
+func tokens(start, n int) []input {
+	inputs := make([]input, n)
+	for i := range inputs {
+		inputs[i] = input{token: int32(start + i)}
+	}
+	return inputs
+}
+
+func TestPrefixIndex(t *testing.T) {
+	c := newPrefixIndex(3)
+	c.put([]uint64{1, 2}, 0)
+	c.put([]uint64{2, 3}, 1)
+
+	if slot, ok := c.get(2); !ok || slot != 1 {
+		t.Errorf("prefix 2 is in slot %v (%v); want the last one to process it", slot, ok)
+	}
+
+	// prefix 1 is the least recently used
+	c.put([]uint64{4}, 2)
+	if _, ok := c.get(1); ok {
+		t.Error("least recently used prefix wasn't evicted")
+	}
+
+	for _, hash := range []uint64{2, 3, 4} {
+		if _, ok := c.get(hash); !ok {
+			t.Errorf("prefix %v was evicted", hash)
+		}
+	}
+}
+
+func TestPrefixHashes(t *testing.T) {
+	prompt := tokens(0, 3*prefixBlockSize+1)
+	hashes := prefixHashes(prompt)
+	if len(hashes) != 3 {
+		t.Fatalf("have %v hashes; want one for each complete block", len(hashes))
+	}
+
+	// prompts that diverge in the second block share the hash of the first
+	other := slices.Concat(prompt[:prefixBlockSize+1], tokens(1000, 2*prefixBlockSize))
+	if have := prefixHashes(other); have[0] != hashes[0] || have[1] == hashes[1] || have[2] == hashes[2] {
+		t.Errorf("have hashes %v; want the first of %v", have, hashes)
+	}
+
+	// images end the prefixes that are hashed
+	prompt[prefixBlockSize+1].image = image.NewGray(image.Rect(0, 0, 1, 1))
+	if have := prefixHashes(prompt); !slices.Equal(have, hashes[:1]) {
+		t.Errorf("have hashes %v; want %v", have, hashes[:1])
+	}
+}
+
+// TestPrefixReuse loads requests with a long system prompt in common, which
+// is only processed by the first of them
+func TestPrefixReuse(t *testing.T) {
+	system := tokens(0, 4096)
+	request := func(i int) []input {
+		return slices.Concat(system, tokens(10000*(i+1), 20))
+	}
+
+	for _, multiUserCache := range []bool{false, true} {
+		cache := &resumeCache{}
+		c := &InputCache{
+			numCtx:         8192,
+			enabled:        true,
+			multiUserCache: multiUserCache,
+			cache:          cache,
+			slots:          []InputCacheSlot{{Id: 0}, {Id: 1}, {Id: 2}},
+			prefixes:       newPrefixIndex(3 * 8192 / prefixBlockSize),
+		}
+
+		// process stores the inputs of a request as processBatch does
+		process := func(slot *InputCacheSlot, inputs []input) {
+			slot.Inputs = append(slot.Inputs, inputs...)
+		}
+
+		first, remaining, err := c.LoadCacheSlot(request(0), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(remaining) != len(request(0)) {
+			t.Errorf("first request has %v inputs to process; want all of them", len(remaining))
+		}
+		process(first, remaining)
+		first.InUse = false
+
+		// the second request only processes its own inputs
+		second, remaining, err := c.LoadCacheSlot(request(1), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(remaining) != 20 {
+			t.Errorf("multi user %v: second request has %v inputs to process; want 20", multiUserCache, len(remaining))
+		}
+		process(second, remaining)
+
+		// while the second request is being processed, a third shares its
+		// cache entries of the system prompt in another slot
+		cache.copies = nil
+		third, remaining, err := c.LoadCacheSlot(request(2), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if third == second || len(remaining) != 20 {
+			t.Errorf("multi user %v: third request is in slot %v of %v with %v inputs to process; want another with 20",
+				multiUserCache, third.Id, second.Id, len(remaining))
+		}
+
+		if want := [][3]int{{second.Id, third.Id, len(system)}}; !slices.Equal(cache.copies, want) {
+			t.Errorf("multi user %v: have copies %v; want %v", multiUserCache, cache.copies, want)
+		}
+	}
+}
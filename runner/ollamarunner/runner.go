@@ -1,6 +1,7 @@
 package ollamarunner
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -10,6 +11,7 @@ import (
 	"image"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -22,10 +24,11 @@ import (
 	"time"
 	"unicode/utf8"
 
-	"golang.org/x/sync/semaphore"
-
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/kvcache"
 	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/nn"
 	"github.com/ollama/ollama/model"
 	"github.com/ollama/ollama/runner/common"
 	"github.com/ollama/ollama/sample"
@@ -53,11 +56,14 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of pendingResponses if requested
+	pendingLogprobs []api.Logprob
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -68,8 +74,26 @@ type Sequence struct {
 	// sampler with transforms to run on generated logits
 	sampler sample.Sampler
 
-	// channel to send back the embedding if embedding only
-	embedding chan []float32
+	// log probabilities recorded by the sampler, with the number of the
+	// most likely tokens to return for each token, if requested
+	logprobs    *sample.Logprobs
+	topLogprobs int
+
+	// beam search, if decoding with it instead of the sampler
+	beams *beamSearch
+
+	// the best completions of the beam search if requested, which are
+	// returned with the final response
+	sequences []api.BeamSequence
+
+	// number of tokens for the draft model to propose, if there is one, and
+	// the tokens it proposed that are in the batch after the next input
+	numDraft int
+	draft    []int32
+
+	// channel to send back the scores of the classification head if
+	// classifying
+	scores chan []float32
 
 	// stop sequences
 	stop []string
@@ -77,24 +101,51 @@ type Sequence struct {
 	// number of inputs to keep at the beginning when shifting context window
 	numKeep int32
 
-	// true if an embedding are to be returned instead of text generation
-	embeddingOnly bool
+	// true if the scores of the classification head are to be returned
+	// instead of text generation
+	classify bool
 
 	doneReason string
 
+	// err is why the sequence ended if doneReason is "error"
+	err error
+
+	// priority is that of the request, which is aged from
+	// startProcessingTime while it waits for a place, and admitted is the
+	// aged priority that it took its place with
+	priority common.Priority
+	admitted common.Priority
+
+	// preempted is signaled when the sequence gives up its place to one of
+	// higher priority, and resume has its inputs to continue from once it
+	// has a place again
+	preempted chan struct{}
+	resume    []input
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
 	numPredicted        int
 	numPromptInputs     int
+	numCachedInputs     int
+	numDrafted          int
+	numAccepted         int
 }
 
 type NewSequenceParams struct {
-	numPredict int
-	stop       []string
-	numKeep    int32
-	sampler    sample.Sampler
-	embedding  bool
+	numPredict  int
+	stop        []string
+	numKeep     int32
+	numDraft    int
+	priority    common.Priority
+	sampler     sample.Sampler
+	logprobs    *sample.Logprobs
+	topLogprobs int
+	classify    bool
+
+	// contextShift keeps prompts that don't fit in the context so that
+	// InputCache.ShiftPrompt can shift them when the sequence is loaded
+	contextShift bool
 }
 
 func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -113,10 +164,15 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		params.numKeep = int32(len(inputs))
 	}
 
+	// Attention sinks can't be discarded, so always keep at least as many inputs
+	if sinks, ok := s.cache.cache.(kvcache.Sinks); ok {
+		params.numKeep = max(params.numKeep, sinks.SinkTokens())
+	}
+
 	// Ensure that at least 1 input can be discarded during shift
 	params.numKeep = min(params.numKeep, s.cache.numCtx-1)
 
-	if int32(len(inputs)) > s.cache.numCtx {
+	if int32(len(inputs)) > s.cache.numCtx && !params.contextShift {
 		discard := int32(len(inputs)) - s.cache.numCtx
 		newInputs := inputs[:params.numKeep]
 		newInputs = append(newInputs, inputs[params.numKeep+discard:]...)
@@ -125,6 +181,12 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		inputs = newInputs
 	}
 
+	// The classification head pools over the whole sequence so it must be
+	// processed in a single batch
+	if params.classify && len(inputs) > s.batchSize {
+		return nil, fmt.Errorf("input length (%d) exceeds batch size (%d)", len(inputs), s.batchSize)
+	}
+
 	// TODO(jessegross): Ingest cached history for grammar
 
 	return &Sequence{
@@ -133,13 +195,18 @@ func (s *Server) NewSequence(prompt string, images []ImageData, params NewSequen
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
-		embedding:           make(chan []float32, 1),
+		scores:              make(chan []float32, 1),
 		sampler:             params.sampler,
-		embeddingOnly:       params.embedding,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
+		classify:            params.classify,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
+		numDraft:            params.numDraft,
+		priority:            params.priority,
+		preempted:           make(chan struct{}, 1),
 	}, nil
 }
 
@@ -215,8 +282,7 @@ type Server struct {
 	// number of simultaneous requests to handle
 	parallel int
 
-	// maximum number of elements in a batch (per sequence)
-	// TODO (jmorganca): make this n_batch
+	// maximum number of inputs in a batch, which the sequences in it share
 	batchSize int
 
 	// protects access to everything below this line
@@ -230,14 +296,55 @@ type Server struct {
 	seqs []*Sequence
 
 	// seqs can have a maximum of parallel entries, which
-	// is enfoced by seqSem
-	seqsSem *semaphore.Weighted
+	// is enfoced by seqSem in order of priority
+	seqsSem *common.PrioritySemaphore
 
 	// KV cache
 	cache *InputCache
 
+	// draft model for speculative decoding, if loaded
+	draft *draftModel
+
 	// next sequence for prompt processing to avoid starvation
 	nextSeq int
+
+	// steps counts the batches that have been processed
+	steps int
+
+	// pieces of the vocabulary of the model for grammars, which are
+	// decoded on the first request with a grammar
+	vocabOnce sync.Once
+	vocab     *sample.Vocabulary
+	vocabErr  error
+}
+
+// vocabulary returns the decoded pieces of the tokens of the model, with
+// control tokens other than the end of sequence left empty so that grammars
+// never allow them
+func (s *Server) vocabulary() (*sample.Vocabulary, error) {
+	s.vocabOnce.Do(func() {
+		tp := s.model.(model.TextProcessor)
+		v := tp.Vocabulary()
+
+		pieces := make([]string, len(v.Values))
+		for i := range v.Values {
+			if v.Types[i] == 3 && int32(i) != v.EOS {
+				continue
+			}
+
+			piece, err := tp.Decode([]int32{int32(i)})
+			if err != nil {
+				s.vocabErr = fmt.Errorf("failed to decode vocabulary: %w", err)
+				return
+			}
+
+			pieces[i] = piece
+		}
+
+		s.vocab = sample.NewVocabulary(pieces, v.EOS)
+	})
+
+	return s.vocab, s.vocabErr
 }
 
 func (s *Server) allNil() bool {
@@ -249,10 +356,20 @@ func (s *Server) allNil() bool {
 	return true
 }
 
+// response is text generated for a sequence, with the log probabilities of
+// its tokens if requested
+type response struct {
+	content  string
+	logprobs []api.Logprob
+}
+
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
 	seq.pendingResponses = []string{}
 
+	logprobs := seq.pendingLogprobs
+	seq.pendingLogprobs = nil
+
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
 	// still make it here:
@@ -263,12 +380,12 @@ func flushPending(seq *Sequence) bool {
 		joined = joined[:len(joined)-1]
 	}
 
-	if len(joined) == 0 {
+	if len(joined) == 0 && len(logprobs) == 0 {
 		return true
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{joined, logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -281,10 +398,58 @@ func (s *Server) removeSequence(seqIndex int, reason string) {
 	flushPending(seq)
 	seq.doneReason = reason
 	close(seq.responses)
-	close(seq.embedding)
+	close(seq.scores)
 	seq.cache.InUse = false
 	s.seqs[seqIndex] = nil
-	s.seqsSem.Release(1)
+
+	// beam search holds a slot of the cache for each beam
+	if seq.beams != nil {
+		for _, slot := range seq.beams.slots {
+			slot.InUse = false
+		}
+
+		s.seqsSem.Release(int64(len(seq.beams.slots)), seq.admitted)
+		return
+	}
+
+	s.seqsSem.Release(1, seq.admitted)
+}
+
+// canceled reports whether the client of seq has gone away
+func (seq *Sequence) canceled() bool {
+	select {
+	case <-seq.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// abandonSequence removes the sequence at seqIndex, whose client has gone
+// away, and frees the cells of the cache that it filled, as its work won't be
+// resumed
+func (s *Server) abandonSequence(seqIndex int) error {
+	seq := s.seqs[seqIndex]
+
+	slots := []*InputCacheSlot{seq.cache}
+	if seq.beams != nil {
+		slots = seq.beams.slots
+	}
+
+	s.removeSequence(seqIndex, "connection")
+
+	if !s.cache.enabled {
+		return nil
+	}
+
+	for _, slot := range slots {
+		if err := s.cache.cache.Remove(slot.Id, 0, math.MaxInt32); err != nil {
+			return err
+		}
+		slot.Inputs = []input{}
+	}
+
+	return nil
 }
 
 func (s *Server) run(ctx context.Context) {
@@ -310,93 +475,45 @@ func (s *Server) processBatch() error {
 	}
 	defer s.mu.Unlock()
 
-	var options model.Options
-	imgSeq := -1
-
-	seqIdx := s.nextSeq - 1
-	for range s.seqs {
-		seqIdx = (seqIdx + 1) % len(s.seqs)
-		seq := s.seqs[seqIdx]
-
-		if seq == nil {
-			continue
-		}
-
-		// if past the num predict limit
-		if seq.numPredict > 0 && seq.numPredicted >= seq.numPredict {
-			s.removeSequence(seqIdx, "limit")
-			continue
-		}
-
-		if !s.cache.enabled {
-			seq.inputs = append(seq.cache.Inputs, seq.inputs...)
-			seq.cache.Inputs = []input{}
-		}
-
-		for i, input := range seq.inputs {
-			if int32(len(seq.cache.Inputs)+len(seq.pendingInputs)+1) > s.cache.numCtx {
-				if len(seq.pendingInputs) == 0 {
-					err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
-					if err != nil {
-						return err
-					}
-				} else {
-					break
-				}
-			}
-
-			if i >= s.batchSize {
-				break
-			}
-
-			// TODO(jessegross): Image inputs need to be rethought - it's
-			// it doesn't work well for different types of models or multiple sequences
-			if input.image != nil {
-				if len(seq.pendingInputs) != len(options.Images) {
-					break
-				}
-
-				if imgSeq != seqIdx && imgSeq != -1 {
-					s.nextSeq = seqIdx
-					break
-				}
-
-				imgSeq = seqIdx
-				options.Images = append(options.Images, input.image)
-				seq.pendingInputs = append(seq.pendingInputs, input)
-				continue
-			}
-
-			options.Inputs = append(options.Inputs, input.token)
-			options.Positions = append(options.Positions, int32(len(seq.cache.Inputs)+len(seq.pendingInputs)))
-			options.Sequences = append(options.Sequences, seq.cache.Id)
-
-			seq.iBatch = len(options.Outputs)
-			if i+1 == len(seq.inputs) {
-				options.Outputs = append(options.Outputs, int32(len(options.Inputs)-1))
-			}
-			seq.pendingInputs = append(seq.pendingInputs, input)
-		}
+	s.preempt()
 
-		seq.inputs = seq.inputs[len(seq.pendingInputs):]
+	b, err := s.nextBatch()
+	if err != nil {
+		return err
 	}
 
-	if len(options.Inputs) == 0 {
+	if len(b.options.Inputs) == 0 {
 		return nil
 	}
 
 	ctx := s.model.Backend().NewContext()
 	defer ctx.Close()
 
-	modelOutput, err := model.Forward(ctx, s.model, options)
+	forward := model.Forward
+	if b.classify {
+		forward = model.Score
+	}
+
+	modelOutput, err := forward(ctx, s.model, b.options)
 	if err != nil {
-		return fmt.Errorf("failed to decode batch: %w", err)
+		// the model may not have a classification head or may fail to
+		// build the graph for the shapes of the batch, which only fails
+		// the requests in the batch rather than the runner
+		slog.Error("failed to decode batch", "classify", b.classify, "error", err)
+		for i, seq := range s.seqs {
+			if seq != nil && b.seqs[i] {
+				seq.err = err
+				s.removeSequence(i, "error")
+			}
+		}
+		return nil
 	}
 
+	s.steps++
 	logits := modelOutput.Floats()
 
 	for i, seq := range s.seqs {
-		if seq == nil {
+		if seq == nil || !b.seqs[i] {
 			continue
 		}
 
@@ -419,81 +536,141 @@ func (s *Server) processBatch() error {
 			seq.startGenerationTime = time.Now()
 		}
 
-		// if done processing the prompt, generate an embedding and return
-		if seq.embeddingOnly {
-			// TODO(jessegross): Embedding support
+		// if done processing the prompt, return the scores of the sequence
+		if seq.classify {
+			labels := modelOutput.Dim(0)
+			seq.scores <- logits[seq.iBatch*labels : (seq.iBatch+1)*labels]
 			s.removeSequence(i, "")
 			continue
 		}
 
-		// sample a token
-		vocabSize := len(logits) / len(options.Outputs)
+		vocabSize := len(logits) / len(b.options.Outputs)
 
-		token, err := seq.sampler.Sample(logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize])
-		if err != nil {
-			return fmt.Errorf("failed to sample token: %w", err)
+		if seq.beams != nil {
+			if err := s.stepBeams(i, logits, vocabSize); err != nil {
+				return fmt.Errorf("failed to step beam search: %w", err)
+			}
+			continue
 		}
 
-		// if it's an end of sequence token, break
-		if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
-			// TODO (jmorganca): we should send this back
-			// as it's important for the /api/generate context
-			// seq.responses <- piece
+		if len(seq.draft) > 0 {
+			if err := s.verifyDraft(i, logits, vocabSize); err != nil {
+				return fmt.Errorf("failed to verify draft: %w", err)
+			}
+		} else {
+			// sample a token
+			token, err := seq.sampler.Sample(logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize])
+			if err != nil {
+				return fmt.Errorf("failed to sample token: %w", err)
+			}
 
-			s.removeSequence(i, "stop")
-			continue
+			if _, err := s.addToken(i, token); err != nil {
+				return err
+			}
 		}
 
-		piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
-		if err != nil {
-			return err
+		// the sequence leaves as soon as it reaches the limit, so another
+		// can take its place in the next batch
+		if s.seqs[i] != nil && seq.numPredict > 0 && seq.numPredicted >= seq.numPredict {
+			s.removeSequence(i, "limit")
 		}
+	}
 
-		seq.inputs = []input{{token: token}}
+	return nil
+}
 
-		seq.pendingResponses = append(seq.pendingResponses, piece)
-		sequence := strings.Join(seq.pendingResponses, "")
+// addToken adds token, which was generated for the sequence at seqIndex, to
+// its response and returns whether the sequence continues, rather than ending
+// such as because of the token or a stop sequence
+func (s *Server) addToken(seqIndex int, token int32) (bool, error) {
+	seq := s.seqs[seqIndex]
 
-		if ok, stop := common.FindStop(sequence, seq.stop); ok {
-			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+	// if it's an end of sequence token, break
+	if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
+		// TODO (jmorganca): we should send this back
+		// as it's important for the /api/generate context
+		// seq.responses <- piece
 
-			var tokenTruncated bool
-			origLen := len(seq.pendingResponses)
-			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
-			newLen := len(seq.pendingResponses)
+		s.removeSequence(seqIndex, "stop")
+		return false, nil
+	}
 
-			// Update the cache based on the tokens that will be returned:
-			// - We have 1 token more than is currently in the cache because
-			// the last one generated wasn't submitted to Decode
-			// - Remove any stop sequences that we stripped out
-			// - If truncateStop removed a portion of a token, drop that
-			// - As defense-in-depth, if truncatedToken didn't find a stop token
-			// remove the extra one that we added to the cache len
-			tokenLen := len(seq.cache.Inputs) + 1
-			tokenLen -= origLen - newLen
-			if tokenTruncated || origLen == newLen {
-				tokenLen--
-			}
-			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+	piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
+	if err != nil {
+		return false, err
+	}
 
-			s.removeSequence(i, "stop")
-			continue
-		}
+	seq.inputs = []input{{token: token}}
 
-		if common.ContainsStopSuffix(sequence, seq.stop) {
-			continue
+	if seq.logprobs != nil {
+		logprob, err := s.logprob(seq, token, piece)
+		if err != nil {
+			return false, err
 		}
 
-		if common.IncompleteUnicode(sequence) {
-			continue
+		seq.pendingLogprobs = append(seq.pendingLogprobs, logprob)
+	}
+
+	seq.pendingResponses = append(seq.pendingResponses, piece)
+	sequence := strings.Join(seq.pendingResponses, "")
+
+	if ok, stop := common.FindStop(sequence, seq.stop); ok {
+		slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+
+		var tokenTruncated bool
+		origLen := len(seq.pendingResponses)
+		seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
+		newLen := len(seq.pendingResponses)
+		seq.pendingLogprobs = seq.pendingLogprobs[:min(len(seq.pendingLogprobs), newLen)]
+
+		// Update the cache based on the tokens that will be returned:
+		// - We have 1 token more than is currently in the cache because
+		// the last one generated wasn't submitted to Decode
+		// - Remove any stop sequences that we stripped out
+		// - If truncateStop removed a portion of a token, drop that
+		// - As defense-in-depth, if truncatedToken didn't find a stop token
+		// remove the extra one that we added to the cache len
+		tokenLen := len(seq.cache.Inputs) + 1
+		tokenLen -= origLen - newLen
+		if tokenTruncated || origLen == newLen {
+			tokenLen--
 		}
+		seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+
+		s.removeSequence(seqIndex, "stop")
+		return false, nil
+	}
+
+	if common.ContainsStopSuffix(sequence, seq.stop) {
+		return true, nil
+	}
 
-		if !flushPending(seq) {
-			s.removeSequence(i, "connection")
+	if common.IncompleteUnicode(sequence) {
+		return true, nil
+	}
+
+	if !flushPending(seq) {
+		s.removeSequence(seqIndex, "connection")
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// logprob returns the log probability of token, which decodes to piece, with
+// those of the most likely tokens requested for seq
+func (s *Server) logprob(seq *Sequence, token int32, piece string) (api.Logprob, error) {
+	logprob := api.Logprob{TokenLogprob: api.TokenLogprob{Token: piece, Logprob: seq.logprobs.Logprob(token)}}
+	for _, top := range seq.logprobs.Top(seq.topLogprobs) {
+		piece, err := s.model.(model.TextProcessor).Decode([]int32{top.Token})
+		if err != nil {
+			return api.Logprob{}, err
 		}
+
+		logprob.TopLogprobs = append(logprob.TopLogprobs, api.TokenLogprob{Token: piece, Logprob: top.Logprob})
 	}
 
-	return nil
+	return logprob, nil
 }
 
 // TODO (jmorganca): use structs from the api package to avoid duplication
@@ -503,6 +680,7 @@ type Options struct {
 	api.Runner
 
 	NumKeep          int      `json:"n_keep"`
+	ContextShift     bool     `json:"context_shift"`
 	Seed             int      `json:"seed"`
 	NumPredict       int      `json:"n_predict"`
 	TopK             int      `json:"top_k"`
@@ -518,6 +696,28 @@ type Options struct {
 	MirostatTau      float32  `json:"mirostat_tau"`
 	MirostatEta      float32  `json:"mirostat_eta"`
 	Stop             []string `json:"stop"`
+	Grammar          string   `json:"grammar"`
+
+	DRYMultiplier       float32  `json:"dry_multiplier"`
+	DRYBase             float32  `json:"dry_base"`
+	DRYAllowedLength    int      `json:"dry_allowed_length"`
+	DRYPenaltyLastN     int      `json:"dry_penalty_last_n"`
+	DRYSequenceBreakers []string `json:"dry_sequence_breakers"`
+
+	// LogitBias is by token id
+	LogitBias map[string]float32 `json:"logit_bias"`
+
+	Logprobs            bool `json:"logprobs"`
+	TopLogprobs         int  `json:"top_logprobs"`
+	LogprobsTemperature bool `json:"logprobs_temperature"`
+
+	NumBeams        int `json:"num_beams"`
+	ReturnSequences int `json:"return_sequences"`
+
+	NumDraft int `json:"num_draft"`
+
+	Pooling   string `json:"pooling"`
+	Normalize *bool  `json:"normalize"`
 }
 
 type ImageData struct {
@@ -532,6 +732,9 @@ type CompletionRequest struct {
 	Grammar     string      `json:"grammar"`
 	CachePrompt bool        `json:"cache_prompt"`
 
+	// Priority orders the requests that wait for a place in the batch
+	Priority common.Priority `json:"priority,omitempty"`
+
 	Options
 }
 
@@ -540,11 +743,18 @@ type Timings struct {
 	PredictedMS float64 `json:"predicted_ms"`
 	PromptN     int     `json:"prompt_n"`
 	PromptMS    float64 `json:"prompt_ms"`
+	CacheN      int     `json:"cache_n,omitempty"`
+
+	DraftN         int `json:"draft_n,omitempty"`
+	DraftAcceptedN int `json:"draft_n_accepted,omitempty"`
 }
 
 type CompletionResponse struct {
-	Content string `json:"content"`
-	Stop    bool   `json:"stop"`
+	Content   string             `json:"content"`
+	Error     string             `json:"error,omitempty"`
+	Logprobs  []api.Logprob      `json:"logprobs,omitempty"`
+	Sequences []api.BeamSequence `json:"sequences,omitempty"`
+	Stop      bool               `json:"stop"`
 
 	Model        string  `json:"model,omitempty"`
 	Prompt       string  `json:"prompt,omitempty"`
@@ -575,12 +785,102 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var grammar sample.Transform
+	if req.Grammar != "" {
+		g, err := sample.ParseGrammar(req.Grammar)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		vocab, err := s.vocabulary()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		grammar = g.Transform(vocab)
+	}
+
+	logitBias := make(sample.LogitBias, len(req.LogitBias))
+	for key, bias := range req.LogitBias {
+		id, err := strconv.ParseInt(key, 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid token id %q in logit_bias", key), http.StatusBadRequest)
+			return
+		}
+
+		logitBias[int32(id)] = float64(bias)
+	}
+
+	var logprobs *sample.Logprobs
+	if req.Logprobs {
+		if req.TopLogprobs < 0 || req.TopLogprobs > 20 {
+			http.Error(w, "top_logprobs must be between 0 and 20", http.StatusBadRequest)
+			return
+		}
+
+		logprobs = &sample.Logprobs{Temperature: req.LogprobsTemperature}
+	}
+
+	// beam search decodes each beam in its own cache slot
+	numBeams := max(req.NumBeams, 1)
+	if req.NumBeams > 0 {
+		if req.NumBeams > s.parallel {
+			http.Error(w, fmt.Sprintf("num_beams (%d) must not exceed the number of parallel requests (%d)", req.NumBeams, s.parallel), http.StatusBadRequest)
+			return
+		}
+
+		if !s.cache.enabled {
+			http.Error(w, "beam search is not supported by this model", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// as in llama.cpp, a window of -1 is the whole context
+	numCtx := int(s.cache.numCtx)
+
+	var penalties *sample.Penalties
+	if lastN := req.RepeatLastN; lastN != 0 && (req.PresencePenalty != 0 || req.FrequencyPenalty != 0) {
+		if lastN < 0 {
+			lastN = numCtx
+		}
+
+		penalties = &sample.Penalties{LastN: lastN, Presence: float64(req.PresencePenalty), Frequency: float64(req.FrequencyPenalty)}
+	}
+
+	var dry *sample.DRY
+	if lastN := req.DRYPenaltyLastN; lastN != 0 && req.DRYMultiplier != 0 && req.DRYBase >= 1 {
+		if lastN < 0 {
+			lastN = numCtx
+		}
+
+		vocab, err := s.vocabulary()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		dry = &sample.DRY{
+			Multiplier:    float64(req.DRYMultiplier),
+			Base:          float64(req.DRYBase),
+			AllowedLength: req.DRYAllowedLength,
+			LastN:         lastN,
+			Breakers:      vocab.SequenceBreakers(req.DRYSequenceBreakers),
+		}
+	}
+
 	sampler, err := sample.NewSampler(
 		req.Temperature,
 		req.TopK,
 		req.TopP,
 		req.MinP,
 		req.Seed,
+		logitBias,
+		penalties,
+		dry,
+		grammar,
+		logprobs,
 	)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create sampler: %v", err), http.StatusInternalServerError)
@@ -588,19 +888,49 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
-		numPredict: req.NumPredict,
-		stop:       req.Stop,
-		numKeep:    int32(req.NumKeep),
-		sampler:    sampler,
-		embedding:  false,
+		numPredict:   req.NumPredict,
+		stop:         req.Stop,
+		numKeep:      int32(req.NumKeep),
+		sampler:      sampler,
+		logprobs:     logprobs,
+		topLogprobs:  req.TopLogprobs,
+		contextShift: req.ContextShift,
+		numDraft:     req.NumDraft,
+		priority:     req.Priority,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	// repetitions of the prompt are penalized too
+	for _, input := range seq.inputs {
+		if input.image == nil {
+			penalties.Accept(input.token)
+			dry.Accept(input.token)
+		}
+	}
+
+	if req.NumBeams > 0 {
+		search, err := sample.NewBeamSearch(req.NumBeams, 1, func(token int32) bool {
+			return s.model.(model.TextProcessor).Is(token, model.SpecialEOS)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		seq.beams = &beamSearch{
+			BeamSearch:      search,
+			iBatch:          make([]int, req.NumBeams),
+			returnSequences: req.ReturnSequences,
+		}
+	}
+
+	// Ensure there is a place to put the sequence, released when removed from
+	// s.seqs, and a cache slot for each beam
+	seq.admitted, err = s.seqsSem.Acquire(r.Context(), int64(numBeams), seq.priority, seq.startProcessingTime)
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -613,6 +943,11 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
+			if req.ContextShift {
+				seq.inputs = s.cache.ShiftPrompt(seq.inputs, seq.numKeep)
+				seq.numPromptInputs = len(seq.inputs)
+			}
+
 			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, req.CachePrompt)
 			if err != nil {
 				s.mu.Unlock()
@@ -620,6 +955,23 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			// only the inputs that aren't already in the cache are processed
+			seq.numCachedInputs = seq.numPromptInputs - len(seq.inputs)
+			seq.numPromptInputs = len(seq.inputs)
+
+			if seq.beams != nil {
+				slots, err := s.cache.freeSlots(numBeams - 1)
+				if err != nil {
+					seq.cache.InUse = false
+					s.mu.Unlock()
+					s.seqsSem.Release(int64(numBeams), seq.admitted)
+					http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
+					return
+				}
+
+				seq.beams.slots = append([]*InputCacheSlot{seq.cache}, slots...)
+			}
+
 			s.seqs[i] = seq
 			s.cond.Signal()
 			found = true
@@ -638,10 +990,19 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case <-seq.preempted:
+			if err := s.resumeSequence(r.Context(), seq); errors.Is(err, context.Canceled) {
+				slog.Info("aborting completion request due to client closing the connection")
+				return
+			} else if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to resume sequence: %v", err), http.StatusInternalServerError)
+				return
+			}
+		case resp, ok := <-seq.responses:
 			if ok {
 				if err := json.NewEncoder(w).Encode(&CompletionResponse{
-					Content: content,
+					Content:  resp.content,
+					Logprobs: resp.logprobs,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
@@ -649,16 +1010,29 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				}
 
 				flusher.Flush()
+			} else if seq.doneReason == "error" {
+				// the response may have started, so the error is sent in
+				// place of the final response
+				if err := json.NewEncoder(w).Encode(&CompletionResponse{Error: seq.err.Error(), Stop: true}); err != nil {
+					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
+				}
+
+				return
 			} else {
 				// Send the final response
 				if err := json.NewEncoder(w).Encode(&CompletionResponse{
+					Sequences:    seq.sequences,
 					Stop:         true,
 					StoppedLimit: seq.doneReason == "limit",
 					Timings: Timings{
 						PromptN:     seq.numPromptInputs,
 						PromptMS:    float64(seq.startGenerationTime.Sub(seq.startProcessingTime).Milliseconds()),
+						CacheN:      seq.numCachedInputs,
 						PredictedN:  seq.numPredicted,
 						PredictedMS: float64(time.Since(seq.startGenerationTime).Milliseconds()),
+
+						DraftN:         seq.numDrafted,
+						DraftAcceptedN: seq.numAccepted,
 					},
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
@@ -671,12 +1045,14 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 }
 
 type EmbeddingRequest struct {
-	Content     string `json:"content"`
-	CachePrompt bool   `json:"cache_prompt"`
+	Contents []string `json:"contents"`
+
+	// Pooling overrides the pooling of the model, such as "mean"
+	Pooling string `json:"pooling,omitempty"`
 }
 
 type EmbeddingResponse struct {
-	Embedding []float32 `json:"embedding"`
+	Embeddings [][]float32 `json:"embeddings"`
 }
 
 func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
@@ -686,20 +1062,79 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var pooling *nn.Pooler
+	if req.Pooling != "" {
+		p, err := nn.ParsePooler(req.Pooling)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		pooling = &p
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
-	slog.Debug("embedding request", "content", req.Content)
+	slog.Debug("embedding request", "inputs", len(req.Contents), "pooling", req.Pooling)
 
-	seq, err := s.NewSequence(req.Content, nil, NewSequenceParams{embedding: true})
+	s.ready.Wait()
+
+	inputs := make([][]input, len(req.Contents))
+	for i, content := range req.Contents {
+		var err error
+		inputs[i], err = s.embeddingInputs(content)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to process input %d: %v", i, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	embeddings, err := s.embed(r.Context(), inputs, pooling)
+	if errors.Is(err, context.Canceled) {
+		slog.Info("aborting embeddings request due to client closing the connection")
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to generate embeddings: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&EmbeddingResponse{
+		Embeddings: embeddings,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+type ScoreRequest struct {
+	Content string `json:"content"`
+}
+
+type ScoreResponse struct {
+	Scores []float32 `json:"scores"`
+}
+
+func (s *Server) score(w http.ResponseWriter, r *http.Request) {
+	var req ScoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	slog.Debug("score request", "content", req.Content)
+
+	seq, err := s.NewSequence(req.Content, nil, NewSequenceParams{classify: true})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	seq.admitted, err = s.seqsSem.Acquire(r.Context(), 1, seq.priority, seq.startProcessingTime)
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting embeddings request due to client closing the connection")
+			slog.Info("aborting score request due to client closing the connection")
 		} else {
 			slog.Error("Failed to acquire semaphore", "error", err)
 		}
@@ -710,7 +1145,7 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, req.CachePrompt)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, false)
 			if err != nil {
 				s.mu.Unlock()
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
@@ -729,15 +1164,239 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	embedding := <-seq.embedding
+	scores, ok := <-seq.scores
+	if !ok {
+		http.Error(w, "failed to score input", http.StatusInternalServerError)
+		return
+	}
 
-	if err := json.NewEncoder(w).Encode(&EmbeddingResponse{
-		Embedding: embedding,
+	if err := json.NewEncoder(w).Encode(&ScoreResponse{
+		Scores: scores,
 	}); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
 }
 
+type SessionRequest struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"`
+	Prompt string `json:"prompt,omitempty"`
+}
+
+type SessionResponse struct {
+	Inputs int `json:"inputs"`
+}
+
+func sessionError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, errInvalidSession) {
+		status = http.StatusBadRequest
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
+// saveSession writes the inputs of an idle cache slot and their entries in the
+// cache to a file, replacing it once it has been written completely
+func (s *Server) saveSession(w http.ResponseWriter, r *http.Request) {
+	var req SessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.ready.Wait()
+
+	var prompt []input
+	if req.Prompt != "" {
+		var err error
+		prompt, err = s.inputs(req.Prompt, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to process inputs: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot, n, err := s.cache.SessionSlot(prompt)
+	if err != nil {
+		sessionError(w, fmt.Errorf("save session: %w", err))
+		return
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(req.Path), filepath.Base(req.Path)+"-*.tmp")
+	if err != nil {
+		sessionError(w, fmt.Errorf("save session: %w", err))
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	start := time.Now()
+	b := bufio.NewWriter(f)
+	if err := s.cache.SaveSession(b, slot, n, req.Digest); err != nil {
+		sessionError(w, fmt.Errorf("save session: %w", err))
+		return
+	}
+
+	if err := b.Flush(); err != nil {
+		sessionError(w, fmt.Errorf("save session: %w", err))
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		sessionError(w, fmt.Errorf("save session: %w", err))
+		return
+	}
+
+	if err := os.Rename(f.Name(), req.Path); err != nil {
+		sessionError(w, fmt.Errorf("save session: %w", err))
+		return
+	}
+
+	slog.Debug("saved session", "id", slot.Id, "inputs", n, "path", req.Path, "duration", time.Since(start))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&SessionResponse{Inputs: int(n)}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// loadSession loads a file written by saveSession into an idle cache slot,
+// so that prompts that start with its inputs don't have to process them again
+func (s *Server) loadSession(w http.ResponseWriter, r *http.Request) {
+	var req SessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.ready.Wait()
+
+	f, err := os.Open(req.Path)
+	if err != nil {
+		sessionError(w, fmt.Errorf("load session: %w", err))
+		return
+	}
+	defer f.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := time.Now()
+	slot, err := s.cache.LoadSession(bufio.NewReader(f), req.Digest)
+	if err != nil {
+		sessionError(w, fmt.Errorf("load session: %w", err))
+		return
+	}
+
+	slog.Debug("loaded session", "id", slot.Id, "inputs", len(slot.Inputs), "path", req.Path, "duration", time.Since(start))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&SessionResponse{Inputs: len(slot.Inputs)}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+type TokenizeRequest struct {
+	Content    string `json:"content"`
+	AddSpecial bool   `json:"add_special"`
+	Pieces     bool   `json:"pieces"`
+}
+
+type TokenizeResponse struct {
+	Tokens []int    `json:"tokens"`
+	Pieces []string `json:"pieces,omitempty"`
+}
+
+// tokenize converts text to tokens with the tokenizer of the model. This
+// doesn't need a sequence, so it doesn't wait for those being processed.
+func (s *Server) tokenize(w http.ResponseWriter, r *http.Request) {
+	var req TokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.ready.Wait()
+
+	tp := s.model.(model.TextProcessor)
+	tokens, err := tp.Encode(req.Content)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to tokenize: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// templates add the special tokens of prompts, so the only one that
+	// the tokenizer knows of is BOS
+	if req.AddSpecial {
+		tokens = append([]int32{tp.Vocabulary().BOS}, tokens...)
+	}
+
+	var resp TokenizeResponse
+	for _, token := range tokens {
+		resp.Tokens = append(resp.Tokens, int(token))
+
+		if req.Pieces {
+			piece, err := tp.Decode([]int32{token})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to decode token %d: %v", token, err), http.StatusInternalServerError)
+				return
+			}
+
+			resp.Pieces = append(resp.Pieces, piece)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+type DetokenizeRequest struct {
+	Tokens []int `json:"tokens"`
+}
+
+type DetokenizeResponse struct {
+	Content string `json:"content"`
+}
+
+// detokenize converts tokens to text, which is the reverse of tokenize
+func (s *Server) detokenize(w http.ResponseWriter, r *http.Request) {
+	var req DetokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.ready.Wait()
+
+	tp := s.model.(model.TextProcessor)
+	tokens := make([]int32, len(req.Tokens))
+	for i, token := range req.Tokens {
+		if token < 0 || token >= len(tp.Vocabulary().Values) {
+			http.Error(w, fmt.Sprintf("invalid token %d", token), http.StatusBadRequest)
+			return
+		}
+
+		tokens[i] = int32(token)
+	}
+
+	content, err := tp.Decode(tokens)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&DetokenizeResponse{Content: content}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
 type HealthResponse struct {
 	Status   string  `json:"status"`
 	Progress float32 `json:"progress"`
@@ -785,6 +1444,7 @@ func (m *multiLPath) String() string {
 
 func (s *Server) loadModel(
 	mpath string,
+	draftPath string,
 	params ml.BackendParams,
 	lpath multiLPath,
 	parallel int,
@@ -800,16 +1460,44 @@ func (s *Server) loadModel(
 
 	slog.Info("system", "info", s.model.Backend().SystemInfo(), "threads", params.NumThreads)
 
+	// attention that isn't fused is slower, so report why once for each reason
+	var fallbacks sync.Map
+	nn.SetAttentionFallbackHook(func(reason string) {
+		if _, loaded := fallbacks.LoadOrStore(reason, struct{}{}); !loaded {
+			slog.Debug("attention is not fused", "reason", reason)
+		}
+	})
+
 	// TODO(jessegross): LoRA loading
 	if lpath.String() != "" {
 		panic("loras are not yet implemented")
 	}
 
-	s.cache, err = NewInputCache(s.model, kvCacheType, int32(kvSize), parallel, multiUserCache)
+	s.cache, err = NewInputCache(s.model, kvCacheType, int32(kvSize), parallel, s.batchSize, multiUserCache)
 	if err != nil {
 		panic(err)
 	}
 
+	if draftPath != "" {
+		if !s.cache.enabled {
+			panic("speculative decoding requires a model that supports caching")
+		}
+
+		// the tensor placement is by the names of the tensors of the model
+		dparams := params
+		dparams.TensorPlacement = nil
+
+		s.draft, err = newDraftModel(draftPath, dparams, s.model, kvCacheType, int32(kvSize), parallel, s.batchSize)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	estimate := nn.BackendMemory(s.model.Backend(), parallel, s.batchSize, kvSize, kvCacheTypeFromStr(kvCacheType))
+	free, total := s.model.Backend().DeviceMemory()
+	slog.Info("estimated memory", "kv", format.HumanBytes2(estimate.KV), "graph", format.HumanBytes2(estimate.Graph),
+		"device.free", format.HumanBytes2(free), "device.total", format.HumanBytes2(total))
+
 	if !s.cache.enabled && parallel > 1 {
 		parallel = 1
 		slog.Warn("model does not support caching, disabling parallel processing")
@@ -817,7 +1505,7 @@ func (s *Server) loadModel(
 
 	s.parallel = parallel
 	s.seqs = make([]*Sequence, s.parallel)
-	s.seqsSem = semaphore.NewWeighted(int64(s.parallel))
+	s.seqsSem = common.NewPrioritySemaphore(int64(s.parallel), false)
 
 	s.status = ServerStatusReady
 	s.ready.Done()
@@ -826,11 +1514,12 @@ func (s *Server) loadModel(
 func Execute(args []string) error {
 	fs := flag.NewFlagSet("runner", flag.ExitOnError)
 	mpath := fs.String("model", "", "Path to model binary file")
+	draftPath := fs.String("draft-model", "", "Path to draft model binary file for speculative decoding")
 	parallel := fs.Int("parallel", 1, "Number of sequences to handle simultaneously")
 	batchSize := fs.Int("batch-size", 512, "Batch size")
 	numGPULayers := fs.Int("n-gpu-layers", 0, "Number of layers to offload to GPU")
 	mainGPU := fs.Int("main-gpu", 0, "Main GPU")
-	_ = fs.Bool("flash-attn", false, "Enable flash attention")
+	flashAttention := fs.Bool("flash-attn", false, "Enable flash attention")
 	kvSize := fs.Int("ctx-size", 2048, "Context (or KV cache) size")
 	kvCacheType := fs.String("kv-cache-type", "", "quantization type for KV cache (default: f16)")
 	port := fs.Int("port", 8080, "Port to expose the server on")
@@ -840,6 +1529,7 @@ func Execute(args []string) error {
 	_ = fs.Bool("mlock", false, "force system to keep model in RAM rather than swapping or compressing")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	tensorPlacement := fs.String("tensor-placement", "", "devices of weights by name, comma-separated list of pattern=cpu or pattern=gpu")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -875,7 +1565,6 @@ func Execute(args []string) error {
 	}
 
 	// TODO(jessegross): Parameters that need to be implemented:
-	//	flash-attn
 	//	no-mmap
 	//	mlock
 
@@ -890,15 +1579,23 @@ func Execute(args []string) error {
 		}
 	}
 
+	placement, err := ml.ParseTensorPlacement(*tensorPlacement)
+	if err != nil {
+		return err
+	}
+
 	params := ml.BackendParams{
-		NumThreads:   *threads,
-		NumGPULayers: *numGPULayers,
-		MainGPU:      *mainGPU,
-		TensorSplit:  tensorSplitFloats,
+		NumThreads:      *threads,
+		NumGPULayers:    *numGPULayers,
+		MainGPU:         *mainGPU,
+		TensorSplit:     tensorSplitFloats,
+		FlashAttention:  *flashAttention,
+		KVCacheType:     kvCacheTypeFromStr(*kvCacheType),
+		TensorPlacement: placement,
 	}
 
 	server.ready.Add(1)
-	go server.loadModel(*mpath, params, lpaths, *parallel, *kvCacheType, *kvSize, *multiUserCache)
+	go server.loadModel(*mpath, *draftPath, params, lpaths, *parallel, *kvCacheType, *kvSize, *multiUserCache)
 
 	server.cond = sync.NewCond(&server.mu)
 
@@ -917,6 +1614,11 @@ func Execute(args []string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/embedding", server.embeddings)
 	mux.HandleFunc("/completion", server.completion)
+	mux.HandleFunc("/score", server.score)
+	mux.HandleFunc("/session/save", server.saveSession)
+	mux.HandleFunc("/session/load", server.loadSession)
+	mux.HandleFunc("/tokenize", server.tokenize)
+	mux.HandleFunc("/detokenize", server.detokenize)
 	mux.HandleFunc("/health", server.health)
 
 	httpServer := http.Server{
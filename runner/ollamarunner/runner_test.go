@@ -0,0 +1,112 @@
+package ollamarunner
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/model"
+)
+
+// bpeModel tokenizes with a byte-level BPE vocabulary of a token for each
+// byte and a BOS of <s>, without any merges
+type bpeModel struct {
+	model.Model
+	model.BytePairEncoding
+}
+
+func newBPEModel() bpeModel {
+	var values []string
+	var types []uint32
+	for b := range 256 {
+		r := rune(b)
+		switch {
+		case r == 0x00ad:
+			r = 0x0143
+		case r <= 0x0020:
+			r = r + 0x0100
+		case r >= 0x007f && r <= 0x00a0:
+			r = r + 0x00a2
+		}
+
+		values = append(values, string(r))
+		types = append(types, 1)
+	}
+
+	return bpeModel{BytePairEncoding: model.NewBytePairEncoding(
+		`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`,
+		&model.Vocabulary{Values: append(values, "<s>"), Types: append(types, 3), BOS: 256},
+	)}
+}
+
+func TestTokenize(t *testing.T) {
+	s := &Server{model: newBPEModel()}
+
+	do := func(handler http.HandlerFunc, req, resp any) int {
+		t.Helper()
+
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return w.Code
+	}
+
+	// bytes that aren't in the vocabulary as characters round trip
+	for _, content := range []string{"~/.ollama", "tab\tand\x7fdel", "请考试我的软件！", "🦙 <s>llama"} {
+		var tokens TokenizeResponse
+		if code := do(s.tokenize, TokenizeRequest{Content: content, AddSpecial: true}, &tokens); code != http.StatusOK {
+			t.Fatalf("%q: have status %d", content, code)
+		}
+
+		if tokens.Tokens[0] != 256 || tokens.Pieces != nil {
+			t.Errorf("%q: have %v, pieces %v; want BOS first and no pieces", content, tokens.Tokens, tokens.Pieces)
+		}
+
+		// special tokens in the content are tokenized as such
+		if want := strings.Contains(content, "<s>"); slices.Contains(tokens.Tokens[1:], 256) != want {
+			t.Errorf("%q: have %v; want BOS in the content %v", content, tokens.Tokens, want)
+		}
+
+		var text DetokenizeResponse
+		if code := do(s.detokenize, DetokenizeRequest{Tokens: tokens.Tokens[1:]}, &text); code != http.StatusOK {
+			t.Fatalf("%q: have status %d", content, code)
+		}
+
+		if text.Content != content {
+			t.Errorf("have %q; want %q", text.Content, content)
+		}
+	}
+
+	var pieces TokenizeResponse
+	if code := do(s.tokenize, TokenizeRequest{Content: "a b", Pieces: true}, &pieces); code != http.StatusOK {
+		t.Fatalf("have status %d", code)
+	}
+
+	if want := []int{'a', ' ', 'b'}; !slices.Equal(pieces.Tokens, want) {
+		t.Errorf("have tokens %v; want %v", pieces.Tokens, want)
+	}
+
+	if want := []string{"a", " ", "b"}; !slices.Equal(pieces.Pieces, want) {
+		t.Errorf("have pieces %q; want %q", pieces.Pieces, want)
+	}
+
+	for _, tokens := range [][]int{{-1}, {1, 257}} {
+		if code := do(s.detokenize, DetokenizeRequest{Tokens: tokens}, nil); code != http.StatusBadRequest {
+			t.Errorf("%v: have status %d; want %d", tokens, code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package ollamarunner
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/ollama/ollama/kvcache"
+)
+
+// errInvalidSession is returned when loading a session that was saved for a
+// different model or type of cache, or that isn't a session at all
+var errInvalidSession = errors.New("invalid session")
+
+// sessionMagic starts every session file, followed by sessionVersion, which
+// changes whenever the format does
+var sessionMagic = [4]byte{'O', 'S', 'E', 'S'}
+
+const sessionVersion = 1
+
+// sessionHeader is followed by the digest of the model, the tokens of the
+// inputs and then the snapshot of the cache
+type sessionHeader struct {
+	Magic   [4]byte
+	Version uint32
+
+	// DType of the cache, which snapshots of the cache must match
+	DType uint32
+
+	DigestLen uint32
+	Inputs    uint32
+}
+
+// SessionSlot returns an idle slot to save and how many of its inputs to save.
+// These are the inputs in common with prompt or, if prompt is empty, all of
+// the inputs of the slot that was used last.
+func (c *InputCache) SessionSlot(prompt []input) (*InputCacheSlot, int32, error) {
+	var slot *InputCacheSlot
+	var n int32
+	for i, s := range c.slots {
+		if s.InUse {
+			continue
+		}
+
+		if len(prompt) > 0 {
+			if count := countCommonPrefix(s.Inputs, prompt); count > n {
+				slot, n = &c.slots[i], count
+			}
+		} else if len(s.Inputs) > 0 && (slot == nil || s.lastUsed.After(slot.lastUsed)) {
+			slot, n = &c.slots[i], int32(len(s.Inputs))
+		}
+	}
+
+	if slot == nil {
+		return nil, 0, errors.New("no cached inputs to save")
+	}
+
+	return slot, n, nil
+}
+
+// SaveSession writes the first n inputs of slot and their entries in the cache
+// to w, for the model with the given digest
+func (c *InputCache) SaveSession(w io.Writer, slot *InputCacheSlot, n int32, digest string) error {
+	snapshot, ok := c.cache.(kvcache.Snapshot)
+	if !c.enabled || !ok {
+		return kvcache.ErrNotSupported
+	}
+
+	tokens := make([]int32, n)
+	for i, input := range slot.Inputs[:n] {
+		if input.image != nil {
+			return errors.New("sessions with images are not supported")
+		}
+
+		tokens[i] = input.token
+	}
+
+	header := sessionHeader{
+		Magic:     sessionMagic,
+		Version:   sessionVersion,
+		DType:     uint32(c.dtype),
+		DigestLen: uint32(len(digest)),
+		Inputs:    uint32(n),
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, digest); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, tokens); err != nil {
+		return err
+	}
+
+	return snapshot.SaveSequence(w, slot.Id, n)
+}
+
+// LoadSession loads a session written by SaveSession for the model with the
+// given digest into the idle slot that was used the longest time ago, so that
+// prompts that start with the inputs of the session continue from them
+func (c *InputCache) LoadSession(r io.Reader, digest string) (*InputCacheSlot, error) {
+	snapshot, ok := c.cache.(kvcache.Snapshot)
+	if !c.enabled || !ok {
+		return nil, kvcache.ErrNotSupported
+	}
+
+	var header sessionHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidSession, err)
+	}
+
+	if header.Magic != sessionMagic || header.Version != sessionVersion {
+		return nil, fmt.Errorf("%w: unsupported format (version: %v)", errInvalidSession, header.Version)
+	}
+
+	if header.DType != uint32(c.dtype) {
+		return nil, fmt.Errorf("%w: saved with a different kv cache type", errInvalidSession)
+	}
+
+	if header.DigestLen != uint32(len(digest)) {
+		return nil, fmt.Errorf("%w: saved with a different model", errInvalidSession)
+	}
+
+	saved := make([]byte, header.DigestLen)
+	if _, err := io.ReadFull(r, saved); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidSession, err)
+	} else if string(saved) != digest {
+		return nil, fmt.Errorf("%w: saved with a different model", errInvalidSession)
+	}
+
+	if header.Inputs == 0 || header.Inputs > uint32(c.numCtx) {
+		return nil, fmt.Errorf("%w: %v inputs don't fit the context of %v", errInvalidSession, header.Inputs, c.numCtx)
+	}
+
+	tokens := make([]int32, header.Inputs)
+	if err := binary.Read(r, binary.LittleEndian, tokens); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidSession, err)
+	}
+
+	var slot *InputCacheSlot
+	for i, s := range c.slots {
+		if !s.InUse && (slot == nil || s.lastUsed.Before(slot.lastUsed)) {
+			slot = &c.slots[i]
+		}
+	}
+
+	if slot == nil {
+		return nil, errors.New("no available cache slots")
+	}
+
+	slot.Inputs = slot.Inputs[:0]
+	if err := snapshot.LoadSequence(r, slot.Id); err != nil {
+		_ = c.cache.Remove(slot.Id, 0, math.MaxInt32)
+		if errors.Is(err, kvcache.ErrSnapshotMismatch) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			err = fmt.Errorf("%w: %w", errInvalidSession, err)
+		}
+		return nil, err
+	}
+
+	for _, t := range tokens {
+		slot.Inputs = append(slot.Inputs, input{token: t})
+	}
+	slot.lastUsed = time.Now()
+
+	return slot, nil
+}
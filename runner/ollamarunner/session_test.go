@@ -0,0 +1,131 @@
+package ollamarunner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/kvcache"
+	"github.com/ollama/ollama/ml"
+)
+
+// snapshotCache saves the sequence and number of tokens in place of the
+// contents of the cache
+type snapshotCache struct {
+	kvcache.Cache
+
+	// loaded is the sequence that the last snapshot was loaded into and
+	// snapshot what was saved
+	loaded   int
+	snapshot [2]int32
+}
+
+func (c *snapshotCache) SaveSequence(w io.Writer, seq int, end int32) error {
+	return binary.Write(w, binary.LittleEndian, [2]int32{int32(seq), end})
+}
+
+func (c *snapshotCache) LoadSequence(r io.Reader, seq int) error {
+	c.loaded = seq
+	return binary.Read(r, binary.LittleEndian, &c.snapshot)
+}
+
+func (c *snapshotCache) Remove(seq int, beginIndex, endIndex int32) error {
+	return nil
+}
+
+func TestSession(t *testing.T) {
+	now := time.Now()
+	newCache := func(dtype ml.DType) *InputCache {
+		return &InputCache{
+			numCtx:  16,
+			enabled: true,
+			cache:   &snapshotCache{loaded: -1},
+			dtype:   dtype,
+			slots: []InputCacheSlot{
+				{Id: 0, Inputs: []input{{token: 1}, {token: 2}, {token: 3}}, lastUsed: now.Add(-time.Second)},
+				{Id: 1, Inputs: []input{{token: 1}, {token: 4}}, lastUsed: now},
+				{Id: 2, Inputs: []input{{token: 5}}, lastUsed: now.Add(time.Second), InUse: true},
+			},
+		}
+	}
+
+	c := newCache(ml.DTypeF16)
+
+	tests := []struct {
+		name   string
+		prompt []input
+		id     int
+		n      int32
+	}{
+		{"LastUsed", nil, 1, 2},
+		{"Prefix", []input{{token: 1}, {token: 2}, {token: 9}}, 0, 2},
+		{"InUse", []input{{token: 5}}, -1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot, n, err := c.SessionSlot(tt.prompt)
+			if tt.id < 0 {
+				if err == nil {
+					t.Errorf("SessionSlot: have slot %v; want error", slot.Id)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if slot.Id != tt.id || n != tt.n {
+				t.Errorf("SessionSlot: have slot %v with %v inputs; want slot %v with %v inputs", slot.Id, n, tt.id, tt.n)
+			}
+		})
+	}
+
+	var b bytes.Buffer
+	if err := c.SaveSession(&b, &c.slots[0], 2, "sha256-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Load", func(t *testing.T) {
+		c := newCache(ml.DTypeF16)
+
+		// the idle slot that was used the longest time ago is replaced
+		slot, err := c.LoadSession(bytes.NewReader(b.Bytes()), "sha256-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := []input{{token: 1}, {token: 2}}; slot.Id != 0 || !slices.Equal(slot.Inputs, want) {
+			t.Errorf("LoadSession: have slot %v with inputs %v; want slot 0 with inputs %v", slot.Id, slot.Inputs, want)
+		}
+
+		if cache := c.cache.(*snapshotCache); cache.loaded != 0 || cache.snapshot != [2]int32{0, 2} {
+			t.Errorf("LoadSequence: have snapshot %v loaded into %v; want [0 2] loaded into 0", cache.snapshot, cache.loaded)
+		}
+	})
+
+	for _, tt := range []struct {
+		name   string
+		dtype  ml.DType
+		digest string
+	}{
+		{"Model", ml.DTypeF16, "sha256-b"},
+		{"DType", ml.DTypeQ80, "sha256-a"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCache(tt.dtype)
+			if _, err := c.LoadSession(bytes.NewReader(b.Bytes()), tt.digest); !errors.Is(err, errInvalidSession) {
+				t.Errorf("LoadSession: have %v; want %v", err, errInvalidSession)
+			}
+
+			if len(c.slots[0].Inputs) != 3 {
+				t.Errorf("LoadSession: slot changed by invalid session")
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package sample
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"slices"
+)
+
+// Beam is a hypothesis of beam search, with the sum of the log probabilities
+// of its tokens
+type Beam struct {
+	Tokens  []int32
+	Logprob float64
+
+	// Done is set once the beam has ended with an end of sequence token,
+	// which isn't part of Tokens but counts towards its length
+	Done bool
+}
+
+// Score is the log probability of b divided by its length raised to
+// lengthPenalty, so that hypotheses of different lengths can be compared. A
+// lengthPenalty of 0 compares the sum of the log probabilities, which favors
+// short hypotheses, and one of 1 their mean.
+func (b Beam) Score(lengthPenalty float64) float64 {
+	n := len(b.Tokens)
+	if b.Done {
+		n++
+	}
+
+	return b.Logprob / math.Pow(float64(max(n, 1)), lengthPenalty)
+}
+
+// BeamSearch decodes by extending the Width most likely hypotheses by each of
+// their possible next tokens and keeping the Width most likely of the results,
+// which finds more likely sequences than greedy decoding at the cost of
+// computing the logits of each hypothesis. A width of 1 is greedy decoding.
+type BeamSearch struct {
+	Width         int
+	LengthPenalty float64
+
+	// EOS reports whether token ends a sequence
+	EOS func(token int32) bool
+
+	// Beams are the hypotheses that are still being extended, from the most
+	// likely. They all have the same number of tokens.
+	Beams []Beam
+
+	// Finished are the hypotheses that have ended, from the best score
+	Finished []Beam
+}
+
+// NewBeamSearch starts a beam search with a single empty hypothesis
+func NewBeamSearch(width int, lengthPenalty float64, eos func(int32) bool) (*BeamSearch, error) {
+	if width < 1 {
+		return nil, errors.New("beam search must have at least one beam")
+	}
+
+	return &BeamSearch{
+		Width:         width,
+		LengthPenalty: lengthPenalty,
+		EOS:           eos,
+		Beams:         []Beam{{}},
+	}, nil
+}
+
+// Step extends each of the beams with the logits of its next token, in the
+// order of Beams, and returns the index of the beam that each of the new
+// beams extends so that callers can fork the state of the beams, such as
+// their caches.
+//
+// Only hypotheses that end among the Width most likely are finished, so that
+// with a width of 1 the tokens are those of greedy decoding.
+func (s *BeamSearch) Step(logits [][]float32) ([]int, error) {
+	if len(logits) != len(s.Beams) {
+		return nil, errors.New("beam search must have logits for each beam")
+	}
+
+	type candidate struct {
+		beam  int
+		token int32
+		score float64
+	}
+
+	var candidates []candidate
+	for i, beam := range s.Beams {
+		logits64 := make([]float64, len(logits[i]))
+		for j, v := range logits[i] {
+			logits64[j] = float64(v)
+		}
+
+		var l Logprobs
+		l.Apply(logits64)
+
+		// enough to fill the beams even if that many of them end
+		for _, top := range l.Top(2 * s.Width) {
+			candidates = append(candidates, candidate{i, top.Token, beam.Logprob + top.Logprob})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, errors.New("no valid logits found for beam search")
+	}
+
+	// ties keep the order of the beams and then of the tokens
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	var beams []Beam
+	var parents []int
+	for rank, c := range candidates {
+		if len(beams) == s.Width {
+			break
+		}
+
+		if s.EOS != nil && s.EOS(c.token) {
+			if rank < s.Width {
+				s.Finished = append(s.Finished, Beam{Tokens: s.Beams[c.beam].Tokens, Logprob: c.score, Done: true})
+			}
+
+			continue
+		}
+
+		beams = append(beams, Beam{Tokens: append(slices.Clip(s.Beams[c.beam].Tokens), c.token), Logprob: c.score})
+		parents = append(parents, c.beam)
+	}
+
+	s.Beams = beams
+	s.Finished = s.best(s.Finished)
+	return parents, nil
+}
+
+// Done reports whether the search can stop, either because no beams are left
+// or all of the finished hypotheses score better than the beams
+func (s *BeamSearch) Done() bool {
+	if len(s.Beams) == 0 {
+		return true
+	}
+
+	return len(s.Finished) >= s.Width && s.Beams[0].Score(s.LengthPenalty) <= s.Finished[len(s.Finished)-1].Score(s.LengthPenalty)
+}
+
+// Results returns the Width best hypotheses from the best score, which
+// include beams that haven't finished if the search is stopped early, such
+// as because of a length limit
+func (s *BeamSearch) Results() []Beam {
+	return s.best(slices.Concat(s.Finished, s.Beams))
+}
+
+// best sorts beams by score and keeps the Width best
+func (s *BeamSearch) best(beams []Beam) []Beam {
+	slices.SortStableFunc(beams, func(a, b Beam) int {
+		return cmp.Compare(b.Score(s.LengthPenalty), a.Score(s.LengthPenalty))
+	})
+
+	return beams[:min(len(beams), s.Width)]
+}
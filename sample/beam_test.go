@@ -0,0 +1,168 @@
+package sample
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// beamModel returns the logits of the next token after tokens from their
+// probabilities
+type beamModel func(tokens []int32) []float64
+
+func (m beamModel) logits(tokens []int32) []float32 {
+	logits := make([]float32, 0, 5)
+	for _, p := range m(tokens) {
+		logits = append(logits, float32(math.Log(p)))
+	}
+
+	return logits
+}
+
+// search runs beam search with the model for at most n steps
+func (m beamModel) search(t *testing.T, width, n int, eos int32) *BeamSearch {
+	t.Helper()
+
+	s, err := NewBeamSearch(width, 0, func(token int32) bool { return token == eos })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range n {
+		var logits [][]float32
+		for _, beam := range s.Beams {
+			logits = append(logits, m.logits(beam.Tokens))
+		}
+
+		parents, err := s.Step(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(parents) != len(s.Beams) {
+			t.Fatalf("have %d parents for %d beams", len(parents), len(s.Beams))
+		}
+
+		if s.Done() {
+			break
+		}
+	}
+
+	return s
+}
+
+func TestBeamSearchGreedy(t *testing.T) {
+	const eos = 4
+
+	// the probabilities depend on all of the tokens and end sequences
+	// once they are long enough
+	m := beamModel(func(tokens []int32) []float64 {
+		p := make([]float64, 5)
+		for i := range p {
+			p[i] = 2 + math.Sin(float64(len(tokens)*7+i*3))
+			for _, token := range tokens {
+				p[i] += 0.1 * math.Cos(float64(token*int32(i+1)))
+			}
+		}
+
+		p[eos] = float64(len(tokens)) / 2
+		return p
+	})
+
+	sampler := Greedy()
+
+	var want []int32
+	for range 16 {
+		token, err := sampler.Sample(m.logits(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token == eos {
+			break
+		}
+
+		want = append(want, token)
+	}
+
+	results := m.search(t, 1, 16, eos).Results()
+	if len(results) != 1 {
+		t.Fatalf("have %d results; want 1", len(results))
+	}
+
+	if !slices.Equal(results[0].Tokens, want) {
+		t.Errorf("have tokens %v; want %v", results[0].Tokens, want)
+	}
+
+	if !results[0].Done {
+		t.Error("expected the hypothesis to end")
+	}
+}
+
+func TestBeamSearch(t *testing.T) {
+	const a, b, c, eos = 0, 1, 2, 4
+
+	// a is the most likely first token, but the tokens after it are less
+	// likely than c after b
+	m := beamModel(func(tokens []int32) []float64 {
+		switch {
+		case len(tokens) == 0:
+			return []float64{0.5, 0.4, 0.05, 0.05, 0}
+		case len(tokens) == 2:
+			return []float64{0, 0, 0, 0, 1}
+		case tokens[0] == a:
+			return []float64{0.25, 0.25, 0.25, 0.25, 0}
+		default:
+			return []float64{0.02, 0.02, 0.9, 0.06, 0}
+		}
+	})
+
+	greedy := m.search(t, 1, 8, eos).Results()[0]
+	if want := []int32{a, a}; !slices.Equal(greedy.Tokens, want) {
+		t.Fatalf("have greedy tokens %v; want %v", greedy.Tokens, want)
+	}
+
+	s := m.search(t, 4, 8, eos)
+	if !s.Done() {
+		t.Fatal("expected the search to be done")
+	}
+
+	results := s.Results()
+	if len(results) != 4 {
+		t.Fatalf("have %d results; want 4", len(results))
+	}
+
+	if want := []int32{b, c}; !slices.Equal(results[0].Tokens, want) {
+		t.Errorf("have tokens %v; want %v", results[0].Tokens, want)
+	}
+
+	if want := math.Log(0.4 * 0.9); math.Abs(results[0].Logprob-want) > 1e-6 {
+		t.Errorf("have logprob %v; want %v", results[0].Logprob, want)
+	}
+
+	if results[0].Logprob <= greedy.Logprob {
+		t.Errorf("have logprob %v; want more than greedy %v", results[0].Logprob, greedy.Logprob)
+	}
+
+	for i := 1; i < len(results); i++ {
+		if results[i].Score(0) > results[i-1].Score(0) {
+			t.Errorf("result %d scores better than result %d", i, i-1)
+		}
+	}
+}
+
+func TestBeamScore(t *testing.T) {
+	beam := Beam{Tokens: []int32{1, 2, 3}, Logprob: -6, Done: true}
+	if got := beam.Score(0); got != -6 {
+		t.Errorf("have score %v; want -6", got)
+	}
+
+	// the end of sequence token counts towards the length
+	if got := beam.Score(1); got != -1.5 {
+		t.Errorf("have score %v; want -1.5", got)
+	}
+
+	if _, err := NewBeamSearch(0, 1, nil); err == nil {
+		t.Error("expected an error for no beams")
+	}
+}
@@ -0,0 +1,918 @@
+package sample
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Grammar is a GBNF grammar, in the format of llama.cpp, that constrains
+// sampling to the tokens that continue a string the grammar matches. Rules
+// define alternatives of sequences of literals ("abc"), character classes
+// ([a-z], [^"] or . for any character), references to other rules and groups,
+// each of which can be repeated with *, +, ? or {m,n}:
+//
+//	root  ::= date
+//	date  ::= digit{4} "-" digit{2} "-" digit{2}
+//	digit ::= [0-9]
+//
+// Matching starts at the rule named root.
+type Grammar struct {
+	rules [][]sequence
+	root  int
+}
+
+// sequence is an alternative of a rule
+type sequence []symbol
+
+// symbol is a reference to a rule or a character class
+type symbol struct {
+	// rule is the index of the referenced rule, or -1 for a character class
+	rule int
+
+	// ranges are the inclusive ranges of the characters that the class
+	// matches, or doesn't match if negated
+	ranges  [][2]rune
+	negated bool
+}
+
+func (s symbol) match(r rune) bool {
+	for _, rg := range s.ranges {
+		if rg[0] <= r && r <= rg[1] {
+			return !s.negated
+		}
+	}
+
+	return s.negated
+}
+
+// matchPartial reports whether any character that starts with the partial
+// UTF-8 encoding p could match s
+func (s symbol) matchPartial(p partialRune) bool {
+	// invalid, or a 7-bit character encoded in 2 bytes
+	if p.remain < 0 || (p.remain == 1 && p.value < 2) {
+		return false
+	}
+
+	low := p.value << (6 * p.remain)
+	high := low | (1<<(6*p.remain) - 1)
+	if low == 0 {
+		// the shortest encodings of 3 and 4 bytes
+		switch p.remain {
+		case 2:
+			low = 1 << 11
+		case 3:
+			low = 1 << 16
+		}
+	}
+
+	// as in llama.cpp, negated classes reject partial characters that could
+	// complete to any character in their ranges
+	for _, rg := range s.ranges {
+		if rg[0] <= high && low <= rg[1] {
+			return !s.negated
+		}
+	}
+
+	return s.negated
+}
+
+// ParseGrammar parses a GBNF grammar, returning an error describing the first
+// problem found if it is invalid
+func ParseGrammar(src string) (*Grammar, error) {
+	p := grammarParser{src: src, ids: make(map[string]int)}
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("invalid grammar: %w", err)
+	}
+
+	root, ok := p.ids["root"]
+	if !ok {
+		return nil, errors.New("invalid grammar: missing rule root")
+	}
+
+	g := &Grammar{rules: p.rules, root: root}
+	if name, ok := g.leftRecursion(p.names()); ok {
+		return nil, fmt.Errorf("invalid grammar: rule %s is left recursive", name)
+	}
+
+	return g, nil
+}
+
+type grammarParser struct {
+	src string
+	pos int
+
+	// ids are the indices of the rules by name, including those generated
+	// for groups and repetitions. rules that are referenced but not yet
+	// defined are nil.
+	ids   map[string]int
+	rules [][]sequence
+}
+
+func (p *grammarParser) errorf(format string, args ...any) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	column := p.pos - strings.LastIndex(p.src[:p.pos], "\n")
+	return fmt.Errorf("%s at line %d column %d", fmt.Sprintf(format, args...), line, column)
+}
+
+func (p *grammarParser) names() []string {
+	names := make([]string, len(p.rules))
+	for name, id := range p.ids {
+		names[id] = name
+	}
+
+	return names
+}
+
+// id returns the index of the rule with the given name
+func (p *grammarParser) id(name string) int {
+	id, ok := p.ids[name]
+	if !ok {
+		id = len(p.rules)
+		p.ids[name] = id
+		p.rules = append(p.rules, nil)
+	}
+
+	return id
+}
+
+// generate returns the index of a new rule for part of the rule named base
+func (p *grammarParser) generate(base string) int {
+	return p.id(base + "_" + strconv.Itoa(len(p.rules)))
+}
+
+func (p *grammarParser) peek(n int) byte {
+	if p.pos+n < len(p.src) {
+		return p.src[p.pos+n]
+	}
+
+	return 0
+}
+
+// space skips spaces and comments and, if newlines is true, newlines
+func (p *grammarParser) space(newlines bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\r' && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case newlines && (c == '\r' || c == '\n'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isWordChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-'
+}
+
+func (p *grammarParser) name() (string, error) {
+	start := p.pos
+	for p.pos < len(p.src) && isWordChar(p.src[p.pos]) {
+		p.pos++
+	}
+
+	if p.pos == start {
+		return "", p.errorf("expecting name")
+	}
+
+	return p.src[start:p.pos], nil
+}
+
+func (p *grammarParser) integer() (int, error) {
+	start := p.pos
+	for p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+		p.pos++
+	}
+
+	n, err := strconv.Atoi(p.src[start:p.pos])
+	if err != nil {
+		p.pos = start
+		return 0, p.errorf("expecting integer")
+	}
+
+	return n, nil
+}
+
+// char parses a character of a literal or class, which may be escaped
+func (p *grammarParser) char() (rune, error) {
+	if p.pos >= len(p.src) {
+		return 0, p.errorf("unexpected end of input")
+	}
+
+	if p.src[p.pos] != '\\' {
+		r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.pos += n
+		return r, nil
+	}
+
+	digits := 0
+	switch c := p.peek(1); c {
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	case 't':
+		p.pos += 2
+		return '\t', nil
+	case 'r':
+		p.pos += 2
+		return '\r', nil
+	case 'n':
+		p.pos += 2
+		return '\n', nil
+	case '\\', '"', '[', ']':
+		p.pos += 2
+		return rune(c), nil
+	default:
+		return 0, p.errorf("unknown escape")
+	}
+
+	if p.pos+2+digits > len(p.src) {
+		return 0, p.errorf("expecting %d hex digits", digits)
+	}
+
+	v, err := strconv.ParseUint(p.src[p.pos+2:p.pos+2+digits], 16, 32)
+	if err != nil {
+		return 0, p.errorf("expecting %d hex digits", digits)
+	}
+
+	p.pos += 2 + digits
+	return rune(v), nil
+}
+
+func (p *grammarParser) parse() error {
+	p.space(true)
+	for p.pos < len(p.src) {
+		if err := p.rule(); err != nil {
+			return err
+		}
+	}
+
+	for id, rule := range p.rules {
+		if rule == nil {
+			return fmt.Errorf("undefined rule %s", p.names()[id])
+		}
+	}
+
+	return nil
+}
+
+func (p *grammarParser) rule() error {
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+
+	p.space(false)
+	if !strings.HasPrefix(p.src[p.pos:], "::=") {
+		return p.errorf("expecting ::=")
+	}
+
+	p.pos += 3
+	p.space(true)
+
+	id := p.id(name)
+	if p.rules[id] != nil {
+		return p.errorf("rule %s is defined twice", name)
+	}
+
+	if err := p.alternates(name, id, false); err != nil {
+		return err
+	}
+
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "\r\n"):
+		p.pos += 2
+	case p.peek(0) == '\r' || p.peek(0) == '\n':
+		p.pos++
+	case p.pos < len(p.src):
+		return p.errorf("expecting newline or end")
+	}
+
+	p.space(true)
+	return nil
+}
+
+// alternates parses the alternatives of the rule with the given index, which
+// is nested if it is a group within parentheses
+func (p *grammarParser) alternates(name string, id int, nested bool) error {
+	var alts []sequence
+	for {
+		seq, err := p.sequence(name, nested)
+		if err != nil {
+			return err
+		}
+
+		alts = append(alts, seq)
+		if p.peek(0) != '|' {
+			break
+		}
+
+		p.pos++
+		p.space(true)
+	}
+
+	p.rules[id] = alts
+	return nil
+}
+
+func (p *grammarParser) sequence(name string, nested bool) (sequence, error) {
+	var seq sequence
+
+	// last is the start of the last item of seq, which repetitions apply to
+	last := 0
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == '"':
+			p.pos++
+			last = len(seq)
+			for p.peek(0) != '"' {
+				if p.pos >= len(p.src) {
+					return nil, p.errorf("unterminated literal")
+				}
+
+				r, err := p.char()
+				if err != nil {
+					return nil, err
+				}
+
+				seq = append(seq, symbol{rule: -1, ranges: [][2]rune{{r, r}}})
+			}
+
+			p.pos++
+			p.space(nested)
+		case c == '[':
+			p.pos++
+			class := symbol{rule: -1}
+			if p.peek(0) == '^' {
+				p.pos++
+				class.negated = true
+			}
+
+			for p.peek(0) != ']' {
+				if p.pos >= len(p.src) {
+					return nil, p.errorf("unterminated character class")
+				}
+
+				lo, err := p.char()
+				if err != nil {
+					return nil, err
+				}
+
+				hi := lo
+				if p.peek(0) == '-' && p.peek(1) != ']' {
+					p.pos++
+					if hi, err = p.char(); err != nil {
+						return nil, err
+					}
+				}
+
+				class.ranges = append(class.ranges, [2]rune{lo, hi})
+			}
+
+			p.pos++
+			last = len(seq)
+			seq = append(seq, class)
+			p.space(nested)
+		case isWordChar(c):
+			ref, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+
+			last = len(seq)
+			seq = append(seq, symbol{rule: p.id(ref)})
+			p.space(nested)
+		case c == '(':
+			p.pos++
+			p.space(true)
+			id := p.generate(name)
+			if err := p.alternates(name, id, true); err != nil {
+				return nil, err
+			}
+
+			if p.peek(0) != ')' {
+				return nil, p.errorf("expecting )")
+			}
+
+			p.pos++
+			last = len(seq)
+			seq = append(seq, symbol{rule: id})
+			p.space(nested)
+		case c == '.':
+			p.pos++
+			last = len(seq)
+			seq = append(seq, symbol{rule: -1, ranges: [][2]rune{{0, math.MaxInt32}}})
+			p.space(nested)
+		case c == '*' || c == '+' || c == '?':
+			p.pos++
+			p.space(nested)
+
+			min, max := 0, -1
+			switch c {
+			case '+':
+				min = 1
+			case '?':
+				max = 1
+			}
+
+			var err error
+			if seq, err = p.repeat(name, seq, last, min, max); err != nil {
+				return nil, err
+			}
+		case c == '{':
+			p.pos++
+			p.space(nested)
+
+			min, err := p.integer()
+			if err != nil {
+				return nil, err
+			}
+			p.space(nested)
+
+			max := min
+			switch p.peek(0) {
+			case '}':
+			case ',':
+				p.pos++
+				p.space(nested)
+
+				max = -1
+				if c := p.peek(0); '0' <= c && c <= '9' {
+					if max, err = p.integer(); err != nil {
+						return nil, err
+					}
+					p.space(nested)
+				}
+
+				if p.peek(0) != '}' {
+					return nil, p.errorf("expecting }")
+				}
+			default:
+				return nil, p.errorf("expecting , or }")
+			}
+
+			p.pos++
+			p.space(nested)
+
+			if max >= 0 && max < min {
+				return nil, p.errorf("maximum repetitions %d is less than the minimum %d", max, min)
+			}
+
+			if seq, err = p.repeat(name, seq, last, min, max); err != nil {
+				return nil, err
+			}
+		default:
+			return seq, nil
+		}
+	}
+
+	return seq, nil
+}
+
+// repeat repeats the last item of seq, which starts at last, between min and
+// max times, or at least min times if max is negative. As in llama.cpp, the
+// optional repetitions are rules that each match the item followed by the
+// next, or nothing:
+//
+//	S{m,n} -> S (m times) S'(n-m), with S'(x) ::= S S'(x-1) | and S'(1) ::= S |
+//	S{m,}  -> S (m times) S', with S' ::= S S' |
+func (p *grammarParser) repeat(name string, seq sequence, last, min, max int) (sequence, error) {
+	if last >= len(seq) {
+		return nil, p.errorf("expecting an item to repeat")
+	}
+
+	item := slices.Clone(seq[last:])
+	if min == 0 {
+		seq = seq[:last]
+	}
+
+	for i := 1; i < min; i++ {
+		seq = append(seq, item...)
+	}
+
+	optional := max - min
+	if max < 0 {
+		optional = 1
+	}
+
+	prev := -1
+	for i := range optional {
+		id := p.generate(name)
+		rec := slices.Clone(item)
+		if max < 0 {
+			rec = append(rec, symbol{rule: id})
+		} else if i > 0 {
+			rec = append(rec, symbol{rule: prev})
+		}
+
+		p.rules[id] = []sequence{rec, nil}
+		prev = id
+	}
+
+	if optional > 0 {
+		seq = append(seq, symbol{rule: prev})
+	}
+
+	return seq, nil
+}
+
+// leftRecursion returns the name of a rule that can reference itself before
+// matching any character, which would recurse forever when matching
+func (g *Grammar) leftRecursion(names []string) (string, bool) {
+	// nullable rules can match nothing, which they do if any of their
+	// alternatives only references nullable rules
+	nullable := make([]bool, len(g.rules))
+	for changed := true; changed; {
+		changed = false
+		for id, rule := range g.rules {
+			if !nullable[id] && slices.ContainsFunc(rule, func(seq sequence) bool {
+				return !slices.ContainsFunc(seq, func(s symbol) bool { return s.rule < 0 || !nullable[s.rule] })
+			}) {
+				nullable[id], changed = true, true
+			}
+		}
+	}
+
+	visited := make([]bool, len(g.rules))
+	inProgress := make([]bool, len(g.rules))
+
+	var detect func(id int) (int, bool)
+	detect = func(id int) (int, bool) {
+		if inProgress[id] {
+			return id, true
+		}
+
+		inProgress[id] = true
+		for _, seq := range g.rules[id] {
+			// recurse into the leftmost references, and those after
+			// references that can match nothing
+			for _, s := range seq {
+				if s.rule < 0 {
+					break
+				}
+
+				if recursive, ok := detect(s.rule); ok {
+					return recursive, true
+				}
+
+				if !nullable[s.rule] {
+					break
+				}
+			}
+		}
+
+		inProgress[id] = false
+		visited[id] = true
+		return 0, false
+	}
+
+	for id := range g.rules {
+		if visited[id] {
+			continue
+		}
+
+		if recursive, ok := detect(id); ok {
+			return names[recursive], true
+		}
+	}
+
+	return "", false
+}
+
+// position is a symbol in an alternative of a rule
+type position struct {
+	rule, alt, index int
+}
+
+// stack is a state of matching a grammar, a stack of the positions to match
+// next with the top at the end. The top position is always a character class,
+// and the grammar has been matched if the stack is empty.
+type stack []position
+
+func push(s stack, p position) stack {
+	return append(s[:len(s):len(s)], p)
+}
+
+func (g *Grammar) symbol(p position) symbol {
+	return g.rules[p.rule][p.alt][p.index]
+}
+
+// advance adds the stacks that result from expanding the references at the
+// top of s until each has a character class at its top, or is empty, to out
+func (g *Grammar) advance(s stack, out *[]stack) {
+	if len(s) > 0 {
+		top := s[len(s)-1]
+		if sym := g.symbol(top); sym.rule >= 0 {
+			rest := s[:len(s)-1]
+			if next := top.index + 1; next < len(g.rules[top.rule][top.alt]) {
+				rest = push(rest, position{top.rule, top.alt, next})
+			}
+
+			for alt, seq := range g.rules[sym.rule] {
+				if len(seq) > 0 {
+					g.advance(push(rest, position{sym.rule, alt, 0}), out)
+				} else {
+					g.advance(rest, out)
+				}
+			}
+
+			return
+		}
+	}
+
+	if !slices.ContainsFunc(*out, func(t stack) bool { return slices.Equal(s, t) }) {
+		*out = append(*out, s)
+	}
+}
+
+// next returns the stack after matching the character class at the top of s
+func (g *Grammar) next(s stack) []stack {
+	top := s[len(s)-1]
+	rest := s[:len(s)-1]
+	if next := top.index + 1; next < len(g.rules[top.rule][top.alt]) {
+		rest = push(rest, position{top.rule, top.alt, next})
+	}
+
+	var stacks []stack
+	g.advance(rest, &stacks)
+	return stacks
+}
+
+func (g *Grammar) start() []stack {
+	var stacks []stack
+	for alt, seq := range g.rules[g.root] {
+		if len(seq) > 0 {
+			g.advance(stack{{g.root, alt, 0}}, &stacks)
+		} else {
+			g.advance(nil, &stacks)
+		}
+	}
+
+	return stacks
+}
+
+// accept returns the stacks after matching r
+func (g *Grammar) accept(stacks []stack, r rune) []stack {
+	var out []stack
+	for _, s := range stacks {
+		if len(s) > 0 && g.symbol(s[len(s)-1]).match(r) {
+			for _, t := range g.next(s) {
+				if !slices.ContainsFunc(out, func(u stack) bool { return slices.Equal(t, u) }) {
+					out = append(out, t)
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// partialRune is the start of the UTF-8 encoding of a character, with value
+// the bits decoded so far and remain the number of bytes that remain, or -1
+// if the encoding is invalid
+type partialRune struct {
+	value  rune
+	remain int
+}
+
+// decodeUTF8 decodes the characters of s, which may start by completing the
+// encoding of partial and end with the start of the encoding of another
+func decodeUTF8(s string, partial partialRune) ([]rune, partialRune) {
+	runes := make([]rune, 0, len(s))
+	value, remain := partial.value, partial.remain
+
+	i := 0
+	for ; i < len(s) && remain > 0; i++ {
+		if s[i]>>6 != 2 {
+			return nil, partialRune{remain: -1}
+		}
+
+		value = value<<6 | rune(s[i]&0x3f)
+		remain--
+	}
+
+	if partial.remain > 0 && remain == 0 {
+		runes = append(runes, value)
+	}
+
+	for i < len(s) {
+		// the number of bytes after the first by its top 4 bits
+		remain = [16]int{0, 0, 0, 0, 0, 0, 0, 0, -1, -1, -1, -1, 1, 1, 2, 3}[s[i]>>4]
+		if remain < 0 {
+			return nil, partialRune{remain: -1}
+		}
+
+		value = rune(s[i]) & (1<<(7-remain) - 1)
+		for i++; i < len(s) && remain > 0; i++ {
+			if s[i]>>6 != 2 {
+				return nil, partialRune{remain: -1}
+			}
+
+			value = value<<6 | rune(s[i]&0x3f)
+			remain--
+		}
+
+		if remain == 0 {
+			runes = append(runes, value)
+		}
+	}
+
+	if remain == 0 {
+		value = 0
+	}
+
+	return runes, partialRune{value, remain}
+}
+
+// Vocabulary is the text of the tokens of a model, which grammars match
+type Vocabulary struct {
+	pieces []piece
+	eos    int32
+}
+
+type piece struct {
+	text    string
+	runes   []rune
+	partial partialRune
+}
+
+// NewVocabulary returns the vocabulary where token i decodes to pieces[i],
+// which may be a partial UTF-8 encoding, and eos ends the sequence. Tokens
+// with empty pieces are never sampled with a grammar; eos is sampled once the
+// grammar has been matched.
+func NewVocabulary(pieces []string, eos int32) *Vocabulary {
+	v := &Vocabulary{pieces: make([]piece, len(pieces)), eos: eos}
+	for i, text := range pieces {
+		runes, partial := decodeUTF8(text, partialRune{})
+		v.pieces[i] = piece{text, runes, partial}
+	}
+
+	return v
+}
+
+// Transform returns a transform that restricts logits to the tokens of v that
+// continue a string that g matches, starting from the empty string, and the
+// end of sequence once g has been matched. The transform tracks the tokens
+// sampled, so it must only be used by a single sampler.
+func (g *Grammar) Transform(v *Vocabulary) Transform {
+	t := &grammarState{g: g, v: v, ids: make(map[string]int32)}
+
+	// the first state has no stacks, which matches nothing
+	t.intern(nil)
+	t.state = t.intern(g.start())
+	return t
+}
+
+type grammarState struct {
+	g *Grammar
+	v *Vocabulary
+
+	// states are the sets of stacks reached by the strings matched so far,
+	// by their keys in ids, with state the current state and partial the
+	// encoding of the last character if it was split between tokens
+	states  []*matchState
+	ids     map[string]int32
+	state   int32
+	partial partialRune
+}
+
+// matchState is a set of stacks with the states that follow it, which are
+// computed once as characters are matched
+type matchState struct {
+	stacks  []stack
+	matched bool
+
+	// ascii are the next states for ASCII characters, or -1 if not yet
+	// known, as these are most common
+	ascii [utf8.RuneSelf]int32
+	next  map[rune]int32
+}
+
+func (t *grammarState) intern(stacks []stack) int32 {
+	keys := make([]string, len(stacks))
+	for i, s := range stacks {
+		keys[i] = fmt.Sprint(s)
+	}
+	slices.Sort(keys)
+	key := strings.Join(keys, ";")
+
+	if id, ok := t.ids[key]; ok {
+		return id
+	}
+
+	id := int32(len(t.states))
+	state := &matchState{stacks: stacks, next: make(map[rune]int32)}
+	state.matched = slices.ContainsFunc(stacks, func(s stack) bool { return len(s) == 0 })
+	for i := range state.ascii {
+		state.ascii[i] = -1
+	}
+
+	t.states = append(t.states, state)
+	t.ids[key] = id
+	return id
+}
+
+// next returns the state after matching r in state id, which is 0 if r
+// doesn't match
+func (t *grammarState) next(id int32, r rune) int32 {
+	state := t.states[id]
+
+	next, ok := state.next[r]
+	if r >= 0 && r < utf8.RuneSelf {
+		next, ok = state.ascii[r], state.ascii[r] >= 0
+	}
+
+	if !ok {
+		next = t.intern(t.g.accept(state.stacks, r))
+		if r >= 0 && r < utf8.RuneSelf {
+			state.ascii[r] = next
+		} else {
+			state.next[r] = next
+		}
+	}
+
+	return next
+}
+
+// advance returns the state after matching runes and then the start of a
+// character partial, which is 0 if they don't match
+func (t *grammarState) advance(id int32, runes []rune, partial partialRune) int32 {
+	for _, r := range runes {
+		if id = t.next(id, r); id == 0 {
+			return 0
+		}
+	}
+
+	if partial.remain > 0 && !slices.ContainsFunc(t.states[id].stacks, func(s stack) bool {
+		return len(s) > 0 && t.g.symbol(s[len(s)-1]).matchPartial(partial)
+	}) {
+		return 0
+	}
+
+	return id
+}
+
+func (t *grammarState) Apply(logits []float64) []float64 {
+	matched := t.partial.remain == 0 && t.states[t.state].matched
+	for i, logit := range logits {
+		if math.IsInf(logit, -1) {
+			continue
+		}
+
+		if int32(i) == t.v.eos {
+			if !matched {
+				logits[i] = math.Inf(-1)
+			}
+			continue
+		}
+
+		if i >= len(t.v.pieces) {
+			logits[i] = math.Inf(-1)
+			continue
+		}
+
+		p := t.v.pieces[i]
+		runes, partial := p.runes, p.partial
+		if t.partial.remain > 0 {
+			runes, partial = decodeUTF8(p.text, t.partial)
+		}
+
+		if partial.remain < 0 || len(runes) == 0 && partial.remain == 0 || t.advance(t.state, runes, partial) == 0 {
+			logits[i] = math.Inf(-1)
+		}
+	}
+
+	return logits
+}
+
+// Accept advances the grammar past token
+func (t *grammarState) Accept(token int32) {
+	if token == t.v.eos || int(token) >= len(t.v.pieces) {
+		return
+	}
+
+	runes, partial := decodeUTF8(t.v.pieces[token].text, t.partial)
+	if partial.remain < 0 {
+		t.state = 0
+		return
+	}
+
+	for _, r := range runes {
+		t.state = t.next(t.state, r)
+	}
+
+	t.partial = partial
+}
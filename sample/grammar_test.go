@@ -0,0 +1,247 @@
+package sample
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseGrammar(t *testing.T) {
+	for _, src := range []string{
+		`root ::= "a"`,
+		"# comment\nroot ::= item+ # trailing\nitem ::= [a-z0-9_] | \"\\\\\" [\"\\\\/bfnrt]\n",
+		"root ::= (\n  \"a\" |\n  \"b\"\n)* \"c\"{2,3} [^\\x00-\\x1F\\u00e9]? .{0,}\r\n",
+		"root ::= | \"x\" space\nspace ::= \" \"?",
+		`root ::= "日本" [\U0001F600-\U0001F64F]`,
+	} {
+		if _, err := ParseGrammar(src); err != nil {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		src, err string
+	}{
+		{``, "missing rule root"},
+		{`item ::= "a"`, "missing rule root"},
+		{`root ::= item`, "undefined rule item"},
+		{`root ::= "a`, "unterminated literal"},
+		{`root ::= [a-z`, "unterminated character class"},
+		{`root ::= "\q"`, "unknown escape at line 1 column 11"},
+		{`root ::= "\x4"`, "expecting 2 hex digits"},
+		{"root ::= \"a\"\nitem = \"b\"", "expecting ::= at line 2 column 6"},
+		{`root ::= ("a"`, "expecting )"},
+		{`root ::= * "a"`, "expecting an item to repeat"},
+		{`root ::= "a"{3,2}`, "less than the minimum"},
+		{`root ::= "a"{x}`, "expecting integer"},
+		{"root ::= \"a\" )", "expecting newline or end"},
+		{"root ::= \"a\"\nroot ::= \"b\"", "defined twice"},
+		{"root ::= expr\nexpr ::= expr \"+\" term | term\nterm ::= [0-9]", "rule expr is left recursive"},
+		{"root ::= space root \"a\"\nspace ::= \" \"?", "rule root is left recursive"},
+	} {
+		_, err := ParseGrammar(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: have error %v; want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+// match reports whether g matches s character by character
+func (g *Grammar) match(s string) bool {
+	stacks := g.start()
+	for _, r := range s {
+		stacks = g.accept(stacks, r)
+	}
+
+	for _, s := range stacks {
+		if len(s) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestGrammarMatch(t *testing.T) {
+	g, err := ParseGrammar(`
+root   ::= object
+object ::= "{" ws ( pair ( "," ws pair )* )? "}"
+pair   ::= string ":" ws value
+value  ::= string | number | object
+string ::= "\"" ( [^"\\] | "\\" ["\\n] )* "\"" ws
+number ::= "-"? [0-9]{1,3} ws
+ws     ::= [ \t\n]*
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for s, want := range map[string]bool{
+		`{}`:                          true,
+		`{"a": 1}`:                    true,
+		`{"a": -12, "b": {"c": "d"}}`: true,
+		`{"é\"": "日本"}`:               true,
+		`{"a": 1234}`:                 false,
+		`{"a": 1,}`:                   false,
+		`{"a" 1}`:                     false,
+		`{`:                           false,
+		`{} `:                         false,
+	} {
+		if got := g.match(s); got != want {
+			t.Errorf("%q: have match %v; want %v", s, got, want)
+		}
+	}
+}
+
+// sampleGrammar samples from random logits over pieces with g until the end
+// of sequence, which is the last token, and returns the text sampled
+func sampleGrammar(t *testing.T, g *Grammar, pieces []string, seed uint64) string {
+	t.Helper()
+
+	eos := int32(len(pieces))
+	s, err := NewSampler(1, 0, 0, 0, int(seed)+1, nil, nil, nil, g.Transform(NewVocabulary(append(pieces, ""), eos)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewPCG(seed, 0))
+	logits := make([]float32, eos+1)
+
+	var sb strings.Builder
+	for range 256 {
+		for i := range logits {
+			logits[i] = float32(r.NormFloat64() * 3)
+		}
+
+		token, err := s.Sample(logits)
+		if err != nil {
+			t.Fatalf("seed %d after %q: %v", seed, sb.String(), err)
+		}
+
+		if token == eos {
+			return sb.String()
+		}
+
+		sb.WriteString(pieces[token])
+	}
+
+	t.Fatalf("seed %d: no end of sequence after %q", seed, sb.String())
+	return ""
+}
+
+func TestGrammarDate(t *testing.T) {
+	g, err := ParseGrammar(`
+root  ::= year "-" month "-" day
+year  ::= [0-9]{4}
+month ::= "0" [1-9] | "1" [0-2]
+day   ::= "0" [1-9] | [12] [0-9] | "3" [01]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens that straddle the terminals of the grammar, and many that can't
+	// be part of a date at all
+	pieces := []string{
+		"0", "1", "2", "3", "4", "5", "6", "7", "8", "9",
+		"-", "--", "20", "202", "2024", "19", "-0", "-1", "-3", "12-", "01-",
+		"31", "99", "00", "-12-", "4-0", "a", "date", " ", "\n", "é", "\xc3",
+	}
+
+	date := regexp.MustCompile(`^[0-9]{4}-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])$`)
+	for seed := range uint64(100) {
+		if s := sampleGrammar(t, g, pieces, seed); !date.MatchString(s) {
+			t.Errorf("seed %d: sampled %q, which isn't a date", seed, s)
+		}
+	}
+}
+
+func TestGrammarUTF8(t *testing.T) {
+	// é is c3 a9 and 日 is e6 97 a5, which these tokens split
+	pieces := []string{"\xc3", "\xa9", "\xe6", "\xe6\x97", "\x97\xa5", "\xa5", "!", "\xa9!", "e"}
+
+	g, err := ParseGrammar(`root ::= ( "é" | "日" ) "!"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for seed := range uint64(20) {
+		if s := sampleGrammar(t, g, pieces, seed); s != "é!" && s != "日!" {
+			t.Errorf("seed %d: sampled %q", seed, s)
+		}
+	}
+
+	// the start of the encoding of é is rejected by a class that excludes it
+	v := NewVocabulary(pieces, -1)
+	for _, tt := range []struct {
+		grammar string
+		allowed []int
+	}{
+		{`root ::= [^é]+`, []int{2, 3, 6, 8}},
+		{`root ::= [a-z]+`, []int{8}},
+		{`root ::= [\u0080-\uFFFF]+`, []int{0, 2, 3}},
+	} {
+		g, err := ParseGrammar(tt.grammar)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		logits := g.Transform(v).Apply(make([]float64, len(pieces)))
+
+		var allowed []int
+		for i, logit := range logits {
+			if !math.IsInf(logit, -1) {
+				allowed = append(allowed, i)
+			}
+		}
+
+		if !slices.Equal(allowed, tt.allowed) {
+			t.Errorf("%s: have tokens %v allowed; want %v", tt.grammar, allowed, tt.allowed)
+		}
+	}
+}
+
+func BenchmarkGrammar(b *testing.B) {
+	g, err := ParseGrammar(`
+root   ::= object
+object ::= "{" ws ( string ":" ws value ( "," ws string ":" ws value )* )? "}" ws
+value  ::= object | string | [0-9]+ ws
+string ::= "\"" ( [^"\\\x7F\x00-\x1F] | "\\" ["\\/bfnrt] )* "\"" ws
+ws     ::= [ \t\n]*
+`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// a vocabulary of the size of that of recent models
+	r := rand.New(rand.NewPCG(1, 2))
+	pieces := make([]string, 1<<17)
+	for i := range pieces {
+		var sb strings.Builder
+		for range 1 + r.IntN(6) {
+			sb.WriteByte(byte(' ' + r.IntN(95)))
+		}
+		pieces[i] = sb.String()
+	}
+
+	v := NewVocabulary(pieces, -1)
+	logits := make([]float64, len(pieces))
+	for _, prefix := range []string{"", `{"key": "val`} {
+		b.Run(fmt.Sprintf("prefix=%q", prefix), func(b *testing.B) {
+			t := g.Transform(v).(*grammarState)
+			for _, r := range prefix {
+				t.state = t.next(t.state, r)
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				clear(logits)
+				t.Apply(logits)
+			}
+		})
+	}
+}
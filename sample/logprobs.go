@@ -0,0 +1,87 @@
+package sample
+
+import (
+	"math"
+	"slices"
+)
+
+// TokenLogprob is the log probability of a token
+type TokenLogprob struct {
+	Token   int32
+	Logprob float64
+}
+
+// Logprobs is a transform that records the log probabilities of the logits at
+// its place among the transforms of a sampler, without changing them.
+// NewSampler places it after any logit bias, penalties and grammar, so that
+// the log probabilities are those of the tokens that can be sampled, and
+// before transforms such as top-k that truncate the distribution.
+type Logprobs struct {
+	// Temperature records the log probabilities after the temperature of the
+	// sampler, if any, rather than those of the logits as they are
+	Temperature bool
+
+	logprobs []float64
+}
+
+func (l *Logprobs) Apply(logits []float64) []float64 {
+	l.logprobs = append(l.logprobs[:0], logits...)
+
+	maxLogit := math.Inf(-1)
+	for _, logit := range l.logprobs {
+		maxLogit = max(maxLogit, logit)
+	}
+
+	// every token is banned, so each is as unlikely
+	if math.IsInf(maxLogit, -1) {
+		return logits
+	}
+
+	var sum float64
+	for _, logit := range l.logprobs {
+		sum += math.Exp(logit - maxLogit)
+	}
+
+	logSum := maxLogit + math.Log(sum)
+	for i := range l.logprobs {
+		l.logprobs[i] -= logSum
+	}
+
+	return logits
+}
+
+// Logprob returns the log probability of token for the logits last applied
+func (l *Logprobs) Logprob(token int32) float64 {
+	if token < 0 || int(token) >= len(l.logprobs) {
+		return math.Inf(-1)
+	}
+
+	return l.logprobs[token]
+}
+
+// Top returns the n most likely tokens for the logits last applied, from the
+// most likely, leaving out those that can't be sampled
+func (l *Logprobs) Top(n int) []TokenLogprob {
+	top := make([]TokenLogprob, 0, n+1)
+	for i, logprob := range l.logprobs {
+		if math.IsInf(logprob, -1) || len(top) == n && logprob <= top[n-1].Logprob {
+			continue
+		}
+
+		j, _ := slices.BinarySearchFunc(top, logprob, func(t TokenLogprob, logprob float64) int {
+			// descending, with ties in the order of the tokens
+			if t.Logprob >= logprob {
+				return -1
+			}
+
+			return 1
+		})
+
+		top = slices.Insert(top, j, TokenLogprob{Token: int32(i), Logprob: logprob})
+		if len(top) > n {
+			top = top[:n]
+		}
+	}
+
+	return top
+}
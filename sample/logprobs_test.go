@@ -0,0 +1,93 @@
+package sample
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestLogprobs(t *testing.T) {
+	var l Logprobs
+
+	logits := []float64{1, math.Inf(-1), 3, 2, 3}
+	if got := l.Apply(slices.Clone(logits)); !slices.Equal(got, logits) {
+		t.Errorf("have logits %v; want them unchanged", got)
+	}
+
+	// the log of e^x / (e + 2e^3 + e^2)
+	logSum := math.Log(math.E + 2*math.Exp(3) + math.Exp(2))
+	for token, want := range map[int32]float64{0: 1 - logSum, 1: math.Inf(-1), 2: 3 - logSum, 5: math.Inf(-1)} {
+		if got := l.Logprob(token); math.Abs(got-want) > 1e-12 && got != want {
+			t.Errorf("token %d: have logprob %v; want %v", token, got, want)
+		}
+	}
+
+	want := []TokenLogprob{{2, 3 - logSum}, {4, 3 - logSum}, {3, 2 - logSum}}
+	if diff := cmp.Diff(want, l.Top(3), cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("top mismatch (-want +got):\n%s", diff)
+	}
+
+	// banned tokens are left out
+	if got := l.Top(10); len(got) != 4 {
+		t.Errorf("have top %v; want the 4 tokens that can be sampled", got)
+	}
+}
+
+func TestNewSamplerLogprobs(t *testing.T) {
+	logits := []float32{-3, -2, -1, 0, 1, 2, 4, 3}
+
+	// a token forced by its bias is certain whatever the temperature
+	for _, temperature := range []bool{false, true} {
+		l := &Logprobs{Temperature: temperature}
+		s, err := NewSampler(0.5, 3, 0.9, 0, 1, LogitBias{2: 100}, nil, nil, nil, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := s.Sample(slices.Clone(logits))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != 2 || math.Abs(l.Logprob(token)) > 1e-9 {
+			t.Errorf("have token %d with logprob %v; want 2 with 0", token, l.Logprob(token))
+		}
+	}
+
+	// top-k doesn't change the log probabilities, while a temperature of 0.5
+	// doubles the logits if they are taken after it
+	for _, tt := range []struct {
+		temperature bool
+		want        float64
+	}{
+		{false, 4 - math.Log(sumExp(logits, 1))},
+		{true, 8 - math.Log(sumExp(logits, 2))},
+	} {
+		l := &Logprobs{Temperature: tt.temperature}
+		s, err := NewSampler(0.5, 1, 0, 0, 1, nil, nil, nil, nil, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := s.Sample(slices.Clone(logits))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := l.Logprob(token); token != 6 || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("temperature %v: have token %d with logprob %v; want 6 with %v", tt.temperature, token, l.Logprob(token), tt.want)
+		}
+	}
+}
+
+func sumExp(logits []float32, scale float64) float64 {
+	var sum float64
+	for _, logit := range logits {
+		sum += math.Exp(float64(logit) * scale)
+	}
+
+	return sum
+}
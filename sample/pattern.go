@@ -0,0 +1,521 @@
+package sample
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// runeSet is a set of characters as sorted, disjoint ranges
+type runeSet [][2]rune
+
+// normalize sorts the ranges of s and merges those that overlap or touch
+func (s runeSet) normalize() runeSet {
+	slices.SortFunc(s, func(a, b [2]rune) int { return int(a[0] - b[0]) })
+
+	var out runeSet
+	for _, r := range s {
+		if n := len(out); n > 0 && r[0] <= out[n-1][1]+1 {
+			out[n-1][1] = max(out[n-1][1], r[1])
+			continue
+		}
+
+		out = append(out, r)
+	}
+
+	return out
+}
+
+// negate returns the characters that aren't in s, which must be normalized
+func (s runeSet) negate() runeSet {
+	var out runeSet
+	next := rune(0)
+	for _, r := range s {
+		if r[0] > next {
+			out = append(out, [2]rune{next, r[0] - 1})
+		}
+
+		next = r[1] + 1
+	}
+
+	if next <= utf8.MaxRune {
+		out = append(out, [2]rune{next, utf8.MaxRune})
+	}
+
+	return out
+}
+
+var (
+	digitSet = runeSet{{'0', '9'}}
+	wordSet  = runeSet{{'0', '9'}, {'A', 'Z'}, {'_', '_'}, {'a', 'z'}}
+	spaceSet = runeSet{{'\t', '\r'}, {' ', ' '}, {0xa0, 0xa0}, {0x1680, 0x1680}, {0x2000, 0x200a}, {0x2028, 0x2029}, {0x202f, 0x202f}, {0x205f, 0x205f}, {0x3000, 0x3000}, {0xfeff, 0xfeff}}
+
+	// lineSet are the line terminators, which . doesn't match
+	lineSet = runeSet{{'\n', '\n'}, {'\r', '\r'}, {0x2028, 0x2029}}
+)
+
+// jsonEscapes are the escapes of the characters of a JSON string that must be
+// escaped and have a short escape. Other control characters and DEL aren't
+// matched by patterns.
+var jsonEscapes = map[rune]string{
+	'"': `\"`, '\\': `\\`, '\b': `\b`, '\f': `\f`, '\n': `\n`, '\r': `\r`, '\t': `\t`,
+}
+
+// classChar writes r as a character of a class of a grammar
+func classChar(sb *strings.Builder, r rune) {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		sb.WriteRune(r)
+	case r <= 0xff:
+		fmt.Fprintf(sb, `\x%02X`, r)
+	case r <= 0xffff:
+		fmt.Fprintf(sb, `\u%04X`, r)
+	default:
+		fmt.Fprintf(sb, `\U%08X`, r)
+	}
+}
+
+// expr returns an expression of a grammar that matches the characters of s
+// as they are written in a JSON string, or "" if s is empty
+func (s runeSet) expr() string {
+	var alts []string
+	var sb strings.Builder
+	for _, r := range s {
+		for lo := r[0]; lo <= r[1]; lo++ {
+			if lo >= 0x20 && lo != '"' && lo != '\\' && lo != 0x7f {
+				// the characters up to the next one that is escaped
+				hi := r[1]
+				for _, c := range []rune{'"', '\\', 0x7f} {
+					if lo < c && c <= hi {
+						hi = c - 1
+					}
+				}
+
+				classChar(&sb, lo)
+				if hi > lo {
+					sb.WriteByte('-')
+					classChar(&sb, hi)
+				}
+
+				lo = hi
+			} else if escape, ok := jsonEscapes[lo]; ok {
+				alts = append(alts, literal(escape))
+			}
+		}
+	}
+
+	if sb.Len() > 0 {
+		alts = append([]string{"[" + sb.String() + "]"}, alts...)
+	}
+
+	switch len(alts) {
+	case 0:
+		return ""
+	case 1:
+		return alts[0]
+	default:
+		return "( " + strings.Join(alts, " | ") + " )"
+	}
+}
+
+// patternParser translates the regular expression of a pattern keyword, in
+// the ECMA 262 dialect of JSON schemas, into an expression of a grammar
+type patternParser struct {
+	src  string
+	pos  int
+	path string
+}
+
+func (p *patternParser) unsupported(reason string) error {
+	return &UnsupportedSchemaError{Path: p.path, Keyword: "pattern", Reason: reason}
+}
+
+func (p *patternParser) peek() rune {
+	if p.pos >= len(p.src) {
+		return -1
+	}
+
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return r
+}
+
+func (p *patternParser) next() rune {
+	r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += n
+	return r
+}
+
+// pattern returns an expression of a grammar for the JSON strings, with their
+// quotes, that contain a match of pattern. Alternatives at the top level that
+// don't start with ^ or end with $ allow any characters before or after them.
+func (c *schemaCompiler) pattern(pattern, path string) (string, error) {
+	p := patternParser{src: pattern, path: path}
+	anything := c.primitive("char") + "*"
+
+	var alts []string
+	for {
+		anchoredStart := p.peek() == '^'
+		if anchoredStart {
+			p.pos++
+		}
+
+		seq, err := p.sequence()
+		if err != nil {
+			return "", err
+		}
+
+		anchoredEnd := p.peek() == '$'
+		if anchoredEnd {
+			p.pos++
+		}
+
+		if !anchoredStart {
+			seq = anything + " " + seq
+		}
+
+		if !anchoredEnd {
+			seq += " " + anything
+		}
+
+		alts = append(alts, seq)
+
+		switch p.peek() {
+		case -1:
+			return `"\"" ( ` + strings.Join(alts, " | ") + ` ) "\""`, nil
+		case '|':
+			p.pos++
+		case ')':
+			return "", fmt.Errorf("invalid JSON schema: pattern at %s has an unmatched )", path)
+		default:
+			return "", p.unsupported(fmt.Sprintf("%q is only supported at the start or end of an alternative at the top level", p.peek()))
+		}
+	}
+}
+
+// alternatives parses alternatives separated by | up to the end of a group
+func (p *patternParser) alternatives() (string, error) {
+	var alts []string
+	for {
+		seq, err := p.sequence()
+		if err != nil {
+			return "", err
+		}
+
+		alts = append(alts, seq)
+		if p.peek() != '|' {
+			break
+		}
+
+		p.pos++
+	}
+
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+
+	return "( " + strings.Join(alts, " | ") + " )", nil
+}
+
+// sequence parses items with their quantifiers up to a |, ), ^ or $, or
+// the end of the pattern
+func (p *patternParser) sequence() (string, error) {
+	var items []string
+	var text string
+	for {
+		switch p.peek() {
+		case -1, '|', ')', '^', '$':
+			if text != "" {
+				items = append(items, literal(text))
+			}
+
+			if len(items) == 0 {
+				return `""`, nil
+			}
+
+			return strings.Join(items, " "), nil
+		}
+
+		item, lit, err := p.atom()
+		if err != nil {
+			return "", err
+		}
+
+		quantified, err := p.quantifier(item)
+		if err != nil {
+			return "", err
+		}
+
+		// consecutive characters without quantifiers are a single literal
+		if lit != "" && quantified == item {
+			text += lit
+			continue
+		}
+
+		if text != "" {
+			items = append(items, literal(text))
+			text = ""
+		}
+
+		if quantified != "" {
+			items = append(items, quantified)
+		}
+	}
+}
+
+// atom parses a character, class or group, and returns its expression and,
+// for a single character, the character as written in a JSON string
+func (p *patternParser) atom() (string, string, error) {
+	switch r := p.next(); r {
+	case '(':
+		if strings.HasPrefix(p.src[p.pos:], "?:") {
+			p.pos += 2
+		} else if strings.HasPrefix(p.src[p.pos:], "?<") && !strings.HasPrefix(p.src[p.pos:], "?<=") && !strings.HasPrefix(p.src[p.pos:], "?<!") {
+			end := strings.IndexByte(p.src[p.pos:], '>')
+			if end < 0 {
+				return "", "", fmt.Errorf("invalid JSON schema: pattern at %s has an unterminated group name", p.path)
+			}
+
+			p.pos += end + 1
+		} else if p.peek() == '?' {
+			return "", "", p.unsupported("lookarounds can't be enforced")
+		}
+
+		expr, err := p.alternatives()
+		if err != nil {
+			return "", "", err
+		}
+
+		switch p.peek() {
+		case '^', '$':
+			return "", "", p.unsupported(fmt.Sprintf("%q is only supported at the start or end of an alternative at the top level", p.peek()))
+		case ')':
+		default:
+			return "", "", fmt.Errorf("invalid JSON schema: pattern at %s has an unterminated group", p.path)
+		}
+
+		p.pos++
+		return "( " + expr + " )", "", nil
+	case '[':
+		set, err := p.class()
+		if err != nil {
+			return "", "", err
+		}
+
+		return p.set(set)
+	case '.':
+		return p.set(lineSet.negate())
+	case '\\':
+		set, err := p.escape(false)
+		if err != nil {
+			return "", "", err
+		}
+
+		return p.set(set)
+	case '*', '+', '?':
+		return "", "", fmt.Errorf("invalid JSON schema: pattern at %s has a quantifier %q without an item", p.path, r)
+	default:
+		return p.set(runeSet{{r, r}})
+	}
+}
+
+// set returns the expression of an atom that matches a character of set
+func (p *patternParser) set(set runeSet) (string, string, error) {
+	expr := set.expr()
+	if expr == "" {
+		return "", "", p.unsupported("it matches a character that can't be generated")
+	}
+
+	var lit string
+	if len(set) == 1 && set[0][0] == set[0][1] {
+		lit = string(set[0][0])
+		if escape, ok := jsonEscapes[set[0][0]]; ok {
+			lit = escape
+		}
+	}
+
+	return expr, lit, nil
+}
+
+// quantifier parses the quantifier that follows item, if any, and returns
+// item with it. Lazy quantifiers match the same strings as greedy ones.
+func (p *patternParser) quantifier(item string) (string, error) {
+	min, max := 1, 1
+	switch p.peek() {
+	case '*':
+		min, max = 0, -1
+	case '+':
+		min, max = 1, -1
+	case '?':
+		min, max = 0, 1
+	case '{':
+		end := strings.IndexByte(p.src[p.pos:], '}')
+		if end < 0 {
+			return item, nil
+		}
+
+		lo, hi, found := strings.Cut(p.src[p.pos+1:p.pos+end], ",")
+		n, err := strconv.Atoi(lo)
+		if err != nil || n < 0 {
+			// a brace that doesn't start a quantifier is a character
+			return item, nil
+		}
+
+		min, max = n, n
+		if found {
+			max = -1
+			if hi != "" {
+				if max, err = strconv.Atoi(hi); err != nil || max < min {
+					return "", fmt.Errorf("invalid JSON schema: pattern at %s has an invalid quantifier %s", p.path, p.src[p.pos:p.pos+end+1])
+				}
+			}
+		}
+
+		p.pos += end
+	default:
+		return item, nil
+	}
+
+	p.pos++
+	if p.peek() == '?' {
+		p.pos++
+	}
+
+	switch p.peek() {
+	case '*', '+', '?', '{':
+		return "", fmt.Errorf("invalid JSON schema: pattern at %s has a quantifier %q without an item", p.path, p.peek())
+	}
+
+	if min == 1 && max == 1 {
+		// the same as item, but no longer a single character
+		return "( " + item + " )", nil
+	}
+
+	return repeat(item, min, max), nil
+}
+
+// class parses a character class after its [
+func (p *patternParser) class() (runeSet, error) {
+	negated := p.peek() == '^'
+	if negated {
+		p.pos++
+	}
+
+	var set runeSet
+	for first := true; first || p.peek() != ']'; first = false {
+		if p.peek() == -1 {
+			return nil, fmt.Errorf("invalid JSON schema: pattern at %s has an unterminated character class", p.path)
+		}
+
+		// ] is the end of the class even as its first character in ECMA 262
+		if first && p.peek() == ']' {
+			break
+		}
+
+		lo, err := p.classAtom()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() == '-' && !strings.HasPrefix(p.src[p.pos:], "-]") && len(lo) == 1 && lo[0][0] == lo[0][1] {
+			p.pos++
+
+			hi, err := p.classAtom()
+			if err != nil {
+				return nil, err
+			}
+
+			if len(hi) != 1 || hi[0][0] != hi[0][1] || hi[0][0] < lo[0][0] {
+				return nil, fmt.Errorf("invalid JSON schema: pattern at %s has an invalid range in a character class", p.path)
+			}
+
+			lo = runeSet{{lo[0][0], hi[0][0]}}
+		}
+
+		set = append(set, lo...)
+	}
+
+	p.pos++
+	set = set.normalize()
+	if negated {
+		set = set.negate()
+	}
+
+	return set, nil
+}
+
+// classAtom parses a character or escape of a class
+func (p *patternParser) classAtom() (runeSet, error) {
+	if r := p.next(); r != '\\' {
+		return runeSet{{r, r}}, nil
+	}
+
+	return p.escape(true)
+}
+
+// escape parses an escape after its \, where \b is a backspace in a class
+func (p *patternParser) escape(inClass bool) (runeSet, error) {
+	if p.peek() == -1 {
+		return nil, fmt.Errorf("invalid JSON schema: pattern at %s ends with \\", p.path)
+	}
+
+	single := func(r rune) (runeSet, error) { return runeSet{{r, r}}, nil }
+
+	switch r := p.next(); r {
+	case 'd':
+		return digitSet, nil
+	case 'D':
+		return digitSet.negate(), nil
+	case 'w':
+		return wordSet, nil
+	case 'W':
+		return wordSet.negate(), nil
+	case 's':
+		return spaceSet, nil
+	case 'S':
+		return spaceSet.negate(), nil
+	case 't':
+		return single('\t')
+	case 'n':
+		return single('\n')
+	case 'r':
+		return single('\r')
+	case 'f':
+		return single('\f')
+	case 'v':
+		return single('\v')
+	case '0':
+		return single(0)
+	case 'b':
+		if inClass {
+			return single('\b')
+		}
+
+		return nil, p.unsupported("word boundaries can't be enforced")
+	case 'x', 'u':
+		digits := 2
+		if r == 'u' {
+			digits = 4
+		}
+
+		if p.pos+digits <= len(p.src) {
+			if v, err := strconv.ParseUint(p.src[p.pos:p.pos+digits], 16, 32); err == nil {
+				p.pos += digits
+				return single(rune(v))
+			}
+		}
+
+		return nil, fmt.Errorf("invalid JSON schema: pattern at %s has an invalid \\%c escape", p.path, r)
+	default:
+		if '1' <= r && r <= '9' {
+			return nil, p.unsupported("backreferences can't be enforced")
+		}
+
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' {
+			return nil, p.unsupported(fmt.Sprintf("the escape \\%c isn't supported", r))
+		}
+
+		return single(r)
+	}
+}
@@ -0,0 +1,73 @@
+package sample
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		match   map[string]bool
+	}{
+		{`^[a-z]+\d{2,3}$`, map[string]bool{`"ab12"`: true, `"a123"`: true, `"a1"`: false, `"ab1234"`: false, `"Ab12"`: false}},
+		{`b`, map[string]bool{`"abc"`: true, `"b"`: true, `"ac"`: false, `""`: false}},
+		{`^(?:foo|ba[rz])-\w*$`, map[string]bool{`"foo-"`: true, `"baz-x_1"`: true, `"bar"`: false, `"qux-1"`: false}},
+		{`^a.c$`, map[string]bool{`"abc"`: true, `"a\"c"`: true, `"a\nc"`: false, `"ac"`: false}},
+		{`^[^"a]+$`, map[string]bool{`"xyz"`: true, `"x\\y"`: true, `"x\"y"`: false, `"xa"`: false}},
+		{`^\$\{[0-9]\}$`, map[string]bool{`"${5}"`: true, `"$5"`: false}},
+		{`^a{2}b?$|^c$`, map[string]bool{`"aa"`: true, `"aab"`: true, `"c"`: true, `"a"`: false, `"ca"`: false}},
+		{`^x\/y\\z$`, map[string]bool{`"x/y\\z"`: true, `"x/yz"`: false}},
+		{`^[-a]+$`, map[string]bool{`"-a-"`: true, `"b"`: false}},
+		{`^\s$`, map[string]bool{`" "`: true, `"\t"`: true, `"x"`: false}},
+		{`^é+$`, map[string]bool{`"éé"`: true, `"e"`: false}},
+	} {
+		src, err := SchemaGrammar([]byte(`{"type": "string", "pattern": ` + encodeJSON(tt.pattern) + `}`))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+
+		g, err := ParseGrammar(src)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", tt.pattern, err, src)
+		}
+
+		for s, want := range tt.match {
+			if got := g.match(s); got != want {
+				t.Errorf("%s: %s has match %v; want %v\n%s", tt.pattern, s, got, want, src)
+			}
+		}
+	}
+}
+
+func TestPatternUnsupported(t *testing.T) {
+	for _, pattern := range []string{`(?=a)`, `a(?!b)`, `(a)\1`, `a^b`, `(a$)`, `\bx`, `\p{L}`, `[^\s\S]`} {
+		_, err := SchemaGrammar([]byte(`{"type": "string", "pattern": ` + encodeJSON(pattern) + `}`))
+
+		var uerr *UnsupportedSchemaError
+		if !errors.As(err, &uerr) || uerr.Keyword != "pattern" {
+			t.Errorf("%s: have error %v; want pattern unsupported", pattern, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		pattern, err string
+	}{
+		{`(a`, "unterminated group"},
+		{`a)`, "unmatched )"},
+		{`[a`, "unterminated character class"},
+		{`*a`, "quantifier '*' without an item"},
+		{`a+*`, "quantifier '*' without an item"},
+		{`[z-a]`, "invalid range"},
+		{`a{3,1}`, "invalid quantifier {3,1}"},
+		{`\u12`, `invalid \u escape`},
+	} {
+		_, err := SchemaGrammar([]byte(`{"type": "string", "pattern": ` + encodeJSON(tt.pattern) + `}`))
+
+		var uerr *UnsupportedSchemaError
+		if err == nil || errors.As(err, &uerr) || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: have error %v; want %q", tt.pattern, err, tt.err)
+		}
+	}
+}
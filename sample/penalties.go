@@ -0,0 +1,179 @@
+package sample
+
+import (
+	"math"
+	"strings"
+)
+
+// history is the most recent tokens of a sequence
+type history struct {
+	tokens []int32
+}
+
+// add appends token, keeping at least the last n tokens
+func (h *history) add(token int32, n int) {
+	// trim rarely, so that adding a token doesn't copy the window
+	if len(h.tokens) >= 2*n {
+		h.tokens = append(h.tokens[:0], h.tokens[len(h.tokens)-n:]...)
+	}
+
+	h.tokens = append(h.tokens, token)
+}
+
+// last returns the last n tokens, or all of them if there are fewer
+func (h *history) last(n int) []int32 {
+	return h.tokens[max(len(h.tokens)-n, 0):]
+}
+
+// Penalties is a transform that applies the presence and frequency penalties
+// of the OpenAI API to the tokens among the last LastN of the sequence. The
+// logit of each token is reduced by Frequency for each time it occurs and by
+// Presence if it occurs at all.
+//
+// The sequence is made of the tokens sampled and any others passed to Accept,
+// such as those of the prompt.
+type Penalties struct {
+	LastN               int
+	Presence, Frequency float64
+
+	history
+}
+
+// Accept adds token to the sequence. It does nothing for nil p.
+func (p *Penalties) Accept(token int32) {
+	if p != nil {
+		p.add(token, p.LastN)
+	}
+}
+
+func (p *Penalties) Apply(logits []float64) []float64 {
+	counts := make(map[int32]int)
+	for _, token := range p.last(p.LastN) {
+		counts[token]++
+	}
+
+	for token, count := range counts {
+		if token < 0 || int(token) >= len(logits) {
+			continue
+		}
+
+		logits[token] -= float64(count)*p.Frequency + p.Presence
+	}
+
+	return logits
+}
+
+// DRY is a transform that implements the DRY ("don't repeat yourself")
+// sampler. A token that would extend a sequence of tokens at the end of the
+// last LastN tokens that also occurs earlier among them, where it is followed
+// by the token, is penalized by Multiplier * Base ^ (length - AllowedLength)
+// if the sequence has at least AllowedLength tokens. Only the longest such
+// sequence counts for each token.
+//
+// Repeated sequences end at the last of Breakers in the sequence, which are
+// themselves never penalized. As with Penalties, the sequence is made of the
+// tokens sampled and any others passed to Accept.
+type DRY struct {
+	Multiplier, Base float64
+	AllowedLength    int
+	LastN            int
+	Breakers         []int32
+
+	breakers map[int32]bool
+
+	history
+}
+
+// Accept adds token to the sequence. It does nothing for nil d.
+func (d *DRY) Accept(token int32) {
+	if d != nil {
+		d.add(token, d.LastN)
+	}
+}
+
+func (d *DRY) Apply(logits []float64) []float64 {
+	if d.breakers == nil {
+		d.breakers = make(map[int32]bool, len(d.Breakers))
+		for _, token := range d.Breakers {
+			d.breakers[token] = true
+		}
+	}
+
+	tokens := d.last(d.LastN)
+	n := len(tokens)
+	if n <= d.AllowedLength {
+		return logits
+	}
+
+	// repeated sequences are limited to the tokens after the last breaker
+	limit := n
+	for i := n - 1; i >= 0; i-- {
+		if d.breakers[tokens[i]] {
+			limit = n - 1 - i
+			break
+		}
+	}
+
+	if limit < d.AllowedLength {
+		return logits
+	}
+
+	// z[k] is the length of the longest common suffix of tokens and
+	// tokens[:n-k], computed with the Z-algorithm on the reversed tokens
+	z := make([]int, n)
+	at := func(i int) int32 { return tokens[n-1-i] }
+	for k, l, r := 1, 0, 0; k < n; k++ {
+		if k < r {
+			z[k] = min(r-k, z[k-l])
+		}
+
+		for k+z[k] < n && at(z[k]) == at(k+z[k]) {
+			z[k]++
+		}
+
+		if k+z[k] > r {
+			l, r = k, k+z[k]
+		}
+	}
+
+	// the longest repeated sequence that each token would extend
+	lengths := make(map[int32]int)
+	for k := 1; k < n; k++ {
+		if length := min(z[k], limit); length >= d.AllowedLength {
+			next := tokens[n-k]
+			lengths[next] = max(lengths[next], length)
+		}
+	}
+
+	// keep the penalty finite
+	maxExponent := math.MaxInt
+	if d.Base > 1 {
+		maxExponent = int(math.Log(math.MaxFloat32) / math.Log(d.Base))
+	}
+
+	for token, length := range lengths {
+		if token < 0 || int(token) >= len(logits) || d.breakers[token] {
+			continue
+		}
+
+		logits[token] -= d.Multiplier * math.Pow(d.Base, float64(min(length-d.AllowedLength, maxExponent)))
+	}
+
+	return logits
+}
+
+// SequenceBreakers returns the tokens of v whose text contains any of
+// breakers, for DRY
+func (v *Vocabulary) SequenceBreakers(breakers []string) []int32 {
+	var tokens []int32
+	for i, p := range v.pieces {
+		for _, breaker := range breakers {
+			if breaker != "" && strings.Contains(p.text, breaker) {
+				tokens = append(tokens, int32(i))
+				break
+			}
+		}
+	}
+
+	return tokens
+}
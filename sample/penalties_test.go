@@ -0,0 +1,166 @@
+package sample
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPenalties(t *testing.T) {
+	p := &Penalties{LastN: 4, Presence: 0.5, Frequency: 0.25}
+	for _, token := range []int32{2, 2, 5, 1, 2} {
+		p.Accept(token)
+	}
+
+	// only the last 4 tokens count: token 2 occurs twice and token 1 once,
+	// while token 5 is out of range
+	got := p.Apply([]float64{0, 1, 2, math.Inf(-1)})
+	want := []float64{0, 0.25, 1, math.Inf(-1)}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("logits mismatch (-want +got):\n%s", diff)
+	}
+
+	// a nil transform ignores the tokens of the prompt
+	var nilPenalties *Penalties
+	nilPenalties.Accept(1)
+}
+
+func TestDRY(t *testing.T) {
+	const a, b, c, y = 0, 1, 2, 3
+	tokens := []int32{a, b, c, c, b, c, y, a, b, c}
+
+	for _, tt := range []struct {
+		name string
+		dry  DRY
+		want []float64
+	}{
+		{
+			// "a b c" is followed by c and "b c" by y, while "c" is too
+			// short to be penalized when it is followed by b
+			name: "repeats",
+			dry:  DRY{Multiplier: 1, Base: 2, AllowedLength: 2, LastN: 64},
+			want: []float64{0, 0, -2, -1, 0},
+		},
+		{
+			name: "multiplier",
+			dry:  DRY{Multiplier: 0.5, Base: 3, AllowedLength: 1, LastN: 64},
+			want: []float64{0, -0.5, -4.5, -1.5, 0},
+		},
+		{
+			// breakers aren't penalized
+			name: "breaker",
+			dry:  DRY{Multiplier: 1, Base: 2, AllowedLength: 2, LastN: 64, Breakers: []int32{y}},
+			want: []float64{0, 0, -2, 0, 0},
+		},
+		{
+			// the sequence after the last breaker is too short
+			name: "recent breaker",
+			dry:  DRY{Multiplier: 1, Base: 2, AllowedLength: 2, LastN: 64, Breakers: []int32{b}},
+			want: []float64{0, 0, 0, 0, 0},
+		},
+		{
+			// "c c b" and "y a b" don't repeat
+			name: "window",
+			dry:  DRY{Multiplier: 1, Base: 2, AllowedLength: 2, LastN: 4},
+			want: []float64{0, 0, 0, 0, 0},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, token := range tokens {
+				tt.dry.Accept(token)
+			}
+
+			got := tt.dry.Apply(make([]float64, 5))
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("logits mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// the penalty stays finite for long repeats with a large base
+	d := &DRY{Multiplier: 1, Base: 1e10, AllowedLength: 2, LastN: 64}
+	for range 8 {
+		d.Accept(a)
+	}
+
+	if got := d.Apply(make([]float64, 1)); got[0] != -1e30 {
+		t.Errorf("have logit %v; want -1e30", got[0])
+	}
+}
+
+func TestNewSamplerPenalties(t *testing.T) {
+	logits := []float32{1, 0.5}
+	for _, tt := range []struct {
+		name   string
+		prompt []int32
+		want   []int32
+	}{
+		{"no prompt", nil, []int32{0, 1, 0, 1}},
+		{"prompt", []int32{0}, []int32{1, 0, 1, 0}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Penalties{LastN: 64, Frequency: 1}
+			for _, token := range tt.prompt {
+				p.Accept(token)
+			}
+
+			s, err := NewSampler(0, 0, 0, 0, 0, nil, p, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int32
+			for range tt.want {
+				token, err := s.Sample(slices.Clone(logits))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got = append(got, token)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("tokens mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// DRY stops greedy sampling from repeating itself
+	d := &DRY{Multiplier: 2, Base: 1.75, AllowedLength: 2, LastN: 64}
+	s, err := NewSampler(0, 0, 0, 0, 0, nil, nil, d, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// token i is most likely after token i-1 and token 0 after token 2
+	var got []int32
+	last := int32(2)
+	for range 7 {
+		logits := []float32{0, 0, 0, 0}
+		logits[(last+1)%3] = 1
+		token, err := s.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, token)
+		last = token
+	}
+
+	// the second "0 1" isn't followed by 2, whose logit drops to -1, but by
+	// the first of the tokens left
+	if want := []int32{0, 1, 2, 0, 1, 0, 1}; !slices.Equal(got, want) {
+		t.Errorf("have tokens %v; want %v", got, want)
+	}
+}
+
+func TestSequenceBreakers(t *testing.T) {
+	v := NewVocabulary([]string{"a", ":", "b\n", "\"x", "c", "*"}, 0)
+
+	got := v.SequenceBreakers([]string{"\n", ":", "\"", ""})
+	if want := []int32{1, 2, 3}; !slices.Equal(got, want) {
+		t.Errorf("have breakers %v; want %v", got, want)
+	}
+}
@@ -3,30 +3,50 @@ package sample
 import (
 	"errors"
 	"math"
-
-	"golang.org/x/exp/rand"
-	"gonum.org/v1/gonum/stat/sampleuv"
+	"math/rand/v2"
 )
 
 type Sampler interface {
 	Sample([]float32) (int32, error)
 }
 
+// accepter is a transform that tracks the tokens sampled, such as a grammar
+type accepter interface {
+	Accept(token int32)
+}
+
+func accept(transforms []Transform, token int32) {
+	for _, t := range transforms {
+		if a, ok := t.(accepter); ok {
+			a.Accept(token)
+		}
+	}
+}
+
 type weighted struct {
-	src        rand.Source
+	rng        *rand.Rand
 	transforms []Transform
 }
 
-// TODO(parthsareen): remove uv sample dependency https://github.com/ollama/ollama/issues/9279
+// Weighted returns a sampler that draws tokens by their probabilities with its
+// own random number generator, seeded with seed or randomly if it is nil. As
+// no other sampler shares the generator, the tokens sampled with a seed only
+// depend on the logits and not on what else is sampled at the same time.
 func Weighted(seed *uint64, transforms ...Transform) Sampler {
-	var src rand.Source
+	var s uint64
 	if seed != nil {
-		src = rand.NewSource(*seed)
+		s = *seed
+	} else {
+		s = rand.Uint64()
 	}
-	return weighted{src: src, transforms: transforms}
+	return weighted{rng: rand.New(rand.NewPCG(s, 0)), transforms: transforms}
 }
 
 func (s weighted) Sample(logits []float32) (int32, error) {
+	// there is exactly one draw for every sample, whatever the logits, so
+	// that the state of the generator only depends on the number of samples
+	r := s.rng.Float64()
+
 	logits64 := make([]float64, len(logits))
 	for i, v := range logits {
 		logits64[i] = float64(v)
@@ -49,12 +69,22 @@ func (s weighted) Sample(logits []float32) (int32, error) {
 		return -1, errors.New("no valid logits found for weighed sampling")
 	}
 
+	// the token at which the cumulative probability, in the order of the
+	// token ids, exceeds the draw. Rounding may leave the sum of all of the
+	// probabilities short of it, in which case that is the last token.
 	probs := softmax(logitsCopy)
-	w := sampleuv.NewWeighted(probs, s.src)
-	if idx, ok := w.Take(); ok {
-		return int32(indices[idx]), nil
+	idx := len(probs) - 1
+	var sum float64
+	for i, p := range probs {
+		sum += p
+		if r < sum {
+			idx = i
+			break
+		}
 	}
-	return -1, errors.New("weighed sampler failed, no valid token found")
+
+	accept(s.transforms, int32(indices[idx]))
+	return int32(indices[idx]), nil
 }
 
 type greedy struct {
@@ -75,8 +105,7 @@ func (s greedy) Sample(logits []float32) (int32, error) {
 		logits64 = t.Apply(logits64)
 	}
 
-	var maxIdx int
-	var maxLogit float64
+	maxIdx, maxLogit := 0, math.Inf(-1)
 	for i, logit := range logits64 {
 		if logit > maxLogit {
 			maxLogit = logit
@@ -88,20 +117,64 @@ func (s greedy) Sample(logits []float32) (int32, error) {
 		return -1, errors.New("no valid logits found for greedy sampling")
 	}
 
+	accept(s.transforms, int32(maxIdx))
 	return int32(maxIdx), nil
 }
 
+// NewSampler returns a sampler with the transforms for the given options, which
+// are disabled by zero values. logitBias, if not empty, applies to the logits
+// before any other transform, followed by penalties and dry if non-nil.
+// grammar, if non-nil, then restricts the tokens sampled, such as one returned
+// by [Grammar.Transform]. logprobs, if non-nil, records the log probabilities
+// of each sample.
+//
+// With a temperature other than 0, a seed greater than 0 samples the same
+// tokens for the same logits, and one of 0 or less a random seed.
+//
 // TODO(parthsareen): update sampler interface to use json unmarshal https://github.com/ollama/ollama/issues/9278
-func NewSampler(temperature float32, topK int, topP float32, minP float32, seed int) (Sampler, error) {
+func NewSampler(temperature float32, topK int, topP float32, minP float32, seed int, logitBias LogitBias, penalties *Penalties, dry *DRY, grammar Transform, logprobs *Logprobs) (Sampler, error) {
 	transforms := []Transform{}
 	if temperature < 0 || temperature > 2 {
 		return nil, errors.New("temperature must be between 0 and 2")
 	}
 
+	if len(logitBias) > 0 {
+		transforms = append(transforms, logitBias)
+	}
+
+	if penalties != nil {
+		transforms = append(transforms, penalties)
+	}
+
+	if dry != nil {
+		transforms = append(transforms, dry)
+	}
+
+	if grammar != nil {
+		transforms = append(transforms, grammar)
+	}
+
+	if logprobs != nil && !logprobs.Temperature {
+		transforms = append(transforms, logprobs)
+	}
+
 	if temperature != 0 {
 		transforms = append(transforms, Temperature(temperature))
 	}
 
+	if logprobs != nil && logprobs.Temperature {
+		transforms = append(transforms, logprobs)
+	}
+
+	// min_p is relative to the probability of the most likely token after
+	// temperature, and applied before top-k and top-p as in llama.cpp
+	if minP != 0 {
+		if minP < 0 || minP >= 1 {
+			return nil, errors.New("minP must be between 0 and 1")
+		}
+		transforms = append(transforms, MinP(minP))
+	}
+
 	if topK != 0 {
 		if topK <= 0 {
 			return nil, errors.New("topK must be greater than 0")
@@ -116,13 +189,6 @@ func NewSampler(temperature float32, topK int, topP float32, minP float32, seed
 		transforms = append(transforms, TopP(topP))
 	}
 
-	if minP != 0 {
-		if minP < 0 || minP >= 1 {
-			return nil, errors.New("minP must be between 0 and 1")
-		}
-		transforms = append(transforms, MinP(minP))
-	}
-
 	if len(transforms) == 0 {
 		return nil, errors.New("at least one transform is required")
 	}
@@ -131,7 +197,7 @@ func NewSampler(temperature float32, topK int, topP float32, minP float32, seed
 		return Greedy(transforms...), nil
 	}
 
-	if seed != 0 {
+	if seed > 0 {
 		seed64 := uint64(seed)
 		return Weighted(&seed64, transforms...), nil
 	}
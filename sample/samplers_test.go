@@ -1,8 +1,10 @@
 package sample
 
 import (
+	"maps"
 	"math"
 	"math/rand/v2"
+	"slices"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -31,12 +33,67 @@ func TestWeighted(t *testing.T) {
 		return
 	}
 	// With seed 42, we expect a consistent sample
-	want = int32(3) // This will be deterministic due to the seed
+	want = int32(2) // This will be deterministic due to the seed
 	if want != got {
 		t.Errorf("index mismatch: want %d, got %d", want, got)
 	}
 }
 
+func TestWeightedSeed(t *testing.T) {
+	logits := []float32{1, 1, 2, 1, 3, float32(math.Inf(-1)), 2, 1}
+
+	sample := func(s Sampler) int32 {
+		t.Helper()
+		got, err := s.Sample(slices.Clone(logits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	seed := uint64(7)
+	var want []int32
+	s := Weighted(&seed, TopK(5), TopP(0.95))
+	for range 64 {
+		want = append(want, sample(s))
+	}
+
+	// samplers of other sequences, with or without a seed, don't change
+	// the tokens of one with the same seed
+	other := uint64(8)
+	var got, different []int32
+	s, s1, s2 := Weighted(&seed, TopK(5), TopP(0.95)), Weighted(&other), Weighted(nil)
+	for range 64 {
+		sample(s1)
+		got = append(got, sample(s))
+		different = append(different, sample(s1))
+		sample(s2)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("sampled tokens mismatch (-want +got):\n%s", diff)
+	}
+
+	if slices.Equal(want, different) {
+		t.Error("expected the tokens of a different seed to differ")
+	}
+
+	// a negative seed, such as the default, is random
+	seen := make(map[int32]bool)
+	for range 16 {
+		s, err := NewSampler(1, 0, 0, 0, -1, nil, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen[sample(s)] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("have tokens %v for random seeds; want several", slices.Sorted(maps.Keys(seen)))
+	}
+}
+
 type testTransform struct {
 	id        int
 	callOrder *[]int
@@ -199,7 +256,7 @@ func TestNewSampler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := NewSampler(tt.temperature, tt.topK, tt.topP, tt.minP, tt.seed)
+			_, err := NewSampler(tt.temperature, tt.topK, tt.topP, tt.minP, tt.seed, nil, nil, nil, nil, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewSampler() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -207,6 +264,94 @@ func TestNewSampler(t *testing.T) {
 	}
 }
 
+func TestNewSamplerMinP(t *testing.T) {
+	logits := []float32{-3, -2, -1, 0, 1, 2, 4, 3}
+
+	// min_p 0.2 keeps tokens 6 and 7, but a temperature of 0.5 is applied
+	// first and halves the relative probability of token 7 to e^-2 ≈ 0.14.
+	// top_p is applied after, to the probabilities of the tokens that min_p
+	// keeps, where token 6 alone has a probability of 0.73.
+	for _, tt := range []struct {
+		name        string
+		temperature float32
+		topP        float32
+		want        []int32
+	}{
+		{"min p", 1, 0, []int32{6, 7}},
+		{"temperature", 0.5, 0, []int32{6}},
+		{"top p", 1, 0.7, []int32{6}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSampler(tt.temperature, 0, tt.topP, 0.2, 42, nil, nil, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			seen := make(map[int32]bool)
+			for range 100 {
+				got, err := s.Sample(slices.Clone(logits))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				seen[got] = true
+			}
+
+			got := slices.Sorted(maps.Keys(seen))
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("sampled tokens mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewSamplerLogitBias(t *testing.T) {
+	logits := []float32{-3, -2, -1, 0, 1, 2, 4, 3}
+
+	for _, tt := range []struct {
+		name      string
+		logitBias LogitBias
+		want      []int32
+	}{
+		{"force", LogitBias{1: 100}, []int32{1}},
+		{"force many", LogitBias{1: 100, 2: 100}, []int32{1, 2}},
+		{"ban", LogitBias{6: -100, 7: -100}, []int32{0, 1, 2, 3, 4, 5}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[int32]bool)
+			for seed := range 200 {
+				// a high temperature samples the other tokens often
+				s, err := NewSampler(2, 0, 0, 0, seed, tt.logitBias, nil, nil, nil, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := s.Sample(slices.Clone(logits))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				seen[got] = true
+			}
+
+			got := slices.Sorted(maps.Keys(seen))
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("sampled tokens mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// the bias applies to greedy sampling too
+	s, err := NewSampler(0, 0, 0, 0, 0, LogitBias{6: -100, 2: 10}, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := s.Sample(slices.Clone(logits)); err != nil || got != 2 {
+		t.Errorf("have token %d, error %v; want 2", got, err)
+	}
+}
+
 func BenchmarkSample(b *testing.B) {
 	transforms := []Transform{
 		Temperature(0.5),
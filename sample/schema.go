@@ -0,0 +1,1136 @@
+package sample
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxAnyOrderProperties is the number of properties up to which the
+// properties of an object can be in any order, as that takes a rule for each
+// subset of them. Larger objects have their properties in the order of the
+// schema.
+const maxAnyOrderProperties = 8
+
+// UnsupportedSchemaError reports a keyword of a JSON schema that
+// SchemaGrammar can't enforce, at the JSON pointer Path
+type UnsupportedSchemaError struct {
+	Path    string
+	Keyword string
+
+	// Reason, if not empty, is why the use of Keyword isn't supported
+	Reason string
+}
+
+func (e *UnsupportedSchemaError) Error() string {
+	s := fmt.Sprintf("unsupported JSON schema keyword %s at %s", e.Keyword, e.Path)
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+
+	return s
+}
+
+// SchemaGrammar compiles a JSON schema into a GBNF grammar that only matches
+// JSON that validates against it. It enforces types, enums and consts, the
+// properties of objects, which are in any order with required properties
+// enforced before the closing brace and no other properties unless
+// additionalProperties allows them, the items of arrays with minItems and
+// maxItems, minLength and maxLength of strings, the formats date, time,
+// date-time and uuid, patterns of strings without lookarounds or
+// backreferences, the ranges of integers, anyOf, oneOf whose alternatives
+// start with different characters, and $ref to $defs or definitions.
+// Annotations such as title and description are ignored.
+//
+// Other keywords, such as patternProperties or the ranges of numbers, can't
+// be enforced and return an *UnsupportedSchemaError rather than a grammar
+// that would allow JSON that doesn't validate.
+func SchemaGrammar(schema []byte) (string, error) {
+	d := json.NewDecoder(bytes.NewReader(schema))
+	d.UseNumber()
+
+	root, err := decodeSchema(d)
+	if err != nil {
+		return "", fmt.Errorf("invalid JSON schema: %w", err)
+	}
+
+	if _, err := d.Token(); !errors.Is(err, io.EOF) {
+		return "", errors.New("invalid JSON schema: unexpected data after the schema")
+	}
+
+	c := schemaCompiler{root: root, defined: make(map[string]bool), refs: make(map[string]string)}
+	c.reserve("root")
+
+	expr, err := c.compile(root, "#", "root")
+	if err != nil {
+		return "", err
+	}
+
+	c.define("root", expr)
+
+	var sb strings.Builder
+	for _, name := range c.names {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+
+	// schemas such as a $ref to itself produce grammars that can't be parsed
+	if _, err := ParseGrammar(sb.String()); err != nil {
+		return "", &UnsupportedSchemaError{Path: "#", Keyword: "$ref", Reason: err.Error()}
+	}
+
+	return sb.String(), nil
+}
+
+// schemaObject is a JSON object of a schema, which keeps the order of its
+// keys for the order of properties
+type schemaObject struct {
+	keys   []string
+	values map[string]any
+}
+
+// decodeSchema decodes the next JSON value of d, with objects as
+// *schemaObject
+func decodeSchema(d *json.Decoder) (any, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		o := &schemaObject{values: make(map[string]any)}
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeSchema(d)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := o.values[key.(string)]; !ok {
+				o.keys = append(o.keys, key.(string))
+			}
+
+			o.values[key.(string)] = value
+		}
+
+		_, err := d.Token()
+		return o, err
+	case json.Delim('['):
+		a := []any{}
+		for d.More() {
+			value, err := decodeSchema(d)
+			if err != nil {
+				return nil, err
+			}
+
+			a = append(a, value)
+		}
+
+		_, err := d.Token()
+		return a, err
+	default:
+		return tok, nil
+	}
+}
+
+// encodeJSON encodes a value decoded by decodeSchema as compact JSON
+func encodeJSON(v any) string {
+	switch v := v.(type) {
+	case *schemaObject:
+		parts := make([]string, len(v.keys))
+		for i, key := range v.keys {
+			parts[i] = encodeJSON(key) + ":" + encodeJSON(v.values[key])
+		}
+
+		return "{" + strings.Join(parts, ",") + "}"
+	case []any:
+		parts := make([]string, len(v))
+		for i, value := range v {
+			parts[i] = encodeJSON(value)
+		}
+
+		return "[" + strings.Join(parts, ",") + "]"
+	default:
+		var b bytes.Buffer
+		e := json.NewEncoder(&b)
+		e.SetEscapeHTML(false)
+		if err := e.Encode(v); err != nil {
+			panic(err)
+		}
+
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+}
+
+// literal quotes s as a literal of a grammar
+func literal(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, `\x%02X`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// schemaKeywords are the keywords that SchemaGrammar enforces or ignores
+var schemaKeywords = map[string]bool{
+	// annotations
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "readOnly": true, "writeOnly": true, "deprecated": true,
+
+	"$defs": true, "definitions": true, "$ref": true,
+	"type": true, "enum": true, "const": true, "anyOf": true, "oneOf": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true,
+	"minLength": true, "maxLength": true, "format": true, "pattern": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+}
+
+// rangeKeywords are the keywords that restrict numbers to a range
+var rangeKeywords = []string{"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum"}
+
+// schemaPrimitives are the rules shared by schemas, with the rules they
+// depend on
+var schemaPrimitives = map[string]struct {
+	rule string
+	deps []string
+}{
+	"space":     {`| " " | "\n" [ \t]{0,20}`, nil},
+	"char":      {`[^"\\\x7F\x00-\x1F] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F]{4} )`, nil},
+	"string":    {`"\"" char* "\""`, []string{"char"}},
+	"integer":   {`"-"? ( [0-9] | [1-9] [0-9]{0,15} )`, nil},
+	"number":    {`integer ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )?`, []string{"integer"}},
+	"boolean":   {`"true" | "false"`, nil},
+	"null":      {`"null"`, nil},
+	"value":     {`object | array | string | number | boolean | null`, []string{"object", "array", "string", "number", "boolean", "null"}},
+	"object":    {`"{" space ( string space ":" space value space ( "," space string space ":" space value space )* )? "}"`, []string{"space", "string", "value"}},
+	"array":     {`"[" space ( value space ( "," space value space )* )? "]"`, []string{"space", "value"}},
+	"date":      {`[0-9]{4} "-" ( "0" [1-9] | "1" [0-2] ) "-" ( "0" [1-9] | [1-2] [0-9] | "3" [0-1] )`, nil},
+	"time":      {`( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] ":" [0-5] [0-9] ( "." [0-9]{3} )? ( "Z" | [+-] ( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] )`, nil},
+	"date-time": {`date "T" time`, []string{"date", "time"}},
+	"uuid":      {`[0-9a-fA-F]{8} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{12}`, nil},
+}
+
+// typeFirst are the characters that JSON of each type starts with
+var typeFirst = map[string]string{
+	"object":  "{",
+	"array":   "[",
+	"string":  `"`,
+	"number":  "-0123456789",
+	"integer": "-0123456789",
+	"boolean": "tf",
+	"null":    "n",
+}
+
+const anyFirst = `{["-0123456789tfn`
+
+type schemaCompiler struct {
+	root any
+
+	// names are the names of the rules in the order they were reserved,
+	// with rules their definitions once compiled
+	names   []string
+	rules   map[string]string
+	defined map[string]bool
+
+	// refs are the names of the rules of the schemas referenced by $ref
+	refs map[string]string
+}
+
+// reserve returns a unique name for a rule based on name, which must be
+// defined later
+func (c *schemaCompiler) reserve(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r > 0x7f || !isWordChar(byte(r)) {
+			return '-'
+		}
+
+		return r
+	}, name)
+
+	unique := name
+	for i := 1; c.defined[unique]; i++ {
+		unique = name + "-" + strconv.Itoa(i)
+	}
+
+	c.defined[unique] = true
+	c.names = append(c.names, unique)
+	return unique
+}
+
+func (c *schemaCompiler) define(name, expr string) {
+	if c.rules == nil {
+		c.rules = make(map[string]string)
+	}
+
+	c.rules[name] = expr
+}
+
+// rule defines a new rule for expr and returns its name
+func (c *schemaCompiler) rule(name, expr string) string {
+	name = c.reserve(name)
+	c.define(name, expr)
+	return name
+}
+
+// primitive defines the shared rule name and those it depends on
+func (c *schemaCompiler) primitive(name string) string {
+	if _, ok := c.rules[name]; !ok {
+		p := schemaPrimitives[name]
+		c.reserve(name)
+		c.define(name, p.rule)
+		for _, dep := range p.deps {
+			c.primitive(dep)
+		}
+	}
+
+	return name
+}
+
+// compile returns an expression of the grammar for schema s at the JSON
+// pointer path, with name the base of the names of any rules it defines
+func (c *schemaCompiler) compile(s any, path, name string) (string, error) {
+	switch s := s.(type) {
+	case bool:
+		if !s {
+			return "", &UnsupportedSchemaError{Path: path, Keyword: "false", Reason: "no JSON validates against it"}
+		}
+
+		return c.primitive("value"), nil
+	case *schemaObject:
+		for _, key := range s.keys {
+			if !schemaKeywords[key] {
+				return "", &UnsupportedSchemaError{Path: path, Keyword: key}
+			}
+		}
+
+		if ref, ok := s.values["$ref"]; ok {
+			for _, key := range s.keys {
+				if key != "$ref" && key != "$defs" && key != "definitions" && !isSchemaAnnotation(key) {
+					return "", &UnsupportedSchemaError{Path: path, Keyword: key, Reason: "alongside $ref"}
+				}
+			}
+
+			ref, ok := ref.(string)
+			if !ok {
+				return "", fmt.Errorf("invalid JSON schema: $ref at %s is not a string", path)
+			}
+
+			return c.ref(ref, path)
+		}
+
+		if v, ok := s.values["const"]; ok {
+			return literal(encodeJSON(v)), nil
+		}
+
+		if v, ok := s.values["enum"]; ok {
+			values, ok := v.([]any)
+			if !ok || len(values) == 0 {
+				return "", fmt.Errorf("invalid JSON schema: enum at %s is not a non-empty array", path)
+			}
+
+			alts := make([]string, len(values))
+			for i, value := range values {
+				alts[i] = literal(encodeJSON(value))
+			}
+
+			return "( " + strings.Join(alts, " | ") + " )", nil
+		}
+
+		for _, keyword := range []string{"anyOf", "oneOf"} {
+			if v, ok := s.values[keyword]; ok {
+				return c.alternatives(s, v, keyword, path, name)
+			}
+		}
+
+		var types []any
+		switch t := s.values["type"].(type) {
+		case nil:
+			switch {
+			case s.values["properties"] != nil || s.values["additionalProperties"] != nil || s.values["required"] != nil:
+				types = []any{"object"}
+			case s.values["items"] != nil || s.values["minItems"] != nil || s.values["maxItems"] != nil:
+				types = []any{"array"}
+			default:
+				// keywords of strings and numbers only apply to values of
+				// their type, which the grammar can't tell apart
+				for _, key := range append([]string{"pattern"}, rangeKeywords...) {
+					if _, ok := s.values[key]; ok {
+						return "", &UnsupportedSchemaError{Path: path, Keyword: key, Reason: "without a type"}
+					}
+				}
+
+				return c.primitive("value"), nil
+			}
+		case string:
+			types = []any{t}
+		case []any:
+			types = t
+		default:
+			return "", fmt.Errorf("invalid JSON schema: type at %s is not a string or array", path)
+		}
+
+		alts := make([]string, len(types))
+		for i, t := range types {
+			t, _ := t.(string)
+
+			var err error
+			switch t {
+			case "object":
+				alts[i], err = c.object(s, path, name)
+			case "array":
+				alts[i], err = c.array(s, path, name)
+			case "string":
+				alts[i], err = c.string(s, path)
+			case "integer":
+				alts[i], err = c.integer(s, path)
+			case "number":
+				for _, key := range rangeKeywords {
+					if _, ok := s.values[key]; ok {
+						return "", &UnsupportedSchemaError{Path: path, Keyword: key, Reason: "only integers can be restricted to a range"}
+					}
+				}
+
+				alts[i] = c.primitive(t)
+			case "boolean", "null":
+				alts[i] = c.primitive(t)
+			default:
+				return "", fmt.Errorf("invalid JSON schema: unknown type %q at %s", t, path)
+			}
+
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if len(alts) == 1 {
+			return alts[0], nil
+		}
+
+		return "( " + strings.Join(alts, " | ") + " )", nil
+	default:
+		return "", fmt.Errorf("invalid JSON schema: %s is not an object or boolean", path)
+	}
+}
+
+func isSchemaAnnotation(key string) bool {
+	switch key {
+	case "$schema", "$id", "$comment", "title", "description", "default", "examples", "readOnly", "writeOnly", "deprecated":
+		return true
+	default:
+		return false
+	}
+}
+
+// ref returns the name of the rule for the schema referenced by ref, which
+// is defined when first referenced so that schemas can be recursive
+func (c *schemaCompiler) ref(ref, path string) (string, error) {
+	if ref == "#" {
+		return "root", nil
+	}
+
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+
+	var defs string
+	switch {
+	case strings.HasPrefix(ref, "#/$defs/"):
+		defs = "$defs"
+	case strings.HasPrefix(ref, "#/definitions/"):
+		defs = "definitions"
+	default:
+		return "", &UnsupportedSchemaError{Path: path, Keyword: "$ref", Reason: fmt.Sprintf("only references to $defs or definitions are supported, not %q", ref)}
+	}
+
+	key := strings.NewReplacer("~1", "/", "~0", "~").Replace(strings.TrimPrefix(ref, "#/"+defs+"/"))
+
+	var target any
+	if root, ok := c.root.(*schemaObject); ok {
+		if defs, ok := root.values[defs].(*schemaObject); ok {
+			target = defs.values[key]
+		}
+	}
+
+	if target == nil {
+		return "", fmt.Errorf("invalid JSON schema: undefined $ref %q at %s", ref, path)
+	}
+
+	name := c.reserve("def-" + key)
+	c.refs[ref] = name
+
+	expr, err := c.compile(target, ref, name)
+	if err != nil {
+		return "", err
+	}
+
+	c.define(name, expr)
+	return name, nil
+}
+
+// alternatives compiles anyOf or oneOf, the schemas v, which for oneOf must
+// start with different characters so that at most one of them matches
+func (c *schemaCompiler) alternatives(s *schemaObject, v any, keyword, path, name string) (string, error) {
+	for _, key := range s.keys {
+		if key != keyword && key != "$defs" && key != "definitions" && !isSchemaAnnotation(key) {
+			return "", &UnsupportedSchemaError{Path: path, Keyword: key, Reason: "alongside " + keyword}
+		}
+	}
+
+	schemas, ok := v.([]any)
+	if !ok || len(schemas) == 0 {
+		return "", fmt.Errorf("invalid JSON schema: %s at %s is not a non-empty array", keyword, path)
+	}
+
+	var first string
+	alts := make([]string, len(schemas))
+	for i, schema := range schemas {
+		if keyword == "oneOf" {
+			f := c.first(schema, make(map[string]bool))
+			if strings.ContainsAny(first, f) {
+				return "", &UnsupportedSchemaError{Path: path, Keyword: keyword, Reason: "alternatives start with the same character"}
+			}
+
+			first += f
+		}
+
+		expr, err := c.compile(schema, fmt.Sprintf("%s/%s/%d", path, keyword, i), fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			return "", err
+		}
+
+		alts[i] = expr
+	}
+
+	return "( " + strings.Join(alts, " | ") + " )", nil
+}
+
+// first returns the characters that JSON validating against s can start
+// with, following references that haven't been seen
+func (c *schemaCompiler) first(s any, seen map[string]bool) string {
+	o, ok := s.(*schemaObject)
+	if !ok {
+		if s == false {
+			return ""
+		}
+
+		return anyFirst
+	}
+
+	if ref, ok := o.values["$ref"].(string); ok {
+		if seen[ref] {
+			return anyFirst
+		}
+
+		seen[ref] = true
+
+		var target any = c.root
+		if ref != "#" {
+			target = nil
+			for _, keyword := range []string{"$defs", "definitions"} {
+				root, _ := c.root.(*schemaObject)
+				if root == nil || !strings.HasPrefix(ref, "#/"+keyword+"/") {
+					continue
+				}
+
+				if defs, ok := root.values[keyword].(*schemaObject); ok {
+					key := strings.NewReplacer("~1", "/", "~0", "~").Replace(strings.TrimPrefix(ref, "#/"+keyword+"/"))
+					target = defs.values[key]
+				}
+			}
+
+			if target == nil {
+				return anyFirst
+			}
+		}
+
+		return c.first(target, seen)
+	}
+
+	if v, ok := o.values["const"]; ok {
+		return encodeJSON(v)[:1]
+	}
+
+	var first string
+	if values, ok := o.values["enum"].([]any); ok {
+		for _, v := range values {
+			first += encodeJSON(v)[:1]
+		}
+
+		return first
+	}
+
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		if schemas, ok := o.values[keyword].([]any); ok {
+			for _, schema := range schemas {
+				first += c.first(schema, seen)
+			}
+
+			return first
+		}
+	}
+
+	switch t := o.values["type"].(type) {
+	case string:
+		return typeFirst[t]
+	case []any:
+		for _, t := range t {
+			if t, ok := t.(string); ok {
+				first += typeFirst[t]
+			}
+		}
+
+		return first
+	}
+
+	switch {
+	case o.values["properties"] != nil || o.values["additionalProperties"] != nil || o.values["required"] != nil:
+		return "{"
+	case o.values["items"] != nil || o.values["minItems"] != nil || o.values["maxItems"] != nil:
+		return "["
+	default:
+		return anyFirst
+	}
+}
+
+// count returns the non-negative integer keyword of s, or def if it isn't set
+func count(s *schemaObject, keyword, path string, def int) (int, error) {
+	v, ok := s.values[keyword]
+	if !ok {
+		return def, nil
+	}
+
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil && i >= 0 {
+			return int(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid JSON schema: %s at %s is not a non-negative integer", keyword, path)
+}
+
+// repeat repeats the expression expr from min to max times, or any number of
+// times more than min if max is negative
+func repeat(expr string, min, max int) string {
+	switch {
+	case max == 0:
+		return ""
+	case min == 0 && max < 0:
+		return expr + "*"
+	case min == 1 && max < 0:
+		return expr + "+"
+	case max < 0:
+		return fmt.Sprintf("%s{%d,}", expr, min)
+	case min == 0 && max == 1:
+		return expr + "?"
+	case min == max:
+		return fmt.Sprintf("%s{%d}", expr, min)
+	default:
+		return fmt.Sprintf("%s{%d,%d}", expr, min, max)
+	}
+}
+
+func (c *schemaCompiler) string(s *schemaObject, path string) (string, error) {
+	if v, ok := s.values["pattern"]; ok {
+		pattern, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("invalid JSON schema: pattern at %s is not a string", path)
+		}
+
+		for _, key := range []string{"format", "minLength", "maxLength"} {
+			if _, ok := s.values[key]; ok {
+				return "", &UnsupportedSchemaError{Path: path, Keyword: key, Reason: "alongside pattern"}
+			}
+		}
+
+		return c.pattern(pattern, path)
+	}
+
+	switch format, _ := s.values["format"].(string); format {
+	case "date", "time", "date-time", "uuid":
+		return `"\"" ` + c.primitive(format) + ` "\""`, nil
+	}
+
+	min, err := count(s, "minLength", path, 0)
+	if err != nil {
+		return "", err
+	}
+
+	max, err := count(s, "maxLength", path, -1)
+	if err != nil {
+		return "", err
+	}
+
+	if min == 0 && max < 0 {
+		return c.primitive("string"), nil
+	}
+
+	if max >= 0 && max < min {
+		return "", &UnsupportedSchemaError{Path: path, Keyword: "maxLength", Reason: "it is less than minLength"}
+	}
+
+	return strings.TrimSpace(`"\"" ` + repeat(c.primitive("char"), min, max) + ` "\""`), nil
+}
+
+// maxIntegerDigits is the number of digits of the largest integers that the
+// integer rule matches
+const maxIntegerDigits = 16
+
+// integer returns an expression for the integers in the range of minimum,
+// maximum, exclusiveMinimum and exclusiveMaximum of s
+func (c *schemaCompiler) integer(s *schemaObject, path string) (string, error) {
+	var lo, hi *int64
+	var hiKey string
+	for _, key := range rangeKeywords {
+		v, ok := s.values[key]
+		if !ok {
+			continue
+		}
+
+		// exclusiveMinimum and exclusiveMaximum are booleans that make
+		// minimum and maximum exclusive before draft 6
+		if _, ok := v.(bool); ok && strings.HasPrefix(key, "exclusive") {
+			continue
+		}
+
+		n, ok := v.(json.Number)
+		if !ok {
+			return "", fmt.Errorf("invalid JSON schema: %s at %s is not a number", key, path)
+		}
+
+		f, err := n.Float64()
+		if err != nil || math.Abs(f) >= math.Pow10(maxIntegerDigits) {
+			return "", &UnsupportedSchemaError{Path: path, Keyword: key, Reason: fmt.Sprintf("only bounds of up to %d digits are supported", maxIntegerDigits)}
+		}
+
+		exclusive := strings.HasPrefix(key, "exclusive")
+		if b, ok := s.values["exclusive"+strings.ToUpper(key[:1])+key[1:]].(bool); ok && b {
+			exclusive = true
+		}
+
+		switch key {
+		case "minimum", "exclusiveMinimum":
+			bound := int64(math.Ceil(f))
+			if exclusive && float64(bound) == f {
+				bound++
+			}
+
+			if lo == nil || bound > *lo {
+				lo = &bound
+			}
+		default:
+			bound := int64(math.Floor(f))
+			if exclusive && float64(bound) == f {
+				bound--
+			}
+
+			if hi == nil || bound < *hi {
+				hi, hiKey = &bound, key
+			}
+		}
+	}
+
+	if lo == nil && hi == nil {
+		return c.primitive("integer"), nil
+	}
+
+	if lo != nil && hi != nil && *hi < *lo {
+		return "", &UnsupportedSchemaError{Path: path, Keyword: hiKey, Reason: "no integers are in the range"}
+	}
+
+	var alts []string
+
+	// negative integers as "-" and their absolute value
+	if lo == nil || *lo < 0 {
+		var max *uint64
+		if lo != nil {
+			v := uint64(-*lo)
+			max = &v
+		}
+
+		min := uint64(1)
+		if hi != nil && *hi < 0 {
+			min = uint64(-*hi)
+		}
+
+		alts = append(alts, `"-" `+naturals(min, max))
+	}
+
+	if hi == nil || *hi >= 0 {
+		var min uint64
+		if lo != nil && *lo > 0 {
+			min = uint64(*lo)
+		}
+
+		var max *uint64
+		if hi != nil {
+			v := uint64(*hi)
+			max = &v
+		}
+
+		alts = append(alts, naturals(min, max))
+	}
+
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+
+	return "( " + strings.Join(alts, " | ") + " )", nil
+}
+
+// naturals returns an expression for the integers from min to max without
+// leading zeros, or up to those of maxIntegerDigits digits if max is nil
+func naturals(min uint64, max *uint64) string {
+	lo := strconv.FormatUint(min, 10)
+	if max == nil {
+		expr := digitRange(lo, strings.Repeat("9", len(lo)))
+		if len(lo) < maxIntegerDigits {
+			expr = "( " + expr + " | [1-9] " + repeat("[0-9]", len(lo), maxIntegerDigits-1) + " )"
+		}
+
+		return expr
+	}
+
+	hi := strconv.FormatUint(*max, 10)
+
+	var alts []string
+	for n := len(lo); n <= len(hi); n++ {
+		// the integers of n digits in the range
+		a, b := strings.Repeat("0", n), strings.Repeat("9", n)
+		if n > 1 {
+			a = "1" + a[1:]
+		}
+
+		if n == len(lo) {
+			a = lo
+		}
+
+		if n == len(hi) {
+			b = hi
+		}
+
+		alts = append(alts, digitRange(a, b))
+	}
+
+	if len(alts) == 1 {
+		return alts[0]
+	}
+
+	return "( " + strings.Join(alts, " | ") + " )"
+}
+
+// digitRange returns an expression for the strings of digits from a to b,
+// which have the same length
+func digitRange(a, b string) string {
+	i := 0
+	for i < len(a) && a[i] == b[i] {
+		i++
+	}
+
+	var prefix string
+	if i > 0 {
+		prefix = literal(a[:i]) + " "
+	}
+
+	if i == len(a) {
+		return strings.TrimSpace(prefix)
+	}
+
+	a, b = a[i:], b[i:]
+	rest := len(a) - 1
+	digits := func(lo, hi byte, n int) string {
+		s := literal(string(lo))
+		if hi > lo {
+			s = fmt.Sprintf("[%c-%c]", lo, hi)
+		}
+
+		switch {
+		case n == 1:
+			s += " [0-9]"
+		case n > 1:
+			s += " " + repeat("[0-9]", n, n)
+		}
+
+		return s
+	}
+
+	// the strings that start with a[0], those that start with the digits
+	// between a[0] and b[0], and those that start with b[0]
+	var alts []string
+	first, last := a[0], b[0]
+	if strings.Trim(a[1:], "0") != "" {
+		alts = append(alts, literal(a[:1])+" "+digitRange(a[1:], strings.Repeat("9", rest)))
+		first++
+	}
+
+	hiAll := strings.Trim(b[1:], "9") == ""
+	if !hiAll {
+		last--
+	}
+
+	if first <= last {
+		alts = append(alts, digits(first, last, rest))
+	}
+
+	if !hiAll {
+		alts = append(alts, literal(b[:1])+" "+digitRange(strings.Repeat("0", rest), b[1:]))
+	}
+
+	if len(alts) == 1 {
+		return prefix + alts[0]
+	}
+
+	return prefix + "( " + strings.Join(alts, " | ") + " )"
+}
+
+func (c *schemaCompiler) array(s *schemaObject, path, name string) (string, error) {
+	min, err := count(s, "minItems", path, 0)
+	if err != nil {
+		return "", err
+	}
+
+	max, err := count(s, "maxItems", path, -1)
+	if err != nil {
+		return "", err
+	}
+
+	if max >= 0 && max < min {
+		return "", &UnsupportedSchemaError{Path: path, Keyword: "maxItems", Reason: "it is less than minItems"}
+	}
+
+	item := c.primitive("value")
+	switch items := s.values["items"].(type) {
+	case nil, bool:
+		if items == false {
+			max = 0
+		}
+	default:
+		expr, err := c.compile(items, path+"/items", name+"-item")
+		if err != nil {
+			return "", err
+		}
+
+		item = c.rule(name+"-item", expr)
+	}
+
+	space := c.primitive("space")
+	switch {
+	case max == 0 && min > 0:
+		return "", &UnsupportedSchemaError{Path: path, Keyword: "minItems", Reason: "no items are allowed"}
+	case max == 0:
+		return `"[" ` + space + ` "]"`, nil
+	case min == 0:
+		rest := repeat(`( "," `+space+` `+item+` `+space+` )`, 0, max-1)
+		if max < 0 {
+			rest = repeat(`( "," `+space+` `+item+` `+space+` )`, 0, -1)
+		}
+
+		return `"[" ` + space + ` ( ` + item + ` ` + space + ` ` + rest + ` )? "]"`, nil
+	default:
+		rest := repeat(`( "," `+space+` `+item+` `+space+` )`, min-1, max-1)
+		if max < 0 {
+			rest = repeat(`( "," `+space+` `+item+` `+space+` )`, min-1, -1)
+		}
+
+		return `"[" ` + space + ` ` + item + ` ` + space + ` ` + rest + ` "]"`, nil
+	}
+}
+
+func (c *schemaCompiler) object(s *schemaObject, path, name string) (string, error) {
+	space := c.primitive("space")
+
+	props, _ := s.values["properties"].(*schemaObject)
+	if _, ok := s.values["properties"]; ok && props == nil {
+		return "", fmt.Errorf("invalid JSON schema: properties at %s is not an object", path)
+	}
+
+	// additional properties are only allowed if the schema allows them, and
+	// objects without properties allow any
+	var extra string
+	switch additional := s.values["additionalProperties"].(type) {
+	case nil:
+		if props == nil || len(props.keys) == 0 {
+			if _, ok := s.values["required"]; !ok {
+				return c.primitive("object"), nil
+			}
+
+			extra = c.primitive("value")
+		}
+	case bool:
+		if additional {
+			extra = c.primitive("value")
+		}
+	default:
+		expr, err := c.compile(additional, path+"/additionalProperties", name+"-additional")
+		if err != nil {
+			return "", err
+		}
+
+		extra = c.rule(name+"-additional", expr)
+	}
+
+	if extra != "" {
+		extra = c.rule(name+"-additional-kv", c.primitive("string")+` `+space+` ":" `+space+` `+extra+` `+space)
+	}
+
+	var keys []string
+	if props != nil {
+		keys = props.keys
+	}
+
+	var required uint64
+	if v, ok := s.values["required"]; ok {
+		names, ok := v.([]any)
+		if !ok {
+			return "", fmt.Errorf("invalid JSON schema: required at %s is not an array", path)
+		}
+
+		for _, n := range names {
+			n, ok := n.(string)
+			if !ok {
+				return "", fmt.Errorf("invalid JSON schema: required at %s is not an array of strings", path)
+			}
+
+			i := slices.Index(keys, n)
+			if i < 0 {
+				return "", &UnsupportedSchemaError{Path: path, Keyword: "required", Reason: fmt.Sprintf("property %q isn't in properties", n)}
+			}
+
+			required |= 1 << i
+		}
+	}
+
+	kvs := make([]string, len(keys))
+	for i, key := range keys {
+		propName := name + "-" + key
+		expr, err := c.compile(props.values[key], path+"/properties/"+strings.NewReplacer("~", "~0", "/", "~1").Replace(key), propName)
+		if err != nil {
+			return "", err
+		}
+
+		value := c.rule(propName, expr)
+		kvs[i] = c.rule(propName+"-kv", literal(encodeJSON(key))+` `+space+` ":" `+space+` `+value+` `+space)
+	}
+
+	separator := `"," ` + space + ` `
+
+	var start string
+	if len(keys) <= maxAnyOrderProperties {
+		start = c.anyOrder(name, kvs, required, extra, separator)
+	} else {
+		start = c.fixedOrder(name, kvs, required, extra, separator)
+	}
+
+	return `"{" ` + space + ` ` + start + ` "}"`, nil
+}
+
+// anyOrder defines a rule for each subset of the properties kvs that have
+// been matched, where each property can follow in any order and the object
+// can only end after the required properties, and returns the first
+func (c *schemaCompiler) anyOrder(name string, kvs []string, required uint64, extra, separator string) string {
+	rules := make(map[uint64]string)
+
+	// state returns the rule that follows the properties of mask, or those
+	// before the first if first is true
+	var state func(mask uint64, first bool) string
+	state = func(mask uint64, first bool) string {
+		key := mask << 1
+		if first {
+			key |= 1
+		}
+
+		if rule, ok := rules[key]; ok {
+			return rule
+		}
+
+		rule := c.reserve(fmt.Sprintf("%s-%d", name, bits.OnesCount64(mask)))
+		rules[key] = rule
+
+		sep := separator
+		if first {
+			sep = ""
+		}
+
+		var alts []string
+		if mask&required == required {
+			alts = append(alts, `""`)
+		}
+
+		for i, kv := range kvs {
+			if mask&(1<<i) == 0 {
+				alts = append(alts, sep+kv+" "+state(mask|1<<i, false))
+			}
+		}
+
+		if extra != "" {
+			alts = append(alts, sep+extra+" "+state(mask, false))
+		}
+
+		c.define(rule, strings.Join(alts, " | "))
+		return rule
+	}
+
+	return state(0, true)
+}
+
+// fixedOrder is like anyOrder but only in the order of kvs, which takes a
+// rule for each property rather than each subset of them
+func (c *schemaCompiler) fixedOrder(name string, kvs []string, required uint64, extra, separator string) string {
+	// after[i] follows the ith property, or the first properties that
+	// were skipped, and start[i] precedes it if no property has matched
+	after, start := make([]string, len(kvs)+1), make([]string, len(kvs)+1)
+	for i := range after {
+		after[i] = c.reserve(fmt.Sprintf("%s-after-%d", name, i))
+		start[i] = c.reserve(fmt.Sprintf("%s-start-%d", name, i))
+	}
+
+	n := len(kvs)
+	if extra != "" {
+		c.define(after[n], `"" | `+separator+extra+" "+after[n])
+		c.define(start[n], `"" | `+extra+" "+after[n])
+	} else {
+		c.define(after[n], `""`)
+		c.define(start[n], `""`)
+	}
+
+	for i := n - 1; i >= 0; i-- {
+		a := []string{separator + kvs[i] + " " + after[i+1]}
+		s := []string{kvs[i] + " " + after[i+1]}
+		if required&(1<<i) == 0 {
+			a = append(a, after[i+1])
+			s = append(s, start[i+1])
+		}
+
+		c.define(after[i], strings.Join(a, " | "))
+		c.define(start[i], strings.Join(s, " | "))
+	}
+
+	return start[0]
+}
@@ -0,0 +1,344 @@
+package sample
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSchemaGrammar(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		schema string
+		match  map[string]bool
+	}{
+		{
+			name:   "object",
+			schema: `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}}, "required": ["name"]}`,
+			match: map[string]bool{
+				`{"name": "a", "age": 1}`:          true,
+				`{"age": 1, "name": "a"}`:          true,
+				"{\n  \"name\": \"a\"\n}":          true,
+				`{"name":"a"}`:                     true,
+				`{"age": 1}`:                       false,
+				`{}`:                               false,
+				`{"name": "a", "name": "b"}`:       false,
+				`{"name": "a", "other": 1}`:        false,
+				`{"name": 1}`:                      false,
+				`{"name": "a", "age": 1.5}`:        false,
+				`{"name": "a",}`:                   false,
+				`{"name": "a"} `:                   false,
+				`{"name": "a", "age": 1, "x": []}`: false,
+			},
+		},
+		{
+			name:   "additional properties",
+			schema: `{"properties": {"a": {"type": "boolean"}}, "additionalProperties": {"type": "null"}}`,
+			match: map[string]bool{
+				`{}`:                                true,
+				`{"x": null}`:                       true,
+				`{"x": null, "a": true, "y": null}`: true,
+				`{"a": false}`:                      true,
+				`{"x": 1}`:                          false,
+			},
+		},
+		{
+			name:   "nested",
+			schema: `{"type": "object", "properties": {"user": {"type": "object", "properties": {"id": {"type": "integer"}, "tags": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 2}}, "required": ["id", "tags"]}}, "required": ["user"]}`,
+			match: map[string]bool{
+				`{"user": {"id": 1, "tags": ["a"]}}`:           true,
+				`{"user": {"tags": ["a", "b"], "id": -2}}`:     true,
+				`{"user": {"id": 1, "tags": []}}`:              false,
+				`{"user": {"id": 1, "tags": ["a", "b", "c"]}}`: false,
+				`{"user": {"id": 1}}`:                          false,
+				`{"user": {"id": 1, "tags": [1]}}`:             false,
+			},
+		},
+		{
+			name:   "enum",
+			schema: `{"type": "string", "enum": ["red", "green", "a \"b\""]}`,
+			match: map[string]bool{
+				`"red"`:     true,
+				`"green"`:   true,
+				`"a \"b\""`: true,
+				`"blue"`:    false,
+				`"re"`:      false,
+				`"redd"`:    false,
+				`red`:       false,
+			},
+		},
+		{
+			name:   "const",
+			schema: `{"const": {"a": [1, "x"]}}`,
+			match: map[string]bool{
+				`{"a":[1,"x"]}`:   true,
+				`{"a": [1, "x"]}`: false,
+			},
+		},
+		{
+			name:   "types",
+			schema: `{"type": ["number", "boolean", "null"]}`,
+			match: map[string]bool{
+				`1.5e3`: true,
+				`-0`:    true,
+				`true`:  true,
+				`null`:  true,
+				`01`:    false,
+				`"1"`:   false,
+			},
+		},
+		{
+			name:   "string length",
+			schema: `{"type": "string", "minLength": 1, "maxLength": 3}`,
+			match: map[string]bool{
+				`"a"`:    true,
+				`"é\n"`:  true,
+				`"abc"`:  true,
+				`""`:     false,
+				`"abcd"`: false,
+			},
+		},
+		{
+			name:   "pattern",
+			schema: `{"type": "object", "properties": {"id": {"type": "string", "pattern": "^[A-Z]{2}-\\d+$"}}, "required": ["id"]}`,
+			match: map[string]bool{
+				`{"id": "AB-12"}`: true,
+				`{"id": "AB-"}`:   false,
+				`{"id": "ab-12"}`: false,
+			},
+		},
+		{
+			name:   "integer range",
+			schema: `{"type": ["integer", "null"], "minimum": -5, "exclusiveMaximum": 120}`,
+			match: map[string]bool{
+				`-5`:   true,
+				`0`:    true,
+				`119`:  true,
+				`null`: true,
+				`-6`:   false,
+				`120`:  false,
+				`-0`:   false,
+				`007`:  false,
+				`1.5`:  false,
+			},
+		},
+		{
+			name:   "format",
+			schema: `{"type": "array", "items": {"type": "string", "format": "date-time"}}`,
+			match: map[string]bool{
+				`[]`:                                true,
+				`["2024-01-31T12:00:00Z"]`:          true,
+				`["2024-01-31T12:00:00.123+02:00"]`: true,
+				`["2024-13-01T12:00:00Z"]`:          false,
+				`["2024-01-31"]`:                    false,
+			},
+		},
+		{
+			name:   "oneOf",
+			schema: `{"oneOf": [{"type": "string"}, {"type": "integer"}, {"enum": [true]}]}`,
+			match: map[string]bool{
+				`"a"`:   true,
+				`1`:     true,
+				`true`:  true,
+				`false`: false,
+			},
+		},
+		{
+			name:   "ref",
+			schema: `{"$defs": {"node": {"type": "object", "properties": {"value": {"type": "integer"}, "next": {"anyOf": [{"$ref": "#/$defs/node"}, {"type": "null"}]}}, "required": ["value", "next"]}}, "$ref": "#/$defs/node"}`,
+			match: map[string]bool{
+				`{"value": 1, "next": null}`:                       true,
+				`{"value": 1, "next": {"value": 2, "next": null}}`: true,
+				`{"value": 1, "next": {"value": 2}}`:               false,
+			},
+		},
+		{
+			name:   "fixed order",
+			schema: `{"properties": {"a": {}, "b": {}, "c": {}, "d": {}, "e": {}, "f": {}, "g": {}, "h": {}, "i": {"type": "integer"}}, "required": ["b", "i"]}`,
+			match: map[string]bool{
+				`{"b": 1, "i": 2}`:          true,
+				`{"a": 1, "b": [], "i": 2}`: true,
+				`{"i": 2, "b": 1}`:          false,
+				`{"b": 1}`:                  false,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := SchemaGrammar([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			g, err := ParseGrammar(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for s, want := range tt.match {
+				if got := g.match(s); got != want {
+					t.Errorf("%s: have match %v; want %v\n%s", s, got, want, src)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaGrammarUnsupported(t *testing.T) {
+	for _, tt := range []struct {
+		schema, keyword, path string
+	}{
+		{`{"type": "object", "patternProperties": {"^a": {}}}`, "patternProperties", "#"},
+		{`{"pattern": "^a"}`, "pattern", "#"},
+		{`{"type": "string", "pattern": "^a", "maxLength": 3}`, "maxLength", "#"},
+		{`{"properties": {"a": {"type": "number", "minimum": 0}}}`, "minimum", "#/properties/a"},
+		{`{"type": "integer", "minimum": 3, "maximum": 2.5}`, "maximum", "#"},
+		{`{"oneOf": [{"type": "integer"}, {"type": "number"}]}`, "oneOf", "#"},
+		{`{"oneOf": [{"enum": ["a", "b"]}, {"type": "string"}]}`, "oneOf", "#"},
+		{`{"allOf": [{"type": "string"}]}`, "allOf", "#"},
+		{`{"properties": {"a": {}}, "required": ["b"]}`, "required", "#"},
+		{`{"$ref": "https://example.com/schema"}`, "$ref", "#"},
+		{`{"type": "array", "items": false, "minItems": 1}`, "minItems", "#"},
+		{`false`, "false", "#"},
+	} {
+		_, err := SchemaGrammar([]byte(tt.schema))
+
+		var uerr *UnsupportedSchemaError
+		if !errors.As(err, &uerr) || uerr.Keyword != tt.keyword || uerr.Path != tt.path {
+			t.Errorf("%s: have error %v; want keyword %s unsupported at %s", tt.schema, err, tt.keyword, tt.path)
+		}
+	}
+
+	for _, tt := range []struct {
+		schema, err string
+	}{
+		{`{"type": "object"`, "unexpected end of JSON input"},
+		{`{} {}`, "unexpected data after the schema"},
+		{`{"type": "list"}`, `unknown type "list" at #`},
+		{`{"enum": []}`, "enum at # is not a non-empty array"},
+		{`{"type": "array", "minItems": -1}`, "minItems at # is not a non-negative integer"},
+		{`{"type": "integer", "minimum": "1"}`, "minimum at # is not a number"},
+		{`{"type": "string", "pattern": 1}`, "pattern at # is not a string"},
+		{`{"$ref": "#/$defs/missing"}`, `undefined $ref "#/$defs/missing"`},
+		{`1`, "# is not an object or boolean"},
+	} {
+		_, err := SchemaGrammar([]byte(tt.schema))
+
+		var uerr *UnsupportedSchemaError
+		if err == nil || errors.As(err, &uerr) || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: have error %v; want %q", tt.schema, err, tt.err)
+		}
+	}
+}
+
+// TestSchemaGrammarIntegerRange checks the integers that ranges match
+// against their bounds
+func TestSchemaGrammarIntegerRange(t *testing.T) {
+	for _, tt := range []struct {
+		bounds   string
+		min, max int
+	}{
+		{`"minimum": 0, "maximum": 0`, 0, 0},
+		{`"minimum": -5, "maximum": 17`, -5, 17},
+		{`"maximum": -3`, math.MinInt, -3},
+		{`"exclusiveMinimum": 3`, 4, math.MaxInt},
+		{`"minimum": -1000, "exclusiveMaximum": -7`, -1000, -8},
+		{`"minimum": 99, "maximum": 1234`, 99, 1234},
+		{`"minimum": 1.5, "maximum": 9.5`, 2, 9},
+		{`"minimum": 7, "maximum": 207`, 7, 207},
+		{`"minimum": 10, "exclusiveMinimum": true, "maximum": 1000`, 11, 1000},
+	} {
+		src, err := SchemaGrammar([]byte(`{"type": "integer", ` + tt.bounds + `}`))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.bounds, err)
+		}
+
+		g, err := ParseGrammar(src)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", tt.bounds, err, src)
+		}
+
+		for i := -1500; i <= 1500; i++ {
+			if got, want := g.match(strconv.Itoa(i)), tt.min <= i && i <= tt.max; got != want {
+				t.Errorf("%s: %d has match %v; want %v\n%s", tt.bounds, i, got, want, src)
+			}
+		}
+	}
+}
+
+func TestSchemaGrammarSample(t *testing.T) {
+	src, err := SchemaGrammar([]byte(`{
+  "type": "object",
+  "properties": {
+    "name": {"type": "string", "maxLength": 4},
+    "color": {"enum": ["red", "green", "blue"]},
+    "sizes": {"type": "array", "items": {"type": "integer"}, "minItems": 2, "maxItems": 3},
+    "owner": {
+      "type": "object",
+      "properties": {"admin": {"type": "boolean"}, "id": {"type": "integer"}},
+      "required": ["id"]
+    }
+  },
+  "required": ["color", "sizes", "owner"]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := ParseGrammar(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// characters and terminals of JSON, tokens that straddle them and the
+	// lowercase letters, so that sampling never reaches a dead end
+	pieces := []string{
+		"{", "}", "[", "]", ",", ":", " ", "\n", "\t", `"`, `",`, `":`, `": "`, "true", "false", "null",
+		"0", "1", "2", "7", "12", "-", "red", "gre", "en", "blue", "bl",
+		"name", `"name"`, "color", `"color":`, "sizes", "owner", "admin", `"id"`, "id",
+	}
+
+	for c := 'a'; c <= 'z'; c++ {
+		pieces = append(pieces, string(c))
+	}
+
+	for seed := range uint64(50) {
+		s := sampleGrammar(t, g, pieces, seed)
+
+		var v struct {
+			Name  *string
+			Color string
+			Sizes []json.Number
+			Owner *struct {
+				Admin *bool
+				ID    *json.Number
+			}
+		}
+
+		d := json.NewDecoder(strings.NewReader(s))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&v); err != nil {
+			t.Errorf("seed %d: %q isn't valid: %v", seed, s, err)
+			continue
+		}
+
+		switch {
+		case v.Name != nil && len([]rune(*v.Name)) > 4:
+			t.Errorf("seed %d: %q has a name longer than 4", seed, s)
+		case v.Color != "red" && v.Color != "green" && v.Color != "blue":
+			t.Errorf("seed %d: %q has no color of the enum", seed, s)
+		case len(v.Sizes) < 2 || len(v.Sizes) > 3:
+			t.Errorf("seed %d: %q has the wrong number of sizes", seed, s)
+		case v.Owner == nil || v.Owner.ID == nil:
+			t.Errorf("seed %d: %q has no owner id", seed, s)
+		}
+
+		for _, n := range v.Sizes {
+			if _, err := n.Int64(); err != nil {
+				t.Errorf("seed %d: %q has size %s, which isn't an integer", seed, s, n)
+			}
+		}
+	}
+}
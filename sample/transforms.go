@@ -54,8 +54,9 @@ func (k TopK) Apply(logits []float64) []float64 {
 	if int(k) >= len(logits) {
 		return logits
 	}
+	// ties keep the tokens with the lowest ids
 	q := pq.NewWith(func(a, b logitMap) int {
-		return -cmp.Compare(a.logit, b.logit)
+		return cmp.Or(-cmp.Compare(a.logit, b.logit), cmp.Compare(a.index, b.index))
 	})
 
 	for i, logit := range logits {
@@ -86,8 +87,9 @@ func (p TopP) Apply(logits []float64) []float64 {
 		indices[i] = i
 	}
 
-	// sort in descending order
-	slices.SortFunc(indices, func(i, j int) int {
+	// sort in descending order, keeping tokens with the same probability in
+	// the order of their ids so that the cutoff between them doesn't vary
+	slices.SortStableFunc(indices, func(i, j int) int {
 		return cmp.Compare(probs[j], probs[i])
 	})
 
@@ -118,3 +120,37 @@ func (p MinP) Apply(logits []float64) []float64 {
 
 	return logits
 }
+
+// LogitBias adds biases to the logits of tokens by their ids, ignoring ids
+// that are out of range. As for logit_bias in the OpenAI API, a bias of -100
+// or less bans a token and one of 100 or more restricts sampling to the tokens
+// with such a bias, which keep their logits.
+type LogitBias map[int32]float64
+
+func (b LogitBias) Apply(logits []float64) []float64 {
+	forced := false
+	for id, bias := range b {
+		if id < 0 || int(id) >= len(logits) {
+			continue
+		}
+
+		switch {
+		case bias <= -100:
+			logits[id] = math.Inf(-1)
+		case bias >= 100:
+			forced = forced || !math.IsInf(logits[id], -1)
+		default:
+			logits[id] += bias
+		}
+	}
+
+	if forced {
+		for i := range logits {
+			if b[int32(i)] < 100 {
+				logits[i] = math.Inf(-1)
+			}
+		}
+	}
+
+	return logits
+}
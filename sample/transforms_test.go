@@ -38,6 +38,13 @@ func TestTopK(t *testing.T) {
 	if diff := cmp.Diff(want, got); diff != "" {
 		t.Errorf("logits mismatch (-want +got):\n%s", diff)
 	}
+
+	// ties keep the lowest token ids
+	got = TopK(3).Apply([]float64{1, 2, 1, 2, 1, 1})
+	want = []float64{1, 2, math.Inf(-1), 2, math.Inf(-1), math.Inf(-1)}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("logits mismatch (-want +got):\n%s", diff)
+	}
 }
 
 func TestTopP(t *testing.T) {
@@ -46,6 +53,13 @@ func TestTopP(t *testing.T) {
 	if diff := cmp.Diff(want, got); diff != "" {
 		t.Errorf("logits mismatch (-want +got):\n%s", diff)
 	}
+
+	// ties keep the lowest token ids
+	got = TopP(0.5).Apply([]float64{0, 1, 0, 1, 1, 1})
+	want = []float64{math.Inf(-1), 1, math.Inf(-1), 1, 1, math.Inf(-1)}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("logits mismatch (-want +got):\n%s", diff)
+	}
 }
 
 func TestMinP(t *testing.T) {
@@ -54,6 +68,53 @@ func TestMinP(t *testing.T) {
 	if diff := cmp.Diff(want, got); diff != "" {
 		t.Errorf("logits mismatch (-want +got):\n%s", diff)
 	}
+
+	// tokens survive if their probability relative to that of token 6 is at
+	// least p: e^-1 ≈ 0.37 for token 7, e^-2 ≈ 0.14 for token 5 and so on
+	for _, tt := range []struct {
+		p    MinP
+		want []int
+	}{
+		{0.5, []int{6}},
+		{0.3, []int{6, 7}},
+		{0.1, []int{5, 6, 7}},
+		{0.04, []int{4, 5, 6, 7}},
+		{0.01, []int{3, 4, 5, 6, 7}},
+		{0.001, []int{1, 2, 3, 4, 5, 6, 7}},
+	} {
+		var got []int
+		for i, logit := range tt.p.Apply([]float64{-3, -2, -1, 0, 1, 2, 4, 3}) {
+			if !math.IsInf(logit, -1) {
+				got = append(got, i)
+			}
+		}
+
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("min p %v: tokens mismatch (-want +got):\n%s", tt.p, diff)
+		}
+	}
+}
+
+func TestLogitBias(t *testing.T) {
+	got := LogitBias{0: 1.5, 2: -100, 3: -2, 9: 100}.Apply([]float64{-3, -2, -1, 0})
+	want := []float64{-1.5, -2, math.Inf(-1), -2}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("logits mismatch (-want +got):\n%s", diff)
+	}
+
+	// tokens with a bias of 100 or more are the only ones left, unless they
+	// are already banned
+	got = LogitBias{1: 100, 2: 200, 3: 5}.Apply([]float64{-3, -2, -1, 0})
+	want = []float64{math.Inf(-1), -2, -1, math.Inf(-1)}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("logits mismatch (-want +got):\n%s", diff)
+	}
+
+	got = LogitBias{1: 100}.Apply([]float64{-3, math.Inf(-1), -1, 0})
+	want = []float64{-3, math.Inf(-1), -1, 0}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("logits mismatch (-want +got):\n%s", diff)
+	}
 }
 
 func BenchmarkTransform(b *testing.B) {
@@ -119,6 +119,26 @@ func (s *Server) CreateHandler(c *gin.Context) {
 			baseLayers = append(baseLayers, adapterLayers...)
 		}
 
+		if r.Draft != "" {
+			draftName := model.ParseName(r.Draft)
+			if !draftName.IsValid() {
+				ch <- gin.H{"error": errtypes.InvalidModelNameErrMsg, "status": http.StatusBadRequest}
+				return
+			}
+
+			draft, err := parseDraftModel(c.Request.Context(), draftName, fn)
+			if err != nil {
+				ch <- gin.H{"error": err.Error()}
+				return
+			}
+
+			// the draft model replaces any of the model it is created from
+			baseLayers = slices.DeleteFunc(baseLayers, func(layer *layerGGML) bool {
+				return layer.MediaType == "application/vnd.ollama.image.draft"
+			})
+			baseLayers = append(baseLayers, draft)
+		}
+
 		if err := createModel(r, name, baseLayers, fn); err != nil {
 			if errors.Is(err, errBadTemplate) {
 				ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
@@ -145,6 +165,29 @@ func (s *Server) CreateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// parseDraftModel returns a layer of the weights of the model name, pulling it
+// if needed, to use as the draft model of speculative decoding. The layer
+// refers to the same blob as the model, so no weights are copied.
+func parseDraftModel(ctx context.Context, name model.Name, fn func(api.ProgressResponse)) (*layerGGML, error) {
+	layers, err := parseFromModel(ctx, name, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range layers {
+		if layer.MediaType == "application/vnd.ollama.image.model" {
+			layer, err := NewLayerFromLayer(layer.Digest, "application/vnd.ollama.image.draft", name.DisplayShortest())
+			if err != nil {
+				return nil, err
+			}
+
+			return &layerGGML{layer, nil}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("draft model %s has no weights", name.DisplayShortest())
+}
+
 func convertModelFromFiles(files map[string]string, baseLayers []*layerGGML, isAdapter bool, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
 	switch detectModelTypeFromFiles(files) {
 	case "safetensors":
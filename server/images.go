@@ -35,6 +35,7 @@ var (
 	errCapabilityCompletion = errors.New("completion")
 	errCapabilityTools      = errors.New("tools")
 	errCapabilityInsert     = errors.New("insert")
+	errCapabilityRerank     = errors.New("rerank")
 )
 
 type Capability string
@@ -43,6 +44,7 @@ const (
 	CapabilityCompletion = Capability("completion")
 	CapabilityTools      = Capability("tools")
 	CapabilityInsert     = Capability("insert")
+	CapabilityRerank     = Capability("rerank")
 )
 
 type registryOptions struct {
@@ -62,6 +64,8 @@ type Model struct {
 	ParentModel    string
 	AdapterPaths   []string
 	ProjectorPaths []string
+	Draft          string
+	DraftPath      string
 	System         string
 	License        []string
 	Digest         string
@@ -104,6 +108,11 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 			if !slices.Contains(vars, "suffix") {
 				errs = append(errs, errCapabilityInsert)
 			}
+		case CapabilityRerank:
+			vars := m.Template.Vars()
+			if !slices.Contains(vars, "query") || !slices.Contains(vars, "document") {
+				errs = append(errs, errCapabilityRerank)
+			}
 		default:
 			slog.Error("unknown capability", "capability", cap)
 			return fmt.Errorf("unknown capability: %s", cap)
@@ -139,6 +148,13 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.Draft != "" {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "draft",
+			Args: m.Draft,
+		})
+	}
+
 	if m.Template != nil {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "template",
@@ -276,6 +292,9 @@ func GetModel(name string) (*Model, error) {
 			model.AdapterPaths = append(model.AdapterPaths, filename)
 		case "application/vnd.ollama.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
+		case "application/vnd.ollama.image.draft":
+			model.Draft = layer.From
+			model.DraftPath = filename
 		case "application/vnd.ollama.image.prompt",
 			"application/vnd.ollama.image.template":
 			bts, err := os.ReadFile(filename)
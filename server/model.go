@@ -44,7 +44,13 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	}
 
 	for _, layer := range m.Layers {
-		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, name.DisplayShortest())
+		// the layer of a draft model keeps the name of the draft model
+		from := name.DisplayShortest()
+		if layer.MediaType == "application/vnd.ollama.image.draft" {
+			from = layer.From
+		}
+
+		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, from)
 		if err != nil {
 			return nil, err
 		}
@@ -153,9 +159,10 @@ func parseObjects(s string) []map[string]any {
 	return objs
 }
 
-// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
-// mxyng: this only really works if the input contains tool calls in some JSON format
-func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+// toolCallTemplate executes the node of the template that ranges over
+// .ToolCalls with a placeholder call, returning its output and the keys of
+// the name and arguments of each call
+func (m *Model) toolCallTemplate() (out, name, arguments string, ok bool) {
 	// create a subtree from the node that ranges over .ToolCalls
 	tmpl := m.Template.Subtree(func(n parse.Node) bool {
 		if t, ok := n.(*parse.RangeNode); ok {
@@ -166,7 +173,7 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	})
 
 	if tmpl == nil {
-		return nil, false
+		return "", "", "", false
 	}
 
 	var b bytes.Buffer
@@ -182,16 +189,15 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 			},
 		},
 	}); err != nil {
-		return nil, false
+		return "", "", "", false
 	}
 
 	templateObjects := parseObjects(b.String())
 	if len(templateObjects) == 0 {
-		return nil, false
+		return "", "", "", false
 	}
 
 	// find the keys that correspond to the name and arguments fields
-	var name, arguments string
 	for k, v := range templateObjects[0] {
 		switch v.(type) {
 		case string:
@@ -202,6 +208,17 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	}
 
 	if name == "" || arguments == "" {
+		return "", "", "", false
+	}
+
+	return b.String(), name, arguments, true
+}
+
+// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
+// mxyng: this only really works if the input contains tool calls in some JSON format
+func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+	_, name, arguments, ok := m.toolCallTemplate()
+	if !ok {
 		return nil, false
 	}
 
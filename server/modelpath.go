@@ -34,6 +34,7 @@ var (
 	ErrInvalidProtocol     = errors.New("invalid protocol scheme")
 	ErrInsecureProtocol    = errors.New("insecure protocol http")
 	ErrInvalidDigestFormat = errors.New("invalid digest format")
+	ErrInvalidSessionName  = errors.New("invalid session name")
 )
 
 func ParseModelPath(name string) ModelPath {
@@ -145,3 +146,19 @@ func GetBlobsPath(digest string) (string, error) {
 
 	return path, nil
 }
+
+// GetSessionPath returns the path of the file of the session name, creating
+// the directory of sessions if it does not exist
+func GetSessionPath(name string) (string, error) {
+	// names can't escape the directory of sessions
+	if !regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`).MatchString(name) {
+		return "", ErrInvalidSessionName
+	}
+
+	dir := filepath.Join(envconfig.Models(), "sessions")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, name), nil
+}
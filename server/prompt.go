@@ -22,7 +22,8 @@ var errTooManyImages = errors.New("vision model only supports a single image per
 
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
 // chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
+// latest message and 2) system messages. With opts.ContextShift, all messages are included and the runner shifts
+// the context instead, keeping the first opts.NumKeep tokens.
 func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
 	var system []api.Message
 
@@ -50,6 +51,11 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 			continue
 		}
 
+		if opts.ContextShift {
+			n = i
+			continue
+		}
+
 		system = make([]api.Message, 0)
 		for j := range i {
 			if msgs[j].Role == "system" {
@@ -56,6 +56,7 @@ func TestChatPrompt(t *testing.T) {
 		name  string
 		model Model
 		limit int
+		shift bool
 		msgs  []api.Message
 		expect
 	}{
@@ -85,6 +86,21 @@ func TestChatPrompt(t *testing.T) {
 				prompt: "A test. And a thumping good one at that, I'd wager. ",
 			},
 		},
+		{
+			name:  "context shift",
+			model: visionModel,
+			limit: 1,
+			shift: true,
+			msgs: []api.Message{
+				{Role: "system", Content: "You are the Test Who Lived."},
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			expect: expect{
+				prompt: "You are the Test Who Lived. You're a test, Harry! I-I'm a what? A test. And a thumping good one at that, I'd wager. ",
+			},
+		},
 		{
 			name:  "truncate messages with image",
 			model: visionModel,
@@ -317,7 +333,7 @@ func TestChatPrompt(t *testing.T) {
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			model := tt.model
-			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, ContextShift: tt.shift}
 			prompt, images, err := chatPrompt(context.TODO(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil)
 			if tt.error == nil && err != nil {
 				t.Fatal(err)
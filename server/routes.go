@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"cmp"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -19,7 +20,9 @@ import (
 	"os/signal"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -34,6 +37,8 @@ import (
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/model/models/mllama"
 	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/runner/common"
+	"github.com/ollama/ollama/sample"
 	"github.com/ollama/ollama/template"
 	"github.com/ollama/ollama/types/errtypes"
 	"github.com/ollama/ollama/types/model"
@@ -45,6 +50,10 @@ var mode string = gin.DebugMode
 type Server struct {
 	addr  net.Addr
 	sched *Scheduler
+
+	// requests are the functions that cancel the generate requests in
+	// progress by their IDs
+	requests sync.Map
 }
 
 func init() {
@@ -120,6 +129,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if err := setPriority(c, req.Priority); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	name := model.ParseName(req.Model)
 	if !name.IsValid() {
 		// Ideally this is "invalid model name" but we're keeping with
@@ -182,6 +196,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if err := grammarOptions(req.Grammar, req.Format, opts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	checkpointLoaded := time.Now()
 
 	// load the model
@@ -288,28 +307,48 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 	slog.Debug("generate request", "images", len(images), "prompt", prompt)
 
+	if s.queueFull(c, r) {
+		return
+	}
+
+	ctx, id, done, err := s.startRequest(c.Request.Context(), req.ID)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	defer done()
+
 	ch := make(chan any)
 	go func() {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
+		if err := r.Completion(ctx, llm.CompletionRequest{
 			Prompt:  prompt,
 			Images:  images,
 			Format:  req.Format,
 			Options: opts,
+			Queued: func(position int) {
+				ch <- api.GenerateResponse{Model: req.Model, ID: id, CreatedAt: time.Now().UTC(), Queued: s.queueStatus(position)}
+			},
 		}, func(cr llm.CompletionResponse) {
 			res := api.GenerateResponse{
 				Model:      req.Model,
+				ID:         id,
 				CreatedAt:  time.Now().UTC(),
 				Response:   cr.Content,
+				Logprobs:   cr.Logprobs,
+				Sequences:  cr.Sequences,
 				Done:       cr.Done,
 				DoneReason: cr.DoneReason,
 				Metrics: api.Metrics{
 					PromptEvalCount:    cr.PromptEvalCount,
 					PromptEvalDuration: cr.PromptEvalDuration,
+					PromptCacheCount:   cr.PromptCacheCount,
 					EvalCount:          cr.EvalCount,
 					EvalDuration:       cr.EvalDuration,
+					DraftCount:         cr.DraftCount,
+					DraftAcceptedCount: cr.DraftAcceptedCount,
 				},
 			}
 
@@ -320,9 +359,10 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			if cr.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				s.sched.throughput.record(cr.EvalCount, cr.EvalDuration)
 
 				if !req.Raw {
-					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
+					tokens, err := r.Tokenize(ctx, prompt+sb.String())
 					if err != nil {
 						ch <- gin.H{"error": err.Error()}
 						return
@@ -333,6 +373,13 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 			ch <- res
 		}); err != nil {
+			if ctx.Err() != nil && c.Request.Context().Err() == nil {
+				// canceled by CancelGenerateHandler rather than the client
+				// closing the connection
+				ch <- api.GenerateResponse{Model: req.Model, ID: id, CreatedAt: time.Now().UTC(), Done: true, DoneReason: "cancel"}
+				return
+			}
+
 			ch <- gin.H{"error": err.Error()}
 		}
 	}()
@@ -340,10 +387,12 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	if req.Stream != nil && !*req.Stream {
 		var r api.GenerateResponse
 		var sb strings.Builder
+		var logprobs []api.Logprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(t.Response)
+				logprobs = append(logprobs, t.Logprobs...)
 				r = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -360,6 +409,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		r.Response = sb.String()
+		r.Logprobs = logprobs
 		c.JSON(http.StatusOK, r)
 		return
 	}
@@ -367,6 +417,39 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// startRequest registers a generate request with id, or a random ID if it is
+// empty, so that CancelGenerateHandler can cancel the returned context. done
+// must be called once the request ends.
+func (s *Server) startRequest(ctx context.Context, id string) (_ context.Context, _ string, done func(), _ error) {
+	if id == "" {
+		id = rand.Text()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	if _, loaded := s.requests.LoadOrStore(id, cancel); loaded {
+		cancel()
+		return nil, "", nil, fmt.Errorf("request %q is already in progress", id)
+	}
+
+	return ctx, id, func() {
+		s.requests.Delete(id)
+		cancel()
+	}, nil
+}
+
+// CancelGenerateHandler cancels the generate request in progress with the ID
+// of the path, for clients that can't close its connection
+func (s *Server) CancelGenerateHandler(c *gin.Context) {
+	cancel, ok := s.requests.Load(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("request %q not found", c.Param("id"))})
+		return
+	}
+
+	cancel.(context.CancelFunc)()
+	c.Status(http.StatusOK)
+}
+
 func (s *Server) EmbedHandler(c *gin.Context) {
 	checkpointStart := time.Now()
 	var req api.EmbedRequest
@@ -380,6 +463,11 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	if err := setPriority(c, req.Priority); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	truncate := true
 
 	if req.Truncate != nil && !*req.Truncate {
@@ -420,6 +508,11 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	if err := checkPooling(opts.Pooling); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(input) == 0 {
@@ -461,33 +554,282 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		input[i] = s
 	}
 
+	if s.queueFull(c, r) {
+		return
+	}
+
+	// the inputs are sent together so that the runner can batch them
+	embeddings, err := r.Embed(c.Request.Context(), input, opts.Pooling)
+	if err != nil {
+		slog.Error("embedding generation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("failed to generate embeddings: %v", err)})
+		return
+	}
+
+	if opts.Normalize == nil || *opts.Normalize {
+		for i := range embeddings {
+			embeddings[i] = normalize(embeddings[i])
+		}
+	}
+
+	resp := api.EmbedResponse{
+		Model:           req.Model,
+		Embeddings:      embeddings,
+		TotalDuration:   time.Since(checkpointStart),
+		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount: count,
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) RerankHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.RerankRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Query == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+
+	if req.TopN < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_n must not be negative"})
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, m, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{CapabilityRerank}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	// each pair is formatted by the template of the model, which inserts the
+	// special tokens that separate the query and document
+	prompts := make([]string, len(req.Documents))
+	var count int
+	for i, document := range req.Documents {
+		var b strings.Builder
+		if err := m.Template.Execute(&b, template.Values{Query: req.Query, Document: document}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		tokens, err := r.Tokenize(c.Request.Context(), b.String())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		count += len(tokens)
+		prompts[i] = b.String()
+	}
+
 	var g errgroup.Group
-	embeddings := make([][]float32, len(input))
-	for i, text := range input {
+	results := make([]api.RerankResult, len(prompts))
+	for i, prompt := range prompts {
 		g.Go(func() error {
-			embedding, err := r.Embedding(c.Request.Context(), text)
+			scores, err := r.Score(c.Request.Context(), prompt)
 			if err != nil {
 				return err
+			} else if len(scores) == 0 {
+				return errors.New("model returned no scores")
 			}
-			embeddings[i] = normalize(embedding)
+
+			results[i] = api.RerankResult{Index: i, Document: req.Documents[i], RelevanceScore: scores[0]}
 			return nil
 		})
 	}
 
 	if err := g.Wait(); err != nil {
-		slog.Error("embedding generation failed", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("failed to generate embeddings: %v", err)})
+		slog.Error("rerank failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to rerank documents: %v", err)})
 		return
 	}
 
-	resp := api.EmbedResponse{
+	slices.SortStableFunc(results, func(a, b api.RerankResult) int {
+		return cmp.Compare(b.RelevanceScore, a.RelevanceScore)
+	})
+
+	if req.TopN > 0 && req.TopN < len(results) {
+		results = results[:req.TopN]
+	}
+
+	c.JSON(http.StatusOK, api.RerankResponse{
 		Model:           req.Model,
-		Embeddings:      embeddings,
+		Results:         results,
 		TotalDuration:   time.Since(checkpointStart),
 		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
 		PromptEvalCount: count,
+	})
+}
+
+func (s *Server) SaveSessionHandler(c *gin.Context) {
+	s.sessionHandler(c, true)
+}
+
+func (s *Server) LoadSessionHandler(c *gin.Context) {
+	s.sessionHandler(c, false)
+}
+
+// sessionHandler saves or loads the KV cache of a prompt to or from a file in
+// the sessions directory. Sessions are tied to the weights of the model, so
+// they are rejected by other models and versions of the model.
+func (s *Server) sessionHandler(c *gin.Context, save bool) {
+	checkpointStart := time.Now()
+	var req api.SessionRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	path, err := GetSessionPath(req.Session)
+	if errors.Is(err, ErrInvalidSessionName) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%v %q", err, req.Session)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := os.Stat(path); !save && errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("session '%s' not found", req.Session)})
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, m, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{CapabilityCompletion}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	session := r.LoadSession
+	if save {
+		session = r.SaveSession
+	}
+
+	// the blob of the weights changes with any change to the model that
+	// changes its KV cache
+	tokens, err := session(c.Request.Context(), llm.SessionRequest{Path: path, Digest: filepath.Base(m.ModelPath), Prompt: req.Prompt})
+	if errors.Is(err, llm.ErrInvalidSession) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.SessionResponse{
+		Model:         req.Model,
+		Session:       req.Session,
+		Tokens:        tokens,
+		TotalDuration: time.Since(checkpointStart),
+		LoadDuration:  checkpointLoaded.Sub(checkpointStart),
+	})
+}
+
+// TokenizeHandler converts text to the token ids of a model with the
+// tokenizer of its runner, which is loaded if it isn't already but without
+// waiting for a slot to process a sequence
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), nil, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	resp, err := r.Encode(c.Request.Context(), llm.TokenizeRequest{Content: req.Content, AddSpecial: req.AddSpecial, Pieces: req.Pieces})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: resp.Tokens, Pieces: resp.Pieces})
+}
+
+// DetokenizeHandler converts the token ids of a model back to text, which is
+// the reverse of TokenizeHandler
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), nil, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	content, err := r.Detokenize(c.Request.Context(), req.Tokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model, Content: content})
+}
+
+// checkPooling returns an error if pooling is not a pooling option of
+// embedding requests
+func checkPooling(pooling string) error {
+	switch pooling {
+	case "", "mean", "cls", "last":
+		return nil
+	case "none":
+		return errors.New("invalid pooling \"none\", each input has a single embedding")
+	default:
+		return fmt.Errorf("invalid pooling %q, expected \"mean\", \"cls\" or \"last\"", pooling)
 	}
-	c.JSON(http.StatusOK, resp)
 }
 
 func normalize(vec []float32) []float32 {
@@ -523,19 +865,24 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, req.KeepAlive)
+	r, _, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []Capability{}, req.Options, req.KeepAlive)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	if err := checkPooling(opts.Pooling); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// an empty request loads the model
 	if req.Prompt == "" {
 		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
 		return
 	}
 
-	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
+	embeddings, err := r.Embed(c.Request.Context(), []string{req.Prompt}, opts.Pooling)
 	if err != nil {
 		slog.Info(fmt.Sprintf("embedding generation failed: %v", err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("failed to generate embedding: %v", err)})
@@ -543,7 +890,7 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	}
 
 	var e []float64
-	for _, v := range embedding {
+	for _, v := range embeddings[0] {
 		e = append(e, float64(v))
 	}
 
@@ -1182,9 +1529,15 @@ func (s *Server) GenerateRoutes() http.Handler {
 	// Inference
 	r.GET("/api/ps", s.PsHandler)
 	r.POST("/api/generate", s.GenerateHandler)
+	r.DELETE("/api/generate/:id", s.CancelGenerateHandler)
 	r.POST("/api/chat", s.ChatHandler)
 	r.POST("/api/embed", s.EmbedHandler)
 	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	r.POST("/api/rerank", s.RerankHandler)
+	r.POST("/api/session/save", s.SaveSessionHandler)
+	r.POST("/api/session/load", s.LoadSessionHandler)
+	r.POST("/api/tokenize", s.TokenizeHandler)
+	r.POST("/api/detokenize", s.DetokenizeHandler)
 
 	// Inference (OpenAI compatibility)
 	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
@@ -1370,6 +1723,11 @@ func (s *Server) PsHandler(c *gin.Context) {
 			Details:   modelDetails,
 			ExpiresAt: v.expiresAt,
 		}
+
+		if v.llama != nil {
+			mr.Queued = queued(v.llama.Waiting())
+		}
+
 		// The scheduler waits to set expiresAt, so if a model is loading it's
 		// possible that it will be set to the unix epoch. For those cases, just
 		// calculate the time w/ the sessionDuration instead.
@@ -1386,7 +1744,57 @@ func (s *Server) PsHandler(c *gin.Context) {
 		return cmp.Compare(j.ExpiresAt.Unix(), i.ExpiresAt.Unix())
 	})
 
-	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
+	c.JSON(http.StatusOK, api.ProcessResponse{Models: models, Queued: queued(s.sched.queue.depths())})
+}
+
+// setPriority sets the priority of the request of c, which orders it among
+// those waiting for a runner and for a place in its batch
+func setPriority(c *gin.Context, priority string) error {
+	p, err := common.ParsePriority(priority)
+	if err != nil {
+		return err
+	}
+
+	c.Request = c.Request.WithContext(common.WithPriority(c.Request.Context(), p))
+	return nil
+}
+
+// queued returns the number of requests of each priority that are waiting,
+// keyed by the name of the priority
+func queued(waiting map[common.Priority]int) map[string]int {
+	if len(waiting) == 0 {
+		return nil
+	}
+
+	m := make(map[string]int, len(waiting))
+	for p, n := range waiting {
+		m[p.String()] = n
+	}
+
+	return m
+}
+
+// grammarOptions sets the grammar of opts to grammar, that of a request,
+// which overrides that of the model, and checks that it is valid so that
+// requests with invalid grammars fail before any tokens are generated
+func grammarOptions(grammar string, format json.RawMessage, opts *api.Options) error {
+	if grammar != "" {
+		switch string(format) {
+		case "", "null", `""`:
+		default:
+			return errors.New("format and grammar cannot both be set")
+		}
+
+		opts.Grammar = grammar
+	}
+
+	if opts.Grammar != "" {
+		if _, err := sample.ParseGrammar(opts.Grammar); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (s *Server) ChatHandler(c *gin.Context) {
@@ -1401,6 +1809,11 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	if err := setPriority(c, req.Priority); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// expire the runner
 	if len(req.Messages) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
 		model, err := GetModel(req.Model)
@@ -1452,6 +1865,11 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	if err := grammarOptions(req.Grammar, req.Format, opts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
@@ -1479,67 +1897,108 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 	slog.Debug("chat request", "images", len(images), "prompt", prompt)
 
+	// tool calls are parsed as they're streamed, so that the content around
+	// them is streamed too
+	var parser *toolParser
+	if len(req.Tools) > 0 && (req.Stream == nil || *req.Stream) {
+		parser = m.toolParser()
+	}
+
+	if s.queueFull(c, r) {
+		return
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
 		var sb strings.Builder
-		var toolCallIndex int = 0
+		var logprobs []api.Logprob
 		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
 			Prompt:  prompt,
 			Images:  images,
 			Format:  req.Format,
 			Options: opts,
+			Queued: func(position int) {
+				ch <- api.ChatResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Message: api.Message{Role: "assistant"}, Queued: s.queueStatus(position)}
+			},
 		}, func(r llm.CompletionResponse) {
 			res := api.ChatResponse{
 				Model:      req.Model,
 				CreatedAt:  time.Now().UTC(),
 				Message:    api.Message{Role: "assistant", Content: r.Content},
+				Logprobs:   r.Logprobs,
 				Done:       r.Done,
 				DoneReason: r.DoneReason,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
+					PromptCacheCount:   r.PromptCacheCount,
 					EvalCount:          r.EvalCount,
 					EvalDuration:       r.EvalDuration,
+					DraftCount:         r.DraftCount,
+					DraftAcceptedCount: r.DraftAcceptedCount,
 				},
 			}
 
 			if r.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				s.sched.throughput.record(r.EvalCount, r.EvalDuration)
 			}
 
-			// TODO: tool call checking and filtering should be moved outside of this callback once streaming
-			// however this was a simple change for now without reworking streaming logic of this (and other)
-			// handlers
-			if req.Stream != nil && !*req.Stream || len(req.Tools) == 0 {
+			if parser == nil {
 				ch <- res
 				return
 			}
 
-			// Streaming tool calls:
-			// If tools are recognized, use a flag to track the sending of a tool downstream
-			// This ensures that content is cleared from the message on the last chunk sent
 			sb.WriteString(r.Content)
-			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-				res.Message.ToolCalls = toolCalls
-				for i := range toolCalls {
-					toolCalls[i].Function.Index = toolCallIndex
-					toolCallIndex++
+			logprobs = append(logprobs, r.Logprobs...)
+			content, deltas, toolCalls := parser.Add(r.Content)
+			if r.Done {
+				rest, err := parser.Done()
+				if err != nil {
+					// the rest of the response is sent before the error
+					if content != "" || len(deltas) > 0 || len(toolCalls) > 0 {
+						ch <- api.ChatResponse{
+							Model:     req.Model,
+							CreatedAt: res.CreatedAt,
+							Message:   api.Message{Role: "assistant", Content: content, ToolCalls: toolCalls, ToolCallDeltas: deltas},
+							Logprobs:  logprobs,
+						}
+					}
+
+					ch <- gin.H{"error": err.Error()}
+					return
+				}
+				content += rest
+
+				// tool calls that aren't opened as in the template can only
+				// be found in the complete response
+				if parser.index == 0 {
+					if calls, ok := m.parseToolCalls(sb.String()); ok {
+						for i := range calls {
+							calls[i].Function.Index = i
+							deltas = append(deltas, api.ToolCallDelta{
+								Index:     i,
+								Name:      calls[i].Function.Name,
+								Arguments: calls[i].Function.Arguments.String(),
+							})
+						}
+						toolCalls = calls
+					}
 				}
-				res.Message.Content = ""
-				sb.Reset()
-				ch <- res
-				return
 			}
 
-			if r.Done {
-				// Send any remaining content if no tool calls were detected
-				if toolCallIndex == 0 {
-					res.Message.Content = sb.String()
-				}
-				ch <- res
+			// wait for more of the response while it may be a tool call
+			if content == "" && len(deltas) == 0 && len(toolCalls) == 0 && !r.Done {
+				return
 			}
+
+			res.Message.Content = content
+			res.Message.ToolCalls = toolCalls
+			res.Message.ToolCallDeltas = deltas
+			res.Logprobs, logprobs = logprobs, nil
+			ch <- res
 		}); err != nil {
 			ch <- gin.H{"error": err.Error()}
 		}
@@ -1548,10 +2007,12 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	if req.Stream != nil && !*req.Stream {
 		var resp api.ChatResponse
 		var sb strings.Builder
+		var logprobs []api.Logprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
 				sb.WriteString(t.Message.Content)
+				logprobs = append(logprobs, t.Logprobs...)
 				resp = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -1568,6 +2029,7 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		}
 
 		resp.Message.Content = sb.String()
+		resp.Logprobs = logprobs
 
 		if len(req.Tools) > 0 {
 			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
@@ -1583,6 +2045,38 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// tooManyRequests refuses a request as the queue is full, with a
+// Retry-After header of at least a second
+func tooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": ErrMaxQueue.Error()})
+}
+
+// queueFull refuses the request of c if OLLAMA_MAX_QUEUE requests are
+// already waiting for r, and reports whether it did
+func (s *Server) queueFull(c *gin.Context, r llm.LlamaServer) bool {
+	var waiting int
+	for _, n := range r.Waiting() {
+		waiting += n
+	}
+
+	if waiting < int(envconfig.MaxQueue()) {
+		return false
+	}
+
+	tooManyRequests(c, s.sched.throughput.wait(waiting))
+	return true
+}
+
+// queueStatus returns the status of a request at position in the queue of a
+// runner, which is expected to start once the requests ahead of it are served
+func (s *Server) queueStatus(position int) *api.QueueStatus {
+	return &api.QueueStatus{
+		Position:       position,
+		EstimatedStart: time.Now().Add(s.sched.throughput.wait(position)).UTC(),
+	}
+}
+
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
 	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
@@ -1590,7 +2084,13 @@ func handleScheduleError(c *gin.Context, name string, err error) {
 	case errors.Is(err, context.Canceled):
 		c.JSON(499, gin.H{"error": "request canceled"})
 	case errors.Is(err, ErrMaxQueue):
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		retryAfter := time.Second
+		var qerr maxQueueError
+		if errors.As(err, &qerr) {
+			retryAfter = qerr.retryAfter
+		}
+
+		tooManyRequests(c, retryAfter)
 	case errors.Is(err, os.ErrNotExist):
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
 	default:
@@ -664,6 +664,72 @@ func TestCreateLicenses(t *testing.T) {
 	}
 }
 
+func TestCreateDraft(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	for name, kv := range map[string]map[string]any{
+		"test":  nil,
+		"draft": {"general.name": "draft"},
+	} {
+		_, digest := createBinFile(t, kv, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   name,
+			Files:  map[string]string{"test.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test2",
+		From:   "test",
+		Draft:  "draft",
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	// models created from one with a draft model keep it
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test3",
+		From:   "test2",
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	draft, err := GetModel("draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"test2", "test3"} {
+		m, err := GetModel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Draft != "draft:latest" || m.DraftPath != draft.ModelPath {
+			t.Errorf("%s: have draft %q at %q; want draft:latest at %q", name, m.Draft, m.DraftPath, draft.ModelPath)
+		}
+
+		if !strings.Contains(m.String(), "DRAFT draft:latest") {
+			t.Errorf("%s: expected the draft in the modelfile, got %s", name, m.String())
+		}
+	}
+}
+
 func TestCreateDetectTemplate(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
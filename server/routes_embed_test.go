@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+func TestEmbedPooling(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// each input is embedded as [3, 4] and the pooling is recorded
+	var pooling string
+	mock := mockRunner{
+		EmbedFn: func(inputs []string, p string) ([][]float32, error) {
+			pooling = p
+			embeddings := make([][]float32, len(inputs))
+			for i := range embeddings {
+				embeddings[i] = []float32{3, 4}
+			}
+			return embeddings, nil
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture": "bert",
+		"bert.pooling_type":    uint32(1),
+		"bert.context_length":  uint32(8),
+	}, []ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	// the pooling and normalization can also be set by the Modelfile
+	for name, parameters := range map[string]map[string]any{
+		"default": nil,
+		"last":    {"pooling": "last", "normalize": false},
+	} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:      name,
+			Files:      map[string]string{"file.gguf": digest},
+			Parameters: parameters,
+			Stream:     &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	cases := []struct {
+		name    string
+		model   string
+		options map[string]any
+		pooling string
+		want    []float32
+	}{
+		{"default", "default", nil, "", []float32{0.6, 0.8}},
+		{"request", "default", map[string]any{"pooling": "mean", "normalize": false}, "mean", []float32{3, 4}},
+		{"modelfile", "last", nil, "last", []float32{3, 4}},
+		{"override modelfile", "last", map[string]any{"pooling": "cls", "normalize": true}, "cls", []float32{0.6, 0.8}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			pooling = "unset"
+			w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: tt.model, Input: []string{"a b", "c"}, Options: tt.options})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.EmbedResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if pooling != tt.pooling {
+				t.Errorf("have pooling %q; want %q", pooling, tt.pooling)
+			}
+
+			if diff := cmp.Diff(resp.Embeddings, [][]float32{tt.want, tt.want}); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+
+	for _, pooling := range []string{"max", "none"} {
+		t.Run("invalid pooling "+pooling, func(t *testing.T) {
+			w := createRequest(t, s.EmbedHandler, api.EmbedRequest{Model: "default", Input: "a", Options: map[string]any{"pooling": pooling}})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		})
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
@@ -18,6 +21,7 @@ import (
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/runner/common"
 )
 
 type mockRunner struct {
@@ -27,6 +31,46 @@ type mockRunner struct {
 	llm.CompletionRequest
 	llm.CompletionResponse
 	CompletionFn func(context.Context, llm.CompletionRequest, func(llm.CompletionResponse)) error
+
+	// ScoreFn returns the scores of each input to Score
+	ScoreFn func(string) ([]float32, error)
+
+	// EmbedFn returns the embeddings of the inputs to Embed
+	EmbedFn func(inputs []string, pooling string) ([][]float32, error)
+
+	// SessionFn is called by SaveSession and LoadSession
+	SessionFn func(save bool, req llm.SessionRequest) (int, error)
+
+	// EncodeFn and DetokenizeFn are called by Encode and Detokenize
+	EncodeFn     func(llm.TokenizeRequest) (*llm.TokenizeResponse, error)
+	DetokenizeFn func([]int) (string, error)
+
+	// waiting is returned by Waiting
+	waiting map[common.Priority]int
+}
+
+func (m *mockRunner) Score(_ context.Context, input string) ([]float32, error) {
+	return m.ScoreFn(input)
+}
+
+func (m *mockRunner) Embed(_ context.Context, inputs []string, pooling string) ([][]float32, error) {
+	return m.EmbedFn(inputs, pooling)
+}
+
+func (m *mockRunner) SaveSession(_ context.Context, req llm.SessionRequest) (int, error) {
+	return m.SessionFn(true, req)
+}
+
+func (m *mockRunner) LoadSession(_ context.Context, req llm.SessionRequest) (int, error) {
+	return m.SessionFn(false, req)
+}
+
+func (m *mockRunner) Encode(_ context.Context, req llm.TokenizeRequest) (*llm.TokenizeResponse, error) {
+	return m.EncodeFn(req)
+}
+
+func (m *mockRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	return m.DetokenizeFn(tokens)
 }
 
 func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
@@ -38,6 +82,10 @@ func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn
 	return nil
 }
 
+func (m *mockRunner) Waiting() map[common.Priority]int {
+	return m.waiting
+}
+
 func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
 	for range strings.Fields(s) {
 		tokens = append(tokens, len(tokens))
@@ -46,8 +94,8 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ api.Options, _ int) (llm.LlamaServer, error) {
+func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ string, _ api.Options, _ int) (llm.LlamaServer, error) {
 		return mock, nil
 	}
 }
@@ -586,6 +634,96 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("final tool call mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	t.Run("messages with tools (streaming deltas)", func(t *testing.T) {
+		tools := []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "get_weather"}}}
+
+		for _, tt := range []struct {
+			name   string
+			chunks []string
+			err    string
+		}{
+			{
+				name:   "complete",
+				chunks: []string{`{"name":"get_`, `weather","arguments":{"location":"Seattle`, `, WA"}}`},
+			},
+			{
+				name:   "truncated",
+				chunks: []string{`{"name":"get_`, `weather","arguments":{"location":"Seattle`},
+				err:    "unexpected end",
+			},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				streamRequest := true
+				mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+					for i, chunk := range tt.chunks {
+						fn(llm.CompletionResponse{Content: chunk, Done: i == len(tt.chunks)-1, DoneReason: "stop"})
+					}
+					return nil
+				}
+
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model:    "test-system",
+					Messages: []api.Message{{Role: "user", Content: "What's the weather in Seattle?"}},
+					Tools:    tools,
+					Stream:   &streamRequest,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				var name, arguments, errMsg string
+				var toolCalls []api.ToolCall
+				decoder := json.NewDecoder(w.Body)
+				for {
+					var resp struct {
+						api.ChatResponse
+						Error string `json:"error"`
+					}
+					if err := decoder.Decode(&resp); err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatal(err)
+					}
+
+					if resp.Message.Content != "" {
+						t.Errorf("expected no content, got %q", resp.Message.Content)
+					}
+
+					for _, d := range resp.Message.ToolCallDeltas {
+						name += d.Name
+						arguments += d.Arguments
+					}
+					toolCalls = append(toolCalls, resp.Message.ToolCalls...)
+					errMsg = resp.Error
+				}
+
+				if name != "get_weather" || !strings.HasPrefix(arguments, `{"location":"Seattle`) {
+					t.Errorf("expected deltas of get_weather, got %q %q", name, arguments)
+				}
+
+				if tt.err != "" {
+					if !strings.Contains(errMsg, tt.err) {
+						t.Errorf("expected final error %q, got %q", tt.err, errMsg)
+					}
+					return
+				}
+
+				if arguments != `{"location":"Seattle, WA"}` {
+					t.Errorf("expected complete arguments, got %q", arguments)
+				}
+
+				want := []api.ToolCall{{Function: api.ToolCallFunction{
+					Name:      "get_weather",
+					Arguments: api.ToolCallFunctionArguments{"location": "Seattle, WA"},
+				}}}
+				if diff := cmp.Diff(toolCalls, want); diff != "" {
+					t.Errorf("tool calls mismatch (-got +want):\n%s", diff)
+				}
+			})
+		}
+	})
 }
 
 func TestGenerate(t *testing.T) {
@@ -959,4 +1097,207 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:      "test-grammar",
+		From:       "test",
+		Parameters: map[string]any{"grammar": `root ::= "yes" | "no"`},
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("grammar", func(t *testing.T) {
+		for _, tt := range []struct {
+			name    string
+			req     api.GenerateRequest
+			grammar string
+			err     string
+		}{
+			{"model", api.GenerateRequest{Model: "test-grammar"}, `root ::= "yes" | "no"`, ""},
+			{"request", api.GenerateRequest{Model: "test-grammar", Grammar: `root ::= [0-9]+`}, `root ::= [0-9]+`, ""},
+			{"invalid", api.GenerateRequest{Model: "test", Grammar: `root ::= "yes`}, "", "invalid grammar: unterminated literal"},
+			{"format", api.GenerateRequest{Model: "test", Grammar: `root ::= "yes"`, Format: json.RawMessage(`"json"`)}, "", "format and grammar cannot both be set"},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				mock.CompletionRequest = llm.CompletionRequest{}
+
+				tt.req.Prompt = "Hello!"
+				tt.req.Stream = &stream
+				w := createRequest(t, s.GenerateHandler, tt.req)
+
+				if tt.err != "" {
+					if w.Code != http.StatusBadRequest {
+						t.Errorf("expected status 400, got %d", w.Code)
+					}
+
+					if !strings.Contains(w.Body.String(), tt.err) {
+						t.Errorf("expected error %q, got %s", tt.err, w.Body.String())
+					}
+
+					if mock.CompletionRequest.Options != nil {
+						t.Error("expected no completion")
+					}
+					return
+				}
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				if diff := cmp.Diff(mock.CompletionRequest.Options.Grammar, tt.grammar); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi", Logprobs: []api.Logprob{{TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.5}}}})
+			fn(llm.CompletionResponse{Content: "!", Logprobs: []api.Logprob{{TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -1}}}, Done: true})
+			return nil
+		}
+		defer func() { mock.CompletionFn = nil }()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"logprobs": true},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if !mock.CompletionRequest.Options.Logprobs {
+			t.Error("expected logprobs to be requested")
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []api.Logprob{
+			{TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.5}},
+			{TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -1}},
+		}
+		if diff := cmp.Diff(resp.Logprobs, want); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("beam search", func(t *testing.T) {
+		sequences := []api.BeamSequence{{Response: "Hi!", Logprob: -0.5}, {Response: "Hello!", Logprob: -1.5}}
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!"})
+			fn(llm.CompletionResponse{Sequences: sequences, Done: true})
+			return nil
+		}
+		defer func() { mock.CompletionFn = nil }()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"num_beams": 4, "return_sequences": 2},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if opts := mock.CompletionRequest.Options; opts.NumBeams != 4 || opts.ReturnSequences != 2 {
+			t.Errorf("have num_beams %d and return_sequences %d; want 4 and 2", opts.NumBeams, opts.ReturnSequences)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "Hi!" {
+			t.Errorf("have response %q; want %q", resp.Response, "Hi!")
+		}
+
+		if diff := cmp.Diff(resp.Sequences, sequences); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+	t.Run("cancel", func(t *testing.T) {
+		started := make(chan struct{})
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi"})
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		defer func() { mock.CompletionFn = nil }()
+
+		cancel := func(id string) int {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Params = gin.Params{{Key: "id", Value: id}}
+			s.CancelGenerateHandler(c)
+			return w.Code
+		}
+
+		if code := cancel("unknown"); code != http.StatusNotFound {
+			t.Errorf("have status %d for an unknown request; want %d", code, http.StatusNotFound)
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			<-started
+			if _, _, _, err := s.startRequest(context.Background(), "request"); err == nil {
+				errc <- errors.New("started a second request with the same ID")
+				return
+			}
+
+			if code := cancel("request"); code != http.StatusOK {
+				errc <- fmt.Errorf("have status %d; want %d", code, http.StatusOK)
+				return
+			}
+			errc <- nil
+		}()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			ID:     "request",
+		})
+
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+
+		var responses []api.GenerateResponse
+		for dec := json.NewDecoder(w.Body); ; {
+			var resp api.GenerateResponse
+			if err := dec.Decode(&resp); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			responses = append(responses, resp)
+		}
+
+		if len(responses) != 2 || responses[0].Response != "Hi" || responses[1].DoneReason != "cancel" || !responses[1].Done {
+			t.Fatalf("have responses %+v; want a response and then done for the cancellation", responses)
+		}
+
+		for _, resp := range responses {
+			if resp.ID != "request" {
+				t.Errorf("have ID %q; want %q", resp.ID, "request")
+			}
+		}
+
+		// the request is no longer in progress once it ends
+		if code := cancel("request"); code != http.StatusNotFound {
+			t.Errorf("have status %d for an ended request; want %d", code, http.StatusNotFound)
+		}
+	})
 }
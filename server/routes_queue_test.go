@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/runner/common"
+)
+
+func TestQueue(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MAX_QUEUE", "2")
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:         true,
+			DoneReason:   "stop",
+			EvalCount:    100,
+			EvalDuration: 10 * time.Second,
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "test",
+		Files:    map[string]string{"file.gguf": digest},
+		Template: `{{ .Prompt }}`,
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	// requests have generated 100 tokens in 10 seconds
+	s.sched.throughput.record(100, 10*time.Second)
+
+	t.Run("full", func(t *testing.T) {
+		mock.waiting = map[common.Priority]int{common.PriorityNormal: 1, common.PriorityLow: 1}
+		t.Cleanup(func() { mock.waiting = nil })
+
+		for _, tt := range []struct {
+			name string
+			fn   func(*gin.Context)
+			body any
+		}{
+			{"generate", s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!"}},
+			{"chat", s.ChatHandler, api.ChatRequest{Model: "test", Messages: []api.Message{{Role: "user", Content: "Hello!"}}}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, tt.fn, tt.body)
+				if w.Code != http.StatusTooManyRequests {
+					t.Fatalf("expected status 429, got %d: %s", w.Code, w.Body)
+				}
+
+				// the two requests waiting take 10 seconds each
+				if retryAfter := w.Header().Get("Retry-After"); retryAfter != "20" {
+					t.Errorf("expected Retry-After 20, got %q", retryAfter)
+				}
+			})
+		}
+	})
+
+	t.Run("queued", func(t *testing.T) {
+		mock.CompletionFn = func(_ context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			r.Queued(3)
+			fn(mock.CompletionResponse)
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		now := time.Now()
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", Prompt: "Hello!"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var responses []api.GenerateResponse
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var resp api.GenerateResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			responses = append(responses, resp)
+		}
+
+		if len(responses) != 2 {
+			t.Fatalf("expected 2 responses, got %d", len(responses))
+		}
+
+		queued := responses[0].Queued
+		if queued == nil || queued.Position != 3 || responses[0].Done {
+			t.Fatalf("expected a status at position 3 before the response, got %+v", responses[0])
+		}
+
+		// the requests ahead of it take about 30 seconds
+		if start := queued.EstimatedStart.Sub(now); start < 29*time.Second || start > 31*time.Second {
+			t.Errorf("expected to start in about 30 seconds, got %v", start)
+		}
+
+		if responses[1].Queued != nil || !responses[1].Done {
+			t.Errorf("expected the final response, got %+v", responses[1])
+		}
+	})
+}
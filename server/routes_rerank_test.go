@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+)
+
+func TestRerank(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mu sync.Mutex
+	var prompts []string
+	mock := mockRunner{
+		// score by the number of times the document repeats the query
+		ScoreFn: func(prompt string) ([]float32, error) {
+			query, document, _ := strings.Cut(prompt, " [SEP] ")
+			mu.Lock()
+			prompts = append(prompts, prompt)
+			mu.Unlock()
+			return []float32{float32(strings.Count(document, query))}, nil
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture": "bert",
+		"bert.pooling_type":    uint32(2),
+	}, []ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	for name, template := range map[string]string{
+		"reranker": `{{ .Query }} [SEP] {{ .Document }}`,
+		"embedder": `{{ .Prompt }}`,
+	} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:    name,
+			Files:    map[string]string{"file.gguf": digest},
+			Template: template,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	t.Run("missing query", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "reranker", Documents: []string{"a"}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing capability", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "embedder", Query: "a", Documents: []string{"a"}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"registry.ollama.ai/library/embedder:latest does not support rerank"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	documents := []string{"panda", "panda panda panda", "bear", "panda panda"}
+
+	cases := []struct {
+		name string
+		topN int
+		want []api.RerankResult
+	}{
+		{"all", 0, []api.RerankResult{
+			{Index: 1, Document: "panda panda panda", RelevanceScore: 3},
+			{Index: 3, Document: "panda panda", RelevanceScore: 2},
+			{Index: 0, Document: "panda", RelevanceScore: 1},
+			{Index: 2, Document: "bear", RelevanceScore: 0},
+		}},
+		{"top n", 2, []api.RerankResult{
+			{Index: 1, Document: "panda panda panda", RelevanceScore: 3},
+			{Index: 3, Document: "panda panda", RelevanceScore: 2},
+		}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			prompts = nil
+
+			w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "reranker", Query: "panda", Documents: documents, TopN: tt.topN})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.RerankResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(resp.Results, tt.want); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if len(prompts) != len(documents) || !strings.HasPrefix(prompts[0], "panda [SEP] ") {
+				t.Errorf("unexpected prompts %q", prompts)
+			}
+		})
+	}
+
+	t.Run("score error", func(t *testing.T) {
+		mock.ScoreFn = func(string) ([]float32, error) { return nil, errors.New("failed") }
+
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{Model: "reranker", Query: "a", Documents: []string{"a"}})
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected status 500, got %d", w.Code)
+		}
+	})
+}
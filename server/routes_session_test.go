@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var saved, loaded llm.SessionRequest
+	mock := mockRunner{
+		SessionFn: func(save bool, req llm.SessionRequest) (int, error) {
+			if !save {
+				loaded = req
+				if req.Digest != saved.Digest {
+					return 0, fmt.Errorf("%w: saved with a different model", llm.ErrInvalidSession)
+				}
+				return 3, nil
+			}
+
+			saved = req
+			return 3, os.WriteFile(req.Path, []byte("session"), 0o644)
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture": "llama",
+		"llama.block_count":    uint32(1),
+	}, []ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	for _, name := range []string{"", "..", ".hidden", "a/b", `a\b`} {
+		t.Run("invalid name "+name, func(t *testing.T) {
+			w := createRequest(t, s.SaveSessionHandler, api.SessionRequest{Model: "test", Session: name})
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		w := createRequest(t, s.LoadSessionHandler, api.SessionRequest{Model: "test", Session: "missing"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		w := createRequest(t, s.SaveSessionHandler, api.SessionRequest{Model: "test", Session: "agent-1.v2", Prompt: "system"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.SessionResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Session != "agent-1.v2" || resp.Tokens != 3 {
+			t.Errorf("unexpected response %+v", resp)
+		}
+
+		if saved.Prompt != "system" || filepath.Base(saved.Path) != "agent-1.v2" || filepath.Base(filepath.Dir(saved.Path)) != "sessions" {
+			t.Errorf("unexpected session request %+v", saved)
+		}
+
+		// sessions are tied to the blob of the weights
+		if !strings.HasPrefix(saved.Digest, "sha256-") {
+			t.Errorf("unexpected digest %q", saved.Digest)
+		}
+
+		w = createRequest(t, s.LoadSessionHandler, api.SessionRequest{Model: "test", Session: "agent-1.v2"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if loaded.Path != saved.Path || loaded.Digest != saved.Digest {
+			t.Errorf("loaded %+v; saved %+v", loaded, saved)
+		}
+	})
+
+	t.Run("invalid session", func(t *testing.T) {
+		saved.Digest = "sha256-other"
+
+		w := createRequest(t, s.LoadSessionHandler, api.SessionRequest{Model: "test", Session: "agent-1.v2"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestTokenize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// each word is a token whose id is its length, after a BOS of 0
+	mock := mockRunner{
+		EncodeFn: func(req llm.TokenizeRequest) (*llm.TokenizeResponse, error) {
+			var resp llm.TokenizeResponse
+			if req.AddSpecial {
+				resp.Tokens = append(resp.Tokens, 0)
+			}
+
+			for _, word := range strings.Fields(req.Content) {
+				resp.Tokens = append(resp.Tokens, len(word))
+				if req.Pieces {
+					resp.Pieces = append(resp.Pieces, word)
+				}
+			}
+
+			return &resp, nil
+		},
+		DetokenizeFn: func(tokens []int) (string, error) {
+			words := make([]string, len(tokens))
+			for i, token := range tokens {
+				if token < 1 {
+					return "", errors.New("invalid token")
+				}
+
+				words[i] = strings.Repeat("a", token)
+			}
+
+			return strings.Join(words, " "), nil
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	// an embedding model can be tokenized as well as one that generates
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture": "bert",
+		"bert.pooling_type":    uint32(1),
+		"bert.block_count":     uint32(1),
+	}, []ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	cases := []struct {
+		name string
+		req  api.TokenizeRequest
+		want api.TokenizeResponse
+	}{
+		{"tokens", api.TokenizeRequest{Content: "the quick fox"}, api.TokenizeResponse{Tokens: []int{3, 5, 3}}},
+		{"add special", api.TokenizeRequest{Content: "the quick fox", AddSpecial: true}, api.TokenizeResponse{Tokens: []int{0, 3, 5, 3}}},
+		{"pieces", api.TokenizeRequest{Content: "the quick", Pieces: true}, api.TokenizeResponse{Tokens: []int{3, 5}, Pieces: []string{"the", "quick"}}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Model = "test"
+			w := createRequest(t, s.TokenizeHandler, tt.req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp api.TokenizeResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Model != "test" || !slices.Equal(resp.Tokens, tt.want.Tokens) || !slices.Equal(resp.Pieces, tt.want.Pieces) {
+				t.Errorf("have %+v; want %+v", resp, tt.want)
+			}
+		})
+	}
+
+	t.Run("detokenize", func(t *testing.T) {
+		w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{Model: "test", Tokens: []int{3, 1}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.DetokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Model != "test" || resp.Content != "aaa a" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{Model: "test", Tokens: []int{-1}})
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected status 500, got %d", w.Code)
+		}
+	})
+
+	t.Run("model not found", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{Model: "missing", Content: "the"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,6 +22,7 @@ import (
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/runner/common"
 )
 
 type LlmRequest struct {
@@ -31,10 +34,134 @@ type LlmRequest struct {
 	successCh       chan *runnerRef
 	errCh           chan error
 	schedAttempts   uint
+
+	// priority is that of the request, which arrived at since
+	priority common.Priority
+	since    time.Time
+}
+
+// pendingQueue has the requests waiting to be scheduled. Requests are taken
+// in order of their priority, aged by how long they've waited, and then in
+// the order they arrived.
+type pendingQueue struct {
+	mu       sync.Mutex
+	requests []*LlmRequest
+}
+
+// push queues req unless it's already queued
+func (q *pendingQueue) push(req *LlmRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !slices.Contains(q.requests, req) {
+		q.requests = append(q.requests, req)
+	}
+}
+
+// remove removes req from the queue
+func (q *pendingQueue) remove(req *LlmRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.requests = slices.DeleteFunc(q.requests, func(r *LlmRequest) bool { return r == req })
+}
+
+// pop removes and returns the next request, or nil if the queue is empty.
+// Aging changes the order of the requests as they wait, so it searches all
+// of them.
+func (q *pendingQueue) pop() *LlmRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.requests) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	aged := func(req *LlmRequest) common.Priority {
+		return req.priority.Aged(now.Sub(req.since))
+	}
+
+	next := 0
+	for i, req := range q.requests[1:] {
+		if cmp.Or(cmp.Compare(aged(q.requests[next]), aged(req)), req.since.Compare(q.requests[next].since)) < 0 {
+			next = i + 1
+		}
+	}
+
+	req := q.requests[next]
+	q.requests = slices.Delete(q.requests, next, next+1)
+	return req
+}
+
+// depths returns the number of queued requests of each priority
+func (q *pendingQueue) depths() map[common.Priority]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	depths := make(map[common.Priority]int)
+	for _, req := range q.requests {
+		depths[req.priority]++
+	}
+
+	return depths
+}
+
+// throughput tracks the rate at which requests are served, to estimate how
+// long queued requests wait. The rates are moving averages of the requests
+// that have completed.
+type throughput struct {
+	mu sync.Mutex
+
+	// tokensPerSecond is the rate at which tokens are generated and
+	// tokensPerRequest the number generated for each request
+	tokensPerSecond  float64
+	tokensPerRequest float64
+}
+
+// throughputWeight is the weight of each completed request in the moving
+// averages of throughput
+const throughputWeight = 0.1
+
+// record records a request that generated tokens in d
+func (t *throughput) record(tokens int, d time.Duration) {
+	if tokens <= 0 || d <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rate := float64(tokens) / d.Seconds()
+	if t.tokensPerSecond == 0 {
+		t.tokensPerSecond, t.tokensPerRequest = rate, float64(tokens)
+		return
+	}
+
+	t.tokensPerSecond += throughputWeight * (rate - t.tokensPerSecond)
+	t.tokensPerRequest += throughputWeight * (float64(tokens) - t.tokensPerRequest)
+}
+
+// wait estimates how long it takes to serve n requests, assuming a second
+// for each until a request has completed
+func (t *throughput) wait(n int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	perRequest := time.Second
+	if t.tokensPerSecond > 0 {
+		perRequest = time.Duration(t.tokensPerRequest / t.tokensPerSecond * float64(time.Second))
+	}
+
+	return time.Duration(n) * perRequest
 }
 
 type Scheduler struct {
+	// pendingReqCh has a request for each one in queue, which are taken
+	// in order of priority rather than in the order they're sent
 	pendingReqCh  chan *LlmRequest
+	queue         pendingQueue
+	throughput    throughput
 	finishedReqCh chan *LlmRequest
 	expiredCh     chan *runnerRef
 	unloadedCh    chan interface{}
@@ -43,7 +170,7 @@ type Scheduler struct {
 	loadedMu sync.Mutex
 
 	loadFn       func(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel int)
-	newServerFn  func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
+	newServerFn  func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() discover.GpuInfoList
 	getCpuFn     func() discover.GpuInfoList
 	reschedDelay time.Duration
@@ -61,6 +188,15 @@ var defaultParallel = 4
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+// maxQueueError is ErrMaxQueue with when to retry the request
+type maxQueueError struct {
+	retryAfter time.Duration
+}
+
+func (e maxQueueError) Error() string { return ErrMaxQueue.Error() }
+
+func (e maxQueueError) Unwrap() error { return ErrMaxQueue }
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
@@ -92,11 +228,14 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
 	}
+	req.priority, req.since = common.PriorityFrom(c)
 
+	s.queue.push(req)
 	select {
 	case s.pendingReqCh <- req:
 	default:
-		req.errCh <- ErrMaxQueue
+		s.queue.remove(req)
+		req.errCh <- maxQueueError{retryAfter: s.throughput.wait(len(s.pendingReqCh))}
 	}
 	return req.successCh, req.errCh
 }
@@ -120,6 +259,12 @@ func (s *Scheduler) processPending(ctx context.Context) {
 			slog.Debug("shutting down scheduler pending loop")
 			return
 		case pending := <-s.pendingReqCh:
+			// requests are queued before they're sent, so take the one of
+			// the highest priority, or the one that was sent if it wasn't
+			if next := s.queue.pop(); next != nil {
+				pending = next
+			}
+
 			// Block other requests until we get this pending request running
 			pending.schedAttempts++
 			if pending.origNumCtx == 0 {
@@ -213,7 +358,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 							s.loadFn(pending, ggml, gpus, numParallel)
 							break
 						}
-						runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus)
+						runnerToExpire = s.maybeFindCPURunnerToUnload(pending, ggml, gpus, numParallel)
 						if runnerToExpire == nil {
 							slog.Debug("cpu mode with available system memory or first model, loading")
 							s.loadFn(pending, ggml, gpus, numParallel)
@@ -266,6 +411,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 								// the scheduler if our queue is full
 								slog.Debug("delaying scheduling while other models finish loading", "attempts", pending.schedAttempts, "model", pending.model.ModelPath)
 								time.Sleep(s.reschedDelay)
+								s.queue.push(pending)
 								s.pendingReqCh <- pending
 							}()
 							break
@@ -418,7 +564,7 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
-	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
+	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, numParallel)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
@@ -601,6 +747,7 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	defer cancel()
 	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
 		!reflect.DeepEqual(runner.model.ProjectorPaths, req.model.ProjectorPaths) || // have the projectors changed?
+		runner.model.DraftPath != req.model.DraftPath || // has the draft model changed?
 		!reflect.DeepEqual(optsExisting, optsNew) || // have the runner options changed?
 		runner.llama.Ping(ctx) != nil {
 		return true
@@ -711,7 +858,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 			req.opts.NumCtx = req.origNumCtx * p
 			if !envconfig.SchedSpread() {
 				for _, g := range sgl {
-					if ok, estimatedVRAM = llm.PredictServerFit([]discover.GpuInfo{g}, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
+					if ok, estimatedVRAM = llm.PredictServerFit([]discover.GpuInfo{g}, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, p); ok {
 						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
 						*numParallel = p
 						return []discover.GpuInfo{g}
@@ -727,7 +874,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 		// Now try all the GPUs
 		for _, p := range numParallelToTry {
 			req.opts.NumCtx = req.origNumCtx * p
-			if ok, estimatedVRAM = llm.PredictServerFit(sgl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
+			if ok, estimatedVRAM = llm.PredictServerFit(sgl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, p); ok {
 				slog.Info("new model will fit in available VRAM, loading", "model", req.model.ModelPath, "library", sgl[0].Library, "parallel", p, "required", format.HumanBytes2(estimatedVRAM))
 				*numParallel = p
 				return sgl
@@ -750,7 +897,7 @@ func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.Gp
 	var bestEstimate uint64
 	var bestFit int
 	for i, gl := range byLibrary {
-		_, estimatedVRAM := llm.PredictServerFit(gl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts)
+		_, estimatedVRAM := llm.PredictServerFit(gl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, *numParallel)
 		if estimatedVRAM > bestEstimate {
 			bestEstimate = estimatedVRAM
 			bestFit = i
@@ -823,9 +970,9 @@ func (s *Scheduler) expireRunner(model *Model) {
 
 // If other runners are loaded, make sure the pending request will fit in system memory
 // If not, pick a runner to unload, else return nil and the request can be loaded
-func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList) *runnerRef {
+func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel int) *runnerRef {
 	slog.Debug("evaluating if CPU model load will fit in available system memory")
-	estimate := llm.EstimateGPULayers(gpus, f, req.model.ProjectorPaths, req.opts)
+	estimate := llm.EstimateGPULayers(gpus, f, req.model.ProjectorPaths, req.model.DraftPath, req.opts, numParallel)
 	if estimate.TotalSize <= gpus[0].FreeMemory {
 		slog.Debug("cpu inference mode, model fits in available system memory", "model", format.HumanBytes2(estimate.TotalSize), "available", format.HumanBytes2(gpus[0].FreeMemory))
 		return nil
@@ -17,6 +17,7 @@ import (
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/runner/common"
 )
 
 func TestMain(m *testing.M) {
@@ -48,7 +49,7 @@ func TestLoad(t *testing.T) {
 		sessionDuration: &api.Duration{Duration: 2 * time.Second},
 	}
 	// Fail to load model first
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return nil, errors.New("something failed to load model blah")
 	}
 	gpus := discover.GpuInfoList{}
@@ -62,7 +63,7 @@ func TestLoad(t *testing.T) {
 	require.Contains(t, err.Error(), "this model may be incompatible")
 
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, f, gpus, 0)
@@ -103,7 +104,7 @@ type reqBundle struct {
 	f       *ggml.GGML
 }
 
-func (scenario *reqBundle) newServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (scenario *reqBundle) newServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 	return scenario.srv, nil
 }
 
@@ -407,6 +408,47 @@ func TestGetRunner(t *testing.T) {
 	b.ctxDone()
 }
 
+func TestGetRunnerPriority(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	t.Setenv("OLLAMA_MAX_QUEUE", "3")
+	s := InitScheduler(ctx)
+
+	// requests are taken from the queue by priority, then in the order they
+	// arrived
+	var reqs []*LlmRequest
+	for _, p := range []common.Priority{common.PriorityLow, common.PriorityNormal, common.PriorityHigh} {
+		s.GetRunner(common.WithPriority(ctx, p), &Model{}, api.Options{}, nil)
+		reqs = append(reqs, s.queue.requests[len(s.queue.requests)-1])
+	}
+
+	require.Equal(t, map[common.Priority]int{common.PriorityLow: 1, common.PriorityNormal: 1, common.PriorityHigh: 1}, s.queue.depths())
+
+	// a request that doesn't fit in the queue isn't queued
+	_, errCh := s.GetRunner(ctx, &Model{}, api.Options{}, nil)
+	require.ErrorIs(t, <-errCh, ErrMaxQueue)
+	require.Len(t, s.queue.requests, 3)
+
+	for _, want := range []*LlmRequest{reqs[2], reqs[1], reqs[0]} {
+		<-s.pendingReqCh
+		require.Same(t, want, s.queue.pop())
+	}
+
+	require.Nil(t, s.queue.pop())
+
+	// requests of low priority that have waited long enough are taken before
+	// those of higher priorities that just arrived
+	low := &LlmRequest{priority: common.PriorityLow, since: time.Now().Add(-2 * common.AgingInterval)}
+	high := &LlmRequest{priority: common.PriorityHigh, since: time.Now()}
+	s.queue.push(high)
+	s.queue.push(low)
+	s.queue.push(low)
+	require.Len(t, s.queue.requests, 2)
+	require.Same(t, low, s.queue.pop())
+	require.Same(t, high, s.queue.pop())
+}
+
 func TestExpireRunner(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 20*time.Millisecond)
 	defer done()
@@ -423,7 +465,7 @@ func TestExpireRunner(t *testing.T) {
 	var f *ggml.GGML
 	gpus := discover.GpuInfoList{}
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, f, gpus, 0)
@@ -660,6 +702,9 @@ func TestNeedsReload(t *testing.T) {
 	req.opts.NumGPU = -1
 	resp = runner.needsReload(ctx, req)
 	require.False(t, resp)
+	req.model.DraftPath = "draft1"
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
 }
 
 func TestUnloadAllRunners(t *testing.T) {
@@ -730,9 +775,9 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 	s.getCpuFn = getCpuFn
 	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		require.Len(t, gpus, 1)
-		return a.newServer(gpus, model, f, adapters, projectors, opts, numParallel)
+		return a.newServer(gpus, model, f, adapters, projectors, draft, opts, numParallel)
 	}
 	slog.Info("a")
 	s.pendingReqCh <- a.req
@@ -754,8 +799,12 @@ type mockLlm struct {
 	pingResp           error
 	waitResp           error
 	completionResp     error
-	embeddingResp      []float32
+	embeddingResp      [][]float32
 	embeddingRespErr   error
+	scoreResp          []float32
+	scoreRespErr       error
+	sessionResp        int
+	sessionRespErr     error
 	tokenizeResp       []int
 	tokenizeRespErr    error
 	detokenizeResp     string
@@ -773,14 +822,30 @@ func (s *mockLlm) Completion(ctx context.Context, req llm.CompletionRequest, fn
 	return s.completionResp
 }
 
-func (s *mockLlm) Embedding(ctx context.Context, input string) ([]float32, error) {
+func (s *mockLlm) Embed(ctx context.Context, inputs []string, pooling string) ([][]float32, error) {
 	return s.embeddingResp, s.embeddingRespErr
 }
 
+func (s *mockLlm) Score(ctx context.Context, input string) ([]float32, error) {
+	return s.scoreResp, s.scoreRespErr
+}
+
+func (s *mockLlm) SaveSession(ctx context.Context, req llm.SessionRequest) (int, error) {
+	return s.sessionResp, s.sessionRespErr
+}
+
+func (s *mockLlm) LoadSession(ctx context.Context, req llm.SessionRequest) (int, error) {
+	return s.sessionResp, s.sessionRespErr
+}
+
 func (s *mockLlm) Tokenize(ctx context.Context, content string) ([]int, error) {
 	return s.tokenizeResp, s.tokenizeRespErr
 }
 
+func (s *mockLlm) Encode(ctx context.Context, req llm.TokenizeRequest) (*llm.TokenizeResponse, error) {
+	return &llm.TokenizeResponse{Tokens: s.tokenizeResp}, s.tokenizeRespErr
+}
+
 func (s *mockLlm) Detokenize(ctx context.Context, tokens []int) (string, error) {
 	return s.detokenizeResp, s.detonekizeRespErr
 }
@@ -792,3 +857,4 @@ func (s *mockLlm) Close() error {
 func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVRAM }
 func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
 func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
+func (s *mockLlm) Waiting() map[common.Priority]int       { return nil }
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template/parse"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+// toolParser parses the tool calls of a response as it's streamed, using the
+// format of tool calls in the model's template. Content outside of tool calls
+// is passed through, while the tool calls are returned as deltas as they're
+// generated and as complete calls once their JSON is.
+type toolParser struct {
+	// prefix opens the tool calls of a response, such as [TOOL_CALLS] or
+	// <tool_call>. If it's empty, the response must start with the tool
+	// calls.
+	prefix string
+
+	// suffix closes the tool calls, such as </tool_call>, if the template
+	// has one
+	suffix string
+
+	// name and arguments are the keys of the name and arguments of a call
+	name, arguments string
+
+	// pending is text that may be the start of prefix or suffix
+	pending string
+
+	// started is set once the response has content other than whitespace
+	started bool
+
+	// inTools is set between prefix and suffix
+	inTools bool
+
+	// index is that of the current call
+	index int
+
+	// call is the JSON of the current call, which is nil between calls
+	call []byte
+
+	depth             int
+	inString, escaped bool
+
+	// stringStart is the offset in call of the last string at depth 1, which
+	// is a key unless it follows a colon
+	stringStart int
+	colon       bool
+	key         string
+
+	// callName is the name of the current call once it's been parsed
+	callName string
+	nameSent bool
+
+	// argumentsStart and argumentsEnd are the offsets of the arguments in
+	// call, which are -1 until they're found, and argumentsSent is the
+	// offset of the end of the arguments that have been returned as deltas
+	argumentsStart, argumentsEnd, argumentsSent int
+
+	// err is the first invalid tool call
+	err error
+}
+
+// toolParser returns a toolParser for the tool calls of the model's template,
+// or nil if the template doesn't have tool calls
+func (m *Model) toolParser() *toolParser {
+	out, name, arguments, ok := m.toolCallTemplate()
+	if !ok {
+		return nil
+	}
+
+	// the text of the template around the node that ranges over .ToolCalls
+	// opens and closes the tool calls, along with the text around each call
+	var before, after string
+	var walk func(parse.Node) bool
+	walk = func(n parse.Node) bool {
+		switch t := n.(type) {
+		case *parse.ListNode:
+			if t == nil {
+				return false
+			}
+
+			for i, c := range t.Nodes {
+				if r, ok := c.(*parse.RangeNode); ok && slices.Contains(template.Identifiers(r.Pipe), "ToolCalls") {
+					for j := i - 1; j >= 0; j-- {
+						text, ok := t.Nodes[j].(*parse.TextNode)
+						if !ok {
+							break
+						}
+						before = string(text.Text) + before
+					}
+
+					for _, n := range t.Nodes[i+1:] {
+						text, ok := n.(*parse.TextNode)
+						if !ok {
+							break
+						}
+						after += string(text.Text)
+					}
+					return true
+				}
+
+				if walk(c) {
+					return true
+				}
+			}
+		case *parse.IfNode:
+			return walk(t.List) || walk(t.ElseList)
+		case *parse.WithNode:
+			return walk(t.List) || walk(t.ElseList)
+		case *parse.RangeNode:
+			return walk(t.List) || walk(t.ElseList)
+		}
+
+		return false
+	}
+	walk(m.Template.Tree.Root)
+
+	before += out[:strings.Index(out, "{")]
+	after = out[strings.LastIndex(out, "}")+1:] + after
+
+	// only the line of the text next to the calls is generated by the
+	// model, as the rest may be part of the prompt
+	before = strings.TrimRight(before, " \t\r\n[")
+	before = strings.TrimSpace(before[strings.LastIndex(before, "\n")+1:])
+
+	after = strings.TrimLeft(after, " \t\r\n]}")
+	after, _, _ = strings.Cut(after, "\n")
+
+	return &toolParser{
+		prefix:         before,
+		suffix:         strings.TrimSpace(after),
+		name:           name,
+		arguments:      arguments,
+		argumentsStart: -1,
+		argumentsEnd:   -1,
+	}
+}
+
+// Add parses the next text of the response, returning its content outside of
+// tool calls, the deltas of the tool calls in it and the calls that it
+// completes. Text that may open a tool call is held back until it's known
+// whether it does.
+func (p *toolParser) Add(s string) (content string, deltas []api.ToolCallDelta, calls []api.ToolCall) {
+	p.pending += s
+
+	var sb strings.Builder
+	for p.pending != "" {
+		if p.call != nil {
+			n := p.scan(p.pending)
+			p.pending = p.pending[n:]
+
+			if delta, ok := p.delta(); ok {
+				deltas = append(deltas, delta)
+			}
+
+			if p.depth == 0 {
+				if call, ok := p.finish(); ok {
+					calls = append(calls, call)
+				}
+			}
+			continue
+		}
+
+		if p.inTools {
+			// skip the text between calls, such as the brackets of an array
+			p.pending = strings.TrimLeft(p.pending, " \t\r\n,[]}")
+			switch {
+			case p.pending == "":
+			case p.pending[0] == '{':
+				p.call = []byte{}
+			case p.prefix != "" && strings.HasPrefix(p.pending, p.prefix):
+				p.pending = p.pending[len(p.prefix):]
+			case p.suffix != "" && strings.HasPrefix(p.pending, p.suffix):
+				p.pending = p.pending[len(p.suffix):]
+				p.inTools = false
+			case strings.HasPrefix(p.prefix, p.pending) || strings.HasPrefix(p.suffix, p.pending):
+				return sb.String(), deltas, calls
+			default:
+				p.inTools = false
+			}
+			continue
+		}
+
+		if p.prefix == "" {
+			if !p.started {
+				trimmed := strings.TrimLeft(p.pending, " \t\r\n")
+				if trimmed == "" {
+					break
+				}
+
+				p.started = true
+				if trimmed[0] == '{' || trimmed[0] == '[' {
+					p.pending, p.inTools = trimmed, true
+					continue
+				}
+			}
+
+			sb.WriteString(p.pending)
+			p.pending = ""
+			break
+		}
+
+		if i := strings.Index(p.pending, p.prefix); i >= 0 {
+			sb.WriteString(p.pending[:i])
+			p.pending, p.inTools = p.pending[i+len(p.prefix):], true
+			continue
+		}
+
+		// hold back the end of the text that may be the start of prefix
+		n := len(p.pending)
+		for i := range p.pending {
+			if strings.HasPrefix(p.prefix, p.pending[i:]) {
+				n = i
+				break
+			}
+		}
+
+		sb.WriteString(p.pending[:n])
+		p.pending = p.pending[n:]
+		break
+	}
+
+	return sb.String(), deltas, calls
+}
+
+// Done returns the content held back at the end of the response, or an error
+// if a tool call is invalid or incomplete
+func (p *toolParser) Done() (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+
+	if p.call != nil {
+		return "", fmt.Errorf("invalid tool call: unexpected end of response in %s", p.call)
+	}
+
+	content := p.pending
+	if p.inTools {
+		content = ""
+	}
+
+	p.pending = ""
+	return content, nil
+}
+
+// scan appends s to the current call until its JSON is complete, returning
+// the length of s that's part of the call
+func (p *toolParser) scan(s string) int {
+	for i := range len(s) {
+		c := s[i]
+		p.call = append(p.call, c)
+
+		depth := p.depth
+		if p.inString {
+			switch {
+			case p.escaped:
+				p.escaped = false
+			case c == '\\':
+				p.escaped = true
+			case c == '"':
+				p.inString = false
+				if depth == 1 {
+					var str string
+					if err := json.Unmarshal(p.call[p.stringStart:], &str); err == nil {
+						if !p.colon {
+							p.key = str
+						} else if p.key == p.name {
+							p.callName = str
+						}
+					}
+				}
+			}
+			continue
+		}
+
+		if depth == 1 && p.colon && p.key == p.arguments && p.argumentsStart < 0 && !strings.ContainsRune(" \t\r\n", rune(c)) {
+			p.argumentsStart = len(p.call) - 1
+		}
+
+		switch c {
+		case '"':
+			p.inString = true
+			p.stringStart = len(p.call) - 1
+		case '{', '[':
+			p.depth++
+		case '}', ']':
+			p.depth--
+		case ':':
+			if depth == 1 {
+				p.colon = true
+			}
+		}
+
+		// a comma or the end of the call ends the value of a key
+		if depth == 1 && (c == ',' || p.depth == 0) {
+			if p.key == p.arguments && p.argumentsStart >= 0 && p.argumentsEnd < 0 {
+				p.argumentsEnd = len(p.call) - 1
+			}
+			p.key, p.colon = "", false
+		}
+
+		if p.depth == 0 {
+			return i + 1
+		}
+	}
+
+	return len(s)
+}
+
+// delta returns the part of the current call that hasn't been returned yet.
+// Deltas start once the name of the call is known, which is usually before
+// its arguments.
+func (p *toolParser) delta() (api.ToolCallDelta, bool) {
+	if p.callName == "" {
+		return api.ToolCallDelta{}, false
+	}
+
+	delta := api.ToolCallDelta{Index: p.index}
+	if !p.nameSent {
+		delta.Name, p.nameSent = p.callName, true
+	}
+
+	if p.argumentsStart >= 0 {
+		end := len(p.call)
+		if p.argumentsEnd >= 0 {
+			end = p.argumentsEnd
+		}
+
+		start := max(p.argumentsSent, p.argumentsStart)
+		if end > start {
+			delta.Arguments = string(p.call[start:end])
+		}
+		p.argumentsSent = end
+	}
+
+	return delta, delta.Name != "" || delta.Arguments != ""
+}
+
+// finish parses the complete JSON of the current call and resets the parser
+// for the next call
+func (p *toolParser) finish() (api.ToolCall, bool) {
+	defer func() {
+		*p = toolParser{
+			prefix:         p.prefix,
+			suffix:         p.suffix,
+			name:           p.name,
+			arguments:      p.arguments,
+			pending:        p.pending,
+			started:        p.started,
+			inTools:        p.inTools,
+			index:          p.index,
+			argumentsStart: -1,
+			argumentsEnd:   -1,
+			err:            p.err,
+		}
+	}()
+
+	var obj map[string]any
+	if err := json.Unmarshal(p.call, &obj); err != nil {
+		p.err = cmp.Or(p.err, fmt.Errorf("invalid tool call %s: %w", p.call, err))
+		return api.ToolCall{}, false
+	}
+
+	name, nok := obj[p.name].(string)
+	arguments, aok := obj[p.arguments].(map[string]any)
+	if !nok || !aok {
+		p.err = cmp.Or(p.err, fmt.Errorf("invalid tool call %s: missing name or arguments", p.call))
+		return api.ToolCall{}, false
+	}
+
+	call := api.ToolCall{
+		Function: api.ToolCallFunction{
+			Index:     p.index,
+			Name:      name,
+			Arguments: arguments,
+		},
+	}
+
+	p.index++
+	return call, true
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/template"
+)
+
+// streamToolCalls parses the chunks of a response with the parser of the
+// model's template, returning its content, the deltas and calls of each
+// chunk and the error at the end of the response
+func streamToolCalls(t *testing.T, m *Model, chunks []string) (string, [][]api.ToolCallDelta, [][]api.ToolCall, error) {
+	t.Helper()
+
+	p := m.toolParser()
+	if p == nil {
+		t.Fatal("expected a tool parser")
+	}
+
+	var sb strings.Builder
+	var deltas [][]api.ToolCallDelta
+	var calls [][]api.ToolCall
+	for _, chunk := range chunks {
+		content, d, c := p.Add(chunk)
+		sb.WriteString(content)
+		deltas = append(deltas, d)
+		calls = append(calls, c)
+	}
+
+	content, err := p.Done()
+	sb.WriteString(content)
+	return sb.String(), deltas, calls, err
+}
+
+func TestToolParser(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+
+	calls := []api.ToolCall{
+		{
+			Function: api.ToolCallFunction{
+				Index: 0,
+				Name:  "get_current_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"format":   "fahrenheit",
+					"location": "San Francisco, CA",
+				},
+			},
+		},
+		{
+			Function: api.ToolCallFunction{
+				Index: 1,
+				Name:  "get_current_weather",
+				Arguments: api.ToolCallFunctionArguments{
+					"format":   "celsius",
+					"location": "Toronto, Canada",
+				},
+			},
+		},
+	}
+
+	for _, model := range []string{"mistral", "llama3-groq-tool-use"} {
+		t.Run(model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Model{Template: tmpl}
+
+			// the chunks of a response of the model with two tool calls
+			var chunks []string
+			if err := json.Unmarshal(readFile(t, p, fmt.Sprintf("%s.stream.json", model)).Bytes(), &chunks); err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("stream", func(t *testing.T) {
+				content, deltas, complete, err := streamToolCalls(t, m, chunks)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if content != "" {
+					t.Errorf("content = %q; want none", content)
+				}
+
+				if diff := cmp.Diff(slices.Concat(complete...), calls); diff != "" {
+					t.Errorf("calls mismatch (-got +want):\n%s", diff)
+				}
+
+				// the deltas of each call have its name and arguments, which
+				// are streamed in several chunks before the call is complete
+				names := make([]string, len(calls))
+				arguments := make([]string, len(calls))
+				var n int
+				for i, chunk := range deltas {
+					for _, d := range chunk {
+						if d.Name != "" && names[d.Index] != "" {
+							t.Errorf("chunk %d: name of call %d is repeated", i, d.Index)
+						}
+						names[d.Index] += d.Name
+						arguments[d.Index] += d.Arguments
+
+						if d.Arguments != "" {
+							n++
+						}
+					}
+				}
+
+				if n < 2*len(calls) {
+					t.Errorf("arguments are in %d deltas; want them streamed", n)
+				}
+
+				for i, call := range calls {
+					if names[i] != call.Function.Name {
+						t.Errorf("name of call %d = %q; want %q", i, names[i], call.Function.Name)
+					}
+
+					var args api.ToolCallFunctionArguments
+					if err := json.Unmarshal([]byte(arguments[i]), &args); err != nil {
+						t.Fatalf("arguments of call %d %q: %v", i, arguments[i], err)
+					}
+
+					if diff := cmp.Diff(args, call.Function.Arguments); diff != "" {
+						t.Errorf("arguments of call %d mismatch (-got +want):\n%s", i, diff)
+					}
+				}
+			})
+
+			t.Run("content", func(t *testing.T) {
+				// content around the tool calls is streamed as it's generated
+				content, _, complete, err := streamToolCalls(t, m, slices.Concat(
+					[]string{"Let me", " check", " the weather.\n"},
+					chunks,
+					[]string{"\n\n", "Checking", " now."},
+				))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the whitespace around tool calls depends on the template
+				if want := "Let me check the weather. Checking now."; strings.Join(strings.Fields(content), " ") != want {
+					t.Errorf("content = %q; want %q", content, want)
+				}
+
+				if diff := cmp.Diff(slices.Concat(complete...), calls); diff != "" {
+					t.Errorf("calls mismatch (-got +want):\n%s", diff)
+				}
+			})
+
+			t.Run("no tool calls", func(t *testing.T) {
+				chunks := []string{"The weather", " in San Francisco", " is 70°F", "."}
+				content, deltas, _, err := streamToolCalls(t, m, chunks)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if want := strings.Join(chunks, ""); content != want {
+					t.Errorf("content = %q; want %q", content, want)
+				}
+
+				if slices.ContainsFunc(deltas, func(d []api.ToolCallDelta) bool { return len(d) > 0 }) {
+					t.Errorf("deltas = %v; want none", deltas)
+				}
+			})
+
+			t.Run("truncated", func(t *testing.T) {
+				// the response ends in the arguments of the second call
+				i := slices.IndexFunc(chunks, func(s string) bool { return strings.Contains(s, "Toronto") })
+				_, _, complete, err := streamToolCalls(t, m, chunks[:i])
+				if err == nil || !strings.Contains(err.Error(), "unexpected end") {
+					t.Errorf("err = %v; want unexpected end", err)
+				}
+
+				if diff := cmp.Diff(slices.Concat(complete...), calls[:1]); diff != "" {
+					t.Errorf("calls mismatch (-got +want):\n%s", diff)
+				}
+			})
+
+			t.Run("malformed", func(t *testing.T) {
+				chunks := slices.Clone(chunks)
+				i := slices.Index(chunks, "\":")
+				chunks[i] = "\";"
+
+				if _, _, _, err := streamToolCalls(t, m, chunks); err == nil || !strings.Contains(err.Error(), "invalid tool call") {
+					t.Errorf("err = %v; want invalid tool call", err)
+				}
+			})
+		})
+	}
+}
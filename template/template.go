@@ -168,6 +168,10 @@ type Values struct {
 	Prompt string
 	Suffix string
 
+	// Query and Document are a pair to be scored by a reranker
+	Query    string
+	Document string
+
 	// forceLegacy is a flag used to test compatibility with legacy templates
 	forceLegacy bool
 }
@@ -220,7 +224,13 @@ func (t *Template) Subtree(fn func(parse.Node) bool) *template.Template {
 
 func (t *Template) Execute(w io.Writer, v Values) error {
 	system, messages := collate(v.Messages)
-	if v.Prompt != "" && v.Suffix != "" {
+	if v.Query != "" || v.Document != "" {
+		return t.Template.Execute(w, map[string]any{
+			"Query":    v.Query,
+			"Document": v.Document,
+			"Response": "",
+		})
+	} else if v.Prompt != "" && v.Suffix != "" {
 		return t.Template.Execute(w, map[string]any{
 			"Prompt":   v.Prompt,
 			"Suffix":   v.Suffix,
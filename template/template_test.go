@@ -376,3 +376,42 @@ func TestExecuteWithSuffix(t *testing.T) {
 		})
 	}
 }
+
+func TestExecuteWithQueryDocument(t *testing.T) {
+	tmpl, err := Parse(`{{- if .Query }}<s>{{ .Query }}</s></s>{{ .Document }}</s>
+{{- else }}{{ .Prompt }}
+{{- end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vars := tmpl.Vars(); !slices.Contains(vars, "query") || !slices.Contains(vars, "document") {
+		t.Errorf("expected query and document in %v", vars)
+	}
+
+	cases := []struct {
+		name   string
+		values Values
+		expect string
+	}{
+		{
+			"message", Values{Messages: []api.Message{{Role: "user", Content: "hello"}}}, "hello",
+		},
+		{
+			"query document", Values{Query: "what is a panda?", Document: "The giant panda is a bear."}, "<s>what is a panda?</s></s>The giant panda is a bear.</s>",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, tt.values); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(b.String(), tt.expect); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}